@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// gcsScheme prefixes archive locations in a Cloud Storage bucket
+const gcsScheme = "gs://"
+
+// azureScheme prefixes archive locations in an Azure Blob Storage container
+const azureScheme = "az://"
+
+// openGCSStore returns the store of a gs://bucket/prefix location. Requests
+// are authorized with the access token in GOOGLE_OAUTH_ACCESS_TOKEN, such as
+// one printed by gcloud auth print-access-token, or with tokens of the service
+// account key file named by GOOGLE_APPLICATION_CREDENTIALS
+func openGCSStore(location string) (packer.BlockStore, error) {
+	bucket, prefix, err := splitBucket(location, gcsScheme)
+	if err != nil {
+		return nil, err
+	}
+	store := packer.GCSStore{Bucket: bucket, Prefix: prefix, Endpoint: os.Getenv("GCS_ENDPOINT_URL")}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		store.Token = func() (string, error) { return token, nil }
+		return store, nil
+	}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		return nil, fmt.Errorf("GOOGLE_OAUTH_ACCESS_TOKEN or GOOGLE_APPLICATION_CREDENTIALS must be set to use %s", location)
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if store.Token, err = packer.NewGCSTokenSource(key, nil); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// openAzureStore returns the store of an az://container/prefix location in
+// the storage account named by AZURE_STORAGE_ACCOUNT, authorized with its
+// AZURE_STORAGE_KEY or an AZURE_STORAGE_SAS_TOKEN
+func openAzureStore(location string) (packer.BlockStore, error) {
+	container, prefix, err := splitBucket(location, azureScheme)
+	if err != nil {
+		return nil, err
+	}
+	store := packer.AzureStore{
+		Account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		Key:       os.Getenv("AZURE_STORAGE_KEY"),
+		SAS:       os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+		Container: container,
+		Prefix:    prefix,
+		Endpoint:  os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT"),
+	}
+	if store.Account == "" || (store.Key == "" && store.SAS == "") {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN must be set to use %s", location)
+	}
+	return store, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the YAML configuration file given with --config
+type config struct {
+	Restore restoreConfig `yaml:"restore"`
+}
+
+// restoreConfig configures unpacking and restoring
+type restoreConfig struct {
+	Destinations []destinationConfig `yaml:"destinations"`
+}
+
+// destinationConfig limits writes below a destination path
+type destinationConfig struct {
+	Prefix     string `yaml:"prefix"`      // Destination path the limit applies to
+	WriteRate  string `yaml:"write_rate"`  // Bytes per second such as 50MB, empty for unlimited
+	MaxWriters int    `yaml:"max_writers"` // Files written at once, 0 for unlimited
+}
+
+// configFlag registers the flag naming the configuration file
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "", "read destination limits and other settings from this YAML file")
+}
+
+// loadConfig reads the configuration file and applies it to opts, an empty
+// path leaves opts unchanged
+func loadConfig(path string, opts *packer.PackerOptions) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	var cfg config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	for _, dest := range cfg.Restore.Destinations {
+		if dest.Prefix == "" {
+			return fmt.Errorf("destination limit in %s has no prefix", path)
+		}
+		limit := packer.DestinationLimit{Prefix: dest.Prefix, MaxWriters: dest.MaxWriters}
+		if dest.WriteRate != "" {
+			limit.BytesPerSecond, err = parseByteSize(dest.WriteRate)
+			if err != nil {
+				return fmt.Errorf("invalid write rate for %s: %w", dest.Prefix, err)
+			}
+		}
+		opts.DestinationLimits = append(opts.DestinationLimits, limit)
+	}
+	return nil
+}
+
+// tagsFile is the YAML sidecar file of tags given with pack --tags
+type tagsFile struct {
+	Archive map[string]string `yaml:"archive"` // Tags of the archive, recorded as labels
+	Files   []tagsRule        `yaml:"files"`   // Tags of the files matching each pattern
+}
+
+// tagsRule tags the archived files matching a pattern
+type tagsRule struct {
+	Pattern string            `yaml:"pattern"`
+	Tags    map[string]string `yaml:"tags"`
+}
+
+// loadTags reads the tags file and adds its tags to opts, an empty path
+// leaves opts unchanged
+func loadTags(path string, opts *packer.PackerOptions) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading tags file: %w", err)
+	}
+	var tags tagsFile
+	if err := yaml.UnmarshalStrict(data, &tags); err != nil {
+		return fmt.Errorf("error parsing tags file %s: %w", path, err)
+	}
+
+	for name, value := range tags.Archive {
+		if _, ok := opts.Labels[name]; !ok {
+			opts.Labels[name] = value
+		}
+	}
+	for _, rule := range tags.Files {
+		if rule.Pattern == "" {
+			return fmt.Errorf("file tags in %s have no pattern", path)
+		}
+		opts.Tags = append(opts.Tags, packer.TagRule{Pattern: rule.Pattern, Tags: rule.Tags})
+	}
+	return nil
+}
+
+// byteUnits are the size suffixes accepted by parseByteSize, longest first
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"MB", 1000 * 1000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as 512KB or 50MB, a plain number is bytes
+func parseByteSize(s string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(s))
+	size := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			size = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * size, nil
+}
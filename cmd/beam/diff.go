@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// diffJSON is the JSON form of a diff
+type diffJSON struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Modified  []string `json:"modified"`
+	Unchanged int      `json:"unchanged"`
+}
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the differences as JSON")
+	dirs, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	diff, err := newPacker(packer.PackerOptions{}).Diff(dirs[0], dirs[1])
+	if err != nil {
+		return err
+	}
+	if !*asJSON {
+		printDiff(diff)
+		return nil
+	}
+	return writeJSON(diffJSON{
+		Added:     nonNil(diff.Added),
+		Removed:   nonNil(diff.Removed),
+		Modified:  nonNil(diff.Modified),
+		Unchanged: diff.Unchanged,
+	})
+}
+
+// printDiff prints the differences in a form similar to a file list diff
+func printDiff(diff *packer.DiffResult) {
+	for _, path := range diff.Removed {
+		fmt.Printf("- %s\n", path)
+	}
+	for _, path := range diff.Added {
+		fmt.Printf("+ %s\n", path)
+	}
+	for _, path := range diff.Modified {
+		fmt.Printf("M %s\n", path)
+	}
+	fmt.Printf("%d added, %d removed, %d modified, %d unchanged\n",
+		len(diff.Added), len(diff.Removed), len(diff.Modified), diff.Unchanged)
+}
+
+func runFingerprint(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, err := newPacker(packer.PackerOptions{}).Fingerprint(dirs[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(fingerprint)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// mergePlanJSON is the JSON form of an unpack dry run
+type mergePlanJSON struct {
+	New              []string `json:"new"`
+	Overwrite        []string `json:"overwrite"`
+	Extraneous       []string `json:"extraneous"`
+	DeleteExtraneous bool     `json:"delete_extraneous"`
+	OverwrittenBytes int64    `json:"overwritten_bytes"`
+	ExtractedBytes   int64    `json:"extracted_bytes"`
+	ReclaimedBytes   int64    `json:"reclaimed_bytes"`
+}
+
+// reconstructPlanJSON is the JSON form of a reconstruct dry run
+type reconstructPlanJSON struct {
+	Blocks        []int32  `json:"blocks"`
+	Parity        []string `json:"parity"`
+	BytesWritten  int64    `json:"bytes_written"`
+	Unrecoverable []int32  `json:"unrecoverable_groups"`
+}
+
+// gcJSON is the JSON form of a gc result
+type gcJSON struct {
+	DryRun         bool     `json:"dry_run"`
+	Removed        []string `json:"removed_blocks"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// compactJSON is the JSON form of a compact result
+type compactJSON struct {
+	DryRun         bool     `json:"dry_run"`
+	Rewritten      []string `json:"rewritten_blocks"`
+	Removed        []string `json:"removed_blocks"`
+	Written        []string `json:"written_blocks"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+func newCompactJSON(result *packer.CompactResult, dryRun bool) compactJSON {
+	return compactJSON{
+		DryRun:         dryRun,
+		Rewritten:      nonNil(result.Rewritten),
+		Removed:        nonNil(result.Removed),
+		Written:        nonNil(result.Written),
+		ReclaimedBytes: result.ReclaimedBytes,
+	}
+}
+
+// removeJSON is the JSON form of a remove result
+type removeJSON struct {
+	DryRun          bool         `json:"dry_run"`
+	Deleted         []string     `json:"deleted"`
+	SnapshotEntries int          `json:"snapshot_entries"`
+	Compact         *compactJSON `json:"compact,omitempty"`
+}
+
+// syncJSON is the JSON form of a sync result
+type syncJSON struct {
+	DryRun        bool     `json:"dry_run"`
+	Uploaded      []string `json:"uploaded"`
+	UploadedBytes int64    `json:"uploaded_bytes"`
+	Unchanged     int      `json:"unchanged_blocks"`
+	Deleted       []string `json:"deleted"`
+}
+
+// printMergePlan lists every decision of the merge plan for an output directory
+func printMergePlan(p packer.Packer, archiveDir string, outputDir string, include []string, deleteExtraneous bool, asJSON bool) error {
+	plan, err := p.PlanMerge(archiveDir, outputDir, include...)
+	if err != nil {
+		return err
+	}
+
+	var reclaimed int64
+	if deleteExtraneous {
+		reclaimed = plan.ExtraneousBytes
+	}
+
+	if asJSON {
+		return writeJSON(mergePlanJSON{
+			New:              nonNil(plan.New),
+			Overwrite:        nonNil(plan.Overwrite),
+			Extraneous:       nonNil(plan.Extraneous),
+			DeleteExtraneous: deleteExtraneous,
+			OverwrittenBytes: plan.OverwrittenBytes,
+			ExtractedBytes:   plan.ExtractedBytes,
+			ReclaimedBytes:   reclaimed,
+		})
+	}
+
+	extraneousAction, extraneousDone := "keep", "kept"
+	if deleteExtraneous {
+		extraneousAction, extraneousDone = "delete", "deleted"
+	}
+	for _, path := range plan.New {
+		fmt.Printf("new        %s\n", path)
+	}
+	for _, path := range plan.Overwrite {
+		fmt.Printf("overwrite  %s\n", path)
+	}
+	for _, path := range plan.Extraneous {
+		fmt.Printf("%-10s %s\n", extraneousAction, path)
+	}
+	fmt.Printf("Merge plan: %d new, %d overwritten, %d extraneous files %s\n",
+		len(plan.New), len(plan.Overwrite), len(plan.Extraneous), extraneousDone)
+	fmt.Printf("%d bytes extracted, %d bytes overwritten, %d bytes reclaimed\n", plan.ExtractedBytes, plan.OverwrittenBytes, reclaimed)
+	return nil
+}
+
+// printReconstructPlan lists the blocks and parity files reconstruct would rewrite
+func printReconstructPlan(p packer.Packer, archiveDir string, asJSON bool) error {
+	plan, err := p.PlanReconstruct(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return writeJSON(reconstructPlanJSON{
+			Blocks:        nonNil(plan.Blocks),
+			Parity:        nonNil(plan.Parity),
+			BytesWritten:  plan.Bytes,
+			Unrecoverable: nonNil(plan.Unrecoverable),
+		})
+	}
+
+	for _, id := range plan.Blocks {
+		fmt.Printf("rebuild    block %d\n", id)
+	}
+	for _, name := range plan.Parity {
+		fmt.Printf("rewrite    %s\n", name)
+	}
+	for _, groupID := range plan.Unrecoverable {
+		fmt.Printf("fail       parity group %d\n", groupID)
+	}
+	fmt.Printf("Reconstruct plan: %d blocks rebuilt, %d parity files rewritten, %d bytes written, %d groups unrecoverable\n",
+		len(plan.Blocks), len(plan.Parity), plan.Bytes, len(plan.Unrecoverable))
+	return nil
+}
+
+// writeJSON prints v as indented JSON to stdout
+func writeJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// nonNil returns an empty slice instead of nil so JSON lists are never null
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// listEntry is the JSON form of an archived file
+type listEntry struct {
+	Path      string            `json:"path"`
+	Size      int64             `json:"size"`
+	Mode      string            `json:"mode"`
+	ModTime   time.Time         `json:"mod_time"`
+	BirthTime *time.Time        `json:"birth_time,omitempty"`
+	Uid       uint32            `json:"uid"`
+	Gid       uint32            `json:"gid"`
+	BlockID   int32             `json:"block_id"`
+	Checksum  string            `json:"checksum"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the listing as JSON")
+	info := fs.Bool("info", false, "print when and where the archive was created, its labels, comment and fingerprint instead of its files")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *info {
+		return printInfo(dirs[0], *asJSON)
+	}
+
+	files, err := newPacker(packer.PackerOptions{}).List(dirs[0])
+	if err != nil {
+		return err
+	}
+	return printFiles(files, *asJSON)
+}
+
+// infoJSON is the JSON form of the archive info
+type infoJSON struct {
+	*packer.ArchiveInfo
+	Fingerprint string `json:"fingerprint"`
+}
+
+// printInfo prints the archive info recorded in the manifest of an archive,
+// along with its fingerprint
+func printInfo(archiveDir string, asJSON bool) error {
+	p := newPacker(packer.PackerOptions{})
+	info, err := p.Info(archiveDir)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := p.Fingerprint(archiveDir)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return writeJSON(infoJSON{ArchiveInfo: info, Fingerprint: fingerprint})
+	}
+
+	fmt.Printf("Created:     %s\n", info.Created.Local().Format(time.DateTime))
+	fmt.Printf("Modified:    %s\n", info.Modified.Local().Format(time.DateTime))
+	fmt.Printf("Tool:        %s\n", info.Tool)
+	if info.Hostname != "" {
+		fmt.Printf("Hostname:    %s\n", info.Hostname)
+	}
+	names := make([]string, 0, len(info.Labels))
+	for name := range info.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("Label:       %s=%s\n", name, info.Labels[name])
+	}
+	if info.Comment != "" {
+		fmt.Printf("Comment:     %s\n", info.Comment)
+	}
+	if info.Expires != nil {
+		fmt.Printf("Expires:     %s\n", info.Expires.Local().Format(time.DateTime))
+	}
+	fmt.Printf("Fingerprint: %s\n", fingerprint)
+	return nil
+}
+
+func runFind(args []string) error {
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	var query packer.Query
+	fs.Var((*stringList)(&query.Patterns), "name", "match archived paths against this glob pattern (repeatable)")
+	sizeFlag(fs, &query.MinSize, "min-size", "match files of at least this size, such as 10MB")
+	sizeFlag(fs, &query.MaxSize, "max-size", "match files of at most this size, such as 10MB")
+	timeFlag(fs, &query.ModifiedAfter, "newer", "match files modified at or after this time, a date, RFC 3339 time or duration ago such as 24h")
+	timeFlag(fs, &query.ModifiedBefore, "older", "match files modified before this time, a date, RFC 3339 time or duration ago such as 24h")
+	query.Tags = map[string]string{}
+	fs.Func("tag", "match files tagged NAME, or NAME=VALUE with that value (repeatable)", func(s string) error {
+		name, value, _ := strings.Cut(s, "=")
+		if name == "" {
+			return fmt.Errorf("tag %q has no name", s)
+		}
+		query.Tags[name] = value
+		return nil
+	})
+	asJSON := fs.Bool("json", false, "print the matching files as JSON")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	files, err := newPacker(packer.PackerOptions{}).Find(dirs[0], query)
+	if err != nil {
+		return err
+	}
+	return printFiles(files, *asJSON)
+}
+
+// sizeFlag registers a flag taking a size such as 512KB or 50MB
+func sizeFlag(fs *flag.FlagSet, size *int64, name string, usage string) {
+	fs.Func(name, usage, func(s string) (err error) {
+		*size, err = parseByteSize(s)
+		return err
+	})
+}
+
+// timeFlag registers a flag taking a point in time, as a date, a date and
+// time in RFC 3339 or the local time zone, or a duration before now
+func timeFlag(fs *flag.FlagSet, t *time.Time, name string, usage string) {
+	fs.Func(name, usage, func(s string) error {
+		if d, err := time.ParseDuration(s); err == nil {
+			*t = time.Now().Add(-d)
+			return nil
+		}
+		if parsed, err := time.Parse(time.RFC3339, s); err == nil {
+			*t = parsed
+			return nil
+		}
+		for _, layout := range []string{time.DateTime, time.DateOnly} {
+			if parsed, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+				*t = parsed
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid time %q", s)
+	})
+}
+
+// printFiles prints archived files as a listing, or as JSON
+func printFiles(files []packer.FileMetadata, asJSON bool) error {
+	if !asJSON {
+		for _, file := range files {
+			fmt.Printf("%s %10d %s %s\n", os.FileMode(file.Mode), file.Size, file.ModTime.Format(time.DateTime), file.Path)
+		}
+		return nil
+	}
+
+	entries := make([]listEntry, 0, len(files))
+	for _, file := range files {
+		entry := listEntry{
+			Path:     file.Path,
+			Size:     file.Size,
+			Mode:     os.FileMode(file.Mode).String(),
+			ModTime:  file.ModTime.UTC(),
+			Uid:      file.Uid,
+			Gid:      file.Gid,
+			BlockID:  file.BlockID,
+			Checksum: hex.EncodeToString(file.Checksum),
+			Tags:     file.Tags,
+		}
+		if !file.BirthTime.IsZero() {
+			birthTime := file.BirthTime.UTC()
+			entry.BirthTime = &birthTime
+		}
+		entries = append(entries, entry)
+	}
+
+	return writeJSON(entries)
+}
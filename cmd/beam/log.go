@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logLevel is the lowest level of the messages printed, set by --verbose and --quiet
+var logLevel = new(slog.LevelVar)
+
+// logger prints the messages of the packer for every command
+var logger = slog.New(&textHandler{mu: new(sync.Mutex), level: logLevel})
+
+// logFlags registers the flags selecting which messages are printed
+func logFlags(fs *flag.FlagSet) {
+	fs.BoolFunc("verbose", "also print debug messages, such as every block written or extracted", func(string) error {
+		logLevel.Set(slog.LevelDebug)
+		return nil
+	})
+	fs.BoolFunc("quiet", "only print warnings and errors", func(string) error {
+		logLevel.Set(slog.LevelWarn)
+		return nil
+	})
+}
+
+// textHandler prints log records as human readable lines, the message
+// followed by its attributes with warnings and errors marked. Lines go to
+// whatever os.Stdout is when they are printed, so redirecting it as --json
+// does redirects them too
+type textHandler struct {
+	mu    *sync.Mutex
+	level slog.Leveler
+	attrs string // Attributes added with WithAttrs, already formatted
+	group string // Prefix of the keys of attributes added after WithGroup
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(r.Message)
+
+	attrs := h.attrs
+	r.Attrs(func(a slog.Attr) bool {
+		attrs += formatAttr(h.group, a)
+		return true
+	})
+	if attrs != "" {
+		b.WriteString(":")
+		b.WriteString(attrs)
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(os.Stdout, b.String())
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	for _, a := range attrs {
+		h2.attrs += formatAttr(h.group, a)
+	}
+	return &h2
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.group += name + "."
+	return &h2
+}
+
+// formatAttr formats an attribute as " key=value", quoting values that
+// contain spaces or quotes
+func formatAttr(group string, a slog.Attr) string {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return ""
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			group += a.Key + "."
+		}
+		var s string
+		for _, ga := range a.Value.Group() {
+			s += formatAttr(group, ga)
+		}
+		return s
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	return fmt.Sprintf(" %s%s=%s", group, a.Key, value)
+}
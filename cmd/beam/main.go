@@ -0,0 +1,893 @@
+// Command beam packs directories into .beam block archives and works with
+// existing archives.
+//
+// Usage:
+//
+//	beam pack [--normalize nfc|nfd] [--resume] [--continue-on-error] [--zero-runs] [--compress METHOD] [--dictionary] [--multi-buffer-hash] [--scan-command CMD] [--read-workers N] [--compact-metadata] [--cbor-metadata] [--read-mode MODE] [--sync POLICY] [--changed-files POLICY] [--special-files POLICY] [--freeze SNAPSHOT] [--follow-symlinks] [--one-file-system] [--max-depth N] [--block-size N] [--volume-size N] [--parity N] [--parity-group M] [--block-names SCHEME] [--block-prefix P] [--format beam|zip] [--label NAME=VALUE...] [--comment TEXT] [--tags FILE] [--expire-after DURATION] [--max-rate RATE] [--low-impact] [--sign-key KEY] [--progress-fd N] [--json] <input_dir> <archive_dir>
+//	beam pack --stream [--multi-buffer-hash] [--sync POLICY] [--changed-files POLICY] [--special-files POLICY] [--freeze SNAPSHOT] [--follow-symlinks] [--one-file-system] [--max-depth N] [--progress-fd N] <input_dir> <archive_file|->
+//	beam pack --stdin <name> <archive_dir>
+//	beam pack --root [PREFIX=]PATH [--root [PREFIX=]PATH...] [--continue-on-error] [--compress METHOD] [--follow-symlinks] [--max-depth N] [--block-size N] [--json] <archive_dir>
+//	beam pack --files-from FILE|- [--null] [--continue-on-error] [--compress METHOD] [--follow-symlinks] [--max-depth N] [--block-size N] [--json] <archive_dir>
+//	beam pack [--continue-on-error] [--block-names SCHEME] [--block-prefix P] [--mirror LOCATION...] [--min-replicas N] [--progress-fd N] <input_dir> s3|gs|az|sftp://...
+//	beam unpack [--normalize nfc|nfd] [--resume] [--continue-on-error] [--salvage] [--include <pattern>...] [--checksum HEX...] [--delete-extraneous] [--overwrite POLICY] [--atomic] [--no-space-check] [--plan|--dry-run] [--json] [--mmap] [--scan-command CMD] [--verify-workers N] [--sync POLICY] [--max-rate RATE] [--low-impact] [--progress-fd N] [--config FILE] <archive_dir> <output_dir>
+//	beam unpack --stream [--include <pattern>...] [--overwrite POLICY] [--atomic] [--sync POLICY] [--progress-fd N] <archive_file|-> <output_dir>
+//	beam unpack [--continue-on-error] [--include <pattern>...] [--progress-fd N] s3|gs|az|sftp://... <output_dir>
+//	beam unpack [--resume] [--continue-on-error] [--include <pattern>...] [--progress-fd N] https://host/archive <output_dir>
+//	beam verify [--json] [--report] [--since DURATION] [--public-key KEY] [--repair-from SOURCE_DIR] <archive_dir>
+//	beam keygen <private_key> <public_key>
+//	beam sign --key KEY <archive_dir>
+//	beam rekey <archive_dir>
+//	beam list [--json] [--info] <archive_dir>
+//	beam find [--name <pattern>...] [--min-size SIZE] [--max-size SIZE] [--newer TIME] [--older TIME] [--tag NAME[=VALUE]...] [--json] <archive_dir>
+//	beam mount [--allow-other] [--cache SIZE] <archive_dir> <mountpoint>
+//	beam diff [--json] <archive_or_dir> <archive_or_dir>
+//	beam fingerprint <archive_dir>
+//	beam sync [--delete-extraneous] [--dry-run] [--json] [--max-rate RATE] [--mirror LOCATION...] [--min-replicas N] <archive_dir> <s3|gs|az|sftp://...|dir>
+//	beam repair-replicas <s3|gs|az|sftp://...|dir> <s3|gs|az|sftp://...|dir>...
+//	beam snapshot [--continue-on-error] [--zero-runs] [--compress METHOD] [--dictionary] [--read-workers N] [--compact-metadata] [--cbor-metadata] [--read-mode MODE] [--sync POLICY] [--changed-files POLICY] [--special-files POLICY] [--freeze SNAPSHOT] [--follow-symlinks] [--one-file-system] [--max-depth N] [--block-size N] [--volume-size N] [--expire-after DURATION] [--max-rate RATE] [--low-impact] [--sign-key KEY] [--progress-fd N] <input_dir> <archive_dir>
+//	beam snapshot --list [--json] <archive_dir>
+//	beam snapshot --forget N <archive_dir>
+//	beam unpack --snapshot N [--resume] [--continue-on-error] [--include <pattern>...] <archive_dir> <output_dir>
+//	beam gc [--dry-run] [--json] <archive_dir>
+//	beam prune [--keep-last N] [--keep-daily N] [--keep-weekly N] [--keep-monthly N] [--dry-run [--json]] <archive_dir>
+//	beam compact [--block-size N] [--volume-size N] [--dry-run] [--json] <archive_dir>
+//	beam upgrade <archive_dir>
+//	beam remove [--compact] [--dry-run] [--json] <archive_dir> <pattern> [<pattern>...]
+//	beam rename <archive_dir> <old_path> <new_path>
+//	beam reconstruct [--dry-run [--json]] <archive_dir>
+//	beam restore --interactive [--config FILE] <archive_dir>
+//	beam subset [--block-size N] [--volume-size N] <archive_dir> <output_dir> --include <pattern> [--include <pattern>...]
+//	beam selftest [--size 1GB | --small-files N [--read-workers N] [--compact-metadata] [--cbor-metadata]] [--dir DIR] [--keep] [--verbose]
+//	beam spec [--output FILE]
+//	beam vectors [--check] <dir>
+//
+// The commands that write or extract archives also take --verbose to print
+// debug messages, such as every block written, and --quiet to print only
+// warnings and errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+const (
+	defaultBufferSize = 32 * 1024 // 32KB buffer size for copying, validation and checksum
+)
+
+// command is a beam subcommand
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"pack", "pack [--normalize nfc|nfd] [--resume] [--continue-on-error] [--zero-runs] [--compress METHOD] [--dictionary] [--multi-buffer-hash] [--scan-command CMD] [--read-workers N] [--compact-metadata] [--cbor-metadata] [--read-mode MODE] [--sync POLICY] [--changed-files POLICY] [--special-files POLICY] [--freeze SNAPSHOT] [--follow-symlinks] [--one-file-system] [--max-depth N] [--block-size N] [--volume-size N] [--parity N] [--parity-group M] [--block-names SCHEME] [--block-prefix P] [--format beam|zip] [--stream] [--stdin <name>] [--files-from FILE [--null]] [--root [PREFIX=]PATH...] [--label NAME=VALUE...] [--comment TEXT] [--tags FILE] [--expire-after DURATION] [--mirror LOCATION...] [--min-replicas N] [--max-rate RATE] [--low-impact] [--sign-key KEY] [--progress-fd N] [--json] <input_dir> <archive>", runPack},
+	{"unpack", "unpack [--normalize nfc|nfd] [--resume] [--continue-on-error] [--salvage] [--include <pattern>...] [--checksum HEX...] [--delete-extraneous] [--overwrite POLICY] [--atomic] [--no-space-check] [--plan|--dry-run] [--json] [--mmap] [--scan-command CMD] [--verify-workers N] [--sync POLICY] [--stream] [--snapshot N] [--max-rate RATE] [--low-impact] [--progress-fd N] [--config FILE] <archive> <output_dir>", runUnpack},
+	{"verify", "verify [--json] [--report] [--since DURATION] [--public-key KEY] [--repair-from SOURCE_DIR] <archive_dir>", runVerify},
+	{"keygen", "keygen <private_key> <public_key>", runKeygen},
+	{"sign", "sign --key KEY <archive_dir>", runSign},
+	{"rekey", "rekey <archive_dir>", runRekey},
+	{"list", "list [--json] [--info] <archive_dir>", runList},
+	{"find", "find [--name <pattern>...] [--min-size SIZE] [--max-size SIZE] [--newer TIME] [--older TIME] [--tag NAME[=VALUE]...] [--json] <archive_dir>", runFind},
+	{"mount", "mount [--allow-other] [--cache SIZE] <archive_dir> <mountpoint>", runMount},
+	{"diff", "diff [--json] <archive_or_dir> <archive_or_dir>", runDiff},
+	{"fingerprint", "fingerprint <archive_dir>", runFingerprint},
+	{"sync", "sync [--delete-extraneous] [--dry-run] [--json] [--max-rate RATE] [--mirror LOCATION...] [--min-replicas N] <archive_dir> <s3|gs|az|sftp://...|dir>", runSync},
+	{"repair-replicas", "repair-replicas <s3|gs|az|sftp://...|dir> <s3|gs|az|sftp://...|dir>...", runRepairReplicas},
+	{"snapshot", "snapshot [--continue-on-error] [--zero-runs] [--compress METHOD] [--dictionary] [--read-workers N] [--compact-metadata] [--cbor-metadata] [--read-mode MODE] [--sync POLICY] [--changed-files POLICY] [--special-files POLICY] [--freeze SNAPSHOT] [--follow-symlinks] [--one-file-system] [--max-depth N] [--block-size N] [--volume-size N] [--expire-after DURATION] [--max-rate RATE] [--low-impact] [--sign-key KEY] <input_dir> <archive_dir> | --list [--json] <archive_dir> | --forget N <archive_dir>", runSnapshot},
+	{"gc", "gc [--dry-run] [--json] <archive_dir>", runGC},
+	{"prune", "prune [--keep-last N] [--keep-daily N] [--keep-weekly N] [--keep-monthly N] [--dry-run [--json]] <archive_dir>", runPrune},
+	{"compact", "compact [--block-size N] [--volume-size N] [--dry-run] [--json] <archive_dir>", runCompact},
+	{"upgrade", "upgrade <archive_dir>", runUpgrade},
+	{"remove", "remove [--compact] [--dry-run] [--json] <archive_dir> <pattern>...", runRemove},
+	{"rename", "rename <archive_dir> <old_path> <new_path>", runRename},
+	{"reconstruct", "reconstruct [--dry-run [--json]] <archive_dir>", runReconstruct},
+	{"restore", "restore --interactive [--config FILE] <archive_dir>", runRestore},
+	{"subset", "subset [--block-size N] [--volume-size N] <archive_dir> <output_dir> --include <pattern>...", runSubset},
+	{"selftest", "selftest [--size 1GB | --small-files N [--read-workers N] [--compact-metadata] [--cbor-metadata]] [--dir DIR] [--keep] [--verbose]", runSelftest},
+	{"spec", "spec [--output FILE]", runSpec},
+	{"vectors", "vectors [--check] <dir>", runVectors},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	var err error
+	if metadataKey, err = metadataKeyFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if lockWait, err = lockWaitFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  beam %s\n", cmd.usage)
+	}
+}
+
+// newPacker creates a packer, filling in the defaults shared by every command
+func newPacker(opts packer.PackerOptions) packer.Packer {
+	opts.VerifyIntegrity = true
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = logger
+	}
+	if opts.MetadataKey == nil {
+		opts.MetadataKey = metadataKey
+	}
+	if opts.Passphrase == "" {
+		opts.Passphrase = os.Getenv(passphraseVar)
+	}
+	if opts.LockTimeout == 0 {
+		opts.LockTimeout = lockWait
+	}
+	return packer.NewPacker(opts)
+}
+
+// lockWaitVar names the environment variable holding how long commands wait
+// for an archive another command is using, such as 30s
+const lockWaitVar = "BEAM_LOCK_WAIT"
+
+// lockWait is the wait read from lockWaitVar, 0 fails at once when it is not set
+var lockWait time.Duration
+
+// lockWaitFromEnv reads the archive lock wait from the environment, which
+// applies to every command alike
+func lockWaitFromEnv() (time.Duration, error) {
+	s := os.Getenv(lockWaitVar)
+	if s == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(s)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("%s must hold a duration such as 30s or 5m", lockWaitVar)
+	}
+	return wait, nil
+}
+
+// preserveFlags registers the flags selecting which file attributes are
+// recorded when packing and restored when unpacking
+func preserveFlags(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.BoolVar(&opts.PreserveOwner, "owner", false, "preserve numeric file owner and group")
+	fs.BoolVar(&opts.PreserveXattrs, "xattrs", false, "preserve all extended attributes")
+	fs.BoolVar(&opts.PreserveACLs, "acls", false, "preserve POSIX ACLs")
+	fs.BoolVar(&opts.PreserveSecurityLabels, "security-labels", false, "preserve SELinux contexts and file capabilities")
+	fs.BoolVar(&opts.PreserveBirthTime, "birth-time", false, "preserve file creation times where the platform supports them")
+}
+
+// normalizeFlag registers the flag selecting the Unicode normalization of
+// archived and extracted paths
+func normalizeFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("normalize", "normalize paths to Unicode form nfc or nfd, e.g. nfc for names written on macOS", func(s string) error {
+		switch s {
+		case "nfc":
+			opts.PathNormalization = packer.PathNormalizationNFC
+		case "nfd":
+			opts.PathNormalization = packer.PathNormalizationNFD
+		case "none":
+			opts.PathNormalization = packer.PathNormalizationNone
+		default:
+			return fmt.Errorf("unknown normalization form %q", s)
+		}
+		return nil
+	})
+}
+
+// sourceReadFlag registers the flag selecting how source files are read
+// when packing
+func sourceReadFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("read-mode", "read source files buffered, sequential with readahead hints or direct with O_DIRECT (Linux)", func(s string) error {
+		switch s {
+		case "buffered":
+			opts.SourceRead = packer.SourceReadBuffered
+		case "sequential":
+			opts.SourceRead = packer.SourceReadSequential
+		case "direct":
+			opts.SourceRead = packer.SourceReadDirect
+		default:
+			return fmt.Errorf("unknown read mode %q", s)
+		}
+		return nil
+	})
+}
+
+// syncFlag registers the flag selecting when written files are flushed to disk
+func syncFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("sync", "flush written files to disk: none, final at the end, block after every block or file after every file", func(s string) error {
+		switch s {
+		case "none":
+			opts.SyncPolicy = packer.SyncNone
+		case "final":
+			opts.SyncPolicy = packer.SyncFinal
+		case "block":
+			opts.SyncPolicy = packer.SyncPerBlock
+		case "file":
+			opts.SyncPolicy = packer.SyncPerFile
+		default:
+			return fmt.Errorf("unknown sync policy %q", s)
+		}
+		return nil
+	})
+}
+
+// changedFilesFlag registers the flag choosing what packing does with files
+// that change while they are read
+func changedFilesFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("changed-files", "what to do with files that change while they are packed: warn, retry, skip or fail", func(s string) error {
+		switch s {
+		case "warn":
+			opts.ChangedFiles = packer.ChangedFileWarn
+		case "retry":
+			opts.ChangedFiles = packer.ChangedFileRetry
+		case "skip":
+			opts.ChangedFiles = packer.ChangedFileSkip
+		case "fail":
+			opts.ChangedFiles = packer.ChangedFileFail
+		default:
+			return fmt.Errorf("unknown changed file policy %q", s)
+		}
+		return nil
+	})
+}
+
+// specialFilesFlag registers the flag choosing what packing does with named
+// pipes, sockets and device nodes
+func specialFilesFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("special-files", "what to do with named pipes, sockets and device nodes: skip, record or fail", func(s string) error {
+		switch s {
+		case "skip":
+			opts.SpecialFiles = packer.SpecialFileSkip
+		case "record":
+			opts.SpecialFiles = packer.SpecialFileRecord
+		case "fail":
+			opts.SpecialFiles = packer.SpecialFileFail
+		default:
+			return fmt.Errorf("unknown special file policy %q", s)
+		}
+		return nil
+	})
+}
+
+// overwritePolicy parses the name of an overwrite policy
+func overwritePolicy(s string) (packer.OverwritePolicy, error) {
+	switch s {
+	case "overwrite":
+		return packer.OverwriteAlways, nil
+	case "error":
+		return packer.OverwriteNever, nil
+	case "skip":
+		return packer.OverwriteSkip, nil
+	case "overwrite-if-newer":
+		return packer.OverwriteIfNewer, nil
+	case "keep-both":
+		return packer.OverwriteKeepBoth, nil
+	}
+	return 0, fmt.Errorf("unknown overwrite policy %q", s)
+}
+
+// overwriteFlag registers the flag choosing what unpacking does with files
+// that already exist
+func overwriteFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("overwrite", "what to do with existing files: overwrite, error, skip, overwrite-if-newer or keep-both", func(s string) (err error) {
+		opts.Overwrite, err = overwritePolicy(s)
+		return err
+	})
+}
+
+// compressFlag registers the flags choosing how file contents are compressed
+func compressFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("compress", "compress file contents that are not compressed already: deflate, zstd or none, only this version reads them", func(s string) error {
+		switch s {
+		case "deflate":
+			opts.Compression = packer.CompressionDeflate
+		case "zstd":
+			opts.Compression = packer.CompressionZstd
+		case "none":
+			opts.Compression = packer.CompressionNone
+		default:
+			return fmt.Errorf("unknown compression method %q", s)
+		}
+		return nil
+	})
+	fs.BoolVar(&opts.TrainDictionary, "dictionary", false, "with --compress zstd, train a dictionary on the small files and keep it in the manifest")
+}
+
+// freezeFlag registers the flag freezing the input directory in a filesystem
+// snapshot before it is packed
+func freezeFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("freeze", "pack from a filesystem snapshot: btrfs:SUBVOLUME, zfs:DATASET, lvm:VG/LV or vss[:VOLUME]", func(s string) error {
+		kind, target, _ := strings.Cut(s, ":")
+		switch {
+		case kind == "btrfs" && target != "":
+			opts.SourceSnapshot = packer.BtrfsSnapshotter{Subvolume: target}
+		case kind == "zfs" && target != "":
+			opts.SourceSnapshot = packer.ZFSSnapshotter{Dataset: target}
+		case kind == "lvm" && target != "":
+			opts.SourceSnapshot = packer.LVMSnapshotter{Volume: target}
+		case kind == "vss":
+			opts.SourceSnapshot = packer.VSSSnapshotter{Volume: target}
+		default:
+			return fmt.Errorf("unknown snapshot %q", s)
+		}
+		return nil
+	})
+}
+
+// walkFlags registers the flags choosing which directories packing walks
+func walkFlags(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.BoolVar(&opts.FollowSymlinks, "follow-symlinks", false, "descend into symlinked directories, skipping links that loop")
+	fs.BoolVar(&opts.OneFileSystem, "one-file-system", false, "do not descend into directories on other file systems")
+	fs.IntVar(&opts.MaxDepth, "max-depth", 0, "pack at most this many directory levels, 1 packs only the files of the input directory, 0 for all")
+}
+
+// bufferFlag registers the flag setting the size of the copy buffers
+func bufferFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.IntVar(&opts.BufferSize, "buffer-size", defaultBufferSize, "size in bytes of the buffers used to copy file contents")
+}
+
+// smallFileFlags registers the flags speeding up packing many small files
+func smallFileFlags(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.IntVar(&opts.ReadWorkers, "read-workers", 0, "number of workers reading small files ahead, 0 reads each file as it is packed")
+	fs.BoolVar(&opts.CompactMetadata, "compact-metadata", false, "write file metadata as varints, only this version reads it")
+	fs.BoolVar(&opts.CBORMetadata, "cbor-metadata", false, "write file metadata as CBOR maps that other languages can read")
+}
+
+// impactFlags registers the flags limiting the load an operation puts on the
+// machine
+func impactFlags(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	maxRateFlag(fs, opts)
+	fs.BoolVar(&opts.LowImpact, "low-impact", false, "use one worker, idle CPU and I/O priority and pauses between files, for busy servers")
+}
+
+// maxRateFlag registers the flag capping the rate of reads and writes
+func maxRateFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("max-rate", "read and write at most this many bytes per second combined, such as 50MB, shared by every worker", func(s string) error {
+		rate, err := parseByteSize(s)
+		opts.MaxBytesPerSecond = rate
+		return err
+	})
+}
+
+// scanFlag registers the flag scanning files with an external command in the
+// given phase, clamdscan - or any command reading the contents from stdin
+func scanFlag(fs *flag.FlagSet, opts *packer.PackerOptions, phase packer.ScanPhase) {
+	fs.Func("scan-command", "scan every file with this command, given the contents on stdin, exit status 1 rejects a file as ClamAV does", func(s string) error {
+		command := strings.Fields(s)
+		if len(command) == 0 {
+			return fmt.Errorf("empty scan command")
+		}
+		opts.Scanner, opts.ScanPhase = packer.CommandScanner{Command: command}, phase
+		return nil
+	})
+}
+
+// blockSizeFlag registers the flags setting the size of the blocks written
+// and of the volume files they are split into
+func blockSizeFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Int64Var(&opts.BlockSize, "block-size", 0, "size in bytes of the blocks written, 0 chooses one from the sizes of the files")
+	fs.Func("volume-size", "split block files larger than this, such as 4000MB, into .beam.001, .beam.002, ... volumes", func(s string) error {
+		size, err := parseByteSize(s)
+		opts.VolumeSize = size
+		return err
+	})
+}
+
+// progressFlag registers the flag selecting the file descriptor that receives
+// progress events
+func progressFlag(fs *flag.FlagSet) *int {
+	return fs.Int("progress-fd", 0, "write newline delimited JSON progress events to this file descriptor")
+}
+
+// openProgress opens the progress file descriptor, 0 disables progress events
+func openProgress(fd int, opts *packer.PackerOptions) error {
+	if fd == 0 {
+		return nil
+	}
+	f := os.NewFile(uintptr(fd), "progress")
+	if f == nil {
+		return fmt.Errorf("invalid progress file descriptor %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("progress file descriptor %d is not open: %w", fd, err)
+	}
+	opts.Progress = f
+	return nil
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and checks the number of positional arguments
+func parseArgs(fs *flag.FlagSet, args []string, positional int) ([]string, error) {
+	rest, err := parseFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != positional {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", fs.Name(), positional, len(rest))
+	}
+	return rest, nil
+}
+
+// parseFlags parses flags that may appear anywhere and returns the positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return rest, nil
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// stringList is a flag that can be repeated to collect several values
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// rootList collects the repeatable --root flag, PREFIX=PATH or a bare PATH
+// packed under its base name
+type rootList []packer.Root
+
+func (r *rootList) String() string {
+	var roots []string
+	for _, root := range *r {
+		roots = append(roots, root.Prefix+"="+root.Path)
+	}
+	return strings.Join(roots, ",")
+}
+
+func (r *rootList) Set(value string) error {
+	prefix, path, ok := strings.Cut(value, "=")
+	if !ok {
+		prefix, path = "", value
+	}
+	if path == "" {
+		return fmt.Errorf("no path in root %q", value)
+	}
+	*r = append(*r, packer.Root{Path: path, Prefix: prefix})
+	return nil
+}
+
+// labelMap collects the repeatable --label flag, NAME=VALUE
+type labelMap map[string]string
+
+func (l labelMap) String() string {
+	var labels []string
+	for name, value := range l {
+		labels = append(labels, name+"="+value)
+	}
+	return strings.Join(labels, ",")
+}
+
+func (l labelMap) Set(value string) error {
+	name, text, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("label %q is not NAME=VALUE", value)
+	}
+	l[name] = text
+	return nil
+}
+
+func runPack(args []string) error {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	preserveFlags(fs, &opts)
+	normalizeFlag(fs, &opts)
+	fs.BoolVar(&opts.Resume, "resume", false, "resume an interrupted pack using the journal in the archive directory")
+	fs.IntVar(&opts.ParityBlocks, "parity", 0, "number of Reed-Solomon parity blocks per parity group")
+	fs.IntVar(&opts.ParityGroupSize, "parity-group", 10, "number of data blocks per parity group")
+	fs.BoolVar(&opts.ContinueOnError, "continue-on-error", false, "skip files that cannot be read and report them at the end")
+	fs.BoolVar(&opts.ZeroRunEncoding, "zero-runs", false, "leave runs of 4KB or more zeros out of the blocks, only this version reads them")
+	compressFlag(fs, &opts)
+	fs.BoolVar(&opts.MultiBufferHashing, "multi-buffer-hash", false, "hash parity groups and stream blocks in AVX-512 lanes where the CPU has them")
+	scanFlag(fs, &opts, packer.ScanPack)
+	smallFileFlags(fs, &opts)
+	sourceReadFlag(fs, &opts)
+	syncFlag(fs, &opts)
+	changedFilesFlag(fs, &opts)
+	specialFilesFlag(fs, &opts)
+	freezeFlag(fs, &opts)
+	walkFlags(fs, &opts)
+	stream := fs.Bool("stream", false, "write a single stream archive to a file, or stdout for -")
+	stdinName := fs.String("stdin", "", "pack stdin as a single file with this archived path")
+	filesFrom := fs.String("files-from", "", "pack the files and directories listed in this file, - for stdin, instead of an input directory")
+	null := fs.Bool("null", false, "the --files-from list is NUL terminated, as find -print0 writes it")
+	var roots rootList
+	fs.Var(&roots, "root", "pack this directory or file under PREFIX, its base name without one, instead of an input directory (repeatable)")
+	opts.Labels = labelMap{}
+	fs.Var(labelMap(opts.Labels), "label", "record this NAME=VALUE label in the archive info of the manifest (repeatable)")
+	fs.StringVar(&opts.Comment, "comment", "", "record this comment in the archive info of the manifest")
+	tagsPath := fs.String("tags", "", "record the archive and file tags of this YAML file in the manifest")
+	mirror := mirrorFlags(fs)
+	fs.DurationVar(&opts.ExpiresAfter, "expire-after", 0, "record that the archive expires this long after it is packed, such as 720h")
+	blockNames := fs.String("block-names", "sequence", "block file naming scheme: sequence, hash, timestamp or ulid")
+	blockPrefix := fs.String("block-prefix", "", "text prepended to every block file name")
+	format := fs.String("format", "beam", "volume format: beam, or zip for archives any zip tool can open")
+	asJSON := fs.Bool("json", false, "print the packed files and written blocks as JSON")
+	blockSizeFlag(fs, &opts)
+	impactFlags(fs, &opts)
+	signFlag(fs, &opts)
+	bufferFlag(fs, &opts)
+	progressFD := progressFlag(fs)
+	dirs, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	positional := 2
+	if *stdinName != "" || *filesFrom != "" || len(roots) > 0 {
+		positional = 1
+	}
+	if len(dirs) != positional {
+		return fmt.Errorf("pack expects %d arguments, got %d", positional, len(dirs))
+	}
+	if *filesFrom != "" && (*stdinName != "" || *stream) {
+		return fmt.Errorf("--files-from cannot be combined with --stdin or --stream")
+	}
+	if len(roots) > 0 && (*stdinName != "" || *filesFrom != "" || *stream) {
+		return fmt.Errorf("--root cannot be combined with --stdin, --files-from or --stream")
+	}
+	if len(mirror.locations) > 0 && (*stdinName != "" || *filesFrom != "" || len(roots) > 0 || *stream) {
+		return fmt.Errorf("--mirror cannot be combined with --stdin, --files-from, --root or --stream")
+	}
+	var list []string
+	if *filesFrom != "" {
+		if list, err = readFileList(*filesFrom, *null); err != nil {
+			return err
+		}
+	}
+	if err := openProgress(*progressFD, &opts); err != nil {
+		return err
+	}
+	if err := loadTags(*tagsPath, &opts); err != nil {
+		return err
+	}
+	if opts.BlockNamer, err = blockNamer(*blockNames, *blockPrefix); err != nil {
+		return err
+	}
+	if opts.Format, err = volumeFormat(*format); err != nil {
+		return err
+	}
+
+	if *asJSON && *stream && dirs[1] == "-" {
+		return fmt.Errorf("--json cannot be combined with a stream archive written to stdout")
+	}
+	if opts.SigningKey != nil && (*stream || opts.Format != packer.FormatBeam) {
+		return fmt.Errorf("--sign-key only signs beam archive directories, not streams or zip volumes")
+	}
+
+	return runReport("pack", dirs[len(dirs)-1], opts, *asJSON, func(p packer.Packer) error {
+		return pack(p, dirs, *stdinName, list, roots, *stream, mirror)
+	})
+}
+
+// readFileList reads the file list of --files-from, from stdin for -
+func readFileList(path string, null bool) ([]string, error) {
+	if path == "-" {
+		return packer.ReadFileList(os.Stdin, null)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return packer.ReadFileList(f, null)
+}
+
+// pack packs the input of the pack command into the archive it names
+func pack(p packer.Packer, dirs []string, stdinName string, list []string, roots rootList, stream bool, mirror *mirrorOptions) error {
+	if stdinName != "" {
+		source := packer.Source{Path: stdinName, Reader: os.Stdin, Size: -1}
+		return p.PackSources([]packer.Source{source}, dirs[0])
+	}
+	if list != nil {
+		return p.PackFiles(list, dirs[0])
+	}
+	if len(roots) > 0 {
+		return p.PackRoots(roots, dirs[0])
+	}
+
+	if !stream {
+		store, err := mirror.open(dirs[1])
+		if err != nil {
+			return err
+		}
+		if store != nil {
+			return p.PackToStore(dirs[0], store)
+		}
+		return p.Pack(dirs[0], dirs[1])
+	}
+
+	if dirs[1] == "-" {
+		// Keep progress messages out of the archive
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		return p.PackStream(dirs[0], stdout)
+	}
+
+	f, err := os.Create(dirs[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := p.PackStream(dirs[0], f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// blockNamer returns the block namer of a naming scheme, nil keeps the default names
+func blockNamer(scheme string, prefix string) (packer.BlockNamer, error) {
+	switch scheme {
+	case "sequence":
+		if prefix == "" {
+			return nil, nil
+		}
+		return packer.SequenceNamer{Prefix: prefix}, nil
+	case "hash":
+		return packer.ContentHashNamer{Prefix: prefix}, nil
+	case "timestamp":
+		return packer.TimestampNamer{Prefix: prefix, Time: time.Now()}, nil
+	case "ulid":
+		return packer.ULIDNamer{Prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unknown block naming scheme %q", scheme)
+}
+
+// volumeFormat returns the packer format of a --format value
+func volumeFormat(name string) (packer.Format, error) {
+	switch name {
+	case "beam":
+		return packer.FormatBeam, nil
+	case "zip":
+		return packer.FormatZip, nil
+	}
+	return 0, fmt.Errorf("unknown format %q", name)
+}
+
+func runUnpack(args []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	preserveFlags(fs, &opts)
+	normalizeFlag(fs, &opts)
+	fs.BoolVar(&opts.Resume, "resume", false, "skip files that were already extracted intact")
+	var include stringList
+	fs.Var(&include, "include", "only extract archived paths matching this glob pattern (repeatable)")
+	var checksums stringList
+	fs.Var(&checksums, "checksum", "only extract files whose SHA-256 checksum starts with these hex digits (repeatable)")
+	fs.BoolVar(&opts.DeleteExtraneous, "delete-extraneous", false, "delete files in the output directory that are not in the archive")
+	overwriteFlag(fs, &opts)
+	fs.BoolVar(&opts.AtomicUnpack, "atomic", false, "extract next to a new or empty output directory and rename it into place once complete")
+	fs.BoolVar(&opts.SkipSpaceCheck, "no-space-check", false, "extract without first checking the output filesystem has room for the files")
+	fs.BoolVar(&opts.ContinueOnError, "continue-on-error", false, "skip files and blocks that cannot be extracted and report them at the end")
+	fs.BoolVar(&opts.Salvage, "salvage", false, "extract the files of damaged blocks that still match their checksum and report the files lost")
+	planOnly := fs.Bool("plan", false, "print the merge plan for the output directory without extracting")
+	fs.BoolVar(planOnly, "dry-run", false, "same as --plan")
+	asJSON := fs.Bool("json", false, "print the extracted files and read blocks as JSON, or the plan with --plan or --dry-run")
+	stream := fs.Bool("stream", false, "read a single stream archive from a file, or stdin for -")
+	snapshot := fs.Int("snapshot", -1, "restore this snapshot generation, 0 for the latest")
+	fs.BoolVar(&opts.UseMmap, "mmap", false, "map block files into memory instead of reading them")
+	scanFlag(fs, &opts, packer.ScanUnpack)
+	fs.IntVar(&opts.VerifyWorkers, "verify-workers", 0, "number of workers verifying checksums while files are written, 0 verifies inline")
+	impactFlags(fs, &opts)
+	syncFlag(fs, &opts)
+	bufferFlag(fs, &opts)
+	progressFD := progressFlag(fs)
+	configPath := configFlag(fs)
+	dirs, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	if err := openProgress(*progressFD, &opts); err != nil {
+		return err
+	}
+	if err := loadConfig(*configPath, &opts); err != nil {
+		return err
+	}
+
+	if *planOnly {
+		return printMergePlan(newPacker(opts), dirs[0], dirs[1], include, opts.DeleteExtraneous, *asJSON)
+	}
+
+	return runReport("unpack", dirs[0], opts, *asJSON, func(p packer.Packer) error {
+		if len(checksums) > 0 {
+			if len(include) > 0 || *snapshot >= 0 || *stream || isURL(dirs[0]) || strings.HasPrefix(dirs[0], s3Scheme) {
+				return fmt.Errorf("--checksum only selects files of archive directories, without --include")
+			}
+			return p.ExtractByChecksum(dirs[0], dirs[1], checksums...)
+		}
+		return unpack(p, dirs, include, *snapshot, *stream)
+	})
+}
+
+// unpack extracts the archive named by the unpack command into the output directory
+func unpack(p packer.Packer, dirs []string, include []string, snapshot int, stream bool) error {
+	if snapshot >= 0 {
+		return p.RestoreSnapshot(dirs[0], snapshot, dirs[1], include...)
+	}
+	if !stream {
+		if isURL(dirs[0]) {
+			return p.UnpackFromURL(dirs[0], dirs[1], include...)
+		}
+		store, err := openStore(dirs[0])
+		if err != nil {
+			return err
+		}
+		if store != nil {
+			return p.UnpackFromStore(store, dirs[1], include...)
+		}
+		return p.Unpack(dirs[0], dirs[1], include...)
+	}
+
+	r := os.Stdin
+	if dirs[0] != "-" {
+		f, err := os.Open(dirs[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return p.UnpackStream(r, dirs[1], include...)
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var opts packer.PackerOptions
+	fs.Func("public-key", "fail unless the archive is signed by the Ed25519 public key in this PEM file", func(path string) error {
+		key, err := readPublicKey(path)
+		opts.TrustedKey = key
+		return err
+	})
+	asJSON := fs.Bool("json", false, "print the verified files and blocks as JSON")
+	withReport := fs.Bool("report", false, "save the status of every block and file next to the archive as verify-report.json")
+	since := fs.Duration("since", 0, "only verify blocks the saved report has not found intact within this long, such as 168h, implies --report")
+	repairFrom := fs.String("repair-from", "", "rebuild the blocks that fail validation from the files of this source directory")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *repairFrom != "" {
+		return repairArchive(dirs[0], *repairFrom, opts)
+	}
+	if *withReport || *since > 0 {
+		return verifyWithReport(dirs[0], opts, *since, *asJSON)
+	}
+	return runReport("verify", dirs[0], opts, *asJSON, func(p packer.Packer) error {
+		if err := p.Verify(dirs[0]); err != nil {
+			return err
+		}
+		if opts.TrustedKey != nil {
+			fmt.Println("Signature verified")
+		}
+		fmt.Println("All blocks verified successfully!")
+		return nil
+	})
+}
+
+// repairArchive rebuilds the damaged blocks of an archive from its source
+// directory, listing the blocks repaired and those that could not be
+func repairArchive(archive string, sourceDir string, opts packer.PackerOptions) error {
+	result, err := newPacker(opts).Repair(archive, sourceDir)
+	if result == nil {
+		return err
+	}
+	for _, name := range result.Repaired {
+		fmt.Printf("Repaired %s\n", name)
+	}
+	for _, name := range result.Unrepaired {
+		fmt.Printf("%s: damaged, not repaired\n", name)
+	}
+	if err == nil {
+		fmt.Printf("Repaired %d blocks, %d intact\n", len(result.Repaired), result.Intact)
+	}
+	return err
+}
+
+// verifyWithReport verifies an archive keeping a report next to it, listing
+// the blocks and files that failed or, with --json, printing the whole report
+func verifyWithReport(archive string, opts packer.PackerOptions, since time.Duration, asJSON bool) error {
+	p := newPacker(opts)
+	stdout := os.Stdout
+	if asJSON {
+		os.Stdout = os.Stderr
+	}
+	report, err := p.VerifyWithReport(archive, since)
+	os.Stdout = stdout
+	if report == nil {
+		return err
+	}
+
+	if asJSON {
+		if jsonErr := writeJSON(report); jsonErr != nil && err == nil {
+			return jsonErr
+		}
+		return err
+	}
+	for _, block := range report.Failed() {
+		fmt.Printf("%s: %s\n", block.Name, block.Status)
+		for _, file := range block.Files {
+			if file.Status != packer.VerifyOK {
+				fmt.Printf("  %s: %s\n", file.Path, file.Status)
+			}
+		}
+	}
+	if err == nil {
+		if opts.TrustedKey != nil {
+			fmt.Println("Signature verified")
+		}
+		fmt.Println("All blocks verified successfully!")
+	}
+	return err
+}
+
+func runReconstruct(args []string) error {
+	fs := flag.NewFlagSet("reconstruct", flag.ExitOnError)
+	logFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "print the blocks and parity files that would be rewritten without changing the archive")
+	asJSON := fs.Bool("json", false, "print the dry run as JSON")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return printReconstructPlan(newPacker(packer.PackerOptions{}), dirs[0], *asJSON)
+	}
+	return newPacker(packer.PackerOptions{}).Reconstruct(dirs[0])
+}
+
+func runSubset(args []string) error {
+	fs := flag.NewFlagSet("subset", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	var include stringList
+	fs.Var(&include, "include", "glob pattern of archived paths to keep, ** matches any number of directories (repeatable)")
+	blockSizeFlag(fs, &opts)
+	dirs, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return newPacker(opts).Subset(dirs[0], dirs[1], include)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+func runMount(args []string) error {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	logFlags(fs)
+	allowOther := fs.Bool("allow-other", false, "let other users read the mounted archive, needs user_allow_other in /etc/fuse.conf")
+	var cacheSize int64
+	sizeFlag(fs, &cacheSize, "cache", "keep up to SIZE of small files in memory, decompressed and verified, e.g. 256MB")
+	dirs, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	fsys, err := packer.OpenArchive(dirs[0])
+	if err != nil {
+		return err
+	}
+	if cacheSize > 0 {
+		fsys.SetCache(packer.NewBlockCache(cacheSize))
+	}
+	return mountArchive(fsys, dirs[0], dirs[1], *allowOther)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+func mountArchive(fsys *packer.ArchiveFS, archiveDir string, mountpoint string, allowOther bool) error {
+	return fmt.Errorf("mounting archives is not supported on %s", runtime.GOOS)
+}
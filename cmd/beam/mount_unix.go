@@ -0,0 +1,167 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// mountCacheTimeout is how long the kernel may cache names and attributes.
+// Nothing in a mounted archive changes, so it is as long as the mount lasts
+const mountCacheTimeout = 24 * time.Hour
+
+// mountArchive serves the archive as a read only FUSE filesystem at the
+// mountpoint until it is unmounted or the command is interrupted
+func mountArchive(fsys *packer.ArchiveFS, archiveDir string, mountpoint string, allowOther bool) error {
+	root := &mountDir{}
+	files := 0
+	dirs := map[string]*fs.Inode{".": &root.Inode}
+	server, err := fs.Mount(mountpoint, root, &fs.Options{
+		EntryTimeout:    durationPtr(mountCacheTimeout),
+		AttrTimeout:     durationPtr(mountCacheTimeout),
+		NegativeTimeout: durationPtr(mountCacheTimeout),
+		MountOptions: fuse.MountOptions{
+			AllowOther: allowOther,
+			FsName:     archiveDir,
+			Name:       "beam",
+			Options:    []string{"ro"},
+
+			// Mount directly when running as root, where fusermount may be
+			// missing, falling back to fusermount otherwise
+			DirectMount: true,
+		},
+		OnAdd: func(ctx context.Context) {
+			// The whole tree is built up front from the file index, so no
+			// lookup ever reads a block
+			iofs.WalkDir(fsys, ".", func(name string, entry iofs.DirEntry, err error) error {
+				if err != nil || name == "." {
+					return err
+				}
+				parent := dirs[path.Dir(name)]
+				if entry.IsDir() {
+					child := parent.NewPersistentInode(ctx, &mountDir{}, fs.StableAttr{Mode: fuse.S_IFDIR})
+					parent.AddChild(entry.Name(), child, true)
+					dirs[name] = child
+					return nil
+				}
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				file := &mountFile{fsys: fsys, name: name, metadata: info.Sys().(*packer.FileMetadata)}
+				parent.AddChild(entry.Name(), parent.NewPersistentInode(ctx, file, fs.StableAttr{Mode: fuse.S_IFREG}), true)
+				files++
+				return nil
+			})
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Mounted archive", "archive", archiveDir, "mountpoint", mountpoint, "files", files)
+
+	// Interrupting unmounts, which fails while files are still open, so it
+	// can be retried
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for range signals {
+			if err := server.Unmount(); err != nil {
+				logger.Warn("Could not unmount", "mountpoint", mountpoint, "error", err)
+			}
+		}
+	}()
+	server.Wait()
+	logger.Info("Unmounted archive", "mountpoint", mountpoint)
+	return nil
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+// mountDir is a directory of a mounted archive. Directories are implied by
+// the archived paths, so every one of them reads as read only and unowned
+type mountDir struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeGetattrer)((*mountDir)(nil))
+
+func (d *mountDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0555
+	out.Nlink = 1
+	return fs.OK
+}
+
+// mountFile is a file of a mounted archive
+type mountFile struct {
+	fs.Inode
+	fsys     *packer.ArchiveFS
+	name     string // Name within the ArchiveFS
+	metadata *packer.FileMetadata
+}
+
+var _ = (fs.NodeGetattrer)((*mountFile)(nil))
+var _ = (fs.NodeOpener)((*mountFile)(nil))
+
+func (f *mountFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFREG | uint32(iofs.FileMode(f.metadata.Mode).Perm()&^0222)
+	out.Nlink = 1
+	out.Size = uint64(f.metadata.Size)
+	out.Blocks = (out.Size + 511) / 512
+	out.Uid = f.metadata.Uid
+	out.Gid = f.metadata.Gid
+	out.SetTimes(nil, &f.metadata.ModTime, &f.metadata.ModTime)
+	return fs.OK
+}
+
+func (f *mountFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	file, err := f.fsys.Open(f.name)
+	if err != nil {
+		logger.Warn("Could not open archived file", "path", f.metadata.Path, "error", err)
+		return nil, 0, fs.ToErrno(err)
+	}
+	// The contents never change, so the kernel keeps them cached across opens
+	return &mountHandle{file: file, path: f.metadata.Path}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+// mountHandle is an open file of a mounted archive, read from its block at
+// the offsets the kernel asks for
+type mountHandle struct {
+	file iofs.File
+	path string
+}
+
+var _ = (fs.FileReader)((*mountHandle)(nil))
+var _ = (fs.FileReleaser)((*mountHandle)(nil))
+
+func (h *mountHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.file.(io.ReaderAt).ReadAt(dest, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		logger.Warn("Could not read archived file", "path", h.path, "error", err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+func (h *mountHandle) Release(ctx context.Context) syscall.Errno {
+	return fs.ToErrno(h.file.Close())
+}
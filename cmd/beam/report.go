@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// opReport is the JSON form of the result of pack, unpack and verify
+type opReport struct {
+	Op      string          `json:"op"`
+	Archive string          `json:"archive"`
+	Success bool            `json:"success"`
+	Error   string          `json:"error,omitempty"`
+	Stats   *packer.Stats   `json:"stats,omitempty"` // Totals of a pack or unpack
+	Files   []reportFile    `json:"files"`
+	Blocks  []reportBlock   `json:"blocks"`
+	Failed  []reportFailure `json:"failed"` // Files skipped with --continue-on-error
+}
+
+// reportFile is a file packed, extracted, skipped or verified
+type reportFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	BlockID  int32  `json:"block_id"`
+	Checksum string `json:"checksum,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"` // Already extracted intact, or reused from an earlier snapshot
+}
+
+// reportBlock is a block written, read or verified
+type reportBlock struct {
+	ID       int32  `json:"id"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size,omitempty"` // Bytes of file data in the block
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// reportFailure is a file that failed with --continue-on-error
+type reportFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// runReport runs an operation on an archive with a packer created from opts.
+// With asJSON the human readable output goes to stderr and a report built
+// from the progress events of the operation is printed to stdout once it
+// ends, whether it failed or not
+func runReport(op string, archive string, opts packer.PackerOptions, asJSON bool, run func(p packer.Packer) error) error {
+	if !asJSON {
+		return run(newPacker(opts))
+	}
+
+	report := &opReport{Op: op, Archive: archive}
+	collector := &reportCollector{report: report, next: opts.Progress, blocks: make(map[int32]int)}
+	opts.Progress = collector
+	p := newPacker(opts)
+
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	err := run(p)
+	os.Stdout = stdout
+
+	if stats := p.Stats(); stats.Op != "" {
+		report.Stats = &stats
+	} else if err == nil {
+		// Operations without progress events, such as verify, report the
+		// archived files instead
+		files, listErr := p.List(archive)
+		if listErr != nil {
+			return listErr
+		}
+		for _, file := range files {
+			event := packer.ProgressEvent{Event: "file", Path: file.Path, Size: file.Size, BlockID: file.BlockID,
+				Checksum: hex.EncodeToString(file.Checksum)}
+			collector.add(&event)
+		}
+	}
+	report.Success = err == nil
+	if err != nil {
+		report.Error = err.Error()
+		var partial *packer.PartialError
+		if errors.As(err, &partial) {
+			for _, failed := range partial.Failed {
+				report.Failed = append(report.Failed, reportFailure{Path: failed.Path, Error: failed.Err.Error()})
+			}
+		}
+	}
+	sort.Slice(report.Blocks, func(i, j int) bool { return report.Blocks[i].ID < report.Blocks[j].ID })
+	report.Files = nonNil(report.Files)
+	report.Blocks = nonNil(report.Blocks)
+	report.Failed = nonNil(report.Failed)
+	if jsonErr := writeJSON(report); jsonErr != nil && err == nil {
+		return jsonErr
+	}
+	return err
+}
+
+// reportCollector adds the files and blocks of progress events to a report,
+// passing the events on to the progress file descriptor when one is open
+type reportCollector struct {
+	report *opReport
+	next   io.Writer
+	buf    []byte
+	blocks map[int32]int // Index of each block in the report
+}
+
+func (c *reportCollector) Write(b []byte) (int, error) {
+	if c.next != nil {
+		c.next.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	for {
+		line, rest, ok := bytes.Cut(c.buf, []byte("\n"))
+		if !ok {
+			return len(b), nil
+		}
+		var event packer.ProgressEvent
+		if err := json.Unmarshal(line, &event); err == nil {
+			c.add(&event)
+		}
+		c.buf = rest
+	}
+}
+
+// add records a file or block event
+func (c *reportCollector) add(event *packer.ProgressEvent) {
+	switch event.Event {
+	case "file":
+		c.report.Files = append(c.report.Files, reportFile{
+			Path:     event.Path,
+			Size:     event.Size,
+			BlockID:  event.BlockID,
+			Checksum: event.Checksum,
+			Skipped:  event.Skipped,
+		})
+		if !event.Skipped {
+			c.block(event.BlockID).Files++
+		}
+	case "block":
+		block := c.block(event.BlockID)
+		block.Size = event.Size
+		block.Checksum = event.Checksum
+	}
+}
+
+// block returns the report entry of a block, adding it on first use
+func (c *reportCollector) block(id int32) *reportBlock {
+	i, ok := c.blocks[id]
+	if !ok {
+		i = len(c.report.Blocks)
+		c.blocks[id] = i
+		c.report.Blocks = append(c.report.Blocks, reportBlock{ID: id})
+	}
+	return &c.report.Blocks[i]
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	logFlags(fs)
+	interactive := fs.Bool("interactive", false, "walk through selecting files, destination and conflict handling")
+	var opts packer.PackerOptions
+	preserveFlags(fs, &opts)
+	normalizeFlag(fs, &opts)
+	configPath := configFlag(fs)
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if err := loadConfig(*configPath, &opts); err != nil {
+		return err
+	}
+	if !*interactive {
+		return fmt.Errorf("restore requires --interactive, use unpack for scripted restores")
+	}
+
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	return w.run(newPacker(opts), dirs[0], &opts)
+}
+
+// wizard prompts the user through an interactive restore
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (w *wizard) run(p packer.Packer, archiveDir string, opts *packer.PackerOptions) error {
+	files, err := p.List(archiveDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("archive %s contains no files", archiveDir)
+	}
+	fmt.Fprintf(w.out, "Archive %s holds %d files, %s\n", archiveDir, len(files), formatSize(totalSize(files)))
+
+	// Step 1: select paths
+	patterns, err := w.selectPaths(files)
+	if err != nil {
+		return err
+	}
+	selected := selectFiles(files, patterns)
+	if len(selected) == 0 {
+		return fmt.Errorf("nothing selected")
+	}
+
+	// Step 2: destination
+	dest, err := w.prompt("Restore to directory", "restore")
+	if err != nil {
+		return err
+	}
+
+	// Step 3: conflict handling when the destination already holds files
+	plan, err := p.PlanMerge(archiveDir, dest, patterns...)
+	if err != nil {
+		return err
+	}
+	if len(plan.Overwrite) > 0 || len(plan.Extraneous) > 0 {
+		fmt.Fprintf(w.out, "%s already holds files: %d are also in the archive, %d are not part of the archive\n",
+			dest, len(plan.Overwrite), len(plan.Extraneous))
+		for len(plan.Overwrite) > 0 {
+			answer, err := w.prompt("Existing files: overwrite, skip, overwrite-if-newer, keep-both or error", "overwrite")
+			if err != nil {
+				return err
+			}
+			if opts.Overwrite, err = overwritePolicy(answer); err == nil {
+				break
+			}
+			fmt.Fprintln(w.out, err)
+		}
+		if len(plan.Extraneous) > 0 {
+			answer, err := w.prompt("Delete files that are not part of the archive? [y/N]", "n")
+			if err != nil {
+				return err
+			}
+			opts.DeleteExtraneous = isYes(answer)
+		}
+	}
+
+	// Step 4: confirm the plan
+	fmt.Fprintln(w.out, "\nRestore plan:")
+	fmt.Fprintf(w.out, "  Files:        %d (%s)\n", len(selected), formatSize(totalSize(selected)))
+	fmt.Fprintf(w.out, "  Destination:  %s\n", dest)
+	fmt.Fprintf(w.out, "  New files:    %d\n", len(plan.New))
+	if opts.Overwrite == packer.OverwriteAlways {
+		fmt.Fprintf(w.out, "  Overwritten:  %d\n", len(plan.Overwrite))
+	} else {
+		fmt.Fprintf(w.out, "  Existing:     %d\n", len(plan.Overwrite))
+	}
+	if opts.DeleteExtraneous {
+		fmt.Fprintf(w.out, "  Deleted:      %d\n", len(plan.Extraneous))
+	}
+	answer, err := w.prompt("Proceed? [y/N]", "n")
+	if err != nil {
+		return err
+	}
+	if !isYes(answer) {
+		fmt.Fprintln(w.out, "Restore cancelled")
+		return nil
+	}
+
+	if err := newPacker(*opts).Unpack(archiveDir, dest, patterns...); err != nil {
+		return err
+	}
+	fmt.Fprintf(w.out, "Restored %d files to %s\n", len(selected), dest)
+	return nil
+}
+
+// selectPaths lets the user browse the archive as a directory tree and pick
+// files and directories, returning the glob patterns for the selection
+func (w *wizard) selectPaths(files []packer.FileMetadata) ([]string, error) {
+	selection := make(map[string]bool)
+	var cwd []string
+
+	fmt.Fprintln(w.out, "\nSelect files to restore. Commands:")
+	fmt.Fprintln(w.out, "  <n>  open directory n     ..   go up")
+	fmt.Fprintln(w.out, "  +<n> select entry n       -<n> deselect entry n")
+	fmt.Fprintln(w.out, "  +*   select everything here")
+	fmt.Fprintln(w.out, "  done finish selecting")
+
+	for {
+		entries := listEntries(files, cwd)
+		fmt.Fprintf(w.out, "\n/%s\n", strings.Join(cwd, "/"))
+		for i, entry := range entries {
+			mark := " "
+			if selection[entry.pattern()] {
+				mark = "*"
+			}
+			name := entry.name
+			if entry.dir {
+				name += "/"
+			}
+			fmt.Fprintf(w.out, " %s %3d  %-40s %10s  %d files\n", mark, i+1, name, formatSize(entry.size), entry.files)
+		}
+		fmt.Fprintf(w.out, "%d entries selected\n", len(selection))
+
+		cmd, err := w.prompt(">", "")
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case cmd == "done":
+			if len(selection) == 0 {
+				fmt.Fprintln(w.out, "Select at least one entry")
+				continue
+			}
+			patterns := make([]string, 0, len(selection))
+			for pattern := range selection {
+				patterns = append(patterns, pattern)
+			}
+			sort.Strings(patterns)
+			return patterns, nil
+		case cmd == "..":
+			if len(cwd) > 0 {
+				cwd = cwd[:len(cwd)-1]
+			}
+		case cmd == "+*":
+			for _, entry := range entries {
+				selection[entry.pattern()] = true
+			}
+		case strings.HasPrefix(cmd, "+"), strings.HasPrefix(cmd, "-"):
+			entry, ok := pickEntry(entries, cmd[1:])
+			if !ok {
+				fmt.Fprintln(w.out, "No such entry")
+				continue
+			}
+			if cmd[0] == '+' {
+				selection[entry.pattern()] = true
+			} else {
+				delete(selection, entry.pattern())
+			}
+		default:
+			entry, ok := pickEntry(entries, cmd)
+			if !ok || !entry.dir {
+				fmt.Fprintln(w.out, "No such directory")
+				continue
+			}
+			cwd = entry.path
+		}
+	}
+}
+
+func (w *wizard) prompt(question string, defaultValue string) (string, error) {
+	if defaultValue != "" && !strings.HasSuffix(question, "]") {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, defaultValue)
+	} else {
+		fmt.Fprintf(w.out, "%s ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("error reading input: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return defaultValue, nil
+	}
+	return line, nil
+}
+
+// browseEntry is a file or directory at one level of the archive tree
+type browseEntry struct {
+	name  string
+	path  []string // Path segments from the archive root
+	dir   bool
+	size  int64 // Total size of the file or everything below the directory
+	files int
+}
+
+// pattern returns the glob pattern selecting the entry
+func (e browseEntry) pattern() string {
+	escaped := make([]string, len(e.path))
+	for i, segment := range e.path {
+		escaped[i] = escapeGlob(segment)
+	}
+	if e.dir {
+		return strings.Join(escaped, "/") + "/**"
+	}
+	return strings.Join(escaped, "/")
+}
+
+// listEntries returns the entries directly below cwd, directories first
+func listEntries(files []packer.FileMetadata, cwd []string) []browseEntry {
+	byName := make(map[string]*browseEntry)
+	for _, file := range files {
+		segments := splitArchivePath(file.Path)
+		if len(segments) <= len(cwd) || !hasPrefix(segments, cwd) {
+			continue
+		}
+		name := segments[len(cwd)]
+		entry, ok := byName[name]
+		if !ok {
+			entry = &browseEntry{
+				name: name,
+				path: append(append([]string(nil), cwd...), name),
+				dir:  len(segments) > len(cwd)+1,
+			}
+			byName[name] = entry
+		}
+		entry.size += file.Size
+		entry.files++
+	}
+
+	entries := make([]browseEntry, 0, len(byName))
+	for _, entry := range byName {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].dir != entries[j].dir {
+			return entries[i].dir
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+func pickEntry(entries []browseEntry, arg string) (browseEntry, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 || n > len(entries) {
+		return browseEntry{}, false
+	}
+	return entries[n-1], true
+}
+
+// selectFiles returns the files matched by any of the patterns
+func selectFiles(files []packer.FileMetadata, patterns []string) []packer.FileMetadata {
+	var selected []packer.FileMetadata
+	for _, file := range files {
+		for _, pattern := range patterns {
+			if matchEntry(pattern, file.Path) {
+				selected = append(selected, file)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// matchEntry matches the patterns produced by browseEntry, which are either
+// an exact path or a directory followed by /**
+func matchEntry(pattern string, path string) bool {
+	target := strings.Join(splitArchivePath(path), "/")
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return strings.HasPrefix(target, unescapeGlob(dir)+"/")
+	}
+	return target == unescapeGlob(pattern)
+}
+
+func splitArchivePath(path string) []string {
+	var segments []string
+	for _, segment := range strings.Split(strings.ReplaceAll(path, "\\", "/"), "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+func hasPrefix(segments []string, prefix []string) bool {
+	for i := range prefix {
+		if segments[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeGlob escapes the glob meta characters of a literal path segment
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func unescapeGlob(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func totalSize(files []packer.FileMetadata) int64 {
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+	return total
+}
+
+// formatSize formats a byte count with a binary unit
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func isYes(answer string) bool {
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
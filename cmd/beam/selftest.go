@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+	"github.com/atterpac/bt-takehome/pkg/testgen"
+)
+
+// selftestStep is one timed stage of the self test
+type selftestStep struct {
+	name string
+	run  func() error
+}
+
+func runSelftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	sizeFlag := fs.String("size", "100MB", "amount of synthetic data to test with, e.g. 1GB")
+	dir := fs.String("dir", "", "directory to run in, such as the storage target to validate, defaults to the temporary directory")
+	keep := fs.Bool("keep", false, "keep the generated files and archive")
+	verbose := fs.Bool("verbose", false, "show the output of every stage")
+	smallFiles := fs.Int("small-files", 0, "test with this many 4KB files instead of a mixed tree of --size bytes")
+	var opts packer.PackerOptions
+	smallFileFlags(fs, &opts)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	size, err := parseByteSize(*sizeFlag)
+	if err != nil {
+		return err
+	}
+	spec := testgen.SizedSpec("source", size)
+	if *smallFiles > 0 {
+		spec = testgen.SmallFilesSpec("source", *smallFiles, "4096B")
+		size = int64(*smallFiles) * 4096
+	}
+
+	workDir, err := os.MkdirTemp(*dir, "beam-selftest-")
+	if err != nil {
+		return fmt.Errorf("error creating self test directory: %w", err)
+	}
+	if *keep {
+		fmt.Printf("Keeping self test files in %s\n", workDir)
+	} else {
+		defer os.RemoveAll(workDir)
+	}
+
+	sourceDir := filepath.Join(workDir, "source")
+	archiveDir := filepath.Join(workDir, "archive")
+	unpackDir := filepath.Join(workDir, "unpack")
+
+	// Archive paths relative to the source so the trees can be compared
+	opts.PathMapper = func(srcPath string) (string, bool) {
+		rel, err := filepath.Rel(sourceDir, srcPath)
+		return rel, err != nil
+	}
+	p := newPacker(opts)
+
+	seed := time.Now().UnixNano()
+	steps := []selftestStep{
+		{"generate", func() error {
+			g := testgen.Generator{Random: rand.New(rand.NewSource(seed))}
+			return g.Generate(spec, workDir)
+		}},
+		{"pack", func() error { return p.Pack(sourceDir, archiveDir) }},
+		{"verify", func() error { return p.Verify(archiveDir) }},
+		{"unpack", func() error { return p.Unpack(archiveDir, unpackDir) }},
+		{"compare", func() error { return compareTrees(sourceDir, unpackDir) }},
+	}
+
+	fmt.Printf("Self test of %s in %s (seed %d)\n", formatBytes(size), workDir, seed)
+	for _, step := range steps {
+		start := time.Now()
+		err := quietly(!*verbose, step.run)
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Printf("%-10s FAIL after %s\n", step.name, elapsed.Round(time.Millisecond))
+			fmt.Println("FAIL")
+			return fmt.Errorf("self test %s failed: %w", step.name, err)
+		}
+		fmt.Printf("%-10s ok  %10s  %8.2f MB/s", step.name, elapsed.Round(time.Microsecond), calculateSpeed(size, elapsed))
+		if *smallFiles > 0 {
+			fmt.Printf("  %9.0f files/s", float64(*smallFiles)/elapsed.Seconds())
+		}
+		fmt.Println()
+	}
+	fmt.Println("PASS")
+	return nil
+}
+
+// quietly runs fn, discarding what it prints to stdout when quiet is set
+func quietly(quiet bool, fn func() error) error {
+	if !quiet {
+		return fn()
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return fn()
+	}
+	defer devNull.Close()
+
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+	return fn()
+}
+
+// compareTrees checks that both directories hold the same files with the
+// same contents
+func compareTrees(want string, got string) error {
+	wantFiles := 0
+	err := filepath.WalkDir(want, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		wantFiles++
+		rel, err := filepath.Rel(want, path)
+		if err != nil {
+			return err
+		}
+		return compareFiles(path, filepath.Join(got, rel))
+	})
+	if err != nil {
+		return err
+	}
+
+	gotFiles := 0
+	err = filepath.WalkDir(got, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			gotFiles++
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if gotFiles != wantFiles {
+		return fmt.Errorf("unpacked %d files, expected %d", gotFiles, wantFiles)
+	}
+	return nil
+}
+
+// compareFiles checks that two files have identical contents
+func compareFiles(want string, got string) error {
+	a, err := os.Open(want)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := os.Open(got)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	bufA := make([]byte, defaultBufferSize)
+	bufB := make([]byte, defaultBufferSize)
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB)
+		if n != m || !bytes.Equal(bufA[:n], bufB[:m]) {
+			return fmt.Errorf("%s differs from %s", got, want)
+		}
+		if errors.Is(errA, io.EOF) || errors.Is(errA, io.ErrUnexpectedEOF) {
+			if errB == errA {
+				return nil
+			}
+			return fmt.Errorf("%s differs from %s", got, want)
+		}
+		if errA != nil {
+			return errA
+		}
+		if errB != nil {
+			return errB
+		}
+	}
+}
+
+// calculateSpeed calculates the processing speed in MB/s
+func calculateSpeed(totalBytes int64, duration time.Duration) float64 {
+	return float64(totalBytes) / (1024 * 1024) / duration.Seconds()
+}
+
+// formatBytes formats a byte count with a decimal unit
+func formatBytes(n int64) string {
+	for _, unit := range byteUnits {
+		if n >= unit.size {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
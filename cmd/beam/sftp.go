@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpScheme prefixes archive locations in a directory of a remote host
+const sftpScheme = "sftp://"
+
+// openSFTPStore returns the store of an sftp://[user@]host[:port]/path
+// location. Paths starting with /~/ are relative to the home directory of the
+// user. Keys are taken from the SSH agent at SSH_AUTH_SOCK and the unencrypted
+// default identities in ~/.ssh, and the host key must be in ~/.ssh/known_hosts
+func openSFTPStore(location string) (packer.BlockStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location %s: %w", location, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %s", location)
+	}
+	name := u.User.Username()
+	if name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("no user in %s: %w", location, err)
+		}
+		name = current.Username
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	dir := u.Path
+	if dir == "/~" || strings.HasPrefix(dir, "/~/") {
+		dir = strings.TrimPrefix(strings.TrimPrefix(dir, "/~"), "/")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading known hosts to check %s: %w", u.Hostname(), err)
+	}
+	signers := identities(home)
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			if keys, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(keys, signers...)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH keys to connect to %s, from SSH_AUTH_SOCK or ~/.ssh", u.Hostname())
+	}
+
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+	return packer.NewSFTPStore(net.JoinHostPort(u.Hostname(), port), dir, config, packer.SFTPOptions{}), nil
+}
+
+// identities returns the signers of the default SSH identities of the user
+// that are not protected by a passphrase
+func identities(home string) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if err != nil && !errors.As(err, &missing) {
+			logger.Warn("Unusable SSH identity", "path", filepath.Join(home, ".ssh", name), "error", err)
+		}
+		if err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	return signers
+}
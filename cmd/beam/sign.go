@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// metadataKeyVar names the environment variable holding the key that
+// encrypts block metadata, as 64 hex digits
+const metadataKeyVar = "BEAM_METADATA_KEY"
+
+// passphraseVar names the environment variable holding the passphrase that
+// encrypts block metadata instead of a key, and newPassphraseVar the one
+// rekey replaces it with
+const (
+	passphraseVar    = "BEAM_PASSPHRASE"
+	newPassphraseVar = "BEAM_NEW_PASSPHRASE"
+)
+
+// metadataKey is the key read from metadataKeyVar, nil when it is not set
+var metadataKey []byte
+
+// metadataKeyFromEnv reads the metadata key from the environment. A key in
+// the environment rather than a flag stays out of the process list and
+// applies to every command alike
+func metadataKeyFromEnv() ([]byte, error) {
+	s := os.Getenv(metadataKeyVar)
+	if s == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != packer.MetadataKeySize {
+		return nil, fmt.Errorf("%s must hold %d hex encoded bytes, such as the output of openssl rand -hex %d",
+			metadataKeyVar, packer.MetadataKeySize, packer.MetadataKeySize)
+	}
+	return key, nil
+}
+
+func runRekey(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	current, next := os.Getenv(passphraseVar), os.Getenv(newPassphraseVar)
+	if current == "" || next == "" {
+		return fmt.Errorf("rekey needs the current passphrase in %s and the new one in %s", passphraseVar, newPassphraseVar)
+	}
+	if err := newPacker(packer.PackerOptions{}).Rekey(dirs[0], next); err != nil {
+		return err
+	}
+	fmt.Printf("Changed the passphrase of %s\n", dirs[0])
+	return nil
+}
+
+// signFlag registers the flag signing the archive with a private key once
+// the command has written it
+func signFlag(fs *flag.FlagSet, opts *packer.PackerOptions) {
+	fs.Func("sign-key", "sign the archive with the Ed25519 private key in this PEM file", func(path string) error {
+		key, err := readPrivateKey(path)
+		opts.SigningKey = key
+		return err
+	})
+}
+
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	paths, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key: %w", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return fmt.Errorf("error encoding private key: %w", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return fmt.Errorf("error encoding public key: %w", err)
+	}
+
+	// The private key is only readable by its owner and never overwritten
+	if err := writePEM(paths[0], "PRIVATE KEY", privateDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(paths[1], "PUBLIC KEY", publicDER, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote private key %s and public key %s\n", paths[0], paths[1])
+	return nil
+}
+
+func runSign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "Ed25519 private key in a PEM file, as written by keygen")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *keyPath == "" {
+		return fmt.Errorf("sign needs --key")
+	}
+	key, err := readPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+	if err := newPacker(packer.PackerOptions{}).Sign(dirs[0], key); err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s\n", dirs[0])
+	return nil
+}
+
+// writePEM writes a PEM block to a new file
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("error creating key file: %w", err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	return f.Close()
+}
+
+// readPEM reads the DER bytes of the first PEM block of a key file
+func readPEM(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in key file %s", path)
+	}
+	return block.Bytes, nil
+}
+
+// readPrivateKey reads an Ed25519 private key from a PKCS #8 PEM file, as
+// written by keygen or openssl genpkey -algorithm ed25519
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key %s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %s is not an Ed25519 key", path)
+	}
+	return private, nil
+}
+
+// readPublicKey reads an Ed25519 public key from a PKIX PEM file, as written
+// by keygen or openssl pkey -pubout
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key %s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an Ed25519 key", path)
+	}
+	return public, nil
+}
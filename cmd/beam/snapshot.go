@@ -0,0 +1,318 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// snapshotJSON is the JSON form of a snapshot
+type snapshotJSON struct {
+	Generation int        `json:"generation"`
+	Created    time.Time  `json:"created"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Source     string     `json:"source"`
+	Files      int        `json:"files"`
+	Size       int64      `json:"size"`
+	Blocks     int        `json:"blocks"`
+}
+
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	preserveFlags(fs, &opts)
+	normalizeFlag(fs, &opts)
+	fs.BoolVar(&opts.ContinueOnError, "continue-on-error", false, "skip files that cannot be read and report them at the end")
+	fs.BoolVar(&opts.ZeroRunEncoding, "zero-runs", false, "leave runs of 4KB or more zeros out of the blocks, only this version reads them")
+	compressFlag(fs, &opts)
+	smallFileFlags(fs, &opts)
+	sourceReadFlag(fs, &opts)
+	syncFlag(fs, &opts)
+	changedFilesFlag(fs, &opts)
+	specialFilesFlag(fs, &opts)
+	freezeFlag(fs, &opts)
+	walkFlags(fs, &opts)
+	list := fs.Bool("list", false, "list the snapshots of the archive instead of taking one")
+	asJSON := fs.Bool("json", false, "print the snapshot list as JSON, with --list")
+	forget := fs.Int("forget", 0, "delete this snapshot generation, its blocks are removed by gc")
+	fs.DurationVar(&opts.ExpiresAfter, "expire-after", 0, "record that the snapshot expires this long after it is taken, prune then deletes it")
+	blockSizeFlag(fs, &opts)
+	impactFlags(fs, &opts)
+	signFlag(fs, &opts)
+	bufferFlag(fs, &opts)
+	progressFD := progressFlag(fs)
+	dirs, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *list || *forget > 0 {
+		if len(dirs) != 1 {
+			return fmt.Errorf("snapshot --list and --forget expect 1 argument, got %d", len(dirs))
+		}
+		if *forget > 0 {
+			return newPacker(opts).ForgetSnapshot(dirs[0], *forget)
+		}
+		return printSnapshots(newPacker(opts), dirs[0], *asJSON)
+	}
+
+	if len(dirs) != 2 {
+		return fmt.Errorf("snapshot expects 2 arguments, got %d", len(dirs))
+	}
+	if err := openProgress(*progressFD, &opts); err != nil {
+		return err
+	}
+	_, err = newPacker(opts).Snapshot(dirs[0], dirs[1])
+	return err
+}
+
+// printSnapshots lists the snapshots of an archive
+func printSnapshots(p packer.Packer, archiveDir string, asJSON bool) error {
+	snapshots, err := p.Snapshots(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	if !asJSON {
+		for _, s := range snapshots {
+			fmt.Printf("%6d %s %6d files %12d bytes %4d blocks %s",
+				s.Generation, s.Created.Local().Format(time.DateTime), s.Files, s.Size, s.Blocks, s.Source)
+			if !s.Expires.IsZero() {
+				fmt.Printf(" (expires %s)", s.Expires.Local().Format(time.DateTime))
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	entries := make([]snapshotJSON, 0, len(snapshots))
+	for _, s := range snapshots {
+		var expires *time.Time
+		if !s.Expires.IsZero() {
+			expires = &s.Expires
+		}
+		entries = append(entries, snapshotJSON{
+			Generation: s.Generation,
+			Created:    s.Created,
+			Expires:    expires,
+			Source:     s.Source,
+			Files:      s.Files,
+			Size:       s.Size,
+			Blocks:     s.Blocks,
+		})
+	}
+	return writeJSON(entries)
+}
+
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the blocks that would be removed without changing the archive")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	result, err := newPacker(opts).GC(dirs[0])
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(gcJSON{
+			DryRun:         opts.DryRun,
+			Removed:        nonNil(result.Removed),
+			ReclaimedBytes: result.ReclaimedBytes,
+		})
+	}
+	removed, reclaimed := "Removed", "reclaimed"
+	if opts.DryRun {
+		removed, reclaimed = "Would remove", "would reclaim"
+	}
+	for _, name := range result.Removed {
+		fmt.Printf("%s %s\n", removed, name)
+	}
+	fmt.Printf("%s %d unreferenced blocks, %s %d bytes\n", removed, len(result.Removed), reclaimed, result.ReclaimedBytes)
+	return nil
+}
+
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	logFlags(fs)
+	var policy packer.RetentionPolicy
+	fs.IntVar(&policy.KeepLast, "keep-last", 0, "keep the latest N snapshots")
+	fs.IntVar(&policy.KeepDaily, "keep-daily", 0, "keep the latest snapshot of each of the latest N days with one")
+	fs.IntVar(&policy.KeepWeekly, "keep-weekly", 0, "keep the latest snapshot of each of the latest N weeks with one")
+	fs.IntVar(&policy.KeepMonthly, "keep-monthly", 0, "keep the latest snapshot of each of the latest N months with one")
+	dryRun := fs.Bool("dry-run", false, "print what would be deleted without changing the archive")
+	asJSON := fs.Bool("json", false, "print the dry run as JSON, with --dry-run")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	p := newPacker(packer.PackerOptions{})
+	if *dryRun {
+		result, err := p.PlanPrune(dirs[0], policy)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return writeJSON(pruneJSON{
+				Kept:           result.Kept,
+				Expired:        result.Expired,
+				Forgotten:      result.Forgotten,
+				Removed:        result.Removed,
+				ReclaimedBytes: result.ReclaimedBytes,
+			})
+		}
+		printPrune(result, "Would delete", "would remove", "reclaim")
+		return nil
+	}
+
+	result, err := p.Prune(dirs[0], policy)
+	if err != nil {
+		return err
+	}
+	printPrune(result, "Deleted", "removed", "reclaimed")
+	return nil
+}
+
+// pruneJSON is the JSON form of a prune dry run
+type pruneJSON struct {
+	Kept           []int    `json:"kept"`
+	Expired        []int    `json:"expired"`
+	Forgotten      []int    `json:"forgotten"`
+	Removed        []string `json:"removed_blocks"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// printPrune prints the snapshots and blocks a prune deleted, or would delete
+func printPrune(result *packer.PruneResult, deleted, removed, reclaimed string) {
+	for _, generation := range result.Expired {
+		fmt.Printf("%s snapshot %d, expired\n", deleted, generation)
+	}
+	for _, generation := range result.Forgotten {
+		fmt.Printf("%s snapshot %d, kept by no rule\n", deleted, generation)
+	}
+	fmt.Printf("Kept %d snapshots, %s %d, %s %d unreferenced blocks, %s %d bytes\n",
+		len(result.Kept), strings.ToLower(deleted), len(result.Expired)+len(result.Forgotten),
+		removed, len(result.Removed), reclaimed, result.ReclaimedBytes)
+}
+
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	blockSizeFlag(fs, &opts)
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the blocks that would be rewritten and removed without changing the archive")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	result, err := newPacker(opts).Compact(dirs[0])
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(newCompactJSON(result, opts.DryRun))
+	}
+	printCompact(result, opts.DryRun)
+	return nil
+}
+
+// printCompact prints the blocks a compaction rewrote and removed, or would
+func printCompact(result *packer.CompactResult, dryRun bool) {
+	rewrite, remove, reclaim := "Rewrote", "Removed", "reclaimed"
+	if dryRun {
+		rewrite, remove, reclaim = "Would rewrite", "Would remove", "would reclaim"
+	}
+	for _, name := range result.Rewritten {
+		fmt.Printf("%s %s\n", rewrite, name)
+	}
+	for _, name := range result.Removed {
+		fmt.Printf("%s %s\n", remove, name)
+	}
+	fmt.Printf("%s %d blocks, %s %d blocks, %s %d bytes\n",
+		rewrite, len(result.Rewritten), strings.ToLower(remove), len(result.Removed), reclaim, result.ReclaimedBytes)
+}
+
+func runUpgrade(args []string) error {
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	logFlags(fs)
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	result, err := newPacker(packer.PackerOptions{}).Upgrade(dirs[0])
+	if err != nil {
+		return err
+	}
+	for _, name := range result.Upgraded {
+		fmt.Printf("Upgraded %s\n", name)
+	}
+	fmt.Printf("Upgraded %d blocks, %d already in the current format\n", len(result.Upgraded), len(result.Current))
+	return nil
+}
+
+func runRemove(args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	fs.BoolVar(&opts.CompactAfterRemove, "compact", false, "compact the archive afterwards so the removed contents are erased from the blocks")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the files that would be removed, and the blocks --compact would rewrite, without changing the archive")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("remove expects an archive directory and at least 1 pattern, got %d arguments", len(args))
+	}
+
+	result, err := newPacker(opts).Remove(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		out := removeJSON{
+			DryRun:          opts.DryRun,
+			Deleted:         nonNil(result.Deleted),
+			SnapshotEntries: result.SnapshotEntries,
+		}
+		if result.Compact != nil {
+			compact := newCompactJSON(result.Compact, opts.DryRun)
+			out.Compact = &compact
+		}
+		return writeJSON(out)
+	}
+	removed := "Removed"
+	if opts.DryRun {
+		removed = "Would remove"
+	}
+	for _, path := range result.Deleted {
+		fmt.Printf("%s %s\n", removed, path)
+	}
+	fmt.Printf("%s %d files, %d snapshot entries\n", removed, len(result.Deleted), result.SnapshotEntries)
+	if result.Compact != nil {
+		printCompact(result.Compact, opts.DryRun)
+	}
+	return nil
+}
+
+func runRename(args []string) error {
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	logFlags(fs)
+	dirs, err := parseArgs(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	return newPacker(packer.PackerOptions{}).Rename(dirs[0], dirs[1], dirs[2])
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+func runSpec(args []string) error {
+	fs := flag.NewFlagSet("spec", flag.ExitOnError)
+	output := fs.String("output", "", "write the specification to this file instead of stdout")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := packer.WriteFormatSpec(&buf); err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(*output, buf.Bytes(), 0644)
+}
+
+func runVectors(args []string) error {
+	fs := flag.NewFlagSet("vectors", flag.ExitOnError)
+	check := fs.Bool("check", false, "read the vectors in the directory instead of writing them")
+	dirs, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	vectors := packer.TestVectors()
+	for _, vector := range vectors {
+		dir := filepath.Join(dirs[0], vector.Name)
+		if *check {
+			err = vector.Check(dir)
+		} else {
+			err = vector.Write(dir)
+		}
+		if err != nil {
+			return err
+		}
+		logger.Debug("Vector done", "name", vector.Name, "dir", dir)
+	}
+	if *check {
+		fmt.Printf("All %d test vectors in %s read back\n", len(vectors), dirs[0])
+	} else {
+		fmt.Printf("Wrote %d test vectors to %s\n", len(vectors), dirs[0])
+	}
+	return nil
+}
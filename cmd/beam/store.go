@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+// s3Scheme prefixes archive locations in an S3 compatible bucket
+const s3Scheme = "s3://"
+
+// openStore returns the block store an archive location refers to, or nil for
+// a local path. Buckets are given as s3://bucket/prefix and the credentials,
+// region and endpoint are read from the standard AWS environment variables.
+// Remote directories are given as sftp://[user@]host[:port]/path, Cloud
+// Storage buckets as gs://bucket/prefix and Azure containers as
+// az://container/prefix
+func openStore(location string) (packer.BlockStore, error) {
+	switch {
+	case strings.HasPrefix(location, sftpScheme):
+		return openSFTPStore(location)
+	case strings.HasPrefix(location, gcsScheme):
+		return openGCSStore(location)
+	case strings.HasPrefix(location, azureScheme):
+		return openAzureStore(location)
+	case !strings.HasPrefix(location, s3Scheme):
+		return nil, nil
+	}
+	bucket, prefix, err := splitBucket(location, s3Scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	store := packer.S3Store{
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+		Region:          os.Getenv("AWS_REGION"),
+		Bucket:          bucket,
+		Prefix:          prefix,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if store.Region == "" {
+		store.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if store.AccessKeyID == "" || store.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use %s", location)
+	}
+	return store, nil
+}
+
+// splitBucket splits a scheme://bucket/prefix location into its bucket and
+// its prefix, which ends with a slash unless it is empty
+func splitBucket(location string, scheme string) (string, string, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, scheme), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("no bucket in %s", location)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// mirrorOptions are the flags putting blocks into several locations at once
+type mirrorOptions struct {
+	locations   stringList
+	minReplicas int
+}
+
+// mirrorFlags registers the flags mirroring an archive to more locations
+func mirrorFlags(fs *flag.FlagSet) *mirrorOptions {
+	var m mirrorOptions
+	fs.Var(&m.locations, "mirror", "also put every block into this s3://, gs://, az:// or sftp:// location or directory (repeatable)")
+	fs.IntVar(&m.minReplicas, "min-replicas", 1, "fail unless every block is stored in at least this many locations, with --mirror")
+	return &m
+}
+
+// open returns the store an archive location refers to, a mirror of it and
+// the --mirror locations when there are any, or nil for a local path alone
+func (m *mirrorOptions) open(location string) (packer.BlockStore, error) {
+	if len(m.locations) == 0 {
+		return openStore(location)
+	}
+	return openMirror(append([]string{location}, m.locations...), m.minReplicas)
+}
+
+// openMirror returns a mirror store keeping a replica in each location, named
+// after it. Local paths are kept as directories
+func openMirror(locations []string, minReplicas int) (*packer.MirrorStore, error) {
+	replicas := make([]packer.Replica, 0, len(locations))
+	for _, location := range locations {
+		store, err := openStore(location)
+		if err != nil {
+			return nil, err
+		}
+		if store == nil {
+			if err := os.MkdirAll(location, 0755); err != nil {
+				return nil, err
+			}
+			store = packer.DirStore{Dir: location}
+		}
+		replicas = append(replicas, packer.Replica{Name: location, Store: store})
+	}
+	return packer.NewMirrorStore(minReplicas, replicas...)
+}
+
+// isURL reports whether an archive location is an HTTP or HTTPS URL, which is
+// only ever read with range requests
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	logFlags(fs)
+	var opts packer.PackerOptions
+	fs.BoolVar(&opts.DeleteExtraneous, "delete-extraneous", false, "delete files in the destination that are not part of the archive")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print what would be uploaded and deleted without changing the destination")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	maxRateFlag(fs, &opts)
+	mirror := mirrorFlags(fs)
+	dirs, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	store, err := mirror.open(dirs[1])
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		// A local destination is a directory like any other store
+		if !opts.DryRun {
+			if err := os.MkdirAll(dirs[1], 0755); err != nil {
+				return err
+			}
+		}
+		store = packer.DirStore{Dir: dirs[1]}
+	}
+	result, err := newPacker(opts).Sync(dirs[0], store)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(syncJSON{
+			DryRun:        opts.DryRun,
+			Uploaded:      nonNil(result.Uploaded),
+			UploadedBytes: result.UploadedBytes,
+			Unchanged:     result.Unchanged,
+			Deleted:       nonNil(result.Deleted),
+		})
+	}
+	uploaded, deleted := "Uploaded", "Deleted"
+	if opts.DryRun {
+		uploaded, deleted = "Would upload", "Would delete"
+	}
+	for _, name := range result.Uploaded {
+		fmt.Printf("%s %s\n", uploaded, name)
+	}
+	for _, name := range result.Deleted {
+		fmt.Printf("%s %s\n", deleted, name)
+	}
+	fmt.Printf("%s %d files, %d bytes, %d blocks unchanged\n", uploaded, len(result.Uploaded), result.UploadedBytes, result.Unchanged)
+	return nil
+}
+
+func runRepairReplicas(args []string) error {
+	fs := flag.NewFlagSet("repair-replicas", flag.ExitOnError)
+	logFlags(fs)
+	locations, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(locations) < 2 {
+		return fmt.Errorf("repair-replicas expects at least 2 locations, got %d", len(locations))
+	}
+
+	store, err := openMirror(locations, 1)
+	if err != nil {
+		return err
+	}
+	result, err := newPacker(packer.PackerOptions{}).RepairReplicas(store)
+	if result == nil {
+		return err
+	}
+	for _, c := range result.Copied {
+		fmt.Printf("Copied %s to %s\n", c.Name, c.Replica)
+	}
+	for _, name := range result.Lost {
+		fmt.Printf("%s: missing from every replica\n", name)
+	}
+	if err == nil {
+		fmt.Printf("Copied %d files, %d bytes, %d blocks complete\n", len(result.Copied), result.CopiedBytes, result.Complete)
+	}
+	return err
+}
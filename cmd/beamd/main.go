@@ -0,0 +1,80 @@
+// Command beamd serves the packer over HTTP, so archiving can be offloaded to
+// a central machine instead of running beam on every client.
+//
+// Usage:
+//
+//	beamd [--addr localhost:7070] [--root DIR] [--jobs N] [--retain 24h] [--token-file FILE]
+//
+// Every operation runs as a job. Starting one returns its ID right away and
+// the job is then polled for its state and progress:
+//
+//	POST /v1/pack    {"input": "src", "archive": "backups/src", "resume": true}
+//	POST /v1/unpack  {"archive": "backups/src", "output": "restored", "include": ["docs/**"]}
+//	POST /v1/verify  {"archive": "backups/src"}
+//	POST /v1/list    {"archive": "backups/src"}
+//	GET  /v1/jobs
+//	GET  /v1/jobs/{id}
+//
+// Paths in requests are resolved below the root directory, symbolic links
+// included, and are rejected when they lead outside of it. With --token-file
+// every request must carry the token the file holds as a bearer token.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:7070", "address to listen on")
+	root := flag.String("root", ".", "directory every path in a request is resolved below")
+	jobs := flag.Int("jobs", 2, "number of jobs running at the same time")
+	retain := flag.Duration("retain", 24*time.Hour, "how long finished jobs can still be polled")
+	tokenFile := flag.String("token-file", "", "file holding the bearer token every request must carry")
+	flag.Parse()
+
+	if err := run(*addr, *root, *jobs, *retain, *tokenFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(addr string, root string, jobs int, retain time.Duration, tokenFile string) error {
+	if jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1, got %d", jobs)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	// Request paths are checked against the root with its links resolved
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("root %s is not a directory", root)
+	}
+
+	s := newServer(root, jobs, retain)
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading token: %w", err)
+		}
+		if s.token = strings.TrimSpace(string(b)); s.token == "" {
+			return fmt.Errorf("token file %s is empty", tokenFile)
+		}
+	}
+	slog.Info("Serving root directory", "root", root, "addr", addr, "token", s.token != "")
+	return http.ListenAndServe(addr, s.routes())
+}
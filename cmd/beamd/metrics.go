@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// blockFillBuckets are the upper bounds of the block fill histogram buckets
+var blockFillBuckets = []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1}
+
+// serverMetrics collects the metrics of every job and serves them in the
+// Prometheus text exposition format
+type serverMetrics struct {
+	mu        sync.Mutex
+	bytes     map[string]int64 // Per operation, as are the other counters
+	files     map[string]int64
+	blocks    map[string]int64
+	errors    map[string]int64
+	fill      []int64 // Observations in each bucket of blockFillBuckets, and above the last
+	fillSum   float64
+	fillCount int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		bytes:  make(map[string]int64),
+		files:  make(map[string]int64),
+		blocks: make(map[string]int64),
+		errors: make(map[string]int64),
+		fill:   make([]int64, len(blockFillBuckets)+1),
+	}
+}
+
+func (m *serverMetrics) AddBytes(op string, n int64) { m.add(m.bytes, op, n) }
+func (m *serverMetrics) AddFiles(op string, n int)   { m.add(m.files, op, int64(n)) }
+func (m *serverMetrics) AddBlocks(op string, n int)  { m.add(m.blocks, op, int64(n)) }
+func (m *serverMetrics) AddErrors(op string, n int)  { m.add(m.errors, op, int64(n)) }
+
+func (m *serverMetrics) add(counter map[string]int64, op string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counter[op] += n
+}
+
+func (m *serverMetrics) ObserveBlockFill(ratio float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := sort.SearchFloat64s(blockFillBuckets, ratio)
+	m.fill[i]++
+	m.fillSum += ratio
+	m.fillCount++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounter(w, "beam_bytes_total", "Bytes of file contents packed or extracted.", m.bytes)
+	writeCounter(w, "beam_files_total", "Files packed or extracted.", m.files)
+	writeCounter(w, "beam_blocks_total", "Blocks written when packing and read when unpacking.", m.blocks)
+	writeCounter(w, "beam_errors_total", "Failed operations and files skipped with continue_on_error.", m.errors)
+
+	fmt.Fprintln(w, "# HELP beam_block_fill_ratio Bytes of data in each written block over the block size.")
+	fmt.Fprintln(w, "# TYPE beam_block_fill_ratio histogram")
+	var cumulative int64
+	for i, bound := range blockFillBuckets {
+		cumulative += m.fill[i]
+		fmt.Fprintf(w, "beam_block_fill_ratio_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "beam_block_fill_ratio_bucket{le=\"+Inf\"} %d\n", m.fillCount)
+	fmt.Fprintf(w, "beam_block_fill_ratio_sum %g\n", m.fillSum)
+	fmt.Fprintf(w, "beam_block_fill_ratio_count %d\n", m.fillCount)
+}
+
+// writeCounter writes a counter with one sample per operation, sorted so the
+// output is stable
+func writeCounter(w io.Writer, name string, help string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	ops := make([]string, 0, len(values))
+	for op := range values {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(w, "%s{op=%q} %d\n", name, op, values[op])
+	}
+}
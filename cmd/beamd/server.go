@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atterpac/bt-takehome/pkg/packer"
+)
+
+const (
+	defaultBufferSize = 32 * 1024 // 32KB buffer size for copying, validation and checksum
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobRequest is the body of a request starting a job. Only the fields used by
+// the operation are read
+type jobRequest struct {
+	Input            string   `json:"input"`             // Directory to pack
+	Archive          string   `json:"archive"`           // Archive directory
+	Output           string   `json:"output"`            // Directory to unpack into
+	Include          []string `json:"include"`           // Patterns selecting the files to unpack
+	Resume           bool     `json:"resume"`            // Resume an interrupted pack or unpack
+	ContinueOnError  bool     `json:"continue_on_error"` // Skip files that fail and report them at the end
+	DeleteExtraneous bool     `json:"delete_extraneous"` // Delete files in the output that are not in the archive
+	Parity           int      `json:"parity"`            // Number of parity blocks per parity group
+	ParityGroup      int      `json:"parity_group"`      // Number of data blocks per parity group
+	Format           string   `json:"format"`            // Volume format, beam or zip
+	MaxRate          int64    `json:"max_rate"`          // Bytes of file contents read per second, 0 for unlimited
+}
+
+// job is an operation started through the API. Its exported fields are
+// guarded by the server mutex
+type job struct {
+	ID       string                `json:"id"`
+	Op       string                `json:"op"` // pack, unpack, verify or list
+	State    string                `json:"state"`
+	Created  time.Time             `json:"created"`
+	Started  *time.Time            `json:"started,omitempty"`
+	Finished *time.Time            `json:"finished,omitempty"`
+	Progress *packer.ProgressEvent `json:"progress,omitempty"` // Latest progress event
+	Stats    *packer.Stats         `json:"stats,omitempty"`    // Totals of a finished pack or unpack job
+	Error    string                `json:"error,omitempty"`
+	Failed   []fileFailure         `json:"failed,omitempty"` // Files skipped with continue_on_error
+	Files    []fileEntry           `json:"files,omitempty"`  // Archived files, for list jobs
+
+	run  func(p packer.Packer) ([]fileEntry, error)
+	opts packer.PackerOptions
+}
+
+// fileFailure is a file skipped by a job
+type fileFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// fileEntry is the JSON form of an archived file
+type fileEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	ModTime  time.Time `json:"mod_time"`
+	BlockID  int32     `json:"block_id"`
+	Checksum string    `json:"checksum"`
+}
+
+// server runs jobs and keeps them around for polling
+type server struct {
+	root    string         // Directory every request path is resolved below, with its symbolic links resolved
+	token   string         // Bearer token every request must carry, empty to accept any request
+	retain  time.Duration  // How long finished jobs are kept
+	slots   chan struct{}  // Limits the number of running jobs
+	metrics *serverMetrics // Counters of every job, served on /metrics
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newServer(root string, jobs int, retain time.Duration) *server {
+	return &server{
+		root:    root,
+		retain:  retain,
+		slots:   make(chan struct{}, jobs),
+		metrics: newServerMetrics(),
+		jobs:    make(map[string]*job),
+	}
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/pack", s.start("pack", s.pack))
+	mux.HandleFunc("POST /v1/unpack", s.start("unpack", s.unpack))
+	mux.HandleFunc("POST /v1/verify", s.start("verify", s.verify))
+	mux.HandleFunc("POST /v1/list", s.start("list", s.list))
+	mux.HandleFunc("GET /v1/jobs", s.listJobs)
+	mux.HandleFunc("GET /v1/jobs/{id}", s.getJob)
+	mux.Handle("GET /metrics", s.metrics)
+	return s.authorize(mux)
+}
+
+// authorize rejects requests without the bearer token of the server, when it
+// has one
+func (s *server) authorize(next http.Handler) http.Handler {
+	if s.token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="beamd"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// start returns a handler decoding a job request, checking it with prepare
+// and queueing the job it returns
+func (s *server) start(op string, prepare func(req jobRequest) (func(p packer.Packer) ([]fileEntry, error), error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req jobRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("error decoding request: %w", err))
+			return
+		}
+		run, err := prepare(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		opts, err := packerOptions(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		id, err := newJobID()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		j := &job{
+			ID:      id,
+			Op:      op,
+			State:   jobQueued,
+			Created: time.Now().UTC(),
+			run:     run,
+			opts:    opts,
+		}
+		s.mu.Lock()
+		s.prune()
+		s.jobs[j.ID] = j
+		snapshot := *j
+		s.mu.Unlock()
+
+		go s.runJob(j)
+		w.Header().Set("Location", "/v1/jobs/"+j.ID)
+		writeJSON(w, http.StatusAccepted, &snapshot)
+	}
+}
+
+func (s *server) pack(req jobRequest) (func(p packer.Packer) ([]fileEntry, error), error) {
+	input, err := s.resolve("input", req.Input)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := s.resolve("archive", req.Archive)
+	if err != nil {
+		return nil, err
+	}
+	return func(p packer.Packer) ([]fileEntry, error) {
+		return nil, p.Pack(input, archive)
+	}, nil
+}
+
+func (s *server) unpack(req jobRequest) (func(p packer.Packer) ([]fileEntry, error), error) {
+	archive, err := s.resolve("archive", req.Archive)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s.resolve("output", req.Output)
+	if err != nil {
+		return nil, err
+	}
+	return func(p packer.Packer) ([]fileEntry, error) {
+		return nil, p.Unpack(archive, output, req.Include...)
+	}, nil
+}
+
+func (s *server) verify(req jobRequest) (func(p packer.Packer) ([]fileEntry, error), error) {
+	archive, err := s.resolve("archive", req.Archive)
+	if err != nil {
+		return nil, err
+	}
+	return func(p packer.Packer) ([]fileEntry, error) {
+		return nil, p.Verify(archive)
+	}, nil
+}
+
+func (s *server) list(req jobRequest) (func(p packer.Packer) ([]fileEntry, error), error) {
+	archive, err := s.resolve("archive", req.Archive)
+	if err != nil {
+		return nil, err
+	}
+	return func(p packer.Packer) ([]fileEntry, error) {
+		files, err := p.List(archive)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]fileEntry, 0, len(files))
+		for _, file := range files {
+			entries = append(entries, fileEntry{
+				Path:     file.Path,
+				Size:     file.Size,
+				Mode:     os.FileMode(file.Mode).String(),
+				ModTime:  file.ModTime.UTC(),
+				BlockID:  file.BlockID,
+				Checksum: hex.EncodeToString(file.Checksum),
+			})
+		}
+		return entries, nil
+	}, nil
+}
+
+// resolve maps a request path below the root directory. Leading slashes and
+// .. elements cannot climb out of it, and the symbolic links of the part of
+// the path that exists are resolved and must not lead out of it either. A
+// link created below the root after the request was checked is not caught
+func (s *server) resolve(field string, path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("%s is required", field)
+	}
+	resolved := filepath.Join(s.root, filepath.Clean("/"+path))
+
+	// Outputs and archives may not exist yet, so the deepest existing
+	// ancestor is resolved and the rest appended to it. The root always exists
+	existing, rest := resolved, ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			resolved = filepath.Join(real, rest)
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("error resolving %s: %w", field, err)
+		}
+		existing, rest = filepath.Dir(existing), filepath.Join(filepath.Base(existing), rest)
+	}
+
+	rel, err := filepath.Rel(s.root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s %s leads outside of the root directory", field, path)
+	}
+	return resolved, nil
+}
+
+// runJob waits for a free slot and runs the job, recording its outcome
+func (s *server) runJob(j *job) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	s.update(j, func() {
+		now := time.Now().UTC()
+		j.Started = &now
+		j.State = jobRunning
+	})
+
+	opts := j.opts
+	opts.Progress = &jobProgress{s: s, j: j}
+	opts.Logger = slog.Default().With("job", j.ID)
+	opts.Metrics = s.metrics
+	p := packer.NewPacker(opts)
+	files, err := j.run(p)
+
+	s.update(j, func() {
+		now := time.Now().UTC()
+		j.Finished = &now
+		j.Files = files
+		if stats := p.Stats(); stats.Op != "" {
+			j.Stats = &stats
+		}
+		j.State = jobSucceeded
+		if err != nil {
+			j.State = jobFailed
+			j.Error = err.Error()
+			var partial *packer.PartialError
+			if errors.As(err, &partial) {
+				for _, failed := range partial.Failed {
+					j.Failed = append(j.Failed, fileFailure{Path: failed.Path, Error: failed.Err.Error()})
+				}
+			}
+		}
+	})
+	if err != nil {
+		slog.Error("Job failed", "job", j.ID, "op", j.Op, "error", err)
+	}
+}
+
+// packerOptions returns the packer options for a job request, filling in the
+// same defaults as the beam command
+func packerOptions(req jobRequest) (packer.PackerOptions, error) {
+	opts := packer.PackerOptions{
+		VerifyIntegrity:   true,
+		BufferSize:        defaultBufferSize,
+		Resume:            req.Resume,
+		ContinueOnError:   req.ContinueOnError,
+		DeleteExtraneous:  req.DeleteExtraneous,
+		ParityBlocks:      req.Parity,
+		ParityGroupSize:   req.ParityGroup,
+		MaxBytesPerSecond: req.MaxRate,
+	}
+	switch req.Format {
+	case "", "beam":
+		opts.Format = packer.FormatBeam
+	case "zip":
+		opts.Format = packer.FormatZip
+	default:
+		return opts, fmt.Errorf("unknown format %q, expected beam or zip", req.Format)
+	}
+	return opts, nil
+}
+
+// update changes a job under the server mutex
+func (s *server) update(j *job, change func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change()
+}
+
+// prune forgets jobs that finished longer ago than the retention period. It
+// must be called with the mutex held
+func (s *server) prune() {
+	cutoff := time.Now().Add(-s.retain)
+	for id, j := range s.jobs {
+		if j.Finished != nil && j.Finished.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.prune()
+	jobs := make([]job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		snapshot := *j
+		snapshot.Files = nil // Listings are only returned for single jobs
+		jobs = append(jobs, snapshot)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Created.Before(jobs[k].Created) })
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *server) getJob(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	j, ok := s.jobs[r.PathValue("id")]
+	var snapshot job
+	if ok {
+		snapshot = *j
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, &snapshot)
+}
+
+// jobProgress receives the progress events of a running job and keeps the
+// latest one for polling
+type jobProgress struct {
+	s   *server
+	j   *job
+	buf []byte
+}
+
+func (p *jobProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		line, rest, ok := bytes.Cut(p.buf, []byte("\n"))
+		if !ok {
+			return len(b), nil
+		}
+		var event packer.ProgressEvent
+		if err := json.Unmarshal(line, &event); err == nil {
+			p.s.update(p.j, func() { p.j.Progress = &event })
+		}
+		p.buf = append(p.buf[:0], rest...)
+	}
+}
+
+// newJobID returns a random job ID
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating job ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
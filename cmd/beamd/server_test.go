@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveStaysBelowRoot(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "archives"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "archives"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newServer(root, 1, time.Hour)
+	tests := []struct {
+		path string
+		want string // Resolved path, empty when the path must be rejected
+	}{
+		{"archives/src", filepath.Join(root, "archives", "src")},
+		{"/archives/../../../etc", filepath.Join(root, "etc")},
+		{"inside/new/dir", filepath.Join(root, "archives", "new", "dir")},
+		{"escape", ""},
+		{"escape/not/there/yet", ""},
+	}
+	for _, tt := range tests {
+		got, err := s.resolve("archive", tt.path)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("resolve(%q) = %s, want an error", tt.path, got)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("resolve(%q) = %s, %v, want %s", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestTokenRequired(t *testing.T) {
+	s := newServer(t.TempDir(), 1, time.Hour)
+	s.token = "secret"
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/v1/jobs", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -1,3 +1,16 @@
 module github.com/atterpac/bt-takehome
 
 go 1.22.2
+
+require (
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/cpuid/v2 v2.2.3
+	github.com/minio/sha256-simd v1.0.1
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"runtime"
 	"time"
 
-	"github.com/atterpac/bt-takehome/internal/packer"
+	"github.com/atterpac/bt-takehome/pkg/packer"
 )
 
 var (
@@ -17,6 +18,7 @@ var (
 	UNPACK_DIR  = "output/unpack"                    // Where to unpack files
 	BUFFER_SIZE = 32 * 1024                          // 32KB buffer size for validation and checksum
 	BLOCK_SIZE  = 60 * 1024 * 1024                   // 60MB block size
+	RESUME      = false                              // Resume an interrupted pack
 )
 
 func main() {
@@ -38,42 +40,31 @@ func main() {
 		VerifyIntegrity: true,
 		BufferSize:      BUFFER_SIZE,
 		BlockSize:       int64(BLOCK_SIZE),
+		Resume:          RESUME,
 	})
 
-	// Calculate original size
-	originalSize := calculateTotalSize(DIR)
 	fmt.Printf("\n=== Packing Stats ===\n")
 	fmt.Printf("Source Directory: %s\n", DIR)
 
 	// Pack files
 	fmt.Printf("\nPacking files into %s...\n", OUTPUT_DIR)
-	packStart := time.Now()
 	if err := p.Pack(DIR, OUTPUT_DIR); err != nil {
 		fmt.Printf("Error packing files: %v\n", err)
 		os.Exit(1)
 	}
 
-	packDuration := time.Since(packStart)
-
 	// Print packing stats
-	fmt.Printf("\nPack Time: %v\n", packDuration)
-	fmt.Printf("Pack Speed: %.2f MB/s\n", calculateSpeed(originalSize, packDuration))
+	printStats("Pack", p.Stats())
 
 	// Unpack files
 	fmt.Printf("\nUnpacking files to %s...\n", UNPACK_DIR)
-	unpackStart := time.Now()
 	if err := p.Unpack(OUTPUT_DIR, UNPACK_DIR); err != nil {
 		fmt.Printf("Error unpacking files: %v\n", err)
 		os.Exit(1)
 	}
-	unpackDuration := time.Since(unpackStart)
-
-	// Calculate unpacked size for verification
-	unpackedSize := calculateTotalSize(UNPACK_DIR)
 
 	// Print unpacking stats
-	fmt.Printf("Unpack Time: %v\n", unpackDuration)
-	fmt.Printf("Unpack Speed: %.2f MB/s\n", calculateSpeed(unpackedSize, unpackDuration))
+	printStats("Unpack", p.Stats())
 
 	// Verify integrity
 	fmt.Println("\nVerifying file integrity...")
@@ -84,40 +75,59 @@ func main() {
 	}
 	fmt.Printf("Verification Time: %v\n", time.Since(verifyStart))
 	fmt.Println("All files verified successfully!")
+
+	// Verify every extracted file against its archived checksum
+	fmt.Println("\nVerifying extracted files...")
+	deepVerifyStart := time.Now()
+	if err := p.VerifyExtracted(OUTPUT_DIR, UNPACK_DIR); err != nil {
+		fmt.Printf("Extracted file verification failed: %v\n", err)
+		printExtractedFilesError(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Extracted Verification Time: %v\n", time.Since(deepVerifyStart))
+	fmt.Println("All extracted files verified successfully!")
 }
 
-// calculateTotalSize calculates the total size of all files in a directory
-func calculateTotalSize(dir string) int64 {
-	var totalSize int64
-	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-		}
-		return nil
-	})
-	return totalSize
+// printExtractedFilesError lists the individual files that failed verification
+func printExtractedFilesError(err error) {
+	var filesErr *packer.ExtractedFilesError
+	if !errors.As(err, &filesErr) {
+		return
+	}
+	for _, mismatch := range filesErr.Mismatched {
+		fmt.Printf("  mismatched: %s\n", mismatch.Path)
+	}
+	for _, path := range filesErr.Missing {
+		fmt.Printf("  missing: %s\n", path)
+	}
+	for _, path := range filesErr.Extra {
+		fmt.Printf("  extra: %s\n", path)
+	}
 }
 
-// calculateSpeed calculates the processing speed in MB/s
-func calculateSpeed(totalBytes int64, duration time.Duration) float64 {
-	return float64(totalBytes) / (1024 * 1024) / duration.Seconds()
+// printStats prints the totals of a pack or unpack operation
+func printStats(op string, stats packer.Stats) {
+	fmt.Printf("\n%s Time: %v\n", op, stats.Duration)
+	fmt.Printf("%s Speed: %.2f MB/s\n", op, stats.Throughput/(1024*1024))
+	fmt.Printf("%s Files: %d files, %d blocks, %d bytes in, %d bytes out\n", op, stats.Files, stats.Blocks, stats.BytesIn, stats.BytesOut)
 }
 
 func checkArgs() {
-	if len(os.Args) > 1 {
+	flag.BoolVar(&RESUME, "resume", RESUME, "resume an interrupted pack using the journal in the output directory")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) > 0 {
 		println("Overriding default directories...")
-		DIR = os.Args[1]
+		DIR = args[0]
 	}
-	if len(os.Args) > 2 {
+	if len(args) > 1 {
 		println("Overriding default output directory...")
-		OUTPUT_DIR = os.Args[2]
+		OUTPUT_DIR = args[1]
 	}
-	if len(os.Args) > 3 {
+	if len(args) > 2 {
 		println("Overriding default unpack directory...")
-		UNPACK_DIR = os.Args[3]
+		UNPACK_DIR = args[2]
 	}
 }
 
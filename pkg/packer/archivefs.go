@@ -0,0 +1,334 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFS is a read only fs.FS view of a packed archive. The file index is
+// read once when the archive is opened and file contents are read lazily from
+// their blocks, so nothing is extracted
+type ArchiveFS struct {
+	files map[string]*archiveEntry // Files by their name within the filesystem
+	dirs  map[string][]string      // Sorted names of the entries of each directory
+	cache *BlockCache              // Keeps the contents of small files once read, nil reads them from their block on every open
+}
+
+// archiveEntry locates the contents of a file within its block
+type archiveEntry struct {
+	metadata  FileMetadata
+	blockPath string
+	stamp     blockStamp // Block file as it was when the archive was opened
+	offset    int64      // Offset of the file contents within the block file
+}
+
+// OpenArchive opens the archive in dir as an fs.FS. Archived paths are made
+// relative, so /home/user/file is found at home/user/file
+func OpenArchive(dir string) (*ArchiveFS, error) {
+	p := defaultPacker{}
+	blockPaths, err := listBlocks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	edits, err := loadEdits(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	fsys := &ArchiveFS{
+		files: make(map[string]*archiveEntry),
+		dirs:  map[string][]string{".": nil},
+	}
+	for _, blockPath := range blockPaths {
+		block, err := p.readBlockIndex(blockPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading block %s: %w", filepath.Base(blockPath), err)
+		}
+		edits.apply(block)
+		stamp, err := statBlock(blockPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading block %s: %w", filepath.Base(blockPath), err)
+		}
+		for _, metadata := range block.Files {
+			name := archiveFSName(metadata.Path)
+			if !fs.ValidPath(name) || name == "." {
+				return nil, fmt.Errorf("archived path %s cannot be represented in a filesystem", metadata.Path)
+			}
+			if _, ok := fsys.files[name]; ok {
+				return nil, fmt.Errorf("archived path %s appears more than once", metadata.Path)
+			}
+			if _, ok := fsys.dirs[name]; ok {
+				return nil, fmt.Errorf("archived path %s is both a file and a directory", metadata.Path)
+			}
+			fsys.files[name] = &archiveEntry{
+				metadata:  metadata,
+				blockPath: blockPath,
+				stamp:     stamp,
+				offset:    block.DataOffset + metadata.Offset,
+			}
+			if err := fsys.addParents(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, names := range fsys.dirs {
+		sort.Strings(names)
+	}
+	return fsys, nil
+}
+
+// SetCache makes the filesystem keep the contents of the small files it
+// opens in cache, decompressed and checked against their checksum, so files
+// opened again are served from memory. It must be called before the
+// filesystem is used, and the cache may be shared with other filesystems and
+// with packers
+func (fsys *ArchiveFS) SetCache(cache *BlockCache) {
+	fsys.cache = cache
+}
+
+// archiveFSName converts an archived path into a name within the filesystem
+func archiveFSName(archivedPath string) string {
+	name := path.Clean(strings.ReplaceAll(archivedPath, "\\", "/"))
+	return strings.TrimLeft(name, "/")
+}
+
+// addParents records name in its parent directory, creating the parent
+// directories as needed
+func (fsys *ArchiveFS) addParents(name string) error {
+	for {
+		dir := path.Dir(name)
+		if _, ok := fsys.files[dir]; ok {
+			return fmt.Errorf("archived path %s is both a file and a directory", dir)
+		}
+		_, exists := fsys.dirs[dir]
+		fsys.dirs[dir] = append(fsys.dirs[dir], path.Base(name))
+		if exists || dir == "." {
+			return nil
+		}
+		name = dir
+	}
+}
+
+func (fsys *ArchiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if entry, ok := fsys.files[name]; ok {
+		if fsys.cache.cacheable(entry.stamp, &entry.metadata) {
+			return fsys.openCached(name, entry)
+		}
+		f, err := openBlockFile(entry.blockPath)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &archiveFile{
+			entry:   entry,
+			block:   f,
+			section: contentSection(f, entry.offset, &entry.metadata),
+			hash:    newChecksum(),
+		}, nil
+	}
+
+	if _, ok := fsys.dirs[name]; ok {
+		return &archiveDir{fsys: fsys, name: name}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// openCached opens a file whose contents are served from the cache, reading
+// them into it on the first open
+func (fsys *ArchiveFS) openCached(name string, entry *archiveEntry) (fs.File, error) {
+	data, ok := fsys.cache.cachedFileContents(entry.stamp, entry.offset)
+	if !ok {
+		f, err := openBlockFile(entry.blockPath)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		defer f.Close()
+		stored := io.NewSectionReader(f, entry.offset, entry.metadata.storedSize())
+		if data, err = fsys.cache.fileContents(entry.stamp, entry.offset, &entry.metadata, stored); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	// The contents are verified already
+	return &archiveFile{entry: entry, section: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))}, nil
+}
+
+// ReadDir returns the entries of a directory sorted by name
+func (fsys *ArchiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	names, ok := fsys.dirs[name]
+	if !ok {
+		if _, isFile := fsys.files[name]; isFile {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(names))
+	for _, child := range names {
+		info, _ := fsys.stat(path.Join(name, child))
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+func (fsys *ArchiveFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, ok := fsys.stat(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (fsys *ArchiveFS) stat(name string) (fs.FileInfo, bool) {
+	if entry, ok := fsys.files[name]; ok {
+		return &archiveFileInfo{name: path.Base(name), metadata: &entry.metadata}, true
+	}
+	if _, ok := fsys.dirs[name]; ok {
+		return &archiveFileInfo{name: path.Base(name)}, true
+	}
+	return nil, false
+}
+
+// archiveFileInfo describes a file or directory of an ArchiveFS. Directories
+// are implied by the archived paths and have no metadata of their own
+type archiveFileInfo struct {
+	name     string
+	metadata *FileMetadata // Nil for directories
+}
+
+func (i *archiveFileInfo) Name() string { return i.name }
+func (i *archiveFileInfo) IsDir() bool  { return i.metadata == nil }
+
+func (i *archiveFileInfo) Size() int64 {
+	if i.metadata == nil {
+		return 0
+	}
+	return i.metadata.Size
+}
+
+func (i *archiveFileInfo) Mode() fs.FileMode {
+	if i.metadata == nil {
+		return fs.ModeDir | 0555
+	}
+	return fs.FileMode(i.metadata.Mode) &^ fs.ModeType
+}
+
+func (i *archiveFileInfo) ModTime() time.Time {
+	if i.metadata == nil {
+		return time.Time{}
+	}
+	return i.metadata.ModTime
+}
+
+// Sys returns the archived *FileMetadata of a file, or nil for directories
+func (i *archiveFileInfo) Sys() any {
+	if i.metadata == nil {
+		return nil
+	}
+	return i.metadata
+}
+
+// archiveFile is an open file of an ArchiveFS. Contents read front to back
+// are checked against the archived checksum once the end is reached
+type archiveFile struct {
+	entry   *archiveEntry
+	block   *blockFile // Nil for contents served from the cache
+	section *io.SectionReader
+	hash    hash.Hash // Nil once the file is read out of order
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) {
+	return &archiveFileInfo{name: path.Base(archiveFSName(f.entry.metadata.Path)), metadata: &f.entry.metadata}, nil
+}
+
+func (f *archiveFile) Read(b []byte) (int, error) {
+	n, err := f.section.Read(b)
+	if f.hash != nil {
+		f.hash.Write(b[:n])
+		if err == io.EOF {
+			if err := checkFileChecksum(f.entry.metadata.Path, f.entry.metadata.Checksum, f.hash); err != nil {
+				f.hash = nil
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+func (f *archiveFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.section.ReadAt(b, off)
+}
+
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.section.Seek(offset, whence)
+	if err == nil && pos != 0 {
+		// Only contents read in one pass from the start can be verified
+		f.hash = nil
+	} else if err == nil && f.hash != nil {
+		f.hash.Reset()
+	}
+	return pos, err
+}
+
+func (f *archiveFile) Close() error {
+	if f.block == nil {
+		return nil
+	}
+	return f.block.Close()
+}
+
+// archiveDir is an open directory of an ArchiveFS
+type archiveDir struct {
+	fsys   *ArchiveFS
+	name   string
+	offset int // Number of entries already returned by ReadDir
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) {
+	return &archiveFileInfo{name: path.Base(d.name)}, nil
+}
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *archiveDir) Close() error {
+	return nil
+}
+
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.fsys.ReadDir(d.name)
+	if err != nil {
+		return nil, err
+	}
+	entries = entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
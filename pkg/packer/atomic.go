@@ -0,0 +1,81 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// stagingSuffix is appended to the name of the output directory to name the
+// directory an AtomicUnpack extracts to. It is hidden next to the output
+// directory, on the same filesystem so it can be renamed into place
+const stagingSuffix = ".beam-unpack"
+
+// unpackAtomically runs unpack into a staging directory next to the output
+// directory and renames it into place once it is complete, so the output
+// directory either does not exist or holds every extracted file. Unpacks
+// completing with failed files under ContinueOnError are still renamed into
+// place. An interrupted unpack leaves the staging directory behind for Resume
+// to carry on with, without Resume it is started over
+func (p defaultPacker) unpackAtomically(outputDir string, unpack func(p defaultPacker, dir string) error) error {
+	if err := checkAtomicOutput(outputDir); err != nil {
+		return err
+	}
+	clean := filepath.Clean(outputDir)
+	staging := filepath.Join(filepath.Dir(clean), "."+filepath.Base(clean)+stagingSuffix)
+	if !p.opts.Resume {
+		if err := os.RemoveAll(staging); err != nil {
+			return fmt.Errorf("error removing staging directory: %w", err)
+		}
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	p.opts.AtomicUnpack = false
+	err := unpack(p, staging)
+	var partial *PartialError
+	if err != nil && !errors.As(err, &partial) {
+		if !p.opts.Resume {
+			os.RemoveAll(staging)
+		}
+		return err
+	}
+
+	// An empty output directory is replaced, which takes removing it first on
+	// platforms that do not rename over empty directories
+	if renameErr := os.Rename(staging, outputDir); renameErr != nil {
+		if removeErr := os.Remove(outputDir); removeErr != nil || os.Rename(staging, outputDir) != nil {
+			return fmt.Errorf("error moving staging directory into place: %w", renameErr)
+		}
+	}
+	if p.opts.SyncPolicy != SyncNone {
+		if syncErr := syncDir(filepath.Dir(clean)); syncErr != nil {
+			return syncErr
+		}
+	}
+	p.logger().Debug("Moved staging directory into place", "staging", staging, "output", outputDir)
+	return err
+}
+
+// checkAtomicOutput rejects output directories an AtomicUnpack cannot replace
+// in one rename, any that exist and hold files
+func checkAtomicOutput(outputDir string) error {
+	f, err := os.Open(outputDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking output directory: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		if err != nil {
+			return fmt.Errorf("error checking output directory: %w", err)
+		}
+		return fmt.Errorf("atomic unpack needs a new or empty output directory, %s is not empty: %w", outputDir, ErrInvalidOption)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package packer
+
+import "os"
+
+// fileAttributes is not supported on this platform, dot files are hidden by
+// their name instead
+func fileAttributes(info os.FileInfo) uint32 {
+	return 0
+}
+
+// restoreAttributes is not supported on this platform
+func restoreAttributes(path string, attributes uint32) error {
+	return nil
+}
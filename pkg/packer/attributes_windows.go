@@ -0,0 +1,35 @@
+//go:build windows
+
+package packer
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileAttributes returns the hidden and system attributes of a file
+func fileAttributes(info os.FileInfo) uint32 {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return 0
+	}
+	return data.FileAttributes & (AttributeHidden | AttributeSystem)
+}
+
+// restoreAttributes sets the hidden and system attributes of a file, keeping
+// its other attributes such as read-only
+func restoreAttributes(path string, attributes uint32) error {
+	attributes &= AttributeHidden | AttributeSystem
+	if attributes == 0 {
+		return nil
+	}
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	current, err := syscall.GetFileAttributes(pathp)
+	if err != nil {
+		return err
+	}
+	return syscall.SetFileAttributes(pathp, current|attributes)
+}
@@ -0,0 +1,295 @@
+package packer
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AzureStore is a BlockStore keeping blocks as block blobs in an Azure Blob
+// Storage container. Requests are signed with the shared key of the storage
+// account, or carry a SAS token instead. Blocks up to PartSize are uploaded in
+// one request and larger ones as staged blob blocks committed by a block list.
+// Every request carries the MD5 of its contents, which the service checks
+// before storing them, and the MD5 of the whole block is kept with the blob
+// and checked again by Get
+type AzureStore struct {
+	Account   string       // Name of the storage account
+	Key       string       // Base64 encoded shared key of the account, empty when SAS is set
+	SAS       string       // Shared access signature query string, used instead of Key
+	Container string       // Container holding the blocks
+	Prefix    string       // Prepended to every block name to form its blob name, e.g. "backups/host1/"
+	Endpoint  string       // Base URL of the service, https://<Account>.blob.core.windows.net when empty
+	PartSize  int64        // Largest part a block is uploaded in, 16MB when 0
+	Client    *http.Client // Client sending the requests, http.DefaultClient when nil
+}
+
+// azureVersion is the version of the Blob Storage REST API requests are made
+// against
+const azureVersion = "2021-08-06"
+
+// azureMaxParts is the most blob blocks a block blob can be committed from
+const azureMaxParts = 50000
+
+func (s AzureStore) Put(name string, r io.Reader, size int64) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if size <= partSize {
+		_, err := readParts(r, size, partSize, func(_ int, part uploadPart) error {
+			resp, err := s.do(http.MethodPut, s.Prefix+name, "", part.data, map[string]string{
+				"Content-MD5":    part.md5,
+				"x-ms-blob-type": "BlockBlob",
+			})
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		})
+		return err
+	}
+	if (size+partSize-1)/partSize > azureMaxParts {
+		return fmt.Errorf("block %s needs more than %d parts of %d bytes: %w", name, azureMaxParts, partSize, ErrInvalidOption)
+	}
+
+	// Blob block IDs must all have the same length before base64 encoding
+	var ids []string
+	whole, err := readParts(r, size, partSize, func(i int, part uploadPart) error {
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", i)))
+		resp, err := s.do(http.MethodPut, s.Prefix+name, "comp=block&blockid="+url.QueryEscape(id), part.data, map[string]string{
+			"Content-MD5": part.md5,
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var list strings.Builder
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	listSum := md5.Sum([]byte(list.String()))
+	resp, err := s.do(http.MethodPut, s.Prefix+name, "comp=blocklist", []byte(list.String()), map[string]string{
+		"Content-MD5":           base64.StdEncoding.EncodeToString(listSum[:]),
+		"x-ms-blob-content-md5": base64.StdEncoding.EncodeToString(whole),
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s AzureStore) Get(name string) (io.ReadCloser, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, s.Prefix+name, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifiedReader(resp.Body, name, "MD5", md5.New(), resp.Header.Get("Content-MD5")), nil
+}
+
+func (s AzureStore) Delete(name string) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.Prefix+name, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// azureBlobList is the response of a List Blobs request
+type azureBlobList struct {
+	Blobs []struct {
+		Name string `xml:"Name"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (s AzureStore) List() ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		query := "comp=list&restype=container&prefix=" + url.QueryEscape(s.Prefix)
+		if marker != "" {
+			query += "&marker=" + url.QueryEscape(marker)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result azureBlobList
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding blob list: %w", err)
+		}
+
+		// Only blobs directly below the prefix are blocks of this archive
+		for _, blob := range result.Blobs {
+			name := strings.TrimPrefix(blob.Name, s.Prefix)
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if result.NextMarker == "" {
+			break
+		}
+		marker = result.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// azureError is the error document returned by a failed request
+type azureError struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for the blob, or for the container itself when
+// blob is empty, and returns the response of a successful request
+func (s AzureStore) do(method string, blob string, query string, body []byte, headers map[string]string) (*http.Response, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + s.Account + ".blob.core.windows.net"
+	}
+	u := strings.TrimSuffix(endpoint, "/") + "/" + uriEncode(s.Container, false)
+	if blob != "" {
+		u += "/" + uriEncode(blob, true)
+	}
+	if query != "" {
+		u += "?" + query
+	}
+
+	// Errors show the URL without the signature of a SAS
+	shown := u
+	if sas := strings.TrimPrefix(s.SAS, "?"); sas != "" {
+		if query == "" {
+			u += "?" + sas
+		} else {
+			u += "&" + sas
+		}
+	}
+
+	req, err := http.NewRequest(method, u, bodyOf(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("x-ms-version", azureVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if s.SAS == "" {
+		if err := s.sign(req, int64(len(body))); err != nil {
+			return nil, err
+		}
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var azErr azureError
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&azErr)
+	err = fmt.Errorf("%s %s: %s %s %s", method, shown, resp.Status, azErr.Code, azErr.Message)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	case azErr.Code == "Md5Mismatch" || azErr.Code == "InvalidMd5":
+		err = fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	return nil, err
+}
+
+// sign adds a Shared Key authorization header to req, covering the standard
+// headers, every x-ms-* header and the query parameters
+func (s AzureStore) sign(req *http.Request, size int64) error {
+	key, err := base64.StdEncoding.DecodeString(s.Key)
+	if err != nil {
+		return fmt.Errorf("invalid storage account key: %w", ErrInvalidOption)
+	}
+
+	// The length is signed empty for requests without a body
+	length := ""
+	if size > 0 {
+		length = strconv.FormatInt(size, 10)
+	}
+	var msHeaders []string
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + s.Account + req.URL.EscapedPath()
+	params := req.URL.Query()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+s.Account+":"+signature)
+	return nil
+}
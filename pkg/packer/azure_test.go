@@ -0,0 +1,300 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// azureTestServer is a Blob Storage container checking the Shared Key
+// signature and the Content-MD5 of every request
+type azureTestServer struct {
+	t       *testing.T
+	account string
+	key     []byte
+
+	mu      sync.Mutex
+	blobs   map[string]azureTestBlob
+	staged  map[string]map[string][]byte // Uncommitted blob blocks by blob and block ID
+	damage  bool                         // Flips a byte of the next body received
+	corrupt string                       // Blob served with a flipped byte
+}
+
+type azureTestBlob struct {
+	data []byte
+	md5  string
+}
+
+// newAzureTestServer returns a server for the container and a store on it
+func newAzureTestServer(t *testing.T) (*azureTestServer, AzureStore) {
+	s := &azureTestServer{
+		t:       t,
+		account: "testaccount",
+		key:     []byte("azure test account key"),
+		blobs:   make(map[string]azureTestBlob),
+		staged:  make(map[string]map[string][]byte),
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, AzureStore{
+		Account:   s.account,
+		Key:       base64.StdEncoding.EncodeToString(s.key),
+		Container: "blocks",
+		Endpoint:  server.URL,
+		Client:    server.Client(),
+	}
+}
+
+// signature computes the Shared Key signature of a request as the service does
+func (s *azureTestServer) signature(r *http.Request) string {
+	length := ""
+	if r.ContentLength > 0 {
+		length = strconv.FormatInt(r.ContentLength, 10)
+	}
+	var headers []string
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name+":"+r.Header.Get(name))
+		}
+	}
+	sort.Strings(headers)
+	resource := "/" + s.account + r.URL.EscapedPath()
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource += "\n" + name + ":" + strings.Join(query[name], ",")
+	}
+	stringToSign := r.Method + "\n" +
+		r.Header.Get("Content-Encoding") + "\n" +
+		r.Header.Get("Content-Language") + "\n" +
+		length + "\n" +
+		r.Header.Get("Content-MD5") + "\n" +
+		r.Header.Get("Content-Type") + "\n" +
+		"\n" + // Date
+		r.Header.Get("If-Modified-Since") + "\n" +
+		r.Header.Get("If-Match") + "\n" +
+		r.Header.Get("If-None-Match") + "\n" +
+		r.Header.Get("If-Unmodified-Since") + "\n" +
+		r.Header.Get("Range") + "\n" +
+		strings.Join(headers, "\n") + "\n" +
+		resource
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(stringToSign))
+	return "SharedKey " + s.account + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *azureTestServer) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	w.Write([]byte("<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>" + code + "</Code><Message>test server</Message></Error>"))
+}
+
+func (s *azureTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		s.fail(w, http.StatusBadRequest, "MissingRequiredHeader")
+		return
+	}
+	if r.Header.Get("Authorization") != s.signature(r) {
+		s.fail(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	if s.damage && len(body) > 0 {
+		s.damage = false
+		body[len(body)/2] ^= 0xff
+	}
+	if sum := r.Header.Get("Content-MD5"); sum != "" && sum != md5String(body) {
+		s.fail(w, http.StatusBadRequest, "Md5Mismatch")
+		return
+	}
+
+	container, blob, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if container != "blocks" {
+		s.fail(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && blob == "" && query.Get("comp") == "list":
+		s.list(w, query.Get("prefix"), query.Get("marker"))
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if s.staged[blob] == nil {
+			s.staged[blob] = make(map[string][]byte)
+		}
+		s.staged[blob][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			s.fail(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := s.staged[blob][id]
+			if !ok || len(id) != len(list.Latest[0]) {
+				s.fail(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			data = append(data, block...)
+		}
+		delete(s.staged, blob)
+		s.blobs[blob] = azureTestBlob{data: data, md5: r.Header.Get("x-ms-blob-content-md5")}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			s.fail(w, http.StatusBadRequest, "MissingRequiredHeader")
+			return
+		}
+		s.blobs[blob] = azureTestBlob{data: body, md5: md5String(body)}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		b, ok := s.blobs[blob]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		data := bytes.Clone(b.data)
+		if blob == s.corrupt {
+			data[0] ^= 0xff
+		}
+		w.Header().Set("Content-MD5", b.md5)
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		if _, ok := s.blobs[blob]; !ok {
+			s.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(s.blobs, blob)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.fail(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+// list answers List Blobs two blobs at a time, so the marker is followed
+func (s *azureTestServer) list(w http.ResponseWriter, prefix string, marker string) {
+	var names []string
+	for name := range s.blobs {
+		if strings.HasPrefix(name, prefix) && name > marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for i, name := range names {
+		if i == 2 {
+			b.WriteString("</Blobs><NextMarker>" + names[i-1] + "</NextMarker><Blobs>")
+			break
+		}
+		b.WriteString("<Blob><Name>" + name + "</Name></Blob>")
+	}
+	b.WriteString("</Blobs></EnumerationResults>")
+	w.Write([]byte(b.String()))
+}
+
+func md5String(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestAzureStore(t *testing.T) {
+	server, store := newAzureTestServer(t)
+	store.Prefix = "backups/host1/"
+	store.PartSize = 1000
+
+	blocks := map[string][]byte{
+		"block-1.beam": testVectorData("block-1", 4500), // Committed from a block list of 5 parts
+		"block-2.beam": testVectorData("block-2", 1000),
+		"empty.beam":   nil,
+	}
+	for name, data := range blocks {
+		if err := store.Put(name, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+	}
+	server.blobs["backups/host1/nested/other.beam"] = azureTestBlob{}
+	server.blobs["backups/host2/block-1.beam"] = azureTestBlob{}
+
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "block-1.beam,block-2.beam,empty.beam" {
+		t.Errorf("listed %q", names)
+	}
+	for name, data := range blocks {
+		if got := getBlock(t, store, name); !bytes.Equal(got, data) {
+			t.Errorf("got %d bytes of %s, want %d", len(got), name, len(data))
+		}
+	}
+
+	if err := store.Delete("block-2.beam"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("block-2.beam"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("get of a deleted block returned %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestAzureStoreChecksums(t *testing.T) {
+	server, store := newAzureTestServer(t)
+	store.PartSize = 1000
+	data := testVectorData("block", 2500)
+
+	// A part damaged on its way is refused by the service
+	server.damage = true
+	if err := store.Put("block-1.beam", bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("put of a damaged part returned %v, want ErrCorrupted", err)
+	}
+
+	// A block damaged in the store does not match the MD5 kept with it
+	if err := store.Put("block-1.beam", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	server.corrupt = "block-1.beam"
+	rc, err := store.Get("block-1.beam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("reading a damaged block returned %v, want ErrCorrupted", err)
+	}
+}
+
+func TestAzureStoreSignature(t *testing.T) {
+	server, store := newAzureTestServer(t)
+	store.Key = base64.StdEncoding.EncodeToString([]byte("some other key"))
+	if err := store.Put("block-1.beam", strings.NewReader("data"), 4); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Errorf("put signed with the wrong key returned %v", err)
+	}
+	if len(server.blobs) != 0 {
+		t.Error("a request signed with the wrong key was served")
+	}
+}
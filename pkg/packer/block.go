@@ -0,0 +1,1021 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Block is a block file being written or read, holding the metadata of its files
+type Block struct {
+	ID         int32          // Unique ID of the block
+	Files      []FileMetadata // Files contained in the block
+	Size       int64          // Current size of the block
+	Checksum   []byte         // SHA-256 checksum of the block
+	Writer     io.Writer      // Writer for block content
+	DataOffset int64          // Offset of the file data section within the block file
+
+	fileName string           // Name of the block file once written
+	length   int64            // Bytes of the block file or stream frame once written
+	volumes  []ManifestVolume // Volumes the block file was split into, none when it is whole
+
+	stamp     blockStamp // Block file the block was read from, set when it is read through a BlockCache
+	encrypted bool       // The metadata was read encrypted
+}
+
+// blockHeaderSize is the size of the block ID and file count preceding the metadata
+const blockHeaderSize = 8
+
+// blockFileName returns the file name of a block
+func blockFileName(id int32) string {
+	return fmt.Sprintf("block-%d.beam", id)
+}
+
+// contentOpener opens the contents of a file that is written into a block
+type contentOpener func(metadata *FileMetadata) (io.ReadCloser, error)
+
+// openSourceFile opens a file from its original path on disk
+func openSourceFile(metadata *FileMetadata) (io.ReadCloser, error) {
+	return os.Open(metadata.source())
+}
+
+// addFileToBlock adds a file to a block with corresponding metadata. The
+// checksum is filled in once the file contents are written
+func (p defaultPacker) addFileToBlock(block *Block, file *FileInfo) error {
+	// Create metadata
+	metaData := &FileMetadata{
+		Path:    file.ArchivePath,
+		Size:    file.Size,
+		ModTime: file.ModTime,
+		Mode:    file.Mode,
+		BlockID: block.ID,
+		Offset:  block.Size,
+	}
+
+	if file.ArchivePath != file.Path {
+		metaData.sourcePath = file.Path
+	}
+
+	// Windows attributes and holes are always recorded, like the mode.
+	// Transformed contents do not keep the holes of the file on disk
+	metaData.Attributes = file.Attributes
+	metaData.Holes = file.Holes
+	metaData.Device = file.Device
+	if p.opts.Transform != nil && !isSpecialMode(file.Mode) {
+		metaData.Holes, metaData.transformed = nil, true
+	}
+
+	// Capture ownership
+	if p.opts.PreserveOwner {
+		metaData.Uid = file.Uid
+		metaData.Gid = file.Gid
+	}
+
+	if p.opts.PreserveBirthTime {
+		metaData.BirthTime = file.BirthTime
+	}
+
+	// Capture extended attributes
+	if p.preservesXattrs() {
+		names, err := p.captureNames(file.Path)
+		if err != nil {
+			return fmt.Errorf("error listing extended attributes for file %s: %w", file.Path, err)
+		}
+		xattrs, err := captureXattrs(file.Path, names)
+		if err != nil {
+			return fmt.Errorf("error capturing extended attributes for file %s: %w", file.Path, err)
+		}
+		metaData.Xattrs = xattrs
+	}
+
+	// Update block
+	block.Files = append(block.Files, *metaData)
+	block.Size += file.Size
+
+	return nil
+}
+
+// archiveFileMode is the mode of the block, manifest and other archive files,
+// which stay readable by other users and backup agents as with os.Create
+const archiveFileMode = 0644
+
+// createArchiveTemp creates a temporary file in dir to be renamed into place
+// as an archive file. os.CreateTemp creates files only their owner can read,
+// so the file is given archiveFileMode first
+func createArchiveTemp(dir string, pattern string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(archiveFileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeBlock writes a block file, or a zip volume in the zip format, reading
+// the contents of each file through open. The block is written to a temporary
+// file first and renamed once its checksum, which the block name may depend
+// on, is known
+func (p defaultPacker) writeBlock(block *Block, outputDir string, open contentOpener) error {
+	f, err := createArchiveTemp(outputDir, blockFileName(block.ID)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Space for the header, data and footer is reserved up front, the space
+	// left over by files dropped, compressed or with zero runs left out is
+	// released below
+	if err := preallocate(f, blockHeaderSize+block.Size+blockFooterSize); err != nil {
+		return err
+	}
+
+	if p.opts.Format == FormatZip {
+		if err := p.writeZipTo(f, block, open); err != nil {
+			return err
+		}
+	} else {
+		// Writes are buffered so small files and metadata records reach the
+		// file in segments instead of one write each
+		count := len(block.Files)
+		bw := bufio.NewWriterSize(f, smallSegmentSize)
+		if err := p.writeBlockTrailingTo(bw, block, open); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if len(block.Files) != count && !p.encryptsMetadata() {
+			if err := rewriteFileCount(f, block); err != nil {
+				return fmt.Errorf("error updating file count of block %d: %w", block.ID, err)
+			}
+		}
+	}
+	if block.length, err = f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if err := f.Truncate(block.length); err != nil {
+		return err
+	}
+	name, err := p.blockName(block.ID, block.Checksum)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(outputDir, name)
+
+	// Blocks larger than VolumeSize are copied into volumes, the whole block
+	// is only ever the temporary file
+	block.volumes = nil
+	if p.opts.VolumeSize > 0 && block.length > p.opts.VolumeSize {
+		if block.volumes, err = p.writeVolumes(f, block.length, path); err != nil {
+			return fmt.Errorf("error splitting block %d: %w", block.ID, err)
+		}
+	} else {
+		if err := p.syncs.block(f); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), path); err != nil {
+			return fmt.Errorf("error naming block %d: %w", block.ID, err)
+		}
+		if err := p.syncs.named(path); err != nil {
+			return err
+		}
+	}
+	if err := removeStaleVolumes(path, len(block.volumes)); err != nil {
+		return fmt.Errorf("error removing old volumes of block %d: %w", block.ID, err)
+	}
+	block.fileName = name
+	p.logger().Debug("Wrote block", "block", block.ID, "name", name, "files", len(block.Files), "size", block.length, "volumes", len(block.volumes))
+	return nil
+}
+
+// rewriteFileCount corrects the header of a block written to f after files
+// that failed to read were dropped from it. The header is hashed before any
+// file is read, so the footer is written again with a new checksum
+func rewriteFileCount(f *os.File, block *Block) error {
+	var count [4]byte
+	binary.LittleEndian.PutUint32(count[:], uint32(len(block.Files)))
+	if _, err := f.WriteAt(count[:], 4); err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	footer, err := readBlockFooter(f, info.Size())
+	if err != nil {
+		return err
+	}
+	footerStart := info.Size() - footer.Length
+
+	h := newChecksum()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, footerStart)); err != nil {
+		return err
+	}
+	footer.Checksum = h.Sum(nil)
+	footer.PayloadLength = footerStart
+	if err := f.Truncate(footerStart); err != nil {
+		return err
+	}
+	if _, err := f.Seek(footerStart, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeBlockFooter(f, footer); err != nil {
+		return err
+	}
+	block.Checksum = footer.Checksum
+	return nil
+}
+
+// hashBlockFiles calculates the checksum of every file in the block ahead of
+// writing it, as needed when the metadata precedes the file contents. With
+// MultiBufferHashing the files are hashed side by side, a lane each
+func (p defaultPacker) hashBlockFiles(block *Block, open contentOpener) error {
+	lanes := 1
+	if p.opts.MultiBufferHashing {
+		lanes = multiBufferLanes
+	}
+	for start := 0; start < len(block.Files); start += lanes {
+		if err := p.hashFiles(block.Files[start:min(start+lanes, len(block.Files))], open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashFiles calculates the checksums of files together, reading a buffer of
+// each in turn so their hashes advance in step
+func (p defaultPacker) hashFiles(files []FileMetadata, open contentOpener) error {
+	hashes := p.newChecksums(len(files))
+	readers := make([]io.Reader, len(files))
+	remaining := make([]int64, len(files))
+	for i := range files {
+		f, err := open(&files[i])
+		if err != nil {
+			return fmt.Errorf("error opening file: %w", err)
+		}
+		defer f.Close()
+		readers[i] = p.wrapReader(f)
+		remaining[i] = files[i].Size
+	}
+
+	buf := p.buffers.get()
+	defer p.buffers.put(buf)
+	for done := false; !done; {
+		done = true
+		for i, r := range readers {
+			if remaining[i] == 0 {
+				continue
+			}
+			chunk := (*buf)[:min(int64(len(*buf)), remaining[i])]
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					err = io.EOF
+				}
+				return fmt.Errorf("error calculating checksum for file %s: %w", files[i].Path, err)
+			}
+			hashes[i].Write(chunk)
+			remaining[i] -= int64(len(chunk))
+			done = done && remaining[i] == 0
+		}
+	}
+	for i := range files {
+		files[i].Checksum = hashes[i].Sum(nil)
+	}
+	return nil
+}
+
+// encodeBlockHeader encodes the block header and file metadata section with
+// the optional fields of the footer flags
+func (p defaultPacker) encodeBlockHeader(block *Block, flags uint32) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// Write block ID
+	if err := binary.Write(&buf, binary.LittleEndian, block.ID); err != nil {
+		return nil, err
+	}
+
+	// Write number of files in block
+	if err := binary.Write(&buf, binary.LittleEndian, int32(len(block.Files))); err != nil {
+		return nil, err
+	}
+
+	// Write metadata for each file
+	for i := range block.Files {
+		var prev *FileMetadata
+		if i > 0 {
+			prev = &block.Files[i-1]
+		}
+		if err := p.writeMetadata(&buf, &block.Files[i], prev, flags); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBlockTo writes a complete block to w with the file metadata preceding
+// the data section, so every checksum must already be known. It is used for
+// stream archives, which are extracted without seeking
+func (p defaultPacker) writeBlockTo(dst io.Writer, block *Block, open contentOpener) error {
+	dst = p.wrapWriter(dst)
+
+	// Write block data, counting the bytes preceding the footer
+	h := newChecksum()
+	payload := &countingWriter{w: dst}
+	w := io.MultiWriter(payload, h)
+
+	// Write block header and metadata
+	header, err := p.encodeBlockHeader(block, streamBlockFlags)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	// Write file contents. The checksums written ahead of them are checked
+	// again as they are copied, a source file that changed in between fails
+	// the block under any ChangedFilePolicy as the header is already written
+	for _, metadata := range block.Files {
+		f, err := open(&metadata)
+		if err != nil {
+			return fmt.Errorf("failed to open file %s: %w", metadata.Path, err)
+		}
+		fh := newChecksum()
+		if _, err := p.buffers.copyN(io.MultiWriter(w, fh), p.wrapReader(f), metadata.Size); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write file %s: %w", metadata.Path, err)
+		}
+		f.Close()
+		if checksum := fh.Sum(nil); !checksumsEqual(checksum, metadata.Checksum) {
+			return fmt.Errorf("file %s changed after it was hashed: %w", metadata.Path, ErrFileChanged)
+		}
+		if err := p.checkUnchanged(&metadata); err != nil {
+			return fmt.Errorf("failed to write file %s: %w", metadata.Path, err)
+		}
+		p.progress.file(&metadata, false)
+		p.pace.wait()
+	}
+
+	// Write block footer, the checksum covers everything written so far
+	footer := &BlockFooter{
+		Checksum:       h.Sum(nil),
+		MetadataOffset: blockHeaderSize,
+		Flags:          streamBlockFlags,
+		PayloadLength:  payload.n,
+	}
+	if err := writeBlockFooter(dst, footer); err != nil {
+		return fmt.Errorf("failed to write block footer: %w", err)
+	}
+	block.Checksum = footer.Checksum
+
+	return nil
+}
+
+// writeBlockTrailingTo writes a complete block to w in a single pass over the
+// file contents. Each file is hashed while it is copied into the data section
+// and the metadata section is written after it. Checksums that are already
+// known, such as when copying files between archives, are verified instead
+func (p defaultPacker) writeBlockTrailingTo(dst io.Writer, block *Block, open contentOpener) error {
+	dst = p.wrapWriter(dst)
+
+	// Write block data, counting the bytes preceding the footer
+	h := newChecksum()
+	payload := &countingWriter{w: dst}
+	w := io.MultiWriter(payload, h)
+
+	// Write block header
+	if err := binary.Write(w, binary.LittleEndian, block.ID); err != nil {
+		return err
+	}
+	// Encrypted metadata holds the file count, the header records 0 files
+	count := int32(len(block.Files))
+	if p.encryptsMetadata() {
+		count = 0
+	}
+	if err := binary.Write(w, binary.LittleEndian, count); err != nil {
+		return err
+	}
+
+	// Write file contents, hashing each file on the way. Files whose source
+	// fails are dropped from the block when failures are collected, the bytes
+	// already copied stay in the data section unreferenced
+	ahead := newReadAhead(p.opts.ReadWorkers, block.Files, open)
+	defer ahead.close()
+	var dataSize int64
+	kept := block.Files[:0]
+	for i := range block.Files {
+		metadata := &block.Files[i]
+		f, err := ahead.openFile(i, metadata, open)
+		if err != nil {
+			if err := p.failures.skip(metadata.source(), fmt.Errorf("failed to open file: %w", err)); err != nil {
+				return fmt.Errorf("failed to open file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+
+		copied, err := p.copyFile(w, f, metadata)
+
+		// Files that changed while they were read are read again as they are
+		// now with ChangedFileRetry, the bytes of each earlier copy stay in the
+		// data section unreferenced
+		for retries := 0; errors.Is(err, ErrFileChanged) && p.opts.ChangedFiles == ChangedFileRetry && retries < changedFileRetries; retries++ {
+			p.logger().Warn("File changed while it was packed, reading it again", "path", metadata.source(), "error", err)
+			dataSize += copied.stored
+			if err = replan(metadata); err == nil {
+				f, err = open(metadata)
+			}
+			if err != nil {
+				copied = copiedFile{source: true}
+				break
+			}
+			copied, err = p.copyFile(w, f, metadata)
+		}
+		if err != nil {
+			if errors.Is(err, ErrFileChanged) && p.opts.ChangedFiles == ChangedFileSkip {
+				p.logger().Warn("Skipping file that changed while it was packed", "path", metadata.source(), "error", err)
+				dataSize += copied.stored
+				continue
+			}
+			// Only failures of the source itself, not of the block, are skipped
+			if copied.source || errors.Is(err, io.EOF) || errors.Is(err, ErrFileTooLarge) {
+				if err := p.failures.skip(metadata.source(), fmt.Errorf("failed to read file: %w", err)); err == nil {
+					dataSize += copied.stored
+					continue
+				}
+			}
+			return fmt.Errorf("failed to write file %s: %w", metadata.Path, err)
+		}
+		metadata.Size = copied.written
+		metadata.ZeroRuns = copied.zeroRuns
+		metadata.Compression = copied.compression
+		metadata.CompressedSize = 0
+		if copied.compression != CompressionNone {
+			metadata.CompressedSize = copied.stored
+		}
+		if metadata.Checksum != nil && !checksumsEqual(metadata.Checksum, copied.checksum) {
+			return &FileIntegrityError{Path: metadata.Path, ExpectedSum: metadata.Checksum, ActualSum: copied.checksum}
+		}
+		metadata.Checksum = copied.checksum
+		metadata.Offset = dataSize
+		dataSize += copied.stored
+		p.progress.file(metadata, false)
+		p.filePacked(metadata)
+		p.pace.wait()
+		kept = append(kept, *metadata)
+	}
+	block.Files = kept
+	block.Size = dataSize
+
+	// Write metadata for each file. Attributes, holes, zero runs, the
+	// compression method and device numbers are only recorded when a file has
+	// any, so blocks without them stay readable by older versions
+	flags := footerFlagTrailingMetadata | footerFlagBirthTime
+	for i := range block.Files {
+		if block.Files[i].Attributes != 0 {
+			flags |= footerFlagAttributes
+		}
+		if len(block.Files[i].Holes) > 0 {
+			flags |= footerFlagHoles
+		}
+		if len(block.Files[i].ZeroRuns) > 0 {
+			flags |= footerFlagZeroRuns
+		}
+		if block.Files[i].Compression != CompressionNone {
+			flags |= footerFlagCompression
+		}
+		if block.Files[i].Device != 0 {
+			flags |= footerFlagDevices
+		}
+	}
+	if p.opts.CompactMetadata {
+		flags |= footerFlagCompactMetadata
+	}
+	if p.opts.CBORMetadata {
+		flags |= footerFlagCBORMetadata
+	}
+	key, keyHeader, err := p.metadataWriteKey()
+	if err != nil {
+		return err
+	}
+	var records bytes.Buffer
+	mw := w
+	if key != nil {
+		flags |= footerFlagEncrypted
+		mw = &records
+	}
+	if keyHeader != nil {
+		flags |= footerFlagPassphrase
+	}
+	for i := range block.Files {
+		var prev *FileMetadata
+		if i > 0 {
+			prev = &block.Files[i-1]
+		}
+		if err := p.writeMetadata(mw, &block.Files[i], prev, flags); err != nil {
+			return err
+		}
+	}
+	if key != nil {
+		sealed, err := sealMetadata(key, block.ID, flags, len(block.Files), records.Bytes())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+	}
+
+	// Write block footer, the checksum covers everything written so far
+	footer := &BlockFooter{
+		Checksum:       h.Sum(nil),
+		MetadataOffset: blockHeaderSize + dataSize,
+		Flags:          flags,
+		KeyHeader:      keyHeader,
+		PayloadLength:  payload.n,
+	}
+	if err := writeBlockFooter(dst, footer); err != nil {
+		return fmt.Errorf("failed to write block footer: %w", err)
+	}
+	block.Checksum = footer.Checksum
+
+	return nil
+}
+
+// copiedFile is a file copied into the data section of a block
+type copiedFile struct {
+	written     int64       // Bytes of contents read
+	stored      int64       // Bytes written to the data section, compressed or less the zero runs left out
+	zeroRuns    []Extent    // Zero runs left out of the data section
+	compression Compression // How the contents were compressed
+	checksum    []byte      // SHA-256 checksum of the contents
+	source      bool        // Whether the copy failed reading the source rather than writing the block
+}
+
+// copyFile copies the contents of a file read from f into the data section
+// written to w and closes f. With Compression files are compressed unless
+// their format is compressed already or a sample of their start looks like
+// it, and long zero runs are left out of stored files with ZeroRunEncoding.
+// Files copied from compressed or encoded blocks stay so. Source files that
+// changed while they were read fail with ErrFileChanged
+func (p defaultPacker) copyFile(w io.Writer, f io.ReadCloser, metadata *FileMetadata) (copiedFile, error) {
+	fh := newChecksum()
+	src := &sourceReader{r: p.transformReader(metadata, p.wrapReader(f))}
+	var r io.Reader = src
+	method := p.compressionFor(metadata)
+	if method != CompressionNone && metadata.Compression == CompressionNone {
+		br := bufio.NewReaderSize(src, compressionSample)
+		sample, _ := br.Peek(compressionSample)
+		if entropy(sample) > maxCompressEntropy {
+			method = CompressionNone
+		}
+		r = br
+	}
+	// Contents new to the archive are scanned, not those copied from blocks
+	var hashed io.Writer = fh
+	var sw *scanWriter
+	if p.scansPack() && metadata.Checksum == nil {
+		sw = p.newScanWriter(metadata.Path)
+		hashed = io.MultiWriter(fh, sw)
+	}
+	var dst io.Writer = w
+	var zw *zeroRunWriter
+	var cw *compressWriter
+	switch {
+	case method != CompressionNone:
+		var err error
+		if cw, err = p.newCompressWriter(w, method); err != nil {
+			f.Close()
+			return copiedFile{}, err
+		}
+		dst = cw
+	case p.opts.ZeroRunEncoding || len(metadata.ZeroRuns) > 0:
+		zw = &zeroRunWriter{w: w}
+		dst = zw
+	}
+	var written int64
+	var err error
+	if metadata.Size == unknownSize || metadata.transformed {
+		// Read until the source ends, it must still fit in a block
+		written, err = p.buffers.copy(io.MultiWriter(dst, hashed), io.LimitReader(r, p.opts.BlockSize+1))
+		if err == nil && written > p.opts.BlockSize {
+			err = ErrFileTooLarge
+		}
+	} else {
+		written, err = p.buffers.copyN(io.MultiWriter(dst, hashed), r, metadata.Size)
+	}
+	f.Close()
+	var rejected error
+	if sw != nil {
+		if scanErr := sw.finish(err); scanErr != nil && err == nil {
+			rejected = scanError(metadata.Path, scanErr)
+		}
+	}
+	if err == nil && zw != nil {
+		err = zw.flush()
+	}
+	if err == nil && cw != nil {
+		err = cw.flush()
+	}
+	copied := copiedFile{written: written, stored: written, source: src.err != nil}
+	if zw != nil {
+		copied.stored = zw.stored
+		copied.zeroRuns = zw.runs
+	}
+	if cw != nil {
+		copied.stored = cw.stored.n
+		copied.compression = method
+	}
+	if err == nil {
+		if err = p.checkUnchanged(metadata); err != nil {
+			copied.source = true
+		}
+	}
+	if err == nil && rejected != nil {
+		// Rejected files are skipped like files that fail to read
+		err, copied.source = rejected, true
+	}
+	copied.checksum = fh.Sum(nil)
+	return copied, err
+}
+
+// readBlockHeader reads the block header and file metadata section of a block
+// whose metadata precedes the data, leaving the reader positioned at the start
+// of the file data section
+func (p defaultPacker) readBlockHeader(r io.Reader, flags uint32) (*Block, error) {
+	block, numFiles, err := readBlockStart(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.readMetadataSection(r, block, numFiles, flags); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// readBlockStart reads the block ID and number of files at the start of a block
+func readBlockStart(r io.Reader) (*Block, int32, error) {
+	block := &Block{}
+
+	// Read block ID
+	if err := binary.Read(r, binary.LittleEndian, &block.ID); err != nil {
+		return nil, 0, fmt.Errorf("error reading block ID: %w", err)
+	}
+
+	// Read number of files in block
+	var numFiles int32
+	if err := binary.Read(r, binary.LittleEndian, &numFiles); err != nil {
+		return nil, 0, fmt.Errorf("error reading number of files in block: %w", err)
+	}
+
+	if numFiles < 0 {
+		return nil, 0, fmt.Errorf("invalid number of files in block %d: %w", numFiles, ErrCorrupted)
+	}
+	return block, numFiles, nil
+}
+
+// readMetadataSection reads the metadata of numFiles files into the block
+func (p defaultPacker) readMetadataSection(r io.Reader, block *Block, numFiles int32, flags uint32) error {
+	// Read metadata for each file, the slice grows as entries are read so a
+	// corrupt file count cannot force a huge allocation
+	// Compact records are read through a buffer, which may read past them. It
+	// is only used for them as other records can precede the data section
+	mr := r
+	if flags&footerFlagCompactMetadata != 0 {
+		mr = asMetadataReader(r)
+	}
+	var prev *FileMetadata
+	for i := int32(0); i < numFiles; i++ {
+		metadata, err := p.readMetadata(mr, prev, flags)
+		if err != nil {
+			return fmt.Errorf("error reading metadata for file %d: %w", i, err)
+		}
+		if metadata.Size < 0 || metadata.Offset < 0 {
+			return fmt.Errorf("invalid size or offset for file %d: %w", i, ErrCorrupted)
+		}
+		metadata.BlockID = block.ID
+		block.Files = append(block.Files, *metadata)
+		block.Size += metadata.storedSize()
+		prev = metadata
+	}
+
+	return nil
+}
+
+// readBlockIndex reads the header and file metadata of a block file, which
+// may be stored before or after the data section as recorded in the footer.
+// With a BlockCache, the index is read once for every time the block is written
+func (p defaultPacker) readBlockIndex(blockPath string) (*Block, error) {
+	var stamp blockStamp
+	if p.opts.BlockCache != nil {
+		var err error
+		if stamp, err = statBlock(blockPath); err != nil {
+			return nil, fmt.Errorf("error opening block file: %w", err)
+		}
+		if block, ok := p.opts.BlockCache.blockIndex(stamp); ok {
+			return block, nil
+		}
+	}
+
+	f, err := openBlockFile(blockPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening block file: %w", err)
+	}
+	defer f.Close()
+	block, err := p.readBlockIndexAt(f, f.Size())
+	if err != nil {
+		return nil, err
+	}
+	block.stamp = stamp
+	p.opts.BlockCache.putBlockIndex(block)
+	return block, nil
+}
+
+// readBlockIndexAt reads the header and file metadata of a block of the given
+// size read through f
+func (p defaultPacker) readBlockIndexAt(f io.ReaderAt, size int64) (*Block, error) {
+	footer, err := readBlockFooter(f, size)
+	if err != nil {
+		return nil, fmt.Errorf("error reading block footer: %w", err)
+	}
+	if err := footer.checkLayout(size); err != nil {
+		return nil, err
+	}
+
+	if footer.Flags&footerFlagTrailingMetadata == 0 {
+		if footer.Flags&(footerFlagCompactMetadata|footerFlagEncrypted|footerFlagCBORMetadata) != 0 {
+			return nil, fmt.Errorf("compact, encrypted or CBOR metadata before the data section: %w", ErrCorrupted)
+		}
+		r := &countingReader{r: bufio.NewReader(io.NewSectionReader(f, 0, size))}
+		block, err := p.readBlockHeader(r, footer.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		// The data section follows the metadata section
+		block.DataOffset = r.n
+		block.Checksum = footer.Checksum
+		return block, nil
+	}
+
+	block, numFiles, err := readBlockStart(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	block.DataOffset = blockHeaderSize
+	block.Checksum = footer.Checksum
+
+	// The metadata section sits between the data section and the footer
+	metadataEnd := size - footer.Length
+	var section io.Reader = io.NewSectionReader(f, footer.MetadataOffset, metadataEnd-footer.MetadataOffset)
+	if footer.Flags&footerFlagEncrypted != 0 {
+		if numFiles, section, err = p.openMetadata(section, block.ID, footer); err != nil {
+			return nil, err
+		}
+		block.encrypted = true
+	}
+	if err := p.readMetadataSection(bufio.NewReader(section), block, numFiles, footer.Flags); err != nil {
+		return nil, err
+	}
+
+	// Every file must lie within the data section
+	dataSize := footer.MetadataOffset - blockHeaderSize
+	for _, metadata := range block.Files {
+		if metadata.Offset > dataSize || metadata.storedSize() > dataSize-metadata.Offset {
+			return nil, fmt.Errorf("file %s extends past the data section: %w", metadata.Path, ErrCorrupted)
+		}
+	}
+	return block, nil
+}
+
+// extractFile writes a file to the output directory. When a verifier is given
+// the checksum is verified in the background and reported by verifier.wait
+func (p *defaultPacker) extractFile(r io.Reader, outputDir string, metadata *FileMetadata, verify *verifier) error {
+	// Create output file
+	outputPath, err := p.extractPath(outputDir, metadata.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fmt.Errorf("error creating directory for file: %w", err)
+	}
+
+	// Special files are created, they have no contents to write
+	if isSpecialMode(metadata.Mode) {
+		if outputPath, err = p.extractSpecial(outputPath, metadata); err != nil {
+			return err
+		}
+		return p.restoreFileMetadata(outputPath, metadata)
+	}
+
+	// Wait for the destination to accept another writer
+	limit := p.destinations.match(outputPath)
+	if limit != nil {
+		defer limit.acquire()()
+	}
+
+	// Open output file, an existing one is handled by OverwritePolicy
+	f, outputPath, err := p.createOutput(outputPath, metadata)
+	if err != nil {
+		if errors.Is(err, ErrFileExists) {
+			return err
+		}
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	defer f.Close()
+
+	// Sparse files are written around their holes
+	var sparse *sparseWriter
+	if len(metadata.Holes) == 0 {
+		if err := preallocate(f, metadata.Size); err != nil {
+			return err
+		}
+	}
+	var out io.Writer = p.wrapWriter(f)
+	if len(metadata.Holes) > 0 {
+		if sparse, err = newSparseWriter(f, metadata.Holes); err != nil {
+			return fmt.Errorf("error creating sparse file: %w", err)
+		}
+		out = p.wrapWriter(sparse)
+	}
+	if limit != nil {
+		out = limit.writer(out)
+	}
+
+	if verify != nil {
+		// Hand the contents to a hash worker while they are written
+		fv := verify.begin(metadata)
+		_, err := p.buffers.copyN(io.MultiWriter(out, fv), p.wrapReader(r), metadata.Size)
+		fv.close(err == nil)
+		if err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	} else {
+		h := newChecksum()
+		w := io.MultiWriter(out, h)
+
+		// Copy file contents
+		if _, err := p.buffers.copyN(w, p.wrapReader(r), metadata.Size); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+
+		// Verify checksum
+		if err := checkFileChecksum(metadata.Path, metadata.Checksum, h); err != nil {
+			return err
+		}
+	}
+
+	if sparse != nil {
+		if err := sparse.finish(); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	if err := p.syncs.extracted(f, outputPath); err != nil {
+		return err
+	}
+	return p.restoreFileMetadata(outputPath, metadata)
+}
+
+// restoreFileMetadata restores the times, owner, extended attributes, mode
+// and Windows attributes of an extracted file. Missing support or privileges
+// for the owner and extended attributes are returned once the rest is restored
+func (p *defaultPacker) restoreFileMetadata(outputPath string, metadata *FileMetadata) error {
+	// Set file modification time
+	if err := os.Chtimes(outputPath, metadata.ModTime, metadata.ModTime); err != nil {
+		return fmt.Errorf("error setting file modification time: %w", err)
+	}
+
+	// Set file birth time where the platform allows it
+	if p.opts.PreserveBirthTime && !metadata.BirthTime.IsZero() {
+		if err := restoreBirthTime(outputPath, metadata.BirthTime); err != nil && !errors.Is(err, errBirthTimeUnsupported) {
+			return fmt.Errorf("error setting file birth time: %w", err)
+		}
+	}
+
+	// Restore ownership and extended attributes. The file contents are already
+	// in place so an unsupported filesystem or missing privileges are reported
+	// back rather than treated as fatal. Ownership goes first as changing it
+	// clears file capabilities
+	var restoreErr error
+	if p.opts.PreserveOwner {
+		if err := restoreOwner(outputPath, metadata); err != nil {
+			if !errors.Is(err, errOwnerPermission) {
+				return fmt.Errorf("error restoring file owner: %w", err)
+			}
+			restoreErr = err
+		}
+	}
+	if p.preservesXattrs() {
+		if err := restoreXattrs(outputPath, metadata, p.restoreNames(metadata)); err != nil {
+			return err
+		}
+	}
+
+	// Read-only files are made read-only last, which on Windows is all the
+	// mode can express, then hidden and system attributes are restored
+	if os.FileMode(metadata.Mode).Perm()&0200 == 0 {
+		if err := os.Chmod(outputPath, os.FileMode(metadata.Mode)); err != nil {
+			return fmt.Errorf("error setting file mode: %w", err)
+		}
+	}
+	if err := restoreAttributes(outputPath, metadata.Attributes); err != nil {
+		return fmt.Errorf("error restoring file attributes: %w", err)
+	}
+
+	return restoreErr
+}
+
+// extractStats counts the outcome of extracting the files of a block
+type extractStats struct {
+	intact      int // Files skipped because they were already extracted
+	kept        int // Files skipped because the existing file was kept under OverwritePolicy
+	unsupported int // Files whose xattrs were not restored, the filesystem lacks support
+	denied      int // Files whose owner or xattrs were not restored, insufficient privileges
+	special     int // Special files not created, sockets and device nodes without privileges
+}
+
+// record counts the non fatal outcomes of extractFile and returns any other error
+func (s *extractStats) record(err error) error {
+	switch {
+	case err == nil:
+	case errors.Is(err, errXattrUnsupported):
+		s.unsupported++
+	case errors.Is(err, errXattrPermission), errors.Is(err, errOwnerPermission):
+		s.denied++
+	case errors.Is(err, errSpecialNotCreated):
+		s.special++
+	default:
+		return err
+	}
+	return nil
+}
+
+// print logs anything noteworthy about the extracted files along with args,
+// such as the block they came from
+func (s *extractStats) print(log *slog.Logger, args ...any) {
+	if s.intact > 0 {
+		log.Info("Resuming, skipped already extracted files", append([]any{"files", s.intact}, args...)...)
+	}
+	if s.kept > 0 {
+		log.Info("Kept existing files instead of extracting them", append([]any{"files", s.kept}, args...)...)
+	}
+	if s.unsupported > 0 {
+		log.Warn("Extended attributes not restored, target filesystem does not support them", append([]any{"files", s.unsupported}, args...)...)
+	}
+	if s.denied > 0 {
+		log.Warn("Ownership or extended attributes not restored, insufficient privileges", append([]any{"files", s.denied}, args...)...)
+	}
+	if s.special > 0 {
+		log.Warn("Special files not created, sockets and device nodes without root privileges", append([]any{"files", s.special}, args...)...)
+	}
+}
+
+// isExtracted reports whether a file has already been extracted intact to the
+// output directory. Damaged files are removed so they are rewritten from
+// scratch when OverwriteAlways lets them be replaced, otherwise they are left
+// to the OverwritePolicy like any other existing file
+func (p *defaultPacker) isExtracted(outputDir string, metadata *FileMetadata) (bool, error) {
+	outputPath, err := p.extractPath(outputDir, metadata.Path)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(outputPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if info.Size() == metadata.Size {
+		checksum, err := p.validator.CalculateFileChecksum(outputPath)
+		if err != nil {
+			return false, err
+		}
+		if p.validator.ChecksumsEqual(checksum, metadata.Checksum) {
+			return true, nil
+		}
+	}
+
+	if p.opts.Overwrite != OverwriteAlways {
+		return false, nil
+	}
+	if err := os.Remove(outputPath); err != nil {
+		return false, fmt.Errorf("error removing damaged file: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,67 @@
+package packer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestArchiveFilesReadableByOthers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not kept on Windows")
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "archive")
+	if err := NewPacker(PackerOptions{}).Pack(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().IsRegular() && info.Mode().Perm() != archiveFileMode {
+			t.Errorf("%s has mode %v, want %v", entry.Name(), info.Mode().Perm(), os.FileMode(archiveFileMode))
+		}
+	}
+}
+
+func TestReadBlockIndexTruncated(t *testing.T) {
+	for _, data := range vectorBlocks(t) {
+		step := max(len(data)/64, 1)
+		for n := 0; n < len(data); n += step {
+			if _, err := (defaultPacker{}).readBlockIndexAt(bytes.NewReader(data[:n]), int64(n)); err == nil {
+				t.Errorf("block cut to %d of %d bytes was read without error", n, len(data))
+			}
+		}
+	}
+}
+
+func FuzzReadBlockIndex(f *testing.F) {
+	for _, data := range vectorBlocks(f) {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAllocations(t, len(data), func() {
+			block, err := (defaultPacker{}).readBlockIndexAt(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				return
+			}
+			for _, metadata := range block.Files {
+				if metadata.Offset < 0 || metadata.storedSize() < 0 || block.DataOffset+metadata.Offset+metadata.storedSize() > int64(len(data)) {
+					t.Errorf("file %s at %d of %d bytes lies outside the block", metadata.Path, metadata.Offset, metadata.storedSize())
+				}
+			}
+		})
+	})
+}
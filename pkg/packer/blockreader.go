@@ -0,0 +1,69 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// blockReader gives access to the contents of a block file
+type blockReader interface {
+	// section returns a reader over n bytes of the block starting at off
+	section(off int64, n int64) io.Reader
+	Close() error
+}
+
+// openBlockReader opens a block file for reading, mapping it into memory when
+// UseMmap is set and the platform supports it. Blocks split into volumes are
+// always read through read system calls
+func (p defaultPacker) openBlockReader(blockPath string) (blockReader, error) {
+	f, err := openBlockFile(blockPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening block file: %w", err)
+	}
+	if !p.opts.UseMmap || f.split() {
+		return fileBlockReader{f}, nil
+	}
+
+	r, err := mmapBlock(f.volumes[0].f)
+	if err != nil {
+		// Fall back to regular reads, e.g. for files on filesystems without mmap support
+		return fileBlockReader{f}, nil
+	}
+	f.Close()
+	return r, nil
+}
+
+// memBlockReader reads a block held in memory
+type memBlockReader struct {
+	data []byte
+}
+
+func (r *memBlockReader) section(off int64, n int64) io.Reader {
+	size := int64(len(r.data))
+	if off > size {
+		off = size
+	}
+	end := off + n
+	if n < 0 || end > size {
+		end = size
+	}
+	return bytes.NewReader(r.data[off:end])
+}
+
+func (r *memBlockReader) Close() error {
+	return nil
+}
+
+// fileBlockReader reads a block file through read system calls
+type fileBlockReader struct {
+	f *blockFile
+}
+
+func (r fileBlockReader) section(off int64, n int64) io.Reader {
+	return io.NewSectionReader(r.f, off, n)
+}
+
+func (r fileBlockReader) Close() error {
+	return r.f.Close()
+}
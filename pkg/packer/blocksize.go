@@ -0,0 +1,69 @@
+package packer
+
+import "sort"
+
+// Bounds of the automatically chosen block size. Below the minimum the
+// header, footer and file handle of each block cost more than the data they
+// hold, above the maximum a single damaged or refetched block costs too much
+const (
+	minAutoBlockSize = 1 << 20 // 1MB
+	maxAutoBlockSize = 1 << 30 // 1GB
+)
+
+// autoBlockCount is the number of blocks an automatic block size aims for, so
+// the blocks of an archive can be written, fetched and restored in parallel
+const autoBlockCount = 64
+
+// autoBlockSize chooses a block size for files of the given sizes, negative
+// sizes being unknown. The total is spread over autoBlockCount blocks within
+// the bounds, and the block size grows to hold files larger than that since
+// files never span blocks. Sizes are rounded up to a whole MB
+func autoBlockSize(sizes []int64) int64 {
+	var total, largest int64
+	unknown := false
+	for _, size := range sizes {
+		if size < 0 {
+			unknown = true
+			continue
+		}
+		total += size
+		largest = max(largest, size)
+	}
+
+	size := min(max(total/autoBlockCount, minAutoBlockSize), maxAutoBlockSize)
+	if unknown {
+		// A file of unknown size could be as large as any block allows
+		size = maxAutoBlockSize
+	}
+
+	// Blocks hold the 90th percentile file several times over, so most files
+	// share a block instead of each filling one of their own
+	if len(sizes) > 0 {
+		sorted := append([]int64(nil), sizes...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		size = min(max(size, 4*sorted[len(sorted)*9/10]), maxAutoBlockSize)
+	}
+
+	size = max(size, largest)
+	return (size + minAutoBlockSize - 1) / minAutoBlockSize * minAutoBlockSize
+}
+
+// blockSizeFor returns the configured block size, or when BlockSize is 0 the
+// block size chosen for files of the given sizes, which is reported
+func (p defaultPacker) blockSizeFor(sizes []int64) int64 {
+	if p.opts.BlockSize > 0 {
+		return p.opts.BlockSize
+	}
+	size := autoBlockSize(sizes)
+	p.logger().Info("Using an automatic block size", "block_size_mb", size/minAutoBlockSize, "files", len(sizes))
+	return size
+}
+
+// fileSizes returns the sizes of the planned files
+func fileSizes(files []FileInfo) []int64 {
+	sizes := make([]int64, len(files))
+	for i, file := range files {
+		sizes[i] = file.Size
+	}
+	return sizes
+}
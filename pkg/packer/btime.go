@@ -0,0 +1,7 @@
+package packer
+
+import "errors"
+
+// errBirthTimeUnsupported is returned when the platform cannot set the birth
+// time of a file
+var errBirthTimeUnsupported = errors.New("setting file birth time not supported")
@@ -0,0 +1,23 @@
+//go:build freebsd || netbsd
+
+package packer
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileBirthTime returns the birth time of a file
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Birthtimespec.Sec <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Birthtimespec.Unix()), true
+}
+
+// restoreBirthTime is not supported on this platform
+func restoreBirthTime(path string, t time.Time) error {
+	return errBirthTimeUnsupported
+}
@@ -0,0 +1,33 @@
+//go:build darwin
+
+package packer
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileBirthTime returns the birth time of a file
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Birthtimespec.Unix()), true
+}
+
+// restoreBirthTime sets the birth time of a file with setattrlist. It must run
+// after the modification time is set, as an older mtime moves the birth time
+func restoreBirthTime(path string, t time.Time) error {
+	ts := unix.NsecToTimespec(t.UnixNano())
+	attrs := unix.Attrlist{
+		Bitmapcount: unix.ATTR_BIT_MAP_COUNT,
+		Commonattr:  unix.ATTR_CMN_CRTIME,
+	}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts))
+	return unix.Setattrlist(path, &attrs, buf, unix.FSOPT_NOFOLLOW)
+}
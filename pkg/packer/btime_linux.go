@@ -0,0 +1,28 @@
+//go:build linux
+
+package packer
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileBirthTime returns the birth time of a file using statx, which is only
+// reported by some filesystems
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil {
+		return time.Time{}, false
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// restoreBirthTime is not possible on Linux, the kernel offers no way to set it
+func restoreBirthTime(path string, t time.Time) error {
+	return errBirthTimeUnsupported
+}
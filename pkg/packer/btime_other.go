@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package packer
+
+import (
+	"os"
+	"time"
+)
+
+// fileBirthTime is not supported on this platform
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// restoreBirthTime is not supported on this platform
+func restoreBirthTime(path string, t time.Time) error {
+	return errBirthTimeUnsupported
+}
@@ -0,0 +1,35 @@
+//go:build windows
+
+package packer
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileBirthTime returns the creation time of a file
+func fileBirthTime(path string, info os.FileInfo) (time.Time, bool) {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.CreationTime.Nanoseconds()), true
+}
+
+// restoreBirthTime sets the creation time of a file
+func restoreBirthTime(path string, t time.Time) error {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(pathp, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+
+	ctime := syscall.NsecToFiletime(t.UnixNano())
+	return syscall.SetFileTime(h, &ctime, nil, nil)
+}
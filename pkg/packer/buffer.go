@@ -0,0 +1,62 @@
+package packer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is used when no buffer size is configured
+const defaultBufferSize = 32 * 1024
+
+// bufferPool hands out reusable copy buffers of the configured buffer size
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return bp
+}
+
+// get returns a buffer from the pool, it must be handed back with put
+func (bp *bufferPool) get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.pool.Put(buf)
+}
+
+// copy copies from src to dst until EOF using a pooled buffer
+func (bp *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := bp.get()
+	defer bp.put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// copyN copies exactly n bytes from src to dst using a pooled buffer. Like
+// io.CopyN it returns io.EOF if src ends early
+func (bp *bufferPool) copyN(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	// Contents already in memory, such as a mapped block, are written in one go
+	if r, ok := src.(*bytes.Reader); ok && int64(r.Len()) == n {
+		return r.WriteTo(dst)
+	}
+
+	written, err := bp.copy(dst, io.LimitReader(src, n))
+	if written == n {
+		return n, nil
+	}
+	if written < n && err == nil {
+		err = io.EOF
+	}
+	return written, err
+}
@@ -0,0 +1,85 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkBufferSizes are the buffer sizes the pack and unpack benchmarks
+// compare, around defaultBufferSize
+var benchmarkBufferSizes = []int{4 << 10, 32 << 10, 256 << 10, 1 << 20}
+
+// benchmarkTree writes the files packed by the benchmarks and returns their
+// directory and combined size
+func benchmarkTree(b *testing.B) (string, int64) {
+	b.Helper()
+	dir := b.TempDir()
+	var total int64
+	for i := 0; i < 16; i++ {
+		data := testVectorData(fmt.Sprintf("bench-%d", i), 1<<20)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%02d", i)), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+		total += int64(len(data))
+	}
+	return dir, total
+}
+
+func benchmarkPacker(bufferSize int) Packer {
+	return NewPacker(PackerOptions{
+		BufferSize: bufferSize,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+}
+
+func BenchmarkPack(b *testing.B) {
+	src, total := benchmarkTree(b)
+	for _, size := range benchmarkBufferSizes {
+		b.Run(fmt.Sprintf("BufferSize=%dKB", size>>10), func(b *testing.B) {
+			p := benchmarkPacker(size)
+			archive := filepath.Join(b.TempDir(), "archive")
+			b.SetBytes(total)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if err := os.RemoveAll(archive); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := p.Pack(src, archive); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	src, total := benchmarkTree(b)
+	archive := filepath.Join(b.TempDir(), "archive")
+	if err := benchmarkPacker(0).Pack(src, archive); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range benchmarkBufferSizes {
+		b.Run(fmt.Sprintf("BufferSize=%dKB", size>>10), func(b *testing.B) {
+			p := benchmarkPacker(size)
+			out := filepath.Join(b.TempDir(), "out")
+			b.SetBytes(total)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				if err := os.RemoveAll(out); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := p.Unpack(archive, out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
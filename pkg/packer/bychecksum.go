@@ -0,0 +1,76 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ExtractByChecksum extracts the files of an archive whose SHA-256 checksum
+// matches one of the given checksums, in hex. Shorter hex strings match every
+// checksum starting with them. Every file holding a matching contents is
+// extracted under its own path, and ErrNoFiles is returned when none matches
+func (p defaultPacker) ExtractByChecksum(archiveDir string, outputDir string, checksums ...string) error {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	prefixes, err := checksumPrefixes(checksums)
+	if err != nil {
+		return err
+	}
+	files, err := p.readArchiveIndex(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	// The matching files are selected by their literal paths
+	var patterns []string
+	for _, metadata := range files {
+		sum := hex.EncodeToString(metadata.Checksum)
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(sum, prefix) {
+				patterns = append(patterns, literalPattern(metadata.Path))
+				break
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("%w in %s match the checksums", ErrNoFiles, archiveDir)
+	}
+	p.logger().Info("Extracting files matching checksums", "checksums", len(prefixes), "files", len(patterns))
+	return p.Unpack(archiveDir, outputDir, patterns...)
+}
+
+// checksumPrefixes validates and lowercases hex checksums or checksum prefixes
+func checksumPrefixes(checksums []string) ([]string, error) {
+	if len(checksums) == 0 {
+		return nil, fmt.Errorf("no checksums given: %w", ErrInvalidOption)
+	}
+	prefixes := make([]string, len(checksums))
+	for i, checksum := range checksums {
+		prefix := strings.ToLower(checksum)
+		if prefix == "" || len(prefix) > 2*sha256.Size || strings.Trim(prefix, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("invalid checksum %q, expected up to %d hex digits: %w", checksum, 2*sha256.Size, ErrInvalidOption)
+		}
+		prefixes[i] = prefix
+	}
+	return prefixes, nil
+}
+
+// literalPattern escapes the glob metacharacters of an archived path, so the
+// pattern matches that path only
+func literalPattern(archivedPath string) string {
+	var b strings.Builder
+	for _, r := range archivedPath {
+		switch r {
+		case '*', '?', '[', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,268 @@
+package packer
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Costs counted against the budget of a BlockCache for the parts of an entry
+// that are not file contents
+const (
+	cachedEntrySize    = 128 // Bookkeeping of any entry
+	cachedMetadataSize = 256 // Metadata of a file in a block index, besides its path
+)
+
+// blockCacheShare is the largest share of the budget a single entry may
+// take, so reading one large file does not evict everything else
+const blockCacheShare = 4
+
+// BlockCache keeps in memory what repeated reads of the same blocks would
+// otherwise read and check again: the file index of each block, whether the
+// block passed its integrity check, and the decompressed contents of small
+// files once they match their checksum. It suits many selective extracts from
+// one archive, such as serving files from it. Entries are evicted least
+// recently used first to stay within the memory budget. Blocks are known by
+// their path, size and modification time, so a block rewritten in place is
+// read again. A cache is safe for concurrent use and may be shared by several
+// packers and ArchiveFS values
+type BlockCache struct {
+	mu      sync.Mutex
+	budget  int64
+	entries map[blockCacheKey]*list.Element
+	lru     *list.List // Entries from the most to the least recently used
+	stats   BlockCacheStats
+}
+
+// BlockCacheStats counts the use of a BlockCache
+type BlockCacheStats struct {
+	Hits      int64 // Lookups answered from the cache
+	Misses    int64 // Lookups that had to read the block
+	Evictions int64 // Entries dropped to stay within the budget
+	Entries   int   // Entries held
+	Bytes     int64 // Memory counted against the budget
+}
+
+// blockStamp identifies the contents of a block file by its path, size and
+// modification time. The zero stamp is never cached
+type blockStamp struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// blockCacheKind is what an entry of a BlockCache holds
+type blockCacheKind uint8
+
+const (
+	cachedIndex    blockCacheKind = iota // *Block read from the block file
+	cachedVerified                       // Nothing, the block passed its integrity check
+	cachedContents                       // []byte contents of the file at offset
+)
+
+type blockCacheKey struct {
+	block  blockStamp
+	kind   blockCacheKind
+	offset int64 // Offset of the stored bytes of the file within the block, for cachedContents
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	value any
+	size  int64
+}
+
+// NewBlockCache returns a cache holding at most budget bytes of indexes and
+// file contents
+func NewBlockCache(budget int64) *BlockCache {
+	return &BlockCache{
+		budget:  budget,
+		entries: make(map[blockCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// get returns the value of an entry and marks it as the most recently used
+func (c *BlockCache) get(key blockCacheKey) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockCacheEntry).value, true
+}
+
+// put adds an entry costing size bytes, evicting the least recently used ones
+// beyond the budget. Entries larger than their share of the budget are not kept
+func (c *BlockCache) put(key blockCacheKey, value any, size int64) {
+	size += cachedEntrySize
+	if size > c.budget/blockCacheShare {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.stats.Bytes -= e.Value.(*blockCacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&blockCacheEntry{key: key, value: value, size: size})
+	c.stats.Bytes += size
+	for c.stats.Bytes > c.budget {
+		e := c.lru.Back()
+		entry := e.Value.(*blockCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.stats.Bytes -= entry.size
+		c.stats.Evictions++
+	}
+}
+
+// statBlock returns the stamp of a block file, or of the volumes of a block
+// split under VolumeSize, the latest of which gives the modification time
+func statBlock(blockPath string) (blockStamp, error) {
+	if n, path := volumeNumber(blockPath); n > 0 {
+		blockPath = path
+	}
+	info, err := os.Stat(blockPath)
+	if err == nil {
+		return blockStamp{path: blockPath, size: info.Size(), modTime: info.ModTime()}, nil
+	}
+	if !os.IsNotExist(err) {
+		return blockStamp{}, err
+	}
+	sizes, ferr := findVolumes(blockPath)
+	if ferr != nil || len(sizes) == 0 {
+		return blockStamp{}, err
+	}
+	stamp := blockStamp{path: blockPath}
+	for n := range sizes {
+		info, err := os.Stat(volumePath(blockPath, n))
+		if err != nil {
+			return blockStamp{}, err
+		}
+		stamp.size += info.Size()
+		if info.ModTime().After(stamp.modTime) {
+			stamp.modTime = info.ModTime()
+		}
+	}
+	return stamp, nil
+}
+
+// blockIndex returns a copy of the cached index of a block, which callers may
+// change
+func (c *BlockCache) blockIndex(stamp blockStamp) (*Block, bool) {
+	if c == nil || stamp == (blockStamp{}) {
+		return nil, false
+	}
+	value, ok := c.get(blockCacheKey{block: stamp, kind: cachedIndex})
+	if !ok {
+		return nil, false
+	}
+	block := *value.(*Block)
+	block.Files = append([]FileMetadata(nil), block.Files...)
+	return &block, true
+}
+
+// putBlockIndex keeps a copy of the index of a block. Indexes of blocks with
+// encrypted metadata are not kept, as they would reach packers without the key
+func (c *BlockCache) putBlockIndex(block *Block) {
+	if c == nil || block.stamp == (blockStamp{}) || block.encrypted {
+		return
+	}
+	cached := *block
+	cached.Files = append([]FileMetadata(nil), block.Files...)
+	size := int64(cachedEntrySize)
+	for _, metadata := range block.Files {
+		size += cachedMetadataSize + int64(len(metadata.Path))
+		for name, value := range metadata.Xattrs {
+			size += int64(len(name) + len(value))
+		}
+	}
+	c.put(blockCacheKey{block: block.stamp, kind: cachedIndex}, &cached, size)
+}
+
+// verified tells whether a block passed its integrity check since it was
+// last written
+func (c *BlockCache) verified(stamp blockStamp) bool {
+	if c == nil || stamp == (blockStamp{}) {
+		return false
+	}
+	_, ok := c.get(blockCacheKey{block: stamp, kind: cachedVerified})
+	return ok
+}
+
+// putVerified records that a block passed its integrity check
+func (c *BlockCache) putVerified(stamp blockStamp) {
+	if c == nil || stamp == (blockStamp{}) {
+		return
+	}
+	c.put(blockCacheKey{block: stamp, kind: cachedVerified}, nil, 0)
+}
+
+// cacheable tells whether the contents of a file may be kept in the cache
+func (c *BlockCache) cacheable(stamp blockStamp, metadata *FileMetadata) bool {
+	return c != nil && stamp != (blockStamp{}) && metadata.Size > 0 && metadata.Size+cachedEntrySize <= c.budget/blockCacheShare
+}
+
+// cachedFileContents returns the cached contents of a file whose stored bytes
+// start at offset in a block
+func (c *BlockCache) cachedFileContents(stamp blockStamp, offset int64) ([]byte, bool) {
+	value, ok := c.get(blockCacheKey{block: stamp, kind: cachedContents, offset: offset})
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+// fileContents reads the contents of a file whose stored bytes start at
+// offset in a block through stored, and keeps them once they match the
+// archived checksum
+func (c *BlockCache) fileContents(stamp blockStamp, offset int64, metadata *FileMetadata, stored io.Reader) ([]byte, error) {
+	data := make([]byte, metadata.Size)
+	if _, err := io.ReadFull(metadata.contents(stored), data); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	h := newChecksum()
+	h.Write(data)
+	if err := checkFileChecksum(metadata.Path, metadata.Checksum, h); err != nil {
+		return nil, err
+	}
+	c.put(blockCacheKey{block: stamp, kind: cachedContents, offset: offset}, data, metadata.Size)
+	return data, nil
+}
+
+// blockContents returns a reader of the contents of a file of a block read
+// through r, going through the BlockCache for files small enough to keep
+func (p defaultPacker) blockContents(block *Block, metadata *FileMetadata, r blockReader) (io.Reader, error) {
+	offset := block.DataOffset + metadata.Offset
+	stored := r.section(offset, metadata.storedSize())
+	cache := p.opts.BlockCache
+	if !cache.cacheable(block.stamp, metadata) {
+		return metadata.contents(stored), nil
+	}
+	data, ok := cache.cachedFileContents(block.stamp, offset)
+	if !ok {
+		var err error
+		if data, err = cache.fileContents(block.stamp, offset, metadata, stored); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,190 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOR metadata records are a length (int32) followed by one CBOR map (RFC
+// 8949) with small integer keys, so any language with a CBOR library can read
+// the metadata of a block. Key 0 holds the schema version. Readers skip keys
+// they do not know, so fields can be added without a new version, and only
+// changes that alter the meaning of existing keys bump it
+const cborMetadataVersion = 1
+
+// maxCBORRecordLength bounds a single record, which holds at most a path and
+// the extended attributes and extents of one file
+const maxCBORRecordLength = 256 * 1024 * 1024
+
+// cborMetadata is the schema of a CBOR metadata record. Fields holding their
+// zero value are left out, except the ones every file has. The doc tags
+// describe the fields in the format specification
+type cborMetadata struct {
+	Version        uint64            `cbor:"0,keyasint" doc:"Schema version"`
+	Path           string            `cbor:"1,keyasint" doc:"Archived path"`
+	Size           int64             `cbor:"2,keyasint" doc:"Size of the contents"`
+	ModTime        int64             `cbor:"3,keyasint" doc:"Modification time, Unix seconds"`
+	Offset         int64             `cbor:"4,keyasint" doc:"Offset of the stored bytes within the data section"`
+	Mode           uint32            `cbor:"5,keyasint" doc:"Go fs.FileMode bits"`
+	Uid            uint32            `cbor:"6,keyasint,omitempty" doc:"Numeric owner"`
+	Gid            uint32            `cbor:"7,keyasint,omitempty" doc:"Numeric group"`
+	Checksum       []byte            `cbor:"8,keyasint" doc:"SHA-256 of the contents"`
+	Xattrs         map[string][]byte `cbor:"9,keyasint,omitempty" doc:"Extended attributes by name"`
+	BirthTime      int64             `cbor:"10,keyasint,omitempty" doc:"Birth time, Unix seconds"`
+	BirthNsec      int32             `cbor:"11,keyasint,omitempty" doc:"Nanoseconds of the birth time"`
+	Attributes     uint32            `cbor:"12,keyasint,omitempty" doc:"Windows file attributes"`
+	Holes          []cborExtent      `cbor:"13,keyasint,omitempty" doc:"Holes of a sparse file"`
+	ZeroRuns       []cborExtent      `cbor:"14,keyasint,omitempty" doc:"Zero runs left out of the data section"`
+	Compression    uint8             `cbor:"15,keyasint,omitempty" doc:"Compression method, 1 for DEFLATE, 2 for zstd"`
+	CompressedSize int64             `cbor:"16,keyasint,omitempty" doc:"Size of the compressed contents in the data section"`
+	Device         uint64            `cbor:"17,keyasint,omitempty" doc:"Device number of a device node"`
+}
+
+// cborExtent is an extent encoded as the array [offset, length]
+type cborExtent struct {
+	_      struct{} `cbor:",toarray"`
+	Offset int64
+	Length int64
+}
+
+// cborEncoding writes records in the core deterministic encoding, so the same
+// metadata always makes the same bytes and blocks stay reproducible
+var cborEncoding = sync.OnceValues(func() (cbor.EncMode, error) {
+	return cbor.CoreDetEncOptions().EncMode()
+})
+
+// cborDecoding rejects duplicate keys, indefinite lengths and invalid UTF-8,
+// and bounds what a corrupt or malicious record can make a reader allocate
+var cborDecoding = sync.OnceValues(func() (cbor.DecMode, error) {
+	return cbor.DecOptions{
+		DupMapKey:        cbor.DupMapKeyEnforcedAPF,
+		IndefLength:      cbor.IndefLengthForbidden,
+		MaxArrayElements: maxExtents,
+		MaxMapPairs:      maxXattrs,
+	}.DecMode()
+})
+
+// writeCBORMetadata writes a file metadata record as a length prefixed CBOR map
+func writeCBORMetadata(w io.Writer, metadata *FileMetadata) error {
+	record := cborMetadata{
+		Version:        cborMetadataVersion,
+		Path:           metadata.Path,
+		Size:           metadata.Size,
+		ModTime:        metadata.ModTime.Unix(),
+		Offset:         metadata.Offset,
+		Mode:           metadata.Mode,
+		Uid:            metadata.Uid,
+		Gid:            metadata.Gid,
+		Checksum:       metadata.Checksum,
+		Xattrs:         metadata.Xattrs,
+		Attributes:     metadata.Attributes,
+		Holes:          cborExtents(metadata.Holes),
+		ZeroRuns:       cborExtents(metadata.ZeroRuns),
+		Compression:    uint8(metadata.Compression),
+		CompressedSize: metadata.CompressedSize,
+		Device:         metadata.Device,
+	}
+	if !metadata.BirthTime.IsZero() {
+		record.BirthTime = metadata.BirthTime.Unix()
+		record.BirthNsec = int32(metadata.BirthTime.Nanosecond())
+	}
+	mode, err := cborEncoding()
+	if err != nil {
+		return fmt.Errorf("error creating CBOR encoder: %w", err)
+	}
+	b, err := mode.Marshal(&record)
+	if err != nil {
+		return fmt.Errorf("error encoding metadata of %s: %w", metadata.Path, err)
+	}
+	return writeBytes(w, b)
+}
+
+// readCBORMetadata reads a length prefixed CBOR metadata record
+func readCBORMetadata(r io.Reader) (*FileMetadata, error) {
+	b, err := readBytes(r, maxCBORRecordLength)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := cborDecoding()
+	if err != nil {
+		return nil, fmt.Errorf("error creating CBOR decoder: %w", err)
+	}
+	var record cborMetadata
+	if err := mode.Unmarshal(b, &record); err != nil {
+		return nil, fmt.Errorf("error decoding metadata record: %v: %w", err, ErrCorrupted)
+	}
+	if record.Version < 1 || record.Version > cborMetadataVersion {
+		return nil, fmt.Errorf("metadata record version %d: %w", record.Version, ErrUnsupportedVersion)
+	}
+
+	if len(record.Path) > maxPathLength || len(record.Checksum) != sha256.Size {
+		return nil, fmt.Errorf("invalid path or checksum in metadata record: %w", ErrCorrupted)
+	}
+	for name, value := range record.Xattrs {
+		if len(name) > maxXattrNameLength || len(value) > maxXattrValueLength {
+			return nil, fmt.Errorf("invalid extended attribute in metadata record: %w", ErrCorrupted)
+		}
+	}
+	if record.BirthNsec < 0 || record.BirthNsec >= 1e9 {
+		return nil, fmt.Errorf("invalid birth time: %w", ErrCorrupted)
+	}
+	holes, zeroRuns := fileExtents(record.Holes), fileExtents(record.ZeroRuns)
+	if err := checkExtents(holes, record.Size); err != nil {
+		return nil, err
+	}
+	if err := checkExtents(zeroRuns, record.Size); err != nil {
+		return nil, err
+	}
+
+	metadata := &FileMetadata{
+		Path:           slashPath(record.Path),
+		Size:           record.Size,
+		ModTime:        time.Unix(record.ModTime, 0),
+		Offset:         record.Offset,
+		Mode:           record.Mode,
+		Uid:            record.Uid,
+		Gid:            record.Gid,
+		Checksum:       record.Checksum,
+		Xattrs:         record.Xattrs,
+		Attributes:     record.Attributes,
+		Holes:          holes,
+		ZeroRuns:       zeroRuns,
+		Compression:    Compression(record.Compression),
+		CompressedSize: record.CompressedSize,
+		Device:         record.Device,
+	}
+	if err := checkCompressedFile(metadata); err != nil {
+		return nil, err
+	}
+	if record.BirthTime != 0 || record.BirthNsec != 0 {
+		metadata.BirthTime = time.Unix(record.BirthTime, int64(record.BirthNsec))
+	}
+	return metadata, nil
+}
+
+func cborExtents(extents []Extent) []cborExtent {
+	if len(extents) == 0 {
+		return nil
+	}
+	out := make([]cborExtent, len(extents))
+	for i, extent := range extents {
+		out[i] = cborExtent{Offset: extent.Offset, Length: extent.Length}
+	}
+	return out
+}
+
+func fileExtents(extents []cborExtent) []Extent {
+	if len(extents) == 0 {
+		return nil
+	}
+	out := make([]Extent, len(extents))
+	for i, extent := range extents {
+		out[i] = Extent{Offset: extent.Offset, Length: extent.Length}
+	}
+	return out
+}
@@ -0,0 +1,31 @@
+package packer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCBORMetadataRoundTrip(t *testing.T) {
+	want := &FileMetadata{
+		Path:     "dir/file.txt",
+		Size:     12345,
+		ModTime:  time.Unix(1700000000, 0),
+		Offset:   64,
+		Mode:     0644,
+		Checksum: bytes.Repeat([]byte{7}, 32),
+		ZeroRuns: []Extent{{Offset: 4096, Length: 8192}},
+	}
+	var buf bytes.Buffer
+	if err := writeCBORMetadata(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readCBORMetadata(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != want.Path || got.Size != want.Size || got.Offset != want.Offset || !got.ModTime.Equal(want.ModTime) ||
+		!bytes.Equal(got.Checksum, want.Checksum) || len(got.ZeroRuns) != 1 || got.ZeroRuns[0] != want.ZeroRuns[0] {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ChangedFilePolicy selects what packing does with a file that changes while
+// it is packed. Its contents are read once, so the checksum always matches
+// the bytes stored, but those may mix old and new contents or be cut at the
+// size the file had when it was planned
+type ChangedFilePolicy int
+
+const (
+	ChangedFileWarn  ChangedFilePolicy = iota // Keep the contents read and log a warning, the default
+	ChangedFileRetry                          // Read the file again, up to changedFileRetries times before failing it
+	ChangedFileSkip                           // Leave the file out of the archive with a warning
+	ChangedFileFail                           // Fail the file, which fails the pack unless ContinueOnError is set
+)
+
+// changedFileRetries is how many times ChangedFileRetry reads a file again
+const changedFileRetries = 3
+
+// ErrFileChanged is returned for files whose size or modification time changed
+// between planning and copying their contents
+var ErrFileChanged = errors.New("file changed while it was packed")
+
+// checkChangedFilePolicy rejects changed file policies this version does not know
+func (p defaultPacker) checkChangedFilePolicy() error {
+	switch p.opts.ChangedFiles {
+	case ChangedFileWarn, ChangedFileRetry, ChangedFileSkip, ChangedFileFail:
+		return nil
+	}
+	return fmt.Errorf("unknown changed file policy %d: %w", p.opts.ChangedFiles, ErrInvalidOption)
+}
+
+// checkUnchanged returns ErrFileChanged when a source file copied into a
+// block no longer has the size and modification time it was planned with,
+// as it changed while it was read. With ChangedFileWarn the change is only
+// logged. Sources of unknown size, such as pipes, are not checked
+func (p defaultPacker) checkUnchanged(metadata *FileMetadata) error {
+	if !p.checkChanges || metadata.Size == unknownSize {
+		return nil
+	}
+	var changed error
+	info, err := os.Stat(metadata.source())
+	switch {
+	case err != nil:
+		changed = fmt.Errorf("%w: %v", ErrFileChanged, err)
+	case info.Size() != metadata.Size || !info.ModTime().Equal(metadata.ModTime):
+		changed = fmt.Errorf("%w: size %d and modification time %s instead of %d and %s", ErrFileChanged,
+			info.Size(), info.ModTime().Format(time.RFC3339Nano), metadata.Size, metadata.ModTime.Format(time.RFC3339Nano))
+	default:
+		return nil
+	}
+	if p.opts.ChangedFiles == ChangedFileWarn {
+		p.logger().Warn("File changed while it was packed", "path", metadata.source(), "error", changed)
+		return nil
+	}
+	return changed
+}
+
+// replan takes the current size and modification time of a source file that
+// changed, so it can be read again and checked for changes once more
+func replan(metadata *FileMetadata) error {
+	info, err := os.Stat(metadata.source())
+	if err != nil {
+		return err
+	}
+	metadata.Size = info.Size()
+	metadata.ModTime = info.ModTime()
+	return nil
+}
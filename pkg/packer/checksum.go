@@ -0,0 +1,62 @@
+package packer
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+
+	sha256simd "github.com/minio/sha256-simd"
+)
+
+// multiBufferLanes is the number of checksums the multi-buffer hasher
+// computes in one pass, one per AVX-512 lane
+const multiBufferLanes = 16
+
+// newChecksum returns a hash computing the SHA-256 checksums of blocks and
+// files. It uses the SHA extensions of x86 and ARM CPUs where present and
+// falls back to the standard library otherwise
+func newChecksum() hash.Hash {
+	return sha256simd.New()
+}
+
+// checksumsEqual reports whether two checksums are identical, taking the same
+// time however many of their bytes match. Checksums are only computed through
+// newChecksum and newChecksums and only compared here, so a keyed checksum can
+// later replace them in one place
+func checksumsEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// hexChecksumsEqual reports whether two hex encoded checksums, as manifests
+// and reports record them, are identical. Checksums that are not valid hex
+// never are
+func hexChecksumsEqual(a, b string) bool {
+	decodedA, errA := hex.DecodeString(a)
+	decodedB, errB := hex.DecodeString(b)
+	return errA == nil && errB == nil && checksumsEqual(decodedA, decodedB)
+}
+
+// checkFileChecksum returns a *FileIntegrityError when the checksum computed by
+// h does not match the expected checksum of the file at path
+func checkFileChecksum(path string, expected []byte, h hash.Hash) error {
+	if actual := h.Sum(nil); !checksumsEqual(actual, expected) {
+		return &FileIntegrityError{Path: path, ExpectedSum: expected, ActualSum: actual}
+	}
+	return nil
+}
+
+// newChecksums returns n hashes for contents that are hashed side by side.
+// With MultiBufferHashing they share the AVX-512 lanes of the multi-buffer
+// hasher on CPUs that have them, so n streams cost little more than one
+func (p defaultPacker) newChecksums(n int) []hash.Hash {
+	if p.opts.MultiBufferHashing && n > 1 {
+		if hashes := newLaneChecksums(n); hashes != nil {
+			return hashes
+		}
+	}
+	hashes := make([]hash.Hash, n)
+	for i := range hashes {
+		hashes[i] = newChecksum()
+	}
+	return hashes
+}
@@ -0,0 +1,83 @@
+//go:build !noasm && !appengine && gc
+
+package packer
+
+import (
+	"hash"
+	"sync"
+
+	"github.com/klauspost/cpuid/v2"
+	sha256simd "github.com/minio/sha256-simd"
+)
+
+// laneServer returns the multi-buffer hasher shared by every packer, nil on
+// CPUs without AVX-512. Its goroutine polls for work for the rest of the
+// process once started, which is why MultiBufferHashing is opt-in
+var laneServer = sync.OnceValue(func() *sha256simd.Avx512Server {
+	if !cpuid.CPU.Supports(cpuid.AVX512F, cpuid.AVX512DQ, cpuid.AVX512BW, cpuid.AVX512VL) {
+		return nil
+	}
+	return sha256simd.NewAvx512Server()
+})
+
+// newLaneChecksums returns n hashes sharing the lanes of the multi-buffer
+// hasher, or nil when it is not available
+func newLaneChecksums(n int) []hash.Hash {
+	server := laneServer()
+	if server == nil {
+		return nil
+	}
+	hashes := make([]hash.Hash, n)
+	for i := range hashes {
+		hashes[i] = &laneChecksum{h: sha256simd.NewAvx512(server)}
+	}
+	return hashes
+}
+
+// laneChecksum feeds a hash of the multi-buffer hasher. The hasher keeps the
+// slices written until a batch of lanes is full, so only copies of whole
+// 64 byte chunks are handed over and partial chunks are held back until Sum
+type laneChecksum struct {
+	h    hash.Hash
+	tail []byte // Bytes written after the last whole chunk
+}
+
+func (l *laneChecksum) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(l.tail) > 0 {
+		fill := min(len(p), sha256simd.BlockSize-len(l.tail))
+		l.tail = append(l.tail, p[:fill]...)
+		p = p[fill:]
+		if len(l.tail) < sha256simd.BlockSize {
+			return n, nil
+		}
+		if _, err := l.h.Write(l.tail); err != nil {
+			return 0, err
+		}
+		l.tail = nil
+	}
+	whole := len(p) &^ (sha256simd.BlockSize - 1)
+	if whole > 0 {
+		if _, err := l.h.Write(append([]byte(nil), p[:whole]...)); err != nil {
+			return 0, err
+		}
+	}
+	l.tail = append(l.tail, p[whole:]...)
+	return n, nil
+}
+
+func (l *laneChecksum) Sum(b []byte) []byte {
+	if len(l.tail) > 0 {
+		l.h.Write(l.tail)
+		l.tail = nil
+	}
+	return l.h.Sum(b)
+}
+
+func (l *laneChecksum) Reset() {
+	l.h.Reset()
+	l.tail = nil
+}
+
+func (l *laneChecksum) Size() int      { return l.h.Size() }
+func (l *laneChecksum) BlockSize() int { return l.h.BlockSize() }
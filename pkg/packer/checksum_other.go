@@ -0,0 +1,10 @@
+//go:build !amd64 || noasm || appengine || !gc
+
+package packer
+
+import "hash"
+
+// newLaneChecksums returns nil, the multi-buffer hasher needs AVX-512
+func newLaneChecksums(n int) []hash.Hash {
+	return nil
+}
@@ -0,0 +1,84 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// defaultPartSize is the largest part a block is uploaded in by the stores
+// with chunked uploads when no part size is set
+const defaultPartSize = 16 << 20
+
+// uploadPart is one part of a chunked upload, with the base64 encoded MD5
+// the provider checks it against
+type uploadPart struct {
+	data []byte
+	md5  string
+}
+
+// readParts reads a block of size bytes in parts sized to it: the fewest
+// parts of at most partSize bytes, all of the same length but for a shorter
+// last one, so a block just over partSize is not followed by a tiny part.
+// Each part is passed to put before the next is read, an empty block as one
+// empty part, and the MD5 of the whole block is returned
+func readParts(r io.Reader, size int64, partSize int64, put func(i int, part uploadPart) error) ([]byte, error) {
+	count := max((size+partSize-1)/partSize, 1)
+	length := (size + count - 1) / count
+	whole := md5.New()
+	buf := make([]byte, length)
+	for i, offset := 0, int64(0); i == 0 || offset < size; i++ {
+		n := min(length, size-offset)
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return nil, fmt.Errorf("error reading block: %w", err)
+		}
+		sum := md5.Sum(buf[:n])
+		whole.Write(buf[:n])
+		if err := put(i, uploadPart{data: buf[:n], md5: base64.StdEncoding.EncodeToString(sum[:])}); err != nil {
+			return nil, err
+		}
+		offset += n
+	}
+	return whole.Sum(nil), nil
+}
+
+// verifiedReader checks a downloaded block against the checksum the provider
+// reported for it once it is read to the end
+type verifiedReader struct {
+	io.ReadCloser
+	name string
+	kind string // Checksum the provider reported, such as MD5
+	hash hash.Hash
+	want []byte
+}
+
+// newVerifiedReader returns body checked against the base64 encoded checksum
+// of the kind, or body itself when the provider reported none
+func newVerifiedReader(body io.ReadCloser, name string, kind string, h hash.Hash, encoded string) io.ReadCloser {
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if encoded == "" || err != nil || len(want) != h.Size() {
+		return body
+	}
+	return &verifiedReader{ReadCloser: body, name: name, kind: kind, hash: h, want: want}
+}
+
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && !checksumsEqual(r.hash.Sum(nil), r.want) {
+		return n, fmt.Errorf("block %s does not match the %s reported by the store: %w", r.name, r.kind, ErrCorrupted)
+	}
+	return n, err
+}
+
+// bodyOf returns a request body of the bytes, http.NoBody when empty
+func bodyOf(data []byte) io.Reader {
+	if len(data) == 0 {
+		return http.NoBody
+	}
+	return bytes.NewReader(data)
+}
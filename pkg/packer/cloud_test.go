@@ -0,0 +1,63 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func TestReadParts(t *testing.T) {
+	tests := []struct {
+		size     int
+		partSize int64
+		want     []int
+	}{
+		{0, 10, []int{0}},
+		{1, 10, []int{1}},
+		{10, 10, []int{10}},
+		{11, 10, []int{6, 5}},
+		{25, 10, []int{9, 9, 7}},
+		{30, 10, []int{10, 10, 10}},
+		{31, 10, []int{8, 8, 8, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d in %d", tt.size, tt.partSize), func(t *testing.T) {
+			data := testVectorData("parts", tt.size)
+			var lengths []int
+			var joined []byte
+			whole, err := readParts(bytes.NewReader(data), int64(tt.size), tt.partSize, func(i int, part uploadPart) error {
+				if i != len(lengths) {
+					t.Errorf("part %d passed after %d parts", i, len(lengths))
+				}
+				sum := md5.Sum(part.data)
+				if part.md5 != base64.StdEncoding.EncodeToString(sum[:]) {
+					t.Errorf("part %d has MD5 %s of other data", i, part.md5)
+				}
+				lengths = append(lengths, len(part.data))
+				joined = append(joined, part.data...)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(lengths) != fmt.Sprint(tt.want) {
+				t.Errorf("parts of %v bytes, want %v", lengths, tt.want)
+			}
+			if !bytes.Equal(joined, data) {
+				t.Error("parts do not join up to the block")
+			}
+			if sum := md5.Sum(data); !bytes.Equal(whole, sum[:]) {
+				t.Error("MD5 of the whole block differs")
+			}
+		})
+	}
+}
+
+func TestReadPartsShortBlock(t *testing.T) {
+	_, err := readParts(bytes.NewReader(make([]byte, 15)), 20, 10, func(int, uploadPart) error { return nil })
+	if err == nil {
+		t.Fatal("a block shorter than its size was read without error")
+	}
+}
@@ -0,0 +1,320 @@
+package packer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CompactResult reports how Compact changed an archive
+type CompactResult struct {
+	Rewritten      []string // Partially referenced blocks whose live contents were moved
+	Removed        []string // Blocks without any referenced contents
+	Written        []string // New blocks holding the moved contents
+	ReclaimedBytes int64    // Size of the removed and rewritten blocks less the size of the new ones
+}
+
+// extentKey identifies stored contents by block and offset from the start of
+// the block file
+type extentKey struct {
+	blockID int32
+	offset  int64
+}
+
+// referencingManifest is a manifest that references stored contents and is
+// rewritten when those contents move
+type referencingManifest struct {
+	path     string
+	manifest *Manifest
+}
+
+// loadReferences reads the snapshot manifests of an archive. An archive
+// without snapshots returns nil, every stored file not marked deleted is then
+// referenced
+func loadReferences(archiveDir string) ([]referencingManifest, error) {
+	if _, err := os.Stat(filepath.Join(archiveDir, snapshotDir)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	generations, err := listGenerations(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]referencingManifest, 0, len(generations))
+	for _, generation := range generations {
+		m, err := readSnapshot(archiveDir, generation)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, referencingManifest{path: snapshotPath(archiveDir, generation), manifest: m})
+	}
+	return refs, nil
+}
+
+// compactPlan is what Compact does to an archive: the blocks it removes or
+// rewrites and the referenced contents it moves out of the rewritten ones
+type compactPlan struct {
+	blocks   map[int32]ManifestBlock // Blocks of the archive by ID
+	nextID   int32                   // ID of the first new block
+	obsolete []ManifestBlock         // Blocks removed and rewritten
+	moves    []ManifestFile          // Referenced contents of the rewritten blocks
+	result   *CompactResult          // Blocks removed and rewritten by name
+}
+
+// planCompact sorts the blocks of an archive indexed by index into fully
+// referenced, partially referenced and dead ones. Contents are referenced by
+// the snapshots of refs, or unless they are marked deleted when there are none
+func planCompact(index *Manifest, refs []referencingManifest) *compactPlan {
+	live := make(map[extentKey]bool)
+	for _, ref := range refs {
+		for _, file := range ref.manifest.Files {
+			live[extentKey{file.BlockID, file.Offset}] = true
+		}
+	}
+	if refs == nil {
+		for _, file := range index.Files {
+			if !file.Deleted {
+				live[extentKey{file.BlockID, file.Offset}] = true
+			}
+		}
+	}
+
+	plan := &compactPlan{blocks: make(map[int32]ManifestBlock, len(index.Blocks)), nextID: 1, result: &CompactResult{}}
+	for _, block := range index.Blocks {
+		plan.blocks[block.ID] = block
+		if block.ID >= plan.nextID {
+			plan.nextID = block.ID + 1
+		}
+	}
+	total := make(map[int32]int)
+	referenced := make(map[int32]int)
+	for _, file := range index.Files {
+		total[file.BlockID]++
+		if live[extentKey{file.BlockID, file.Offset}] {
+			referenced[file.BlockID]++
+		}
+	}
+
+	rewritten := make(map[int32]bool)
+	for _, block := range index.Blocks {
+		switch {
+		case referenced[block.ID] == 0:
+			plan.result.Removed = append(plan.result.Removed, block.Name)
+		case referenced[block.ID] < total[block.ID]:
+			rewritten[block.ID] = true
+			plan.result.Rewritten = append(plan.result.Rewritten, block.Name)
+		default:
+			continue
+		}
+		plan.obsolete = append(plan.obsolete, block)
+		plan.result.ReclaimedBytes += block.Size
+	}
+	for _, file := range index.Files {
+		if rewritten[file.BlockID] && live[extentKey{file.BlockID, file.Offset}] {
+			plan.moves = append(plan.moves, file)
+		}
+	}
+	return plan
+}
+
+// Compact rewrites the blocks of an archive that hold contents no snapshot
+// references any more, or that were removed from an archive without
+// snapshots. Referenced contents of partially referenced blocks are moved
+// into new blocks, blocks without referenced contents are removed and the
+// snapshots and manifest are updated to the new locations. With DryRun it
+// returns the blocks it would rewrite and remove and leaves the archive as it is
+func (p defaultPacker) Compact(archiveDir string) (*CompactResult, error) {
+	unlock, err := p.lockArchive(archiveDir, !p.opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	// Contents moved are compressed again with the dictionary of the archive
+	if p.dictionary, err = latestDictionary(archiveDir); err != nil {
+		return nil, err
+	}
+	index, err := p.buildManifest(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error indexing archive: %w", err)
+	}
+	plan := planCompact(index, refs)
+	moved, err := p.moveContents(archiveDir, plan)
+	if err != nil {
+		return nil, err
+	}
+	result := plan.result
+	if p.opts.DryRun {
+		return result, nil
+	}
+
+	// Point the snapshots at the moved contents before the old blocks go
+	for _, ref := range refs {
+		if err := ref.manifest.relocate(moved, plan.blocks); err != nil {
+			return nil, err
+		}
+		if err := writeManifestFile(ref.path, ref.manifest); err != nil {
+			return nil, fmt.Errorf("error updating snapshot %d: %w", ref.manifest.Generation, err)
+		}
+	}
+
+	for _, block := range plan.obsolete {
+		if err := removeBlock(filepath.Join(archiveDir, block.Name)); err != nil {
+			return nil, fmt.Errorf("error removing block %s: %w", block.Name, err)
+		}
+	}
+	if err := p.writeManifest(archiveDir); err != nil {
+		return nil, err
+	}
+
+	p.logger().Info("Compacted archive", "blocks_rewritten", len(result.Rewritten), "blocks_written", len(result.Written),
+		"blocks_removed", len(result.Removed), "reclaimed_bytes", result.ReclaimedBytes)
+	return result, nil
+}
+
+// moveContents writes the contents the plan moves into new blocks, added to
+// the blocks of the plan, and returns where each moved extent is now stored.
+// The size of the new blocks is taken from the space the plan reclaims. With DryRun
+// the blocks are only encoded to measure their size, so the space reclaimed
+// is the same as without it, and nothing is moved
+func (p defaultPacker) moveContents(archiveDir string, plan *compactPlan) (map[extentKey]extentKey, error) {
+	blocks, result := plan.blocks, plan.result
+
+	// Copy the referenced contents into new blocks, the checksum of every file
+	// is checked as it is copied
+	sources := make(map[extentKey]extentKey)
+	open := func(metadata *FileMetadata) (io.ReadCloser, error) {
+		source := sources[extentKey{metadata.BlockID, metadata.Offset}]
+		f, err := openBlockFile(filepath.Join(archiveDir, blocks[source.blockID].Name))
+		if err != nil {
+			return nil, err
+		}
+		return &sectionReadCloser{
+			SectionReader: contentSection(f, source.offset, metadata),
+			closer:        f,
+		}, nil
+	}
+	moved := make(map[extentKey]extentKey)
+	writeMoved := func(block *Block) error {
+		if p.opts.DryRun {
+			size, err := p.measureBlock(block, open)
+			if err != nil {
+				return fmt.Errorf("error encoding block: %w", err)
+			}
+			name, err := p.blockName(block.ID, block.Checksum)
+			if err != nil {
+				return err
+			}
+			result.Written = append(result.Written, name)
+			result.ReclaimedBytes -= size
+			return nil
+		}
+
+		// Writing the block assigns the offsets the files are stored at,
+		// which differ from the planned ones once contents are compressed
+		// or zero runs left out, so sources are matched by position
+		planned := make([]extentKey, len(block.Files))
+		for i, metadata := range block.Files {
+			planned[i] = sources[extentKey{block.ID, metadata.Offset}]
+		}
+		if err := p.writeBlock(block, archiveDir, open); err != nil {
+			return fmt.Errorf("error writing block: %w", err)
+		}
+		if len(block.Files) != len(planned) {
+			return fmt.Errorf("block %d holds %d of %d moved files: %w", block.ID, len(block.Files), len(planned), ErrCorrupted)
+		}
+		size, err := blockFileSize(filepath.Join(archiveDir, block.fileName))
+		if err != nil {
+			return err
+		}
+		blocks[block.ID] = ManifestBlock{
+			ID:       block.ID,
+			Name:     block.fileName,
+			Size:     size,
+			Checksum: hex.EncodeToString(block.Checksum),
+			Volumes:  block.volumes,
+		}
+		for i, metadata := range block.Files {
+			moved[planned[i]] = extentKey{block.ID, blockHeaderSize + metadata.Offset}
+		}
+		result.Written = append(result.Written, block.fileName)
+		result.ReclaimedBytes -= size
+		return nil
+	}
+
+	if len(plan.moves) > 0 {
+		sizes := make([]int64, len(plan.moves))
+		for i, file := range plan.moves {
+			sizes[i] = file.Size
+		}
+		p.opts.BlockSize = p.blockSizeFor(sizes)
+	}
+
+	current := &Block{ID: plan.nextID}
+	for i := range plan.moves {
+		metadata, err := plan.moves[i].metadata()
+		if err != nil {
+			return nil, err
+		}
+		if len(current.Files) > 0 && current.Size+metadata.Size > p.opts.BlockSize {
+			if err := writeMoved(current); err != nil {
+				return nil, err
+			}
+			current = &Block{ID: current.ID + 1}
+		}
+		sources[extentKey{current.ID, current.Size}] = extentKey{metadata.BlockID, metadata.Offset}
+		metadata.BlockID = current.ID
+		metadata.Offset = current.Size
+		current.Files = append(current.Files, metadata)
+		current.Size += metadata.Size
+	}
+	if len(current.Files) > 0 {
+		if err := writeMoved(current); err != nil {
+			return nil, err
+		}
+	}
+	return moved, nil
+}
+
+// measureBlock returns the size a block would be written in, encoding it
+// without keeping any of it
+func (p defaultPacker) measureBlock(block *Block, open contentOpener) (int64, error) {
+	w := &countingWriter{w: io.Discard}
+	var err error
+	if p.opts.Format == FormatZip {
+		err = p.writeZipTo(w, block, open)
+	} else {
+		err = p.writeBlockTrailingTo(w, block, open)
+	}
+	return w.n, err
+}
+
+// relocate points the files of a manifest at the new location of moved
+// contents and lists the blocks they are now stored in
+func (m *Manifest) relocate(moved map[extentKey]extentKey, blocks map[int32]ManifestBlock) error {
+	used := make(map[int32]bool)
+	for i := range m.Files {
+		file := &m.Files[i]
+		if to, ok := moved[extentKey{file.BlockID, file.Offset}]; ok {
+			file.BlockID = to.blockID
+			file.Offset = to.offset
+		}
+		used[file.BlockID] = true
+	}
+
+	m.Blocks = m.Blocks[:0]
+	for id := range used {
+		block, ok := blocks[id]
+		if !ok {
+			return fmt.Errorf("block %d referenced by the manifest is missing: %w", id, ErrCorrupted)
+		}
+		m.Blocks = append(m.Blocks, block)
+	}
+	m.sort()
+	return nil
+}
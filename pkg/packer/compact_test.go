@@ -0,0 +1,129 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTree replaces the files of dir with the contents given by name
+func writeTree(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the contents of the regular files below dir by base name
+func readTree(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		files[d.Name()] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// generation returns the files of one generation of a source tree, half of
+// which change between generations. Contents compress well and hold runs of
+// zeros, so both compression and zero run encoding shrink them
+func generation(gen int) map[string][]byte {
+	files := make(map[string][]byte)
+	for i := 0; i < 12; i++ {
+		version := 0
+		if i%2 == 0 {
+			version = gen
+		}
+		var b bytes.Buffer
+		b.WriteString(strings.Repeat(fmt.Sprintf("file %d version %d\n", i, version), 200+i*10))
+		b.Write(make([]byte, 8192))
+		b.WriteString(strings.Repeat("tail\n", i+1))
+		files[fmt.Sprintf("file-%02d.txt", i)] = b.Bytes()
+	}
+	return files
+}
+
+func TestCompactKeepsSnapshotsRestorable(t *testing.T) {
+	tests := []struct {
+		name string
+		opts PackerOptions
+	}{
+		{"plain", PackerOptions{}},
+		{"zstd", PackerOptions{Compression: CompressionZstd}},
+		{"deflate", PackerOptions{Compression: CompressionDeflate}},
+		{"zero runs", PackerOptions{ZeroRunEncoding: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.BlockSize = 32 << 10
+			p := NewPacker(tt.opts)
+			src := filepath.Join(t.TempDir(), "src")
+			archive := filepath.Join(t.TempDir(), "archive")
+
+			for gen := 1; gen <= 3; gen++ {
+				writeTree(t, src, generation(gen))
+				if _, err := p.Snapshot(src, archive); err != nil {
+					t.Fatalf("snapshot %d: %v", gen, err)
+				}
+			}
+			if err := p.ForgetSnapshot(archive, 1); err != nil {
+				t.Fatal(err)
+			}
+			dryRun := tt.opts
+			dryRun.DryRun = true
+			planned, err := NewPacker(dryRun).Compact(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := p.Compact(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Rewritten) == 0 {
+				t.Fatal("no block was rewritten, the test does not cover relocation")
+			}
+			if planned.ReclaimedBytes != result.ReclaimedBytes {
+				t.Errorf("dry run reclaims %d bytes, Compact %d", planned.ReclaimedBytes, result.ReclaimedBytes)
+			}
+
+			for gen := 2; gen <= 3; gen++ {
+				out := t.TempDir()
+				if err := p.RestoreSnapshot(archive, gen, out); err != nil {
+					t.Fatalf("restoring snapshot %d: %v", gen, err)
+				}
+				got := readTree(t, out)
+				want := generation(gen)
+				if len(got) != len(want) {
+					t.Fatalf("snapshot %d restored %d files, want %d", gen, len(got), len(want))
+				}
+				for name, data := range want {
+					if !bytes.Equal(got[name], data) {
+						t.Errorf("snapshot %d: %s differs after compact", gen, name)
+					}
+				}
+			}
+			if err := p.Verify(archive); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Compact metadata records store every number as a varint and most fields
+// relative to the record before them, so the metadata of a block of tiny files
+// takes a fraction of the fixed width encoding. Records start with the length
+// of the path prefix shared with the previous record followed by the rest of
+// the path, the size, the change in modification time and the gap between the
+// end of the previous file's bytes and the offset. A byte of compactField bits
+// then tells which of mode, owner and group differ from the previous record
+// and follow, and whether extended attributes follow the checksum. The
+// optional fields the footer flags announce come last, as in fixed width
+// records
+const (
+	compactFieldMode   byte = 1 << 0
+	compactFieldUid    byte = 1 << 1
+	compactFieldGid    byte = 1 << 2
+	compactFieldXattrs byte = 1 << 3
+)
+
+// metadataReader reads metadata sections, the compact encoding needs to read
+// varints a byte at a time
+type metadataReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// asMetadataReader returns r as a metadataReader, buffering it when needed.
+// Compact metadata only follows the data section, so reading past it does
+// not lose data
+func asMetadataReader(r io.Reader) metadataReader {
+	if mr, ok := r.(metadataReader); ok {
+		return mr
+	}
+	return bufio.NewReader(r)
+}
+
+// writeCompactMetadata writes a file metadata record in the compact encoding,
+// relative to prev, the record written before it or nil for the first
+func writeCompactMetadata(w io.Writer, metadata *FileMetadata, prev *FileMetadata, flags uint32) error {
+	if prev == nil {
+		prev = &FileMetadata{ModTime: time.Unix(0, 0)}
+	}
+
+	shared := 0
+	for shared < len(metadata.Path) && shared < len(prev.Path) && metadata.Path[shared] == prev.Path[shared] {
+		shared++
+	}
+	b := binary.AppendUvarint(nil, uint64(shared))
+	b = binary.AppendUvarint(b, uint64(len(metadata.Path)-shared))
+	b = append(b, metadata.Path[shared:]...)
+	b = binary.AppendUvarint(b, uint64(metadata.Size))
+	b = binary.AppendVarint(b, metadata.ModTime.Unix()-prev.ModTime.Unix())
+	b = binary.AppendVarint(b, metadata.Offset-(prev.Offset+prev.storedSize()))
+
+	var fields byte
+	if metadata.Mode != prev.Mode {
+		fields |= compactFieldMode
+	}
+	if metadata.Uid != prev.Uid {
+		fields |= compactFieldUid
+	}
+	if metadata.Gid != prev.Gid {
+		fields |= compactFieldGid
+	}
+	if len(metadata.Xattrs) > 0 {
+		fields |= compactFieldXattrs
+	}
+	b = append(b, fields)
+	if fields&compactFieldMode != 0 {
+		b = binary.AppendUvarint(b, uint64(metadata.Mode))
+	}
+	if fields&compactFieldUid != 0 {
+		b = binary.AppendUvarint(b, uint64(metadata.Uid))
+	}
+	if fields&compactFieldGid != 0 {
+		b = binary.AppendUvarint(b, uint64(metadata.Gid))
+	}
+	b = append(b, metadata.Checksum...)
+
+	// Extended attributes sorted by name so blocks are reproducible
+	if fields&compactFieldXattrs != 0 {
+		names := make([]string, 0, len(metadata.Xattrs))
+		for name := range metadata.Xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b = binary.AppendUvarint(b, uint64(len(names)))
+		for _, name := range names {
+			b = binary.AppendUvarint(b, uint64(len(name)))
+			b = append(b, name...)
+			b = binary.AppendUvarint(b, uint64(len(metadata.Xattrs[name])))
+			b = append(b, metadata.Xattrs[name]...)
+		}
+	}
+
+	if flags&footerFlagBirthTime != 0 {
+		var birthSec int64
+		var birthNsec int
+		if !metadata.BirthTime.IsZero() {
+			birthSec = metadata.BirthTime.Unix()
+			birthNsec = metadata.BirthTime.Nanosecond()
+		}
+		b = binary.AppendVarint(b, birthSec)
+		b = binary.AppendUvarint(b, uint64(birthNsec))
+	}
+	if flags&footerFlagAttributes != 0 {
+		b = binary.AppendUvarint(b, uint64(metadata.Attributes))
+	}
+	if flags&footerFlagHoles != 0 {
+		b = appendCompactExtents(b, metadata.Holes)
+	}
+	if flags&footerFlagZeroRuns != 0 {
+		b = appendCompactExtents(b, metadata.ZeroRuns)
+	}
+	if flags&footerFlagCompression != 0 {
+		b = append(b, byte(metadata.Compression))
+		b = binary.AppendUvarint(b, uint64(metadata.CompressedSize))
+	}
+	if flags&footerFlagDevices != 0 {
+		b = binary.AppendUvarint(b, metadata.Device)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readCompactMetadata reads a file metadata record in the compact encoding,
+// relative to prev, the record read before it or nil for the first
+func readCompactMetadata(r metadataReader, prev *FileMetadata, flags uint32) (*FileMetadata, error) {
+	if prev == nil {
+		prev = &FileMetadata{ModTime: time.Unix(0, 0)}
+	}
+
+	shared, err := readCompactUint(r, uint64(len(prev.Path)))
+	if err != nil {
+		return nil, err
+	}
+	rest, err := readCompactUint(r, maxPathLength-shared)
+	if err != nil {
+		return nil, err
+	}
+	path := make([]byte, shared+rest)
+	copy(path, prev.Path[:shared])
+	if _, err := io.ReadFull(r, path[shared:]); err != nil {
+		return nil, err
+	}
+
+	size, err := readCompactUint(r, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	gap, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	mode, uid, gid := uint64(prev.Mode), uint64(prev.Uid), uint64(prev.Gid)
+	for _, field := range []struct {
+		bit   byte
+		value *uint64
+	}{{compactFieldMode, &mode}, {compactFieldUid, &uid}, {compactFieldGid, &gid}} {
+		if fields&field.bit != 0 {
+			if *field.value, err = readCompactUint(r, math.MaxUint32); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	checksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, checksum); err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string][]byte
+	if fields&compactFieldXattrs != 0 {
+		count, err := readCompactUint(r, maxXattrs)
+		if err != nil {
+			return nil, err
+		}
+		xattrs = make(map[string][]byte, min(count, maxXattrsHint))
+		for i := uint64(0); i < count; i++ {
+			name, err := readCompactBytes(r, maxXattrNameLength)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readCompactBytes(r, maxXattrValueLength)
+			if err != nil {
+				return nil, err
+			}
+			xattrs[string(name)] = value
+		}
+	}
+
+	metadata := &FileMetadata{
+		Path:     slashPath(string(path)),
+		Size:     int64(size),
+		ModTime:  time.Unix(prev.ModTime.Unix()+modTime, 0),
+		Offset:   prev.Offset + prev.storedSize() + gap,
+		Mode:     uint32(mode),
+		Uid:      uint32(uid),
+		Gid:      uint32(gid),
+		Checksum: checksum,
+		Xattrs:   xattrs,
+	}
+
+	if flags&footerFlagBirthTime != 0 {
+		birthSec, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		birthNsec, err := readCompactUint(r, 1e9-1)
+		if err != nil {
+			return nil, err
+		}
+		if birthSec != 0 || birthNsec != 0 {
+			metadata.BirthTime = time.Unix(birthSec, int64(birthNsec))
+		}
+	}
+	if flags&footerFlagAttributes != 0 {
+		attributes, err := readCompactUint(r, math.MaxUint32)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Attributes = uint32(attributes)
+	}
+	if flags&footerFlagHoles != 0 {
+		if metadata.Holes, err = readCompactExtents(r, metadata.Size); err != nil {
+			return nil, err
+		}
+	}
+	if flags&footerFlagZeroRuns != 0 {
+		if metadata.ZeroRuns, err = readCompactExtents(r, metadata.Size); err != nil {
+			return nil, err
+		}
+	}
+	if flags&footerFlagCompression != 0 {
+		compression, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		compressedSize, err := readCompactUint(r, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Compression = Compression(compression)
+		metadata.CompressedSize = int64(compressedSize)
+		if err := checkCompressedFile(metadata); err != nil {
+			return nil, err
+		}
+	}
+	if flags&footerFlagDevices != 0 {
+		if metadata.Device, err = readCompactUint(r, math.MaxUint64); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+// appendCompactExtents appends a count prefixed list of extents as varints
+func appendCompactExtents(b []byte, extents []Extent) []byte {
+	b = binary.AppendUvarint(b, uint64(len(extents)))
+	for _, extent := range extents {
+		b = binary.AppendUvarint(b, uint64(extent.Offset))
+		b = binary.AppendUvarint(b, uint64(extent.Length))
+	}
+	return b
+}
+
+// readCompactExtents reads a count prefixed list of extents of a file of the
+// given size, rejecting lists that are not sorted or extend past the file
+func readCompactExtents(r metadataReader, size int64) ([]Extent, error) {
+	count, err := readCompactUint(r, maxExtents)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	// The list grows as extents are read, a corrupt count cannot force a
+	// huge allocation
+	var extents []Extent
+	for i := uint64(0); i < count; i++ {
+		offset, err := readCompactUint(r, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		length, err := readCompactUint(r, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, Extent{Offset: int64(offset), Length: int64(length)})
+	}
+	if err := checkExtents(extents, size); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// readCompactUint reads a varint, rejecting values above max
+func readCompactUint(r io.ByteReader, max uint64) (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if v > max {
+		return 0, fmt.Errorf("invalid value %d: %w", v, ErrCorrupted)
+	}
+	return v, nil
+}
+
+// readCompactBytes reads a varint length prefixed byte slice, rejecting
+// lengths above maxLength
+func readCompactBytes(r metadataReader, maxLength uint64) ([]byte, error) {
+	length, err := readCompactUint(r, maxLength)
+	if err != nil {
+		return nil, err
+	}
+	return readFull(r, int64(length))
+}
@@ -0,0 +1,334 @@
+package packer
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how the contents of a file are stored in the data
+// section. Each file records its own method, like the entries of a zip file,
+// so files that would not shrink are stored as they are
+type Compression uint8
+
+const (
+	CompressionNone    Compression = iota // Contents are stored as they are
+	CompressionDeflate                    // Contents are compressed with DEFLATE (RFC 1951)
+	CompressionZstd                       // Contents are a zstd frame (RFC 8878), with the archive's dictionary under TrainDictionary
+)
+
+// Files smaller than minCompressSize are stored, the few bytes compression
+// could save are lost to its framing
+const minCompressSize = 64
+
+// compressionSample is how much of the start of a file is sampled to estimate
+// how well it compresses
+const compressionSample = 64 * 1024
+
+// maxCompressEntropy is the entropy, in bits per byte, above which a sample is
+// taken to be already compressed or encrypted and the file is stored. Text is
+// around 4 to 5 bits per byte, executables around 6, compressed data close to 8
+const maxCompressEntropy = 7.5
+
+// compressedExtensions are file extensions of formats that are compressed
+// already, stored without trying to compress them again
+var compressedExtensions = map[string]bool{
+	// Images
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".heif": true,
+	".avif": true, ".jxl": true,
+	// Audio and video
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true, ".mp4": true,
+	".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true, ".wmv": true,
+	// Archives and compressed files
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".txz": true, ".zst": true,
+	".lz4": true, ".lzma": true, ".br": true, ".7z": true, ".rar": true, ".cab": true, ".beam": true,
+	// Zip based documents and packages
+	".jar": true, ".war": true, ".apk": true, ".ipa": true, ".docx": true, ".xlsx": true, ".pptx": true,
+	".odt": true, ".ods": true, ".odp": true, ".epub": true,
+	// Fonts
+	".woff": true, ".woff2": true,
+}
+
+// checkCompression rejects compression methods this version does not know and
+// dictionaries that cannot be used
+func (p defaultPacker) checkCompression() error {
+	switch p.opts.Compression {
+	case CompressionNone, CompressionDeflate, CompressionZstd:
+	default:
+		return fmt.Errorf("unknown compression method %d: %w", p.opts.Compression, ErrInvalidOption)
+	}
+	if !p.opts.TrainDictionary {
+		return nil
+	}
+	if p.opts.Compression != CompressionZstd {
+		return fmt.Errorf("dictionaries are only trained for zstd compression: %w", ErrInvalidOption)
+	}
+	if p.encryptsMetadata() {
+		return fmt.Errorf("dictionaries are kept in the manifest, which archives with encrypted metadata do not have: %w", ErrInvalidOption)
+	}
+	return nil
+}
+
+// checkCompressedFile rejects compression fields of a metadata record that
+// this version cannot read or that contradict each other
+func checkCompressedFile(metadata *FileMetadata) error {
+	switch metadata.Compression {
+	case CompressionNone:
+		if metadata.CompressedSize != 0 {
+			return fmt.Errorf("compressed size of stored file %s: %w", metadata.Path, ErrCorrupted)
+		}
+		return nil
+	case CompressionDeflate, CompressionZstd:
+	default:
+		return fmt.Errorf("compression method %d of file %s: %w", metadata.Compression, metadata.Path, ErrUnsupportedVersion)
+	}
+	if metadata.CompressedSize < 0 || len(metadata.ZeroRuns) > 0 {
+		return fmt.Errorf("invalid compressed size or zero runs of file %s: %w", metadata.Path, ErrCorrupted)
+	}
+	return nil
+}
+
+// compressionFor returns the method a file is compressed with when it is
+// copied into a block. Files copied from blocks keep the method they were
+// compressed with, and files of compressed formats are stored
+func (p defaultPacker) compressionFor(metadata *FileMetadata) Compression {
+	if metadata.Compression != CompressionNone {
+		return metadata.Compression
+	}
+	if p.opts.Compression == CompressionNone {
+		return CompressionNone
+	}
+	if metadata.Size != unknownSize && metadata.Size < minCompressSize {
+		return CompressionNone
+	}
+	if compressedExtensions[strings.ToLower(path.Ext(metadata.Path))] {
+		return CompressionNone
+	}
+	return p.opts.Compression
+}
+
+// entropy returns the Shannon entropy of b in bits per byte
+func entropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var bits float64
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(b))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
+
+// compressWriter compresses file contents into a data section, counting the
+// bytes written for them
+type compressWriter struct {
+	w      io.WriteCloser // Compressor
+	stored *countingWriter
+	done   func() // Hands the compressor back once it is closed
+}
+
+// newCompressWriter returns a writer compressing contents with the given
+// method, zstd with the packer's dictionary when it has one
+func (p defaultPacker) newCompressWriter(w io.Writer, method Compression) (*compressWriter, error) {
+	cw := &compressWriter{stored: &countingWriter{w: w}, done: func() {}}
+	switch method {
+	case CompressionDeflate:
+		// The level is valid, NewWriter cannot fail
+		cw.w, _ = flate.NewWriter(cw.stored, flate.DefaultCompression)
+	case CompressionZstd:
+		d := p.dictionary
+		if d == nil {
+			d = noDictionary
+		}
+		enc, err := d.encoder(cw.stored)
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd encoder: %w", err)
+		}
+		cw.w, cw.done = enc, func() { d.putEncoder(enc) }
+	default:
+		return nil, fmt.Errorf("unknown compression method %d: %w", method, ErrInvalidOption)
+	}
+	return cw, nil
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+// flush writes the rest of the compressed contents. It must be called once
+// the contents are complete
+func (w *compressWriter) flush() error {
+	err := w.w.Close()
+	if err == nil {
+		w.done()
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompressReader reads the contents of a compressed file from the bytes
+// stored for it. Stored bytes that do not decompress to exactly the size of
+// the file are reported as corrupted
+type decompressReader struct {
+	stored *sourceReader
+	method Compression
+	r      io.Reader // Decompressor, opened on the first read
+	done   func()    // Hands the decompressor back once the contents are read
+	pos    int64
+	size   int64
+}
+
+func newDecompressReader(stored io.Reader, metadata *FileMetadata) *decompressReader {
+	return &decompressReader{stored: &sourceReader{r: stored}, method: metadata.Compression, size: metadata.Size}
+}
+
+// open starts decompressing. zstd frames name the dictionary they need, which
+// must be registered from the manifest of their archive
+func (r *decompressReader) open() error {
+	switch r.method {
+	case CompressionDeflate:
+		fr := flate.NewReader(r.stored)
+		r.r, r.done = fr, func() { fr.Close() }
+		return nil
+	case CompressionZstd:
+		br := bufio.NewReader(r.stored)
+		header, _ := br.Peek(zstd.HeaderMaxSize)
+		var frame zstd.Header
+		if err := frame.Decode(header); err != nil {
+			return r.corrupted(err)
+		}
+		d, err := lookupDictionary(frame.DictionaryID)
+		if err != nil {
+			return err
+		}
+		dec, err := d.decoder(br)
+		if err != nil {
+			return r.corrupted(err)
+		}
+		r.r, r.done = dec, func() { d.putDecoder(dec) }
+		return nil
+	}
+	return fmt.Errorf("compression method %d: %w", r.method, ErrUnsupportedVersion)
+}
+
+func (r *decompressReader) Read(b []byte) (int, error) {
+	if r.r == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.pos >= r.size {
+		// The stream must end with the contents
+		var extra [1]byte
+		n, err := r.r.Read(extra[:])
+		if n > 0 {
+			return 0, fmt.Errorf("contents decompress past %d bytes: %w", r.size, ErrCorrupted)
+		}
+		if err != nil && err != io.EOF {
+			return 0, r.corrupted(err)
+		}
+		r.release()
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.size-r.pos {
+		b = b[:r.size-r.pos]
+	}
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+	if err == io.EOF {
+		if r.pos < r.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	if err != nil {
+		err = r.corrupted(err)
+	}
+	return n, err
+}
+
+// release hands the decompressor back, once it read the whole stream
+func (r *decompressReader) release() {
+	if r.done != nil {
+		r.done()
+		r.done = nil
+	}
+}
+
+// corrupted reports a stream that does not decompress to the contents. Errors
+// reading the stored bytes are returned as they are
+func (r *decompressReader) corrupted(err error) error {
+	if r.stored.err != nil || err == io.ErrUnexpectedEOF {
+		return err
+	}
+	return fmt.Errorf("decompressing contents: %v: %w", err, ErrCorrupted)
+}
+
+// decompressReaderAt reads the contents of a compressed file at any offset.
+// Reads moving forward continue decompressing where the last one stopped,
+// reads moving back start again from the beginning
+type decompressReaderAt struct {
+	mu       sync.Mutex
+	stored   io.ReaderAt
+	metadata *FileMetadata
+	r        io.Reader // Contents from pos on
+	pos      int64
+}
+
+func newDecompressReaderAt(stored io.ReaderAt, metadata *FileMetadata) *decompressReaderAt {
+	return &decompressReaderAt{stored: stored, metadata: metadata}
+}
+
+func (r *decompressReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off >= r.metadata.Size {
+		return 0, io.EOF
+	}
+	if r.r == nil || off < r.pos {
+		r.r = newDecompressReader(io.NewSectionReader(r.stored, 0, r.metadata.CompressedSize), r.metadata)
+		r.pos = 0
+	}
+	if off > r.pos {
+		skipped, err := io.CopyN(io.Discard, r.r, off-r.pos)
+		r.pos += skipped
+		if err != nil {
+			r.r = nil
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(r.r, b)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF && r.pos == r.metadata.Size {
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		r.r = nil
+	}
+	return n, err
+}
@@ -0,0 +1,317 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Limits of dictionary training. Dictionaries help small files most, which
+// are too short for zstd to learn their common strings on its own
+const (
+	dictionarySize        = 32 * 1024  // Bytes of history in a trained dictionary
+	dictionarySampleFiles = 1024       // Most files sampled
+	dictionaryFileSize    = 128 * 1024 // Largest file sampled, larger files compress well on their own
+	dictionarySampleSize  = 16 * 1024  // Bytes read from the start of each sampled file
+	minDictionarySamples  = 8          // Fewest samples a dictionary is trained on
+)
+
+// maxZstdWindow bounds the memory a corrupt or malicious frame can make a
+// reader allocate, frames written by this package use a window of 8MB
+const maxZstdWindow = 32 << 20
+
+// ErrMissingDictionary is returned for files compressed with a zstd dictionary
+// that is not in the manifest of their archive
+var ErrMissingDictionary = errors.New("compression dictionary not found")
+
+// zstdDictionary is a zstd dictionary with pools of the encoders and decoders
+// using it. noDictionary compresses without one
+type zstdDictionary struct {
+	id       uint32
+	data     []byte
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+var noDictionary = &zstdDictionary{}
+
+// zstdDictionaries holds the dictionaries of every manifest read and every
+// dictionary trained, by ID. IDs are derived from the dictionary contents, so
+// an entry never changes once it is registered
+var zstdDictionaries sync.Map
+
+// dictionaryID derives the ID of a dictionary from its entropy tables and
+// history, within the range the zstd format leaves to private dictionaries, and
+// records it in the dictionary header after the magic number
+func dictionaryID(data []byte) uint32 {
+	sum := sha256.Sum256(data[8:])
+	const first, end = 1 << 15, 1 << 31
+	id := first + binary.LittleEndian.Uint32(sum[:4])%(end-first)
+	binary.LittleEndian.PutUint32(data[4:8], id)
+	return id
+}
+
+// registerDictionary makes a dictionary available to readers, checking that
+// it is a valid zstd dictionary with the given ID and the only one with it
+func registerDictionary(id uint32, data []byte) (*zstdDictionary, error) {
+	if d, ok := zstdDictionaries.Load(id); ok {
+		if !bytes.Equal(d.(*zstdDictionary).data, data) {
+			return nil, fmt.Errorf("compression dictionary %d differs from the one registered: %w", id, ErrCorrupted)
+		}
+		return d.(*zstdDictionary), nil
+	}
+	info, err := zstd.InspectDictionary(data)
+	if err != nil || info.ID() != id {
+		return nil, fmt.Errorf("invalid compression dictionary %d: %w", id, ErrCorrupted)
+	}
+	d, _ := zstdDictionaries.LoadOrStore(id, &zstdDictionary{id: id, data: data})
+	return d.(*zstdDictionary), nil
+}
+
+// lookupDictionary returns the registered dictionary with the given ID, or
+// noDictionary for ID 0
+func lookupDictionary(id uint32) (*zstdDictionary, error) {
+	if id == 0 {
+		return noDictionary, nil
+	}
+	d, ok := zstdDictionaries.Load(id)
+	if !ok {
+		return nil, fmt.Errorf("zstd dictionary %d: %w", id, ErrMissingDictionary)
+	}
+	return d.(*zstdDictionary), nil
+}
+
+// encoder returns an encoder writing a single zstd frame to w, which must be
+// closed and handed back with putEncoder
+func (d *zstdDictionary) encoder(w io.Writer) (*zstd.Encoder, error) {
+	if enc, ok := d.encoders.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return enc, nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithEncoderCRC(false), zstd.WithZeroFrames(true)}
+	if d.data != nil {
+		opts = append(opts, zstd.WithEncoderDict(d.data))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+func (d *zstdDictionary) putEncoder(enc *zstd.Encoder) {
+	enc.Reset(nil)
+	d.encoders.Put(enc)
+}
+
+// decoder returns a decoder reading zstd frames from r, handed back with
+// putDecoder once they are read
+func (d *zstdDictionary) decoder(r io.Reader) (*zstd.Decoder, error) {
+	if dec, ok := d.decoders.Get().(*zstd.Decoder); ok {
+		return dec, dec.Reset(r)
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindow)}
+	if d.data != nil {
+		opts = append(opts, zstd.WithDecoderDicts(d.data))
+	}
+	return zstd.NewReader(r, opts...)
+}
+
+func (d *zstdDictionary) putDecoder(dec *zstd.Decoder) {
+	dec.Reset(nil)
+	d.decoders.Put(dec)
+}
+
+// manifestDictionaries is the part of a manifest read for its dictionaries
+type manifestDictionaries struct {
+	Dictionaries []ManifestDictionary `json:"dictionaries"`
+}
+
+// register makes the dictionaries of a manifest available to readers
+func (m manifestDictionaries) register() ([]*zstdDictionary, error) {
+	dicts := make([]*zstdDictionary, 0, len(m.Dictionaries))
+	for _, dictionary := range m.Dictionaries {
+		d, err := registerDictionary(dictionary.ID, dictionary.Data)
+		if err != nil {
+			return nil, err
+		}
+		dicts = append(dicts, d)
+	}
+	return dicts, nil
+}
+
+// readDictionaries reads the dictionaries recorded in the manifest of an
+// archive directory, skipping its files. Archives without a manifest have none
+func readDictionaries(archiveDir string) ([]ManifestDictionary, error) {
+	f, err := os.Open(filepath.Join(archiveDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m manifestDictionaries
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	return m.Dictionaries, nil
+}
+
+// loadDictionaries registers the dictionaries of an archive directory, so the
+// files compressed with them can be read from its blocks. It returns them in
+// the order they were added to the archive
+func loadDictionaries(archiveDir string) ([]*zstdDictionary, error) {
+	dictionaries, err := readDictionaries(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading compression dictionaries: %w", err)
+	}
+	return manifestDictionaries{dictionaries}.register()
+}
+
+// latestDictionary registers the dictionaries of an archive directory and
+// returns the one added last, which files rewritten in place are compressed
+// with again, or nil when it has none
+func latestDictionary(archiveDir string) (*zstdDictionary, error) {
+	dicts, err := loadDictionaries(archiveDir)
+	if err != nil || len(dicts) == 0 {
+		return nil, err
+	}
+	return dicts[len(dicts)-1], nil
+}
+
+// archiveDictionary returns the dictionary the files packed into an archive
+// directory are compressed with under TrainDictionary: the one the archive
+// has already, or one trained on a sample of the files and recorded in its
+// manifest before any block is written, as the blocks cannot be read without it
+func (p defaultPacker) archiveDictionary(archiveDir string, files []FileInfo, open contentOpener) (*zstdDictionary, error) {
+	if !p.opts.TrainDictionary {
+		return nil, nil
+	}
+	if d, err := latestDictionary(archiveDir); d != nil || err != nil {
+		return d, err
+	}
+	d, err := p.trainDictionary(files, open)
+	if d == nil || err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(archiveDir, manifestFileName)
+	m, err := readManifestFile(path)
+	if os.IsNotExist(err) {
+		m, err = &Manifest{Version: manifestVersion, Blocks: []ManifestBlock{}, Files: []ManifestFile{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	m.Dictionaries = append(m.Dictionaries, d.manifest())
+	if err := writeManifestFile(path, m); err != nil {
+		return nil, fmt.Errorf("error recording compression dictionary: %w", err)
+	}
+	return d, nil
+}
+
+// trainDictionary trains a zstd dictionary on the start of a sample of the
+// small files to pack, read through open. The dictionary history is taken from
+// the samples in turn, holding the headers, keys and other strings files of a
+// kind share, and the entropy tables are learnt from compressing every sample
+// with it. The history is at most half of the sampled bytes, leaving the rest
+// to learn from. It returns nil when there are too few small files to learn from
+func (p defaultPacker) trainDictionary(files []FileInfo, open contentOpener) (*zstdDictionary, error) {
+	var candidates []FileInfo
+	for _, file := range files {
+		if file.IsDir || file.Size < minCompressSize || file.Size > dictionaryFileSize ||
+			compressedExtensions[strings.ToLower(filepath.Ext(file.ArchivePath))] {
+			continue
+		}
+		candidates = append(candidates, file)
+	}
+	step := max(1, len(candidates)/dictionarySampleFiles)
+	var samples [][]byte
+	for i := 0; i < len(candidates) && len(samples) < dictionarySampleFiles; i += step {
+		sample, err := readSample(open, &FileMetadata{Path: candidates[i].ArchivePath, sourcePath: candidates[i].Path})
+		if err != nil {
+			p.logger().Debug("Skipping dictionary sample", "path", candidates[i].Path, "error", err)
+			continue
+		}
+		if entropy(sample) <= maxCompressEntropy {
+			samples = append(samples, sample)
+		}
+	}
+	if len(samples) < minDictionarySamples {
+		p.logger().Info("Too few small files to train a compression dictionary", "samples", len(samples))
+		return nil, nil
+	}
+
+	var total int
+	for _, sample := range samples {
+		total += len(sample)
+	}
+	share, size := max(1024, dictionarySize/len(samples)), min(dictionarySize, total/2)
+	var history []byte
+	for _, sample := range samples {
+		history = append(history, sample[:min(share, len(sample), size-len(history))]...)
+		if len(history) == size {
+			break
+		}
+	}
+	data, err := buildDictionary(zstd.BuildDictOptions{
+		ID:       1 << 15, // Replaced by the ID derived from the dictionary
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		p.logger().Info("Packing without a compression dictionary", "error", err)
+		return nil, nil
+	}
+	id := dictionaryID(data)
+	d, err := registerDictionary(id, data)
+	if err != nil {
+		return nil, err
+	}
+	p.logger().Info("Trained compression dictionary", "id", id, "samples", len(samples), "size", len(data))
+	return d, nil
+}
+
+// buildDictionary builds a zstd dictionary, failing instead of panicking on
+// samples that leave no literals to build the entropy tables from
+func buildDictionary(opts zstd.BuildDictOptions) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error training compression dictionary: %v", r)
+		}
+	}()
+	data, err = zstd.BuildDict(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error training compression dictionary: %w", err)
+	}
+	return data, nil
+}
+
+// readSample reads the start of a file for dictionary training
+func readSample(open contentOpener, metadata *FileMetadata) ([]byte, error) {
+	f, err := open(metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sample := make([]byte, dictionarySampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return sample[:n], err
+}
+
+// manifest returns the manifest entry of a dictionary
+func (d *zstdDictionary) manifest() ManifestDictionary {
+	return ManifestDictionary{ID: d.id, Data: d.data}
+}
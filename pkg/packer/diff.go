@@ -0,0 +1,140 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// DiffResult lists how the files of one archive or directory differ from
+// another. Paths are archived paths and each list is sorted
+type DiffResult struct {
+	Added     []string // Files only in b
+	Removed   []string // Files only in a
+	Modified  []string // Files in both whose contents differ
+	Unchanged int      // Files in both with identical contents
+}
+
+// Empty reports whether both sides hold the same files with the same contents
+func (d *DiffResult) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// diffEntry is a file on one side of a diff. Files on disk are only hashed
+// once their checksum is needed
+type diffEntry struct {
+	size     int64
+	checksum []byte
+	diskPath string // Path of a file on disk, empty for archived files
+}
+
+// Diff compares a and b, each either an archive (a directory of .beam blocks
+// or a single block) or a plain directory. Files are matched by archived path,
+// the files of a directory under the paths Pack would record for them, and
+// compared by size and SHA-256 checksum
+func (p defaultPacker) Diff(a string, b string) (*DiffResult, error) {
+	filesA, err := p.diffSide(a)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := p.diffSide(b)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DiffResult{}
+	for path, entryA := range filesA {
+		entryB, ok := filesB[path]
+		if !ok {
+			result.Removed = append(result.Removed, path)
+			continue
+		}
+		same, err := p.sameContents(entryA, entryB)
+		if err != nil {
+			return nil, fmt.Errorf("error comparing %s: %w", path, err)
+		}
+		if same {
+			result.Unchanged++
+		} else {
+			result.Modified = append(result.Modified, path)
+		}
+	}
+	for path := range filesB {
+		if _, ok := filesA[path]; !ok {
+			result.Added = append(result.Added, path)
+		}
+	}
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Modified)
+	return result, nil
+}
+
+// diffSide indexes the files of an archive or directory by archived path
+func (p defaultPacker) diffSide(path string) (map[string]*diffEntry, error) {
+	blockPaths, err := listBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*diffEntry)
+	if len(blockPaths) > 0 {
+		archived, err := p.readArchiveIndex(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range archived {
+			files[p.opts.PathNormalization.normalize(metadata.Path)] = &diffEntry{size: metadata.Size, checksum: metadata.Checksum}
+		}
+		return files, nil
+	}
+
+	var found []FileInfo
+	err = filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			found = append(found, FileInfo{Path: filePath, Size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking directory: %w", err)
+	}
+	if len(found) == 0 {
+		return files, nil
+	}
+	found, err = p.mapPaths(found)
+	if errors.Is(err, ErrNoFiles) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range found {
+		files[file.ArchivePath] = &diffEntry{size: file.Size, diskPath: file.Path}
+	}
+	return files, nil
+}
+
+// sameContents compares two files by size, then by checksum
+func (p defaultPacker) sameContents(a *diffEntry, b *diffEntry) (bool, error) {
+	if a.size != b.size {
+		return false, nil
+	}
+	for _, entry := range []*diffEntry{a, b} {
+		if entry.checksum != nil {
+			continue
+		}
+		checksum, err := p.validator.CalculateFileChecksum(entry.diskPath)
+		if err != nil {
+			return false, err
+		}
+		entry.checksum = checksum
+	}
+	return checksumsEqual(a.checksum, b.checksum), nil
+}
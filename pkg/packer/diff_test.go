@@ -0,0 +1,33 @@
+package packer
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffArchiveAgainstDirectory(t *testing.T) {
+	p := NewPacker(PackerOptions{})
+	src := filepath.Join(t.TempDir(), "src")
+	archive := filepath.Join(t.TempDir(), "archive")
+	writeTree(t, src, map[string][]byte{"kept": []byte("same"), "changed": []byte("old"), "gone": []byte("x")})
+	if err := p.Pack(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, src, map[string][]byte{"kept": []byte("same"), "changed": []byte("new"), "new": []byte("y")})
+
+	diff, err := p.Diff(archive, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.ToSlash(src) + "/"
+	want := &DiffResult{
+		Added:     []string{prefix + "new"},
+		Removed:   []string{prefix + "gone"},
+		Modified:  []string{prefix + "changed"},
+		Unchanged: 1,
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("Diff returned %+v, want %+v", diff, want)
+	}
+}
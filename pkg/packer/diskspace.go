@@ -0,0 +1,79 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrInsufficientSpace is returned before unpacking when the filesystem of
+// the output directory has too little free space or too few free inodes for
+// the files to extract
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+// diskSpace is what a filesystem has free. Filesystems that do not report a
+// count leave it 0 with the count unknown
+type diskSpace struct {
+	bytes        uint64 // Bytes free for unprivileged users
+	inodes       uint64 // Inodes free
+	blockSize    int64  // Allocation unit, files take a whole number of them
+	inodesKnown  bool   // The filesystem reports a fixed number of inodes
+	reportsSpace bool   // The platform reports free space at all
+}
+
+// checkDiskSpace fails an unpack that the filesystem of the output directory
+// has no room for, before any file is written, instead of running out of space
+// with half the tree extracted. The space needed is estimated from the sizes
+// in the metadata, each file rounded up to the allocation unit, less the files
+// replaced, and the inodes from the files and directories created
+func (p defaultPacker) checkDiskSpace(outputDir string, plan *MergePlan) error {
+	if p.opts.SkipSpaceCheck {
+		return nil
+	}
+	dir, err := existingParent(outputDir)
+	if err != nil {
+		return err
+	}
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		p.logger().Debug("Cannot check free disk space", "dir", dir, "error", err)
+		return nil
+	}
+	if !free.reportsSpace {
+		return nil
+	}
+
+	files := int64(len(plan.New) + len(plan.Overwrite))
+	need := plan.ExtractedBytes + files*(free.blockSize-1) + int64(plan.NewDirectories)*free.blockSize
+	if p.opts.Overwrite == OverwriteAlways {
+		need -= plan.OverwrittenBytes
+	}
+	if need > 0 && uint64(need) > free.bytes {
+		return fmt.Errorf("unpacking needs about %d bytes in %s, %d are free: %w", need, dir, free.bytes, ErrInsufficientSpace)
+	}
+	inodes := uint64(len(plan.New) + plan.NewDirectories)
+	if free.inodesKnown && inodes > free.inodes {
+		return fmt.Errorf("unpacking creates %d files and directories in %s, %d inodes are free: %w", inodes, dir, free.inodes, ErrInsufficientSpace)
+	}
+	return nil
+}
+
+// existingParent returns the directory itself or the closest of its parents
+// that exists, where a directory not created yet will be
+func existingParent(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) {
+			return dir, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, nil
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package packer
+
+// freeDiskSpace reports nothing on this platform, unpacking is not checked
+func freeDiskSpace(dir string) (diskSpace, error) {
+	return diskSpace{}, nil
+}
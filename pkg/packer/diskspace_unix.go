@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package packer
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the free space of the filesystem holding dir
+func freeDiskSpace(dir string) (diskSpace, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return diskSpace{}, err
+	}
+	return diskSpace{
+		bytes:        uint64(st.Bavail) * uint64(st.Bsize),
+		inodes:       uint64(st.Ffree),
+		blockSize:    max(int64(st.Bsize), 1),
+		inodesKnown:  st.Files > 0, // btrfs and others allocate inodes as needed and report none
+		reportsSpace: true,
+	}, nil
+}
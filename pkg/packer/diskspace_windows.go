@@ -0,0 +1,22 @@
+//go:build windows
+
+package packer
+
+import "golang.org/x/sys/windows"
+
+// ntfsClusterSize is the default NTFS allocation unit for volumes up to 16TB
+const ntfsClusterSize = 4096
+
+// freeDiskSpace returns the free space of the volume holding dir, available to
+// the user under quotas. NTFS has no fixed number of inodes
+func freeDiskSpace(dir string) (diskSpace, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return diskSpace{}, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return diskSpace{}, err
+	}
+	return diskSpace{bytes: available, blockSize: ntfsClusterSize, reportsSpace: true}, nil
+}
@@ -0,0 +1,87 @@
+// Package packer packs files into fixed size .beam block archives and
+// extracts, verifies and repairs them.
+//
+// A Packer is created with NewPacker from PackerOptions. Pack, PackSources and
+// PackFS write an archive directory of .beam block files, named block-N.beam
+// unless a BlockNamer is set and optionally protected by Reed-Solomon parity
+// files, or of standard .zip volumes with FormatZip. PackStream writes the
+// same blocks as a single stream and PackToStore uploads them to a BlockStore
+// such as an S3 bucket, to which Sync replicates an archive directory by
+// uploading only the blocks the store lacks. Unpack, UnpackBlock, UnpackStream and UnpackFromStore
+// extract them again, Verify and VerifyExtracted check archives and extracted
+// trees against their checksums, Diff compares archives and directories, and
+// OpenArchive exposes an archive as an fs.FS. PathNormalization converts
+// archived and extracted paths to one Unicode normalization form. Archive
+// directories hold a manifest.json indexing every block and file, which
+// UnpackFromURL uses to fetch single files from an archive served over HTTP
+// with Range requests.
+//
+// Snapshot adds generations to an archive that share the blocks of earlier
+// generations for unchanged contents. RestoreSnapshot extracts a generation,
+// GC removes the blocks left unreferenced by ForgetSnapshot, and Compact
+// rewrites the blocks that are only partially referenced. Remove marks files
+// deleted in the manifest and drops them from every snapshot, and Compact
+// then erases their contents from the blocks. Rename moves files to new paths
+// in the manifest and every snapshot without rewriting any block.
+//
+// # Errors
+//
+// Checksum failures are reported as *BlockIntegrityError for whole blocks,
+// *FileIntegrityError for single files and *ExtractedFilesError when an
+// extracted tree differs from its archive. Other failures wrap one of the
+// sentinel errors, such as ErrBlockTruncated, ErrUnsupportedVersion,
+// ErrPathUnsafe, ErrFileTooLarge or ErrNoFiles. Damaged data of any kind
+// matches ErrCorrupted and unusable options match ErrInvalidOption with
+// errors.Is, which tells them apart from I/O errors. Errors wrap their cause
+// with %w throughout.
+//
+// With ContinueOnError, Pack, PackSources, PackFS, Unpack and UnpackBlock
+// skip the files that fail and return a *PartialError listing them once
+// everything else is done.
+//
+// # Block format
+//
+// All integers are little endian. A block file is laid out as
+//
+//	header    block ID (int32), number of files (int32)
+//	data      file contents, concatenated
+//	metadata  one record per file
+//	footer    56 bytes, see below
+//
+// Each metadata record holds the slash separated path (int32 length and
+// bytes), size (int64), modification time in Unix seconds (int64), offset
+// within the data section (int64), mode, uid and gid (uint32 each), the
+// SHA-256 checksum of the contents (32 bytes), the number of extended
+// attributes (int32) followed by each name and value (int32 length and
+// bytes), and, when footer flag bit 1 is set, the birth time as Unix
+// seconds (int64) and nanoseconds (int32), zero when unknown, and, when
+// footer flag bit 2 is set, the Windows hidden and system attributes
+// (uint32), and, when footer flag bit 3 is set, the number of holes of a
+// sparse file (int32) followed by the offset and length of each (int64
+// each), and, when footer flag bit 4 is set, the number of zero runs left
+// out of the data section (int32) followed by the offset and length of each
+// (int64 each). The offset of a file with zero runs points at its remaining
+// bytes, which are shorter than its size by the length of the runs. Footer
+// flag bit 5 replaces these records with a compact encoding that stores
+// numbers as varints and most fields relative to the previous record. With
+// footer flag bit 6 the header records 0 files and the metadata section is a
+// 12 byte nonce followed by the AES-256-GCM sealed file count (uint32) and
+// records, authenticated with the block ID and footer flags. Footer flag
+// bit 7 marks blocks whose metadata key is sealed with a passphrase. With
+// footer flag bit 8 every record is its length (int32) followed by a CBOR
+// map with integer keys and a schema version under key 0, readable without
+// this package.
+//
+// The footer holds the SHA-256 checksum of everything preceding it (32
+// bytes), the offset of the metadata section (int64), the feature flags
+// (uint32), with footer flag bit 7 a key header of 85 bytes, the footer
+// length (uint32), a CRC-32 (IEEE) of the preceding footer bytes (uint32)
+// and the magic "BEAM". Readers locate the footer from its last 12 bytes, so
+// fields added before the length are skipped by older readers. Flag bit 0
+// marks the metadata section as following the data section; without it the
+// metadata directly follows the header and the data comes after it, the
+// layout used by earlier versions and by stream archives.
+//
+// A stream archive is the magic "BMST" followed by one frame per block, each
+// an int64 length and the block bytes, and ends with a zero length frame.
+package packer
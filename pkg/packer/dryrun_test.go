@@ -0,0 +1,174 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// snapshotArchive returns an archive of three snapshot generations with the
+// first two forgotten. The first shares no contents with the others, so its
+// blocks are unreferenced, while the blocks of the second are partially
+// referenced by the third
+func snapshotArchive(t *testing.T) string {
+	t.Helper()
+	p := NewPacker(PackerOptions{BlockSize: 32 << 10})
+	src := filepath.Join(t.TempDir(), "src")
+	archive := filepath.Join(t.TempDir(), "archive")
+	for gen := 1; gen <= 3; gen++ {
+		files := generation(gen)
+		if gen == 1 {
+			for name, data := range files {
+				files[name] = append(data, "first generation only\n"...)
+			}
+		}
+		writeTree(t, src, files)
+		if _, err := p.Snapshot(src, archive); err != nil {
+			t.Fatalf("snapshot %d: %v", gen, err)
+		}
+	}
+	for gen := 1; gen <= 2; gen++ {
+		if err := p.ForgetSnapshot(archive, gen); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return archive
+}
+
+// assertUnchanged fails unless dir holds the same files with the same
+// contents as before
+func assertUnchanged(t *testing.T, dir string, before map[string][]byte) {
+	t.Helper()
+	after := readTree(t, dir)
+	for name, data := range before {
+		if !bytes.Equal(after[name], data) {
+			t.Errorf("%s was changed or removed", name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			t.Errorf("%s was created", name)
+		}
+	}
+}
+
+func TestGCDryRun(t *testing.T) {
+	archive := snapshotArchive(t)
+	before := readTree(t, archive)
+
+	planned, err := NewPacker(PackerOptions{DryRun: true}).GC(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned.Removed) == 0 {
+		t.Fatal("dry run removes no block, the test does not cover GC")
+	}
+	assertUnchanged(t, archive, before)
+
+	result, err := NewPacker(PackerOptions{}).GC(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(planned, result) {
+		t.Errorf("dry run reported %+v, GC did %+v", planned, result)
+	}
+}
+
+func TestCompactDryRun(t *testing.T) {
+	archive := snapshotArchive(t)
+	before := readTree(t, archive)
+
+	planned, err := NewPacker(PackerOptions{DryRun: true}).Compact(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned.Removed) == 0 || len(planned.Rewritten) == 0 {
+		t.Fatalf("dry run removes %v and rewrites %v, the test does not cover both", planned.Removed, planned.Rewritten)
+	}
+	assertUnchanged(t, archive, before)
+
+	// The space reclaimed counts the new blocks as written, headers and
+	// metadata included
+	result, err := NewPacker(PackerOptions{}).Compact(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(planned, result) {
+		t.Errorf("dry run reported %+v, Compact did %+v", planned, result)
+	}
+}
+
+func TestRemoveDryRun(t *testing.T) {
+	archive := snapshotArchive(t)
+	before := readTree(t, archive)
+	files, err := NewPacker(PackerOptions{}).List(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := files[0].Path
+
+	opts := PackerOptions{DryRun: true, CompactAfterRemove: true}
+	planned, err := NewPacker(opts).Remove(archive, []string{removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned.Deleted) != 1 || planned.Deleted[0] != removed || planned.Compact == nil {
+		t.Fatalf("dry run reported %+v", planned)
+	}
+	assertUnchanged(t, archive, before)
+	if _, err := NewPacker(opts).Remove(archive, []string{"no/such/file"}); !errors.Is(err, ErrNoFiles) {
+		t.Errorf("dry run of a pattern matching nothing returned %v, want ErrNoFiles", err)
+	}
+
+	opts.DryRun = false
+	result, err := NewPacker(opts).Remove(archive, []string{removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(planned, result) {
+		t.Errorf("dry run reported %+v, Remove did %+v", planned, result)
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	archive := snapshotArchive(t)
+	store := DirStore{Dir: t.TempDir()}
+	if _, err := NewPacker(PackerOptions{}).Sync(archive, store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPacker(PackerOptions{}).GC(archive); err != nil {
+		t.Fatal(err)
+	}
+	before := readTree(t, store.Dir)
+
+	opts := PackerOptions{DeleteExtraneous: true, DryRun: true}
+	planned, err := NewPacker(opts).Sync(archive, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned.Deleted) == 0 {
+		t.Fatal("dry run deletes nothing, the test does not cover DeleteExtraneous")
+	}
+	assertUnchanged(t, store.Dir, before)
+
+	opts.DryRun = false
+	result, err := NewPacker(opts).Sync(archive, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(planned, result) {
+		t.Errorf("dry run reported %+v, Sync did %+v", planned, result)
+	}
+
+	// A directory not created yet has everything uploaded to it
+	missing := DirStore{Dir: filepath.Join(t.TempDir(), "missing")}
+	planned, err = NewPacker(PackerOptions{DryRun: true}).Sync(archive, missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(planned.Uploaded) == 0 || planned.Unchanged != 0 {
+		t.Errorf("dry run to a missing directory reported %+v", planned)
+	}
+}
@@ -0,0 +1,74 @@
+package packer
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+)
+
+// manifestEdits holds the manifest entries of files removed, renamed or
+// tagged without repacking, by the location of their contents. The blocks
+// still record the original path of these files and none of their tags
+type manifestEdits map[extentKey]ManifestFile
+
+// loadEdits reads the files removed, renamed or tagged in the manifest of the archive
+// holding path, which is the archive directory or one of its blocks. Archives
+// without a manifest have no edits
+func loadEdits(path string) (manifestEdits, error) {
+	archiveDir := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		archiveDir = filepath.Dir(path)
+	}
+	m, err := readManifestFile(filepath.Join(archiveDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var edits manifestEdits
+	for _, file := range m.Files {
+		if !file.Deleted && file.Original == "" && len(file.Tags) == 0 {
+			continue
+		}
+		if edits == nil {
+			edits = make(manifestEdits)
+		}
+		edits[extentKey{file.BlockID, file.Offset}] = file
+	}
+	return edits, nil
+}
+
+// lookup returns the edited manifest entry of a file of a block. The checksum
+// guards against a block being replaced after the edit was made
+func (e manifestEdits) lookup(block *Block, metadata *FileMetadata) (ManifestFile, bool) {
+	file, ok := e[extentKey{block.ID, block.DataOffset + metadata.Offset}]
+	if !ok {
+		return ManifestFile{}, false
+	}
+	if sum, err := hex.DecodeString(file.Checksum); err != nil || !checksumsEqual(sum, metadata.Checksum) {
+		return ManifestFile{}, false
+	}
+	return file, true
+}
+
+// apply drops the removed files from a block index and gives the renamed
+// ones their new path and the tagged ones their tags
+func (e manifestEdits) apply(block *Block) {
+	if len(e) == 0 {
+		return
+	}
+	kept := block.Files[:0]
+	for i := range block.Files {
+		metadata := block.Files[i]
+		if file, ok := e.lookup(block, &metadata); ok {
+			if file.Deleted {
+				continue
+			}
+			metadata.Path, metadata.Tags = file.Path, file.Tags
+		}
+		kept = append(kept, metadata)
+	}
+	block.Files = kept
+}
@@ -0,0 +1,53 @@
+package packer
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// Error classes, matched with errors.Is by the errors of that class so callers
+// can tell damaged data and bad options apart from I/O errors without knowing
+// every case. The integrity errors, ErrBlockTruncated and ErrTrailingData are
+// ErrCorrupted, ErrFileTooLarge is ErrInvalidOption
+var (
+	ErrCorrupted     = errors.New("data corrupted") // Data does not match its checksum or the block format
+	ErrInvalidOption = errors.New("invalid option") // The options or arguments passed to the packer cannot be used
+)
+
+var (
+	// ErrBlockTruncated is returned for blocks that end before their footer
+	// or before the data their metadata describes
+	ErrBlockTruncated error = &classError{msg: "block truncated", class: ErrCorrupted}
+
+	// ErrTrailingData is returned for blocks with data appended after their
+	// footer
+	ErrTrailingData error = &classError{msg: "trailing data after block footer", class: ErrCorrupted}
+
+	// ErrUnsupportedVersion is returned for blocks using format features this
+	// version does not know
+	ErrUnsupportedVersion = errors.New("unsupported block format version")
+
+	// ErrPathUnsafe is returned for archived paths that would be written
+	// outside the output directory, or mapped outside the archive
+	ErrPathUnsafe = errors.New("unsafe path")
+
+	// ErrFileTooLarge is returned for sources that do not fit in a block
+	ErrFileTooLarge error = &classError{msg: "file too large for a block", class: ErrInvalidOption}
+
+	// ErrNoFiles is returned when there is nothing to pack or extract
+	ErrNoFiles = errors.New("no files")
+
+	// ErrFileExists is returned for files extracted with OverwriteNever over
+	// an existing file, it also matches fs.ErrExist
+	ErrFileExists error = &classError{msg: "file already exists", class: fs.ErrExist}
+)
+
+// classError is a sentinel error that also matches its class
+type classError struct {
+	msg   string
+	class error
+}
+
+func (e *classError) Error() string { return e.msg }
+
+func (e *classError) Is(target error) bool { return target == e.class }
@@ -0,0 +1,129 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileError is a file that could not be packed or extracted
+type FileError struct {
+	Path string // Source path when packing, archived path or block file when unpacking
+	Err  error  // Cause of the failure
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned with ContinueOnError when some files failed while
+// every other file was packed or extracted. It matches the errors of the
+// failed files with errors.Is and errors.As
+type PartialError struct {
+	Op     string       // Operation that failed partially, "pack" or "unpack"
+	Failed []*FileError // Files that failed, sorted by path
+}
+
+func (e *PartialError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s completed with %d failed files", e.Op, len(e.Failed))
+	for _, failed := range e.Failed {
+		b.WriteString("\n  ")
+		b.WriteString(failed.Error())
+	}
+	return b.String()
+}
+
+func (e *PartialError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, failed := range e.Failed {
+		errs[i] = failed
+	}
+	return errs
+}
+
+// failureLog collects the files skipped by one Pack or Unpack call. A nil log
+// skips nothing, so every failure aborts the call as without ContinueOnError
+type failureLog struct {
+	mu     sync.Mutex
+	failed []*FileError
+	seen   map[string]bool // Paths already recorded, each is reported once
+	log    *slog.Logger
+	counts *progressReporter // Counts each skipped file as an error of the operation
+}
+
+// newFailureLog returns the log for a new call, nil unless ContinueOnError is set
+func (p defaultPacker) newFailureLog() *failureLog {
+	if !p.opts.ContinueOnError {
+		return nil
+	}
+	return &failureLog{seen: make(map[string]bool), log: p.logger(), counts: p.progress}
+}
+
+// skip records the failure of a single file so the caller can carry on
+// without it, it returns err unchanged when failures are not collected. Only
+// the first failure of each path is recorded
+func (l *failureLog) skip(path string, err error) error {
+	if l == nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[path] {
+		return nil
+	}
+	l.seen[path] = true
+	l.log.Warn("Skipping file", "path", path, "error", err)
+	l.counts.failed()
+	l.failed = append(l.failed, &FileError{Path: path, Err: err})
+	return nil
+}
+
+// skipIntegrity records each checksum mismatch reported by a verifier
+func (l *failureLog) skipIntegrity(err error) error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if l == nil || !ok {
+		return err
+	}
+	for _, err := range joined.Unwrap() {
+		var integrityErr *FileIntegrityError
+		if !errors.As(err, &integrityErr) {
+			return err
+		}
+		l.skip(integrityErr.Path, err)
+	}
+	return nil
+}
+
+// result returns err if the call failed as a whole, otherwise a *PartialError
+// listing the skipped files, or nil when there are none
+func (l *failureLog) result(op string, err error) error {
+	if err != nil || l == nil || len(l.failed) == 0 {
+		return err
+	}
+	sort.Slice(l.failed, func(i, j int) bool { return l.failed[i].Path < l.failed[j].Path })
+	return &PartialError{Op: op, Failed: l.failed}
+}
+
+// sourceReader remembers the error of the reader it wraps, telling failures
+// to read a source file apart from failures to write the block
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,90 @@
+package packer
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjectedFault is returned by writes failed by Faults
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultInjector simulates I/O failures for resilience testing. When set in
+// PackerOptions every reader and writer used for file and block contents is
+// wrapped with it
+type FaultInjector interface {
+	WrapReader(r io.Reader) io.Reader
+	WrapWriter(w io.Writer) io.Writer
+}
+
+// Faults is a FaultInjector covering the common failure modes. Writes are
+// counted across all wrapped writers, so FailWriteN fails exactly one write
+// of the whole operation
+type Faults struct {
+	FailWriteN  int64         // Fail the Nth write, 0 disables
+	ShortWriteN int64         // Make the Nth write only write half its data, 0 disables
+	ReadDelay   time.Duration // Delay applied to every read
+	Err         error         // Error returned by the failed write, defaults to ErrInjectedFault
+
+	writes atomic.Int64
+}
+
+func (f *Faults) WrapReader(r io.Reader) io.Reader {
+	if f.ReadDelay == 0 {
+		return r
+	}
+	return &faultReader{r: r, faults: f}
+}
+
+func (f *Faults) WrapWriter(w io.Writer) io.Writer {
+	return &faultWriter{w: w, faults: f}
+}
+
+type faultReader struct {
+	r      io.Reader
+	faults *Faults
+}
+
+func (r *faultReader) Read(b []byte) (int, error) {
+	time.Sleep(r.faults.ReadDelay)
+	return r.r.Read(b)
+}
+
+type faultWriter struct {
+	w      io.Writer
+	faults *Faults
+}
+
+func (w *faultWriter) Write(b []byte) (int, error) {
+	n := w.faults.writes.Add(1)
+	switch n {
+	case w.faults.FailWriteN:
+		if w.faults.Err != nil {
+			return 0, w.faults.Err
+		}
+		return 0, ErrInjectedFault
+	case w.faults.ShortWriteN:
+		// A short write without an error, callers must detect it themselves
+		return w.w.Write(b[:len(b)/2])
+	}
+	return w.w.Write(b)
+}
+
+// wrapReader applies the configured fault injector and MaxBytesPerSecond to a
+// reader of file contents
+func (p defaultPacker) wrapReader(r io.Reader) io.Reader {
+	if p.opts.FaultInjector != nil {
+		r = p.opts.FaultInjector.WrapReader(r)
+	}
+	return p.throttleReader(r)
+}
+
+// wrapWriter applies the configured fault injector and MaxBytesPerSecond to a
+// writer of blocks or extracted files
+func (p defaultPacker) wrapWriter(w io.Writer) io.Writer {
+	if p.opts.FaultInjector != nil {
+		w = p.opts.FaultInjector.WrapWriter(w)
+	}
+	return p.throttleWriter(w)
+}
@@ -0,0 +1,101 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// maxFileListEntry bounds an entry of a file list, well above the longest path
+// any platform accepts
+const maxFileListEntry = 1 << 20
+
+// ReadFileList reads the paths of a file list, as tar -T and cpio take them:
+// one per line, or terminated by NUL bytes as find -print0 writes them when
+// nul is set. NUL terminated lists hold any path, line lists cannot hold paths
+// with newlines. Empty entries are skipped
+func ReadFileList(r io.Reader, nul bool) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFileListEntry)
+	if nul {
+		scanner.Split(scanNUL)
+	}
+	var paths []string
+	for scanner.Scan() {
+		path := scanner.Text()
+		if !nul {
+			// Lists written on Windows end their lines with CRLF
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading file list: %w", err)
+	}
+	return paths, nil
+}
+
+// scanNUL is a bufio.SplitFunc returning the entries terminated by NUL bytes,
+// the last one may be left unterminated
+func scanNUL(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func (p defaultPacker) PackFiles(paths []string, outputDir string) error {
+	unlock, err := p.lockArchive(outputDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	p.failures = p.newFailureLog()
+	p.checkChanges = true
+	if p.opts.SourceSnapshot != nil {
+		return fmt.Errorf("a file list has no input directory to freeze: %w", ErrInvalidOption)
+	}
+	fileInfos, err := p.planList(paths)
+	if err != nil {
+		return err
+	}
+	return p.failures.result("pack", p.packPlanned(fileInfos, outputDir, p.sourceOpener()))
+}
+
+// planList returns the files of a file list to pack, largest first. Listed
+// directories are walked, and files listed twice, or listed and found under a
+// listed directory, are packed once
+func (p defaultPacker) planList(paths []string) ([]FileInfo, error) {
+	if err := p.checkPlanOptions(); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		found, err := p.walkInput(filepath.Clean(path))
+		if err != nil {
+			return nil, fmt.Errorf("error walking %s: %w", path, err)
+		}
+		for _, file := range found {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w found in file list", ErrNoFiles)
+	}
+	return p.planPaths(files)
+}
@@ -0,0 +1,91 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Query selects archived files by path, size, modification time and tags.
+// Every set field must match, the zero Query matches every file
+type Query struct {
+	Patterns       []string          // Glob patterns of archived paths as for Unpack, a file matching any of them matches
+	MinSize        int64             // Smallest size in bytes matched
+	MaxSize        int64             // Largest size in bytes matched, 0 for no limit
+	ModifiedAfter  time.Time         // Only match files modified at or after this time, zero for no limit
+	ModifiedBefore time.Time         // Only match files modified before this time, zero for no limit
+	Tags           map[string]string // Only match files with every one of these tags, an empty value matching any value of the tag
+}
+
+// check rejects queries that cannot match anything because they are malformed
+func (q Query) check() error {
+	if err := validatePatterns(q.Patterns); err != nil {
+		return err
+	}
+	if q.MinSize < 0 || q.MaxSize < 0 || (q.MaxSize > 0 && q.MinSize > q.MaxSize) {
+		return fmt.Errorf("invalid size range %d to %d: %w", q.MinSize, q.MaxSize, ErrInvalidOption)
+	}
+	if !q.ModifiedAfter.IsZero() && !q.ModifiedBefore.IsZero() && !q.ModifiedAfter.Before(q.ModifiedBefore) {
+		return fmt.Errorf("invalid modification time range %s to %s: %w",
+			q.ModifiedAfter.Format(time.RFC3339), q.ModifiedBefore.Format(time.RFC3339), ErrInvalidOption)
+	}
+	return nil
+}
+
+// matches reports whether an archived file matches the query
+func (q Query) matches(metadata *FileMetadata) bool {
+	switch {
+	case metadata.Size < q.MinSize, q.MaxSize > 0 && metadata.Size > q.MaxSize:
+		return false
+	case !q.ModifiedAfter.IsZero() && metadata.ModTime.Before(q.ModifiedAfter):
+		return false
+	case !q.ModifiedBefore.IsZero() && !metadata.ModTime.Before(q.ModifiedBefore):
+		return false
+	case !matchTags(metadata.Tags, q.Tags):
+		return false
+	}
+	return matchAny(q.Patterns, metadata.Path)
+}
+
+// Find returns the archived files matching the query, sorted by path. The
+// query is evaluated against the manifest, so no block is read unless the
+// archive has none, as with encrypted metadata
+func (p defaultPacker) Find(archiveDir string, query Query) ([]FileMetadata, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := query.check(); err != nil {
+		return nil, err
+	}
+
+	var files []FileMetadata
+	m, err := readManifestFile(filepath.Join(archiveDir, manifestFileName))
+	switch {
+	case err == nil:
+		if files, _, err = m.locate(query.Patterns); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err), errors.Is(err, syscall.ENOTDIR):
+		// Single blocks and archives without a manifest are indexed from their blocks
+		if files, err = p.readArchiveIndex(archiveDir); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	found := files[:0]
+	for i := range files {
+		if query.matches(&files[i]) {
+			found = append(found, files[i])
+		}
+	}
+	sortByPath(found)
+	return found, nil
+}
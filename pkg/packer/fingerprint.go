@@ -0,0 +1,115 @@
+package packer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fingerprintVersion starts the input of every fingerprint, so fingerprints
+// computed over other fields later never collide with these
+const fingerprintVersion = "beam fingerprint 1\n"
+
+// Fingerprint returns the fingerprint of an archive, a hex encoded SHA-256
+// digest of what unpacking it restores: the path, size, mode, times, owner,
+// attributes and checksum of every file. It leaves out how the archive
+// stores them, such as block sizes, compression and metadata encoding, so two
+// archives with the same fingerprint hold the same files whatever options
+// they were packed with. The fingerprint recorded in the manifest is returned
+// when there is one, otherwise it is computed from the block indexes
+func (p defaultPacker) Fingerprint(archiveDir string) (string, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	m, err := readManifestFile(filepath.Join(archiveDir, manifestFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("error reading manifest: %w", err)
+	}
+	if m != nil && m.Fingerprint != "" {
+		return m.Fingerprint, nil
+	}
+	files, err := p.readArchiveIndex(archiveDir)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint(files), nil
+}
+
+// fingerprint returns the fingerprint of the files of an archive, in any order
+func fingerprint(files []FileMetadata) string {
+	sorted := make([]*FileMetadata, len(files))
+	for i := range files {
+		sorted[i] = &files[i]
+	}
+	// Files archived twice under one path are told apart by their contents,
+	// not by where they are stored
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Path != sorted[j].Path {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return string(sorted[i].Checksum) < string(sorted[j].Checksum)
+	})
+
+	h := newChecksum()
+	h.Write([]byte(fingerprintVersion))
+	var b []byte
+	for _, metadata := range sorted {
+		// Variable length fields are length prefixed so no two files encode
+		// the same
+		b = binary.AppendUvarint(b[:0], uint64(len(metadata.Path)))
+		b = append(b, metadata.Path...)
+		b = binary.AppendVarint(b, metadata.Size)
+		b = binary.AppendUvarint(b, uint64(metadata.Mode))
+		b = binary.AppendVarint(b, metadata.ModTime.Unix())
+		var birthTime int64
+		if !metadata.BirthTime.IsZero() {
+			birthTime = metadata.BirthTime.Unix()
+		}
+		b = binary.AppendVarint(b, birthTime)
+		b = binary.AppendUvarint(b, uint64(metadata.Uid))
+		b = binary.AppendUvarint(b, uint64(metadata.Gid))
+		b = binary.AppendUvarint(b, uint64(metadata.Attributes))
+		b = binary.AppendUvarint(b, metadata.Device)
+		names := make([]string, 0, len(metadata.Xattrs))
+		for name := range metadata.Xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b = binary.AppendUvarint(b, uint64(len(names)))
+		for _, name := range names {
+			b = binary.AppendUvarint(b, uint64(len(name)))
+			b = append(b, name...)
+			b = binary.AppendUvarint(b, uint64(len(metadata.Xattrs[name])))
+			b = append(b, metadata.Xattrs[name]...)
+		}
+		b = binary.AppendUvarint(b, uint64(len(metadata.Checksum)))
+		b = append(b, metadata.Checksum...)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setFingerprint records the fingerprint of the files a manifest lists, less
+// those removed from the archive
+func (m *Manifest) setFingerprint() error {
+	files := make([]FileMetadata, 0, len(m.Files))
+	for i := range m.Files {
+		if m.Files[i].Deleted {
+			continue
+		}
+		metadata, err := m.Files[i].metadata()
+		if err != nil {
+			return err
+		}
+		files = append(files, metadata)
+	}
+	m.Fingerprint = fingerprint(files)
+	return nil
+}
@@ -0,0 +1,184 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// footerMagic marks the last bytes of every block file
+var footerMagic = [4]byte{'B', 'E', 'A', 'M'}
+
+// footerTrailerSize is the size of the fixed fields at the very end of the
+// footer: footer length, footer CRC and magic
+const footerTrailerSize = 4 + 4 + 4
+
+// minFooterSize is the size of the smallest footer, written by versions that
+// did not record the payload length
+const minFooterSize = sha256.Size + 8 + 4 + footerTrailerSize
+
+// blockFooterSize is the size of the footer written by this version
+const blockFooterSize = minFooterSize + 8
+
+// footerSearchSize is how far from the end of a block ValidateBlock looks
+// for a footer followed by trailing data
+const footerSearchSize = 64 << 10
+
+// Footer flags
+const (
+	footerFlagTrailingMetadata uint32 = 1 << 0  // File metadata follows the data section instead of the header
+	footerFlagBirthTime        uint32 = 1 << 1  // File metadata records end with the file birth time
+	footerFlagAttributes       uint32 = 1 << 2  // File metadata records end with the Windows file attributes
+	footerFlagHoles            uint32 = 1 << 3  // File metadata records end with the holes of sparse files
+	footerFlagZeroRuns         uint32 = 1 << 4  // File metadata records end with the zero runs left out of the data section
+	footerFlagCompactMetadata  uint32 = 1 << 5  // File metadata records use the compact encoding, only with trailing metadata
+	footerFlagEncrypted        uint32 = 1 << 6  // The metadata section and file count are encrypted, only with trailing metadata
+	footerFlagPassphrase       uint32 = 1 << 7  // The footer holds the key header unlocking the metadata key with a passphrase, only with encryption
+	footerFlagCBORMetadata     uint32 = 1 << 8  // File metadata records are length prefixed CBOR maps, only with trailing metadata
+	footerFlagCompression      uint32 = 1 << 9  // File metadata records end with the compression method and compressed size
+	footerFlagDevices          uint32 = 1 << 10 // File metadata records end with the device number of device nodes
+
+	// knownFooterFlags are the flags this version can read. Flags change how
+	// the rest of the block is laid out, so blocks with any other flag set
+	// cannot be read
+	knownFooterFlags = footerFlagTrailingMetadata | footerFlagBirthTime | footerFlagAttributes | footerFlagHoles |
+		footerFlagZeroRuns | footerFlagCompactMetadata | footerFlagEncrypted | footerFlagPassphrase | footerFlagCBORMetadata |
+		footerFlagCompression | footerFlagDevices
+)
+
+// BlockFooter describes a block and is written at its end. New fields are
+// added before the trailer so readers can always locate the footer from the
+// end of the file and skip fields they do not know
+type BlockFooter struct {
+	Checksum       []byte // SHA-256 checksum of the block contents preceding the footer
+	MetadataOffset int64  // Offset of the file metadata section within the block
+	Flags          uint32 // Feature flags of the block
+	KeyHeader      []byte // Passphrase salt, Argon2id parameters and sealed metadata key, with footerFlagPassphrase
+	PayloadLength  int64  // Size of the header, data and metadata sections preceding the footer, 0 for blocks that did not record it
+	Length         int64  // Size of the footer in bytes
+}
+
+// writeBlockFooter writes the footer, protecting it with a CRC of the
+// preceding footer bytes
+func writeBlockFooter(w io.Writer, footer *BlockFooter) error {
+	var buf bytes.Buffer
+
+	// Write block checksum
+	buf.Write(footer.Checksum)
+
+	// Write metadata offset and flags
+	binary.Write(&buf, binary.LittleEndian, footer.MetadataOffset)
+	binary.Write(&buf, binary.LittleEndian, footer.Flags)
+	buf.Write(footer.KeyHeader)
+
+	// Write payload length, left out when rewriting the footer of a block that
+	// did not record it so the footer keeps its size
+	length := minFooterSize + len(footer.KeyHeader)
+	if footer.PayloadLength > 0 {
+		binary.Write(&buf, binary.LittleEndian, footer.PayloadLength)
+		length += 8
+	}
+
+	// Write footer length followed by the CRC covering everything before it
+	binary.Write(&buf, binary.LittleEndian, uint32(length))
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(footerMagic[:])
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readBlockFooter locates and decodes the footer at the end of a block of the given size
+func readBlockFooter(r io.ReaderAt, size int64) (*BlockFooter, error) {
+	if size < footerTrailerSize {
+		return nil, fmt.Errorf("block too small to hold a footer: %w", ErrBlockTruncated)
+	}
+
+	// Read trailer
+	trailer := make([]byte, footerTrailerSize)
+	if _, err := r.ReadAt(trailer, size-footerTrailerSize); err != nil {
+		return nil, fmt.Errorf("error reading footer trailer: %w", err)
+	}
+	if !bytes.Equal(trailer[8:], footerMagic[:]) {
+		return nil, fmt.Errorf("block footer not found: %w", ErrBlockTruncated)
+	}
+
+	length := int64(binary.LittleEndian.Uint32(trailer[0:4]))
+	if length < minFooterSize || length > size {
+		return nil, fmt.Errorf("invalid block footer length %d: %w", length, ErrCorrupted)
+	}
+
+	// Read the whole footer and check its CRC
+	buf := make([]byte, length)
+	if _, err := r.ReadAt(buf, size-length); err != nil {
+		return nil, fmt.Errorf("error reading footer: %w", err)
+	}
+	crcOffset := length - 8
+	if crc32.ChecksumIEEE(buf[:crcOffset]) != binary.LittleEndian.Uint32(buf[crcOffset:]) {
+		return nil, fmt.Errorf("block footer CRC mismatch: %w", ErrCorrupted)
+	}
+
+	// Fields are read in the order they were added
+	footer := &BlockFooter{
+		Checksum:       buf[:sha256.Size],
+		MetadataOffset: int64(binary.LittleEndian.Uint64(buf[sha256.Size:])),
+		Flags:          binary.LittleEndian.Uint32(buf[sha256.Size+8:]),
+		Length:         length,
+	}
+	if unknown := footer.Flags &^ knownFooterFlags; unknown != 0 {
+		return nil, fmt.Errorf("block uses unknown format flags %#x: %w", unknown, ErrUnsupportedVersion)
+	}
+	offset := int64(sha256.Size + 8 + 4)
+	if footer.Flags&footerFlagPassphrase != 0 {
+		if footer.Flags&footerFlagEncrypted == 0 || length < minFooterSize+keyHeaderSize {
+			return nil, fmt.Errorf("invalid key header in block footer: %w", ErrCorrupted)
+		}
+		footer.KeyHeader = buf[offset : offset+keyHeaderSize]
+		offset += keyHeaderSize
+	}
+	if offset+8 <= length-footerTrailerSize {
+		footer.PayloadLength = int64(binary.LittleEndian.Uint64(buf[offset:]))
+	}
+	return footer, nil
+}
+
+// checkLayout checks the footer of a block of the given size against the
+// sections preceding it, telling a block missing bytes or holding bytes it
+// was not written with apart from one whose contents changed
+func (footer *BlockFooter) checkLayout(size int64) error {
+	payload := size - footer.Length
+	if footer.PayloadLength > payload {
+		return fmt.Errorf("block is missing %d bytes before its footer: %w", footer.PayloadLength-payload, ErrBlockTruncated)
+	}
+	if footer.PayloadLength > 0 && footer.PayloadLength < payload {
+		return fmt.Errorf("block holds %d bytes more than it was written with: %w", payload-footer.PayloadLength, ErrCorrupted)
+	}
+	if payload < blockHeaderSize {
+		return fmt.Errorf("block too small to hold a header: %w", ErrBlockTruncated)
+	}
+	if footer.MetadataOffset < blockHeaderSize || footer.MetadataOffset > payload {
+		return fmt.Errorf("invalid metadata offset %d: %w", footer.MetadataOffset, ErrCorrupted)
+	}
+	return nil
+}
+
+// findBlockFooter looks for a valid footer ending before the last bytes of a
+// block of the given size whose own footer cannot be found, returning where it
+// ends. A block that has one had data appended after it
+func findBlockFooter(r io.ReaderAt, size int64) (int64, bool) {
+	start := max(size-footerSearchSize, 0)
+	buf := make([]byte, size-start)
+	if _, err := r.ReadAt(buf, start); err != nil {
+		return 0, false
+	}
+	for i := bytes.LastIndex(buf, footerMagic[:]); i >= 0; i = bytes.LastIndex(buf[:i], footerMagic[:]) {
+		end := start + int64(i) + int64(len(footerMagic))
+		if footer, err := readBlockFooter(r, end); err == nil && footer.checkLayout(end) == nil {
+			return end, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,309 @@
+package packer
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceSnapshotter freezes the input directory of a pack in a filesystem
+// snapshot before it is walked, so a live system is archived as it was at a
+// single point in time instead of while it changes. Files are read from the
+// snapshot but archived under the paths they have in the input directory
+type SourceSnapshotter interface {
+	// Freeze snapshots the filesystem holding dir and returns the path of dir
+	// within the snapshot, which stays readable until release is called
+	Freeze(dir string) (path string, release func() error, err error)
+}
+
+// SourceSnapshotterFunc adapts a function to the SourceSnapshotter interface
+type SourceSnapshotterFunc func(dir string) (path string, release func() error, err error)
+
+func (f SourceSnapshotterFunc) Freeze(dir string) (string, func() error, error) {
+	return f(dir)
+}
+
+// frozenSource is an input directory frozen by the SourceSnapshotter for the
+// duration of a call. A nil frozenSource reads the input directory itself
+type frozenSource struct {
+	dir      string       // Input directory as given
+	snapshot string       // The input directory within the snapshot
+	release  func() error // Removes the snapshot
+}
+
+// freezeSource freezes the input directory with the configured
+// SourceSnapshotter, returning nil when there is none
+func (p defaultPacker) freezeSource(inputDir string) (*frozenSource, error) {
+	if p.opts.SourceSnapshot == nil {
+		return nil, nil
+	}
+	path, release, err := p.opts.SourceSnapshot.Freeze(inputDir)
+	if err != nil {
+		return nil, fmt.Errorf("error freezing input directory: %w", err)
+	}
+	frozen := &frozenSource{dir: inputDir, snapshot: path, release: release}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		frozen.close(p.logger())
+		if err == nil {
+			err = fmt.Errorf("%s is not a directory", path)
+		}
+		return nil, fmt.Errorf("error reading frozen input directory: %w", err)
+	}
+	p.logger().Info("Froze input directory", "dir", inputDir, "snapshot", path)
+	return frozen, nil
+}
+
+// root returns the directory walked for the input directory
+func (f *frozenSource) root(inputDir string) string {
+	if f == nil {
+		return inputDir
+	}
+	return f.snapshot
+}
+
+// livePath returns the path a file read from the snapshot has in the input
+// directory, which is what gets archived
+func (f *frozenSource) livePath(path string) string {
+	if f == nil {
+		return path
+	}
+	rel, err := filepath.Rel(f.snapshot, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(f.dir, rel)
+}
+
+// close releases the snapshot. A snapshot that cannot be removed does not fail
+// the call, whose archive is complete, but it is logged as it keeps using space
+func (f *frozenSource) close(logger *slog.Logger) {
+	if f == nil || f.release == nil {
+		return
+	}
+	if err := f.release(); err != nil {
+		logger.Warn("Error releasing input directory snapshot", "snapshot", f.snapshot, "error", err)
+	}
+}
+
+// snapshotName returns a name for a new snapshot that is valid for every
+// supported snapshot tool
+func snapshotName() string {
+	return "beam-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// runSnapshotCommand runs a snapshot tool and returns what it printed to
+// stdout, failing with what it printed to stderr
+func runSnapshotCommand(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+		return "", fmt.Errorf("error running %s %s: %w: %s", name, strings.Join(args, " "), err, msg)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error running %s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// relativeTo returns the path of dir below root, failing when dir is not in root
+func relativeTo(root string, dir string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not below %s: %w", dir, root, ErrInvalidOption)
+	}
+	return rel, nil
+}
+
+// BtrfsSnapshotter freezes input directories on a btrfs subvolume with a read
+// only snapshot of the subvolume, deleted once the pack is done
+type BtrfsSnapshotter struct {
+	Subvolume   string // Subvolume holding the input directory
+	SnapshotDir string // Directory on the same filesystem the snapshot is created in, next to the subvolume when empty
+}
+
+func (s BtrfsSnapshotter) Freeze(dir string) (string, func() error, error) {
+	rel, err := relativeTo(s.Subvolume, dir)
+	if err != nil {
+		return "", nil, err
+	}
+	snapshotDir := s.SnapshotDir
+	if snapshotDir == "" {
+		snapshotDir = filepath.Dir(filepath.Clean(s.Subvolume))
+	}
+	snapshot := filepath.Join(snapshotDir, "."+snapshotName())
+	if _, err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", s.Subvolume, snapshot); err != nil {
+		return "", nil, err
+	}
+	release := func() error {
+		_, err := runSnapshotCommand("btrfs", "subvolume", "delete", snapshot)
+		return err
+	}
+	return filepath.Join(snapshot, rel), release, nil
+}
+
+// ZFSSnapshotter freezes input directories on a ZFS dataset with a snapshot of
+// the dataset, read through the .zfs/snapshot directory of its mountpoint and
+// destroyed once the pack is done
+type ZFSSnapshotter struct {
+	Dataset    string // Dataset holding the input directory, e.g. "tank/home"
+	Mountpoint string // Where the dataset is mounted, asked from zfs when empty
+}
+
+func (s ZFSSnapshotter) Freeze(dir string) (string, func() error, error) {
+	mountpoint := s.Mountpoint
+	if mountpoint == "" {
+		var err error
+		if mountpoint, err = runSnapshotCommand("zfs", "get", "-H", "-o", "value", "mountpoint", s.Dataset); err != nil {
+			return "", nil, err
+		}
+	}
+	rel, err := relativeTo(mountpoint, dir)
+	if err != nil {
+		return "", nil, err
+	}
+	name := snapshotName()
+	snapshot := s.Dataset + "@" + name
+	if _, err := runSnapshotCommand("zfs", "snapshot", snapshot); err != nil {
+		return "", nil, err
+	}
+	release := func() error {
+		_, err := runSnapshotCommand("zfs", "destroy", snapshot)
+		return err
+	}
+	return filepath.Join(mountpoint, ".zfs", "snapshot", name, rel), release, nil
+}
+
+// LVMSnapshotter freezes input directories on an LVM logical volume with a
+// copy on write snapshot volume, mounted read only while the pack reads it and
+// removed once the pack is done. XFS volumes need "nouuid" in MountOptions
+type LVMSnapshotter struct {
+	Volume       string // Logical volume holding the input directory, as "vg/lv"
+	Mountpoint   string // Where the logical volume is mounted, asked from findmnt when empty
+	Size         string // Space reserved for changes made while the snapshot exists, 10% of the volume when empty
+	MountDir     string // Directory the snapshot is mounted on, a new temporary directory when empty
+	MountOptions string // Extra mount options, joined to "ro"
+}
+
+func (s LVMSnapshotter) Freeze(dir string) (path string, release func() error, err error) {
+	group, _, ok := strings.Cut(s.Volume, "/")
+	if !ok {
+		return "", nil, fmt.Errorf("logical volume %q is not given as vg/lv: %w", s.Volume, ErrInvalidOption)
+	}
+	mountpoint := s.Mountpoint
+	if mountpoint == "" {
+		out, err := runSnapshotCommand("findmnt", "--noheadings", "--first-only", "--output", "TARGET", "--source", "/dev/"+s.Volume)
+		if err != nil {
+			return "", nil, err
+		}
+		mountpoint = out
+	}
+	rel, err := relativeTo(mountpoint, dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := snapshotName()
+	size := []string{"--extents", "10%ORIGIN"}
+	if s.Size != "" {
+		size = []string{"--size", s.Size}
+	}
+	args := append([]string{"--snapshot", "--name", name}, size...)
+	if _, err := runSnapshotCommand("lvcreate", append(args, s.Volume)...); err != nil {
+		return "", nil, err
+	}
+	removeVolume := func() error {
+		_, err := runSnapshotCommand("lvremove", "--force", group+"/"+name)
+		return err
+	}
+
+	mountDir := s.MountDir
+	if mountDir == "" {
+		if mountDir, err = os.MkdirTemp("", name+"-"); err != nil {
+			removeVolume()
+			return "", nil, fmt.Errorf("error creating snapshot mount directory: %w", err)
+		}
+	}
+	options := "ro"
+	if s.MountOptions != "" {
+		options += "," + s.MountOptions
+	}
+	if _, err := runSnapshotCommand("mount", "-o", options, "/dev/"+group+"/"+name, mountDir); err != nil {
+		removeVolume()
+		if s.MountDir == "" {
+			os.Remove(mountDir)
+		}
+		return "", nil, err
+	}
+	release = func() error {
+		if _, err := runSnapshotCommand("umount", mountDir); err != nil {
+			return err
+		}
+		if s.MountDir == "" {
+			os.Remove(mountDir)
+		}
+		return removeVolume()
+	}
+	return filepath.Join(mountDir, rel), release, nil
+}
+
+// VSSSnapshotter freezes input directories on Windows with a Volume Shadow
+// Copy of their volume, created and deleted through PowerShell, which needs an
+// elevated process
+type VSSSnapshotter struct {
+	Volume string // Volume holding the input directory, e.g. `C:\`, taken from the input directory when empty
+}
+
+func (s VSSSnapshotter) Freeze(dir string) (string, func() error, error) {
+	volume := s.Volume
+	if volume == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", nil, err
+		}
+		volume = filepath.VolumeName(abs) + `\`
+	}
+	rel, err := relativeTo(volume, dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The shadow copy is printed as its ID and device path on two lines
+	script := fmt.Sprintf(`$r = (Get-WmiObject -List Win32_ShadowCopy).Create('%s', 'ClientAccessible'); `+
+		`if ($r.ReturnValue -ne 0) { throw "shadow copy failed with $($r.ReturnValue)" }; `+
+		`$s = Get-WmiObject Win32_ShadowCopy -Filter "ID='$($r.ShadowID)'"; $s.ID; $s.DeviceObject`,
+		strings.ReplaceAll(volume, "'", "''"))
+	out, err := runSnapshotCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	if err != nil {
+		return "", nil, err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return "", nil, fmt.Errorf("unexpected shadow copy output %q", out)
+	}
+	id, device := lines[0], lines[1]
+	release := func() error {
+		_, err := runSnapshotCommand("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			fmt.Sprintf(`(Get-WmiObject Win32_ShadowCopy -Filter "ID='%s'").Delete()`, id))
+		return err
+	}
+	if rel == "." {
+		return device + `\`, release, nil
+	}
+	return device + `\` + rel, release, nil
+}
@@ -0,0 +1,412 @@
+package packer
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCSStore is a BlockStore keeping blocks as objects in a Google Cloud
+// Storage bucket, through its XML API with OAuth 2.0 access tokens. Blocks up
+// to PartSize are uploaded in one request carrying their MD5 and CRC32C, and
+// larger ones as a multipart upload whose parts each carry their MD5, which
+// the service checks before storing them. The CRC32C the service reports for
+// a completed multipart upload is compared with that of the block, and Get
+// checks the block against the checksum reported with it
+type GCSStore struct {
+	Bucket   string                 // Bucket holding the blocks
+	Prefix   string                 // Prepended to every block name to form its object name, e.g. "backups/host1/"
+	Token    func() (string, error) // Returns the access token requests are authorized with, such as one of NewGCSTokenSource
+	Endpoint string                 // Base URL of the service, https://storage.googleapis.com when empty
+	PartSize int64                  // Largest part a block is uploaded in, at least 10MB, 16MB when 0
+	Client   *http.Client           // Client sending the requests, http.DefaultClient when nil
+}
+
+// gcsMinPartSize is the smallest PartSize of a GCSStore, which keeps every
+// part but the last at the 5MB multipart uploads require
+const gcsMinPartSize = 10 << 20
+
+// castagnoli is the CRC32C table of the checksums Cloud Storage keeps
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (s GCSStore) Put(name string, r io.Reader, size int64) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	partSize := s.PartSize
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if partSize < gcsMinPartSize {
+		return fmt.Errorf("part size %d is below %d bytes: %w", partSize, gcsMinPartSize, ErrInvalidOption)
+	}
+	key := s.Prefix + name
+	if size <= partSize {
+		_, err := readParts(r, size, partSize, func(_ int, part uploadPart) error {
+			resp, err := s.do(http.MethodPut, key, "", part.data, map[string]string{
+				"Content-MD5": part.md5,
+				"x-goog-hash": "crc32c=" + crc32cString(crc32.Checksum(part.data, castagnoli)) + ",md5=" + part.md5,
+			})
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		})
+		return err
+	}
+
+	resp, err := s.do(http.MethodPost, key, "uploads", nil, nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error decoding upload of block %s: %w", name, err)
+	}
+	if upload.UploadID == "" {
+		return fmt.Errorf("no upload ID for block %s: %w", name, ErrCorrupted)
+	}
+	uploadQuery := "uploadId=" + url.QueryEscape(upload.UploadID)
+	if err := s.putParts(key, uploadQuery, r, size, partSize); err != nil {
+		if resp, abortErr := s.do(http.MethodDelete, key, uploadQuery, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// gcsCompleteUpload is the body completing a multipart upload
+type gcsCompleteUpload struct {
+	XMLName xml.Name  `xml:"CompleteMultipartUpload"`
+	Parts   []gcsPart `xml:"Part"`
+}
+
+// gcsPart is an uploaded part of a multipart upload
+type gcsPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putParts uploads the parts of a multipart upload and completes it, then
+// checks the CRC32C the service reports for the object. An object that does
+// not match is deleted
+func (s GCSStore) putParts(key string, uploadQuery string, r io.Reader, size int64, partSize int64) error {
+	var complete gcsCompleteUpload
+	var crc uint32
+	_, err := readParts(r, size, partSize, func(i int, part uploadPart) error {
+		resp, err := s.do(http.MethodPut, key, "partNumber="+strconv.Itoa(i+1)+"&"+uploadQuery, part.data, map[string]string{
+			"Content-MD5": part.md5,
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		crc = crc32.Update(crc, castagnoli, part.data)
+		complete.Parts = append(complete.Parts, gcsPart{PartNumber: i + 1, ETag: resp.Header.Get("ETag")})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, key, uploadQuery, body, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	resp, err = s.do(http.MethodHead, key, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if got := gcsHash(resp.Header, "crc32c"); got != "" && got != crc32cString(crc) {
+		if resp, err := s.do(http.MethodDelete, key, "", nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		return fmt.Errorf("uploaded object %s has CRC32C %q, expected %s: %w", key, got, crc32cString(crc), ErrCorrupted)
+	}
+	return nil
+}
+
+func (s GCSStore) Get(name string) (io.ReadCloser, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, s.Prefix+name, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects of multipart uploads only have a CRC32C
+	if sum := gcsHash(resp.Header, "md5"); sum != "" {
+		return newVerifiedReader(resp.Body, name, "MD5", md5.New(), sum), nil
+	}
+	return newVerifiedReader(resp.Body, name, "CRC32C", crc32.New(castagnoli), gcsHash(resp.Header, "crc32c")), nil
+}
+
+func (s GCSStore) Delete(name string) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.Prefix+name, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// gcsObjectList is the response of a List Objects request
+type gcsObjectList struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+}
+
+func (s GCSStore) List() ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		query := "prefix=" + uriEncode(s.Prefix, false)
+		if marker != "" {
+			query = "marker=" + uriEncode(marker, false) + "&" + query
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result gcsObjectList
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding object list: %w", err)
+		}
+
+		// Only objects directly below the prefix are blocks of this archive
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.Prefix)
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated || result.NextMarker == "" {
+			break
+		}
+		marker = result.NextMarker
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// gcsHash returns the base64 encoded checksum of the kind, crc32c or md5,
+// from the x-goog-hash headers of a response
+func gcsHash(header http.Header, kind string) string {
+	for _, value := range header.Values("x-goog-hash") {
+		for _, field := range strings.Split(value, ",") {
+			if sum, ok := strings.CutPrefix(strings.TrimSpace(field), kind+"="); ok {
+				return sum
+			}
+		}
+	}
+	return ""
+}
+
+// crc32cString base64 encodes a CRC32C in big endian order, as Cloud Storage
+// reports it
+func crc32cString(crc uint32) string {
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc))
+}
+
+// gcsError is the error document returned by a failed request
+type gcsError struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends an authorized request for the object, or for the bucket itself
+// when key is empty, and returns the response of a successful request
+func (s GCSStore) do(method string, key string, query string, body []byte, headers map[string]string) (*http.Response, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	u := strings.TrimSuffix(endpoint, "/") + "/" + uriEncode(s.Bucket, false)
+	if key != "" {
+		u += "/" + uriEncode(key, true)
+	}
+	if query != "" {
+		u += "?" + query
+	}
+
+	req, err := http.NewRequest(method, u, bodyOf(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	if s.Token != nil {
+		token, err := s.Token()
+		if err != nil {
+			return nil, fmt.Errorf("error getting access token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var gcsErr gcsError
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&gcsErr)
+	err = fmt.Errorf("%s %s: %s %s %s", method, u, resp.Status, gcsErr.Code, gcsErr.Message)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	case gcsErr.Code == "BadDigest" || gcsErr.Code == "InvalidDigest":
+		err = fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	return nil, err
+}
+
+// gcsScope is the OAuth 2.0 scope of the access tokens of NewGCSTokenSource
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// serviceAccountKey is the part of a service account key file used to get
+// access tokens
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// NewGCSTokenSource returns a GCSStore Token function getting access tokens
+// for the service account of a JSON key file, as downloaded from the Cloud
+// console. A token is reused until a minute before it expires
+func NewGCSTokenSource(keyFile []byte, client *http.Client) (func() (string, error), error) {
+	var key serviceAccountKey
+	if err := json.Unmarshal(keyFile, &key); err != nil {
+		return nil, fmt.Errorf("error decoding service account key: %w", err)
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" {
+		return nil, fmt.Errorf("not a service account key: %w", ErrInvalidOption)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no private key in service account key: %w", ErrInvalidOption)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing service account private key: %w", err)
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service account private key is not an RSA key: %w", ErrInvalidOption)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var mu sync.Mutex
+	var token string
+	var expires time.Time
+	return func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Now().Before(expires) {
+			return token, nil
+		}
+		var err error
+		var lifetime time.Duration
+		if token, lifetime, err = fetchGCSToken(client, key, private, time.Now()); err != nil {
+			return "", err
+		}
+		expires = time.Now().Add(lifetime - time.Minute)
+		return token, nil
+	}, nil
+}
+
+// fetchGCSToken exchanges a JWT signed with the service account key for an
+// access token, returning it with its lifetime
+func fetchGCSToken(client *http.Client, key serviceAccountKey, private *rsa.PrivateKey, now time.Time) (string, time.Duration, error) {
+	encode := func(v any) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + encode(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": gcsScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", 0, fmt.Errorf("error signing token request: %w", err)
+	}
+
+	resp, err := client.PostForm(key.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("error requesting access token: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return "", 0, fmt.Errorf("error decoding access token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", 0, fmt.Errorf("access token request failed: %s %s", resp.Status, result.Error)
+	}
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
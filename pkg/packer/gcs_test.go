@@ -0,0 +1,399 @@
+package packer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gcsTestServer is a Cloud Storage bucket served through the XML API,
+// checking the access token and the checksums of every request
+type gcsTestServer struct {
+	t     *testing.T
+	token string
+
+	mu      sync.Mutex
+	objects map[string]gcsTestObject
+	uploads map[string]map[int][]byte // Parts of multipart uploads by upload ID and part number
+	nextID  int
+	damage  bool   // Flips a byte of the next body received
+	corrupt string // Object served with a flipped byte
+	badCRC  bool   // Reports a wrong CRC32C for completed multipart uploads
+}
+
+type gcsTestObject struct {
+	data []byte
+	md5  string // Empty for objects of multipart uploads
+}
+
+// newGCSTestServer returns a server for the bucket and a store on it
+func newGCSTestServer(t *testing.T) (*gcsTestServer, GCSStore) {
+	s := &gcsTestServer{
+		t:       t,
+		token:   "test-access-token",
+		objects: make(map[string]gcsTestObject),
+		uploads: make(map[string]map[int][]byte),
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, GCSStore{
+		Bucket:   "blocks",
+		Token:    func() (string, error) { return s.token, nil },
+		Endpoint: server.URL,
+		Client:   server.Client(),
+	}
+}
+
+func (s *gcsTestServer) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	w.Write([]byte("<?xml version='1.0' encoding='UTF-8'?><Error><Code>" + code + "</Code><Message>test server</Message></Error>"))
+}
+
+func (s *gcsTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		s.fail(w, http.StatusUnauthorized, "AuthenticationRequired")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	if s.damage && len(body) > 0 {
+		s.damage = false
+		body[len(body)/2] ^= 0xff
+	}
+	if sum := r.Header.Get("Content-MD5"); sum != "" && sum != md5String(body) {
+		s.fail(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+	if sum := gcsHash(r.Header, "crc32c"); sum != "" && sum != crc32cString(crc32.Checksum(body, castagnoli)) {
+		s.fail(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "blocks" {
+		s.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	upload := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, query.Get("prefix"), query.Get("marker"))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>blocks</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+	case r.Method == http.MethodPut && upload != "":
+		part, err := strconv.Atoi(query.Get("partNumber"))
+		if s.uploads[upload] == nil || err != nil || part < 1 {
+			s.fail(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		s.uploads[upload][part] = body
+		w.Header().Set("ETag", strconv.Quote(md5String(body)))
+	case r.Method == http.MethodPost && upload != "":
+		var complete gcsCompleteUpload
+		if err := xml.Unmarshal(body, &complete); err != nil || s.uploads[upload] == nil {
+			s.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			stored, ok := s.uploads[upload][part.PartNumber]
+			if !ok || part.ETag != strconv.Quote(md5String(stored)) {
+				s.fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+				s.fail(w, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+			data = append(data, stored...)
+		}
+		delete(s.uploads, upload)
+		s.objects[key] = gcsTestObject{data: data}
+	case r.Method == http.MethodDelete && upload != "":
+		delete(s.uploads, upload)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.objects[key] = gcsTestObject{data: body, md5: md5String(body)}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		crc := crc32.Checksum(object.data, castagnoli)
+		if s.badCRC && object.md5 == "" {
+			crc++
+		}
+		w.Header().Add("x-goog-hash", "crc32c="+crc32cString(crc))
+		if object.md5 != "" {
+			w.Header().Add("x-goog-hash", "md5="+object.md5)
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		data := bytes.Clone(object.data)
+		if key == s.corrupt {
+			data[0] ^= 0xff
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		if _, ok := s.objects[key]; !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.fail(w, http.StatusBadRequest, "InvalidArgument")
+	}
+}
+
+// list answers List Objects two objects at a time, so the marker is followed
+func (s *gcsTestServer) list(w http.ResponseWriter, prefix string, marker string) {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("<ListBucketResult><Name>blocks</Name>")
+	for i, key := range keys {
+		if i == 2 {
+			b.WriteString("<IsTruncated>true</IsTruncated><NextMarker>" + keys[i-1] + "</NextMarker>")
+			break
+		}
+		b.WriteString("<Contents><Key>" + key + "</Key></Contents>")
+	}
+	b.WriteString("</ListBucketResult>")
+	w.Write([]byte(b.String()))
+}
+
+func TestGCSStore(t *testing.T) {
+	server, store := newGCSTestServer(t)
+	store.Prefix = "backups/host1/"
+	store.PartSize = gcsMinPartSize
+
+	blocks := map[string][]byte{
+		"block-1.beam": testVectorData("block-1", 2*gcsMinPartSize+100), // Uploaded in 3 parts
+		"block-2.beam": testVectorData("block-2", 1000),
+		"empty.beam":   nil,
+	}
+	for name, data := range blocks {
+		if err := store.Put(name, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+	}
+	if len(server.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(server.uploads))
+	}
+	server.objects["backups/host1/nested/other.beam"] = gcsTestObject{}
+	server.objects["backups/host2/block-1.beam"] = gcsTestObject{}
+
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "block-1.beam,block-2.beam,empty.beam" {
+		t.Errorf("listed %q", names)
+	}
+	for name, data := range blocks {
+		if got := getBlock(t, store, name); !bytes.Equal(got, data) {
+			t.Errorf("got %d bytes of %s, want %d", len(got), name, len(data))
+		}
+	}
+
+	if err := store.Delete("block-2.beam"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("block-2.beam"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("get of a deleted block returned %v, want fs.ErrNotExist", err)
+	}
+
+	store.Token = func() (string, error) { return "expired-token", nil }
+	if _, err := store.List(); err == nil {
+		t.Error("list with the wrong token succeeded")
+	}
+}
+
+func TestGCSStoreChecksums(t *testing.T) {
+	server, store := newGCSTestServer(t)
+	store.PartSize = gcsMinPartSize
+	small := testVectorData("small", 2500)
+	large := testVectorData("large", gcsMinPartSize+100)
+
+	// A block damaged on its way is refused by the service
+	server.damage = true
+	if err := store.Put("block-1.beam", bytes.NewReader(small), int64(len(small))); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("put of a damaged block returned %v, want ErrCorrupted", err)
+	}
+	server.damage = true
+	if err := store.Put("block-2.beam", bytes.NewReader(large), int64(len(large))); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("put of a damaged part returned %v, want ErrCorrupted", err)
+	}
+	if len(server.uploads) != 0 {
+		t.Error("the failed multipart upload was not aborted")
+	}
+
+	// A completed upload whose CRC32C differs is deleted
+	server.badCRC = true
+	if err := store.Put("block-2.beam", bytes.NewReader(large), int64(len(large))); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("put of a block stored with another CRC32C returned %v, want ErrCorrupted", err)
+	}
+	if _, ok := server.objects["block-2.beam"]; ok {
+		t.Error("the block stored with another CRC32C was kept")
+	}
+	server.badCRC = false
+
+	// Blocks damaged in the store do not match the MD5 or the CRC32C kept
+	// with them
+	for name, data := range map[string][]byte{"block-1.beam": small, "block-2.beam": large} {
+		if err := store.Put(name, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		server.corrupt = name
+		rc, err := store.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(rc); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("reading damaged %s returned %v, want ErrCorrupted", name, err)
+		}
+		rc.Close()
+	}
+}
+
+func TestGCSTokenSource(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var issued int
+	var tokenURI string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := checkGCSAssertion(r, &private.PublicKey, tokenURI); err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant", "error_description": "invalid assertion"}`))
+			return
+		}
+		issued++
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600, "token_type": "Bearer"}`, issued)
+	}))
+	defer server.Close()
+	tokenURI = server.URL + "/token"
+
+	keyFile, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "beam@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewGCSTokenSource(keyFile, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "token-1" {
+			t.Errorf("got token %q, want token-1 reused until it expires", got)
+		}
+	}
+
+	if _, err := NewGCSTokenSource([]byte(`{"type": "authorized_user"}`), nil); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("user credentials returned %v, want ErrInvalidOption", err)
+	}
+}
+
+// checkGCSAssertion checks the JWT of a token request is signed with the key
+// and claims the scope of GCSStore for the token endpoint
+func checkGCSAssertion(r *http.Request, public *rsa.PublicKey, tokenURI string) error {
+	if grant := r.PostFormValue("grant_type"); grant != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		return fmt.Errorf("grant type %q", grant)
+	}
+	parts := strings.Split(r.PostFormValue("assertion"), ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("assertion of %d parts", len(parts))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("assertion signature: %w", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+	}
+	var claims struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	for i, v := range []any{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return err
+		}
+	}
+	switch {
+	case header.Alg != "RS256" || header.Typ != "JWT":
+		return fmt.Errorf("assertion header %+v", header)
+	case claims.Iss != "beam@project.iam.gserviceaccount.com" || claims.Scope != gcsScope || claims.Aud != tokenURI:
+		return fmt.Errorf("assertion claims %+v", claims)
+	case claims.Exp-claims.Iat != 3600:
+		return fmt.Errorf("assertion valid for %ds", claims.Exp-claims.Iat)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+//go:build ignore
+
+// gen_normtables.go writes normtables.go, the canonical decompositions,
+// combining classes and compositions nfc and nfd need, from the Unicode
+// Character Database. It is run by go generate:
+//
+//	go run gen_normtables.go [-ucd URL_OR_DIR] [-version 14.0.0] [-output normtables.go]
+//
+// The database is downloaded from unicode.org unless -ucd names a directory
+// holding UnicodeData.txt and CompositionExclusions.txt
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	version := flag.String("version", "14.0.0", "version of the Unicode Character Database")
+	ucd := flag.String("ucd", "", "base URL or directory of the database files, unicode.org for the version when empty")
+	output := flag.String("output", "normtables.go", "file to write")
+	flag.Parse()
+	if *ucd == "" {
+		*ucd = "https://www.unicode.org/Public/" + *version + "/ucd/"
+	}
+
+	data, err := open(*ucd, "UnicodeData.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	decompositions, classes, err := readUnicodeData(data)
+	data.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	exclusionsFile, err := open(*ucd, "CompositionExclusions.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	exclusions, err := readExclusions(exclusionsFile)
+	exclusionsFile.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	src, err := generate(*version, decompositions, classes, exclusions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// open returns a database file from a URL or a directory
+func open(base string, name string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(base, "https://") && !strings.HasPrefix(base, "http://") {
+		return os.Open(filepath.Join(base, name))
+	}
+	resp, err := http.Get(strings.TrimSuffix(base, "/") + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading %s: %s", name, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// readUnicodeData returns the canonical decomposition mappings, one level
+// deep, and the non-zero combining classes of UnicodeData.txt
+func readUnicodeData(r io.Reader) (map[rune][]rune, map[rune]uint8, error) {
+	decompositions := make(map[rune][]rune)
+	classes := make(map[rune]uint8)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) < 6 {
+			continue
+		}
+		r, err := parseRune(fields[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		class, err := strconv.ParseUint(fields[3], 10, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("combining class of %04X: %w", r, err)
+		}
+		if class != 0 {
+			classes[r] = uint8(class)
+		}
+		// Compatibility mappings start with a <tag> and are left out
+		if fields[5] == "" || strings.HasPrefix(fields[5], "<") {
+			continue
+		}
+		for _, field := range strings.Fields(fields[5]) {
+			d, err := parseRune(field)
+			if err != nil {
+				return nil, nil, err
+			}
+			decompositions[r] = append(decompositions[r], d)
+		}
+	}
+	return decompositions, classes, scanner.Err()
+}
+
+// readExclusions returns the runes CompositionExclusions.txt lists
+func readExclusions(r io.Reader) (map[rune]bool, error) {
+	exclusions := make(map[rune]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		r, err := parseRune(line)
+		if err != nil {
+			return nil, err
+		}
+		exclusions[r] = true
+	}
+	return exclusions, scanner.Err()
+}
+
+func parseRune(s string) (rune, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid code point %q: %w", s, err)
+	}
+	return rune(n), nil
+}
+
+// fullDecomposition applies the canonical mappings until none is left
+func fullDecomposition(r rune, decompositions map[rune][]rune) []rune {
+	mapping, ok := decompositions[r]
+	if !ok {
+		return []rune{r}
+	}
+	var full []rune
+	for _, d := range mapping {
+		full = append(full, fullDecomposition(d, decompositions)...)
+	}
+	return full
+}
+
+// generate returns the formatted source of normtables.go. A rune is composed
+// from its pair unless it is listed as an exclusion, decomposes to a single
+// rune or is or decomposes to a rune with a non-zero combining class
+func generate(version string, decompositions map[rune][]rune, classes map[rune]uint8, exclusions map[rune]bool) ([]byte, error) {
+	runes := make([]rune, 0, len(decompositions))
+	for r := range decompositions {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_normtables.go from the Unicode Character Database %s. DO NOT EDIT.\n\n", version)
+	b.WriteString("package packer\n\n")
+
+	b.WriteString("// canonicalDecompositions maps runes to their full canonical decomposition.\n")
+	b.WriteString("// Hangul syllables are decomposed algorithmically instead\n")
+	b.WriteString("var canonicalDecompositions = map[rune]string{\n")
+	for _, r := range runes {
+		fmt.Fprintf(&b, "\t0x%04X: \"", r)
+		for _, d := range fullDecomposition(r, decompositions) {
+			if d > 0xFFFF {
+				fmt.Fprintf(&b, "\\U%08X", d)
+			} else {
+				fmt.Fprintf(&b, "\\u%04X", d)
+			}
+		}
+		b.WriteString("\",\n")
+	}
+	b.WriteString("}\n\n")
+
+	marks := make([]rune, 0, len(classes))
+	for r := range classes {
+		marks = append(marks, r)
+	}
+	sort.Slice(marks, func(i, j int) bool { return marks[i] < marks[j] })
+	b.WriteString("// combiningClasses holds the canonical combining class of every rune that\n")
+	b.WriteString("// has a non-zero one\n")
+	b.WriteString("var combiningClasses = map[rune]uint8{\n")
+	for _, r := range marks {
+		fmt.Fprintf(&b, "\t0x%04X: %d,\n", r, classes[r])
+	}
+	b.WriteString("}\n\n")
+
+	type composition struct {
+		pair      [2]rune
+		composite rune
+	}
+	var compositions []composition
+	for _, r := range runes {
+		mapping := decompositions[r]
+		if len(mapping) != 2 || exclusions[r] || classes[r] != 0 || classes[mapping[0]] != 0 {
+			continue
+		}
+		compositions = append(compositions, composition{[2]rune{mapping[0], mapping[1]}, r})
+	}
+	sort.Slice(compositions, func(i, j int) bool {
+		a, c := compositions[i].pair, compositions[j].pair
+		return a[0] < c[0] || a[0] == c[0] && a[1] < c[1]
+	})
+	b.WriteString("// canonicalCompositions maps pairs of runes to the primary composite they\n")
+	b.WriteString("// compose to, excluding the composition exclusions\n")
+	b.WriteString("var canonicalCompositions = map[[2]rune]rune{\n")
+	for _, c := range compositions {
+		fmt.Fprintf(&b, "\t{0x%04X, 0x%04X}: 0x%04X,\n", c.pair[0], c.pair[1], c.composite)
+	}
+	b.WriteString("}\n")
+
+	return format.Source(b.Bytes())
+}
@@ -0,0 +1,75 @@
+package packer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// validatePatterns checks that every pattern is well formed
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, segment := range splitPath(pattern) {
+			if segment == "**" {
+				continue
+			}
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w: %w", pattern, err, ErrInvalidOption)
+			}
+		}
+	}
+	return nil
+}
+
+// matchAny reports whether an archived path matches any of the patterns, an
+// empty pattern list matches everything
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches an archived path against a glob pattern. Patterns use
+// path.Match syntax per segment, with "**" matching any number of segments
+func matchPattern(pattern string, name string) bool {
+	return matchSegments(splitPath(pattern), splitPath(filepath.ToSlash(name)))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try every possible number of segments for the wildcard
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// splitPath splits a slash separated path into its segments, ignoring leading
+// and trailing slashes
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
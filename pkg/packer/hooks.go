@@ -0,0 +1,31 @@
+package packer
+
+import "io"
+
+// FileFilter decides whether a file planned for packing is packed, once its
+// archived path is known. It may read the file at file.Path to decide on its
+// contents, such as to leave out files holding private keys
+type FileFilter func(file FileInfo) bool
+
+// FileTransform rewrites the contents of a file as they are packed,
+// such as to redact secrets or normalize line endings. path is the archived
+// path, and returning r leaves the contents as they are. Errors reading the
+// returned reader fail the file like errors reading the file itself
+type FileTransform func(path string, r io.Reader) io.Reader
+
+// transformReader returns the reader the contents of a file are packed from,
+// through Transform for the files planned with it set
+func (p defaultPacker) transformReader(metadata *FileMetadata, r io.Reader) io.Reader {
+	if !metadata.transformed {
+		return r
+	}
+	return p.opts.Transform(metadata.Path, r)
+}
+
+// filePacked reports a file whose contents are written to a block to
+// FilePacked
+func (p defaultPacker) filePacked(metadata *FileMetadata) {
+	if p.opts.FilePacked != nil {
+		p.opts.FilePacked(*metadata)
+	}
+}
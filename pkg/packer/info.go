@@ -0,0 +1,130 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// packerModule is the module path of this package, whose version is recorded
+// as the tool archives were created with
+const packerModule = "github.com/atterpac/bt-takehome"
+
+// ArchiveInfo describes an archive as a whole, so it can be told apart and
+// traced back long after it was packed. It is recorded in the manifest when
+// the archive is first packed, along with the labels and comment of
+// PackerOptions, and kept whenever the manifest is written again
+type ArchiveInfo struct {
+	Created  time.Time         `json:"created"`            // When the archive was first packed
+	Modified time.Time         `json:"modified"`           // When the manifest was last rebuilt from the blocks
+	Tool     string            `json:"tool"`               // Name and version of the packer that created the archive
+	Hostname string            `json:"hostname,omitempty"` // Host the archive was created on
+	Labels   map[string]string `json:"labels,omitempty"`   // Labels given in PackerOptions.Labels, by name
+	Comment  string            `json:"comment,omitempty"`  // Comment given in PackerOptions.Comment
+	Expires  *time.Time        `json:"expires,omitempty"`  // When the archive may be deleted, from PackerOptions.ExpiresAfter
+}
+
+// Info returns the archive info recorded in the manifest of an archive. It
+// returns an error matching fs.ErrNotExist for archives without one, such as
+// archives with encrypted metadata, which have no manifest
+func (p defaultPacker) Info(archiveDir string) (*ArchiveInfo, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	info, err := readInfo(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("archive %s records no info: %w", archiveDir, os.ErrNotExist)
+	}
+	return info, nil
+}
+
+// readInfo returns the archive info recorded in the manifest of an archive,
+// nil when there is none
+func readInfo(archiveDir string) (*ArchiveInfo, error) {
+	f, err := os.Open(filepath.Join(archiveDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m struct {
+		Info *ArchiveInfo `json:"info"`
+	}
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	return m.Info, nil
+}
+
+// archiveInfo returns the archive info to record in a manifest written now,
+// starting from the one recorded, which is nil for a new archive. The labels
+// and comment of the options are applied over the recorded ones, and their
+// expiry replaces the recorded one
+func (p defaultPacker) archiveInfo(recorded *ArchiveInfo) *ArchiveInfo {
+	now := time.Now().UTC().Truncate(time.Second)
+	var info ArchiveInfo
+	if recorded != nil {
+		info = *recorded
+	} else {
+		info.Created = now
+		info.Tool = toolVersion()
+		info.Hostname, _ = os.Hostname()
+	}
+	info.Modified = now
+	if len(p.opts.Labels) > 0 {
+		labels := make(map[string]string, len(info.Labels)+len(p.opts.Labels))
+		for name, value := range info.Labels {
+			labels[name] = value
+		}
+		for name, value := range p.opts.Labels {
+			labels[name] = value
+		}
+		info.Labels = labels
+	}
+	if p.opts.Comment != "" {
+		info.Comment = p.opts.Comment
+	}
+	if p.opts.ExpiresAfter > 0 {
+		expires := now.Add(p.opts.ExpiresAfter)
+		info.Expires = &expires
+	}
+	return &info
+}
+
+// toolVersion returns the name and version of this packer, as far as the
+// build records it
+func toolVersion() string {
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "beam"
+	}
+	module := &build.Main
+	for _, dep := range build.Deps {
+		if dep.Path == packerModule {
+			module = dep
+		}
+	}
+	version := module.Version
+	if module == &build.Main && (version == "" || version == "(devel)") {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				version = "(devel " + setting.Value[:12] + ")"
+			}
+		}
+	}
+	if version == "" {
+		return "beam"
+	}
+	return "beam " + version
+}
@@ -0,0 +1,195 @@
+package packer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// journalFileName is the name of the pack journal inside the output directory
+const journalFileName = "pack.journal"
+
+// journalEntry records a block that was completely written to disk
+type journalEntry struct {
+	BlockID int32    `json:"block_id"`       // ID of the completed block
+	Name    string   `json:"name,omitempty"` // File name of the block, the default name when empty
+	Files   []string `json:"files"`          // Archived paths of the files packed into the block
+}
+
+// fileName returns the name of the block file the entry refers to
+func (e journalEntry) fileName() string {
+	if e.Name == "" {
+		return blockFileName(e.BlockID)
+	}
+	return e.Name
+}
+
+// packJournal is an append only log of completed blocks used to resume an
+// interrupted Pack, it is removed once packing finishes successfully
+type packJournal struct {
+	path    string
+	f       *os.File
+	entries []journalEntry
+}
+
+// openJournal opens the journal in the output directory. When resuming, the
+// entries of blocks that still validate are loaded, otherwise the journal is
+// started from scratch
+func (p defaultPacker) openJournal(outputDir string) (*packJournal, error) {
+	j := &packJournal{path: filepath.Join(outputDir, journalFileName)}
+
+	if p.opts.Resume {
+		entries, err := readJournal(j.path)
+		if err != nil {
+			return nil, err
+		}
+		// Only trust blocks up to the first one that is missing or damaged
+		for _, entry := range entries {
+			if err := p.validateVolume(filepath.Join(outputDir, entry.fileName())); err != nil {
+				p.logger().Warn("Block from journal failed validation, repacking from there", "block", entry.BlockID)
+				break
+			}
+			j.entries = append(j.entries, entry)
+		}
+		if len(entries) > 0 {
+			if err := j.removeUntrusted(outputDir, p.volumeExt()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Rewrite the journal with the trusted entries only
+	f, err := os.Create(j.path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating journal: %w", err)
+	}
+	j.f = f
+	for _, entry := range j.entries {
+		if err := j.write(entry); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// removeUntrusted deletes the blocks of an interrupted pack that are not in
+// the trusted journal entries. They are written again under new names, which
+// need not match the old ones when the block namer is not deterministic
+func (j *packJournal) removeUntrusted(outputDir string, ext string) error {
+	trusted := make(map[string]bool)
+	for _, entry := range j.entries {
+		trusted[entry.fileName()] = true
+	}
+	// Blocks are listed with their volumes
+	listFiles := listBlocks
+	if ext != blockExt {
+		listFiles = func(dir string) ([]string, error) { return listVolumes(dir, ext) }
+	}
+	paths, err := listFiles(outputDir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if trusted[filepath.Base(path)] {
+			continue
+		}
+		if err := removeBlock(path); err != nil {
+			return fmt.Errorf("error removing incomplete block: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateVolume checks a volume written by an earlier pack
+func (p defaultPacker) validateVolume(path string) error {
+	if p.opts.Format == FormatZip {
+		return validateZip(path)
+	}
+	return p.validator.ValidateBlock(path)
+}
+
+// readJournal reads all complete entries from a journal file, a missing
+// journal yields no entries and a torn final line is ignored
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %w", err)
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	return entries, nil
+}
+
+// packedFiles returns the set of source paths already stored in completed blocks
+func (j *packJournal) packedFiles() map[string]bool {
+	packed := make(map[string]bool)
+	for _, entry := range j.entries {
+		for _, path := range entry.Files {
+			packed[path] = true
+		}
+	}
+	return packed
+}
+
+// nextBlockID returns the ID of the first block that still needs writing
+func (j *packJournal) nextBlockID() int32 {
+	next := int32(1)
+	for _, entry := range j.entries {
+		if entry.BlockID >= next {
+			next = entry.BlockID + 1
+		}
+	}
+	return next
+}
+
+// complete records a block as written and flushes the journal to disk
+func (j *packJournal) complete(block *Block) error {
+	entry := journalEntry{BlockID: block.ID, Name: block.fileName}
+	for _, metadata := range block.Files {
+		entry.Files = append(entry.Files, metadata.Path)
+	}
+	if err := j.write(entry); err != nil {
+		return err
+	}
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *packJournal) write(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding journal entry: %w", err)
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	return j.f.Sync()
+}
+
+// finish removes the journal after a successful Pack
+func (j *packJournal) finish() error {
+	if err := j.f.Close(); err != nil {
+		return fmt.Errorf("error closing journal: %w", err)
+	}
+	return os.Remove(j.path)
+}
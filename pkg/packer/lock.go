@@ -0,0 +1,95 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockFileName is the file in an archive directory that operations lock, so
+// two writers never rewrite the manifest at once and readers never see a
+// writer half way. It stays in place once created, locks held on it are
+// released by the operating system when the process holding them exits
+const lockFileName = ".beam.lock"
+
+// lockRetryInterval is how often a lock held by another process is tried
+// again within LockTimeout
+const lockRetryInterval = 50 * time.Millisecond
+
+// ErrArchiveLocked is returned when another operation holds the lock of an
+// archive directory for longer than LockTimeout
+var ErrArchiveLocked = errors.New("archive locked by another operation")
+
+// errLockHeld is returned by tryLockFile when another process holds the lock
+var errLockHeld = errors.New("lock held")
+
+// lockArchive takes the advisory lock of an archive directory for the current
+// call, exclusive for calls writing the archive and shared for calls reading
+// it, so readers run side by side but never alongside a writer. The calls
+// the current one makes on a directory it locked already do not lock it again.
+// Writers create the lock file, readers lock it when it is there and go on
+// without it otherwise, so reading an archive never writes to its directory.
+// The lock is released by the function returned
+func (p *defaultPacker) lockArchive(archiveDir string, exclusive bool) (func(), error) {
+	unlock := func() {}
+	if p.opts.NoArchiveLock {
+		return unlock, nil
+	}
+	dir, err := filepath.Abs(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		// A single block is locked through its directory
+		dir = filepath.Dir(dir)
+	}
+	for _, locked := range p.locked {
+		if locked == dir {
+			return unlock, nil
+		}
+	}
+
+	path := filepath.Join(dir, lockFileName)
+	if exclusive {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating archive directory: %w", err)
+		}
+	}
+	var f *os.File
+	if exclusive {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else if f, err = os.Open(path); err != nil {
+		p.logger().Debug("Reading archive without locking it", "dir", dir, "error", err)
+		return unlock, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive lock: %w", err)
+	}
+
+	deadline := time.Now().Add(p.opts.LockTimeout)
+	for waited := false; ; waited = true {
+		err := tryLockFile(f, exclusive)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockHeld) {
+			f.Close()
+			return nil, fmt.Errorf("error locking archive: %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", dir, ErrArchiveLocked)
+		}
+		if !waited {
+			p.logger().Info("Waiting for another operation on the archive", "dir", dir)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	p.locked = append(p.locked[:len(p.locked):len(p.locked)], dir)
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
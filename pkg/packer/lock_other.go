@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package packer
+
+import "os"
+
+// tryLockFile does nothing, archives are not locked on this platform
+func tryLockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile does nothing, archives are not locked on this platform
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package packer
+
+// longPath returns path unchanged, only Windows limits path lengths this way
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package packer
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxLegacyPath is the longest path the Windows APIs accept without the \\?\
+// prefix, less room for a file name as directories are limited further
+const maxLegacyPath = 248
+
+// longPath returns path in the \\?\ form that lifts the Windows path length
+// limit when it is too long for the legacy APIs. The os package does this for
+// its own calls, but not for paths handed to syscall directly
+func longPath(path string) string {
+	if len(path) < maxLegacyPath || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
@@ -0,0 +1,62 @@
+//go:build windows
+
+package packer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	long := `C:\` + strings.Repeat(`directory\`, 30) + "file.txt"
+	longUNC := `\\server\share\` + strings.Repeat(`directory\`, 30) + "file.txt"
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short", `C:\data\file.txt`, `C:\data\file.txt`},
+		{"long", long, `\\?\` + long},
+		{"long UNC", longUNC, `\\?\UNC\` + longUNC[2:]},
+		{"prefixed", `\\?\` + long, `\\?\` + long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := longPath(tt.in); got != tt.want {
+				t.Errorf("longPath(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackDeepTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	deep := filepath.Join(src, strings.Repeat("directory-name\\", 20))
+	if len(deep) < maxLegacyPath {
+		t.Fatalf("%s is too short to need the long path form", deep)
+	}
+	data := []byte("deep file contents")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(deep, "file.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPacker(PackerOptions{})
+	archive := filepath.Join(t.TempDir(), "archive")
+	if err := p.Pack(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := p.Unpack(archive, out); err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, out)
+	if !bytes.Equal(got["file.txt"], data) {
+		t.Errorf("unpacked %q, want %q", got["file.txt"], data)
+	}
+}
@@ -0,0 +1,55 @@
+package packer
+
+import (
+	"sync"
+	"time"
+)
+
+// LowImpact caps ReadWorkers and VerifyWorkers at lowImpactWorkers and
+// pauses after each file for as long as the file took, up to
+// lowImpactMaxPause, so a pack or unpack runs at most about half the time
+const (
+	lowImpactWorkers  = 1
+	lowImpactMaxPause = time.Second
+)
+
+// lowerPriorityOnce lowers the priority of the process the first time a
+// packer with LowImpact is created, it is never raised again
+var lowerPriorityOnce sync.Once
+
+// lowerPriority runs the process at idle CPU and I/O priority where the
+// platform allows, logging a warning when it does not
+func (p defaultPacker) lowerPriority() {
+	lowerPriorityOnce.Do(func() {
+		if err := lowerProcessPriority(); err != nil {
+			p.logger().Warn("Could not lower the priority of the process", "error", err)
+		}
+	})
+}
+
+// pacer spaces out the files of an operation with LowImpact
+type pacer struct {
+	mu   sync.Mutex
+	last time.Time // End of the previous pause
+}
+
+func newPacer(enabled bool) *pacer {
+	if !enabled {
+		return nil
+	}
+	return &pacer{}
+}
+
+// wait pauses after a file was packed or extracted for as long as it took
+// since the previous pause
+func (pc *pacer) wait() {
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.last.IsZero() {
+		time.Sleep(min(time.Since(pc.last), lowImpactMaxPause))
+	}
+	pc.last = time.Now()
+}
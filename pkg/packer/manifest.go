@@ -0,0 +1,355 @@
+package packer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// manifestFileName is the name of the manifest next to the blocks of an archive
+const manifestFileName = "manifest.json"
+
+// manifestVersion is the version of the manifests written by this package
+const manifestVersion = 1
+
+// Manifest indexes an archive: its blocks and where the contents of every
+// file are stored, so files can be located without opening the blocks. It is
+// written next to the blocks as manifest.json. The blocks remain the source
+// of truth, the manifest can always be rebuilt from them except for the zstd
+// dictionaries, input roots and archive info it holds, which every rebuild
+// carries over
+type Manifest struct {
+	Version      int                  `json:"version"`                // Manifest format version
+	Generation   int                  `json:"generation,omitempty"`   // Snapshot generation, 0 for the manifest of the whole archive
+	Created      *time.Time           `json:"created,omitempty"`      // When the snapshot was taken
+	Expires      *time.Time           `json:"expires,omitempty"`      // When the snapshot expires and Prune deletes it
+	Source       string               `json:"source,omitempty"`       // Directory the snapshot was taken of
+	Blocks       []ManifestBlock      `json:"blocks"`                 // Blocks sorted by ID
+	Files        []ManifestFile       `json:"files"`                  // Files sorted by path
+	Dictionaries []ManifestDictionary `json:"dictionaries,omitempty"` // zstd dictionaries files are compressed with, in the order they were added
+	Roots        []ManifestRoot       `json:"roots,omitempty"`        // Input roots packed by PackRoots, sorted by prefix
+	Info         *ArchiveInfo         `json:"info,omitempty"`         // Creation time, tool, host, labels and comment of the archive, not of snapshots
+	Fingerprint  string               `json:"fingerprint,omitempty"`  // Fingerprint of the files listed, see Packer.Fingerprint
+}
+
+// ManifestRoot records an input root packed by PackRoots and the prefix its
+// files are archived under
+type ManifestRoot struct {
+	Prefix string `json:"prefix"` // Archived path the files of the root are under
+	Source string `json:"source"` // Directory or file packed under the prefix
+}
+
+// ManifestDictionary is a zstd dictionary files of an archive are compressed
+// with. Their zstd frames name it by its ID
+type ManifestDictionary struct {
+	ID   uint32 `json:"id"`   // Dictionary ID, as recorded in the dictionary and in the frames using it
+	Data []byte `json:"data"` // The dictionary in the zstd dictionary format, base64 encoded
+}
+
+// ManifestBlock describes a block file of an archive
+type ManifestBlock struct {
+	ID       int32            `json:"id"`                 // Block ID from the block header
+	Name     string           `json:"name"`               // File name of the block
+	Size     int64            `json:"size"`               // Size of the block file in bytes
+	Checksum string           `json:"checksum"`           // Hex encoded SHA-256 checksum from the block footer
+	Volumes  []ManifestVolume `json:"volumes,omitempty"`  // Volumes the block file is split into under VolumeSize, in order
+	Replicas []string         `json:"replicas,omitempty"` // Names of the MirrorStore replicas holding the block, in the order of the store
+}
+
+// ManifestVolume is one of the volumes a block file is split into. Offsets
+// within the block run on from one volume to the next
+type ManifestVolume struct {
+	Name string `json:"name"` // File name of the volume, the block file name followed by its number
+	Size int64  `json:"size"` // Size of the volume in bytes
+}
+
+// ManifestFile describes an archived file and where its contents are stored
+type ManifestFile struct {
+	Path           string            `json:"path"`                      // Archived path
+	Size           int64             `json:"size"`                      // Size of the contents in bytes
+	Mode           uint32            `json:"mode"`                      // File mode bits
+	ModTime        time.Time         `json:"mod_time"`                  // Last modification time
+	BirthTime      *time.Time        `json:"birth_time,omitempty"`      // Creation time, when recorded
+	Uid            uint32            `json:"uid"`                       // Numeric owner, when recorded
+	Gid            uint32            `json:"gid"`                       // Numeric group, when recorded
+	Xattrs         map[string][]byte `json:"xattrs,omitempty"`          // Extended attributes, base64 encoded
+	Attributes     uint32            `json:"attributes,omitempty"`      // Windows hidden and system attributes
+	Holes          []Extent          `json:"holes,omitempty"`           // Zero filled regions of a sparse file
+	ZeroRuns       []Extent          `json:"zero_runs,omitempty"`       // Runs of zeros left out of the block, relative to the file
+	Compression    Compression       `json:"compression,omitempty"`     // Compression method of the contents, 1 for DEFLATE, 2 for zstd
+	CompressedSize int64             `json:"compressed_size,omitempty"` // Size of the compressed contents in the block
+	Device         uint64            `json:"device,omitempty"`          // Device number of a device node
+	BlockID        int32             `json:"block_id"`                  // ID of the block holding the contents
+	Offset         int64             `json:"offset"`                    // Offset of the contents from the start of the block file
+	Checksum       string            `json:"checksum"`                  // Hex encoded SHA-256 checksum of the contents
+	Deleted        bool              `json:"deleted,omitempty"`         // Removed from the archive, the contents remain until it is compacted
+	Original       string            `json:"original,omitempty"`        // Path recorded in the block when the file was renamed since
+	Tags           map[string]string `json:"tags,omitempty"`            // User defined tags, see TagRule
+}
+
+// addBlock adds a block and its files to the manifest. The block checksum and
+// data offset must be known, as they are for written blocks and read indexes
+func (m *Manifest) addBlock(block *Block, name string, size int64) {
+	m.Blocks = append(m.Blocks, ManifestBlock{
+		ID:       block.ID,
+		Name:     name,
+		Size:     size,
+		Checksum: hex.EncodeToString(block.Checksum),
+		Volumes:  block.volumes,
+	})
+	for i := range block.Files {
+		m.Files = append(m.Files, manifestFile(&block.Files[i], block.DataOffset+block.Files[i].Offset))
+	}
+}
+
+// manifestFile returns the manifest entry of a file whose contents start at
+// offset within its block file
+func manifestFile(metadata *FileMetadata, offset int64) ManifestFile {
+	file := ManifestFile{
+		Path:           metadata.Path,
+		Size:           metadata.Size,
+		Mode:           metadata.Mode,
+		ModTime:        metadata.ModTime.UTC(),
+		Uid:            metadata.Uid,
+		Gid:            metadata.Gid,
+		Xattrs:         metadata.Xattrs,
+		Attributes:     metadata.Attributes,
+		Holes:          metadata.Holes,
+		ZeroRuns:       metadata.ZeroRuns,
+		Compression:    metadata.Compression,
+		CompressedSize: metadata.CompressedSize,
+		Device:         metadata.Device,
+		Tags:           metadata.Tags,
+		BlockID:        metadata.BlockID,
+		Offset:         offset,
+		Checksum:       hex.EncodeToString(metadata.Checksum),
+	}
+	if !metadata.BirthTime.IsZero() {
+		birthTime := metadata.BirthTime.UTC()
+		file.BirthTime = &birthTime
+	}
+	return file
+}
+
+// sort orders the blocks by ID and the files by path
+func (m *Manifest) sort() {
+	sort.Slice(m.Blocks, func(i, j int) bool { return m.Blocks[i].ID < m.Blocks[j].ID })
+	sort.SliceStable(m.Files, func(i, j int) bool { return m.Files[i].Path < m.Files[j].Path })
+}
+
+// metadata returns the file metadata of a manifest entry. Its offset is the
+// offset from the start of the block file
+func (f *ManifestFile) metadata() (FileMetadata, error) {
+	checksum, err := hex.DecodeString(f.Checksum)
+	if err != nil || len(checksum) != 32 {
+		return FileMetadata{}, fmt.Errorf("invalid checksum for file %s in manifest: %w", f.Path, ErrCorrupted)
+	}
+	if f.Size < 0 || f.Offset < 0 {
+		return FileMetadata{}, fmt.Errorf("invalid size or offset for file %s in manifest: %w", f.Path, ErrCorrupted)
+	}
+	if err := checkExtents(f.Holes, f.Size); err != nil {
+		return FileMetadata{}, fmt.Errorf("holes of file %s in manifest: %w", f.Path, err)
+	}
+	if err := checkExtents(f.ZeroRuns, f.Size); err != nil {
+		return FileMetadata{}, fmt.Errorf("zero runs of file %s in manifest: %w", f.Path, err)
+	}
+	metadata := FileMetadata{
+		Path:           f.Path,
+		Size:           f.Size,
+		ModTime:        f.ModTime,
+		Checksum:       checksum,
+		Offset:         f.Offset,
+		BlockID:        f.BlockID,
+		Mode:           f.Mode,
+		Uid:            f.Uid,
+		Gid:            f.Gid,
+		Xattrs:         f.Xattrs,
+		Attributes:     f.Attributes,
+		Holes:          f.Holes,
+		ZeroRuns:       f.ZeroRuns,
+		Compression:    f.Compression,
+		CompressedSize: f.CompressedSize,
+		Device:         f.Device,
+		Tags:           f.Tags,
+	}
+	if err := checkCompressedFile(&metadata); err != nil {
+		return FileMetadata{}, err
+	}
+	if f.BirthTime != nil {
+		metadata.BirthTime = *f.BirthTime
+	}
+	return metadata, nil
+}
+
+// locate returns the metadata of the files matching any of the patterns, with
+// offsets from the start of their block file, and the names of the blocks
+func (m *Manifest) locate(patterns []string) ([]FileMetadata, map[int32]string, error) {
+	blockNames := make(map[int32]string, len(m.Blocks))
+	for _, block := range m.Blocks {
+		blockNames[block.ID] = block.Name
+	}
+
+	var files []FileMetadata
+	for i := range m.Files {
+		if m.Files[i].Deleted || !matchAny(patterns, m.Files[i].Path) {
+			continue
+		}
+		metadata, err := m.Files[i].metadata()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := blockNames[metadata.BlockID]; !ok {
+			return nil, nil, fmt.Errorf("file %s is in block %d, which is not in the manifest: %w", metadata.Path, metadata.BlockID, ErrCorrupted)
+		}
+		files = append(files, metadata)
+	}
+	return files, blockNames, nil
+}
+
+// readManifest decodes a manifest, rejecting versions this package does not know
+func readManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	if m.Version < 1 || m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest version %d: %w", m.Version, ErrUnsupportedVersion)
+	}
+	if _, err := (manifestDictionaries{m.Dictionaries}).register(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// encode writes the manifest as indented JSON, recording the fingerprint of
+// the files it lists
+func (m *Manifest) encode(w io.Writer) error {
+	if err := m.setFingerprint(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// readManifestFile reads the manifest stored at path
+func readManifestFile(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readManifest(f)
+}
+
+// buildManifest indexes the blocks of an archive directory, keeping the files
+// removed, renamed or tagged, the dictionaries, the roots and the archive info
+// in its current manifest, along with the roots being packed and the tags of
+// the options
+func (p defaultPacker) buildManifest(archiveDir string) (*Manifest, error) {
+	blockPaths, err := listBlocks(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	edits, err := loadEdits(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	dictionaries, err := readDictionaries(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	roots, err := readRoots(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	info, err := readInfo(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	m := &Manifest{Version: manifestVersion, Dictionaries: dictionaries, Roots: mergeRoots(roots, p.roots), Info: p.archiveInfo(info)}
+	for _, blockPath := range blockPaths {
+		f, err := openBlockFile(blockPath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening block %s: %w", filepath.Base(blockPath), err)
+		}
+		block, err := p.readBlockIndexAt(f, f.Size())
+		size, volumes := f.Size(), f.manifest()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading block %s: %w", filepath.Base(blockPath), err)
+		}
+		block.volumes = volumes
+		first := len(m.Files)
+		m.addBlock(block, filepath.Base(blockPath), size)
+		for i := range block.Files {
+			if edit, ok := edits.lookup(block, &block.Files[i]); ok {
+				file := &m.Files[first+i]
+				file.Path, file.Original, file.Deleted, file.Tags = edit.Path, edit.Original, edit.Deleted, edit.Tags
+			}
+		}
+	}
+	if err := m.applyTags(p.opts.Tags); err != nil {
+		return nil, err
+	}
+	m.sort()
+	return m, nil
+}
+
+// writeManifest rebuilds the manifest of an archive directory from its blocks
+// and signs the archive again when SigningKey is set. Zip volumes have no
+// manifest, nor do archives with encrypted metadata as it lists every path
+func (p defaultPacker) writeManifest(archiveDir string) error {
+	// The blocks are flushed before the manifest listing them is written
+	if err := p.syncs.flush(); err != nil {
+		return err
+	}
+	if p.opts.Format != FormatBeam {
+		return nil
+	}
+	if p.encryptsMetadata() {
+		return p.resign(archiveDir)
+	}
+	m, err := p.buildManifest(archiveDir)
+	if err != nil {
+		return fmt.Errorf("error building manifest: %w", err)
+	}
+
+	path := filepath.Join(archiveDir, manifestFileName)
+	if err := writeManifestFile(path, m); err != nil {
+		return err
+	}
+	if err := p.syncs.written(path); err != nil {
+		return err
+	}
+	if err := p.syncs.flush(); err != nil {
+		return err
+	}
+	return p.resign(archiveDir)
+}
+
+// writeManifestFile writes a manifest to path, replacing any previous one
+// only once it is complete
+func writeManifestFile(path string, m *Manifest) error {
+	f, err := createArchiveTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating manifest: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := m.encode(f); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
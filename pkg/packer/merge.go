@@ -0,0 +1,214 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MergePlan describes how unpacking an archive changes an existing directory.
+// Paths are relative to the output directory and sorted
+type MergePlan struct {
+	New        []string // Archived files not yet present in the output directory
+	Overwrite  []string // Archived files replacing an existing file
+	Extraneous []string // Files in the output directory that are not part of the archive
+
+	OverwrittenBytes int64 // Size of the existing files that will be replaced
+	ExtraneousBytes  int64 // Size of the extraneous files, reclaimed when they are deleted
+	ExtractedBytes   int64 // Size of the archived files extracted, new and overwritten
+	NewDirectories   int   // Directories created for the new files
+}
+
+func (p defaultPacker) PlanMerge(archiveDir string, outputDir string, patterns ...string) (*MergePlan, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := validatePatterns(patterns); err != nil {
+		return nil, err
+	}
+
+	files, err := p.readArchiveIndex(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &MergePlan{}
+	archived := make(map[string]bool)
+	dirs := make(map[string]bool) // Parent directories of new files checked
+	for _, metadata := range files {
+		relPath, err := p.outputRelPath(outputDir, metadata.Path)
+		if err != nil {
+			return nil, err
+		}
+		archived[relPath] = true
+
+		if !matchAny(patterns, metadata.Path) {
+			continue
+		}
+
+		plan.ExtractedBytes += metadata.Size
+		info, err := os.Lstat(filepath.Join(outputDir, relPath))
+		switch {
+		case err == nil:
+			plan.Overwrite = append(plan.Overwrite, relPath)
+			plan.OverwrittenBytes += info.Size()
+		case errors.Is(err, os.ErrNotExist):
+			plan.New = append(plan.New, relPath)
+			plan.NewDirectories += countNewDirs(outputDir, filepath.Dir(relPath), dirs)
+		default:
+			return nil, fmt.Errorf("error checking %s: %w", relPath, err)
+		}
+	}
+
+	// Extraneous files are judged against the whole archive, not only the
+	// selected files, so a selective restore never deletes archived paths
+	plan.Extraneous, err = findExtraneous(archiveDir, outputDir, archived)
+	if err != nil {
+		return nil, err
+	}
+	for _, relPath := range plan.Extraneous {
+		info, err := os.Lstat(filepath.Join(outputDir, relPath))
+		if err != nil {
+			return nil, fmt.Errorf("error checking %s: %w", relPath, err)
+		}
+		plan.ExtraneousBytes += info.Size()
+	}
+
+	sort.Strings(plan.New)
+	sort.Strings(plan.Overwrite)
+	sort.Strings(plan.Extraneous)
+	return plan, nil
+}
+
+// countNewDirs returns how many of a directory and its parents below the
+// output directory do not exist yet and were not counted before, recording
+// the ones checked in dirs
+func countNewDirs(outputDir string, relDir string, dirs map[string]bool) int {
+	var n int
+	for ; relDir != "." && relDir != string(filepath.Separator); relDir = filepath.Dir(relDir) {
+		if dirs[relDir] {
+			// Checked along with its parents for an earlier file
+			break
+		}
+		dirs[relDir] = true
+		if _, err := os.Stat(filepath.Join(outputDir, relDir)); err == nil {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// deleteExtraneous removes the extraneous files of the plan along with any
+// directories left empty by their removal
+func (m *MergePlan) deleteExtraneous(outputDir string) error {
+	dirs := make(map[string]bool)
+	for _, relPath := range m.Extraneous {
+		if err := os.Remove(filepath.Join(outputDir, relPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error deleting extraneous file %s: %w", relPath, err)
+		}
+		for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	// Remove the deepest directories first, non empty ones are left alone
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sortByDepth(sorted)
+	for _, dir := range sorted {
+		os.Remove(filepath.Join(outputDir, dir))
+	}
+	return nil
+}
+
+// outputRelPath returns where an archived file is extracted to, relative to
+// the output directory, with the separators of the platform and the
+// configured Unicode normalization. Archived paths that would end up outside
+// the output directory, such as paths starting with a Windows drive letter,
+// are rejected
+func (p defaultPacker) outputRelPath(outputDir string, archivedPath string) (string, error) {
+	nativePath := filepath.FromSlash(p.opts.PathNormalization.normalize(archivedPath))
+	if filepath.VolumeName(nativePath) != "" {
+		return "", fmt.Errorf("archived path %q: %w", archivedPath, ErrPathUnsafe)
+	}
+	relPath, err := filepath.Rel(outputDir, filepath.Join(outputDir, nativePath))
+	if err != nil {
+		return "", fmt.Errorf("error resolving path %s: %w", archivedPath, err)
+	}
+	if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archived path %q: %w", archivedPath, ErrPathUnsafe)
+	}
+	return relPath, nil
+}
+
+// extractPath returns the path an archived file is extracted to, in the long
+// path form on Windows when it exceeds the legacy path length limit
+func (p defaultPacker) extractPath(outputDir string, archivedPath string) (string, error) {
+	relPath, err := p.outputRelPath(outputDir, archivedPath)
+	if err != nil {
+		return "", err
+	}
+	return longPath(filepath.Join(outputDir, relPath)), nil
+}
+
+// findExtraneous lists the files in the output directory that are not
+// expected, ignoring the archive itself if it lives inside the output directory
+func findExtraneous(archiveDir string, outputDir string, expected map[string]bool) ([]string, error) {
+	archiveAbs, err := filepath.Abs(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var extraneous []string
+	err = filepath.WalkDir(outputDir, func(path string, d os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && path == outputDir {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		// The block, parity and journal files of the archive are never extraneous
+		if d.IsDir() {
+			if abs == archiveAbs && path != outputDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(abs) == archiveAbs {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		if !expected[relPath] {
+			extraneous = append(extraneous, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking output directory: %w", err)
+	}
+	return extraneous, nil
+}
+
+// sortByDepth orders paths so that deeper paths come first
+func sortByDepth(paths []string) {
+	depth := func(p string) int { return strings.Count(p, string(filepath.Separator)) }
+	sort.Slice(paths, func(i, j int) bool { return depth(paths[i]) > depth(paths[j]) })
+}
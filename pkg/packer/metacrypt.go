@@ -0,0 +1,97 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MetadataKeySize is the size of PackerOptions.MetadataKey, an AES-256 key
+const MetadataKeySize = 32
+
+var (
+	// ErrMetadataEncrypted is returned when reading the metadata of a block
+	// that is encrypted without a MetadataKey
+	ErrMetadataEncrypted = errors.New("block metadata is encrypted")
+
+	// ErrMetadataKey is returned when the metadata of a block cannot be
+	// decrypted, because the key is not the one it was encrypted with or the
+	// block was damaged
+	ErrMetadataKey = errors.New("cannot decrypt block metadata, wrong key or damaged block")
+)
+
+// metadataCipher returns the AES-256-GCM cipher of encrypted metadata
+// sections. Those hold a random nonce followed by the sealed file count and
+// metadata records. The block ID and footer flags are authenticated with
+// them, so a section cannot be moved to another block unnoticed. The header
+// of the block records 0 files, so the block reveals no more than the sizes
+// of its data and metadata sections
+func metadataCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != MetadataKeySize {
+		return nil, fmt.Errorf("metadata key of %d bytes instead of %d: %w", len(key), MetadataKeySize, ErrInvalidOption)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// metadataAdditionalData returns the block fields authenticated with its
+// encrypted metadata
+func metadataAdditionalData(blockID int32, flags uint32) []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint32(ad[0:], uint32(blockID))
+	binary.LittleEndian.PutUint32(ad[4:], flags)
+	return ad[:]
+}
+
+// sealMetadata encrypts the metadata records of numFiles files of a block
+func sealMetadata(key []byte, blockID int32, flags uint32, numFiles int, records []byte) ([]byte, error) {
+	aead, err := metadataCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	plain := binary.LittleEndian.AppendUint32(nil, uint32(numFiles))
+	plain = append(plain, records...)
+	return aead.Seal(nonce, nonce, plain, metadataAdditionalData(blockID, flags)), nil
+}
+
+// openMetadata decrypts the metadata section of a block read from r, returning
+// the number of files and a reader of their metadata records
+func (p defaultPacker) openMetadata(r io.Reader, blockID int32, footer *BlockFooter) (int32, io.Reader, error) {
+	key, err := p.metadataReadKey(footer)
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := metadataCipher(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading metadata: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return 0, nil, fmt.Errorf("encrypted metadata too short: %w", ErrBlockTruncated)
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(sealed[:0], nonce, sealed, metadataAdditionalData(blockID, footer.Flags))
+	if err != nil || len(plain) < 4 {
+		return 0, nil, ErrMetadataKey
+	}
+	numFiles := int32(binary.LittleEndian.Uint32(plain))
+	if numFiles < 0 {
+		return 0, nil, fmt.Errorf("invalid number of files in block %d: %w", numFiles, ErrCorrupted)
+	}
+	return numFiles, bytes.NewReader(plain[4:]), nil
+}
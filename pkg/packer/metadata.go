@@ -0,0 +1,452 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limits applied when decoding metadata, generous compared to what any
+// filesystem allows but small enough to bound allocations
+const (
+	maxPathLength       = 64 * 1024
+	maxXattrs           = 64 * 1024
+	maxXattrNameLength  = 64 * 1024
+	maxXattrValueLength = 16 * 1024 * 1024
+
+	// maxXattrsHint caps the extended attributes allocated for before they are read
+	maxXattrsHint = 64
+)
+
+// FileMetadata describes an archived file and where its contents are stored
+type FileMetadata struct {
+	Path           string            // Original path
+	Size           int64             // File size in bytes
+	ModTime        time.Time         // Last modification time
+	Checksum       []byte            // SHA-256 checksum of the file
+	Offset         int64             // Offset within the block
+	BlockID        int32             // ID of the block containing the file
+	Mode           uint32            // File permissions
+	Uid            uint32            // Numeric owner, only set when ownership is preserved
+	Gid            uint32            // Numeric group, only set when ownership is preserved
+	Xattrs         map[string][]byte // Extended attributes such as POSIX ACLs
+	BirthTime      time.Time         // Creation time, zero if unknown or not preserved
+	Attributes     uint32            // Windows file attributes, AttributeHidden and AttributeSystem, zero elsewhere
+	Holes          []Extent          // Zero filled regions of a sparse file, left unallocated when extracting
+	ZeroRuns       []Extent          // Runs of zeros left out of the data section, Offset is relative to the file
+	Compression    Compression       // How the contents are compressed in the data section
+	CompressedSize int64             // Bytes stored in the data section for compressed contents
+	Device         uint64            // Device number of a character or block device node, zero for other files
+	Tags           map[string]string // User defined tags from the manifest, see TagRule, never stored in the blocks
+
+	sourcePath  string // Path the contents are read from while packing, when it differs from Path
+	transformed bool   // Contents pass through Transform while packing, the size is the size on disk until then
+}
+
+// source returns the path the contents of the file are read from while packing
+func (m *FileMetadata) source() string {
+	if m.sourcePath != "" {
+		return m.sourcePath
+	}
+	return m.Path
+}
+
+// FileInfo represents information about a file that is being processed
+type FileInfo struct {
+	Path        string
+	ArchivePath string
+	Size        int64
+	ModTime     time.Time
+	Mode        uint32
+	Uid         uint32
+	Gid         uint32
+	BirthTime   time.Time
+	Attributes  uint32
+	Holes       []Extent
+	Device      uint64
+	IsDir       bool
+}
+
+// Windows file attributes recorded in FileMetadata.Attributes, with the values
+// Windows uses for them. The read-only attribute is recorded in the mode as a
+// missing owner write permission
+const (
+	AttributeHidden uint32 = 0x2 // Hidden from directory listings
+	AttributeSystem uint32 = 0x4 // Used by the operating system
+)
+
+// slashPath returns an archived path with forward slashes. Archives written on
+// Windows by older versions stored paths with backslashes
+func slashPath(archivedPath string) string {
+	return strings.ReplaceAll(archivedPath, `\`, "/")
+}
+
+// writeMetadata writes a file metadata record holding the optional fields the
+// footer flags of its block announce. prev is the record written before it,
+// which compact records are encoded relative to
+func (p *defaultPacker) writeMetadata(w io.Writer, metadata *FileMetadata, prev *FileMetadata, flags uint32) error {
+	if flags&footerFlagCBORMetadata != 0 {
+		return writeCBORMetadata(w, metadata)
+	}
+	if flags&footerFlagCompactMetadata != 0 {
+		return writeCompactMetadata(w, metadata, prev, flags)
+	}
+
+	pathBytes := []byte(metadata.Path)
+	if err := binary.Write(w, binary.LittleEndian, int32(len(pathBytes))); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(pathBytes); err != nil {
+		return err
+	}
+
+	// Write Size
+	if err := binary.Write(w, binary.LittleEndian, metadata.Size); err != nil {
+		return err
+	}
+
+	// Write ModTime
+	if err := binary.Write(w, binary.LittleEndian, metadata.ModTime.Unix()); err != nil {
+		return err
+	}
+
+	// Write Offset
+	if err := binary.Write(w, binary.LittleEndian, metadata.Offset); err != nil {
+		return err
+	}
+
+	// Write Mode
+	if err := binary.Write(w, binary.LittleEndian, metadata.Mode); err != nil {
+		return err
+	}
+
+	// Write owner and group
+	if err := binary.Write(w, binary.LittleEndian, metadata.Uid); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, metadata.Gid); err != nil {
+		return err
+	}
+
+	// Write Checksum
+	if _, err := w.Write(metadata.Checksum); err != nil {
+		return err
+	}
+
+	// Write extended attributes sorted by name so blocks are reproducible
+	names := make([]string, 0, len(metadata.Xattrs))
+	for name := range metadata.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := binary.Write(w, binary.LittleEndian, int32(len(names))); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := writeBytes(w, []byte(name)); err != nil {
+			return err
+		}
+		if err := writeBytes(w, metadata.Xattrs[name]); err != nil {
+			return err
+		}
+	}
+
+	// Write birth time, zero when unknown
+	if flags&footerFlagBirthTime != 0 {
+		var birthSec int64
+		var birthNsec int32
+		if !metadata.BirthTime.IsZero() {
+			birthSec = metadata.BirthTime.Unix()
+			birthNsec = int32(metadata.BirthTime.Nanosecond())
+		}
+		if err := binary.Write(w, binary.LittleEndian, birthSec); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, birthNsec); err != nil {
+			return err
+		}
+	}
+
+	// Write Windows file attributes
+	if flags&footerFlagAttributes != 0 {
+		if err := binary.Write(w, binary.LittleEndian, metadata.Attributes); err != nil {
+			return err
+		}
+	}
+
+	// Write the holes of sparse files and the zero runs left out
+	if flags&footerFlagHoles != 0 {
+		if err := writeExtents(w, metadata.Holes); err != nil {
+			return err
+		}
+	}
+	if flags&footerFlagZeroRuns != 0 {
+		if err := writeExtents(w, metadata.ZeroRuns); err != nil {
+			return err
+		}
+	}
+
+	// Write the compression method and the compressed size
+	if flags&footerFlagCompression != 0 {
+		if err := binary.Write(w, binary.LittleEndian, metadata.Compression); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, metadata.CompressedSize); err != nil {
+			return err
+		}
+	}
+
+	// Write the device number of device nodes
+	if flags&footerFlagDevices != 0 {
+		if err := binary.Write(w, binary.LittleEndian, metadata.Device); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readMetadata reads a file metadata record. The block's footer flags tell
+// which optional fields the record holds and whether it is compact, relative
+// to prev, the record read before it
+func (p *defaultPacker) readMetadata(r io.Reader, prev *FileMetadata, flags uint32) (*FileMetadata, error) {
+	if flags&footerFlagCBORMetadata != 0 {
+		return readCBORMetadata(r)
+	}
+	if flags&footerFlagCompactMetadata != 0 {
+		return readCompactMetadata(asMetadataReader(r), prev, flags)
+	}
+
+	// Get Path
+	pathBytes, err := readBytes(r, maxPathLength)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(0)
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+
+	var modTime int64
+	if err := binary.Read(r, binary.LittleEndian, &modTime); err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
+		return nil, err
+	}
+
+	var mode uint32
+	if err := binary.Read(r, binary.LittleEndian, &mode); err != nil {
+		return nil, err
+	}
+
+	var uid, gid uint32
+	if err := binary.Read(r, binary.LittleEndian, &uid); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &gid); err != nil {
+		return nil, err
+	}
+
+	checksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, checksum); err != nil {
+		return nil, err
+	}
+
+	var numXattrs int32
+	if err := binary.Read(r, binary.LittleEndian, &numXattrs); err != nil {
+		return nil, err
+	}
+	if numXattrs < 0 || numXattrs > maxXattrs {
+		return nil, fmt.Errorf("invalid extended attribute count %d: %w", numXattrs, ErrCorrupted)
+	}
+
+	var xattrs map[string][]byte
+	if numXattrs > 0 {
+		xattrs = make(map[string][]byte, min(numXattrs, maxXattrsHint))
+	}
+	for i := int32(0); i < numXattrs; i++ {
+		name, err := readBytes(r, maxXattrNameLength)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readBytes(r, maxXattrValueLength)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value
+	}
+
+	var birthTime time.Time
+	if flags&footerFlagBirthTime != 0 {
+		var birthSec int64
+		var birthNsec int32
+		if err := binary.Read(r, binary.LittleEndian, &birthSec); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &birthNsec); err != nil {
+			return nil, err
+		}
+		if birthNsec < 0 || birthNsec >= 1e9 {
+			return nil, fmt.Errorf("invalid birth time: %w", ErrCorrupted)
+		}
+		if birthSec != 0 || birthNsec != 0 {
+			birthTime = time.Unix(birthSec, int64(birthNsec))
+		}
+	}
+
+	var attributes uint32
+	if flags&footerFlagAttributes != 0 {
+		if err := binary.Read(r, binary.LittleEndian, &attributes); err != nil {
+			return nil, err
+		}
+	}
+
+	var holes, zeroRuns []Extent
+	if flags&footerFlagHoles != 0 {
+		if holes, err = readExtents(r, size); err != nil {
+			return nil, err
+		}
+	}
+	if flags&footerFlagZeroRuns != 0 {
+		if zeroRuns, err = readExtents(r, size); err != nil {
+			return nil, err
+		}
+	}
+
+	var compression Compression
+	var compressedSize int64
+	if flags&footerFlagCompression != 0 {
+		if err := binary.Read(r, binary.LittleEndian, &compression); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &compressedSize); err != nil {
+			return nil, err
+		}
+	}
+
+	var device uint64
+	if flags&footerFlagDevices != 0 {
+		if err := binary.Read(r, binary.LittleEndian, &device); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := &FileMetadata{
+		Path:           slashPath(string(pathBytes)),
+		Size:           size,
+		ModTime:        time.Unix(modTime, 0),
+		Offset:         offset,
+		Mode:           mode,
+		Uid:            uid,
+		Gid:            gid,
+		Checksum:       checksum,
+		Xattrs:         xattrs,
+		BirthTime:      birthTime,
+		Attributes:     attributes,
+		Holes:          holes,
+		ZeroRuns:       zeroRuns,
+		Compression:    compression,
+		CompressedSize: compressedSize,
+		Device:         device,
+	}
+	if err := checkCompressedFile(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// writeExtents writes a count prefixed list of extents
+func writeExtents(w io.Writer, extents []Extent) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(len(extents))); err != nil {
+		return err
+	}
+	for _, extent := range extents {
+		if err := binary.Write(w, binary.LittleEndian, extent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExtents reads a count prefixed list of extents of a file of the given
+// size, rejecting lists that are not sorted or extend past the file
+func readExtents(r io.Reader, size int64) ([]Extent, error) {
+	var count int32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count < 0 || count > maxExtents {
+		return nil, fmt.Errorf("invalid extent count %d: %w", count, ErrCorrupted)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	raw, err := readFull(r, int64(count)*int64(binary.Size(Extent{})))
+	if err != nil {
+		return nil, err
+	}
+	extents := make([]Extent, count)
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, extents); err != nil {
+		return nil, err
+	}
+	if err := checkExtents(extents, size); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// writeBytes writes a length prefixed byte slice
+func writeBytes(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readBytes reads a length prefixed byte slice, rejecting lengths above
+// maxLength so corrupt or malicious blocks cannot force huge allocations
+func readBytes(r io.Reader, maxLength int32) ([]byte, error) {
+	var length int32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 0 || length > maxLength {
+		return nil, fmt.Errorf("invalid length %d: %w", length, ErrCorrupted)
+	}
+	return readFull(r, int64(length))
+}
+
+// readChunkSize is the most readFull allocates before the bytes arrive
+const readChunkSize = 64 * 1024
+
+// readFull reads length bytes. Long slices grow as the bytes are read, so a
+// length decoded from a truncated block cannot allocate more than it holds
+func readFull(r io.Reader, length int64) ([]byte, error) {
+	if length <= readChunkSize {
+		b := make([]byte, length)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,120 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// maxAllocPerByte bounds what decoding may allocate for every byte of input.
+// A compact record repeats a path of up to maxPathLength shared with the
+// record before it for little more than its checksum
+const maxAllocPerByte = maxPathLength / sha256.Size
+
+// checkAllocations fails the test when decode allocates more than n bytes of
+// input can account for, above a fixed allowance
+func checkAllocations(t *testing.T, n int, decode func()) {
+	t.Helper()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	decode()
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20+uint64(n)*maxAllocPerByte {
+		t.Fatalf("decoding %d bytes allocated %d bytes", n, allocated)
+	}
+}
+
+// vectorBlocks returns the contents of the blocks of the golden vectors
+func vectorBlocks(t testing.TB) [][]byte {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(vectorsDir, "*", "archive", "*.beam"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no blocks in %s", vectorsDir)
+	}
+	blocks := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, data)
+	}
+	return blocks
+}
+
+// metadataSection is the file metadata section of a block with the number of
+// records it holds and the footer flags telling how they are encoded
+type metadataSection struct {
+	data     []byte
+	numFiles int32
+	flags    uint32
+}
+
+// vectorMetadataSections returns the metadata sections of the unencrypted
+// blocks of the golden vectors
+func vectorMetadataSections(t testing.TB) []metadataSection {
+	t.Helper()
+	var sections []metadataSection
+	for _, data := range vectorBlocks(t) {
+		r := bytes.NewReader(data)
+		footer, err := readBlockFooter(r, r.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if footer.Flags&footerFlagEncrypted != 0 {
+			continue
+		}
+		block, err := (defaultPacker{}).readBlockIndexAt(r, r.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		section := data[blockHeaderSize:block.DataOffset]
+		if footer.Flags&footerFlagTrailingMetadata != 0 {
+			section = data[footer.MetadataOffset : r.Size()-footer.Length]
+		}
+		sections = append(sections, metadataSection{section, int32(len(block.Files)), footer.Flags})
+	}
+	return sections
+}
+
+// readSection reads the records of a metadata section the way blocks are read
+func readSection(section metadataSection) (*Block, error) {
+	block := &Block{}
+	err := defaultPacker{}.readMetadataSection(bytes.NewReader(section.data), block, section.numFiles, section.flags)
+	return block, err
+}
+
+func TestReadMetadataTruncated(t *testing.T) {
+	for _, section := range vectorMetadataSections(t) {
+		if _, err := readSection(section); err != nil {
+			t.Fatalf("reading a golden metadata section: %v", err)
+		}
+		step := max(len(section.data)/64, 1)
+		for n := 0; n < len(section.data); n += step {
+			truncated := metadataSection{section.data[:n], section.numFiles, section.flags}
+			if _, err := readSection(truncated); err == nil {
+				t.Errorf("metadata section with flags %#x cut to %d of %d bytes was read without error", section.flags, n, len(section.data))
+			}
+		}
+	}
+}
+
+func FuzzReadMetadata(f *testing.F) {
+	for _, section := range vectorMetadataSections(f) {
+		f.Add(section.data, section.numFiles, section.flags)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, numFiles int32, flags uint32) {
+		if flags&^knownFooterFlags != 0 {
+			return
+		}
+		checkAllocations(t, len(data), func() {
+			readSection(metadataSection{data, numFiles, flags})
+		})
+	})
+}
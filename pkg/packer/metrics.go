@@ -0,0 +1,26 @@
+package packer
+
+// Metrics receives counters and observations from pack and unpack operations
+// so services embedding the packer can export them to a monitoring system
+// such as Prometheus. The op of every call is "pack" or "unpack". Methods are
+// called from the goroutines doing the work and must be safe for concurrent
+// use
+type Metrics interface {
+	// AddBytes counts bytes of file contents packed or extracted
+	AddBytes(op string, n int64)
+
+	// AddFiles counts files packed or extracted
+	AddFiles(op string, n int)
+
+	// AddBlocks counts blocks written when packing and read when unpacking
+	AddBlocks(op string, n int)
+
+	// AddErrors counts operations that failed once under way, after their files
+	// were planned, and files skipped with ContinueOnError
+	AddErrors(op string, n int)
+
+	// ObserveBlockFill records how full a written block is, the bytes of data it
+	// holds over the block size. Blocks other than the last of a pack being far
+	// from full suggests a smaller block size or files too large to share blocks
+	ObserveBlockFill(ratio float64)
+}
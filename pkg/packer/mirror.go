@@ -0,0 +1,372 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// Replica is one of the stores a MirrorStore keeps a copy of every block in
+type Replica struct {
+	Name  string     // Name the replica is recorded under in the manifest, such as its location
+	Store BlockStore // Store holding the copy
+}
+
+// MirrorStore is a BlockStore keeping a copy of every block in each of its
+// replicas, such as a local directory and an S3 bucket or two buckets. Blocks
+// are written to all replicas at once as they are read, and a Put succeeds
+// when at least MinReplicas of them stored the block. The replicas holding
+// each block are recorded in the manifest by PackToStore and Sync, and
+// RepairReplicas copies blocks to the replicas missing them. Gets are served
+// by the first replica that holds the block
+type MirrorStore struct {
+	replicas    []Replica
+	minReplicas int
+
+	mu     sync.Mutex
+	stored map[string][]string // Names of the replicas the last Put of each block succeeded on
+}
+
+// NewMirrorStore returns a MirrorStore writing to the replicas, each with a
+// distinct name. A Put fails when fewer than minReplicas replicas stored the
+// block, 0 requires one
+func NewMirrorStore(minReplicas int, replicas ...Replica) (*MirrorStore, error) {
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("mirror store without replicas: %w", ErrInvalidOption)
+	}
+	if minReplicas <= 0 {
+		minReplicas = 1
+	}
+	if minReplicas > len(replicas) {
+		return nil, fmt.Errorf("mirror store requires %d replicas and has %d: %w", minReplicas, len(replicas), ErrInvalidOption)
+	}
+	names := make(map[string]bool, len(replicas))
+	for _, replica := range replicas {
+		if replica.Name == "" || names[replica.Name] {
+			return nil, fmt.Errorf("mirror store replica name %q is empty or repeated: %w", replica.Name, ErrInvalidOption)
+		}
+		names[replica.Name] = true
+	}
+	return &MirrorStore{
+		replicas:    append([]Replica(nil), replicas...),
+		minReplicas: minReplicas,
+		stored:      make(map[string][]string),
+	}, nil
+}
+
+// Replicas returns the replicas of the store
+func (s *MirrorStore) Replicas() []Replica {
+	return append([]Replica(nil), s.replicas...)
+}
+
+func (s *MirrorStore) Put(name string, r io.Reader, size int64) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+
+	// Every replica reads its own pipe, a replica failing only closes its own
+	writers := make([]*io.PipeWriter, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range s.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = replica.Store.Put(name, pr, size)
+			pr.Close()
+		}()
+	}
+	buf := make([]byte, 256<<10)
+	failing := make([]bool, len(writers))
+	var readErr error
+	for {
+		n, err := r.Read(buf)
+		for i, w := range writers {
+			if n > 0 && !failing[i] {
+				_, werr := w.Write(buf[:n])
+				failing[i] = werr != nil
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	for _, w := range writers {
+		w.CloseWithError(readErr)
+	}
+	wg.Wait()
+	if readErr != nil {
+		return fmt.Errorf("error reading block %s: %w", name, readErr)
+	}
+
+	var stored []string
+	var failed []error
+	for i, replica := range s.replicas {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("replica %s: %w", replica.Name, errs[i]))
+			continue
+		}
+		stored = append(stored, replica.Name)
+	}
+	s.mu.Lock()
+	s.stored[name] = stored
+	s.mu.Unlock()
+	if len(stored) < s.minReplicas {
+		return fmt.Errorf("block %s stored on %d of %d required replicas: %w", name, len(stored), s.minReplicas, errors.Join(failed...))
+	}
+	return nil
+}
+
+func (s *MirrorStore) Get(name string) (io.ReadCloser, error) {
+	var failed []error
+	for _, replica := range s.replicas {
+		rc, err := replica.Store.Get(name)
+		if err == nil {
+			return rc, nil
+		}
+		failed = append(failed, fmt.Errorf("replica %s: %w", replica.Name, err))
+	}
+	return nil, errors.Join(failed...)
+}
+
+// List returns the names of the blocks held by any replica, so blocks some
+// replicas lack can still be read from the others
+func (s *MirrorStore) List() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, replica := range s.replicas {
+		names, err := replica.Store.List()
+		if err != nil {
+			return nil, fmt.Errorf("replica %s: %w", replica.Name, err)
+		}
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete removes the block from every replica holding it
+func (s *MirrorStore) Delete(name string) error {
+	var failed []error
+	for _, replica := range s.replicas {
+		if err := replica.Store.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			failed = append(failed, fmt.Errorf("replica %s: %w", replica.Name, err))
+		}
+	}
+	s.mu.Lock()
+	delete(s.stored, name)
+	s.mu.Unlock()
+	return errors.Join(failed...)
+}
+
+// storedOn returns the names of the replicas the last Put of each named file
+// succeeded on, nil when the store is not a MirrorStore
+func storedOn(store BlockStore, names []string) []string {
+	s, ok := store.(*MirrorStore)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stored []string
+	for _, replica := range s.replicas {
+		held := true
+		for _, name := range names {
+			held = held && containsString(s.stored[name], replica.Name)
+		}
+		if held {
+			stored = append(stored, replica.Name)
+		}
+	}
+	return stored
+}
+
+// replicatedEverywhere reports whether the manifest of a store records a
+// block as held by every replica, always true for stores that are not a
+// MirrorStore
+func replicatedEverywhere(store BlockStore, block ManifestBlock) bool {
+	s, ok := store.(*MirrorStore)
+	if !ok {
+		return true
+	}
+	for _, replica := range s.replicas {
+		if !containsString(block.Replicas, replica.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString reports whether a slice holds a string
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// files returns the files a block is stored as, its volumes when it is split
+// into some
+func (b ManifestBlock) files() []ManifestVolume {
+	if len(b.Volumes) > 0 {
+		return b.Volumes
+	}
+	return []ManifestVolume{{Name: b.Name, Size: b.Size}}
+}
+
+// ReplicaCopy is a block file RepairReplicas copied to a replica missing it
+type ReplicaCopy struct {
+	Name    string // File name of the block or volume
+	Replica string // Name of the replica it was copied to
+	Size    int64  // Size of the file in bytes
+}
+
+// ReplicaRepairResult reports how RepairReplicas brought the replicas of a
+// MirrorStore back in line
+type ReplicaRepairResult struct {
+	Copied      []ReplicaCopy // Block files copied to the replicas missing them
+	CopiedBytes int64         // Combined size of the copies
+	Lost        []string      // Blocks no replica holds whole, which cannot be copied
+	Complete    int           // Blocks every replica already held
+}
+
+// RepairReplicas copies the blocks listed in the manifest of a MirrorStore
+// to every replica missing them, reading each from a replica that holds it,
+// and records in the manifest, put to every replica, which replicas hold each
+// block. What each replica holds is taken from its own listing, not the
+// manifest, so blocks deleted from a replica behind its back are found too.
+// Blocks no replica holds are listed in the result, which is returned along
+// with an error
+func (p defaultPacker) RepairReplicas(store *MirrorStore) (*ReplicaRepairResult, error) {
+	held := make(map[string]map[string]bool, len(store.replicas))
+	for _, replica := range store.replicas {
+		names, err := replica.Store.List()
+		if err != nil {
+			return nil, fmt.Errorf("error listing replica %s: %w", replica.Name, err)
+		}
+		held[replica.Name] = make(map[string]bool, len(names))
+		for _, name := range names {
+			held[replica.Name][name] = true
+		}
+	}
+	m, err := getManifest(store)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReplicaRepairResult{}
+	for i := range m.Blocks {
+		block := &m.Blocks[i]
+		files := block.files()
+		var sources, missing []Replica
+		for _, replica := range store.replicas {
+			whole := true
+			for _, file := range files {
+				whole = whole && held[replica.Name][file.Name]
+			}
+			if whole {
+				sources = append(sources, replica)
+			} else {
+				missing = append(missing, replica)
+			}
+		}
+		if len(sources) == 0 {
+			result.Lost = append(result.Lost, block.Name)
+			block.Replicas = nil
+			continue
+		}
+		if len(missing) == 0 {
+			result.Complete++
+		}
+		for _, replica := range missing {
+			copied, err := copyReplica(sources, replica, files, held[replica.Name])
+			if err != nil {
+				p.logger().Warn("Block not copied to replica", "block", block.Name, "replica", replica.Name, "error", err)
+				continue
+			}
+			for _, c := range copied {
+				result.Copied = append(result.Copied, c)
+				result.CopiedBytes += c.Size
+			}
+			sources = append(sources, replica)
+		}
+		block.Replicas = nil
+		for _, replica := range store.replicas {
+			if containsReplica(sources, replica.Name) {
+				block.Replicas = append(block.Replicas, replica.Name)
+			}
+		}
+	}
+	if err := putManifest(store, m); err != nil {
+		return nil, err
+	}
+
+	p.logger().Info("Repaired replicas", "files_copied", len(result.Copied), "bytes_copied", result.CopiedBytes,
+		"blocks_lost", len(result.Lost), "blocks_complete", result.Complete)
+	if len(result.Lost) > 0 {
+		return result, fmt.Errorf("%d blocks are missing from every replica: %w", len(result.Lost), ErrCorrupted)
+	}
+	return result, nil
+}
+
+// copyReplica copies the files of a block the target replica lacks from the
+// first source replica that can provide each of them
+func copyReplica(sources []Replica, target Replica, files []ManifestVolume, held map[string]bool) ([]ReplicaCopy, error) {
+	var copied []ReplicaCopy
+	for _, file := range files {
+		if held[file.Name] {
+			continue
+		}
+		var failed []error
+		for _, source := range sources {
+			err := copyStoreFile(source.Store, target.Store, file)
+			if err == nil {
+				failed = nil
+				break
+			}
+			failed = append(failed, fmt.Errorf("from replica %s: %w", source.Name, err))
+		}
+		if len(failed) > 0 {
+			return copied, errors.Join(failed...)
+		}
+		held[file.Name] = true
+		copied = append(copied, ReplicaCopy{Name: file.Name, Replica: target.Name, Size: file.Size})
+	}
+	return copied, nil
+}
+
+// copyStoreFile copies a block file from one store to another
+func copyStoreFile(from BlockStore, to BlockStore, file ManifestVolume) error {
+	rc, err := from.Get(file.Name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return to.Put(file.Name, rc, file.Size)
+}
+
+// containsReplica reports whether a replica of the name is in a slice
+func containsReplica(replicas []Replica, name string) bool {
+	for _, replica := range replicas {
+		if replica.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package packer
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapBlock is not supported on this platform, blocks are read with regular reads
+func mmapBlock(f *os.File) (blockReader, error) {
+	return nil, errors.New("mmap not supported")
+}
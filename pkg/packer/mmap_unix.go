@@ -0,0 +1,44 @@
+//go:build unix
+
+package packer
+
+import (
+	"errors"
+	"math"
+	"os"
+	"syscall"
+)
+
+// mmapBlockReader reads a block file mapped into memory. Sections are served
+// straight from the mapping, so file contents are copied once into the output
+// file instead of passing through an intermediate read buffer
+type mmapBlockReader struct {
+	memBlockReader
+}
+
+// mmapBlock maps a block file into memory read only
+func mmapBlock(f *os.File) (blockReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size <= 0 || size > math.MaxInt {
+		return nil, errors.New("block file size cannot be mapped")
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapBlockReader{memBlockReader{data: data}}, nil
+}
+
+func (r *mmapBlockReader) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(r.data)
+	r.data = nil
+	return err
+}
@@ -0,0 +1,152 @@
+package packer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// blockExt is the extension every block file name ends with
+const blockExt = ".beam"
+
+// BlockNamer chooses the file names of the blocks a Packer writes, so the
+// archive can follow the naming conventions of the system it belongs to.
+// Block IDs inside the blocks stay sequential whatever the file names are
+type BlockNamer interface {
+	// BlockName returns the name of a block file without the .beam extension,
+	// given the block ID and the checksum stored in its footer
+	BlockName(id int32, checksum []byte) string
+}
+
+// BlockNamerFunc adapts a function to the BlockNamer interface
+type BlockNamerFunc func(id int32, checksum []byte) string
+
+func (f BlockNamerFunc) BlockName(id int32, checksum []byte) string {
+	return f(id, checksum)
+}
+
+// SequenceNamer names blocks by their ID after a prefix, zero padded to Width
+// digits. The zero value produces the default names block-1, block-2, ...
+type SequenceNamer struct {
+	Prefix string // Text before the block ID, "block-" when empty
+	Width  int    // Minimum number of digits of the block ID
+}
+
+func (n SequenceNamer) BlockName(id int32, checksum []byte) string {
+	prefix := n.Prefix
+	if prefix == "" {
+		prefix = "block-"
+	}
+	return fmt.Sprintf("%s%0*d", prefix, n.Width, id)
+}
+
+// ContentHashNamer names blocks by the hex encoded checksum of their contents,
+// so identical blocks always get the same name
+type ContentHashNamer struct {
+	Prefix string // Text before the checksum
+}
+
+func (n ContentHashNamer) BlockName(id int32, checksum []byte) string {
+	return n.Prefix + hex.EncodeToString(checksum)
+}
+
+// TimestampNamer names blocks by a timestamp followed by the block ID
+type TimestampNamer struct {
+	Prefix string    // Text before the timestamp
+	Time   time.Time // Timestamp shared by all blocks, the current time of each block when zero
+}
+
+func (n TimestampNamer) BlockName(id int32, checksum []byte) string {
+	t := n.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return fmt.Sprintf("%s%s-%d", n.Prefix, t.UTC().Format("20060102T150405Z"), id)
+}
+
+// ULIDNamer names blocks with a new ULID each, which sort by creation time
+type ULIDNamer struct {
+	Prefix string // Text before the ULID
+}
+
+func (n ULIDNamer) BlockName(id int32, checksum []byte) string {
+	return n.Prefix + newULID(time.Now())
+}
+
+// crockford is the base32 alphabet used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits of millisecond timestamp followed by 80
+// random bits, encoded as 26 characters of Crockford base32
+func newULID(t time.Time) string {
+	var id [16]byte
+	ms := uint64(t.UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	rand.Read(id[6:])
+
+	// 128 bits are encoded as 26 groups of 5 bits, the first group holds 3
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// blockName returns the file name of a block written by the packer
+func (p defaultPacker) blockName(id int32, checksum []byte) (string, error) {
+	namer := p.opts.BlockNamer
+	if namer == nil {
+		namer = SequenceNamer{}
+	}
+	name := namer.BlockName(id, checksum)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid block name %q for block %d: %w", name, id, ErrInvalidOption)
+	}
+	return name + p.volumeExt(), nil
+}
+
+// blockFiles maps the ID of every block in an archive directory to its path.
+// Blocks are found by the ID in their header, whatever their file names
+func blockFiles(archiveDir string) (map[int32]string, error) {
+	paths, err := listBlocks(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int32]string, len(paths))
+	for _, path := range paths {
+		f, err := openBlockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var id int32
+		err = binary.Read(io.NewSectionReader(f, 0, f.Size()), binary.LittleEndian, &id)
+		f.Close()
+		if err != nil {
+			// Damaged blocks are left for the caller to find missing
+			continue
+		}
+		if _, ok := files[id]; !ok {
+			files[id] = path
+		}
+	}
+	return files, nil
+}
+
+// blockPath returns the path of the block with the given ID, falling back to
+// the default name when it is not among the known block files
+func blockPath(files map[int32]string, archiveDir string, id int32) string {
+	if path, ok := files[id]; ok {
+		return path
+	}
+	return filepath.Join(archiveDir, blockFileName(id))
+}
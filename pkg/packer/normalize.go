@@ -0,0 +1,165 @@
+package packer
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// PathNormalization selects the Unicode normalization form applied to
+// archived paths. macOS writes file names in decomposed form (NFD) while
+// Linux and Windows keep whatever bytes they are given and most tools produce
+// the composed form (NFC), so the same name can be spelled in two ways
+type PathNormalization int
+
+const (
+	PathNormalizationNone PathNormalization = iota // Keep paths exactly as they are, the default
+	PathNormalizationNFC                           // Composed form, as Linux and Windows tools usually write names
+	PathNormalizationNFD                           // Decomposed form, as macOS writes names
+)
+
+// checkNormalization rejects normalization forms this version does not know
+func (p defaultPacker) checkNormalization() error {
+	switch p.opts.PathNormalization {
+	case PathNormalizationNone, PathNormalizationNFC, PathNormalizationNFD:
+		return nil
+	}
+	return fmt.Errorf("unknown path normalization %d: %w", p.opts.PathNormalization, ErrInvalidOption)
+}
+
+// normalize returns a path in the normalization form n
+func (n PathNormalization) normalize(path string) string {
+	switch n {
+	case PathNormalizationNFC:
+		return nfc(path)
+	case PathNormalizationNFD:
+		return nfd(path)
+	}
+	return path
+}
+
+//go:generate go run gen_normtables.go
+
+// Hangul syllables are composed and decomposed algorithmically
+const (
+	hangulBase   = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// isASCII reports whether s holds only ASCII, which every form leaves alone
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// nfd returns s in Unicode normalization form D: every rune fully decomposed
+// and combining marks in canonical order. Invalid UTF-8 is returned unchanged
+func nfd(s string) string {
+	if isASCII(s) || !utf8.ValidString(s) {
+		return s
+	}
+	return string(decompose(s))
+}
+
+// decompose returns the canonical decomposition of s in canonical order
+func decompose(s string) []rune {
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= hangulBase && r < hangulBase+hangulSCount:
+			index := r - hangulBase
+			runes = append(runes, hangulLBase+index/hangulNCount, hangulVBase+index%hangulNCount/hangulTCount)
+			if t := index % hangulTCount; t != 0 {
+				runes = append(runes, hangulTBase+t)
+			}
+		case canonicalDecompositions[r] != "":
+			runes = append(runes, []rune(canonicalDecompositions[r])...)
+		default:
+			runes = append(runes, r)
+		}
+	}
+
+	// Sort every run of combining marks by combining class, keeping the order
+	// of marks of the same class
+	for start := 0; start < len(runes); start++ {
+		if combiningClasses[runes[start]] == 0 {
+			continue
+		}
+		end := start
+		for end < len(runes) && combiningClasses[runes[end]] != 0 {
+			end++
+		}
+		marks := runes[start:end]
+		sort.SliceStable(marks, func(i, j int) bool {
+			return combiningClasses[marks[i]] < combiningClasses[marks[j]]
+		})
+		start = end
+	}
+	return runes
+}
+
+// nfc returns s in Unicode normalization form C: canonically decomposed, then
+// recomposed wherever a primary composite exists. Invalid UTF-8 is returned
+// unchanged
+func nfc(s string) string {
+	if isASCII(s) || !utf8.ValidString(s) {
+		return s
+	}
+	runes := decompose(s)
+	if len(runes) == 0 {
+		return s
+	}
+
+	composed := runes[:1]
+	starter := 0 // Index in composed of the last starter, -1 when there is none
+	if combiningClasses[runes[0]] != 0 {
+		starter = -1
+	}
+	var lastClass uint8 // Combining class of the last rune appended after the starter
+	for _, r := range runes[1:] {
+		class := combiningClasses[r]
+		if starter >= 0 {
+			// A rune combines with the starter unless a rune of the same or a
+			// higher class sits between them
+			blocked := len(composed)-1 > starter && (lastClass == 0 || lastClass >= class)
+			if !blocked {
+				if c, ok := compose(composed[starter], r); ok {
+					composed[starter] = c
+					continue
+				}
+			}
+		}
+		if class == 0 {
+			starter = len(composed)
+		}
+		lastClass = class
+		composed = append(composed, r)
+	}
+	return string(composed)
+}
+
+// compose returns the primary composite of a pair of runes
+func compose(a rune, b rune) (rune, bool) {
+	// Hangul leading and vowel jamo form an LV syllable, which takes a
+	// trailing jamo to form an LVT syllable
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulBase + ((a-hangulLBase)*hangulVCount+b-hangulVBase)*hangulTCount, true
+	}
+	if a >= hangulBase && a < hangulBase+hangulSCount && (a-hangulBase)%hangulTCount == 0 &&
+		b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + b - hangulTBase, true
+	}
+	c, ok := canonicalCompositions[[2]rune{a, b}]
+	return c, ok
+}
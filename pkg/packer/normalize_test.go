@@ -0,0 +1,113 @@
+package packer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestNormalizationForms(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		nfc  string
+		nfd  string
+	}{
+		{"ascii", "docs/readme.txt", "docs/readme.txt", "docs/readme.txt"},
+		{"composed", "caf\u00e9", "caf\u00e9", "cafe\u0301"},
+		{"decomposed", "cafe\u0301", "caf\u00e9", "cafe\u0301"},
+		{"hangul LV", "\uac00", "\uac00", "\u1100\u1161"},
+		{"hangul LV jamo", "\u1100\u1161", "\uac00", "\u1100\u1161"},
+		{"hangul LVT", "\uac01", "\uac01", "\u1100\u1161\u11a8"},
+		{"hangul LVT jamo", "\u1100\u1161\u11a8", "\uac01", "\u1100\u1161\u11a8"},
+		{"hangul LV and T", "\uac00\u11a8", "\uac01", "\u1100\u1161\u11a8"},
+		{"mark reordering", "a\u0301\u0323", "\u1ea1\u0301", "a\u0323\u0301"},
+		{"blocked by same class", "a\u0305\u0301", "a\u0305\u0301", "a\u0305\u0301"},
+		{"second mark of a class", "e\u0301\u0301", "\u00e9\u0301", "e\u0301\u0301"},
+		{"composition past a lower class", "\u00c5\u0327", "\u00c5\u0327", "A\u0327\u030a"},
+		{"recursive decomposition", "\u1e9b\u0323", "\u1e9b\u0323", "\u017f\u0323\u0307"},
+		{"composition exclusion", "\u0958", "\u0915\u093c", "\u0915\u093c"},
+		{"singleton", "\u212b", "\u00c5", "A\u030a"},
+		{"leading mark", "\u0301e", "\u0301e", "\u0301e"},
+		{"supplementary", "\U0001d15e", "\U0001d157\U0001d165", "\U0001d157\U0001d165"},
+		{"invalid UTF-8", "caf\xc3 e\u0301", "caf\xc3 e\u0301", "caf\xc3 e\u0301"},
+		{"empty", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nfc(tt.in); got != tt.nfc {
+				t.Errorf("nfc(%+q) = %+q, want %+q", tt.in, got, tt.nfc)
+			}
+			if got := nfd(tt.in); got != tt.nfd {
+				t.Errorf("nfd(%+q) = %+q, want %+q", tt.in, got, tt.nfd)
+			}
+		})
+	}
+}
+
+func TestPackDecomposedNamesAsNFC(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	archive := filepath.Join(t.TempDir(), "archive")
+	if err := os.MkdirAll(filepath.Join(src, "Ame\u0301lie"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"cafe\u0301.txt":         "coffee",
+		"Ame\u0301lie/notes.txt": "notes",
+		"\u1100\u1161\u11a8.txt": "hangul",
+		"plain.txt":              "ascii",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := PackerOptions{PathNormalization: PathNormalizationNFC}
+	p := NewPacker(opts)
+	if err := p.Pack(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := p.List(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, metadata := range listed {
+		rel, err := filepath.Rel(src, "/"+metadata.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	sort.Strings(paths)
+	want := []string{"Am\u00e9lie/notes.txt", "caf\u00e9.txt", "plain.txt", "\uac01.txt"}
+	sort.Strings(want)
+	if len(paths) != len(want) {
+		t.Fatalf("archived %q, want %q", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("archived %+q, want %+q", paths[i], want[i])
+		}
+	}
+
+	for _, form := range []PathNormalization{PathNormalizationNFC, PathNormalizationNFD} {
+		out := t.TempDir()
+		if err := NewPacker(PackerOptions{PathNormalization: form}).Unpack(archive, out); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range files {
+			path := filepath.Join(out, form.normalize(src), form.normalize(name))
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("form %d: %v", form, err)
+				continue
+			}
+			if string(got) != data {
+				t.Errorf("form %d: %s holds %q, want %q", form, path, got, data)
+			}
+		}
+	}
+}
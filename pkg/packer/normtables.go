@@ -0,0 +1,3932 @@
+// Code generated by gen_normtables.go from the Unicode Character Database 14.0.0. DO NOT EDIT.
+
+package packer
+
+// canonicalDecompositions maps runes to their full canonical decomposition.
+// Hangul syllables are decomposed algorithmically instead
+var canonicalDecompositions = map[rune]string{
+	0x00C0:  "\u0041\u0300",
+	0x00C1:  "\u0041\u0301",
+	0x00C2:  "\u0041\u0302",
+	0x00C3:  "\u0041\u0303",
+	0x00C4:  "\u0041\u0308",
+	0x00C5:  "\u0041\u030A",
+	0x00C7:  "\u0043\u0327",
+	0x00C8:  "\u0045\u0300",
+	0x00C9:  "\u0045\u0301",
+	0x00CA:  "\u0045\u0302",
+	0x00CB:  "\u0045\u0308",
+	0x00CC:  "\u0049\u0300",
+	0x00CD:  "\u0049\u0301",
+	0x00CE:  "\u0049\u0302",
+	0x00CF:  "\u0049\u0308",
+	0x00D1:  "\u004E\u0303",
+	0x00D2:  "\u004F\u0300",
+	0x00D3:  "\u004F\u0301",
+	0x00D4:  "\u004F\u0302",
+	0x00D5:  "\u004F\u0303",
+	0x00D6:  "\u004F\u0308",
+	0x00D9:  "\u0055\u0300",
+	0x00DA:  "\u0055\u0301",
+	0x00DB:  "\u0055\u0302",
+	0x00DC:  "\u0055\u0308",
+	0x00DD:  "\u0059\u0301",
+	0x00E0:  "\u0061\u0300",
+	0x00E1:  "\u0061\u0301",
+	0x00E2:  "\u0061\u0302",
+	0x00E3:  "\u0061\u0303",
+	0x00E4:  "\u0061\u0308",
+	0x00E5:  "\u0061\u030A",
+	0x00E7:  "\u0063\u0327",
+	0x00E8:  "\u0065\u0300",
+	0x00E9:  "\u0065\u0301",
+	0x00EA:  "\u0065\u0302",
+	0x00EB:  "\u0065\u0308",
+	0x00EC:  "\u0069\u0300",
+	0x00ED:  "\u0069\u0301",
+	0x00EE:  "\u0069\u0302",
+	0x00EF:  "\u0069\u0308",
+	0x00F1:  "\u006E\u0303",
+	0x00F2:  "\u006F\u0300",
+	0x00F3:  "\u006F\u0301",
+	0x00F4:  "\u006F\u0302",
+	0x00F5:  "\u006F\u0303",
+	0x00F6:  "\u006F\u0308",
+	0x00F9:  "\u0075\u0300",
+	0x00FA:  "\u0075\u0301",
+	0x00FB:  "\u0075\u0302",
+	0x00FC:  "\u0075\u0308",
+	0x00FD:  "\u0079\u0301",
+	0x00FF:  "\u0079\u0308",
+	0x0100:  "\u0041\u0304",
+	0x0101:  "\u0061\u0304",
+	0x0102:  "\u0041\u0306",
+	0x0103:  "\u0061\u0306",
+	0x0104:  "\u0041\u0328",
+	0x0105:  "\u0061\u0328",
+	0x0106:  "\u0043\u0301",
+	0x0107:  "\u0063\u0301",
+	0x0108:  "\u0043\u0302",
+	0x0109:  "\u0063\u0302",
+	0x010A:  "\u0043\u0307",
+	0x010B:  "\u0063\u0307",
+	0x010C:  "\u0043\u030C",
+	0x010D:  "\u0063\u030C",
+	0x010E:  "\u0044\u030C",
+	0x010F:  "\u0064\u030C",
+	0x0112:  "\u0045\u0304",
+	0x0113:  "\u0065\u0304",
+	0x0114:  "\u0045\u0306",
+	0x0115:  "\u0065\u0306",
+	0x0116:  "\u0045\u0307",
+	0x0117:  "\u0065\u0307",
+	0x0118:  "\u0045\u0328",
+	0x0119:  "\u0065\u0328",
+	0x011A:  "\u0045\u030C",
+	0x011B:  "\u0065\u030C",
+	0x011C:  "\u0047\u0302",
+	0x011D:  "\u0067\u0302",
+	0x011E:  "\u0047\u0306",
+	0x011F:  "\u0067\u0306",
+	0x0120:  "\u0047\u0307",
+	0x0121:  "\u0067\u0307",
+	0x0122:  "\u0047\u0327",
+	0x0123:  "\u0067\u0327",
+	0x0124:  "\u0048\u0302",
+	0x0125:  "\u0068\u0302",
+	0x0128:  "\u0049\u0303",
+	0x0129:  "\u0069\u0303",
+	0x012A:  "\u0049\u0304",
+	0x012B:  "\u0069\u0304",
+	0x012C:  "\u0049\u0306",
+	0x012D:  "\u0069\u0306",
+	0x012E:  "\u0049\u0328",
+	0x012F:  "\u0069\u0328",
+	0x0130:  "\u0049\u0307",
+	0x0134:  "\u004A\u0302",
+	0x0135:  "\u006A\u0302",
+	0x0136:  "\u004B\u0327",
+	0x0137:  "\u006B\u0327",
+	0x0139:  "\u004C\u0301",
+	0x013A:  "\u006C\u0301",
+	0x013B:  "\u004C\u0327",
+	0x013C:  "\u006C\u0327",
+	0x013D:  "\u004C\u030C",
+	0x013E:  "\u006C\u030C",
+	0x0143:  "\u004E\u0301",
+	0x0144:  "\u006E\u0301",
+	0x0145:  "\u004E\u0327",
+	0x0146:  "\u006E\u0327",
+	0x0147:  "\u004E\u030C",
+	0x0148:  "\u006E\u030C",
+	0x014C:  "\u004F\u0304",
+	0x014D:  "\u006F\u0304",
+	0x014E:  "\u004F\u0306",
+	0x014F:  "\u006F\u0306",
+	0x0150:  "\u004F\u030B",
+	0x0151:  "\u006F\u030B",
+	0x0154:  "\u0052\u0301",
+	0x0155:  "\u0072\u0301",
+	0x0156:  "\u0052\u0327",
+	0x0157:  "\u0072\u0327",
+	0x0158:  "\u0052\u030C",
+	0x0159:  "\u0072\u030C",
+	0x015A:  "\u0053\u0301",
+	0x015B:  "\u0073\u0301",
+	0x015C:  "\u0053\u0302",
+	0x015D:  "\u0073\u0302",
+	0x015E:  "\u0053\u0327",
+	0x015F:  "\u0073\u0327",
+	0x0160:  "\u0053\u030C",
+	0x0161:  "\u0073\u030C",
+	0x0162:  "\u0054\u0327",
+	0x0163:  "\u0074\u0327",
+	0x0164:  "\u0054\u030C",
+	0x0165:  "\u0074\u030C",
+	0x0168:  "\u0055\u0303",
+	0x0169:  "\u0075\u0303",
+	0x016A:  "\u0055\u0304",
+	0x016B:  "\u0075\u0304",
+	0x016C:  "\u0055\u0306",
+	0x016D:  "\u0075\u0306",
+	0x016E:  "\u0055\u030A",
+	0x016F:  "\u0075\u030A",
+	0x0170:  "\u0055\u030B",
+	0x0171:  "\u0075\u030B",
+	0x0172:  "\u0055\u0328",
+	0x0173:  "\u0075\u0328",
+	0x0174:  "\u0057\u0302",
+	0x0175:  "\u0077\u0302",
+	0x0176:  "\u0059\u0302",
+	0x0177:  "\u0079\u0302",
+	0x0178:  "\u0059\u0308",
+	0x0179:  "\u005A\u0301",
+	0x017A:  "\u007A\u0301",
+	0x017B:  "\u005A\u0307",
+	0x017C:  "\u007A\u0307",
+	0x017D:  "\u005A\u030C",
+	0x017E:  "\u007A\u030C",
+	0x01A0:  "\u004F\u031B",
+	0x01A1:  "\u006F\u031B",
+	0x01AF:  "\u0055\u031B",
+	0x01B0:  "\u0075\u031B",
+	0x01CD:  "\u0041\u030C",
+	0x01CE:  "\u0061\u030C",
+	0x01CF:  "\u0049\u030C",
+	0x01D0:  "\u0069\u030C",
+	0x01D1:  "\u004F\u030C",
+	0x01D2:  "\u006F\u030C",
+	0x01D3:  "\u0055\u030C",
+	0x01D4:  "\u0075\u030C",
+	0x01D5:  "\u0055\u0308\u0304",
+	0x01D6:  "\u0075\u0308\u0304",
+	0x01D7:  "\u0055\u0308\u0301",
+	0x01D8:  "\u0075\u0308\u0301",
+	0x01D9:  "\u0055\u0308\u030C",
+	0x01DA:  "\u0075\u0308\u030C",
+	0x01DB:  "\u0055\u0308\u0300",
+	0x01DC:  "\u0075\u0308\u0300",
+	0x01DE:  "\u0041\u0308\u0304",
+	0x01DF:  "\u0061\u0308\u0304",
+	0x01E0:  "\u0041\u0307\u0304",
+	0x01E1:  "\u0061\u0307\u0304",
+	0x01E2:  "\u00C6\u0304",
+	0x01E3:  "\u00E6\u0304",
+	0x01E6:  "\u0047\u030C",
+	0x01E7:  "\u0067\u030C",
+	0x01E8:  "\u004B\u030C",
+	0x01E9:  "\u006B\u030C",
+	0x01EA:  "\u004F\u0328",
+	0x01EB:  "\u006F\u0328",
+	0x01EC:  "\u004F\u0328\u0304",
+	0x01ED:  "\u006F\u0328\u0304",
+	0x01EE:  "\u01B7\u030C",
+	0x01EF:  "\u0292\u030C",
+	0x01F0:  "\u006A\u030C",
+	0x01F4:  "\u0047\u0301",
+	0x01F5:  "\u0067\u0301",
+	0x01F8:  "\u004E\u0300",
+	0x01F9:  "\u006E\u0300",
+	0x01FA:  "\u0041\u030A\u0301",
+	0x01FB:  "\u0061\u030A\u0301",
+	0x01FC:  "\u00C6\u0301",
+	0x01FD:  "\u00E6\u0301",
+	0x01FE:  "\u00D8\u0301",
+	0x01FF:  "\u00F8\u0301",
+	0x0200:  "\u0041\u030F",
+	0x0201:  "\u0061\u030F",
+	0x0202:  "\u0041\u0311",
+	0x0203:  "\u0061\u0311",
+	0x0204:  "\u0045\u030F",
+	0x0205:  "\u0065\u030F",
+	0x0206:  "\u0045\u0311",
+	0x0207:  "\u0065\u0311",
+	0x0208:  "\u0049\u030F",
+	0x0209:  "\u0069\u030F",
+	0x020A:  "\u0049\u0311",
+	0x020B:  "\u0069\u0311",
+	0x020C:  "\u004F\u030F",
+	0x020D:  "\u006F\u030F",
+	0x020E:  "\u004F\u0311",
+	0x020F:  "\u006F\u0311",
+	0x0210:  "\u0052\u030F",
+	0x0211:  "\u0072\u030F",
+	0x0212:  "\u0052\u0311",
+	0x0213:  "\u0072\u0311",
+	0x0214:  "\u0055\u030F",
+	0x0215:  "\u0075\u030F",
+	0x0216:  "\u0055\u0311",
+	0x0217:  "\u0075\u0311",
+	0x0218:  "\u0053\u0326",
+	0x0219:  "\u0073\u0326",
+	0x021A:  "\u0054\u0326",
+	0x021B:  "\u0074\u0326",
+	0x021E:  "\u0048\u030C",
+	0x021F:  "\u0068\u030C",
+	0x0226:  "\u0041\u0307",
+	0x0227:  "\u0061\u0307",
+	0x0228:  "\u0045\u0327",
+	0x0229:  "\u0065\u0327",
+	0x022A:  "\u004F\u0308\u0304",
+	0x022B:  "\u006F\u0308\u0304",
+	0x022C:  "\u004F\u0303\u0304",
+	0x022D:  "\u006F\u0303\u0304",
+	0x022E:  "\u004F\u0307",
+	0x022F:  "\u006F\u0307",
+	0x0230:  "\u004F\u0307\u0304",
+	0x0231:  "\u006F\u0307\u0304",
+	0x0232:  "\u0059\u0304",
+	0x0233:  "\u0079\u0304",
+	0x0340:  "\u0300",
+	0x0341:  "\u0301",
+	0x0343:  "\u0313",
+	0x0344:  "\u0308\u0301",
+	0x0374:  "\u02B9",
+	0x037E:  "\u003B",
+	0x0385:  "\u00A8\u0301",
+	0x0386:  "\u0391\u0301",
+	0x0387:  "\u00B7",
+	0x0388:  "\u0395\u0301",
+	0x0389:  "\u0397\u0301",
+	0x038A:  "\u0399\u0301",
+	0x038C:  "\u039F\u0301",
+	0x038E:  "\u03A5\u0301",
+	0x038F:  "\u03A9\u0301",
+	0x0390:  "\u03B9\u0308\u0301",
+	0x03AA:  "\u0399\u0308",
+	0x03AB:  "\u03A5\u0308",
+	0x03AC:  "\u03B1\u0301",
+	0x03AD:  "\u03B5\u0301",
+	0x03AE:  "\u03B7\u0301",
+	0x03AF:  "\u03B9\u0301",
+	0x03B0:  "\u03C5\u0308\u0301",
+	0x03CA:  "\u03B9\u0308",
+	0x03CB:  "\u03C5\u0308",
+	0x03CC:  "\u03BF\u0301",
+	0x03CD:  "\u03C5\u0301",
+	0x03CE:  "\u03C9\u0301",
+	0x03D3:  "\u03D2\u0301",
+	0x03D4:  "\u03D2\u0308",
+	0x0400:  "\u0415\u0300",
+	0x0401:  "\u0415\u0308",
+	0x0403:  "\u0413\u0301",
+	0x0407:  "\u0406\u0308",
+	0x040C:  "\u041A\u0301",
+	0x040D:  "\u0418\u0300",
+	0x040E:  "\u0423\u0306",
+	0x0419:  "\u0418\u0306",
+	0x0439:  "\u0438\u0306",
+	0x0450:  "\u0435\u0300",
+	0x0451:  "\u0435\u0308",
+	0x0453:  "\u0433\u0301",
+	0x0457:  "\u0456\u0308",
+	0x045C:  "\u043A\u0301",
+	0x045D:  "\u0438\u0300",
+	0x045E:  "\u0443\u0306",
+	0x0476:  "\u0474\u030F",
+	0x0477:  "\u0475\u030F",
+	0x04C1:  "\u0416\u0306",
+	0x04C2:  "\u0436\u0306",
+	0x04D0:  "\u0410\u0306",
+	0x04D1:  "\u0430\u0306",
+	0x04D2:  "\u0410\u0308",
+	0x04D3:  "\u0430\u0308",
+	0x04D6:  "\u0415\u0306",
+	0x04D7:  "\u0435\u0306",
+	0x04DA:  "\u04D8\u0308",
+	0x04DB:  "\u04D9\u0308",
+	0x04DC:  "\u0416\u0308",
+	0x04DD:  "\u0436\u0308",
+	0x04DE:  "\u0417\u0308",
+	0x04DF:  "\u0437\u0308",
+	0x04E2:  "\u0418\u0304",
+	0x04E3:  "\u0438\u0304",
+	0x04E4:  "\u0418\u0308",
+	0x04E5:  "\u0438\u0308",
+	0x04E6:  "\u041E\u0308",
+	0x04E7:  "\u043E\u0308",
+	0x04EA:  "\u04E8\u0308",
+	0x04EB:  "\u04E9\u0308",
+	0x04EC:  "\u042D\u0308",
+	0x04ED:  "\u044D\u0308",
+	0x04EE:  "\u0423\u0304",
+	0x04EF:  "\u0443\u0304",
+	0x04F0:  "\u0423\u0308",
+	0x04F1:  "\u0443\u0308",
+	0x04F2:  "\u0423\u030B",
+	0x04F3:  "\u0443\u030B",
+	0x04F4:  "\u0427\u0308",
+	0x04F5:  "\u0447\u0308",
+	0x04F8:  "\u042B\u0308",
+	0x04F9:  "\u044B\u0308",
+	0x0622:  "\u0627\u0653",
+	0x0623:  "\u0627\u0654",
+	0x0624:  "\u0648\u0654",
+	0x0625:  "\u0627\u0655",
+	0x0626:  "\u064A\u0654",
+	0x06C0:  "\u06D5\u0654",
+	0x06C2:  "\u06C1\u0654",
+	0x06D3:  "\u06D2\u0654",
+	0x0929:  "\u0928\u093C",
+	0x0931:  "\u0930\u093C",
+	0x0934:  "\u0933\u093C",
+	0x0958:  "\u0915\u093C",
+	0x0959:  "\u0916\u093C",
+	0x095A:  "\u0917\u093C",
+	0x095B:  "\u091C\u093C",
+	0x095C:  "\u0921\u093C",
+	0x095D:  "\u0922\u093C",
+	0x095E:  "\u092B\u093C",
+	0x095F:  "\u092F\u093C",
+	0x09CB:  "\u09C7\u09BE",
+	0x09CC:  "\u09C7\u09D7",
+	0x09DC:  "\u09A1\u09BC",
+	0x09DD:  "\u09A2\u09BC",
+	0x09DF:  "\u09AF\u09BC",
+	0x0A33:  "\u0A32\u0A3C",
+	0x0A36:  "\u0A38\u0A3C",
+	0x0A59:  "\u0A16\u0A3C",
+	0x0A5A:  "\u0A17\u0A3C",
+	0x0A5B:  "\u0A1C\u0A3C",
+	0x0A5E:  "\u0A2B\u0A3C",
+	0x0B48:  "\u0B47\u0B56",
+	0x0B4B:  "\u0B47\u0B3E",
+	0x0B4C:  "\u0B47\u0B57",
+	0x0B5C:  "\u0B21\u0B3C",
+	0x0B5D:  "\u0B22\u0B3C",
+	0x0B94:  "\u0B92\u0BD7",
+	0x0BCA:  "\u0BC6\u0BBE",
+	0x0BCB:  "\u0BC7\u0BBE",
+	0x0BCC:  "\u0BC6\u0BD7",
+	0x0C48:  "\u0C46\u0C56",
+	0x0CC0:  "\u0CBF\u0CD5",
+	0x0CC7:  "\u0CC6\u0CD5",
+	0x0CC8:  "\u0CC6\u0CD6",
+	0x0CCA:  "\u0CC6\u0CC2",
+	0x0CCB:  "\u0CC6\u0CC2\u0CD5",
+	0x0D4A:  "\u0D46\u0D3E",
+	0x0D4B:  "\u0D47\u0D3E",
+	0x0D4C:  "\u0D46\u0D57",
+	0x0DDA:  "\u0DD9\u0DCA",
+	0x0DDC:  "\u0DD9\u0DCF",
+	0x0DDD:  "\u0DD9\u0DCF\u0DCA",
+	0x0DDE:  "\u0DD9\u0DDF",
+	0x0F43:  "\u0F42\u0FB7",
+	0x0F4D:  "\u0F4C\u0FB7",
+	0x0F52:  "\u0F51\u0FB7",
+	0x0F57:  "\u0F56\u0FB7",
+	0x0F5C:  "\u0F5B\u0FB7",
+	0x0F69:  "\u0F40\u0FB5",
+	0x0F73:  "\u0F71\u0F72",
+	0x0F75:  "\u0F71\u0F74",
+	0x0F76:  "\u0FB2\u0F80",
+	0x0F78:  "\u0FB3\u0F80",
+	0x0F81:  "\u0F71\u0F80",
+	0x0F93:  "\u0F92\u0FB7",
+	0x0F9D:  "\u0F9C\u0FB7",
+	0x0FA2:  "\u0FA1\u0FB7",
+	0x0FA7:  "\u0FA6\u0FB7",
+	0x0FAC:  "\u0FAB\u0FB7",
+	0x0FB9:  "\u0F90\u0FB5",
+	0x1026:  "\u1025\u102E",
+	0x1B06:  "\u1B05\u1B35",
+	0x1B08:  "\u1B07\u1B35",
+	0x1B0A:  "\u1B09\u1B35",
+	0x1B0C:  "\u1B0B\u1B35",
+	0x1B0E:  "\u1B0D\u1B35",
+	0x1B12:  "\u1B11\u1B35",
+	0x1B3B:  "\u1B3A\u1B35",
+	0x1B3D:  "\u1B3C\u1B35",
+	0x1B40:  "\u1B3E\u1B35",
+	0x1B41:  "\u1B3F\u1B35",
+	0x1B43:  "\u1B42\u1B35",
+	0x1E00:  "\u0041\u0325",
+	0x1E01:  "\u0061\u0325",
+	0x1E02:  "\u0042\u0307",
+	0x1E03:  "\u0062\u0307",
+	0x1E04:  "\u0042\u0323",
+	0x1E05:  "\u0062\u0323",
+	0x1E06:  "\u0042\u0331",
+	0x1E07:  "\u0062\u0331",
+	0x1E08:  "\u0043\u0327\u0301",
+	0x1E09:  "\u0063\u0327\u0301",
+	0x1E0A:  "\u0044\u0307",
+	0x1E0B:  "\u0064\u0307",
+	0x1E0C:  "\u0044\u0323",
+	0x1E0D:  "\u0064\u0323",
+	0x1E0E:  "\u0044\u0331",
+	0x1E0F:  "\u0064\u0331",
+	0x1E10:  "\u0044\u0327",
+	0x1E11:  "\u0064\u0327",
+	0x1E12:  "\u0044\u032D",
+	0x1E13:  "\u0064\u032D",
+	0x1E14:  "\u0045\u0304\u0300",
+	0x1E15:  "\u0065\u0304\u0300",
+	0x1E16:  "\u0045\u0304\u0301",
+	0x1E17:  "\u0065\u0304\u0301",
+	0x1E18:  "\u0045\u032D",
+	0x1E19:  "\u0065\u032D",
+	0x1E1A:  "\u0045\u0330",
+	0x1E1B:  "\u0065\u0330",
+	0x1E1C:  "\u0045\u0327\u0306",
+	0x1E1D:  "\u0065\u0327\u0306",
+	0x1E1E:  "\u0046\u0307",
+	0x1E1F:  "\u0066\u0307",
+	0x1E20:  "\u0047\u0304",
+	0x1E21:  "\u0067\u0304",
+	0x1E22:  "\u0048\u0307",
+	0x1E23:  "\u0068\u0307",
+	0x1E24:  "\u0048\u0323",
+	0x1E25:  "\u0068\u0323",
+	0x1E26:  "\u0048\u0308",
+	0x1E27:  "\u0068\u0308",
+	0x1E28:  "\u0048\u0327",
+	0x1E29:  "\u0068\u0327",
+	0x1E2A:  "\u0048\u032E",
+	0x1E2B:  "\u0068\u032E",
+	0x1E2C:  "\u0049\u0330",
+	0x1E2D:  "\u0069\u0330",
+	0x1E2E:  "\u0049\u0308\u0301",
+	0x1E2F:  "\u0069\u0308\u0301",
+	0x1E30:  "\u004B\u0301",
+	0x1E31:  "\u006B\u0301",
+	0x1E32:  "\u004B\u0323",
+	0x1E33:  "\u006B\u0323",
+	0x1E34:  "\u004B\u0331",
+	0x1E35:  "\u006B\u0331",
+	0x1E36:  "\u004C\u0323",
+	0x1E37:  "\u006C\u0323",
+	0x1E38:  "\u004C\u0323\u0304",
+	0x1E39:  "\u006C\u0323\u0304",
+	0x1E3A:  "\u004C\u0331",
+	0x1E3B:  "\u006C\u0331",
+	0x1E3C:  "\u004C\u032D",
+	0x1E3D:  "\u006C\u032D",
+	0x1E3E:  "\u004D\u0301",
+	0x1E3F:  "\u006D\u0301",
+	0x1E40:  "\u004D\u0307",
+	0x1E41:  "\u006D\u0307",
+	0x1E42:  "\u004D\u0323",
+	0x1E43:  "\u006D\u0323",
+	0x1E44:  "\u004E\u0307",
+	0x1E45:  "\u006E\u0307",
+	0x1E46:  "\u004E\u0323",
+	0x1E47:  "\u006E\u0323",
+	0x1E48:  "\u004E\u0331",
+	0x1E49:  "\u006E\u0331",
+	0x1E4A:  "\u004E\u032D",
+	0x1E4B:  "\u006E\u032D",
+	0x1E4C:  "\u004F\u0303\u0301",
+	0x1E4D:  "\u006F\u0303\u0301",
+	0x1E4E:  "\u004F\u0303\u0308",
+	0x1E4F:  "\u006F\u0303\u0308",
+	0x1E50:  "\u004F\u0304\u0300",
+	0x1E51:  "\u006F\u0304\u0300",
+	0x1E52:  "\u004F\u0304\u0301",
+	0x1E53:  "\u006F\u0304\u0301",
+	0x1E54:  "\u0050\u0301",
+	0x1E55:  "\u0070\u0301",
+	0x1E56:  "\u0050\u0307",
+	0x1E57:  "\u0070\u0307",
+	0x1E58:  "\u0052\u0307",
+	0x1E59:  "\u0072\u0307",
+	0x1E5A:  "\u0052\u0323",
+	0x1E5B:  "\u0072\u0323",
+	0x1E5C:  "\u0052\u0323\u0304",
+	0x1E5D:  "\u0072\u0323\u0304",
+	0x1E5E:  "\u0052\u0331",
+	0x1E5F:  "\u0072\u0331",
+	0x1E60:  "\u0053\u0307",
+	0x1E61:  "\u0073\u0307",
+	0x1E62:  "\u0053\u0323",
+	0x1E63:  "\u0073\u0323",
+	0x1E64:  "\u0053\u0301\u0307",
+	0x1E65:  "\u0073\u0301\u0307",
+	0x1E66:  "\u0053\u030C\u0307",
+	0x1E67:  "\u0073\u030C\u0307",
+	0x1E68:  "\u0053\u0323\u0307",
+	0x1E69:  "\u0073\u0323\u0307",
+	0x1E6A:  "\u0054\u0307",
+	0x1E6B:  "\u0074\u0307",
+	0x1E6C:  "\u0054\u0323",
+	0x1E6D:  "\u0074\u0323",
+	0x1E6E:  "\u0054\u0331",
+	0x1E6F:  "\u0074\u0331",
+	0x1E70:  "\u0054\u032D",
+	0x1E71:  "\u0074\u032D",
+	0x1E72:  "\u0055\u0324",
+	0x1E73:  "\u0075\u0324",
+	0x1E74:  "\u0055\u0330",
+	0x1E75:  "\u0075\u0330",
+	0x1E76:  "\u0055\u032D",
+	0x1E77:  "\u0075\u032D",
+	0x1E78:  "\u0055\u0303\u0301",
+	0x1E79:  "\u0075\u0303\u0301",
+	0x1E7A:  "\u0055\u0304\u0308",
+	0x1E7B:  "\u0075\u0304\u0308",
+	0x1E7C:  "\u0056\u0303",
+	0x1E7D:  "\u0076\u0303",
+	0x1E7E:  "\u0056\u0323",
+	0x1E7F:  "\u0076\u0323",
+	0x1E80:  "\u0057\u0300",
+	0x1E81:  "\u0077\u0300",
+	0x1E82:  "\u0057\u0301",
+	0x1E83:  "\u0077\u0301",
+	0x1E84:  "\u0057\u0308",
+	0x1E85:  "\u0077\u0308",
+	0x1E86:  "\u0057\u0307",
+	0x1E87:  "\u0077\u0307",
+	0x1E88:  "\u0057\u0323",
+	0x1E89:  "\u0077\u0323",
+	0x1E8A:  "\u0058\u0307",
+	0x1E8B:  "\u0078\u0307",
+	0x1E8C:  "\u0058\u0308",
+	0x1E8D:  "\u0078\u0308",
+	0x1E8E:  "\u0059\u0307",
+	0x1E8F:  "\u0079\u0307",
+	0x1E90:  "\u005A\u0302",
+	0x1E91:  "\u007A\u0302",
+	0x1E92:  "\u005A\u0323",
+	0x1E93:  "\u007A\u0323",
+	0x1E94:  "\u005A\u0331",
+	0x1E95:  "\u007A\u0331",
+	0x1E96:  "\u0068\u0331",
+	0x1E97:  "\u0074\u0308",
+	0x1E98:  "\u0077\u030A",
+	0x1E99:  "\u0079\u030A",
+	0x1E9B:  "\u017F\u0307",
+	0x1EA0:  "\u0041\u0323",
+	0x1EA1:  "\u0061\u0323",
+	0x1EA2:  "\u0041\u0309",
+	0x1EA3:  "\u0061\u0309",
+	0x1EA4:  "\u0041\u0302\u0301",
+	0x1EA5:  "\u0061\u0302\u0301",
+	0x1EA6:  "\u0041\u0302\u0300",
+	0x1EA7:  "\u0061\u0302\u0300",
+	0x1EA8:  "\u0041\u0302\u0309",
+	0x1EA9:  "\u0061\u0302\u0309",
+	0x1EAA:  "\u0041\u0302\u0303",
+	0x1EAB:  "\u0061\u0302\u0303",
+	0x1EAC:  "\u0041\u0323\u0302",
+	0x1EAD:  "\u0061\u0323\u0302",
+	0x1EAE:  "\u0041\u0306\u0301",
+	0x1EAF:  "\u0061\u0306\u0301",
+	0x1EB0:  "\u0041\u0306\u0300",
+	0x1EB1:  "\u0061\u0306\u0300",
+	0x1EB2:  "\u0041\u0306\u0309",
+	0x1EB3:  "\u0061\u0306\u0309",
+	0x1EB4:  "\u0041\u0306\u0303",
+	0x1EB5:  "\u0061\u0306\u0303",
+	0x1EB6:  "\u0041\u0323\u0306",
+	0x1EB7:  "\u0061\u0323\u0306",
+	0x1EB8:  "\u0045\u0323",
+	0x1EB9:  "\u0065\u0323",
+	0x1EBA:  "\u0045\u0309",
+	0x1EBB:  "\u0065\u0309",
+	0x1EBC:  "\u0045\u0303",
+	0x1EBD:  "\u0065\u0303",
+	0x1EBE:  "\u0045\u0302\u0301",
+	0x1EBF:  "\u0065\u0302\u0301",
+	0x1EC0:  "\u0045\u0302\u0300",
+	0x1EC1:  "\u0065\u0302\u0300",
+	0x1EC2:  "\u0045\u0302\u0309",
+	0x1EC3:  "\u0065\u0302\u0309",
+	0x1EC4:  "\u0045\u0302\u0303",
+	0x1EC5:  "\u0065\u0302\u0303",
+	0x1EC6:  "\u0045\u0323\u0302",
+	0x1EC7:  "\u0065\u0323\u0302",
+	0x1EC8:  "\u0049\u0309",
+	0x1EC9:  "\u0069\u0309",
+	0x1ECA:  "\u0049\u0323",
+	0x1ECB:  "\u0069\u0323",
+	0x1ECC:  "\u004F\u0323",
+	0x1ECD:  "\u006F\u0323",
+	0x1ECE:  "\u004F\u0309",
+	0x1ECF:  "\u006F\u0309",
+	0x1ED0:  "\u004F\u0302\u0301",
+	0x1ED1:  "\u006F\u0302\u0301",
+	0x1ED2:  "\u004F\u0302\u0300",
+	0x1ED3:  "\u006F\u0302\u0300",
+	0x1ED4:  "\u004F\u0302\u0309",
+	0x1ED5:  "\u006F\u0302\u0309",
+	0x1ED6:  "\u004F\u0302\u0303",
+	0x1ED7:  "\u006F\u0302\u0303",
+	0x1ED8:  "\u004F\u0323\u0302",
+	0x1ED9:  "\u006F\u0323\u0302",
+	0x1EDA:  "\u004F\u031B\u0301",
+	0x1EDB:  "\u006F\u031B\u0301",
+	0x1EDC:  "\u004F\u031B\u0300",
+	0x1EDD:  "\u006F\u031B\u0300",
+	0x1EDE:  "\u004F\u031B\u0309",
+	0x1EDF:  "\u006F\u031B\u0309",
+	0x1EE0:  "\u004F\u031B\u0303",
+	0x1EE1:  "\u006F\u031B\u0303",
+	0x1EE2:  "\u004F\u031B\u0323",
+	0x1EE3:  "\u006F\u031B\u0323",
+	0x1EE4:  "\u0055\u0323",
+	0x1EE5:  "\u0075\u0323",
+	0x1EE6:  "\u0055\u0309",
+	0x1EE7:  "\u0075\u0309",
+	0x1EE8:  "\u0055\u031B\u0301",
+	0x1EE9:  "\u0075\u031B\u0301",
+	0x1EEA:  "\u0055\u031B\u0300",
+	0x1EEB:  "\u0075\u031B\u0300",
+	0x1EEC:  "\u0055\u031B\u0309",
+	0x1EED:  "\u0075\u031B\u0309",
+	0x1EEE:  "\u0055\u031B\u0303",
+	0x1EEF:  "\u0075\u031B\u0303",
+	0x1EF0:  "\u0055\u031B\u0323",
+	0x1EF1:  "\u0075\u031B\u0323",
+	0x1EF2:  "\u0059\u0300",
+	0x1EF3:  "\u0079\u0300",
+	0x1EF4:  "\u0059\u0323",
+	0x1EF5:  "\u0079\u0323",
+	0x1EF6:  "\u0059\u0309",
+	0x1EF7:  "\u0079\u0309",
+	0x1EF8:  "\u0059\u0303",
+	0x1EF9:  "\u0079\u0303",
+	0x1F00:  "\u03B1\u0313",
+	0x1F01:  "\u03B1\u0314",
+	0x1F02:  "\u03B1\u0313\u0300",
+	0x1F03:  "\u03B1\u0314\u0300",
+	0x1F04:  "\u03B1\u0313\u0301",
+	0x1F05:  "\u03B1\u0314\u0301",
+	0x1F06:  "\u03B1\u0313\u0342",
+	0x1F07:  "\u03B1\u0314\u0342",
+	0x1F08:  "\u0391\u0313",
+	0x1F09:  "\u0391\u0314",
+	0x1F0A:  "\u0391\u0313\u0300",
+	0x1F0B:  "\u0391\u0314\u0300",
+	0x1F0C:  "\u0391\u0313\u0301",
+	0x1F0D:  "\u0391\u0314\u0301",
+	0x1F0E:  "\u0391\u0313\u0342",
+	0x1F0F:  "\u0391\u0314\u0342",
+	0x1F10:  "\u03B5\u0313",
+	0x1F11:  "\u03B5\u0314",
+	0x1F12:  "\u03B5\u0313\u0300",
+	0x1F13:  "\u03B5\u0314\u0300",
+	0x1F14:  "\u03B5\u0313\u0301",
+	0x1F15:  "\u03B5\u0314\u0301",
+	0x1F18:  "\u0395\u0313",
+	0x1F19:  "\u0395\u0314",
+	0x1F1A:  "\u0395\u0313\u0300",
+	0x1F1B:  "\u0395\u0314\u0300",
+	0x1F1C:  "\u0395\u0313\u0301",
+	0x1F1D:  "\u0395\u0314\u0301",
+	0x1F20:  "\u03B7\u0313",
+	0x1F21:  "\u03B7\u0314",
+	0x1F22:  "\u03B7\u0313\u0300",
+	0x1F23:  "\u03B7\u0314\u0300",
+	0x1F24:  "\u03B7\u0313\u0301",
+	0x1F25:  "\u03B7\u0314\u0301",
+	0x1F26:  "\u03B7\u0313\u0342",
+	0x1F27:  "\u03B7\u0314\u0342",
+	0x1F28:  "\u0397\u0313",
+	0x1F29:  "\u0397\u0314",
+	0x1F2A:  "\u0397\u0313\u0300",
+	0x1F2B:  "\u0397\u0314\u0300",
+	0x1F2C:  "\u0397\u0313\u0301",
+	0x1F2D:  "\u0397\u0314\u0301",
+	0x1F2E:  "\u0397\u0313\u0342",
+	0x1F2F:  "\u0397\u0314\u0342",
+	0x1F30:  "\u03B9\u0313",
+	0x1F31:  "\u03B9\u0314",
+	0x1F32:  "\u03B9\u0313\u0300",
+	0x1F33:  "\u03B9\u0314\u0300",
+	0x1F34:  "\u03B9\u0313\u0301",
+	0x1F35:  "\u03B9\u0314\u0301",
+	0x1F36:  "\u03B9\u0313\u0342",
+	0x1F37:  "\u03B9\u0314\u0342",
+	0x1F38:  "\u0399\u0313",
+	0x1F39:  "\u0399\u0314",
+	0x1F3A:  "\u0399\u0313\u0300",
+	0x1F3B:  "\u0399\u0314\u0300",
+	0x1F3C:  "\u0399\u0313\u0301",
+	0x1F3D:  "\u0399\u0314\u0301",
+	0x1F3E:  "\u0399\u0313\u0342",
+	0x1F3F:  "\u0399\u0314\u0342",
+	0x1F40:  "\u03BF\u0313",
+	0x1F41:  "\u03BF\u0314",
+	0x1F42:  "\u03BF\u0313\u0300",
+	0x1F43:  "\u03BF\u0314\u0300",
+	0x1F44:  "\u03BF\u0313\u0301",
+	0x1F45:  "\u03BF\u0314\u0301",
+	0x1F48:  "\u039F\u0313",
+	0x1F49:  "\u039F\u0314",
+	0x1F4A:  "\u039F\u0313\u0300",
+	0x1F4B:  "\u039F\u0314\u0300",
+	0x1F4C:  "\u039F\u0313\u0301",
+	0x1F4D:  "\u039F\u0314\u0301",
+	0x1F50:  "\u03C5\u0313",
+	0x1F51:  "\u03C5\u0314",
+	0x1F52:  "\u03C5\u0313\u0300",
+	0x1F53:  "\u03C5\u0314\u0300",
+	0x1F54:  "\u03C5\u0313\u0301",
+	0x1F55:  "\u03C5\u0314\u0301",
+	0x1F56:  "\u03C5\u0313\u0342",
+	0x1F57:  "\u03C5\u0314\u0342",
+	0x1F59:  "\u03A5\u0314",
+	0x1F5B:  "\u03A5\u0314\u0300",
+	0x1F5D:  "\u03A5\u0314\u0301",
+	0x1F5F:  "\u03A5\u0314\u0342",
+	0x1F60:  "\u03C9\u0313",
+	0x1F61:  "\u03C9\u0314",
+	0x1F62:  "\u03C9\u0313\u0300",
+	0x1F63:  "\u03C9\u0314\u0300",
+	0x1F64:  "\u03C9\u0313\u0301",
+	0x1F65:  "\u03C9\u0314\u0301",
+	0x1F66:  "\u03C9\u0313\u0342",
+	0x1F67:  "\u03C9\u0314\u0342",
+	0x1F68:  "\u03A9\u0313",
+	0x1F69:  "\u03A9\u0314",
+	0x1F6A:  "\u03A9\u0313\u0300",
+	0x1F6B:  "\u03A9\u0314\u0300",
+	0x1F6C:  "\u03A9\u0313\u0301",
+	0x1F6D:  "\u03A9\u0314\u0301",
+	0x1F6E:  "\u03A9\u0313\u0342",
+	0x1F6F:  "\u03A9\u0314\u0342",
+	0x1F70:  "\u03B1\u0300",
+	0x1F71:  "\u03B1\u0301",
+	0x1F72:  "\u03B5\u0300",
+	0x1F73:  "\u03B5\u0301",
+	0x1F74:  "\u03B7\u0300",
+	0x1F75:  "\u03B7\u0301",
+	0x1F76:  "\u03B9\u0300",
+	0x1F77:  "\u03B9\u0301",
+	0x1F78:  "\u03BF\u0300",
+	0x1F79:  "\u03BF\u0301",
+	0x1F7A:  "\u03C5\u0300",
+	0x1F7B:  "\u03C5\u0301",
+	0x1F7C:  "\u03C9\u0300",
+	0x1F7D:  "\u03C9\u0301",
+	0x1F80:  "\u03B1\u0313\u0345",
+	0x1F81:  "\u03B1\u0314\u0345",
+	0x1F82:  "\u03B1\u0313\u0300\u0345",
+	0x1F83:  "\u03B1\u0314\u0300\u0345",
+	0x1F84:  "\u03B1\u0313\u0301\u0345",
+	0x1F85:  "\u03B1\u0314\u0301\u0345",
+	0x1F86:  "\u03B1\u0313\u0342\u0345",
+	0x1F87:  "\u03B1\u0314\u0342\u0345",
+	0x1F88:  "\u0391\u0313\u0345",
+	0x1F89:  "\u0391\u0314\u0345",
+	0x1F8A:  "\u0391\u0313\u0300\u0345",
+	0x1F8B:  "\u0391\u0314\u0300\u0345",
+	0x1F8C:  "\u0391\u0313\u0301\u0345",
+	0x1F8D:  "\u0391\u0314\u0301\u0345",
+	0x1F8E:  "\u0391\u0313\u0342\u0345",
+	0x1F8F:  "\u0391\u0314\u0342\u0345",
+	0x1F90:  "\u03B7\u0313\u0345",
+	0x1F91:  "\u03B7\u0314\u0345",
+	0x1F92:  "\u03B7\u0313\u0300\u0345",
+	0x1F93:  "\u03B7\u0314\u0300\u0345",
+	0x1F94:  "\u03B7\u0313\u0301\u0345",
+	0x1F95:  "\u03B7\u0314\u0301\u0345",
+	0x1F96:  "\u03B7\u0313\u0342\u0345",
+	0x1F97:  "\u03B7\u0314\u0342\u0345",
+	0x1F98:  "\u0397\u0313\u0345",
+	0x1F99:  "\u0397\u0314\u0345",
+	0x1F9A:  "\u0397\u0313\u0300\u0345",
+	0x1F9B:  "\u0397\u0314\u0300\u0345",
+	0x1F9C:  "\u0397\u0313\u0301\u0345",
+	0x1F9D:  "\u0397\u0314\u0301\u0345",
+	0x1F9E:  "\u0397\u0313\u0342\u0345",
+	0x1F9F:  "\u0397\u0314\u0342\u0345",
+	0x1FA0:  "\u03C9\u0313\u0345",
+	0x1FA1:  "\u03C9\u0314\u0345",
+	0x1FA2:  "\u03C9\u0313\u0300\u0345",
+	0x1FA3:  "\u03C9\u0314\u0300\u0345",
+	0x1FA4:  "\u03C9\u0313\u0301\u0345",
+	0x1FA5:  "\u03C9\u0314\u0301\u0345",
+	0x1FA6:  "\u03C9\u0313\u0342\u0345",
+	0x1FA7:  "\u03C9\u0314\u0342\u0345",
+	0x1FA8:  "\u03A9\u0313\u0345",
+	0x1FA9:  "\u03A9\u0314\u0345",
+	0x1FAA:  "\u03A9\u0313\u0300\u0345",
+	0x1FAB:  "\u03A9\u0314\u0300\u0345",
+	0x1FAC:  "\u03A9\u0313\u0301\u0345",
+	0x1FAD:  "\u03A9\u0314\u0301\u0345",
+	0x1FAE:  "\u03A9\u0313\u0342\u0345",
+	0x1FAF:  "\u03A9\u0314\u0342\u0345",
+	0x1FB0:  "\u03B1\u0306",
+	0x1FB1:  "\u03B1\u0304",
+	0x1FB2:  "\u03B1\u0300\u0345",
+	0x1FB3:  "\u03B1\u0345",
+	0x1FB4:  "\u03B1\u0301\u0345",
+	0x1FB6:  "\u03B1\u0342",
+	0x1FB7:  "\u03B1\u0342\u0345",
+	0x1FB8:  "\u0391\u0306",
+	0x1FB9:  "\u0391\u0304",
+	0x1FBA:  "\u0391\u0300",
+	0x1FBB:  "\u0391\u0301",
+	0x1FBC:  "\u0391\u0345",
+	0x1FBE:  "\u03B9",
+	0x1FC1:  "\u00A8\u0342",
+	0x1FC2:  "\u03B7\u0300\u0345",
+	0x1FC3:  "\u03B7\u0345",
+	0x1FC4:  "\u03B7\u0301\u0345",
+	0x1FC6:  "\u03B7\u0342",
+	0x1FC7:  "\u03B7\u0342\u0345",
+	0x1FC8:  "\u0395\u0300",
+	0x1FC9:  "\u0395\u0301",
+	0x1FCA:  "\u0397\u0300",
+	0x1FCB:  "\u0397\u0301",
+	0x1FCC:  "\u0397\u0345",
+	0x1FCD:  "\u1FBF\u0300",
+	0x1FCE:  "\u1FBF\u0301",
+	0x1FCF:  "\u1FBF\u0342",
+	0x1FD0:  "\u03B9\u0306",
+	0x1FD1:  "\u03B9\u0304",
+	0x1FD2:  "\u03B9\u0308\u0300",
+	0x1FD3:  "\u03B9\u0308\u0301",
+	0x1FD6:  "\u03B9\u0342",
+	0x1FD7:  "\u03B9\u0308\u0342",
+	0x1FD8:  "\u0399\u0306",
+	0x1FD9:  "\u0399\u0304",
+	0x1FDA:  "\u0399\u0300",
+	0x1FDB:  "\u0399\u0301",
+	0x1FDD:  "\u1FFE\u0300",
+	0x1FDE:  "\u1FFE\u0301",
+	0x1FDF:  "\u1FFE\u0342",
+	0x1FE0:  "\u03C5\u0306",
+	0x1FE1:  "\u03C5\u0304",
+	0x1FE2:  "\u03C5\u0308\u0300",
+	0x1FE3:  "\u03C5\u0308\u0301",
+	0x1FE4:  "\u03C1\u0313",
+	0x1FE5:  "\u03C1\u0314",
+	0x1FE6:  "\u03C5\u0342",
+	0x1FE7:  "\u03C5\u0308\u0342",
+	0x1FE8:  "\u03A5\u0306",
+	0x1FE9:  "\u03A5\u0304",
+	0x1FEA:  "\u03A5\u0300",
+	0x1FEB:  "\u03A5\u0301",
+	0x1FEC:  "\u03A1\u0314",
+	0x1FED:  "\u00A8\u0300",
+	0x1FEE:  "\u00A8\u0301",
+	0x1FEF:  "\u0060",
+	0x1FF2:  "\u03C9\u0300\u0345",
+	0x1FF3:  "\u03C9\u0345",
+	0x1FF4:  "\u03C9\u0301\u0345",
+	0x1FF6:  "\u03C9\u0342",
+	0x1FF7:  "\u03C9\u0342\u0345",
+	0x1FF8:  "\u039F\u0300",
+	0x1FF9:  "\u039F\u0301",
+	0x1FFA:  "\u03A9\u0300",
+	0x1FFB:  "\u03A9\u0301",
+	0x1FFC:  "\u03A9\u0345",
+	0x1FFD:  "\u00B4",
+	0x2000:  "\u2002",
+	0x2001:  "\u2003",
+	0x2126:  "\u03A9",
+	0x212A:  "\u004B",
+	0x212B:  "\u0041\u030A",
+	0x219A:  "\u2190\u0338",
+	0x219B:  "\u2192\u0338",
+	0x21AE:  "\u2194\u0338",
+	0x21CD:  "\u21D0\u0338",
+	0x21CE:  "\u21D4\u0338",
+	0x21CF:  "\u21D2\u0338",
+	0x2204:  "\u2203\u0338",
+	0x2209:  "\u2208\u0338",
+	0x220C:  "\u220B\u0338",
+	0x2224:  "\u2223\u0338",
+	0x2226:  "\u2225\u0338",
+	0x2241:  "\u223C\u0338",
+	0x2244:  "\u2243\u0338",
+	0x2247:  "\u2245\u0338",
+	0x2249:  "\u2248\u0338",
+	0x2260:  "\u003D\u0338",
+	0x2262:  "\u2261\u0338",
+	0x226D:  "\u224D\u0338",
+	0x226E:  "\u003C\u0338",
+	0x226F:  "\u003E\u0338",
+	0x2270:  "\u2264\u0338",
+	0x2271:  "\u2265\u0338",
+	0x2274:  "\u2272\u0338",
+	0x2275:  "\u2273\u0338",
+	0x2278:  "\u2276\u0338",
+	0x2279:  "\u2277\u0338",
+	0x2280:  "\u227A\u0338",
+	0x2281:  "\u227B\u0338",
+	0x2284:  "\u2282\u0338",
+	0x2285:  "\u2283\u0338",
+	0x2288:  "\u2286\u0338",
+	0x2289:  "\u2287\u0338",
+	0x22AC:  "\u22A2\u0338",
+	0x22AD:  "\u22A8\u0338",
+	0x22AE:  "\u22A9\u0338",
+	0x22AF:  "\u22AB\u0338",
+	0x22E0:  "\u227C\u0338",
+	0x22E1:  "\u227D\u0338",
+	0x22E2:  "\u2291\u0338",
+	0x22E3:  "\u2292\u0338",
+	0x22EA:  "\u22B2\u0338",
+	0x22EB:  "\u22B3\u0338",
+	0x22EC:  "\u22B4\u0338",
+	0x22ED:  "\u22B5\u0338",
+	0x2329:  "\u3008",
+	0x232A:  "\u3009",
+	0x2ADC:  "\u2ADD\u0338",
+	0x304C:  "\u304B\u3099",
+	0x304E:  "\u304D\u3099",
+	0x3050:  "\u304F\u3099",
+	0x3052:  "\u3051\u3099",
+	0x3054:  "\u3053\u3099",
+	0x3056:  "\u3055\u3099",
+	0x3058:  "\u3057\u3099",
+	0x305A:  "\u3059\u3099",
+	0x305C:  "\u305B\u3099",
+	0x305E:  "\u305D\u3099",
+	0x3060:  "\u305F\u3099",
+	0x3062:  "\u3061\u3099",
+	0x3065:  "\u3064\u3099",
+	0x3067:  "\u3066\u3099",
+	0x3069:  "\u3068\u3099",
+	0x3070:  "\u306F\u3099",
+	0x3071:  "\u306F\u309A",
+	0x3073:  "\u3072\u3099",
+	0x3074:  "\u3072\u309A",
+	0x3076:  "\u3075\u3099",
+	0x3077:  "\u3075\u309A",
+	0x3079:  "\u3078\u3099",
+	0x307A:  "\u3078\u309A",
+	0x307C:  "\u307B\u3099",
+	0x307D:  "\u307B\u309A",
+	0x3094:  "\u3046\u3099",
+	0x309E:  "\u309D\u3099",
+	0x30AC:  "\u30AB\u3099",
+	0x30AE:  "\u30AD\u3099",
+	0x30B0:  "\u30AF\u3099",
+	0x30B2:  "\u30B1\u3099",
+	0x30B4:  "\u30B3\u3099",
+	0x30B6:  "\u30B5\u3099",
+	0x30B8:  "\u30B7\u3099",
+	0x30BA:  "\u30B9\u3099",
+	0x30BC:  "\u30BB\u3099",
+	0x30BE:  "\u30BD\u3099",
+	0x30C0:  "\u30BF\u3099",
+	0x30C2:  "\u30C1\u3099",
+	0x30C5:  "\u30C4\u3099",
+	0x30C7:  "\u30C6\u3099",
+	0x30C9:  "\u30C8\u3099",
+	0x30D0:  "\u30CF\u3099",
+	0x30D1:  "\u30CF\u309A",
+	0x30D3:  "\u30D2\u3099",
+	0x30D4:  "\u30D2\u309A",
+	0x30D6:  "\u30D5\u3099",
+	0x30D7:  "\u30D5\u309A",
+	0x30D9:  "\u30D8\u3099",
+	0x30DA:  "\u30D8\u309A",
+	0x30DC:  "\u30DB\u3099",
+	0x30DD:  "\u30DB\u309A",
+	0x30F4:  "\u30A6\u3099",
+	0x30F7:  "\u30EF\u3099",
+	0x30F8:  "\u30F0\u3099",
+	0x30F9:  "\u30F1\u3099",
+	0x30FA:  "\u30F2\u3099",
+	0x30FE:  "\u30FD\u3099",
+	0xF900:  "\u8C48",
+	0xF901:  "\u66F4",
+	0xF902:  "\u8ECA",
+	0xF903:  "\u8CC8",
+	0xF904:  "\u6ED1",
+	0xF905:  "\u4E32",
+	0xF906:  "\u53E5",
+	0xF907:  "\u9F9C",
+	0xF908:  "\u9F9C",
+	0xF909:  "\u5951",
+	0xF90A:  "\u91D1",
+	0xF90B:  "\u5587",
+	0xF90C:  "\u5948",
+	0xF90D:  "\u61F6",
+	0xF90E:  "\u7669",
+	0xF90F:  "\u7F85",
+	0xF910:  "\u863F",
+	0xF911:  "\u87BA",
+	0xF912:  "\u88F8",
+	0xF913:  "\u908F",
+	0xF914:  "\u6A02",
+	0xF915:  "\u6D1B",
+	0xF916:  "\u70D9",
+	0xF917:  "\u73DE",
+	0xF918:  "\u843D",
+	0xF919:  "\u916A",
+	0xF91A:  "\u99F1",
+	0xF91B:  "\u4E82",
+	0xF91C:  "\u5375",
+	0xF91D:  "\u6B04",
+	0xF91E:  "\u721B",
+	0xF91F:  "\u862D",
+	0xF920:  "\u9E1E",
+	0xF921:  "\u5D50",
+	0xF922:  "\u6FEB",
+	0xF923:  "\u85CD",
+	0xF924:  "\u8964",
+	0xF925:  "\u62C9",
+	0xF926:  "\u81D8",
+	0xF927:  "\u881F",
+	0xF928:  "\u5ECA",
+	0xF929:  "\u6717",
+	0xF92A:  "\u6D6A",
+	0xF92B:  "\u72FC",
+	0xF92C:  "\u90CE",
+	0xF92D:  "\u4F86",
+	0xF92E:  "\u51B7",
+	0xF92F:  "\u52DE",
+	0xF930:  "\u64C4",
+	0xF931:  "\u6AD3",
+	0xF932:  "\u7210",
+	0xF933:  "\u76E7",
+	0xF934:  "\u8001",
+	0xF935:  "\u8606",
+	0xF936:  "\u865C",
+	0xF937:  "\u8DEF",
+	0xF938:  "\u9732",
+	0xF939:  "\u9B6F",
+	0xF93A:  "\u9DFA",
+	0xF93B:  "\u788C",
+	0xF93C:  "\u797F",
+	0xF93D:  "\u7DA0",
+	0xF93E:  "\u83C9",
+	0xF93F:  "\u9304",
+	0xF940:  "\u9E7F",
+	0xF941:  "\u8AD6",
+	0xF942:  "\u58DF",
+	0xF943:  "\u5F04",
+	0xF944:  "\u7C60",
+	0xF945:  "\u807E",
+	0xF946:  "\u7262",
+	0xF947:  "\u78CA",
+	0xF948:  "\u8CC2",
+	0xF949:  "\u96F7",
+	0xF94A:  "\u58D8",
+	0xF94B:  "\u5C62",
+	0xF94C:  "\u6A13",
+	0xF94D:  "\u6DDA",
+	0xF94E:  "\u6F0F",
+	0xF94F:  "\u7D2F",
+	0xF950:  "\u7E37",
+	0xF951:  "\u964B",
+	0xF952:  "\u52D2",
+	0xF953:  "\u808B",
+	0xF954:  "\u51DC",
+	0xF955:  "\u51CC",
+	0xF956:  "\u7A1C",
+	0xF957:  "\u7DBE",
+	0xF958:  "\u83F1",
+	0xF959:  "\u9675",
+	0xF95A:  "\u8B80",
+	0xF95B:  "\u62CF",
+	0xF95C:  "\u6A02",
+	0xF95D:  "\u8AFE",
+	0xF95E:  "\u4E39",
+	0xF95F:  "\u5BE7",
+	0xF960:  "\u6012",
+	0xF961:  "\u7387",
+	0xF962:  "\u7570",
+	0xF963:  "\u5317",
+	0xF964:  "\u78FB",
+	0xF965:  "\u4FBF",
+	0xF966:  "\u5FA9",
+	0xF967:  "\u4E0D",
+	0xF968:  "\u6CCC",
+	0xF969:  "\u6578",
+	0xF96A:  "\u7D22",
+	0xF96B:  "\u53C3",
+	0xF96C:  "\u585E",
+	0xF96D:  "\u7701",
+	0xF96E:  "\u8449",
+	0xF96F:  "\u8AAA",
+	0xF970:  "\u6BBA",
+	0xF971:  "\u8FB0",
+	0xF972:  "\u6C88",
+	0xF973:  "\u62FE",
+	0xF974:  "\u82E5",
+	0xF975:  "\u63A0",
+	0xF976:  "\u7565",
+	0xF977:  "\u4EAE",
+	0xF978:  "\u5169",
+	0xF979:  "\u51C9",
+	0xF97A:  "\u6881",
+	0xF97B:  "\u7CE7",
+	0xF97C:  "\u826F",
+	0xF97D:  "\u8AD2",
+	0xF97E:  "\u91CF",
+	0xF97F:  "\u52F5",
+	0xF980:  "\u5442",
+	0xF981:  "\u5973",
+	0xF982:  "\u5EEC",
+	0xF983:  "\u65C5",
+	0xF984:  "\u6FFE",
+	0xF985:  "\u792A",
+	0xF986:  "\u95AD",
+	0xF987:  "\u9A6A",
+	0xF988:  "\u9E97",
+	0xF989:  "\u9ECE",
+	0xF98A:  "\u529B",
+	0xF98B:  "\u66C6",
+	0xF98C:  "\u6B77",
+	0xF98D:  "\u8F62",
+	0xF98E:  "\u5E74",
+	0xF98F:  "\u6190",
+	0xF990:  "\u6200",
+	0xF991:  "\u649A",
+	0xF992:  "\u6F23",
+	0xF993:  "\u7149",
+	0xF994:  "\u7489",
+	0xF995:  "\u79CA",
+	0xF996:  "\u7DF4",
+	0xF997:  "\u806F",
+	0xF998:  "\u8F26",
+	0xF999:  "\u84EE",
+	0xF99A:  "\u9023",
+	0xF99B:  "\u934A",
+	0xF99C:  "\u5217",
+	0xF99D:  "\u52A3",
+	0xF99E:  "\u54BD",
+	0xF99F:  "\u70C8",
+	0xF9A0:  "\u88C2",
+	0xF9A1:  "\u8AAA",
+	0xF9A2:  "\u5EC9",
+	0xF9A3:  "\u5FF5",
+	0xF9A4:  "\u637B",
+	0xF9A5:  "\u6BAE",
+	0xF9A6:  "\u7C3E",
+	0xF9A7:  "\u7375",
+	0xF9A8:  "\u4EE4",
+	0xF9A9:  "\u56F9",
+	0xF9AA:  "\u5BE7",
+	0xF9AB:  "\u5DBA",
+	0xF9AC:  "\u601C",
+	0xF9AD:  "\u73B2",
+	0xF9AE:  "\u7469",
+	0xF9AF:  "\u7F9A",
+	0xF9B0:  "\u8046",
+	0xF9B1:  "\u9234",
+	0xF9B2:  "\u96F6",
+	0xF9B3:  "\u9748",
+	0xF9B4:  "\u9818",
+	0xF9B5:  "\u4F8B",
+	0xF9B6:  "\u79AE",
+	0xF9B7:  "\u91B4",
+	0xF9B8:  "\u96B8",
+	0xF9B9:  "\u60E1",
+	0xF9BA:  "\u4E86",
+	0xF9BB:  "\u50DA",
+	0xF9BC:  "\u5BEE",
+	0xF9BD:  "\u5C3F",
+	0xF9BE:  "\u6599",
+	0xF9BF:  "\u6A02",
+	0xF9C0:  "\u71CE",
+	0xF9C1:  "\u7642",
+	0xF9C2:  "\u84FC",
+	0xF9C3:  "\u907C",
+	0xF9C4:  "\u9F8D",
+	0xF9C5:  "\u6688",
+	0xF9C6:  "\u962E",
+	0xF9C7:  "\u5289",
+	0xF9C8:  "\u677B",
+	0xF9C9:  "\u67F3",
+	0xF9CA:  "\u6D41",
+	0xF9CB:  "\u6E9C",
+	0xF9CC:  "\u7409",
+	0xF9CD:  "\u7559",
+	0xF9CE:  "\u786B",
+	0xF9CF:  "\u7D10",
+	0xF9D0:  "\u985E",
+	0xF9D1:  "\u516D",
+	0xF9D2:  "\u622E",
+	0xF9D3:  "\u9678",
+	0xF9D4:  "\u502B",
+	0xF9D5:  "\u5D19",
+	0xF9D6:  "\u6DEA",
+	0xF9D7:  "\u8F2A",
+	0xF9D8:  "\u5F8B",
+	0xF9D9:  "\u6144",
+	0xF9DA:  "\u6817",
+	0xF9DB:  "\u7387",
+	0xF9DC:  "\u9686",
+	0xF9DD:  "\u5229",
+	0xF9DE:  "\u540F",
+	0xF9DF:  "\u5C65",
+	0xF9E0:  "\u6613",
+	0xF9E1:  "\u674E",
+	0xF9E2:  "\u68A8",
+	0xF9E3:  "\u6CE5",
+	0xF9E4:  "\u7406",
+	0xF9E5:  "\u75E2",
+	0xF9E6:  "\u7F79",
+	0xF9E7:  "\u88CF",
+	0xF9E8:  "\u88E1",
+	0xF9E9:  "\u91CC",
+	0xF9EA:  "\u96E2",
+	0xF9EB:  "\u533F",
+	0xF9EC:  "\u6EBA",
+	0xF9ED:  "\u541D",
+	0xF9EE:  "\u71D0",
+	0xF9EF:  "\u7498",
+	0xF9F0:  "\u85FA",
+	0xF9F1:  "\u96A3",
+	0xF9F2:  "\u9C57",
+	0xF9F3:  "\u9E9F",
+	0xF9F4:  "\u6797",
+	0xF9F5:  "\u6DCB",
+	0xF9F6:  "\u81E8",
+	0xF9F7:  "\u7ACB",
+	0xF9F8:  "\u7B20",
+	0xF9F9:  "\u7C92",
+	0xF9FA:  "\u72C0",
+	0xF9FB:  "\u7099",
+	0xF9FC:  "\u8B58",
+	0xF9FD:  "\u4EC0",
+	0xF9FE:  "\u8336",
+	0xF9FF:  "\u523A",
+	0xFA00:  "\u5207",
+	0xFA01:  "\u5EA6",
+	0xFA02:  "\u62D3",
+	0xFA03:  "\u7CD6",
+	0xFA04:  "\u5B85",
+	0xFA05:  "\u6D1E",
+	0xFA06:  "\u66B4",
+	0xFA07:  "\u8F3B",
+	0xFA08:  "\u884C",
+	0xFA09:  "\u964D",
+	0xFA0A:  "\u898B",
+	0xFA0B:  "\u5ED3",
+	0xFA0C:  "\u5140",
+	0xFA0D:  "\u55C0",
+	0xFA10:  "\u585A",
+	0xFA12:  "\u6674",
+	0xFA15:  "\u51DE",
+	0xFA16:  "\u732A",
+	0xFA17:  "\u76CA",
+	0xFA18:  "\u793C",
+	0xFA19:  "\u795E",
+	0xFA1A:  "\u7965",
+	0xFA1B:  "\u798F",
+	0xFA1C:  "\u9756",
+	0xFA1D:  "\u7CBE",
+	0xFA1E:  "\u7FBD",
+	0xFA20:  "\u8612",
+	0xFA22:  "\u8AF8",
+	0xFA25:  "\u9038",
+	0xFA26:  "\u90FD",
+	0xFA2A:  "\u98EF",
+	0xFA2B:  "\u98FC",
+	0xFA2C:  "\u9928",
+	0xFA2D:  "\u9DB4",
+	0xFA2E:  "\u90DE",
+	0xFA2F:  "\u96B7",
+	0xFA30:  "\u4FAE",
+	0xFA31:  "\u50E7",
+	0xFA32:  "\u514D",
+	0xFA33:  "\u52C9",
+	0xFA34:  "\u52E4",
+	0xFA35:  "\u5351",
+	0xFA36:  "\u559D",
+	0xFA37:  "\u5606",
+	0xFA38:  "\u5668",
+	0xFA39:  "\u5840",
+	0xFA3A:  "\u58A8",
+	0xFA3B:  "\u5C64",
+	0xFA3C:  "\u5C6E",
+	0xFA3D:  "\u6094",
+	0xFA3E:  "\u6168",
+	0xFA3F:  "\u618E",
+	0xFA40:  "\u61F2",
+	0xFA41:  "\u654F",
+	0xFA42:  "\u65E2",
+	0xFA43:  "\u6691",
+	0xFA44:  "\u6885",
+	0xFA45:  "\u6D77",
+	0xFA46:  "\u6E1A",
+	0xFA47:  "\u6F22",
+	0xFA48:  "\u716E",
+	0xFA49:  "\u722B",
+	0xFA4A:  "\u7422",
+	0xFA4B:  "\u7891",
+	0xFA4C:  "\u793E",
+	0xFA4D:  "\u7949",
+	0xFA4E:  "\u7948",
+	0xFA4F:  "\u7950",
+	0xFA50:  "\u7956",
+	0xFA51:  "\u795D",
+	0xFA52:  "\u798D",
+	0xFA53:  "\u798E",
+	0xFA54:  "\u7A40",
+	0xFA55:  "\u7A81",
+	0xFA56:  "\u7BC0",
+	0xFA57:  "\u7DF4",
+	0xFA58:  "\u7E09",
+	0xFA59:  "\u7E41",
+	0xFA5A:  "\u7F72",
+	0xFA5B:  "\u8005",
+	0xFA5C:  "\u81ED",
+	0xFA5D:  "\u8279",
+	0xFA5E:  "\u8279",
+	0xFA5F:  "\u8457",
+	0xFA60:  "\u8910",
+	0xFA61:  "\u8996",
+	0xFA62:  "\u8B01",
+	0xFA63:  "\u8B39",
+	0xFA64:  "\u8CD3",
+	0xFA65:  "\u8D08",
+	0xFA66:  "\u8FB6",
+	0xFA67:  "\u9038",
+	0xFA68:  "\u96E3",
+	0xFA69:  "\u97FF",
+	0xFA6A:  "\u983B",
+	0xFA6B:  "\u6075",
+	0xFA6C:  "\U000242EE",
+	0xFA6D:  "\u8218",
+	0xFA70:  "\u4E26",
+	0xFA71:  "\u51B5",
+	0xFA72:  "\u5168",
+	0xFA73:  "\u4F80",
+	0xFA74:  "\u5145",
+	0xFA75:  "\u5180",
+	0xFA76:  "\u52C7",
+	0xFA77:  "\u52FA",
+	0xFA78:  "\u559D",
+	0xFA79:  "\u5555",
+	0xFA7A:  "\u5599",
+	0xFA7B:  "\u55E2",
+	0xFA7C:  "\u585A",
+	0xFA7D:  "\u58B3",
+	0xFA7E:  "\u5944",
+	0xFA7F:  "\u5954",
+	0xFA80:  "\u5A62",
+	0xFA81:  "\u5B28",
+	0xFA82:  "\u5ED2",
+	0xFA83:  "\u5ED9",
+	0xFA84:  "\u5F69",
+	0xFA85:  "\u5FAD",
+	0xFA86:  "\u60D8",
+	0xFA87:  "\u614E",
+	0xFA88:  "\u6108",
+	0xFA89:  "\u618E",
+	0xFA8A:  "\u6160",
+	0xFA8B:  "\u61F2",
+	0xFA8C:  "\u6234",
+	0xFA8D:  "\u63C4",
+	0xFA8E:  "\u641C",
+	0xFA8F:  "\u6452",
+	0xFA90:  "\u6556",
+	0xFA91:  "\u6674",
+	0xFA92:  "\u6717",
+	0xFA93:  "\u671B",
+	0xFA94:  "\u6756",
+	0xFA95:  "\u6B79",
+	0xFA96:  "\u6BBA",
+	0xFA97:  "\u6D41",
+	0xFA98:  "\u6EDB",
+	0xFA99:  "\u6ECB",
+	0xFA9A:  "\u6F22",
+	0xFA9B:  "\u701E",
+	0xFA9C:  "\u716E",
+	0xFA9D:  "\u77A7",
+	0xFA9E:  "\u7235",
+	0xFA9F:  "\u72AF",
+	0xFAA0:  "\u732A",
+	0xFAA1:  "\u7471",
+	0xFAA2:  "\u7506",
+	0xFAA3:  "\u753B",
+	0xFAA4:  "\u761D",
+	0xFAA5:  "\u761F",
+	0xFAA6:  "\u76CA",
+	0xFAA7:  "\u76DB",
+	0xFAA8:  "\u76F4",
+	0xFAA9:  "\u774A",
+	0xFAAA:  "\u7740",
+	0xFAAB:  "\u78CC",
+	0xFAAC:  "\u7AB1",
+	0xFAAD:  "\u7BC0",
+	0xFAAE:  "\u7C7B",
+	0xFAAF:  "\u7D5B",
+	0xFAB0:  "\u7DF4",
+	0xFAB1:  "\u7F3E",
+	0xFAB2:  "\u8005",
+	0xFAB3:  "\u8352",
+	0xFAB4:  "\u83EF",
+	0xFAB5:  "\u8779",
+	0xFAB6:  "\u8941",
+	0xFAB7:  "\u8986",
+	0xFAB8:  "\u8996",
+	0xFAB9:  "\u8ABF",
+	0xFABA:  "\u8AF8",
+	0xFABB:  "\u8ACB",
+	0xFABC:  "\u8B01",
+	0xFABD:  "\u8AFE",
+	0xFABE:  "\u8AED",
+	0xFABF:  "\u8B39",
+	0xFAC0:  "\u8B8A",
+	0xFAC1:  "\u8D08",
+	0xFAC2:  "\u8F38",
+	0xFAC3:  "\u9072",
+	0xFAC4:  "\u9199",
+	0xFAC5:  "\u9276",
+	0xFAC6:  "\u967C",
+	0xFAC7:  "\u96E3",
+	0xFAC8:  "\u9756",
+	0xFAC9:  "\u97DB",
+	0xFACA:  "\u97FF",
+	0xFACB:  "\u980B",
+	0xFACC:  "\u983B",
+	0xFACD:  "\u9B12",
+	0xFACE:  "\u9F9C",
+	0xFACF:  "\U0002284A",
+	0xFAD0:  "\U00022844",
+	0xFAD1:  "\U000233D5",
+	0xFAD2:  "\u3B9D",
+	0xFAD3:  "\u4018",
+	0xFAD4:  "\u4039",
+	0xFAD5:  "\U00025249",
+	0xFAD6:  "\U00025CD0",
+	0xFAD7:  "\U00027ED3",
+	0xFAD8:  "\u9F43",
+	0xFAD9:  "\u9F8E",
+	0xFB1D:  "\u05D9\u05B4",
+	0xFB1F:  "\u05F2\u05B7",
+	0xFB2A:  "\u05E9\u05C1",
+	0xFB2B:  "\u05E9\u05C2",
+	0xFB2C:  "\u05E9\u05BC\u05C1",
+	0xFB2D:  "\u05E9\u05BC\u05C2",
+	0xFB2E:  "\u05D0\u05B7",
+	0xFB2F:  "\u05D0\u05B8",
+	0xFB30:  "\u05D0\u05BC",
+	0xFB31:  "\u05D1\u05BC",
+	0xFB32:  "\u05D2\u05BC",
+	0xFB33:  "\u05D3\u05BC",
+	0xFB34:  "\u05D4\u05BC",
+	0xFB35:  "\u05D5\u05BC",
+	0xFB36:  "\u05D6\u05BC",
+	0xFB38:  "\u05D8\u05BC",
+	0xFB39:  "\u05D9\u05BC",
+	0xFB3A:  "\u05DA\u05BC",
+	0xFB3B:  "\u05DB\u05BC",
+	0xFB3C:  "\u05DC\u05BC",
+	0xFB3E:  "\u05DE\u05BC",
+	0xFB40:  "\u05E0\u05BC",
+	0xFB41:  "\u05E1\u05BC",
+	0xFB43:  "\u05E3\u05BC",
+	0xFB44:  "\u05E4\u05BC",
+	0xFB46:  "\u05E6\u05BC",
+	0xFB47:  "\u05E7\u05BC",
+	0xFB48:  "\u05E8\u05BC",
+	0xFB49:  "\u05E9\u05BC",
+	0xFB4A:  "\u05EA\u05BC",
+	0xFB4B:  "\u05D5\u05B9",
+	0xFB4C:  "\u05D1\u05BF",
+	0xFB4D:  "\u05DB\u05BF",
+	0xFB4E:  "\u05E4\u05BF",
+	0x1109A: "\U00011099\U000110BA",
+	0x1109C: "\U0001109B\U000110BA",
+	0x110AB: "\U000110A5\U000110BA",
+	0x1112E: "\U00011131\U00011127",
+	0x1112F: "\U00011132\U00011127",
+	0x1134B: "\U00011347\U0001133E",
+	0x1134C: "\U00011347\U00011357",
+	0x114BB: "\U000114B9\U000114BA",
+	0x114BC: "\U000114B9\U000114B0",
+	0x114BE: "\U000114B9\U000114BD",
+	0x115BA: "\U000115B8\U000115AF",
+	0x115BB: "\U000115B9\U000115AF",
+	0x11938: "\U00011935\U00011930",
+	0x1D15E: "\U0001D157\U0001D165",
+	0x1D15F: "\U0001D158\U0001D165",
+	0x1D160: "\U0001D158\U0001D165\U0001D16E",
+	0x1D161: "\U0001D158\U0001D165\U0001D16F",
+	0x1D162: "\U0001D158\U0001D165\U0001D170",
+	0x1D163: "\U0001D158\U0001D165\U0001D171",
+	0x1D164: "\U0001D158\U0001D165\U0001D172",
+	0x1D1BB: "\U0001D1B9\U0001D165",
+	0x1D1BC: "\U0001D1BA\U0001D165",
+	0x1D1BD: "\U0001D1B9\U0001D165\U0001D16E",
+	0x1D1BE: "\U0001D1BA\U0001D165\U0001D16E",
+	0x1D1BF: "\U0001D1B9\U0001D165\U0001D16F",
+	0x1D1C0: "\U0001D1BA\U0001D165\U0001D16F",
+	0x2F800: "\u4E3D",
+	0x2F801: "\u4E38",
+	0x2F802: "\u4E41",
+	0x2F803: "\U00020122",
+	0x2F804: "\u4F60",
+	0x2F805: "\u4FAE",
+	0x2F806: "\u4FBB",
+	0x2F807: "\u5002",
+	0x2F808: "\u507A",
+	0x2F809: "\u5099",
+	0x2F80A: "\u50E7",
+	0x2F80B: "\u50CF",
+	0x2F80C: "\u349E",
+	0x2F80D: "\U0002063A",
+	0x2F80E: "\u514D",
+	0x2F80F: "\u5154",
+	0x2F810: "\u5164",
+	0x2F811: "\u5177",
+	0x2F812: "\U0002051C",
+	0x2F813: "\u34B9",
+	0x2F814: "\u5167",
+	0x2F815: "\u518D",
+	0x2F816: "\U0002054B",
+	0x2F817: "\u5197",
+	0x2F818: "\u51A4",
+	0x2F819: "\u4ECC",
+	0x2F81A: "\u51AC",
+	0x2F81B: "\u51B5",
+	0x2F81C: "\U000291DF",
+	0x2F81D: "\u51F5",
+	0x2F81E: "\u5203",
+	0x2F81F: "\u34DF",
+	0x2F820: "\u523B",
+	0x2F821: "\u5246",
+	0x2F822: "\u5272",
+	0x2F823: "\u5277",
+	0x2F824: "\u3515",
+	0x2F825: "\u52C7",
+	0x2F826: "\u52C9",
+	0x2F827: "\u52E4",
+	0x2F828: "\u52FA",
+	0x2F829: "\u5305",
+	0x2F82A: "\u5306",
+	0x2F82B: "\u5317",
+	0x2F82C: "\u5349",
+	0x2F82D: "\u5351",
+	0x2F82E: "\u535A",
+	0x2F82F: "\u5373",
+	0x2F830: "\u537D",
+	0x2F831: "\u537F",
+	0x2F832: "\u537F",
+	0x2F833: "\u537F",
+	0x2F834: "\U00020A2C",
+	0x2F835: "\u7070",
+	0x2F836: "\u53CA",
+	0x2F837: "\u53DF",
+	0x2F838: "\U00020B63",
+	0x2F839: "\u53EB",
+	0x2F83A: "\u53F1",
+	0x2F83B: "\u5406",
+	0x2F83C: "\u549E",
+	0x2F83D: "\u5438",
+	0x2F83E: "\u5448",
+	0x2F83F: "\u5468",
+	0x2F840: "\u54A2",
+	0x2F841: "\u54F6",
+	0x2F842: "\u5510",
+	0x2F843: "\u5553",
+	0x2F844: "\u5563",
+	0x2F845: "\u5584",
+	0x2F846: "\u5584",
+	0x2F847: "\u5599",
+	0x2F848: "\u55AB",
+	0x2F849: "\u55B3",
+	0x2F84A: "\u55C2",
+	0x2F84B: "\u5716",
+	0x2F84C: "\u5606",
+	0x2F84D: "\u5717",
+	0x2F84E: "\u5651",
+	0x2F84F: "\u5674",
+	0x2F850: "\u5207",
+	0x2F851: "\u58EE",
+	0x2F852: "\u57CE",
+	0x2F853: "\u57F4",
+	0x2F854: "\u580D",
+	0x2F855: "\u578B",
+	0x2F856: "\u5832",
+	0x2F857: "\u5831",
+	0x2F858: "\u58AC",
+	0x2F859: "\U000214E4",
+	0x2F85A: "\u58F2",
+	0x2F85B: "\u58F7",
+	0x2F85C: "\u5906",
+	0x2F85D: "\u591A",
+	0x2F85E: "\u5922",
+	0x2F85F: "\u5962",
+	0x2F860: "\U000216A8",
+	0x2F861: "\U000216EA",
+	0x2F862: "\u59EC",
+	0x2F863: "\u5A1B",
+	0x2F864: "\u5A27",
+	0x2F865: "\u59D8",
+	0x2F866: "\u5A66",
+	0x2F867: "\u36EE",
+	0x2F868: "\u36FC",
+	0x2F869: "\u5B08",
+	0x2F86A: "\u5B3E",
+	0x2F86B: "\u5B3E",
+	0x2F86C: "\U000219C8",
+	0x2F86D: "\u5BC3",
+	0x2F86E: "\u5BD8",
+	0x2F86F: "\u5BE7",
+	0x2F870: "\u5BF3",
+	0x2F871: "\U00021B18",
+	0x2F872: "\u5BFF",
+	0x2F873: "\u5C06",
+	0x2F874: "\u5F53",
+	0x2F875: "\u5C22",
+	0x2F876: "\u3781",
+	0x2F877: "\u5C60",
+	0x2F878: "\u5C6E",
+	0x2F879: "\u5CC0",
+	0x2F87A: "\u5C8D",
+	0x2F87B: "\U00021DE4",
+	0x2F87C: "\u5D43",
+	0x2F87D: "\U00021DE6",
+	0x2F87E: "\u5D6E",
+	0x2F87F: "\u5D6B",
+	0x2F880: "\u5D7C",
+	0x2F881: "\u5DE1",
+	0x2F882: "\u5DE2",
+	0x2F883: "\u382F",
+	0x2F884: "\u5DFD",
+	0x2F885: "\u5E28",
+	0x2F886: "\u5E3D",
+	0x2F887: "\u5E69",
+	0x2F888: "\u3862",
+	0x2F889: "\U00022183",
+	0x2F88A: "\u387C",
+	0x2F88B: "\u5EB0",
+	0x2F88C: "\u5EB3",
+	0x2F88D: "\u5EB6",
+	0x2F88E: "\u5ECA",
+	0x2F88F: "\U0002A392",
+	0x2F890: "\u5EFE",
+	0x2F891: "\U00022331",
+	0x2F892: "\U00022331",
+	0x2F893: "\u8201",
+	0x2F894: "\u5F22",
+	0x2F895: "\u5F22",
+	0x2F896: "\u38C7",
+	0x2F897: "\U000232B8",
+	0x2F898: "\U000261DA",
+	0x2F899: "\u5F62",
+	0x2F89A: "\u5F6B",
+	0x2F89B: "\u38E3",
+	0x2F89C: "\u5F9A",
+	0x2F89D: "\u5FCD",
+	0x2F89E: "\u5FD7",
+	0x2F89F: "\u5FF9",
+	0x2F8A0: "\u6081",
+	0x2F8A1: "\u393A",
+	0x2F8A2: "\u391C",
+	0x2F8A3: "\u6094",
+	0x2F8A4: "\U000226D4",
+	0x2F8A5: "\u60C7",
+	0x2F8A6: "\u6148",
+	0x2F8A7: "\u614C",
+	0x2F8A8: "\u614E",
+	0x2F8A9: "\u614C",
+	0x2F8AA: "\u617A",
+	0x2F8AB: "\u618E",
+	0x2F8AC: "\u61B2",
+	0x2F8AD: "\u61A4",
+	0x2F8AE: "\u61AF",
+	0x2F8AF: "\u61DE",
+	0x2F8B0: "\u61F2",
+	0x2F8B1: "\u61F6",
+	0x2F8B2: "\u6210",
+	0x2F8B3: "\u621B",
+	0x2F8B4: "\u625D",
+	0x2F8B5: "\u62B1",
+	0x2F8B6: "\u62D4",
+	0x2F8B7: "\u6350",
+	0x2F8B8: "\U00022B0C",
+	0x2F8B9: "\u633D",
+	0x2F8BA: "\u62FC",
+	0x2F8BB: "\u6368",
+	0x2F8BC: "\u6383",
+	0x2F8BD: "\u63E4",
+	0x2F8BE: "\U00022BF1",
+	0x2F8BF: "\u6422",
+	0x2F8C0: "\u63C5",
+	0x2F8C1: "\u63A9",
+	0x2F8C2: "\u3A2E",
+	0x2F8C3: "\u6469",
+	0x2F8C4: "\u647E",
+	0x2F8C5: "\u649D",
+	0x2F8C6: "\u6477",
+	0x2F8C7: "\u3A6C",
+	0x2F8C8: "\u654F",
+	0x2F8C9: "\u656C",
+	0x2F8CA: "\U0002300A",
+	0x2F8CB: "\u65E3",
+	0x2F8CC: "\u66F8",
+	0x2F8CD: "\u6649",
+	0x2F8CE: "\u3B19",
+	0x2F8CF: "\u6691",
+	0x2F8D0: "\u3B08",
+	0x2F8D1: "\u3AE4",
+	0x2F8D2: "\u5192",
+	0x2F8D3: "\u5195",
+	0x2F8D4: "\u6700",
+	0x2F8D5: "\u669C",
+	0x2F8D6: "\u80AD",
+	0x2F8D7: "\u43D9",
+	0x2F8D8: "\u6717",
+	0x2F8D9: "\u671B",
+	0x2F8DA: "\u6721",
+	0x2F8DB: "\u675E",
+	0x2F8DC: "\u6753",
+	0x2F8DD: "\U000233C3",
+	0x2F8DE: "\u3B49",
+	0x2F8DF: "\u67FA",
+	0x2F8E0: "\u6785",
+	0x2F8E1: "\u6852",
+	0x2F8E2: "\u6885",
+	0x2F8E3: "\U0002346D",
+	0x2F8E4: "\u688E",
+	0x2F8E5: "\u681F",
+	0x2F8E6: "\u6914",
+	0x2F8E7: "\u3B9D",
+	0x2F8E8: "\u6942",
+	0x2F8E9: "\u69A3",
+	0x2F8EA: "\u69EA",
+	0x2F8EB: "\u6AA8",
+	0x2F8EC: "\U000236A3",
+	0x2F8ED: "\u6ADB",
+	0x2F8EE: "\u3C18",
+	0x2F8EF: "\u6B21",
+	0x2F8F0: "\U000238A7",
+	0x2F8F1: "\u6B54",
+	0x2F8F2: "\u3C4E",
+	0x2F8F3: "\u6B72",
+	0x2F8F4: "\u6B9F",
+	0x2F8F5: "\u6BBA",
+	0x2F8F6: "\u6BBB",
+	0x2F8F7: "\U00023A8D",
+	0x2F8F8: "\U00021D0B",
+	0x2F8F9: "\U00023AFA",
+	0x2F8FA: "\u6C4E",
+	0x2F8FB: "\U00023CBC",
+	0x2F8FC: "\u6CBF",
+	0x2F8FD: "\u6CCD",
+	0x2F8FE: "\u6C67",
+	0x2F8FF: "\u6D16",
+	0x2F900: "\u6D3E",
+	0x2F901: "\u6D77",
+	0x2F902: "\u6D41",
+	0x2F903: "\u6D69",
+	0x2F904: "\u6D78",
+	0x2F905: "\u6D85",
+	0x2F906: "\U00023D1E",
+	0x2F907: "\u6D34",
+	0x2F908: "\u6E2F",
+	0x2F909: "\u6E6E",
+	0x2F90A: "\u3D33",
+	0x2F90B: "\u6ECB",
+	0x2F90C: "\u6EC7",
+	0x2F90D: "\U00023ED1",
+	0x2F90E: "\u6DF9",
+	0x2F90F: "\u6F6E",
+	0x2F910: "\U00023F5E",
+	0x2F911: "\U00023F8E",
+	0x2F912: "\u6FC6",
+	0x2F913: "\u7039",
+	0x2F914: "\u701E",
+	0x2F915: "\u701B",
+	0x2F916: "\u3D96",
+	0x2F917: "\u704A",
+	0x2F918: "\u707D",
+	0x2F919: "\u7077",
+	0x2F91A: "\u70AD",
+	0x2F91B: "\U00020525",
+	0x2F91C: "\u7145",
+	0x2F91D: "\U00024263",
+	0x2F91E: "\u719C",
+	0x2F91F: "\U000243AB",
+	0x2F920: "\u7228",
+	0x2F921: "\u7235",
+	0x2F922: "\u7250",
+	0x2F923: "\U00024608",
+	0x2F924: "\u7280",
+	0x2F925: "\u7295",
+	0x2F926: "\U00024735",
+	0x2F927: "\U00024814",
+	0x2F928: "\u737A",
+	0x2F929: "\u738B",
+	0x2F92A: "\u3EAC",
+	0x2F92B: "\u73A5",
+	0x2F92C: "\u3EB8",
+	0x2F92D: "\u3EB8",
+	0x2F92E: "\u7447",
+	0x2F92F: "\u745C",
+	0x2F930: "\u7471",
+	0x2F931: "\u7485",
+	0x2F932: "\u74CA",
+	0x2F933: "\u3F1B",
+	0x2F934: "\u7524",
+	0x2F935: "\U00024C36",
+	0x2F936: "\u753E",
+	0x2F937: "\U00024C92",
+	0x2F938: "\u7570",
+	0x2F939: "\U0002219F",
+	0x2F93A: "\u7610",
+	0x2F93B: "\U00024FA1",
+	0x2F93C: "\U00024FB8",
+	0x2F93D: "\U00025044",
+	0x2F93E: "\u3FFC",
+	0x2F93F: "\u4008",
+	0x2F940: "\u76F4",
+	0x2F941: "\U000250F3",
+	0x2F942: "\U000250F2",
+	0x2F943: "\U00025119",
+	0x2F944: "\U00025133",
+	0x2F945: "\u771E",
+	0x2F946: "\u771F",
+	0x2F947: "\u771F",
+	0x2F948: "\u774A",
+	0x2F949: "\u4039",
+	0x2F94A: "\u778B",
+	0x2F94B: "\u4046",
+	0x2F94C: "\u4096",
+	0x2F94D: "\U0002541D",
+	0x2F94E: "\u784E",
+	0x2F94F: "\u788C",
+	0x2F950: "\u78CC",
+	0x2F951: "\u40E3",
+	0x2F952: "\U00025626",
+	0x2F953: "\u7956",
+	0x2F954: "\U0002569A",
+	0x2F955: "\U000256C5",
+	0x2F956: "\u798F",
+	0x2F957: "\u79EB",
+	0x2F958: "\u412F",
+	0x2F959: "\u7A40",
+	0x2F95A: "\u7A4A",
+	0x2F95B: "\u7A4F",
+	0x2F95C: "\U0002597C",
+	0x2F95D: "\U00025AA7",
+	0x2F95E: "\U00025AA7",
+	0x2F95F: "\u7AEE",
+	0x2F960: "\u4202",
+	0x2F961: "\U00025BAB",
+	0x2F962: "\u7BC6",
+	0x2F963: "\u7BC9",
+	0x2F964: "\u4227",
+	0x2F965: "\U00025C80",
+	0x2F966: "\u7CD2",
+	0x2F967: "\u42A0",
+	0x2F968: "\u7CE8",
+	0x2F969: "\u7CE3",
+	0x2F96A: "\u7D00",
+	0x2F96B: "\U00025F86",
+	0x2F96C: "\u7D63",
+	0x2F96D: "\u4301",
+	0x2F96E: "\u7DC7",
+	0x2F96F: "\u7E02",
+	0x2F970: "\u7E45",
+	0x2F971: "\u4334",
+	0x2F972: "\U00026228",
+	0x2F973: "\U00026247",
+	0x2F974: "\u4359",
+	0x2F975: "\U000262D9",
+	0x2F976: "\u7F7A",
+	0x2F977: "\U0002633E",
+	0x2F978: "\u7F95",
+	0x2F979: "\u7FFA",
+	0x2F97A: "\u8005",
+	0x2F97B: "\U000264DA",
+	0x2F97C: "\U00026523",
+	0x2F97D: "\u8060",
+	0x2F97E: "\U000265A8",
+	0x2F97F: "\u8070",
+	0x2F980: "\U0002335F",
+	0x2F981: "\u43D5",
+	0x2F982: "\u80B2",
+	0x2F983: "\u8103",
+	0x2F984: "\u440B",
+	0x2F985: "\u813E",
+	0x2F986: "\u5AB5",
+	0x2F987: "\U000267A7",
+	0x2F988: "\U000267B5",
+	0x2F989: "\U00023393",
+	0x2F98A: "\U0002339C",
+	0x2F98B: "\u8201",
+	0x2F98C: "\u8204",
+	0x2F98D: "\u8F9E",
+	0x2F98E: "\u446B",
+	0x2F98F: "\u8291",
+	0x2F990: "\u828B",
+	0x2F991: "\u829D",
+	0x2F992: "\u52B3",
+	0x2F993: "\u82B1",
+	0x2F994: "\u82B3",
+	0x2F995: "\u82BD",
+	0x2F996: "\u82E6",
+	0x2F997: "\U00026B3C",
+	0x2F998: "\u82E5",
+	0x2F999: "\u831D",
+	0x2F99A: "\u8363",
+	0x2F99B: "\u83AD",
+	0x2F99C: "\u8323",
+	0x2F99D: "\u83BD",
+	0x2F99E: "\u83E7",
+	0x2F99F: "\u8457",
+	0x2F9A0: "\u8353",
+	0x2F9A1: "\u83CA",
+	0x2F9A2: "\u83CC",
+	0x2F9A3: "\u83DC",
+	0x2F9A4: "\U00026C36",
+	0x2F9A5: "\U00026D6B",
+	0x2F9A6: "\U00026CD5",
+	0x2F9A7: "\u452B",
+	0x2F9A8: "\u84F1",
+	0x2F9A9: "\u84F3",
+	0x2F9AA: "\u8516",
+	0x2F9AB: "\U000273CA",
+	0x2F9AC: "\u8564",
+	0x2F9AD: "\U00026F2C",
+	0x2F9AE: "\u455D",
+	0x2F9AF: "\u4561",
+	0x2F9B0: "\U00026FB1",
+	0x2F9B1: "\U000270D2",
+	0x2F9B2: "\u456B",
+	0x2F9B3: "\u8650",
+	0x2F9B4: "\u865C",
+	0x2F9B5: "\u8667",
+	0x2F9B6: "\u8669",
+	0x2F9B7: "\u86A9",
+	0x2F9B8: "\u8688",
+	0x2F9B9: "\u870E",
+	0x2F9BA: "\u86E2",
+	0x2F9BB: "\u8779",
+	0x2F9BC: "\u8728",
+	0x2F9BD: "\u876B",
+	0x2F9BE: "\u8786",
+	0x2F9BF: "\u45D7",
+	0x2F9C0: "\u87E1",
+	0x2F9C1: "\u8801",
+	0x2F9C2: "\u45F9",
+	0x2F9C3: "\u8860",
+	0x2F9C4: "\u8863",
+	0x2F9C5: "\U00027667",
+	0x2F9C6: "\u88D7",
+	0x2F9C7: "\u88DE",
+	0x2F9C8: "\u4635",
+	0x2F9C9: "\u88FA",
+	0x2F9CA: "\u34BB",
+	0x2F9CB: "\U000278AE",
+	0x2F9CC: "\U00027966",
+	0x2F9CD: "\u46BE",
+	0x2F9CE: "\u46C7",
+	0x2F9CF: "\u8AA0",
+	0x2F9D0: "\u8AED",
+	0x2F9D1: "\u8B8A",
+	0x2F9D2: "\u8C55",
+	0x2F9D3: "\U00027CA8",
+	0x2F9D4: "\u8CAB",
+	0x2F9D5: "\u8CC1",
+	0x2F9D6: "\u8D1B",
+	0x2F9D7: "\u8D77",
+	0x2F9D8: "\U00027F2F",
+	0x2F9D9: "\U00020804",
+	0x2F9DA: "\u8DCB",
+	0x2F9DB: "\u8DBC",
+	0x2F9DC: "\u8DF0",
+	0x2F9DD: "\U000208DE",
+	0x2F9DE: "\u8ED4",
+	0x2F9DF: "\u8F38",
+	0x2F9E0: "\U000285D2",
+	0x2F9E1: "\U000285ED",
+	0x2F9E2: "\u9094",
+	0x2F9E3: "\u90F1",
+	0x2F9E4: "\u9111",
+	0x2F9E5: "\U0002872E",
+	0x2F9E6: "\u911B",
+	0x2F9E7: "\u9238",
+	0x2F9E8: "\u92D7",
+	0x2F9E9: "\u92D8",
+	0x2F9EA: "\u927C",
+	0x2F9EB: "\u93F9",
+	0x2F9EC: "\u9415",
+	0x2F9ED: "\U00028BFA",
+	0x2F9EE: "\u958B",
+	0x2F9EF: "\u4995",
+	0x2F9F0: "\u95B7",
+	0x2F9F1: "\U00028D77",
+	0x2F9F2: "\u49E6",
+	0x2F9F3: "\u96C3",
+	0x2F9F4: "\u5DB2",
+	0x2F9F5: "\u9723",
+	0x2F9F6: "\U00029145",
+	0x2F9F7: "\U0002921A",
+	0x2F9F8: "\u4A6E",
+	0x2F9F9: "\u4A76",
+	0x2F9FA: "\u97E0",
+	0x2F9FB: "\U0002940A",
+	0x2F9FC: "\u4AB2",
+	0x2F9FD: "\U00029496",
+	0x2F9FE: "\u980B",
+	0x2F9FF: "\u980B",
+	0x2FA00: "\u9829",
+	0x2FA01: "\U000295B6",
+	0x2FA02: "\u98E2",
+	0x2FA03: "\u4B33",
+	0x2FA04: "\u9929",
+	0x2FA05: "\u99A7",
+	0x2FA06: "\u99C2",
+	0x2FA07: "\u99FE",
+	0x2FA08: "\u4BCE",
+	0x2FA09: "\U00029B30",
+	0x2FA0A: "\u9B12",
+	0x2FA0B: "\u9C40",
+	0x2FA0C: "\u9CFD",
+	0x2FA0D: "\u4CCE",
+	0x2FA0E: "\u4CED",
+	0x2FA0F: "\u9D67",
+	0x2FA10: "\U0002A0CE",
+	0x2FA11: "\u4CF8",
+	0x2FA12: "\U0002A105",
+	0x2FA13: "\U0002A20E",
+	0x2FA14: "\U0002A291",
+	0x2FA15: "\u9EBB",
+	0x2FA16: "\u4D56",
+	0x2FA17: "\u9EF9",
+	0x2FA18: "\u9EFE",
+	0x2FA19: "\u9F05",
+	0x2FA1A: "\u9F0F",
+	0x2FA1B: "\u9F16",
+	0x2FA1C: "\u9F3B",
+	0x2FA1D: "\U0002A600",
+}
+
+// combiningClasses holds the canonical combining class of every rune that
+// has a non-zero one
+var combiningClasses = map[rune]uint8{
+	0x0300:  230,
+	0x0301:  230,
+	0x0302:  230,
+	0x0303:  230,
+	0x0304:  230,
+	0x0305:  230,
+	0x0306:  230,
+	0x0307:  230,
+	0x0308:  230,
+	0x0309:  230,
+	0x030A:  230,
+	0x030B:  230,
+	0x030C:  230,
+	0x030D:  230,
+	0x030E:  230,
+	0x030F:  230,
+	0x0310:  230,
+	0x0311:  230,
+	0x0312:  230,
+	0x0313:  230,
+	0x0314:  230,
+	0x0315:  232,
+	0x0316:  220,
+	0x0317:  220,
+	0x0318:  220,
+	0x0319:  220,
+	0x031A:  232,
+	0x031B:  216,
+	0x031C:  220,
+	0x031D:  220,
+	0x031E:  220,
+	0x031F:  220,
+	0x0320:  220,
+	0x0321:  202,
+	0x0322:  202,
+	0x0323:  220,
+	0x0324:  220,
+	0x0325:  220,
+	0x0326:  220,
+	0x0327:  202,
+	0x0328:  202,
+	0x0329:  220,
+	0x032A:  220,
+	0x032B:  220,
+	0x032C:  220,
+	0x032D:  220,
+	0x032E:  220,
+	0x032F:  220,
+	0x0330:  220,
+	0x0331:  220,
+	0x0332:  220,
+	0x0333:  220,
+	0x0334:  1,
+	0x0335:  1,
+	0x0336:  1,
+	0x0337:  1,
+	0x0338:  1,
+	0x0339:  220,
+	0x033A:  220,
+	0x033B:  220,
+	0x033C:  220,
+	0x033D:  230,
+	0x033E:  230,
+	0x033F:  230,
+	0x0340:  230,
+	0x0341:  230,
+	0x0342:  230,
+	0x0343:  230,
+	0x0344:  230,
+	0x0345:  240,
+	0x0346:  230,
+	0x0347:  220,
+	0x0348:  220,
+	0x0349:  220,
+	0x034A:  230,
+	0x034B:  230,
+	0x034C:  230,
+	0x034D:  220,
+	0x034E:  220,
+	0x0350:  230,
+	0x0351:  230,
+	0x0352:  230,
+	0x0353:  220,
+	0x0354:  220,
+	0x0355:  220,
+	0x0356:  220,
+	0x0357:  230,
+	0x0358:  232,
+	0x0359:  220,
+	0x035A:  220,
+	0x035B:  230,
+	0x035C:  233,
+	0x035D:  234,
+	0x035E:  234,
+	0x035F:  233,
+	0x0360:  234,
+	0x0361:  234,
+	0x0362:  233,
+	0x0363:  230,
+	0x0364:  230,
+	0x0365:  230,
+	0x0366:  230,
+	0x0367:  230,
+	0x0368:  230,
+	0x0369:  230,
+	0x036A:  230,
+	0x036B:  230,
+	0x036C:  230,
+	0x036D:  230,
+	0x036E:  230,
+	0x036F:  230,
+	0x0483:  230,
+	0x0484:  230,
+	0x0485:  230,
+	0x0486:  230,
+	0x0487:  230,
+	0x0591:  220,
+	0x0592:  230,
+	0x0593:  230,
+	0x0594:  230,
+	0x0595:  230,
+	0x0596:  220,
+	0x0597:  230,
+	0x0598:  230,
+	0x0599:  230,
+	0x059A:  222,
+	0x059B:  220,
+	0x059C:  230,
+	0x059D:  230,
+	0x059E:  230,
+	0x059F:  230,
+	0x05A0:  230,
+	0x05A1:  230,
+	0x05A2:  220,
+	0x05A3:  220,
+	0x05A4:  220,
+	0x05A5:  220,
+	0x05A6:  220,
+	0x05A7:  220,
+	0x05A8:  230,
+	0x05A9:  230,
+	0x05AA:  220,
+	0x05AB:  230,
+	0x05AC:  230,
+	0x05AD:  222,
+	0x05AE:  228,
+	0x05AF:  230,
+	0x05B0:  10,
+	0x05B1:  11,
+	0x05B2:  12,
+	0x05B3:  13,
+	0x05B4:  14,
+	0x05B5:  15,
+	0x05B6:  16,
+	0x05B7:  17,
+	0x05B8:  18,
+	0x05B9:  19,
+	0x05BA:  19,
+	0x05BB:  20,
+	0x05BC:  21,
+	0x05BD:  22,
+	0x05BF:  23,
+	0x05C1:  24,
+	0x05C2:  25,
+	0x05C4:  230,
+	0x05C5:  220,
+	0x05C7:  18,
+	0x0610:  230,
+	0x0611:  230,
+	0x0612:  230,
+	0x0613:  230,
+	0x0614:  230,
+	0x0615:  230,
+	0x0616:  230,
+	0x0617:  230,
+	0x0618:  30,
+	0x0619:  31,
+	0x061A:  32,
+	0x064B:  27,
+	0x064C:  28,
+	0x064D:  29,
+	0x064E:  30,
+	0x064F:  31,
+	0x0650:  32,
+	0x0651:  33,
+	0x0652:  34,
+	0x0653:  230,
+	0x0654:  230,
+	0x0655:  220,
+	0x0656:  220,
+	0x0657:  230,
+	0x0658:  230,
+	0x0659:  230,
+	0x065A:  230,
+	0x065B:  230,
+	0x065C:  220,
+	0x065D:  230,
+	0x065E:  230,
+	0x065F:  220,
+	0x0670:  35,
+	0x06D6:  230,
+	0x06D7:  230,
+	0x06D8:  230,
+	0x06D9:  230,
+	0x06DA:  230,
+	0x06DB:  230,
+	0x06DC:  230,
+	0x06DF:  230,
+	0x06E0:  230,
+	0x06E1:  230,
+	0x06E2:  230,
+	0x06E3:  220,
+	0x06E4:  230,
+	0x06E7:  230,
+	0x06E8:  230,
+	0x06EA:  220,
+	0x06EB:  230,
+	0x06EC:  230,
+	0x06ED:  220,
+	0x0711:  36,
+	0x0730:  230,
+	0x0731:  220,
+	0x0732:  230,
+	0x0733:  230,
+	0x0734:  220,
+	0x0735:  230,
+	0x0736:  230,
+	0x0737:  220,
+	0x0738:  220,
+	0x0739:  220,
+	0x073A:  230,
+	0x073B:  220,
+	0x073C:  220,
+	0x073D:  230,
+	0x073E:  220,
+	0x073F:  230,
+	0x0740:  230,
+	0x0741:  230,
+	0x0742:  220,
+	0x0743:  230,
+	0x0744:  220,
+	0x0745:  230,
+	0x0746:  220,
+	0x0747:  230,
+	0x0748:  220,
+	0x0749:  230,
+	0x074A:  230,
+	0x07EB:  230,
+	0x07EC:  230,
+	0x07ED:  230,
+	0x07EE:  230,
+	0x07EF:  230,
+	0x07F0:  230,
+	0x07F1:  230,
+	0x07F2:  220,
+	0x07F3:  230,
+	0x07FD:  220,
+	0x0816:  230,
+	0x0817:  230,
+	0x0818:  230,
+	0x0819:  230,
+	0x081B:  230,
+	0x081C:  230,
+	0x081D:  230,
+	0x081E:  230,
+	0x081F:  230,
+	0x0820:  230,
+	0x0821:  230,
+	0x0822:  230,
+	0x0823:  230,
+	0x0825:  230,
+	0x0826:  230,
+	0x0827:  230,
+	0x0829:  230,
+	0x082A:  230,
+	0x082B:  230,
+	0x082C:  230,
+	0x082D:  230,
+	0x0859:  220,
+	0x085A:  220,
+	0x085B:  220,
+	0x0898:  230,
+	0x0899:  220,
+	0x089A:  220,
+	0x089B:  220,
+	0x089C:  230,
+	0x089D:  230,
+	0x089E:  230,
+	0x089F:  230,
+	0x08CA:  230,
+	0x08CB:  230,
+	0x08CC:  230,
+	0x08CD:  230,
+	0x08CE:  230,
+	0x08CF:  220,
+	0x08D0:  220,
+	0x08D1:  220,
+	0x08D2:  220,
+	0x08D3:  220,
+	0x08D4:  230,
+	0x08D5:  230,
+	0x08D6:  230,
+	0x08D7:  230,
+	0x08D8:  230,
+	0x08D9:  230,
+	0x08DA:  230,
+	0x08DB:  230,
+	0x08DC:  230,
+	0x08DD:  230,
+	0x08DE:  230,
+	0x08DF:  230,
+	0x08E0:  230,
+	0x08E1:  230,
+	0x08E3:  220,
+	0x08E4:  230,
+	0x08E5:  230,
+	0x08E6:  220,
+	0x08E7:  230,
+	0x08E8:  230,
+	0x08E9:  220,
+	0x08EA:  230,
+	0x08EB:  230,
+	0x08EC:  230,
+	0x08ED:  220,
+	0x08EE:  220,
+	0x08EF:  220,
+	0x08F0:  27,
+	0x08F1:  28,
+	0x08F2:  29,
+	0x08F3:  230,
+	0x08F4:  230,
+	0x08F5:  230,
+	0x08F6:  220,
+	0x08F7:  230,
+	0x08F8:  230,
+	0x08F9:  220,
+	0x08FA:  220,
+	0x08FB:  230,
+	0x08FC:  230,
+	0x08FD:  230,
+	0x08FE:  230,
+	0x08FF:  230,
+	0x093C:  7,
+	0x094D:  9,
+	0x0951:  230,
+	0x0952:  220,
+	0x0953:  230,
+	0x0954:  230,
+	0x09BC:  7,
+	0x09CD:  9,
+	0x09FE:  230,
+	0x0A3C:  7,
+	0x0A4D:  9,
+	0x0ABC:  7,
+	0x0ACD:  9,
+	0x0B3C:  7,
+	0x0B4D:  9,
+	0x0BCD:  9,
+	0x0C3C:  7,
+	0x0C4D:  9,
+	0x0C55:  84,
+	0x0C56:  91,
+	0x0CBC:  7,
+	0x0CCD:  9,
+	0x0D3B:  9,
+	0x0D3C:  9,
+	0x0D4D:  9,
+	0x0DCA:  9,
+	0x0E38:  103,
+	0x0E39:  103,
+	0x0E3A:  9,
+	0x0E48:  107,
+	0x0E49:  107,
+	0x0E4A:  107,
+	0x0E4B:  107,
+	0x0EB8:  118,
+	0x0EB9:  118,
+	0x0EBA:  9,
+	0x0EC8:  122,
+	0x0EC9:  122,
+	0x0ECA:  122,
+	0x0ECB:  122,
+	0x0F18:  220,
+	0x0F19:  220,
+	0x0F35:  220,
+	0x0F37:  220,
+	0x0F39:  216,
+	0x0F71:  129,
+	0x0F72:  130,
+	0x0F74:  132,
+	0x0F7A:  130,
+	0x0F7B:  130,
+	0x0F7C:  130,
+	0x0F7D:  130,
+	0x0F80:  130,
+	0x0F82:  230,
+	0x0F83:  230,
+	0x0F84:  9,
+	0x0F86:  230,
+	0x0F87:  230,
+	0x0FC6:  220,
+	0x1037:  7,
+	0x1039:  9,
+	0x103A:  9,
+	0x108D:  220,
+	0x135D:  230,
+	0x135E:  230,
+	0x135F:  230,
+	0x1714:  9,
+	0x1715:  9,
+	0x1734:  9,
+	0x17D2:  9,
+	0x17DD:  230,
+	0x18A9:  228,
+	0x1939:  222,
+	0x193A:  230,
+	0x193B:  220,
+	0x1A17:  230,
+	0x1A18:  220,
+	0x1A60:  9,
+	0x1A75:  230,
+	0x1A76:  230,
+	0x1A77:  230,
+	0x1A78:  230,
+	0x1A79:  230,
+	0x1A7A:  230,
+	0x1A7B:  230,
+	0x1A7C:  230,
+	0x1A7F:  220,
+	0x1AB0:  230,
+	0x1AB1:  230,
+	0x1AB2:  230,
+	0x1AB3:  230,
+	0x1AB4:  230,
+	0x1AB5:  220,
+	0x1AB6:  220,
+	0x1AB7:  220,
+	0x1AB8:  220,
+	0x1AB9:  220,
+	0x1ABA:  220,
+	0x1ABB:  230,
+	0x1ABC:  230,
+	0x1ABD:  220,
+	0x1ABF:  220,
+	0x1AC0:  220,
+	0x1AC1:  230,
+	0x1AC2:  230,
+	0x1AC3:  220,
+	0x1AC4:  220,
+	0x1AC5:  230,
+	0x1AC6:  230,
+	0x1AC7:  230,
+	0x1AC8:  230,
+	0x1AC9:  230,
+	0x1ACA:  220,
+	0x1ACB:  230,
+	0x1ACC:  230,
+	0x1ACD:  230,
+	0x1ACE:  230,
+	0x1B34:  7,
+	0x1B44:  9,
+	0x1B6B:  230,
+	0x1B6C:  220,
+	0x1B6D:  230,
+	0x1B6E:  230,
+	0x1B6F:  230,
+	0x1B70:  230,
+	0x1B71:  230,
+	0x1B72:  230,
+	0x1B73:  230,
+	0x1BAA:  9,
+	0x1BAB:  9,
+	0x1BE6:  7,
+	0x1BF2:  9,
+	0x1BF3:  9,
+	0x1C37:  7,
+	0x1CD0:  230,
+	0x1CD1:  230,
+	0x1CD2:  230,
+	0x1CD4:  1,
+	0x1CD5:  220,
+	0x1CD6:  220,
+	0x1CD7:  220,
+	0x1CD8:  220,
+	0x1CD9:  220,
+	0x1CDA:  230,
+	0x1CDB:  230,
+	0x1CDC:  220,
+	0x1CDD:  220,
+	0x1CDE:  220,
+	0x1CDF:  220,
+	0x1CE0:  230,
+	0x1CE2:  1,
+	0x1CE3:  1,
+	0x1CE4:  1,
+	0x1CE5:  1,
+	0x1CE6:  1,
+	0x1CE7:  1,
+	0x1CE8:  1,
+	0x1CED:  220,
+	0x1CF4:  230,
+	0x1CF8:  230,
+	0x1CF9:  230,
+	0x1DC0:  230,
+	0x1DC1:  230,
+	0x1DC2:  220,
+	0x1DC3:  230,
+	0x1DC4:  230,
+	0x1DC5:  230,
+	0x1DC6:  230,
+	0x1DC7:  230,
+	0x1DC8:  230,
+	0x1DC9:  230,
+	0x1DCA:  220,
+	0x1DCB:  230,
+	0x1DCC:  230,
+	0x1DCD:  234,
+	0x1DCE:  214,
+	0x1DCF:  220,
+	0x1DD0:  202,
+	0x1DD1:  230,
+	0x1DD2:  230,
+	0x1DD3:  230,
+	0x1DD4:  230,
+	0x1DD5:  230,
+	0x1DD6:  230,
+	0x1DD7:  230,
+	0x1DD8:  230,
+	0x1DD9:  230,
+	0x1DDA:  230,
+	0x1DDB:  230,
+	0x1DDC:  230,
+	0x1DDD:  230,
+	0x1DDE:  230,
+	0x1DDF:  230,
+	0x1DE0:  230,
+	0x1DE1:  230,
+	0x1DE2:  230,
+	0x1DE3:  230,
+	0x1DE4:  230,
+	0x1DE5:  230,
+	0x1DE6:  230,
+	0x1DE7:  230,
+	0x1DE8:  230,
+	0x1DE9:  230,
+	0x1DEA:  230,
+	0x1DEB:  230,
+	0x1DEC:  230,
+	0x1DED:  230,
+	0x1DEE:  230,
+	0x1DEF:  230,
+	0x1DF0:  230,
+	0x1DF1:  230,
+	0x1DF2:  230,
+	0x1DF3:  230,
+	0x1DF4:  230,
+	0x1DF5:  230,
+	0x1DF6:  232,
+	0x1DF7:  228,
+	0x1DF8:  228,
+	0x1DF9:  220,
+	0x1DFA:  218,
+	0x1DFB:  230,
+	0x1DFC:  233,
+	0x1DFD:  220,
+	0x1DFE:  230,
+	0x1DFF:  220,
+	0x20D0:  230,
+	0x20D1:  230,
+	0x20D2:  1,
+	0x20D3:  1,
+	0x20D4:  230,
+	0x20D5:  230,
+	0x20D6:  230,
+	0x20D7:  230,
+	0x20D8:  1,
+	0x20D9:  1,
+	0x20DA:  1,
+	0x20DB:  230,
+	0x20DC:  230,
+	0x20E1:  230,
+	0x20E5:  1,
+	0x20E6:  1,
+	0x20E7:  230,
+	0x20E8:  220,
+	0x20E9:  230,
+	0x20EA:  1,
+	0x20EB:  1,
+	0x20EC:  220,
+	0x20ED:  220,
+	0x20EE:  220,
+	0x20EF:  220,
+	0x20F0:  230,
+	0x2CEF:  230,
+	0x2CF0:  230,
+	0x2CF1:  230,
+	0x2D7F:  9,
+	0x2DE0:  230,
+	0x2DE1:  230,
+	0x2DE2:  230,
+	0x2DE3:  230,
+	0x2DE4:  230,
+	0x2DE5:  230,
+	0x2DE6:  230,
+	0x2DE7:  230,
+	0x2DE8:  230,
+	0x2DE9:  230,
+	0x2DEA:  230,
+	0x2DEB:  230,
+	0x2DEC:  230,
+	0x2DED:  230,
+	0x2DEE:  230,
+	0x2DEF:  230,
+	0x2DF0:  230,
+	0x2DF1:  230,
+	0x2DF2:  230,
+	0x2DF3:  230,
+	0x2DF4:  230,
+	0x2DF5:  230,
+	0x2DF6:  230,
+	0x2DF7:  230,
+	0x2DF8:  230,
+	0x2DF9:  230,
+	0x2DFA:  230,
+	0x2DFB:  230,
+	0x2DFC:  230,
+	0x2DFD:  230,
+	0x2DFE:  230,
+	0x2DFF:  230,
+	0x302A:  218,
+	0x302B:  228,
+	0x302C:  232,
+	0x302D:  222,
+	0x302E:  224,
+	0x302F:  224,
+	0x3099:  8,
+	0x309A:  8,
+	0xA66F:  230,
+	0xA674:  230,
+	0xA675:  230,
+	0xA676:  230,
+	0xA677:  230,
+	0xA678:  230,
+	0xA679:  230,
+	0xA67A:  230,
+	0xA67B:  230,
+	0xA67C:  230,
+	0xA67D:  230,
+	0xA69E:  230,
+	0xA69F:  230,
+	0xA6F0:  230,
+	0xA6F1:  230,
+	0xA806:  9,
+	0xA82C:  9,
+	0xA8C4:  9,
+	0xA8E0:  230,
+	0xA8E1:  230,
+	0xA8E2:  230,
+	0xA8E3:  230,
+	0xA8E4:  230,
+	0xA8E5:  230,
+	0xA8E6:  230,
+	0xA8E7:  230,
+	0xA8E8:  230,
+	0xA8E9:  230,
+	0xA8EA:  230,
+	0xA8EB:  230,
+	0xA8EC:  230,
+	0xA8ED:  230,
+	0xA8EE:  230,
+	0xA8EF:  230,
+	0xA8F0:  230,
+	0xA8F1:  230,
+	0xA92B:  220,
+	0xA92C:  220,
+	0xA92D:  220,
+	0xA953:  9,
+	0xA9B3:  7,
+	0xA9C0:  9,
+	0xAAB0:  230,
+	0xAAB2:  230,
+	0xAAB3:  230,
+	0xAAB4:  220,
+	0xAAB7:  230,
+	0xAAB8:  230,
+	0xAABE:  230,
+	0xAABF:  230,
+	0xAAC1:  230,
+	0xAAF6:  9,
+	0xABED:  9,
+	0xFB1E:  26,
+	0xFE20:  230,
+	0xFE21:  230,
+	0xFE22:  230,
+	0xFE23:  230,
+	0xFE24:  230,
+	0xFE25:  230,
+	0xFE26:  230,
+	0xFE27:  220,
+	0xFE28:  220,
+	0xFE29:  220,
+	0xFE2A:  220,
+	0xFE2B:  220,
+	0xFE2C:  220,
+	0xFE2D:  220,
+	0xFE2E:  230,
+	0xFE2F:  230,
+	0x101FD: 220,
+	0x102E0: 220,
+	0x10376: 230,
+	0x10377: 230,
+	0x10378: 230,
+	0x10379: 230,
+	0x1037A: 230,
+	0x10A0D: 220,
+	0x10A0F: 230,
+	0x10A38: 230,
+	0x10A39: 1,
+	0x10A3A: 220,
+	0x10A3F: 9,
+	0x10AE5: 230,
+	0x10AE6: 220,
+	0x10D24: 230,
+	0x10D25: 230,
+	0x10D26: 230,
+	0x10D27: 230,
+	0x10EAB: 230,
+	0x10EAC: 230,
+	0x10F46: 220,
+	0x10F47: 220,
+	0x10F48: 230,
+	0x10F49: 230,
+	0x10F4A: 230,
+	0x10F4B: 220,
+	0x10F4C: 230,
+	0x10F4D: 220,
+	0x10F4E: 220,
+	0x10F4F: 220,
+	0x10F50: 220,
+	0x10F82: 230,
+	0x10F83: 220,
+	0x10F84: 230,
+	0x10F85: 220,
+	0x11046: 9,
+	0x11070: 9,
+	0x1107F: 9,
+	0x110B9: 9,
+	0x110BA: 7,
+	0x11100: 230,
+	0x11101: 230,
+	0x11102: 230,
+	0x11133: 9,
+	0x11134: 9,
+	0x11173: 7,
+	0x111C0: 9,
+	0x111CA: 7,
+	0x11235: 9,
+	0x11236: 7,
+	0x112E9: 7,
+	0x112EA: 9,
+	0x1133B: 7,
+	0x1133C: 7,
+	0x1134D: 9,
+	0x11366: 230,
+	0x11367: 230,
+	0x11368: 230,
+	0x11369: 230,
+	0x1136A: 230,
+	0x1136B: 230,
+	0x1136C: 230,
+	0x11370: 230,
+	0x11371: 230,
+	0x11372: 230,
+	0x11373: 230,
+	0x11374: 230,
+	0x11442: 9,
+	0x11446: 7,
+	0x1145E: 230,
+	0x114C2: 9,
+	0x114C3: 7,
+	0x115BF: 9,
+	0x115C0: 7,
+	0x1163F: 9,
+	0x116B6: 9,
+	0x116B7: 7,
+	0x1172B: 9,
+	0x11839: 9,
+	0x1183A: 7,
+	0x1193D: 9,
+	0x1193E: 9,
+	0x11943: 7,
+	0x119E0: 9,
+	0x11A34: 9,
+	0x11A47: 9,
+	0x11A99: 9,
+	0x11C3F: 9,
+	0x11D42: 7,
+	0x11D44: 9,
+	0x11D45: 9,
+	0x11D97: 9,
+	0x16AF0: 1,
+	0x16AF1: 1,
+	0x16AF2: 1,
+	0x16AF3: 1,
+	0x16AF4: 1,
+	0x16B30: 230,
+	0x16B31: 230,
+	0x16B32: 230,
+	0x16B33: 230,
+	0x16B34: 230,
+	0x16B35: 230,
+	0x16B36: 230,
+	0x16FF0: 6,
+	0x16FF1: 6,
+	0x1BC9E: 1,
+	0x1D165: 216,
+	0x1D166: 216,
+	0x1D167: 1,
+	0x1D168: 1,
+	0x1D169: 1,
+	0x1D16D: 226,
+	0x1D16E: 216,
+	0x1D16F: 216,
+	0x1D170: 216,
+	0x1D171: 216,
+	0x1D172: 216,
+	0x1D17B: 220,
+	0x1D17C: 220,
+	0x1D17D: 220,
+	0x1D17E: 220,
+	0x1D17F: 220,
+	0x1D180: 220,
+	0x1D181: 220,
+	0x1D182: 220,
+	0x1D185: 230,
+	0x1D186: 230,
+	0x1D187: 230,
+	0x1D188: 230,
+	0x1D189: 230,
+	0x1D18A: 220,
+	0x1D18B: 220,
+	0x1D1AA: 230,
+	0x1D1AB: 230,
+	0x1D1AC: 230,
+	0x1D1AD: 230,
+	0x1D242: 230,
+	0x1D243: 230,
+	0x1D244: 230,
+	0x1E000: 230,
+	0x1E001: 230,
+	0x1E002: 230,
+	0x1E003: 230,
+	0x1E004: 230,
+	0x1E005: 230,
+	0x1E006: 230,
+	0x1E008: 230,
+	0x1E009: 230,
+	0x1E00A: 230,
+	0x1E00B: 230,
+	0x1E00C: 230,
+	0x1E00D: 230,
+	0x1E00E: 230,
+	0x1E00F: 230,
+	0x1E010: 230,
+	0x1E011: 230,
+	0x1E012: 230,
+	0x1E013: 230,
+	0x1E014: 230,
+	0x1E015: 230,
+	0x1E016: 230,
+	0x1E017: 230,
+	0x1E018: 230,
+	0x1E01B: 230,
+	0x1E01C: 230,
+	0x1E01D: 230,
+	0x1E01E: 230,
+	0x1E01F: 230,
+	0x1E020: 230,
+	0x1E021: 230,
+	0x1E023: 230,
+	0x1E024: 230,
+	0x1E026: 230,
+	0x1E027: 230,
+	0x1E028: 230,
+	0x1E029: 230,
+	0x1E02A: 230,
+	0x1E130: 230,
+	0x1E131: 230,
+	0x1E132: 230,
+	0x1E133: 230,
+	0x1E134: 230,
+	0x1E135: 230,
+	0x1E136: 230,
+	0x1E2AE: 230,
+	0x1E2EC: 230,
+	0x1E2ED: 230,
+	0x1E2EE: 230,
+	0x1E2EF: 230,
+	0x1E8D0: 220,
+	0x1E8D1: 220,
+	0x1E8D2: 220,
+	0x1E8D3: 220,
+	0x1E8D4: 220,
+	0x1E8D5: 220,
+	0x1E8D6: 220,
+	0x1E944: 230,
+	0x1E945: 230,
+	0x1E946: 230,
+	0x1E947: 230,
+	0x1E948: 230,
+	0x1E949: 230,
+	0x1E94A: 7,
+}
+
+// canonicalCompositions maps pairs of runes to the primary composite they
+// compose to, excluding the composition exclusions
+var canonicalCompositions = map[[2]rune]rune{
+	{0x003C, 0x0338}:   0x226E,
+	{0x003D, 0x0338}:   0x2260,
+	{0x003E, 0x0338}:   0x226F,
+	{0x0041, 0x0300}:   0x00C0,
+	{0x0041, 0x0301}:   0x00C1,
+	{0x0041, 0x0302}:   0x00C2,
+	{0x0041, 0x0303}:   0x00C3,
+	{0x0041, 0x0304}:   0x0100,
+	{0x0041, 0x0306}:   0x0102,
+	{0x0041, 0x0307}:   0x0226,
+	{0x0041, 0x0308}:   0x00C4,
+	{0x0041, 0x0309}:   0x1EA2,
+	{0x0041, 0x030A}:   0x00C5,
+	{0x0041, 0x030C}:   0x01CD,
+	{0x0041, 0x030F}:   0x0200,
+	{0x0041, 0x0311}:   0x0202,
+	{0x0041, 0x0323}:   0x1EA0,
+	{0x0041, 0x0325}:   0x1E00,
+	{0x0041, 0x0328}:   0x0104,
+	{0x0042, 0x0307}:   0x1E02,
+	{0x0042, 0x0323}:   0x1E04,
+	{0x0042, 0x0331}:   0x1E06,
+	{0x0043, 0x0301}:   0x0106,
+	{0x0043, 0x0302}:   0x0108,
+	{0x0043, 0x0307}:   0x010A,
+	{0x0043, 0x030C}:   0x010C,
+	{0x0043, 0x0327}:   0x00C7,
+	{0x0044, 0x0307}:   0x1E0A,
+	{0x0044, 0x030C}:   0x010E,
+	{0x0044, 0x0323}:   0x1E0C,
+	{0x0044, 0x0327}:   0x1E10,
+	{0x0044, 0x032D}:   0x1E12,
+	{0x0044, 0x0331}:   0x1E0E,
+	{0x0045, 0x0300}:   0x00C8,
+	{0x0045, 0x0301}:   0x00C9,
+	{0x0045, 0x0302}:   0x00CA,
+	{0x0045, 0x0303}:   0x1EBC,
+	{0x0045, 0x0304}:   0x0112,
+	{0x0045, 0x0306}:   0x0114,
+	{0x0045, 0x0307}:   0x0116,
+	{0x0045, 0x0308}:   0x00CB,
+	{0x0045, 0x0309}:   0x1EBA,
+	{0x0045, 0x030C}:   0x011A,
+	{0x0045, 0x030F}:   0x0204,
+	{0x0045, 0x0311}:   0x0206,
+	{0x0045, 0x0323}:   0x1EB8,
+	{0x0045, 0x0327}:   0x0228,
+	{0x0045, 0x0328}:   0x0118,
+	{0x0045, 0x032D}:   0x1E18,
+	{0x0045, 0x0330}:   0x1E1A,
+	{0x0046, 0x0307}:   0x1E1E,
+	{0x0047, 0x0301}:   0x01F4,
+	{0x0047, 0x0302}:   0x011C,
+	{0x0047, 0x0304}:   0x1E20,
+	{0x0047, 0x0306}:   0x011E,
+	{0x0047, 0x0307}:   0x0120,
+	{0x0047, 0x030C}:   0x01E6,
+	{0x0047, 0x0327}:   0x0122,
+	{0x0048, 0x0302}:   0x0124,
+	{0x0048, 0x0307}:   0x1E22,
+	{0x0048, 0x0308}:   0x1E26,
+	{0x0048, 0x030C}:   0x021E,
+	{0x0048, 0x0323}:   0x1E24,
+	{0x0048, 0x0327}:   0x1E28,
+	{0x0048, 0x032E}:   0x1E2A,
+	{0x0049, 0x0300}:   0x00CC,
+	{0x0049, 0x0301}:   0x00CD,
+	{0x0049, 0x0302}:   0x00CE,
+	{0x0049, 0x0303}:   0x0128,
+	{0x0049, 0x0304}:   0x012A,
+	{0x0049, 0x0306}:   0x012C,
+	{0x0049, 0x0307}:   0x0130,
+	{0x0049, 0x0308}:   0x00CF,
+	{0x0049, 0x0309}:   0x1EC8,
+	{0x0049, 0x030C}:   0x01CF,
+	{0x0049, 0x030F}:   0x0208,
+	{0x0049, 0x0311}:   0x020A,
+	{0x0049, 0x0323}:   0x1ECA,
+	{0x0049, 0x0328}:   0x012E,
+	{0x0049, 0x0330}:   0x1E2C,
+	{0x004A, 0x0302}:   0x0134,
+	{0x004B, 0x0301}:   0x1E30,
+	{0x004B, 0x030C}:   0x01E8,
+	{0x004B, 0x0323}:   0x1E32,
+	{0x004B, 0x0327}:   0x0136,
+	{0x004B, 0x0331}:   0x1E34,
+	{0x004C, 0x0301}:   0x0139,
+	{0x004C, 0x030C}:   0x013D,
+	{0x004C, 0x0323}:   0x1E36,
+	{0x004C, 0x0327}:   0x013B,
+	{0x004C, 0x032D}:   0x1E3C,
+	{0x004C, 0x0331}:   0x1E3A,
+	{0x004D, 0x0301}:   0x1E3E,
+	{0x004D, 0x0307}:   0x1E40,
+	{0x004D, 0x0323}:   0x1E42,
+	{0x004E, 0x0300}:   0x01F8,
+	{0x004E, 0x0301}:   0x0143,
+	{0x004E, 0x0303}:   0x00D1,
+	{0x004E, 0x0307}:   0x1E44,
+	{0x004E, 0x030C}:   0x0147,
+	{0x004E, 0x0323}:   0x1E46,
+	{0x004E, 0x0327}:   0x0145,
+	{0x004E, 0x032D}:   0x1E4A,
+	{0x004E, 0x0331}:   0x1E48,
+	{0x004F, 0x0300}:   0x00D2,
+	{0x004F, 0x0301}:   0x00D3,
+	{0x004F, 0x0302}:   0x00D4,
+	{0x004F, 0x0303}:   0x00D5,
+	{0x004F, 0x0304}:   0x014C,
+	{0x004F, 0x0306}:   0x014E,
+	{0x004F, 0x0307}:   0x022E,
+	{0x004F, 0x0308}:   0x00D6,
+	{0x004F, 0x0309}:   0x1ECE,
+	{0x004F, 0x030B}:   0x0150,
+	{0x004F, 0x030C}:   0x01D1,
+	{0x004F, 0x030F}:   0x020C,
+	{0x004F, 0x0311}:   0x020E,
+	{0x004F, 0x031B}:   0x01A0,
+	{0x004F, 0x0323}:   0x1ECC,
+	{0x004F, 0x0328}:   0x01EA,
+	{0x0050, 0x0301}:   0x1E54,
+	{0x0050, 0x0307}:   0x1E56,
+	{0x0052, 0x0301}:   0x0154,
+	{0x0052, 0x0307}:   0x1E58,
+	{0x0052, 0x030C}:   0x0158,
+	{0x0052, 0x030F}:   0x0210,
+	{0x0052, 0x0311}:   0x0212,
+	{0x0052, 0x0323}:   0x1E5A,
+	{0x0052, 0x0327}:   0x0156,
+	{0x0052, 0x0331}:   0x1E5E,
+	{0x0053, 0x0301}:   0x015A,
+	{0x0053, 0x0302}:   0x015C,
+	{0x0053, 0x0307}:   0x1E60,
+	{0x0053, 0x030C}:   0x0160,
+	{0x0053, 0x0323}:   0x1E62,
+	{0x0053, 0x0326}:   0x0218,
+	{0x0053, 0x0327}:   0x015E,
+	{0x0054, 0x0307}:   0x1E6A,
+	{0x0054, 0x030C}:   0x0164,
+	{0x0054, 0x0323}:   0x1E6C,
+	{0x0054, 0x0326}:   0x021A,
+	{0x0054, 0x0327}:   0x0162,
+	{0x0054, 0x032D}:   0x1E70,
+	{0x0054, 0x0331}:   0x1E6E,
+	{0x0055, 0x0300}:   0x00D9,
+	{0x0055, 0x0301}:   0x00DA,
+	{0x0055, 0x0302}:   0x00DB,
+	{0x0055, 0x0303}:   0x0168,
+	{0x0055, 0x0304}:   0x016A,
+	{0x0055, 0x0306}:   0x016C,
+	{0x0055, 0x0308}:   0x00DC,
+	{0x0055, 0x0309}:   0x1EE6,
+	{0x0055, 0x030A}:   0x016E,
+	{0x0055, 0x030B}:   0x0170,
+	{0x0055, 0x030C}:   0x01D3,
+	{0x0055, 0x030F}:   0x0214,
+	{0x0055, 0x0311}:   0x0216,
+	{0x0055, 0x031B}:   0x01AF,
+	{0x0055, 0x0323}:   0x1EE4,
+	{0x0055, 0x0324}:   0x1E72,
+	{0x0055, 0x0328}:   0x0172,
+	{0x0055, 0x032D}:   0x1E76,
+	{0x0055, 0x0330}:   0x1E74,
+	{0x0056, 0x0303}:   0x1E7C,
+	{0x0056, 0x0323}:   0x1E7E,
+	{0x0057, 0x0300}:   0x1E80,
+	{0x0057, 0x0301}:   0x1E82,
+	{0x0057, 0x0302}:   0x0174,
+	{0x0057, 0x0307}:   0x1E86,
+	{0x0057, 0x0308}:   0x1E84,
+	{0x0057, 0x0323}:   0x1E88,
+	{0x0058, 0x0307}:   0x1E8A,
+	{0x0058, 0x0308}:   0x1E8C,
+	{0x0059, 0x0300}:   0x1EF2,
+	{0x0059, 0x0301}:   0x00DD,
+	{0x0059, 0x0302}:   0x0176,
+	{0x0059, 0x0303}:   0x1EF8,
+	{0x0059, 0x0304}:   0x0232,
+	{0x0059, 0x0307}:   0x1E8E,
+	{0x0059, 0x0308}:   0x0178,
+	{0x0059, 0x0309}:   0x1EF6,
+	{0x0059, 0x0323}:   0x1EF4,
+	{0x005A, 0x0301}:   0x0179,
+	{0x005A, 0x0302}:   0x1E90,
+	{0x005A, 0x0307}:   0x017B,
+	{0x005A, 0x030C}:   0x017D,
+	{0x005A, 0x0323}:   0x1E92,
+	{0x005A, 0x0331}:   0x1E94,
+	{0x0061, 0x0300}:   0x00E0,
+	{0x0061, 0x0301}:   0x00E1,
+	{0x0061, 0x0302}:   0x00E2,
+	{0x0061, 0x0303}:   0x00E3,
+	{0x0061, 0x0304}:   0x0101,
+	{0x0061, 0x0306}:   0x0103,
+	{0x0061, 0x0307}:   0x0227,
+	{0x0061, 0x0308}:   0x00E4,
+	{0x0061, 0x0309}:   0x1EA3,
+	{0x0061, 0x030A}:   0x00E5,
+	{0x0061, 0x030C}:   0x01CE,
+	{0x0061, 0x030F}:   0x0201,
+	{0x0061, 0x0311}:   0x0203,
+	{0x0061, 0x0323}:   0x1EA1,
+	{0x0061, 0x0325}:   0x1E01,
+	{0x0061, 0x0328}:   0x0105,
+	{0x0062, 0x0307}:   0x1E03,
+	{0x0062, 0x0323}:   0x1E05,
+	{0x0062, 0x0331}:   0x1E07,
+	{0x0063, 0x0301}:   0x0107,
+	{0x0063, 0x0302}:   0x0109,
+	{0x0063, 0x0307}:   0x010B,
+	{0x0063, 0x030C}:   0x010D,
+	{0x0063, 0x0327}:   0x00E7,
+	{0x0064, 0x0307}:   0x1E0B,
+	{0x0064, 0x030C}:   0x010F,
+	{0x0064, 0x0323}:   0x1E0D,
+	{0x0064, 0x0327}:   0x1E11,
+	{0x0064, 0x032D}:   0x1E13,
+	{0x0064, 0x0331}:   0x1E0F,
+	{0x0065, 0x0300}:   0x00E8,
+	{0x0065, 0x0301}:   0x00E9,
+	{0x0065, 0x0302}:   0x00EA,
+	{0x0065, 0x0303}:   0x1EBD,
+	{0x0065, 0x0304}:   0x0113,
+	{0x0065, 0x0306}:   0x0115,
+	{0x0065, 0x0307}:   0x0117,
+	{0x0065, 0x0308}:   0x00EB,
+	{0x0065, 0x0309}:   0x1EBB,
+	{0x0065, 0x030C}:   0x011B,
+	{0x0065, 0x030F}:   0x0205,
+	{0x0065, 0x0311}:   0x0207,
+	{0x0065, 0x0323}:   0x1EB9,
+	{0x0065, 0x0327}:   0x0229,
+	{0x0065, 0x0328}:   0x0119,
+	{0x0065, 0x032D}:   0x1E19,
+	{0x0065, 0x0330}:   0x1E1B,
+	{0x0066, 0x0307}:   0x1E1F,
+	{0x0067, 0x0301}:   0x01F5,
+	{0x0067, 0x0302}:   0x011D,
+	{0x0067, 0x0304}:   0x1E21,
+	{0x0067, 0x0306}:   0x011F,
+	{0x0067, 0x0307}:   0x0121,
+	{0x0067, 0x030C}:   0x01E7,
+	{0x0067, 0x0327}:   0x0123,
+	{0x0068, 0x0302}:   0x0125,
+	{0x0068, 0x0307}:   0x1E23,
+	{0x0068, 0x0308}:   0x1E27,
+	{0x0068, 0x030C}:   0x021F,
+	{0x0068, 0x0323}:   0x1E25,
+	{0x0068, 0x0327}:   0x1E29,
+	{0x0068, 0x032E}:   0x1E2B,
+	{0x0068, 0x0331}:   0x1E96,
+	{0x0069, 0x0300}:   0x00EC,
+	{0x0069, 0x0301}:   0x00ED,
+	{0x0069, 0x0302}:   0x00EE,
+	{0x0069, 0x0303}:   0x0129,
+	{0x0069, 0x0304}:   0x012B,
+	{0x0069, 0x0306}:   0x012D,
+	{0x0069, 0x0308}:   0x00EF,
+	{0x0069, 0x0309}:   0x1EC9,
+	{0x0069, 0x030C}:   0x01D0,
+	{0x0069, 0x030F}:   0x0209,
+	{0x0069, 0x0311}:   0x020B,
+	{0x0069, 0x0323}:   0x1ECB,
+	{0x0069, 0x0328}:   0x012F,
+	{0x0069, 0x0330}:   0x1E2D,
+	{0x006A, 0x0302}:   0x0135,
+	{0x006A, 0x030C}:   0x01F0,
+	{0x006B, 0x0301}:   0x1E31,
+	{0x006B, 0x030C}:   0x01E9,
+	{0x006B, 0x0323}:   0x1E33,
+	{0x006B, 0x0327}:   0x0137,
+	{0x006B, 0x0331}:   0x1E35,
+	{0x006C, 0x0301}:   0x013A,
+	{0x006C, 0x030C}:   0x013E,
+	{0x006C, 0x0323}:   0x1E37,
+	{0x006C, 0x0327}:   0x013C,
+	{0x006C, 0x032D}:   0x1E3D,
+	{0x006C, 0x0331}:   0x1E3B,
+	{0x006D, 0x0301}:   0x1E3F,
+	{0x006D, 0x0307}:   0x1E41,
+	{0x006D, 0x0323}:   0x1E43,
+	{0x006E, 0x0300}:   0x01F9,
+	{0x006E, 0x0301}:   0x0144,
+	{0x006E, 0x0303}:   0x00F1,
+	{0x006E, 0x0307}:   0x1E45,
+	{0x006E, 0x030C}:   0x0148,
+	{0x006E, 0x0323}:   0x1E47,
+	{0x006E, 0x0327}:   0x0146,
+	{0x006E, 0x032D}:   0x1E4B,
+	{0x006E, 0x0331}:   0x1E49,
+	{0x006F, 0x0300}:   0x00F2,
+	{0x006F, 0x0301}:   0x00F3,
+	{0x006F, 0x0302}:   0x00F4,
+	{0x006F, 0x0303}:   0x00F5,
+	{0x006F, 0x0304}:   0x014D,
+	{0x006F, 0x0306}:   0x014F,
+	{0x006F, 0x0307}:   0x022F,
+	{0x006F, 0x0308}:   0x00F6,
+	{0x006F, 0x0309}:   0x1ECF,
+	{0x006F, 0x030B}:   0x0151,
+	{0x006F, 0x030C}:   0x01D2,
+	{0x006F, 0x030F}:   0x020D,
+	{0x006F, 0x0311}:   0x020F,
+	{0x006F, 0x031B}:   0x01A1,
+	{0x006F, 0x0323}:   0x1ECD,
+	{0x006F, 0x0328}:   0x01EB,
+	{0x0070, 0x0301}:   0x1E55,
+	{0x0070, 0x0307}:   0x1E57,
+	{0x0072, 0x0301}:   0x0155,
+	{0x0072, 0x0307}:   0x1E59,
+	{0x0072, 0x030C}:   0x0159,
+	{0x0072, 0x030F}:   0x0211,
+	{0x0072, 0x0311}:   0x0213,
+	{0x0072, 0x0323}:   0x1E5B,
+	{0x0072, 0x0327}:   0x0157,
+	{0x0072, 0x0331}:   0x1E5F,
+	{0x0073, 0x0301}:   0x015B,
+	{0x0073, 0x0302}:   0x015D,
+	{0x0073, 0x0307}:   0x1E61,
+	{0x0073, 0x030C}:   0x0161,
+	{0x0073, 0x0323}:   0x1E63,
+	{0x0073, 0x0326}:   0x0219,
+	{0x0073, 0x0327}:   0x015F,
+	{0x0074, 0x0307}:   0x1E6B,
+	{0x0074, 0x0308}:   0x1E97,
+	{0x0074, 0x030C}:   0x0165,
+	{0x0074, 0x0323}:   0x1E6D,
+	{0x0074, 0x0326}:   0x021B,
+	{0x0074, 0x0327}:   0x0163,
+	{0x0074, 0x032D}:   0x1E71,
+	{0x0074, 0x0331}:   0x1E6F,
+	{0x0075, 0x0300}:   0x00F9,
+	{0x0075, 0x0301}:   0x00FA,
+	{0x0075, 0x0302}:   0x00FB,
+	{0x0075, 0x0303}:   0x0169,
+	{0x0075, 0x0304}:   0x016B,
+	{0x0075, 0x0306}:   0x016D,
+	{0x0075, 0x0308}:   0x00FC,
+	{0x0075, 0x0309}:   0x1EE7,
+	{0x0075, 0x030A}:   0x016F,
+	{0x0075, 0x030B}:   0x0171,
+	{0x0075, 0x030C}:   0x01D4,
+	{0x0075, 0x030F}:   0x0215,
+	{0x0075, 0x0311}:   0x0217,
+	{0x0075, 0x031B}:   0x01B0,
+	{0x0075, 0x0323}:   0x1EE5,
+	{0x0075, 0x0324}:   0x1E73,
+	{0x0075, 0x0328}:   0x0173,
+	{0x0075, 0x032D}:   0x1E77,
+	{0x0075, 0x0330}:   0x1E75,
+	{0x0076, 0x0303}:   0x1E7D,
+	{0x0076, 0x0323}:   0x1E7F,
+	{0x0077, 0x0300}:   0x1E81,
+	{0x0077, 0x0301}:   0x1E83,
+	{0x0077, 0x0302}:   0x0175,
+	{0x0077, 0x0307}:   0x1E87,
+	{0x0077, 0x0308}:   0x1E85,
+	{0x0077, 0x030A}:   0x1E98,
+	{0x0077, 0x0323}:   0x1E89,
+	{0x0078, 0x0307}:   0x1E8B,
+	{0x0078, 0x0308}:   0x1E8D,
+	{0x0079, 0x0300}:   0x1EF3,
+	{0x0079, 0x0301}:   0x00FD,
+	{0x0079, 0x0302}:   0x0177,
+	{0x0079, 0x0303}:   0x1EF9,
+	{0x0079, 0x0304}:   0x0233,
+	{0x0079, 0x0307}:   0x1E8F,
+	{0x0079, 0x0308}:   0x00FF,
+	{0x0079, 0x0309}:   0x1EF7,
+	{0x0079, 0x030A}:   0x1E99,
+	{0x0079, 0x0323}:   0x1EF5,
+	{0x007A, 0x0301}:   0x017A,
+	{0x007A, 0x0302}:   0x1E91,
+	{0x007A, 0x0307}:   0x017C,
+	{0x007A, 0x030C}:   0x017E,
+	{0x007A, 0x0323}:   0x1E93,
+	{0x007A, 0x0331}:   0x1E95,
+	{0x00A8, 0x0300}:   0x1FED,
+	{0x00A8, 0x0301}:   0x0385,
+	{0x00A8, 0x0342}:   0x1FC1,
+	{0x00C2, 0x0300}:   0x1EA6,
+	{0x00C2, 0x0301}:   0x1EA4,
+	{0x00C2, 0x0303}:   0x1EAA,
+	{0x00C2, 0x0309}:   0x1EA8,
+	{0x00C4, 0x0304}:   0x01DE,
+	{0x00C5, 0x0301}:   0x01FA,
+	{0x00C6, 0x0301}:   0x01FC,
+	{0x00C6, 0x0304}:   0x01E2,
+	{0x00C7, 0x0301}:   0x1E08,
+	{0x00CA, 0x0300}:   0x1EC0,
+	{0x00CA, 0x0301}:   0x1EBE,
+	{0x00CA, 0x0303}:   0x1EC4,
+	{0x00CA, 0x0309}:   0x1EC2,
+	{0x00CF, 0x0301}:   0x1E2E,
+	{0x00D4, 0x0300}:   0x1ED2,
+	{0x00D4, 0x0301}:   0x1ED0,
+	{0x00D4, 0x0303}:   0x1ED6,
+	{0x00D4, 0x0309}:   0x1ED4,
+	{0x00D5, 0x0301}:   0x1E4C,
+	{0x00D5, 0x0304}:   0x022C,
+	{0x00D5, 0x0308}:   0x1E4E,
+	{0x00D6, 0x0304}:   0x022A,
+	{0x00D8, 0x0301}:   0x01FE,
+	{0x00DC, 0x0300}:   0x01DB,
+	{0x00DC, 0x0301}:   0x01D7,
+	{0x00DC, 0x0304}:   0x01D5,
+	{0x00DC, 0x030C}:   0x01D9,
+	{0x00E2, 0x0300}:   0x1EA7,
+	{0x00E2, 0x0301}:   0x1EA5,
+	{0x00E2, 0x0303}:   0x1EAB,
+	{0x00E2, 0x0309}:   0x1EA9,
+	{0x00E4, 0x0304}:   0x01DF,
+	{0x00E5, 0x0301}:   0x01FB,
+	{0x00E6, 0x0301}:   0x01FD,
+	{0x00E6, 0x0304}:   0x01E3,
+	{0x00E7, 0x0301}:   0x1E09,
+	{0x00EA, 0x0300}:   0x1EC1,
+	{0x00EA, 0x0301}:   0x1EBF,
+	{0x00EA, 0x0303}:   0x1EC5,
+	{0x00EA, 0x0309}:   0x1EC3,
+	{0x00EF, 0x0301}:   0x1E2F,
+	{0x00F4, 0x0300}:   0x1ED3,
+	{0x00F4, 0x0301}:   0x1ED1,
+	{0x00F4, 0x0303}:   0x1ED7,
+	{0x00F4, 0x0309}:   0x1ED5,
+	{0x00F5, 0x0301}:   0x1E4D,
+	{0x00F5, 0x0304}:   0x022D,
+	{0x00F5, 0x0308}:   0x1E4F,
+	{0x00F6, 0x0304}:   0x022B,
+	{0x00F8, 0x0301}:   0x01FF,
+	{0x00FC, 0x0300}:   0x01DC,
+	{0x00FC, 0x0301}:   0x01D8,
+	{0x00FC, 0x0304}:   0x01D6,
+	{0x00FC, 0x030C}:   0x01DA,
+	{0x0102, 0x0300}:   0x1EB0,
+	{0x0102, 0x0301}:   0x1EAE,
+	{0x0102, 0x0303}:   0x1EB4,
+	{0x0102, 0x0309}:   0x1EB2,
+	{0x0103, 0x0300}:   0x1EB1,
+	{0x0103, 0x0301}:   0x1EAF,
+	{0x0103, 0x0303}:   0x1EB5,
+	{0x0103, 0x0309}:   0x1EB3,
+	{0x0112, 0x0300}:   0x1E14,
+	{0x0112, 0x0301}:   0x1E16,
+	{0x0113, 0x0300}:   0x1E15,
+	{0x0113, 0x0301}:   0x1E17,
+	{0x014C, 0x0300}:   0x1E50,
+	{0x014C, 0x0301}:   0x1E52,
+	{0x014D, 0x0300}:   0x1E51,
+	{0x014D, 0x0301}:   0x1E53,
+	{0x015A, 0x0307}:   0x1E64,
+	{0x015B, 0x0307}:   0x1E65,
+	{0x0160, 0x0307}:   0x1E66,
+	{0x0161, 0x0307}:   0x1E67,
+	{0x0168, 0x0301}:   0x1E78,
+	{0x0169, 0x0301}:   0x1E79,
+	{0x016A, 0x0308}:   0x1E7A,
+	{0x016B, 0x0308}:   0x1E7B,
+	{0x017F, 0x0307}:   0x1E9B,
+	{0x01A0, 0x0300}:   0x1EDC,
+	{0x01A0, 0x0301}:   0x1EDA,
+	{0x01A0, 0x0303}:   0x1EE0,
+	{0x01A0, 0x0309}:   0x1EDE,
+	{0x01A0, 0x0323}:   0x1EE2,
+	{0x01A1, 0x0300}:   0x1EDD,
+	{0x01A1, 0x0301}:   0x1EDB,
+	{0x01A1, 0x0303}:   0x1EE1,
+	{0x01A1, 0x0309}:   0x1EDF,
+	{0x01A1, 0x0323}:   0x1EE3,
+	{0x01AF, 0x0300}:   0x1EEA,
+	{0x01AF, 0x0301}:   0x1EE8,
+	{0x01AF, 0x0303}:   0x1EEE,
+	{0x01AF, 0x0309}:   0x1EEC,
+	{0x01AF, 0x0323}:   0x1EF0,
+	{0x01B0, 0x0300}:   0x1EEB,
+	{0x01B0, 0x0301}:   0x1EE9,
+	{0x01B0, 0x0303}:   0x1EEF,
+	{0x01B0, 0x0309}:   0x1EED,
+	{0x01B0, 0x0323}:   0x1EF1,
+	{0x01B7, 0x030C}:   0x01EE,
+	{0x01EA, 0x0304}:   0x01EC,
+	{0x01EB, 0x0304}:   0x01ED,
+	{0x0226, 0x0304}:   0x01E0,
+	{0x0227, 0x0304}:   0x01E1,
+	{0x0228, 0x0306}:   0x1E1C,
+	{0x0229, 0x0306}:   0x1E1D,
+	{0x022E, 0x0304}:   0x0230,
+	{0x022F, 0x0304}:   0x0231,
+	{0x0292, 0x030C}:   0x01EF,
+	{0x0391, 0x0300}:   0x1FBA,
+	{0x0391, 0x0301}:   0x0386,
+	{0x0391, 0x0304}:   0x1FB9,
+	{0x0391, 0x0306}:   0x1FB8,
+	{0x0391, 0x0313}:   0x1F08,
+	{0x0391, 0x0314}:   0x1F09,
+	{0x0391, 0x0345}:   0x1FBC,
+	{0x0395, 0x0300}:   0x1FC8,
+	{0x0395, 0x0301}:   0x0388,
+	{0x0395, 0x0313}:   0x1F18,
+	{0x0395, 0x0314}:   0x1F19,
+	{0x0397, 0x0300}:   0x1FCA,
+	{0x0397, 0x0301}:   0x0389,
+	{0x0397, 0x0313}:   0x1F28,
+	{0x0397, 0x0314}:   0x1F29,
+	{0x0397, 0x0345}:   0x1FCC,
+	{0x0399, 0x0300}:   0x1FDA,
+	{0x0399, 0x0301}:   0x038A,
+	{0x0399, 0x0304}:   0x1FD9,
+	{0x0399, 0x0306}:   0x1FD8,
+	{0x0399, 0x0308}:   0x03AA,
+	{0x0399, 0x0313}:   0x1F38,
+	{0x0399, 0x0314}:   0x1F39,
+	{0x039F, 0x0300}:   0x1FF8,
+	{0x039F, 0x0301}:   0x038C,
+	{0x039F, 0x0313}:   0x1F48,
+	{0x039F, 0x0314}:   0x1F49,
+	{0x03A1, 0x0314}:   0x1FEC,
+	{0x03A5, 0x0300}:   0x1FEA,
+	{0x03A5, 0x0301}:   0x038E,
+	{0x03A5, 0x0304}:   0x1FE9,
+	{0x03A5, 0x0306}:   0x1FE8,
+	{0x03A5, 0x0308}:   0x03AB,
+	{0x03A5, 0x0314}:   0x1F59,
+	{0x03A9, 0x0300}:   0x1FFA,
+	{0x03A9, 0x0301}:   0x038F,
+	{0x03A9, 0x0313}:   0x1F68,
+	{0x03A9, 0x0314}:   0x1F69,
+	{0x03A9, 0x0345}:   0x1FFC,
+	{0x03AC, 0x0345}:   0x1FB4,
+	{0x03AE, 0x0345}:   0x1FC4,
+	{0x03B1, 0x0300}:   0x1F70,
+	{0x03B1, 0x0301}:   0x03AC,
+	{0x03B1, 0x0304}:   0x1FB1,
+	{0x03B1, 0x0306}:   0x1FB0,
+	{0x03B1, 0x0313}:   0x1F00,
+	{0x03B1, 0x0314}:   0x1F01,
+	{0x03B1, 0x0342}:   0x1FB6,
+	{0x03B1, 0x0345}:   0x1FB3,
+	{0x03B5, 0x0300}:   0x1F72,
+	{0x03B5, 0x0301}:   0x03AD,
+	{0x03B5, 0x0313}:   0x1F10,
+	{0x03B5, 0x0314}:   0x1F11,
+	{0x03B7, 0x0300}:   0x1F74,
+	{0x03B7, 0x0301}:   0x03AE,
+	{0x03B7, 0x0313}:   0x1F20,
+	{0x03B7, 0x0314}:   0x1F21,
+	{0x03B7, 0x0342}:   0x1FC6,
+	{0x03B7, 0x0345}:   0x1FC3,
+	{0x03B9, 0x0300}:   0x1F76,
+	{0x03B9, 0x0301}:   0x03AF,
+	{0x03B9, 0x0304}:   0x1FD1,
+	{0x03B9, 0x0306}:   0x1FD0,
+	{0x03B9, 0x0308}:   0x03CA,
+	{0x03B9, 0x0313}:   0x1F30,
+	{0x03B9, 0x0314}:   0x1F31,
+	{0x03B9, 0x0342}:   0x1FD6,
+	{0x03BF, 0x0300}:   0x1F78,
+	{0x03BF, 0x0301}:   0x03CC,
+	{0x03BF, 0x0313}:   0x1F40,
+	{0x03BF, 0x0314}:   0x1F41,
+	{0x03C1, 0x0313}:   0x1FE4,
+	{0x03C1, 0x0314}:   0x1FE5,
+	{0x03C5, 0x0300}:   0x1F7A,
+	{0x03C5, 0x0301}:   0x03CD,
+	{0x03C5, 0x0304}:   0x1FE1,
+	{0x03C5, 0x0306}:   0x1FE0,
+	{0x03C5, 0x0308}:   0x03CB,
+	{0x03C5, 0x0313}:   0x1F50,
+	{0x03C5, 0x0314}:   0x1F51,
+	{0x03C5, 0x0342}:   0x1FE6,
+	{0x03C9, 0x0300}:   0x1F7C,
+	{0x03C9, 0x0301}:   0x03CE,
+	{0x03C9, 0x0313}:   0x1F60,
+	{0x03C9, 0x0314}:   0x1F61,
+	{0x03C9, 0x0342}:   0x1FF6,
+	{0x03C9, 0x0345}:   0x1FF3,
+	{0x03CA, 0x0300}:   0x1FD2,
+	{0x03CA, 0x0301}:   0x0390,
+	{0x03CA, 0x0342}:   0x1FD7,
+	{0x03CB, 0x0300}:   0x1FE2,
+	{0x03CB, 0x0301}:   0x03B0,
+	{0x03CB, 0x0342}:   0x1FE7,
+	{0x03CE, 0x0345}:   0x1FF4,
+	{0x03D2, 0x0301}:   0x03D3,
+	{0x03D2, 0x0308}:   0x03D4,
+	{0x0406, 0x0308}:   0x0407,
+	{0x0410, 0x0306}:   0x04D0,
+	{0x0410, 0x0308}:   0x04D2,
+	{0x0413, 0x0301}:   0x0403,
+	{0x0415, 0x0300}:   0x0400,
+	{0x0415, 0x0306}:   0x04D6,
+	{0x0415, 0x0308}:   0x0401,
+	{0x0416, 0x0306}:   0x04C1,
+	{0x0416, 0x0308}:   0x04DC,
+	{0x0417, 0x0308}:   0x04DE,
+	{0x0418, 0x0300}:   0x040D,
+	{0x0418, 0x0304}:   0x04E2,
+	{0x0418, 0x0306}:   0x0419,
+	{0x0418, 0x0308}:   0x04E4,
+	{0x041A, 0x0301}:   0x040C,
+	{0x041E, 0x0308}:   0x04E6,
+	{0x0423, 0x0304}:   0x04EE,
+	{0x0423, 0x0306}:   0x040E,
+	{0x0423, 0x0308}:   0x04F0,
+	{0x0423, 0x030B}:   0x04F2,
+	{0x0427, 0x0308}:   0x04F4,
+	{0x042B, 0x0308}:   0x04F8,
+	{0x042D, 0x0308}:   0x04EC,
+	{0x0430, 0x0306}:   0x04D1,
+	{0x0430, 0x0308}:   0x04D3,
+	{0x0433, 0x0301}:   0x0453,
+	{0x0435, 0x0300}:   0x0450,
+	{0x0435, 0x0306}:   0x04D7,
+	{0x0435, 0x0308}:   0x0451,
+	{0x0436, 0x0306}:   0x04C2,
+	{0x0436, 0x0308}:   0x04DD,
+	{0x0437, 0x0308}:   0x04DF,
+	{0x0438, 0x0300}:   0x045D,
+	{0x0438, 0x0304}:   0x04E3,
+	{0x0438, 0x0306}:   0x0439,
+	{0x0438, 0x0308}:   0x04E5,
+	{0x043A, 0x0301}:   0x045C,
+	{0x043E, 0x0308}:   0x04E7,
+	{0x0443, 0x0304}:   0x04EF,
+	{0x0443, 0x0306}:   0x045E,
+	{0x0443, 0x0308}:   0x04F1,
+	{0x0443, 0x030B}:   0x04F3,
+	{0x0447, 0x0308}:   0x04F5,
+	{0x044B, 0x0308}:   0x04F9,
+	{0x044D, 0x0308}:   0x04ED,
+	{0x0456, 0x0308}:   0x0457,
+	{0x0474, 0x030F}:   0x0476,
+	{0x0475, 0x030F}:   0x0477,
+	{0x04D8, 0x0308}:   0x04DA,
+	{0x04D9, 0x0308}:   0x04DB,
+	{0x04E8, 0x0308}:   0x04EA,
+	{0x04E9, 0x0308}:   0x04EB,
+	{0x0627, 0x0653}:   0x0622,
+	{0x0627, 0x0654}:   0x0623,
+	{0x0627, 0x0655}:   0x0625,
+	{0x0648, 0x0654}:   0x0624,
+	{0x064A, 0x0654}:   0x0626,
+	{0x06C1, 0x0654}:   0x06C2,
+	{0x06D2, 0x0654}:   0x06D3,
+	{0x06D5, 0x0654}:   0x06C0,
+	{0x0928, 0x093C}:   0x0929,
+	{0x0930, 0x093C}:   0x0931,
+	{0x0933, 0x093C}:   0x0934,
+	{0x09C7, 0x09BE}:   0x09CB,
+	{0x09C7, 0x09D7}:   0x09CC,
+	{0x0B47, 0x0B3E}:   0x0B4B,
+	{0x0B47, 0x0B56}:   0x0B48,
+	{0x0B47, 0x0B57}:   0x0B4C,
+	{0x0B92, 0x0BD7}:   0x0B94,
+	{0x0BC6, 0x0BBE}:   0x0BCA,
+	{0x0BC6, 0x0BD7}:   0x0BCC,
+	{0x0BC7, 0x0BBE}:   0x0BCB,
+	{0x0C46, 0x0C56}:   0x0C48,
+	{0x0CBF, 0x0CD5}:   0x0CC0,
+	{0x0CC6, 0x0CC2}:   0x0CCA,
+	{0x0CC6, 0x0CD5}:   0x0CC7,
+	{0x0CC6, 0x0CD6}:   0x0CC8,
+	{0x0CCA, 0x0CD5}:   0x0CCB,
+	{0x0D46, 0x0D3E}:   0x0D4A,
+	{0x0D46, 0x0D57}:   0x0D4C,
+	{0x0D47, 0x0D3E}:   0x0D4B,
+	{0x0DD9, 0x0DCA}:   0x0DDA,
+	{0x0DD9, 0x0DCF}:   0x0DDC,
+	{0x0DD9, 0x0DDF}:   0x0DDE,
+	{0x0DDC, 0x0DCA}:   0x0DDD,
+	{0x1025, 0x102E}:   0x1026,
+	{0x1B05, 0x1B35}:   0x1B06,
+	{0x1B07, 0x1B35}:   0x1B08,
+	{0x1B09, 0x1B35}:   0x1B0A,
+	{0x1B0B, 0x1B35}:   0x1B0C,
+	{0x1B0D, 0x1B35}:   0x1B0E,
+	{0x1B11, 0x1B35}:   0x1B12,
+	{0x1B3A, 0x1B35}:   0x1B3B,
+	{0x1B3C, 0x1B35}:   0x1B3D,
+	{0x1B3E, 0x1B35}:   0x1B40,
+	{0x1B3F, 0x1B35}:   0x1B41,
+	{0x1B42, 0x1B35}:   0x1B43,
+	{0x1E36, 0x0304}:   0x1E38,
+	{0x1E37, 0x0304}:   0x1E39,
+	{0x1E5A, 0x0304}:   0x1E5C,
+	{0x1E5B, 0x0304}:   0x1E5D,
+	{0x1E62, 0x0307}:   0x1E68,
+	{0x1E63, 0x0307}:   0x1E69,
+	{0x1EA0, 0x0302}:   0x1EAC,
+	{0x1EA0, 0x0306}:   0x1EB6,
+	{0x1EA1, 0x0302}:   0x1EAD,
+	{0x1EA1, 0x0306}:   0x1EB7,
+	{0x1EB8, 0x0302}:   0x1EC6,
+	{0x1EB9, 0x0302}:   0x1EC7,
+	{0x1ECC, 0x0302}:   0x1ED8,
+	{0x1ECD, 0x0302}:   0x1ED9,
+	{0x1F00, 0x0300}:   0x1F02,
+	{0x1F00, 0x0301}:   0x1F04,
+	{0x1F00, 0x0342}:   0x1F06,
+	{0x1F00, 0x0345}:   0x1F80,
+	{0x1F01, 0x0300}:   0x1F03,
+	{0x1F01, 0x0301}:   0x1F05,
+	{0x1F01, 0x0342}:   0x1F07,
+	{0x1F01, 0x0345}:   0x1F81,
+	{0x1F02, 0x0345}:   0x1F82,
+	{0x1F03, 0x0345}:   0x1F83,
+	{0x1F04, 0x0345}:   0x1F84,
+	{0x1F05, 0x0345}:   0x1F85,
+	{0x1F06, 0x0345}:   0x1F86,
+	{0x1F07, 0x0345}:   0x1F87,
+	{0x1F08, 0x0300}:   0x1F0A,
+	{0x1F08, 0x0301}:   0x1F0C,
+	{0x1F08, 0x0342}:   0x1F0E,
+	{0x1F08, 0x0345}:   0x1F88,
+	{0x1F09, 0x0300}:   0x1F0B,
+	{0x1F09, 0x0301}:   0x1F0D,
+	{0x1F09, 0x0342}:   0x1F0F,
+	{0x1F09, 0x0345}:   0x1F89,
+	{0x1F0A, 0x0345}:   0x1F8A,
+	{0x1F0B, 0x0345}:   0x1F8B,
+	{0x1F0C, 0x0345}:   0x1F8C,
+	{0x1F0D, 0x0345}:   0x1F8D,
+	{0x1F0E, 0x0345}:   0x1F8E,
+	{0x1F0F, 0x0345}:   0x1F8F,
+	{0x1F10, 0x0300}:   0x1F12,
+	{0x1F10, 0x0301}:   0x1F14,
+	{0x1F11, 0x0300}:   0x1F13,
+	{0x1F11, 0x0301}:   0x1F15,
+	{0x1F18, 0x0300}:   0x1F1A,
+	{0x1F18, 0x0301}:   0x1F1C,
+	{0x1F19, 0x0300}:   0x1F1B,
+	{0x1F19, 0x0301}:   0x1F1D,
+	{0x1F20, 0x0300}:   0x1F22,
+	{0x1F20, 0x0301}:   0x1F24,
+	{0x1F20, 0x0342}:   0x1F26,
+	{0x1F20, 0x0345}:   0x1F90,
+	{0x1F21, 0x0300}:   0x1F23,
+	{0x1F21, 0x0301}:   0x1F25,
+	{0x1F21, 0x0342}:   0x1F27,
+	{0x1F21, 0x0345}:   0x1F91,
+	{0x1F22, 0x0345}:   0x1F92,
+	{0x1F23, 0x0345}:   0x1F93,
+	{0x1F24, 0x0345}:   0x1F94,
+	{0x1F25, 0x0345}:   0x1F95,
+	{0x1F26, 0x0345}:   0x1F96,
+	{0x1F27, 0x0345}:   0x1F97,
+	{0x1F28, 0x0300}:   0x1F2A,
+	{0x1F28, 0x0301}:   0x1F2C,
+	{0x1F28, 0x0342}:   0x1F2E,
+	{0x1F28, 0x0345}:   0x1F98,
+	{0x1F29, 0x0300}:   0x1F2B,
+	{0x1F29, 0x0301}:   0x1F2D,
+	{0x1F29, 0x0342}:   0x1F2F,
+	{0x1F29, 0x0345}:   0x1F99,
+	{0x1F2A, 0x0345}:   0x1F9A,
+	{0x1F2B, 0x0345}:   0x1F9B,
+	{0x1F2C, 0x0345}:   0x1F9C,
+	{0x1F2D, 0x0345}:   0x1F9D,
+	{0x1F2E, 0x0345}:   0x1F9E,
+	{0x1F2F, 0x0345}:   0x1F9F,
+	{0x1F30, 0x0300}:   0x1F32,
+	{0x1F30, 0x0301}:   0x1F34,
+	{0x1F30, 0x0342}:   0x1F36,
+	{0x1F31, 0x0300}:   0x1F33,
+	{0x1F31, 0x0301}:   0x1F35,
+	{0x1F31, 0x0342}:   0x1F37,
+	{0x1F38, 0x0300}:   0x1F3A,
+	{0x1F38, 0x0301}:   0x1F3C,
+	{0x1F38, 0x0342}:   0x1F3E,
+	{0x1F39, 0x0300}:   0x1F3B,
+	{0x1F39, 0x0301}:   0x1F3D,
+	{0x1F39, 0x0342}:   0x1F3F,
+	{0x1F40, 0x0300}:   0x1F42,
+	{0x1F40, 0x0301}:   0x1F44,
+	{0x1F41, 0x0300}:   0x1F43,
+	{0x1F41, 0x0301}:   0x1F45,
+	{0x1F48, 0x0300}:   0x1F4A,
+	{0x1F48, 0x0301}:   0x1F4C,
+	{0x1F49, 0x0300}:   0x1F4B,
+	{0x1F49, 0x0301}:   0x1F4D,
+	{0x1F50, 0x0300}:   0x1F52,
+	{0x1F50, 0x0301}:   0x1F54,
+	{0x1F50, 0x0342}:   0x1F56,
+	{0x1F51, 0x0300}:   0x1F53,
+	{0x1F51, 0x0301}:   0x1F55,
+	{0x1F51, 0x0342}:   0x1F57,
+	{0x1F59, 0x0300}:   0x1F5B,
+	{0x1F59, 0x0301}:   0x1F5D,
+	{0x1F59, 0x0342}:   0x1F5F,
+	{0x1F60, 0x0300}:   0x1F62,
+	{0x1F60, 0x0301}:   0x1F64,
+	{0x1F60, 0x0342}:   0x1F66,
+	{0x1F60, 0x0345}:   0x1FA0,
+	{0x1F61, 0x0300}:   0x1F63,
+	{0x1F61, 0x0301}:   0x1F65,
+	{0x1F61, 0x0342}:   0x1F67,
+	{0x1F61, 0x0345}:   0x1FA1,
+	{0x1F62, 0x0345}:   0x1FA2,
+	{0x1F63, 0x0345}:   0x1FA3,
+	{0x1F64, 0x0345}:   0x1FA4,
+	{0x1F65, 0x0345}:   0x1FA5,
+	{0x1F66, 0x0345}:   0x1FA6,
+	{0x1F67, 0x0345}:   0x1FA7,
+	{0x1F68, 0x0300}:   0x1F6A,
+	{0x1F68, 0x0301}:   0x1F6C,
+	{0x1F68, 0x0342}:   0x1F6E,
+	{0x1F68, 0x0345}:   0x1FA8,
+	{0x1F69, 0x0300}:   0x1F6B,
+	{0x1F69, 0x0301}:   0x1F6D,
+	{0x1F69, 0x0342}:   0x1F6F,
+	{0x1F69, 0x0345}:   0x1FA9,
+	{0x1F6A, 0x0345}:   0x1FAA,
+	{0x1F6B, 0x0345}:   0x1FAB,
+	{0x1F6C, 0x0345}:   0x1FAC,
+	{0x1F6D, 0x0345}:   0x1FAD,
+	{0x1F6E, 0x0345}:   0x1FAE,
+	{0x1F6F, 0x0345}:   0x1FAF,
+	{0x1F70, 0x0345}:   0x1FB2,
+	{0x1F74, 0x0345}:   0x1FC2,
+	{0x1F7C, 0x0345}:   0x1FF2,
+	{0x1FB6, 0x0345}:   0x1FB7,
+	{0x1FBF, 0x0300}:   0x1FCD,
+	{0x1FBF, 0x0301}:   0x1FCE,
+	{0x1FBF, 0x0342}:   0x1FCF,
+	{0x1FC6, 0x0345}:   0x1FC7,
+	{0x1FF6, 0x0345}:   0x1FF7,
+	{0x1FFE, 0x0300}:   0x1FDD,
+	{0x1FFE, 0x0301}:   0x1FDE,
+	{0x1FFE, 0x0342}:   0x1FDF,
+	{0x2190, 0x0338}:   0x219A,
+	{0x2192, 0x0338}:   0x219B,
+	{0x2194, 0x0338}:   0x21AE,
+	{0x21D0, 0x0338}:   0x21CD,
+	{0x21D2, 0x0338}:   0x21CF,
+	{0x21D4, 0x0338}:   0x21CE,
+	{0x2203, 0x0338}:   0x2204,
+	{0x2208, 0x0338}:   0x2209,
+	{0x220B, 0x0338}:   0x220C,
+	{0x2223, 0x0338}:   0x2224,
+	{0x2225, 0x0338}:   0x2226,
+	{0x223C, 0x0338}:   0x2241,
+	{0x2243, 0x0338}:   0x2244,
+	{0x2245, 0x0338}:   0x2247,
+	{0x2248, 0x0338}:   0x2249,
+	{0x224D, 0x0338}:   0x226D,
+	{0x2261, 0x0338}:   0x2262,
+	{0x2264, 0x0338}:   0x2270,
+	{0x2265, 0x0338}:   0x2271,
+	{0x2272, 0x0338}:   0x2274,
+	{0x2273, 0x0338}:   0x2275,
+	{0x2276, 0x0338}:   0x2278,
+	{0x2277, 0x0338}:   0x2279,
+	{0x227A, 0x0338}:   0x2280,
+	{0x227B, 0x0338}:   0x2281,
+	{0x227C, 0x0338}:   0x22E0,
+	{0x227D, 0x0338}:   0x22E1,
+	{0x2282, 0x0338}:   0x2284,
+	{0x2283, 0x0338}:   0x2285,
+	{0x2286, 0x0338}:   0x2288,
+	{0x2287, 0x0338}:   0x2289,
+	{0x2291, 0x0338}:   0x22E2,
+	{0x2292, 0x0338}:   0x22E3,
+	{0x22A2, 0x0338}:   0x22AC,
+	{0x22A8, 0x0338}:   0x22AD,
+	{0x22A9, 0x0338}:   0x22AE,
+	{0x22AB, 0x0338}:   0x22AF,
+	{0x22B2, 0x0338}:   0x22EA,
+	{0x22B3, 0x0338}:   0x22EB,
+	{0x22B4, 0x0338}:   0x22EC,
+	{0x22B5, 0x0338}:   0x22ED,
+	{0x3046, 0x3099}:   0x3094,
+	{0x304B, 0x3099}:   0x304C,
+	{0x304D, 0x3099}:   0x304E,
+	{0x304F, 0x3099}:   0x3050,
+	{0x3051, 0x3099}:   0x3052,
+	{0x3053, 0x3099}:   0x3054,
+	{0x3055, 0x3099}:   0x3056,
+	{0x3057, 0x3099}:   0x3058,
+	{0x3059, 0x3099}:   0x305A,
+	{0x305B, 0x3099}:   0x305C,
+	{0x305D, 0x3099}:   0x305E,
+	{0x305F, 0x3099}:   0x3060,
+	{0x3061, 0x3099}:   0x3062,
+	{0x3064, 0x3099}:   0x3065,
+	{0x3066, 0x3099}:   0x3067,
+	{0x3068, 0x3099}:   0x3069,
+	{0x306F, 0x3099}:   0x3070,
+	{0x306F, 0x309A}:   0x3071,
+	{0x3072, 0x3099}:   0x3073,
+	{0x3072, 0x309A}:   0x3074,
+	{0x3075, 0x3099}:   0x3076,
+	{0x3075, 0x309A}:   0x3077,
+	{0x3078, 0x3099}:   0x3079,
+	{0x3078, 0x309A}:   0x307A,
+	{0x307B, 0x3099}:   0x307C,
+	{0x307B, 0x309A}:   0x307D,
+	{0x309D, 0x3099}:   0x309E,
+	{0x30A6, 0x3099}:   0x30F4,
+	{0x30AB, 0x3099}:   0x30AC,
+	{0x30AD, 0x3099}:   0x30AE,
+	{0x30AF, 0x3099}:   0x30B0,
+	{0x30B1, 0x3099}:   0x30B2,
+	{0x30B3, 0x3099}:   0x30B4,
+	{0x30B5, 0x3099}:   0x30B6,
+	{0x30B7, 0x3099}:   0x30B8,
+	{0x30B9, 0x3099}:   0x30BA,
+	{0x30BB, 0x3099}:   0x30BC,
+	{0x30BD, 0x3099}:   0x30BE,
+	{0x30BF, 0x3099}:   0x30C0,
+	{0x30C1, 0x3099}:   0x30C2,
+	{0x30C4, 0x3099}:   0x30C5,
+	{0x30C6, 0x3099}:   0x30C7,
+	{0x30C8, 0x3099}:   0x30C9,
+	{0x30CF, 0x3099}:   0x30D0,
+	{0x30CF, 0x309A}:   0x30D1,
+	{0x30D2, 0x3099}:   0x30D3,
+	{0x30D2, 0x309A}:   0x30D4,
+	{0x30D5, 0x3099}:   0x30D6,
+	{0x30D5, 0x309A}:   0x30D7,
+	{0x30D8, 0x3099}:   0x30D9,
+	{0x30D8, 0x309A}:   0x30DA,
+	{0x30DB, 0x3099}:   0x30DC,
+	{0x30DB, 0x309A}:   0x30DD,
+	{0x30EF, 0x3099}:   0x30F7,
+	{0x30F0, 0x3099}:   0x30F8,
+	{0x30F1, 0x3099}:   0x30F9,
+	{0x30F2, 0x3099}:   0x30FA,
+	{0x30FD, 0x3099}:   0x30FE,
+	{0x11099, 0x110BA}: 0x1109A,
+	{0x1109B, 0x110BA}: 0x1109C,
+	{0x110A5, 0x110BA}: 0x110AB,
+	{0x11131, 0x11127}: 0x1112E,
+	{0x11132, 0x11127}: 0x1112F,
+	{0x11347, 0x1133E}: 0x1134B,
+	{0x11347, 0x11357}: 0x1134C,
+	{0x114B9, 0x114B0}: 0x114BC,
+	{0x114B9, 0x114BA}: 0x114BB,
+	{0x114B9, 0x114BD}: 0x114BE,
+	{0x115B8, 0x115AF}: 0x115BA,
+	{0x115B9, 0x115AF}: 0x115BB,
+	{0x11935, 0x11930}: 0x11938,
+}
@@ -0,0 +1,103 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OverwritePolicy selects what unpacking does with a file that already exists
+// where an archived file is extracted to
+type OverwritePolicy int
+
+const (
+	OverwriteAlways   OverwritePolicy = iota // Replace the existing file, the default
+	OverwriteNever                           // Fail the file with ErrFileExists, which fails the unpack unless ContinueOnError is set
+	OverwriteSkip                            // Keep the existing file and leave the archived one out
+	OverwriteIfNewer                         // Replace the existing file only when the archived one was modified later
+	OverwriteKeepBoth                        // Keep the existing file and extract the archived one next to it as "name (1).ext"
+)
+
+// checkOverwritePolicy rejects overwrite policies this version does not know
+func (p defaultPacker) checkOverwritePolicy() error {
+	switch p.opts.Overwrite {
+	case OverwriteAlways, OverwriteNever, OverwriteSkip, OverwriteIfNewer, OverwriteKeepBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown overwrite policy %d: %w", p.opts.Overwrite, ErrInvalidOption)
+}
+
+// keepExisting reports whether a file is left out of the extraction because
+// the file already at its output path is kept, with OverwriteSkip always and
+// with OverwriteIfNewer unless the archived file was modified later
+func (p *defaultPacker) keepExisting(outputDir string, metadata *FileMetadata) (bool, error) {
+	if p.opts.Overwrite != OverwriteSkip && p.opts.Overwrite != OverwriteIfNewer {
+		return false, nil
+	}
+	outputPath, err := p.extractPath(outputDir, metadata.Path)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Lstat(outputPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if p.opts.Overwrite == OverwriteIfNewer {
+		return !metadata.ModTime.After(info.ModTime()), nil
+	}
+	return true, nil
+}
+
+// createOutput opens the file an archived file is extracted to, truncating it
+// when it is replaced, and returns the path it was created at, which only
+// differs from outputPath with OverwriteKeepBoth
+func (p *defaultPacker) createOutput(outputPath string, metadata *FileMetadata) (*os.File, string, error) {
+	mode := os.FileMode(metadata.Mode)
+	switch p.opts.Overwrite {
+	case OverwriteNever:
+		f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, "", fmt.Errorf("error creating output file: %w", ErrFileExists)
+		}
+		return f, outputPath, err
+	case OverwriteKeepBoth:
+		for n := 0; ; n++ {
+			path := outputPath
+			if n > 0 {
+				path = numberedPath(outputPath, n)
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+			if !errors.Is(err, fs.ErrExist) {
+				return f, path, err
+			}
+		}
+	}
+
+	// A read-only file left by an earlier extraction is made writable, the
+	// archived mode is applied again once it is written
+	if info, err := os.Lstat(outputPath); err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0200 == 0 {
+		if err := os.Chmod(outputPath, info.Mode().Perm()|0200); err != nil {
+			return nil, "", fmt.Errorf("error making read-only file writable: %w", err)
+		}
+	}
+	f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	return f, outputPath, err
+}
+
+// numberedPath returns the nth alternative name for a path, "report (2).txt"
+// for "report.txt". Names starting with a dot keep it
+func numberedPath(path string, n int) string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	if ext == name || strings.TrimLeft(name, ".") == strings.TrimLeft(ext, ".") {
+		ext = ""
+	}
+	return dir + strings.TrimSuffix(name, ext) + " (" + strconv.Itoa(n) + ")" + ext
+}
@@ -0,0 +1,73 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeHonorsOverwritePolicy(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	archive := filepath.Join(t.TempDir(), "archive")
+	archived := []byte("archived contents\n")
+	intact := []byte("extracted by the interrupted run\n")
+	writeTree(t, src, map[string][]byte{"file.txt": archived, "intact.txt": intact})
+	if err := NewPacker(PackerOptions{}).Pack(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// The existing file differs from the archived one and is newer, so every
+	// policy but OverwriteAlways keeps it
+	existing := []byte("partial\n")
+	tests := []struct {
+		name     string
+		policy   OverwritePolicy
+		err      error
+		contents []byte // Contents of file.txt after unpacking
+		other    []byte // Contents of "file (1).txt", nil when it must not exist
+	}{
+		{"always", OverwriteAlways, nil, archived, nil},
+		{"never", OverwriteNever, ErrFileExists, existing, nil},
+		{"skip", OverwriteSkip, nil, existing, nil},
+		{"if newer", OverwriteIfNewer, nil, existing, nil},
+		{"keep both", OverwriteKeepBoth, nil, existing, archived},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Files are extracted under the path they were packed from
+			dir := filepath.Join(t.TempDir(), src)
+			writeTree(t, dir, map[string][]byte{"file.txt": existing, "intact.txt": intact})
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(filepath.Join(dir, "file.txt"), later, later); err != nil {
+				t.Fatal(err)
+			}
+
+			p := NewPacker(PackerOptions{Resume: true, Overwrite: tt.policy})
+			err := p.Unpack(archive, strings.TrimSuffix(dir, src))
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("Unpack returned %v, want %v", err, tt.err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.contents) {
+				t.Errorf("file.txt holds %q, want %q", got, tt.contents)
+			}
+			got, err = os.ReadFile(filepath.Join(dir, "file (1).txt"))
+			switch {
+			case tt.other == nil && !os.IsNotExist(err):
+				t.Errorf("file (1).txt exists, err %v", err)
+			case tt.other != nil && !bytes.Equal(got, tt.other):
+				t.Errorf("file (1).txt holds %q, want %q, err %v", got, tt.other, err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "intact.txt")); err != nil || !bytes.Equal(got, intact) {
+				t.Errorf("intact.txt holds %q, err %v", got, err)
+			}
+		})
+	}
+}
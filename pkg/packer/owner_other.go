@@ -0,0 +1,15 @@
+//go:build !unix
+
+package packer
+
+import "os"
+
+// fileOwner is not supported on this platform
+func fileOwner(info os.FileInfo) (uid uint32, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+// restoreOwner is not supported on this platform
+func restoreOwner(path string, metadata *FileMetadata) error {
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package packer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the numeric owner and group of a file
+func fileOwner(info os.FileInfo) (uid uint32, gid uint32, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return stat.Uid, stat.Gid, true
+}
+
+// restoreOwner sets the owner and group of a file, returning
+// errOwnerPermission when the current user may not change them
+func restoreOwner(path string, metadata *FileMetadata) error {
+	err := os.Lchown(path, int(metadata.Uid), int(metadata.Gid))
+	if errors.Is(err, syscall.EPERM) {
+		return errOwnerPermission
+	}
+	if err != nil {
+		return err
+	}
+
+	// Changing the owner clears the setuid and setgid bits
+	return os.Chmod(path, os.FileMode(metadata.Mode))
+}
@@ -0,0 +1,1207 @@
+package packer
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packer defines the interface for file packing operations
+type Packer interface {
+	// Pack takes an input directory and packs all files into blocks in the output directory
+	Pack(inputDir string, outputDir string) error
+
+	// PackFiles packs the files in a list, such as one read with ReadFileList, into
+	// blocks in the output directory. Directories in the list are walked like Pack
+	// walks its input directory
+	PackFiles(paths []string, outputDir string) error
+
+	// PackRoots packs several input directories or files into blocks in the output
+	// directory, the files of each under the prefix of its root
+	PackRoots(roots []Root, outputDir string) error
+
+	// PackSources packs files read from readers, such as pipes or sockets, into blocks
+	// in the output directory. Sources of unknown size are read until they end
+	PackSources(sources []Source, outputDir string) error
+
+	// PackFS packs all files in fsys into blocks in the output directory, allowing archives
+	// to be built from embedded, zip backed or in-memory filesystems
+	PackFS(fsys fs.FS, outputDir string) error
+
+	// PackStream packs all files in the input directory into a single stream archive written to w
+	PackStream(inputDir string, w io.Writer) error
+
+	// PackToStore packs all files in the input directory into blocks uploaded to the store
+	PackToStore(inputDir string, store BlockStore) error
+
+	// UnpackFromStore extracts files from the blocks in the store to the output directory.
+	// When patterns are given only files whose archived path matches one of them are extracted
+	UnpackFromStore(store BlockStore, outputDir string, patterns ...string) error
+
+	// Sync uploads the blocks of the archive that are missing or changed in the store, then its manifest,
+	// or only reports them with DryRun
+	Sync(archiveDir string, store BlockStore) (*SyncResult, error)
+
+	// RepairReplicas copies the blocks of a mirror store to the replicas missing them and records
+	// which replicas hold each block in its manifest
+	RepairReplicas(store *MirrorStore) (*ReplicaRepairResult, error)
+
+	// UnpackFromURL extracts files from an archive served over HTTP, fetching only their byte ranges.
+	// When patterns are given only files whose archived path matches one of them are extracted
+	UnpackFromURL(baseURL string, outputDir string, patterns ...string) error
+
+	// UnpackStream extracts files from a stream archive read sequentially from r.
+	// When patterns are given only files whose archived path matches one of them are extracted
+	UnpackStream(r io.Reader, outputDir string, patterns ...string) error
+
+	// Unpack extracts files from blocks in the input and writes them to the output directory.
+	// When patterns are given only files whose archived path matches one of them are extracted
+	Unpack(inputDir string, outputDir string, patterns ...string) error
+
+	// Find returns the archived files matching a query on their path, size and modification
+	// time, evaluated against the manifest without extracting anything
+	Find(archiveDir string, query Query) ([]FileMetadata, error)
+
+	// ExtractByChecksum extracts the files whose checksum matches one of the hex checksums
+	// or checksum prefixes, for pulling known contents out of an archive
+	ExtractByChecksum(archiveDir string, outputDir string, checksums ...string) error
+
+	// UnpackBlock extracts files from a single block and writes them to the output directory.
+	// When patterns are given only files whose archived path matches one of them are extracted
+	UnpackBlock(blockPath string, outputDir string, patterns ...string) error
+
+	// Verify checks the integrity of the packed files and fails when a block listed by the
+	// manifest or a snapshot manifest is missing
+	Verify(inputDir string) error
+
+	// VerifyWithReport checks every block of an archive and the files of those that fail,
+	// saving the result next to the archive. Blocks found intact within since by the last
+	// report and unchanged are not read again, since 0 checks every block
+	VerifyWithReport(archiveDir string, since time.Duration) (*VerifyReport, error)
+
+	// Sign signs the block checksums and manifests of an archive with an Ed25519 key,
+	// writing the detached signature next to them as archive.sig
+	Sign(archiveDir string, key ed25519.PrivateKey) error
+
+	// VerifySignature checks the signature of an archive against an Ed25519 public key,
+	// returning ErrSignatureMissing or ErrSignatureInvalid when it cannot be trusted
+	VerifySignature(archiveDir string, key ed25519.PublicKey) error
+
+	// Rekey seals the metadata keys of the blocks written with Passphrase under newPassphrase,
+	// rewriting only their footers and parity. The metadata and contents are not encrypted again
+	Rekey(archiveDir string, newPassphrase string) error
+
+	// Subset writes a new archive to the output directory containing only the files matching
+	// any of the include patterns, copying their contents directly from the existing blocks
+	Subset(archiveDir string, outputDir string, include []string) error
+
+	// Reconstruct rebuilds missing or damaged blocks from the parity blocks in the archive
+	Reconstruct(archiveDir string) error
+
+	// PlanReconstruct computes which blocks and parity files Reconstruct would rewrite
+	// without changing the archive
+	PlanReconstruct(archiveDir string) (*ReconstructPlan, error)
+
+	// List returns the metadata of every file in the archive sorted by path, so the
+	// order does not depend on how files were assigned to blocks
+	List(archiveDir string) ([]FileMetadata, error)
+
+	// PlanMerge computes how unpacking the archive would change an existing output directory
+	PlanMerge(archiveDir string, outputDir string, patterns ...string) (*MergePlan, error)
+
+	// Snapshot packs the input directory as a new snapshot generation of the archive,
+	// sharing the blocks of earlier generations for contents they already hold
+	Snapshot(inputDir string, archiveDir string) (*SnapshotInfo, error)
+
+	// Snapshots lists the snapshot generations of the archive, oldest first
+	Snapshots(archiveDir string) ([]SnapshotInfo, error)
+
+	// RestoreSnapshot extracts the files of a snapshot generation, 0 restores the latest.
+	// When patterns are given only files whose archived path matches one of them are extracted
+	RestoreSnapshot(archiveDir string, generation int, outputDir string, patterns ...string) error
+
+	// ForgetSnapshot deletes a snapshot generation, leaving its blocks for GC
+	ForgetSnapshot(archiveDir string, generation int) error
+
+	// GC removes the blocks of the archive that no snapshot references, or only reports
+	// them with DryRun
+	GC(archiveDir string) (*GCResult, error)
+
+	// Prune deletes the snapshots that expired or that no rule of the retention policy keeps,
+	// then removes the blocks no remaining snapshot references
+	Prune(archiveDir string, policy RetentionPolicy) (*PruneResult, error)
+
+	// PlanPrune reports what Prune would delete without changing the archive
+	PlanPrune(archiveDir string, policy RetentionPolicy) (*PruneResult, error)
+
+	// Compact moves the contents still referenced by snapshots out of partially referenced
+	// blocks into new ones and removes the old blocks, reclaiming the space of dead contents,
+	// or only reports those blocks with DryRun
+	Compact(archiveDir string) (*CompactResult, error)
+
+	// Upgrade rewrites the blocks written in an older version of the format in the current
+	// one, updating the manifest, snapshots and parity to their new locations
+	Upgrade(archiveDir string) (*UpgradeResult, error)
+
+	// Repair rebuilds the blocks of the archive that fail validation from the files of the
+	// source directory it was packed from, rewriting only the damaged blocks
+	Repair(archiveDir string, sourceDir string) (*RepairResult, error)
+
+	// Info returns the creation time, tool, host, labels and comment recorded in the
+	// manifest of the archive
+	Info(archiveDir string) (*ArchiveInfo, error)
+	// Fingerprint returns a digest of the files of the archive and what unpacking restores
+	// of them, equal for archives holding the same files however they were packed
+	Fingerprint(archiveDir string) (string, error)
+	// Remove marks the files matching any of the patterns as deleted in the manifest and
+	// drops them from every snapshot, compacting the archive with CompactAfterRemove. With
+	// DryRun it only reports what it would change
+	Remove(archiveDir string, patterns []string) (*RemoveResult, error)
+
+	// Rename moves an archived file, or every file below an archived directory, to a new
+	// path in the manifest and every snapshot without rewriting any block
+	Rename(archiveDir string, oldPath string, newPath string) error
+
+	// Diff compares two archives, or an archive and a directory, reporting the files added,
+	// removed and modified in b relative to a
+	Diff(a string, b string) (*DiffResult, error)
+
+	// VerifyExtracted checks every file unpacked into the output directory against the
+	// checksums stored in the archive, reporting mismatched, missing and extra files
+	VerifyExtracted(archiveDir string, outputDir string) error
+
+	// Stats returns the totals of the last pack or unpack operation, or of the one
+	// in progress, so callers can report on it without walking the files again
+	Stats() Stats
+}
+
+// PackerOptions configures the behavior of the packer
+type PackerOptions struct {
+	VerifyIntegrity        bool               // Verify the integrity of the files after packing
+	BufferSize             int                // Size of the buffer used for reading and writing files
+	BlockSize              int64              // Size of the block in bytes, 0 chooses one from the sizes of the files packed
+	VolumeSize             int64              // Split block files larger than this many bytes into volumes block-1.beam.001, block-1.beam.002, ..., 0 keeps them whole
+	PreserveACLs           bool               // Capture POSIX ACLs when packing and restore them when unpacking
+	Resume                 bool               // Resume an interrupted Pack from its journal, or Unpack by skipping intact files
+	PreserveSecurityLabels bool               // Capture SELinux contexts and file capabilities, restoring them needs privileges
+	ParityBlocks           int                // Number of Reed-Solomon parity blocks written per parity group, 0 disables parity
+	ParityGroupSize        int                // Number of data blocks protected by each parity group, defaults to 10
+	DeleteExtraneous       bool               // Delete files in the output directory that are not part of the archive when unpacking, or in the store when syncing
+	Overwrite              OverwritePolicy    // What unpacking does with files that already exist in the output directory, replacing them by default
+	AtomicUnpack           bool               // Extract to a staging directory next to a new or empty output directory and rename it into place at the end
+	SkipSpaceCheck         bool               // Unpack without first checking that the output filesystem has the space and inodes the files need
+	PreserveOwner          bool               // Record the numeric owner and group of files and restore them when unpacking
+	PreserveXattrs         bool               // Capture and restore every extended attribute of each file
+	PreserveBirthTime      bool               // Record file creation times where available and restore them where the platform allows
+	FaultInjector          FaultInjector      // Wraps file and block I/O to simulate failures in tests, nil disables
+	PathMapper             PathMapper         // Rewrites or skips the archived path of each file when packing, nil keeps paths
+	FileFilter             FileFilter         // Skips the files it returns false for when packing, after PathMapper, nil packs every file
+	Transform              FileTransform      // Rewrites the contents of the files packed, except those of PackSources, their size is only known once read, nil packs them as they are
+	FilePacked             func(FileMetadata) // Called with the metadata of each file once its contents are written to a block, nil for none
+	Scanner                Scanner            // Inspects the contents of files as they are packed and before they are extracted, failing the files it rejects, nil for none
+	ScanPhase              ScanPhase          // When Scanner is called, both when packing and unpacking by default
+	Progress               io.Writer          // Receives newline delimited JSON progress events, nil disables
+	UseMmap                bool               // Map block files into memory when unpacking instead of reading them
+	VerifyWorkers          int                // Number of workers verifying checksums while files are written, 0 verifies inline
+	ReadWorkers            int                // Number of workers reading small files ahead while packing, 0 reads each file as it is written
+	SyncPolicy             SyncPolicy         // When blocks, manifests and extracted files are flushed to disk, left to the operating system by default
+	SourceRead             SourceRead         // How source files are read when packing: through the page cache, with sequential hints or with O_DIRECT
+	ChangedFiles           ChangedFilePolicy  // What packing does with files that change while they are read, logging a warning by default
+	SpecialFiles           SpecialFilePolicy  // What packing does with named pipes, sockets and device nodes, skipping them with a warning by default
+	FollowSymlinks         bool               // Descend into symlinked directories when packing, skipping links that loop back to a directory being walked
+	OneFileSystem          bool               // Do not descend into directories on another file system than the input directory when packing, on Unix
+	MaxDepth               int                // Number of directory levels below the input directory packed, 1 packs only its own files, 0 for unlimited
+	SourceSnapshot         SourceSnapshotter  // Freezes the input directory in a filesystem snapshot that packing reads instead, nil reads it live
+	CompactMetadata        bool               // Write file metadata as varints relative to the previous file, only this version reads them
+	CBORMetadata           bool               // Write file metadata as versioned CBOR maps that other languages can read, not with CompactMetadata
+	DestinationLimits      []DestinationLimit // Write rate and concurrency caps for files extracted below given paths
+	BlockNamer             BlockNamer         // Chooses block file names, nil names blocks block-1.beam, block-2.beam, ...
+	ContinueOnError        bool               // Skip files that fail to pack or unpack and report them in a *PartialError at the end
+	Salvage                bool               // Unpack the files of damaged blocks that match their own checksum, reporting the lost ones in a *PartialError, implies ContinueOnError for unpacking
+	BlockCache             *BlockCache        // Keeps block indexes, integrity checks and small file contents across calls reading the same blocks, nil reads them every time
+	LockTimeout            time.Duration      // How long an operation waits for the archive lock held by another one, 0 fails at once with ErrArchiveLocked
+	NoArchiveLock          bool               // Use archive directories without locking them, for archives only one process ever uses
+	Format                 Format             // File format of the volumes written when packing, .beam blocks by default
+	CompactAfterRemove     bool               // Compact the archive at the end of Remove, erasing the removed contents from disk
+	DryRun                 bool               // Make GC and Compact report the blocks they would remove or rewrite, Remove log the files it would mark deleted and Sync report what it would upload and delete, without changing the archive or store
+	PathNormalization      PathNormalization  // Unicode form of the archived paths when packing and of the extracted paths, unchanged by default
+	Labels                 map[string]string  // Labels, or archive tags, recorded in the archive info of the manifest when it is written, replacing recorded labels of the same name
+	Comment                string             // Comment recorded in the archive info of the manifest when it is written, replacing the recorded one
+	Tags                   []TagRule          // Tags recorded in the manifest for the archived files matching each rule when it is written, later rules replacing the tags of earlier ones
+	ExpiresAfter           time.Duration      // Record that a snapshot, or else the archive info of the manifest, expires this long after it is written, 0 records no expiry
+	Logger                 *slog.Logger       // Receives the messages of every operation, nil logs through slog.Default
+	Metrics                Metrics            // Receives counters of bytes, files, blocks and errors and the fill of blocks, nil disables
+	MaxBytesPerSecond      int64              // Caps the combined rate of reading file contents and writing blocks, parity, extracted files and store uploads, 0 for unlimited
+	ZeroRunEncoding        bool               // Leave runs of 4KB or more zeros out of the blocks and record their length instead
+	Compression            Compression        // Compress file contents in the blocks, storing files of compressed formats and files that do not compress, only this version reads them
+	TrainDictionary        bool               // With CompressionZstd, train a dictionary on a sample of the small files packed and keep it in the manifest, which the archive then needs
+	LowImpact              bool               // Use one worker, idle CPU and I/O priority for the whole process and pauses between files, for busy servers
+	MultiBufferHashing     bool               // Hash the blocks of a parity group and the files of stream blocks side by side in AVX-512 lanes where the CPU has them
+	SigningKey             ed25519.PrivateKey // Signs the archive whenever an operation writes its manifests, nil leaves signatures alone
+	TrustedKey             ed25519.PublicKey  // Makes Verify fail unless the archive carries a valid signature by this key, nil skips the check
+	MetadataKey            []byte             // AES-256 key encrypting the paths, sizes and other metadata of the blocks written and decrypting them on reads, nil for none
+	Passphrase             string             // Encrypts metadata like MetadataKey with a random key per run sealed by an Argon2id key from this passphrase, takes precedence on writes
+	// Concurrent      bool // Enable concurrent processing
+
+}
+
+// PathMapper maps the path of a file on disk to the path recorded in the
+// archive, or reports that the file should not be packed at all
+type PathMapper func(srcPath string) (archivePath string, skip bool)
+
+type defaultPacker struct {
+	opts         PackerOptions
+	validator    *Validator
+	buffers      *bufferPool
+	progress     *progressReporter
+	destinations destinationLimits
+	rate         *rateLimiter         // MaxBytesPerSecond schedule, shared by copies of the packer
+	pace         *pacer               // Pauses between files with LowImpact
+	failures     *failureLog          // Files skipped by the current call, set per call when ContinueOnError is set
+	checkChanges bool                 // Source files are checked for changes once copied, set per call by the calls packing from disk
+	frozen       *frozenSource        // Snapshot of the input directory read by the current call, nil reads it live
+	dictionary   *zstdDictionary      // zstd dictionary the current call compresses with, nil compresses without one
+	roots        []ManifestRoot       // Input roots packed by the current call, recorded in the manifest
+	rejected     map[scannedFile]bool // Files the Scanner failed, left out by the current call
+	locked       []string             // Archive directories the current call holds the lock of
+	keys         *keyring             // Keys derived from Passphrase, shared by copies of the packer
+	syncs        *syncLog             // Files waiting to be flushed under SyncPolicy, shared by copies of the packer
+}
+
+// logger returns the logger of the packer
+func (p defaultPacker) logger() *slog.Logger {
+	if p.opts.Logger != nil {
+		return p.opts.Logger
+	}
+	return slog.Default()
+}
+
+// NewPacker returns a Packer configured by opts
+func NewPacker(opts PackerOptions) Packer {
+	if opts.LowImpact {
+		opts.ReadWorkers = min(opts.ReadWorkers, lowImpactWorkers)
+		opts.VerifyWorkers = min(opts.VerifyWorkers, lowImpactWorkers)
+	}
+	validator := NewValidator(opts.BufferSize)
+	p := defaultPacker{
+		opts:         opts,
+		validator:    validator,
+		buffers:      validator.buffers,
+		progress:     newProgressReporter(opts.Progress, opts.Metrics),
+		destinations: newDestinationLimits(opts.DestinationLimits),
+		rate:         newRateLimiter(opts.MaxBytesPerSecond, rateBurst),
+		pace:         newPacer(opts.LowImpact),
+		keys:         newKeyring(opts.Passphrase),
+		syncs:        newSyncLog(opts.SyncPolicy),
+	}
+	if opts.LowImpact {
+		p.lowerPriority()
+	}
+	return p
+}
+
+func (p defaultPacker) Pack(inputDir string, outputDir string) error {
+	unlock, err := p.lockArchive(outputDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	p.failures = p.newFailureLog()
+	p.checkChanges = true
+	frozen, err := p.freezeSource(inputDir)
+	if err != nil {
+		return err
+	}
+	defer frozen.close(p.logger())
+	p.frozen = frozen
+	fileInfos, err := p.planFiles(inputDir)
+	if err != nil {
+		return err
+	}
+	return p.failures.result("pack", p.packPlanned(fileInfos, outputDir, p.sourceOpener()))
+}
+
+// packPlanned packs the planned files into blocks in the output directory,
+// reading their contents through open
+func (p defaultPacker) packPlanned(fileInfos []FileInfo, outputDir string, open contentOpener) (err error) {
+	if err := p.checkFormat(); err != nil {
+		return err
+	}
+	p.opts.BlockSize = p.blockSizeFor(fileSizes(fileInfos))
+
+	// Create outputDir
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+	if p.dictionary, err = p.archiveDictionary(outputDir, fileInfos, open); err != nil {
+		return err
+	}
+
+	journal, err := p.openJournal(outputDir)
+	if err != nil {
+		return err
+	}
+
+	// Skip files already packed into completed blocks
+	if packed := journal.packedFiles(); len(packed) > 0 {
+		remaining := fileInfos[:0]
+		for _, file := range fileInfos {
+			if !packed[file.ArchivePath] {
+				remaining = append(remaining, file)
+			}
+		}
+		p.logger().Info("Resuming pack", "blocks_written", len(journal.entries), "files_remaining", len(remaining))
+		fileInfos = remaining
+	}
+
+	p.progress.start("pack", len(fileInfos), totalBytes(fileInfos))
+	defer func() { p.progress.finish(err) }()
+
+	err = p.packFiles(fileInfos, journal.nextBlockID(), func(block *Block) error {
+		if err := p.writeBlock(block, outputDir, open); err != nil {
+			return fmt.Errorf("error writing block: %w", err)
+		}
+		p.progress.blockWritten(block, p.opts.BlockSize)
+		return journal.complete(block)
+	})
+	if err != nil {
+		journal.f.Close()
+		return err
+	}
+
+	// Protect the written blocks with parity blocks
+	if p.opts.ParityBlocks > 0 {
+		var blockIDs []int32
+		for _, entry := range journal.entries {
+			blockIDs = append(blockIDs, entry.BlockID)
+		}
+		if err := p.writeParity(outputDir, blockIDs); err != nil {
+			journal.f.Close()
+			return err
+		}
+	}
+	if err := p.writeManifest(outputDir); err != nil {
+		journal.f.Close()
+		return err
+	}
+	return journal.finish()
+}
+
+func (p defaultPacker) Unpack(inputDir string, outputDir string, patterns ...string) (err error) {
+	unlock, err := p.lockArchive(inputDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	if p.opts.AtomicUnpack {
+		return p.unpackAtomically(outputDir, func(p defaultPacker, dir string) error {
+			return p.Unpack(inputDir, dir, patterns...)
+		})
+	}
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkOverwritePolicy(); err != nil {
+		return err
+	}
+	if err := p.checkScanPhase(); err != nil {
+		return err
+	}
+	p.failures = p.newUnpackFailureLog()
+	blockPaths, err := archiveBlocks(inputDir)
+	if err != nil {
+		return err
+	}
+
+	// Work out how the output directory changes before touching it
+	plan, err := p.PlanMerge(inputDir, outputDir, patterns...)
+	if err != nil {
+		return fmt.Errorf("error planning merge into output directory: %w", err)
+	}
+	if len(plan.Overwrite) > 0 || len(plan.Extraneous) > 0 {
+		p.logger().Info("Merging into existing output directory", "new", len(plan.New), "overwritten", len(plan.Overwrite),
+			"extraneous", len(plan.Extraneous), "delete_extraneous", p.opts.DeleteExtraneous)
+	}
+
+	if err := p.checkDiskSpace(outputDir, plan); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Totals are only counted up front for progress events, Stats needs none
+	var files int
+	var size int64
+	if p.opts.Progress != nil {
+		var countErr error
+		if files, size, countErr = p.countMatching(inputDir, patterns); countErr != nil {
+			return countErr
+		}
+	}
+	p.progress.start("unpack", files, size)
+	defer func() { p.progress.finish(err) }()
+
+	edits, err := loadEdits(inputDir)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	if p.scansUnpack() {
+		if p.rejected, err = p.scanBlocks(blockPaths, patterns, edits); err != nil {
+			return err
+		}
+	}
+	for _, blockPath := range blockPaths {
+		if err := p.unpackBlock(blockPath, outputDir, patterns, edits); err != nil {
+			err = fmt.Errorf("error unpacking block %s: %w", filepath.Base(blockPath), err)
+			if err := p.failures.skip(blockPath, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.opts.DeleteExtraneous {
+		if err := plan.deleteExtraneous(outputDir); err != nil {
+			return err
+		}
+	}
+	if err := p.syncs.flush(); err != nil {
+		return err
+	}
+	return p.failures.result("unpack", nil)
+}
+
+func (p defaultPacker) UnpackBlock(blockPath string, outputDir string, patterns ...string) error {
+	unlock, err := p.lockArchive(blockPath, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkOverwritePolicy(); err != nil {
+		return err
+	}
+	if err := p.checkScanPhase(); err != nil {
+		return err
+	}
+	p.failures = p.newUnpackFailureLog()
+	edits, err := loadEdits(blockPath)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+	if p.scansUnpack() {
+		if p.rejected, err = p.scanBlocks([]string{blockPath}, patterns, edits); err != nil {
+			return p.failures.result("unpack", err)
+		}
+	}
+	if err := p.unpackBlock(blockPath, outputDir, patterns, edits); err != nil {
+		return p.failures.result("unpack", err)
+	}
+	return p.failures.result("unpack", p.syncs.flush())
+}
+
+// unpackBlock extracts the files of a block matching the patterns and not
+// removed from the archive, under their current path, skipping the files that
+// fail when failures are collected
+func (p defaultPacker) unpackBlock(blockPath string, outputDir string, patterns []string, edits manifestEdits) error {
+	// Read block header and file metadata
+	block, damaged, err := p.readSalvageIndex(blockPath)
+	if err != nil {
+		return err
+	}
+	if damaged {
+		p.logger().Warn("Block index is damaged, salvaging the files the manifest lists in it", "block", filepath.Base(blockPath))
+	}
+	edits.apply(block)
+
+	// Select the files to extract, leaving out those the scanner failed. Blocks
+	// without matches are not read any further
+	files := matchingFiles(block, patterns)
+	if len(p.rejected) > 0 {
+		kept := files[:0]
+		for _, metadata := range files {
+			if !p.rejected[scannedFile{block.ID, metadata.Path}] {
+				kept = append(kept, metadata)
+			}
+		}
+		files = kept
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// Verify block integrity. A block missing volumes cannot be checked as a
+	// whole, the files in the volumes present are still extracted and checked
+	// against their checksums while those in missing volumes fail
+	if (p.opts.VerifyIntegrity || p.opts.Salvage) && !damaged && !p.opts.BlockCache.verified(block.stamp) {
+		err := p.validator.ValidateBlock(blockPath)
+		if errors.Is(err, ErrMissingVolume) {
+			p.logger().Warn("Block is missing volumes, extracting the files of the volumes present", "block", filepath.Base(blockPath), "error", err)
+		} else if err != nil && p.opts.Salvage {
+			p.logger().Warn("Block is damaged, salvaging the files that match their checksum", "block", filepath.Base(blockPath), "error", err)
+			damaged = true
+		} else if err != nil {
+			return fmt.Errorf("error verifying block integrity: %w", err)
+		} else {
+			p.opts.BlockCache.putVerified(block.stamp)
+		}
+	}
+
+	// Open block file
+	r, err := p.openBlockReader(blockPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if damaged {
+		if files, err = p.salvageFiles(block, files, r); err != nil {
+			return err
+		}
+	}
+	return p.extractBlock(block, files, r, outputDir)
+}
+
+// matchingFiles returns the files of a block whose archived path matches any
+// of the patterns
+func matchingFiles(block *Block, patterns []string) []FileMetadata {
+	var files []FileMetadata
+	for _, metadata := range block.Files {
+		if matchAny(patterns, metadata.Path) {
+			files = append(files, metadata)
+		}
+	}
+	return files
+}
+
+// extractBlock extracts the given files of a block read through r
+func (p defaultPacker) extractBlock(block *Block, files []FileMetadata, r blockReader, outputDir string) error {
+	blockID := block.ID
+	var stats extractStats
+	verify := newVerifier(p.opts.VerifyWorkers, p.buffers)
+	for _, metadata := range files {
+		// Skip over files a previous run already extracted
+		if p.opts.Resume {
+			ok, err := p.isExtracted(outputDir, &metadata)
+			if err != nil {
+				if err := p.failures.skip(metadata.Path, fmt.Errorf("error checking extracted file: %w", err)); err != nil {
+					return fmt.Errorf("error checking extracted file %s: %w", metadata.Path, err)
+				}
+				continue
+			}
+			if ok {
+				stats.intact++
+				p.progress.file(&metadata, true)
+				continue
+			}
+		}
+
+		// Leave existing files alone under OverwritePolicy
+		keep, err := p.keepExisting(outputDir, &metadata)
+		if err != nil {
+			if err := p.failures.skip(metadata.Path, fmt.Errorf("error checking existing file: %w", err)); err != nil {
+				return fmt.Errorf("error checking existing file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+		if keep {
+			stats.kept++
+			p.progress.file(&metadata, true)
+			continue
+		}
+
+		contents, err := p.blockContents(block, &metadata, r)
+		if err == nil {
+			err = p.extractFile(contents, outputDir, &metadata, verify)
+		}
+		if err := stats.record(err); err != nil {
+			if err := p.failures.skip(metadata.Path, err); err != nil {
+				verify.wait()
+				return fmt.Errorf("error extracting file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+		p.progress.file(&metadata, false)
+		p.pace.wait()
+	}
+
+	if err := verify.wait(); err != nil {
+		if err := p.failures.skipIntegrity(err); err != nil {
+			return err
+		}
+	}
+	verify.print(p.logger(), blockID)
+	if err := p.syncs.blockDone(); err != nil {
+		return err
+	}
+	p.progress.block(block)
+	stats.print(p.logger(), "block", blockID)
+	p.logger().Debug("Extracted block", "block", blockID, "files", len(files))
+	return nil
+}
+
+func (p defaultPacker) Verify(inputDir string) error {
+	unlock, err := p.lockArchive(inputDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	blockPaths, err := archiveBlocks(inputDir)
+	if err != nil {
+		return err
+	}
+	if err := p.checkSignature(inputDir); err != nil {
+		return err
+	}
+	missing, err := missingBlocks(inputDir, blockPaths)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("blocks listed in the manifest are missing: %s: %w", strings.Join(missing, ", "), ErrCorrupted)
+	}
+
+	for _, blockPath := range blockPaths {
+		if err := p.validator.ValidateBlock(blockPath); err != nil {
+			return fmt.Errorf("error verifying block integrity: %w", err)
+		}
+	}
+	return nil
+}
+
+// missingBlocks returns the names of the blocks listed by the manifest or a
+// snapshot manifest of an archive directory that are not among its block
+// files, sorted. An archive without a manifest has none missing
+func missingBlocks(archiveDir string, blockPaths []string) ([]string, error) {
+	present := make(map[string]bool, len(blockPaths))
+	for _, blockPath := range blockPaths {
+		present[filepath.Base(blockPath)] = true
+	}
+	info, err := os.Stat(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get input directory info: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, nil
+	}
+
+	var manifests []*Manifest
+	m, err := readManifestFile(filepath.Join(archiveDir, manifestFileName))
+	switch {
+	case err == nil:
+		manifests = append(manifests, m)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		manifests = append(manifests, ref.manifest)
+	}
+
+	listed := make(map[string]bool)
+	var missing []string
+	for _, m := range manifests {
+		for _, block := range m.Blocks {
+			if !present[block.Name] && !listed[block.Name] {
+				missing = append(missing, block.Name)
+			}
+			listed[block.Name] = true
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+func (p defaultPacker) VerifyExtracted(archiveDir string, outputDir string) error {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	files, err := p.readArchiveIndex(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	result := &ExtractedFilesError{}
+	expected := make(map[string]bool)
+
+	for _, metadata := range files {
+		relPath, err := p.outputRelPath(outputDir, metadata.Path)
+		if err != nil {
+			return err
+		}
+		expected[relPath] = true
+
+		err = p.validator.VerifyFileIntegrity(filepath.Join(outputDir, relPath), metadata.Checksum)
+		var integrityErr *FileIntegrityError
+		switch {
+		case err == nil:
+		case errors.As(err, &integrityErr):
+			integrityErr.Path = relPath
+			result.Mismatched = append(result.Mismatched, integrityErr)
+		case errors.Is(err, os.ErrNotExist):
+			result.Missing = append(result.Missing, relPath)
+		default:
+			return fmt.Errorf("error verifying file %s: %w", relPath, err)
+		}
+	}
+
+	// Anything else in the output directory was not part of the archive
+	result.Extra, err = findExtraneous(archiveDir, outputDir, expected)
+	if err != nil {
+		return err
+	}
+
+	if len(result.Mismatched) > 0 || len(result.Missing) > 0 || len(result.Extra) > 0 {
+		sort.Slice(result.Mismatched, func(i, j int) bool { return result.Mismatched[i].Path < result.Mismatched[j].Path })
+		sort.Strings(result.Missing)
+		sort.Strings(result.Extra)
+		return result
+	}
+	return nil
+}
+
+func (p defaultPacker) List(archiveDir string) ([]FileMetadata, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	files, err := p.readArchiveIndex(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	sortByPath(files)
+	return files, nil
+}
+
+// sortByPath orders files lexicographically by path, breaking ties by block
+// and offset so the order is fully deterministic
+func sortByPath(files []FileMetadata) {
+	sort.Slice(files, func(i, j int) bool {
+		a, b := &files[i], &files[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.BlockID != b.BlockID {
+			return a.BlockID < b.BlockID
+		}
+		return a.Offset < b.Offset
+	})
+}
+
+// readArchiveIndex reads the file metadata of every block in the archive
+func (p defaultPacker) readArchiveIndex(archiveDir string) ([]FileMetadata, error) {
+	blockPaths, err := listBlocks(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	edits, err := loadEdits(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	var files []FileMetadata
+	for _, blockPath := range blockPaths {
+		block, _, err := p.readSalvageIndex(blockPath)
+		if err != nil {
+			err = fmt.Errorf("error reading block %s: %w", filepath.Base(blockPath), err)
+			if err := p.failures.skip(blockPath, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		edits.apply(block)
+		files = append(files, block.Files...)
+	}
+	return files, nil
+}
+
+// countMatching returns the number and combined size of the archived files
+// matching any of the patterns
+func (p defaultPacker) countMatching(archiveDir string, patterns []string) (int, int64, error) {
+	files, err := p.readArchiveIndex(archiveDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int
+	var size int64
+	for _, metadata := range files {
+		if matchAny(patterns, metadata.Path) {
+			count++
+			size += metadata.Size
+		}
+	}
+	return count, size, nil
+}
+
+// listBlocks returns the block files in a directory sorted by name, or the
+// path itself if it points at a single block
+func listBlocks(inputDir string) ([]string, error) {
+	paths, err := listVolumes(inputDir, blockExt)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 1 && paths[0] == inputDir {
+		// A single block, or one volume standing for its block
+		if n, blockPath := volumeNumber(inputDir); n > 0 {
+			return []string{blockPath}, nil
+		}
+		return paths, nil
+	}
+
+	// Blocks split under VolumeSize are listed once, under the path they would
+	// have whole, unless the whole block file is there as well
+	split, err := splitBlocks(inputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input directory: %w", err)
+	}
+	whole := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		whole[path] = true
+	}
+	for _, path := range split {
+		if !whole[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// archiveBlocks returns the blocks of an archive being read like listBlocks,
+// failing for a directory holding none and for zip volumes, which are read
+// with zip tools rather than by this package
+func archiveBlocks(inputDir string) ([]string, error) {
+	blockPaths, err := listBlocks(inputDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(blockPaths) == 1 && blockPaths[0] == inputDir && strings.EqualFold(filepath.Ext(inputDir), zipExt) {
+		return nil, fmt.Errorf("%s is a zip volume, extract it with a zip tool: %w", inputDir, ErrInvalidOption)
+	}
+	if len(blockPaths) > 0 {
+		return blockPaths, nil
+	}
+	zips, err := listVolumes(inputDir, zipExt)
+	if err != nil {
+		return nil, err
+	}
+	if len(zips) > 0 {
+		return nil, fmt.Errorf("%s holds zip volumes, extract them with a zip tool: %w", inputDir, ErrInvalidOption)
+	}
+	return nil, fmt.Errorf("%w in %s, it holds no blocks", ErrNoFiles, inputDir)
+}
+
+// listVolumes returns the files with the given extension in a directory
+// sorted by name, or the path itself if it points at a single file
+func listVolumes(inputDir string, ext string) ([]string, error) {
+	info, err := os.Stat(inputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get input directory info: %w", err)
+	}
+
+	if !info.IsDir() {
+		return []string{inputDir}, nil
+	}
+
+	entries, err := os.ReadDir(inputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input directory: %w", err)
+	}
+
+	var blockPaths []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ext {
+			blockPaths = append(blockPaths, filepath.Join(inputDir, entry.Name()))
+		}
+	}
+	return blockPaths, nil
+}
+
+// collectFileInfo collects file info for all files in the input directory
+func (p defaultPacker) collectFileInfo(files []string) ([]FileInfo, error) {
+	var fileInfo []FileInfo
+
+	stats := p.statFiles(files)
+	for i, path := range files {
+		info, err := stats[i].info, stats[i].err
+		if err != nil {
+			if err := p.failures.skip(path, fmt.Errorf("error getting file info: %w", err)); err != nil {
+				return nil, fmt.Errorf("error getting file info: %w", err)
+			}
+			continue
+		}
+
+		if p.opts.BlockSize > 0 && info.Size() > p.opts.BlockSize {
+			p.logger().Warn("Skipping file, size exceeds block size", "path", path)
+			continue
+		}
+
+		// Special files are never read, only recorded with SpecialFileRecord
+		var device uint64
+		if isSpecialMode(uint32(info.Mode())) {
+			keep, err := p.keepSpecial(path, info)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+			device = fileDeviceNumber(info)
+		}
+
+		if !info.IsDir() {
+			uid, gid, _ := fileOwner(info)
+			fileInfo = append(fileInfo, FileInfo{
+				Path:       path,
+				Size:       info.Size(),
+				ModTime:    info.ModTime(),
+				Mode:       uint32(info.Mode()),
+				Uid:        uid,
+				Gid:        gid,
+				BirthTime:  stats[i].birthTime,
+				Attributes: fileAttributes(info),
+				Holes:      stats[i].holes,
+				Device:     device,
+				IsDir:      false,
+			})
+		}
+	}
+	return fileInfo, nil
+}
+
+// fileStat is what collectFileInfo needs from the filesystem about a file
+type fileStat struct {
+	info      os.FileInfo
+	birthTime time.Time
+	holes     []Extent
+	err       error
+}
+
+// statFiles stats the files, spreading the system calls over ReadWorkers
+// workers when set since they dominate planning trees of many small files
+func (p defaultPacker) statFiles(files []string) []fileStat {
+	stats := make([]fileStat, len(files))
+	stat := func(i int) {
+		info, err := os.Stat(files[i])
+		if err != nil {
+			stats[i].err = err
+			return
+		}
+		stats[i].info = info
+		if !info.Mode().IsRegular() {
+			return
+		}
+		if p.opts.PreserveBirthTime {
+			stats[i].birthTime, _ = fileBirthTime(files[i], info)
+		}
+		stats[i].holes = fileHoles(files[i], info)
+	}
+
+	if p.opts.ReadWorkers <= 0 {
+		for i := range files {
+			stat(i)
+		}
+		return stats
+	}
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < p.opts.ReadWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				stat(i)
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return stats
+}
+
+// planFiles walks the input directory and returns the files to pack, largest first
+func (p defaultPacker) planFiles(inputDir string) ([]FileInfo, error) {
+	if err := p.checkPlanOptions(); err != nil {
+		return nil, err
+	}
+
+	// Walk files in inputDir, or its snapshot. Files are only stat'ed once by collectFileInfo
+	files, err := p.walkInput(p.frozen.root(inputDir))
+	if err != nil {
+		return nil, fmt.Errorf("error walking input directory: %w", err)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w found in input directory", ErrNoFiles)
+	}
+	return p.planPaths(files)
+}
+
+// checkPlanOptions rejects options that would fail packing only once the
+// files are planned
+func (p defaultPacker) checkPlanOptions() error {
+	if err := p.checkSourceRead(); err != nil {
+		return err
+	}
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkChangedFilePolicy(); err != nil {
+		return err
+	}
+	if err := p.checkSpecialFilePolicy(); err != nil {
+		return err
+	}
+	if err := p.checkScanPhase(); err != nil {
+		return err
+	}
+	return p.checkCompression()
+}
+
+// planPaths stats the files found and returns the ones to pack, largest first
+func (p defaultPacker) planPaths(files []string) ([]FileInfo, error) {
+	fileInfos, err := p.collectFileInfo(files)
+	if err != nil {
+		return nil, fmt.Errorf("error collecting file info: %w", err)
+	}
+	return p.orderFiles(fileInfos)
+}
+
+// orderFiles maps the paths of the collected files and sorts them by size,
+// largest first
+func (p defaultPacker) orderFiles(fileInfos []FileInfo) ([]FileInfo, error) {
+	fileInfos, err := p.mapPaths(fileInfos)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort files by size, files of the same size stay in walk order so small
+	// files of a directory end up next to each other
+	sort.SliceStable(fileInfos, func(i, j int) bool {
+		return fileInfos[i].Size > fileInfos[j].Size
+	})
+	return fileInfos, nil
+}
+
+// mapPaths sets the archived path of each file through the path mapper,
+// dropping skipped files and rejecting mappings that collide. Archived paths
+// use forward slashes on every platform and the configured Unicode form
+func (p defaultPacker) mapPaths(files []FileInfo) ([]FileInfo, error) {
+	if err := p.checkNormalization(); err != nil {
+		return nil, err
+	}
+	mapped := files[:0]
+	sources := make(map[string]string, len(files))
+	for _, file := range files {
+		livePath := p.frozen.livePath(file.Path)
+		if file.ArchivePath == "" {
+			// Files of a root already have their path under its prefix
+			file.ArchivePath = filepath.ToSlash(livePath)
+		}
+		if p.opts.PathMapper != nil {
+			archivePath, skip := p.opts.PathMapper(livePath)
+			if skip {
+				continue
+			}
+			if archivePath == "" {
+				return nil, fmt.Errorf("path mapper returned an empty path for %s: %w", file.Path, ErrInvalidOption)
+			}
+			archivePath = filepath.ToSlash(archivePath)
+			for _, segment := range splitPath(archivePath) {
+				if segment == ".." {
+					return nil, fmt.Errorf("path mapper maps %s outside the archive to %s: %w", file.Path, archivePath, ErrPathUnsafe)
+				}
+			}
+			file.ArchivePath = archivePath
+		}
+
+		file.ArchivePath = p.opts.PathNormalization.normalize(file.ArchivePath)
+		if p.opts.FileFilter != nil && !p.opts.FileFilter(file) {
+			continue
+		}
+
+		if other, ok := sources[file.ArchivePath]; ok {
+			return nil, fmt.Errorf("path mapping collision, %s and %s both map to %s: %w", other, file.Path, file.ArchivePath, ErrInvalidOption)
+		}
+		sources[file.ArchivePath] = file.Path
+		mapped = append(mapped, file)
+	}
+
+	if len(mapped) == 0 {
+		return nil, fmt.Errorf("%w left to pack after mapping paths", ErrNoFiles)
+	}
+	return mapped, nil
+}
+
+// packFiles groups files into blocks starting at blockNum and hands each
+// completed block to emit
+func (p defaultPacker) packFiles(files []FileInfo, blockNum int32, emit func(block *Block) error) error {
+	currentBlock := &Block{
+		ID:    blockNum,
+		Files: make([]FileMetadata, 0),
+		Size:  0,
+	}
+
+	var currentSize int64
+
+	for i, file := range files {
+		// If file doesnt fit in currnt block, write current block and start new one
+		if currentSize+file.Size > p.opts.BlockSize {
+			if err := emit(currentBlock); err != nil {
+				return err
+			}
+			blockNum++
+			currentSize = 0
+			currentBlock = &Block{
+				ID:    blockNum,
+				Files: make([]FileMetadata, 0),
+				Size:  0,
+			}
+		}
+
+		if err := p.addFileToBlock(currentBlock, &file); err != nil {
+			if err := p.failures.skip(file.Path, err); err != nil {
+				return err
+			}
+		} else {
+			currentSize += file.Size
+		}
+
+		if i == len(files)-1 {
+			if err := emit(currentBlock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+func (p defaultPacker) PackFS(fsys fs.FS, outputDir string) error {
+	unlock, err := p.lockArchive(outputDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// An fs.FS carries no owner, extended attributes or birth time to record
+	p.opts.PreserveOwner = false
+	p.opts.PreserveXattrs = false
+	p.opts.PreserveACLs = false
+	p.opts.PreserveSecurityLabels = false
+	p.opts.PreserveBirthTime = false
+
+	p.failures = p.newFailureLog()
+	fileInfos, err := p.planFS(fsys)
+	if err != nil {
+		return err
+	}
+
+	open := func(metadata *FileMetadata) (io.ReadCloser, error) {
+		return fsys.Open(metadata.source())
+	}
+	return p.failures.result("pack", p.packPlanned(fileInfos, outputDir, open))
+}
+
+// planFS walks fsys and returns the files to pack, largest first. Archived
+// paths are the slash separated paths within fsys
+func (p defaultPacker) planFS(fsys fs.FS) ([]FileInfo, error) {
+	var fileInfos []FileInfo
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return p.failures.skip(path, err)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return p.failures.skip(path, fmt.Errorf("error getting file info: %w", err))
+		}
+		if p.opts.BlockSize > 0 && info.Size() > p.opts.BlockSize {
+			p.logger().Warn("Skipping file, size exceeds block size", "path", path)
+			return nil
+		}
+
+		fileInfos = append(fileInfos, FileInfo{
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    uint32(info.Mode()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking filesystem: %w", err)
+	}
+
+	if len(fileInfos) == 0 {
+		return nil, fmt.Errorf("%w found in filesystem", ErrNoFiles)
+	}
+	return p.orderFiles(fileInfos)
+}
@@ -0,0 +1,600 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// defaultParityGroupSize is the number of data blocks per parity group when
+// PackerOptions.ParityGroupSize is not set
+const defaultParityGroupSize = 10
+
+var parityMagic = [4]byte{'B', 'P', 'A', 'R'}
+
+// parityBlockInfo identifies a data block protected by a parity group
+type parityBlockInfo struct {
+	ID       int32  // ID of the data block
+	Length   int64  // Size of the block file in bytes
+	Checksum []byte // SHA-256 checksum of the whole block file
+}
+
+// parityHeader is stored at the start of every parity file so each one can
+// describe its group on its own
+type parityHeader struct {
+	GroupID      int32             // Parity group the file belongs to
+	Index        int32             // Index of the parity block within the group
+	ParityBlocks int32             // Number of parity blocks in the group
+	ShardSize    int64             // Size of the parity data, the largest block in the group
+	Blocks       []parityBlockInfo // Data blocks protected by the group
+	Checksum     []byte            // SHA-256 checksum of the parity data
+}
+
+// parityFileName returns the file name of a parity block
+func parityFileName(groupID int32, index int32) string {
+	return fmt.Sprintf("parity-%d-%d.parity", groupID, index)
+}
+
+// headerSize returns the encoded size of the header
+func (h *parityHeader) headerSize() int64 {
+	return int64(len(parityMagic)) + 4*4 + 8 + int64(len(h.Blocks))*(4+8+sha256.Size) + sha256.Size
+}
+
+func (h *parityHeader) write(w io.Writer) error {
+	if _, err := w.Write(parityMagic[:]); err != nil {
+		return err
+	}
+	fields := []any{h.GroupID, h.Index, h.ParityBlocks, int32(len(h.Blocks)), h.ShardSize}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	for _, block := range h.Blocks {
+		if err := binary.Write(w, binary.LittleEndian, block.ID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, block.Length); err != nil {
+			return err
+		}
+		if _, err := w.Write(padChecksum(block.Checksum)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(padChecksum(h.Checksum))
+	return err
+}
+
+func readParityHeader(r io.Reader) (*parityHeader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != parityMagic {
+		return nil, fmt.Errorf("not a parity file")
+	}
+
+	h := &parityHeader{}
+	var numBlocks int32
+	fields := []any{&h.GroupID, &h.Index, &h.ParityBlocks, &numBlocks, &h.ShardSize}
+	for _, field := range fields {
+		if err := binary.Read(r, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	if numBlocks <= 0 || numBlocks > 256 {
+		return nil, fmt.Errorf("invalid number of blocks in parity group: %d", numBlocks)
+	}
+
+	h.Blocks = make([]parityBlockInfo, numBlocks)
+	for i := range h.Blocks {
+		if err := binary.Read(r, binary.LittleEndian, &h.Blocks[i].ID); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &h.Blocks[i].Length); err != nil {
+			return nil, err
+		}
+		h.Blocks[i].Checksum = make([]byte, sha256.Size)
+		if _, err := io.ReadFull(r, h.Blocks[i].Checksum); err != nil {
+			return nil, err
+		}
+	}
+	h.Checksum = make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, h.Checksum); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// padChecksum returns a checksum sized slice so placeholder headers have
+// their final length
+func padChecksum(checksum []byte) []byte {
+	if len(checksum) == sha256.Size {
+		return checksum
+	}
+	return make([]byte, sha256.Size)
+}
+
+// writeParity splits the blocks into groups and writes the parity blocks of each
+func (p defaultPacker) writeParity(outputDir string, blockIDs []int32) error {
+	groupSize := p.opts.ParityGroupSize
+	if groupSize <= 0 {
+		groupSize = defaultParityGroupSize
+	}
+
+	sort.Slice(blockIDs, func(i, j int) bool { return blockIDs[i] < blockIDs[j] })
+
+	files, err := blockFiles(outputDir)
+	if err != nil {
+		return err
+	}
+
+	groupID := int32(1)
+	for start := 0; start < len(blockIDs); start += groupSize {
+		end := min(start+groupSize, len(blockIDs))
+		if err := p.writeParityGroup(outputDir, files, groupID, blockIDs[start:end], p.opts.ParityBlocks); err != nil {
+			return fmt.Errorf("error writing parity group %d: %w", groupID, err)
+		}
+		groupID++
+	}
+	return nil
+}
+
+// writeParityGroup computes the parity blocks of a group, streaming the data
+// blocks in stripes so only one stripe per block is held in memory. Blocks are
+// looked up by ID in files
+func (p defaultPacker) writeParityGroup(outputDir string, files map[int32]string, groupID int32, blockIDs []int32, parityBlocks int) error {
+	codec, err := newRSCodec(len(blockIDs), parityBlocks)
+	if err != nil {
+		return err
+	}
+
+	// Open data blocks
+	dataFiles := make([]*os.File, len(blockIDs))
+	// The blocks and parity blocks of the group are hashed stripe by stripe,
+	// side by side
+	hashes := p.newChecksums(len(blockIDs) + parityBlocks)
+	dataHashes, parityHashes := hashes[:len(blockIDs)], hashes[len(blockIDs):]
+	header := parityHeader{GroupID: groupID, ParityBlocks: int32(parityBlocks)}
+	for i, id := range blockIDs {
+		f, err := os.Open(blockPath(files, outputDir, id))
+		if err != nil {
+			return fmt.Errorf("error opening block %d: %w", id, err)
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("error getting block info: %w", err)
+		}
+		dataFiles[i] = f
+		header.Blocks = append(header.Blocks, parityBlockInfo{ID: id, Length: info.Size()})
+		header.ShardSize = max(header.ShardSize, info.Size())
+	}
+
+	// Create parity files with a placeholder header, the checksums are
+	// filled in once all data has been read
+	parityFiles := make([]*os.File, parityBlocks)
+	for i := range parityFiles {
+		f, err := os.Create(filepath.Join(outputDir, parityFileName(groupID, int32(i+1))))
+		if err != nil {
+			return fmt.Errorf("error creating parity file: %w", err)
+		}
+		defer f.Close()
+		if _, err := f.Seek(header.headerSize(), io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking past parity header: %w", err)
+		}
+		parityFiles[i] = f
+	}
+
+	data, parity := allocShards(len(blockIDs), p.stripeSize()), allocShards(parityBlocks, p.stripeSize())
+	for offset := int64(0); offset < header.ShardSize; offset += int64(p.stripeSize()) {
+		stripe := int(min(int64(p.stripeSize()), header.ShardSize-offset))
+		for i, f := range dataFiles {
+			n, err := io.ReadFull(f, data[i][:stripe])
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("error reading block %d: %w", blockIDs[i], err)
+			}
+			dataHashes[i].Write(data[i][:n])
+			// Blocks shorter than the shard are padded with zeros
+			clear(data[i][n:stripe])
+		}
+
+		codec.encode(trimShards(data, stripe), trimShards(parity, stripe))
+		for i, f := range parityFiles {
+			if _, err := p.throttleWriter(f).Write(parity[i][:stripe]); err != nil {
+				return fmt.Errorf("error writing parity file: %w", err)
+			}
+			parityHashes[i].Write(parity[i][:stripe])
+		}
+	}
+
+	for i := range header.Blocks {
+		header.Blocks[i].Checksum = dataHashes[i].Sum(nil)
+	}
+
+	// Write the final headers
+	for i, f := range parityFiles {
+		header.Index = int32(i + 1)
+		header.Checksum = parityHashes[i].Sum(nil)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking to parity header: %w", err)
+		}
+		if err := header.write(f); err != nil {
+			return fmt.Errorf("error writing parity header: %w", err)
+		}
+	}
+	return nil
+}
+
+// ReconstructPlan describes what Reconstruct would rewrite in an archive
+type ReconstructPlan struct {
+	Blocks        []int32  // Data blocks rebuilt from parity, sorted
+	Parity        []string // Parity files rewritten because their group lost some, sorted
+	Bytes         int64    // Bytes written by the rebuild
+	Unrecoverable []int32  // Parity groups with more damaged blocks than intact parity blocks, sorted
+}
+
+func (p defaultPacker) Reconstruct(archiveDir string) error {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	groups, headers, err := p.readParityGroups(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	files, err := blockFiles(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	var failed []int32
+	for groupID, parityFiles := range groups {
+		if err := p.reconstructGroup(archiveDir, files, headers[groupID], parityFiles); err != nil {
+			p.logger().Error("Error reconstructing parity group", "group", groupID, "error", err)
+			failed = append(failed, groupID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to reconstruct %d parity groups", len(failed))
+	}
+	return nil
+}
+
+func (p defaultPacker) PlanReconstruct(archiveDir string) (*ReconstructPlan, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	groups, headers, err := p.readParityGroups(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	files, err := blockFiles(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &ReconstructPlan{}
+	for groupID, parityFiles := range groups {
+		header := headers[groupID]
+		_, damaged := p.checkGroupBlocks(archiveDir, files, header)
+		if len(damaged) > len(parityFiles) {
+			plan.Unrecoverable = append(plan.Unrecoverable, groupID)
+			continue
+		}
+		for _, i := range damaged {
+			plan.Blocks = append(plan.Blocks, header.Blocks[i].ID)
+			plan.Bytes += header.Blocks[i].Length
+		}
+		if len(parityFiles) < int(header.ParityBlocks) {
+			for index := int32(1); index <= header.ParityBlocks; index++ {
+				plan.Parity = append(plan.Parity, parityFileName(groupID, index))
+				plan.Bytes += header.headerSize() + header.ShardSize
+			}
+		}
+	}
+
+	sort.Slice(plan.Blocks, func(i, j int) bool { return plan.Blocks[i] < plan.Blocks[j] })
+	sort.Strings(plan.Parity)
+	sort.Slice(plan.Unrecoverable, func(i, j int) bool { return plan.Unrecoverable[i] < plan.Unrecoverable[j] })
+	return plan, nil
+}
+
+// readParityGroups groups the intact parity files of an archive by parity
+// group, keyed by their index within the group. Damaged parity files are
+// skipped, and reported when warn is set
+func (p defaultPacker) readParityGroups(archiveDir string, warn bool) (map[int32]map[int32]string, map[int32]*parityHeader, error) {
+	parityPaths, err := filepath.Glob(filepath.Join(archiveDir, "*.parity"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing parity files: %w", err)
+	}
+	if len(parityPaths) == 0 {
+		return nil, nil, fmt.Errorf("no parity files found in %s", archiveDir)
+	}
+
+	groups := make(map[int32]map[int32]string)
+	headers := make(map[int32]*parityHeader)
+	for _, path := range parityPaths {
+		header, err := p.checkParityFile(path)
+		if err != nil {
+			if warn {
+				p.logger().Warn("Ignoring damaged parity file", "file", filepath.Base(path), "error", err)
+			}
+			continue
+		}
+		if groups[header.GroupID] == nil {
+			groups[header.GroupID] = make(map[int32]string)
+		}
+		groups[header.GroupID][header.Index] = path
+		headers[header.GroupID] = header
+	}
+	return groups, headers, nil
+}
+
+// checkGroupBlocks checks every data block of a parity group against its
+// checksum, returning which shards are present and the indexes of the
+// missing or damaged blocks
+func (p defaultPacker) checkGroupBlocks(archiveDir string, files map[int32]string, header *parityHeader) ([]bool, []int) {
+	present := make([]bool, len(header.Blocks)+int(header.ParityBlocks))
+	var damaged []int
+	for i, block := range header.Blocks {
+		checksum, err := p.validator.CalculateFileChecksum(blockPath(files, archiveDir, block.ID))
+		if err == nil && p.validator.ChecksumsEqual(checksum, block.Checksum) {
+			present[i] = true
+			continue
+		}
+		damaged = append(damaged, i)
+	}
+	return present, damaged
+}
+
+// checkParityFile reads the header of a parity file and verifies its data
+func (p defaultPacker) checkParityFile(path string) (*parityHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := readParityHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading parity header: %w", err)
+	}
+
+	h := newChecksum()
+	n, err := p.buffers.copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading parity data: %w", err)
+	}
+	if n != header.ShardSize || !p.validator.ChecksumsEqual(h.Sum(nil), header.Checksum) {
+		return nil, fmt.Errorf("parity data checksum mismatch")
+	}
+	return header, nil
+}
+
+// reconstructGroup rebuilds the missing or damaged data blocks of a parity
+// group, then rewrites any missing parity files
+func (p defaultPacker) reconstructGroup(archiveDir string, files map[int32]string, header *parityHeader, parityFiles map[int32]string) error {
+	present, damaged := p.checkGroupBlocks(archiveDir, files, header)
+	for index := range parityFiles {
+		present[len(header.Blocks)+int(index)-1] = true
+	}
+
+	if len(damaged) == 0 && len(parityFiles) == int(header.ParityBlocks) {
+		return nil
+	}
+	if len(damaged) > len(parityFiles) {
+		return fmt.Errorf("%d blocks damaged but only %d parity blocks intact", len(damaged), len(parityFiles))
+	}
+
+	if len(damaged) > 0 {
+		codec, err := newRSCodec(len(header.Blocks), int(header.ParityBlocks))
+		if err != nil {
+			return err
+		}
+
+		// Open every intact shard positioned at its data
+		readers := make([]*os.File, len(present))
+		for i, block := range header.Blocks {
+			if !present[i] {
+				continue
+			}
+			f, err := os.Open(blockPath(files, archiveDir, block.ID))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			readers[i] = f
+		}
+		for index, path := range parityFiles {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := f.Seek(header.headerSize(), io.SeekStart); err != nil {
+				return err
+			}
+			readers[len(header.Blocks)+int(index)-1] = f
+		}
+
+		// Rebuilt blocks are written to temporary files first
+		writers := make(map[int]*os.File)
+		for _, i := range damaged {
+			f, err := createArchiveTemp(archiveDir, blockFileName(header.Blocks[i].ID)+".*.tmp")
+			if err != nil {
+				return fmt.Errorf("error creating temporary block file: %w", err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			writers[i] = f
+		}
+
+		shards := allocShards(len(present), p.stripeSize())
+		for offset := int64(0); offset < header.ShardSize; offset += int64(p.stripeSize()) {
+			stripe := int(min(int64(p.stripeSize()), header.ShardSize-offset))
+			for i, f := range readers {
+				if f == nil {
+					continue
+				}
+				n, err := io.ReadFull(f, shards[i][:stripe])
+				if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					return fmt.Errorf("error reading shard: %w", err)
+				}
+				clear(shards[i][n:stripe])
+			}
+
+			if err := codec.reconstruct(trimShards(shards, stripe), present); err != nil {
+				return err
+			}
+
+			for i, f := range writers {
+				// Drop the zero padding past the end of the block
+				n := min(int64(stripe), max(header.Blocks[i].Length-offset, 0))
+				if _, err := p.throttleWriter(f).Write(shards[i][:n]); err != nil {
+					return fmt.Errorf("error writing reconstructed block: %w", err)
+				}
+			}
+		}
+
+		for i, f := range writers {
+			block := header.Blocks[i]
+			if err := f.Close(); err != nil {
+				return err
+			}
+			checksum, err := p.validator.CalculateFileChecksum(f.Name())
+			if err != nil {
+				return err
+			}
+			if !p.validator.ChecksumsEqual(checksum, block.Checksum) {
+				return fmt.Errorf("reconstructed block %d does not match its checksum", block.ID)
+			}
+			path, err := p.rebuiltBlockPath(archiveDir, files, block.ID, f.Name())
+			if err != nil {
+				return err
+			}
+			if err := os.Rename(f.Name(), path); err != nil {
+				return fmt.Errorf("error replacing block %d: %w", block.ID, err)
+			}
+			files[block.ID] = path
+			p.logger().Info("Reconstructed block", "block", block.ID)
+		}
+	}
+
+	// Rewrite parity blocks that were missing or damaged
+	if len(parityFiles) < int(header.ParityBlocks) {
+		blockIDs := make([]int32, len(header.Blocks))
+		for i, block := range header.Blocks {
+			blockIDs[i] = block.ID
+		}
+		if err := p.writeParityGroup(archiveDir, files, header.GroupID, blockIDs, int(header.ParityBlocks)); err != nil {
+			return err
+		}
+		p.logger().Info("Rewrote parity blocks", "group", header.GroupID)
+	}
+	return nil
+}
+
+// rebuiltBlockPath returns where a reconstructed block belongs: in place of
+// the damaged file, or under the name the packer gives new blocks when the
+// block file is missing altogether
+func (p defaultPacker) rebuiltBlockPath(archiveDir string, files map[int32]string, id int32, rebuiltPath string) (string, error) {
+	if path, ok := files[id]; ok {
+		return path, nil
+	}
+
+	f, err := os.Open(rebuiltPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	footer, err := readBlockFooter(f, info.Size())
+	if err != nil {
+		return "", fmt.Errorf("error reading reconstructed block footer: %w", err)
+	}
+	name, err := p.blockName(id, footer.Checksum)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(archiveDir, name), nil
+}
+
+// stripeSize returns the number of bytes processed per block in each stripe
+func (p defaultPacker) stripeSize() int {
+	if p.opts.BufferSize > 0 {
+		return p.opts.BufferSize
+	}
+	return 32 * 1024
+}
+
+func allocShards(count int, size int) [][]byte {
+	shards := make([][]byte, count)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+	}
+	return shards
+}
+
+// trimShards returns the shards cut down to the length of the current stripe
+func trimShards(shards [][]byte, length int) [][]byte {
+	trimmed := make([][]byte, len(shards))
+	for i, shard := range shards {
+		trimmed[i] = shard[:length]
+	}
+	return trimmed
+}
+
+// rewriteParity rewrites the parity blocks of the groups protecting any of
+// the blocks given, after those were changed in place. Archives without
+// parity are left as they are
+func (p defaultPacker) rewriteParity(archiveDir string, blockIDs []int32) error {
+	parityPaths, err := filepath.Glob(filepath.Join(archiveDir, "*.parity"))
+	if err != nil || len(parityPaths) == 0 || len(blockIDs) == 0 {
+		return err
+	}
+	groups, headers, err := p.readParityGroups(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	files, err := blockFiles(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	changed := make(map[int32]bool, len(blockIDs))
+	for _, id := range blockIDs {
+		changed[id] = true
+	}
+	for groupID := range groups {
+		header := headers[groupID]
+		groupIDs := make([]int32, len(header.Blocks))
+		rewrite := false
+		for i, block := range header.Blocks {
+			groupIDs[i] = block.ID
+			rewrite = rewrite || changed[block.ID]
+		}
+		if !rewrite {
+			continue
+		}
+		if err := p.writeParityGroup(archiveDir, files, groupID, groupIDs, int(header.ParityBlocks)); err != nil {
+			return fmt.Errorf("error writing parity group %d: %w", groupID, err)
+		}
+		p.logger().Info("Rewrote parity blocks", "group", groupID)
+	}
+	return nil
+}
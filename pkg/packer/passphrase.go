@@ -0,0 +1,310 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters of the keys derived from a Passphrase, the second
+// recommended option of RFC 9106. They are stored in every block, so they can
+// be raised later without breaking older archives
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+
+	// argonMaxMemory bounds the memory a block can make a reader spend
+	argonMaxMemory = 4 * 1024 * 1024 // KiB
+)
+
+// keyHeaderSize is the size of the key header of a block: the Argon2id salt
+// (16 bytes), time (uint32), memory in KiB (uint32) and threads (uint8), and
+// the block's metadata key sealed with the derived key (nonce, key and tag)
+const (
+	argonSaltSize = 16
+	keyHeaderSize = argonSaltSize + 4 + 4 + 1 + 12 + MetadataKeySize + 16
+)
+
+// ErrPassphrase is returned when the passphrase given cannot unlock the
+// metadata key of a block
+var ErrPassphrase = errors.New("wrong passphrase")
+
+// keyring derives keys from a Passphrase. Deriving a key takes a noticeable
+// time and memory on purpose, so derived keys are cached by their salt and
+// parameters and the metadata key of the blocks written is only made once
+type keyring struct {
+	passphrase string
+
+	mu      sync.Mutex
+	derived map[string][]byte // Derived keys by the salt and parameters of their key header
+	key     []byte            // Metadata key of the blocks written, made on the first one
+	header  []byte            // Key header of the blocks written
+}
+
+func newKeyring(passphrase string) *keyring {
+	if passphrase == "" {
+		return nil
+	}
+	return &keyring{passphrase: passphrase, derived: make(map[string][]byte)}
+}
+
+// deriveKey derives the key that seals the metadata key from the salt and
+// parameters at the start of a key header
+func (k *keyring) deriveKey(passphrase string, params []byte) ([]byte, error) {
+	salt := params[:argonSaltSize]
+	time := binary.LittleEndian.Uint32(params[argonSaltSize:])
+	memory := binary.LittleEndian.Uint32(params[argonSaltSize+4:])
+	threads := params[argonSaltSize+8]
+	if time == 0 || threads == 0 || memory < 8*uint32(threads) || memory > argonMaxMemory {
+		return nil, fmt.Errorf("invalid Argon2id parameters: %w", ErrCorrupted)
+	}
+
+	cacheKey := passphrase + "\x00" + string(params)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, ok := k.derived[cacheKey]; ok {
+		return key, nil
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, time, memory, threads, MetadataKeySize)
+	k.derived[cacheKey] = key
+	return key, nil
+}
+
+// newKeyHeader seals key with a key derived from passphrase and a new salt
+func (k *keyring) newKeyHeader(passphrase string, key []byte) ([]byte, error) {
+	params := make([]byte, argonSaltSize, argonSaltSize+9)
+	if _, err := rand.Read(params); err != nil {
+		return nil, fmt.Errorf("error generating salt: %w", err)
+	}
+	params = binary.LittleEndian.AppendUint32(params, argonTime)
+	params = binary.LittleEndian.AppendUint32(params, argonMemory)
+	params = append(params, argonThreads)
+	return k.sealKeyHeader(passphrase, params, key)
+}
+
+// sealKeyHeader seals key with a key derived from passphrase and the salt and
+// parameters given
+func (k *keyring) sealKeyHeader(passphrase string, params []byte, key []byte) ([]byte, error) {
+	aead, err := k.headerCipher(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, keyHeaderSize)
+	header = append(header, params...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, key, params), nil
+}
+
+// openKeyHeader returns the metadata key sealed in a key header
+func (k *keyring) openKeyHeader(passphrase string, header []byte) ([]byte, error) {
+	if len(header) != keyHeaderSize {
+		return nil, fmt.Errorf("invalid key header of %d bytes: %w", len(header), ErrCorrupted)
+	}
+	params := keyHeaderParams(header)
+	aead, err := k.headerCipher(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(params) : len(params)+aead.NonceSize()]
+	key, err := aead.Open(nil, nonce, header[len(params)+aead.NonceSize():], params)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return key, nil
+}
+
+// keyHeaderParams returns the Argon2id salt and parameters of a key header
+func keyHeaderParams(header []byte) []byte {
+	return header[:argonSaltSize+9]
+}
+
+// headerCipher returns the cipher sealing the metadata key of a key header
+// with the given salt and parameters
+func (k *keyring) headerCipher(passphrase string, params []byte) (cipher.AEAD, error) {
+	derived, err := k.deriveKey(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return metadataCipher(derived)
+}
+
+// writeKey returns the metadata key of the blocks written and the key header
+// sealing it, making both on first use
+func (k *keyring) writeKey() ([]byte, []byte, error) {
+	k.mu.Lock()
+	key, header := k.key, k.header
+	k.mu.Unlock()
+	if key != nil {
+		return key, header, nil
+	}
+
+	key = make([]byte, MetadataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("error generating metadata key: %w", err)
+	}
+	header, err := k.newKeyHeader(k.passphrase, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key == nil {
+		k.key, k.header = key, header
+	}
+	return k.key, k.header, nil
+}
+
+// encryptsMetadata reports whether the blocks written have encrypted metadata
+func (p defaultPacker) encryptsMetadata() bool {
+	return p.opts.MetadataKey != nil || p.opts.Passphrase != ""
+}
+
+// metadataWriteKey returns the key encrypting the metadata of the blocks
+// written and, with a Passphrase, the key header to store in their footer
+func (p defaultPacker) metadataWriteKey() ([]byte, []byte, error) {
+	if p.keys != nil {
+		return p.keys.writeKey()
+	}
+	return p.opts.MetadataKey, nil, nil
+}
+
+// metadataReadKey returns the key decrypting the metadata of a block
+func (p defaultPacker) metadataReadKey(footer *BlockFooter) ([]byte, error) {
+	if footer.Flags&footerFlagPassphrase == 0 {
+		if p.opts.MetadataKey == nil {
+			return nil, ErrMetadataEncrypted
+		}
+		return p.opts.MetadataKey, nil
+	}
+	if p.keys == nil {
+		return nil, fmt.Errorf("%w with a passphrase", ErrMetadataEncrypted)
+	}
+	return p.keys.openKeyHeader(p.keys.passphrase, footer.KeyHeader)
+}
+
+func (p defaultPacker) Rekey(archiveDir string, newPassphrase string) error {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if p.keys == nil || newPassphrase == "" {
+		return fmt.Errorf("rekeying needs the current and the new passphrase: %w", ErrInvalidOption)
+	}
+	blockPaths, err := listBlocks(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	// Every block is sealed with the same new salt, so the new key is only
+	// derived once however many metadata keys the archive holds
+	var rekeyed []int32
+	var params []byte
+	headers := make(map[string][]byte) // New key headers by the metadata key they seal
+	for _, blockPath := range blockPaths {
+		id, err := p.rekeyBlock(blockPath, func(key []byte) ([]byte, error) {
+			if header, ok := headers[string(key)]; ok {
+				return header, nil
+			}
+			var header []byte
+			var err error
+			if params == nil {
+				header, err = p.keys.newKeyHeader(newPassphrase, key)
+			} else {
+				header, err = p.keys.sealKeyHeader(newPassphrase, params, key)
+			}
+			if err != nil {
+				return nil, err
+			}
+			params = keyHeaderParams(header)
+			headers[string(key)] = header
+			return header, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error rekeying block %s: %w", filepath.Base(blockPath), err)
+		}
+		if id < 0 {
+			p.logger().Warn("Block has no passphrase to change", "block", filepath.Base(blockPath))
+			continue
+		}
+		rekeyed = append(rekeyed, id)
+	}
+	p.logger().Info("Changed passphrase", "blocks", len(rekeyed))
+
+	if err := p.rewriteParity(archiveDir, rekeyed); err != nil {
+		return err
+	}
+	return p.resign(archiveDir)
+}
+
+// rekeyBlock replaces the key header of a block with the one reseal returns
+// for its metadata key, returning the block ID or -1 for blocks without a
+// passphrase. Only the footer is rewritten, the data and metadata sections
+// and the checksum of the block stay as they are
+func (p defaultPacker) rekeyBlock(blockPath string, reseal func(key []byte) ([]byte, error)) (int32, error) {
+	f, err := os.OpenFile(blockPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		if volumes, _ := findVolumes(blockPath); len(volumes) > 0 {
+			return 0, fmt.Errorf("the footer of a block split into volumes is not rewritten in place: %w", ErrInvalidOption)
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening block file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error getting file info: %w", err)
+	}
+	footer, err := readBlockFooter(f, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("error reading block footer: %w", err)
+	}
+	if footer.Flags&footerFlagPassphrase == 0 {
+		return -1, nil
+	}
+	start, _, err := readBlockStart(io.NewSectionReader(f, 0, info.Size()))
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := p.keys.openKeyHeader(p.keys.passphrase, footer.KeyHeader)
+	if err != nil {
+		return 0, err
+	}
+	if footer.KeyHeader, err = reseal(key); err != nil {
+		return 0, err
+	}
+
+	// The key header keeps its size, so the footer is overwritten in place
+	var buf bytes.Buffer
+	if err := writeBlockFooter(&buf, footer); err != nil {
+		return 0, err
+	}
+	if int64(buf.Len()) != footer.Length {
+		return 0, fmt.Errorf("footer of %d bytes instead of %d: %w", buf.Len(), footer.Length, ErrCorrupted)
+	}
+	if _, err := f.WriteAt(buf.Bytes(), info.Size()-footer.Length); err != nil {
+		return 0, fmt.Errorf("error writing block footer: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("error writing block footer: %w", err)
+	}
+	return start.ID, f.Close()
+}
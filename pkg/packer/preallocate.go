@@ -0,0 +1,24 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+)
+
+// preallocateMinSize is the smallest file preallocated, the filesystem lays
+// out smaller ones in one piece on its own
+const preallocateMinSize = 1024 * 1024
+
+// preallocate reserves size bytes of disk space for a file about to be
+// written, so it is laid out in as few extents as possible and a full disk is
+// reported before any of it is written. The file size is left unchanged.
+// Platforms and filesystems that cannot preallocate write the file as before
+func preallocate(f *os.File, size int64) error {
+	if size < preallocateMinSize {
+		return nil
+	}
+	if err := fallocate(f, size); err != nil {
+		return fmt.Errorf("error preallocating %d bytes: %w", size, err)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package packer
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fallocate allocates disk space for the first size bytes of a file with
+// FALLOC_FL_KEEP_SIZE, ignoring filesystems without fallocate
+func fallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	return err
+}
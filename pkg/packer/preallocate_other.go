@@ -0,0 +1,10 @@
+//go:build !linux
+
+package packer
+
+import "os"
+
+// fallocate does nothing, files are only preallocated on Linux
+func fallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package packer
+
+import "errors"
+
+// lowerProcessPriority is not supported on this platform
+func lowerProcessPriority() error {
+	return errors.New("process priority is not supported on this platform")
+}
@@ -0,0 +1,11 @@
+//go:build unix && !linux
+
+package packer
+
+import "golang.org/x/sys/unix"
+
+// lowerProcessPriority gives the process the lowest CPU priority, nice 19.
+// There is no portable way to lower its I/O priority
+func lowerProcessPriority() error {
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, 19)
+}
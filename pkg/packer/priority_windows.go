@@ -0,0 +1,11 @@
+//go:build windows
+
+package packer
+
+import "golang.org/x/sys/windows"
+
+// lowerProcessPriority puts the process in background mode, which lowers its
+// CPU, I/O and memory priority
+func lowerProcessPriority() error {
+	return windows.SetPriorityClass(windows.CurrentProcess(), windows.PROCESS_MODE_BACKGROUND_BEGIN)
+}
@@ -0,0 +1,159 @@
+package packer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// ProgressEvent is a machine readable progress update. Events are written to
+// PackerOptions.Progress as newline delimited JSON, one event per line
+type ProgressEvent struct {
+	Event      string    `json:"event"` // start, file, block, done or error
+	Op         string    `json:"op"`    // pack or unpack
+	Time       time.Time `json:"time"`
+	Path       string    `json:"path,omitempty"`        // File the event refers to
+	BlockID    int32     `json:"block_id,omitempty"`    // Block the event refers to
+	Size       int64     `json:"size,omitempty"`        // Size of the file or block contents
+	Skipped    bool      `json:"skipped,omitempty"`     // File was already extracted intact
+	Checksum   string    `json:"checksum,omitempty"`    // Hex encoded SHA-256 checksum of the file or block
+	FilesDone  int       `json:"files_done"`            // Files processed so far
+	BytesDone  int64     `json:"bytes_done"`            // Bytes of file contents processed so far
+	FilesTotal int       `json:"files_total,omitempty"` // Files in the operation, unknown for streams
+	BytesTotal int64     `json:"bytes_total,omitempty"` // Bytes in the operation, unknown for streams
+	Error      string    `json:"error,omitempty"`
+}
+
+// progressReporter keeps the running totals of the current operation and
+// writes its events. Events are only written between start and finish
+type progressReporter struct {
+	mu      sync.Mutex
+	w       io.Writer // Receives the events, nil only keeps the totals for Stats
+	metrics Metrics   // Receives the counters of every operation, nil disables
+	event   ProgressEvent
+	totals  operationTotals // Totals of the current operation, or the last one once finished
+}
+
+func newProgressReporter(w io.Writer, metrics Metrics) *progressReporter {
+	return &progressReporter{w: w, metrics: metrics}
+}
+
+// start begins reporting an operation with the given totals
+func (r *progressReporter) start(op string, files int, bytes int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event = ProgressEvent{Op: op, FilesTotal: files, BytesTotal: bytes}
+	r.totals = operationTotals{op: op, started: time.Now()}
+	r.emit(ProgressEvent{Event: "start"})
+}
+
+// file reports a file that was packed, extracted or skipped
+func (r *progressReporter) file(metadata *FileMetadata, skipped bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.event.Op == "" {
+		return
+	}
+	r.event.FilesDone++
+	r.event.BytesDone += metadata.Size
+	r.totals.file(metadata, skipped)
+	if r.metrics != nil && !skipped {
+		r.metrics.AddFiles(r.event.Op, 1)
+		r.metrics.AddBytes(r.event.Op, metadata.Size)
+	}
+	r.emit(ProgressEvent{Event: "file", Path: metadata.Path, BlockID: metadata.BlockID, Size: metadata.Size, Skipped: skipped,
+		Checksum: hex.EncodeToString(metadata.Checksum)})
+}
+
+// block reports a block that was completely read
+func (r *progressReporter) block(block *Block) {
+	r.blockWritten(block, 0)
+}
+
+// blockWritten reports a block that was completely written with the given
+// block size, so its fill can be observed
+func (r *progressReporter) blockWritten(block *Block, blockSize int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.event.Op == "" {
+		return
+	}
+	if r.metrics != nil {
+		r.metrics.AddBlocks(r.event.Op, 1)
+		if blockSize > 0 {
+			r.metrics.ObserveBlockFill(float64(block.Size) / float64(blockSize))
+		}
+	}
+	r.totals.blocks++
+	r.totals.blockBytes += block.length
+	r.emit(ProgressEvent{Event: "block", BlockID: block.ID, Size: block.Size, Checksum: hex.EncodeToString(block.Checksum)})
+}
+
+// failed reports a file skipped after failing with ContinueOnError
+func (r *progressReporter) failed() {
+	if r == nil || r.metrics == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.event.Op != "" {
+		r.metrics.AddErrors(r.event.Op, 1)
+	}
+}
+
+// finish ends the operation with a done event, or an error event if err is set
+func (r *progressReporter) finish(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.event.Op == "" {
+		return
+	}
+	r.totals.finished = time.Now()
+	if r.metrics != nil && err != nil {
+		r.metrics.AddErrors(r.event.Op, 1)
+	}
+	if err != nil {
+		r.emit(ProgressEvent{Event: "error", Error: err.Error()})
+	} else {
+		r.emit(ProgressEvent{Event: "done"})
+	}
+	r.event = ProgressEvent{}
+}
+
+// emit writes an event carrying the running totals. Progress is best effort,
+// a consumer that goes away must not fail the operation
+func (r *progressReporter) emit(event ProgressEvent) {
+	if r.w == nil {
+		return
+	}
+	event.Op = r.event.Op
+	event.Time = time.Now().UTC()
+	event.FilesDone = r.event.FilesDone
+	event.BytesDone = r.event.BytesDone
+	event.FilesTotal = r.event.FilesTotal
+	event.BytesTotal = r.event.BytesTotal
+	_ = json.NewEncoder(r.w).Encode(event)
+}
+
+// totalBytes returns the combined size of the files
+func totalBytes(files []FileInfo) int64 {
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+	return total
+}
@@ -0,0 +1,165 @@
+package packer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Files up to smallFileSize are read ahead in segments of up to
+// smallSegmentSize bytes or smallSegmentFiles files, so the open, read and
+// close of many tiny files overlap instead of running one after another
+const (
+	smallFileSize     = 64 * 1024
+	smallSegmentSize  = 1024 * 1024
+	smallSegmentFiles = 256
+)
+
+// readAhead reads the small files of a block into memory ahead of the block
+// writer. Segments are read by ReadWorkers workers, at most twice as many are
+// held in memory at once
+type readAhead struct {
+	open     contentOpener
+	segments []*segment
+	owner    map[int]*segment // Segment holding each file read ahead
+	slots    chan struct{}    // Limits the number of segments read or held
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// segment is a run of consecutive small files of a block read by one worker
+type segment struct {
+	first int
+	files []FileMetadata
+	data  [][]byte // Contents read of each file
+	errs  []error  // Error opening or reading each file
+	opens []bool   // Whether the error occurred opening the file
+	left  int      // Files not yet handed to the block writer
+	done  chan struct{}
+}
+
+// newReadAhead starts reading the small files of files ahead with the given
+// number of workers. It returns nil when workers is 0 so files are read as
+// they are written
+func newReadAhead(workers int, files []FileMetadata, open contentOpener) *readAhead {
+	if workers <= 0 {
+		return nil
+	}
+	ra := &readAhead{
+		open:  open,
+		owner: make(map[int]*segment),
+		slots: make(chan struct{}, 2*workers),
+		stop:  make(chan struct{}),
+	}
+
+	// Group consecutive small files into segments. The metadata is copied as
+	// the block writer updates its own as it goes
+	var current *segment
+	var size int64
+	for i := range files {
+		if files[i].Size < 0 || files[i].Size > smallFileSize {
+			current = nil
+			continue
+		}
+		if current == nil || size+files[i].Size > smallSegmentSize || len(current.files) == smallSegmentFiles {
+			current = &segment{first: i, done: make(chan struct{})}
+			ra.segments = append(ra.segments, current)
+			size = 0
+		}
+		current.files = append(current.files, files[i])
+		current.left++
+		size += files[i].Size
+		ra.owner[i] = current
+	}
+	if len(ra.segments) == 0 {
+		return nil
+	}
+
+	sem := make(chan struct{}, workers)
+	go func() {
+		for _, s := range ra.segments {
+			select {
+			case ra.slots <- struct{}{}:
+			case <-ra.stop:
+				return
+			}
+			sem <- struct{}{}
+			go func(s *segment) {
+				defer func() { <-sem }()
+				ra.read(s)
+			}(s)
+		}
+	}()
+	return ra
+}
+
+// read reads every file of a segment into one buffer
+func (ra *readAhead) read(s *segment) {
+	defer close(s.done)
+	var size int64
+	for i := range s.files {
+		size += s.files[i].Size
+	}
+	buf := make([]byte, size)
+	s.data = make([][]byte, len(s.files))
+	s.errs = make([]error, len(s.files))
+	s.opens = make([]bool, len(s.files))
+	for i := range s.files {
+		f, err := ra.open(&s.files[i])
+		if err != nil {
+			s.errs[i], s.opens[i] = err, true
+			continue
+		}
+		// Files that shrank are read short and fail in the block writer like
+		// any other, files that grew are cut at the size planned
+		data := buf[:s.files[i].Size:s.files[i].Size]
+		buf = buf[s.files[i].Size:]
+		n, err := io.ReadFull(f, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		s.data[i], s.errs[i] = data[:n], err
+		f.Close()
+	}
+}
+
+// openFile opens the file at index i of the block, from memory when it was
+// read ahead and through open otherwise
+func (ra *readAhead) openFile(i int, metadata *FileMetadata, open contentOpener) (io.ReadCloser, error) {
+	if ra == nil || ra.owner[i] == nil {
+		return open(metadata)
+	}
+	s := ra.owner[i]
+	<-s.done
+	j := i - s.first
+	data, err := s.data[j], s.errs[j]
+	s.data[j] = nil
+	if s.left--; s.left == 0 {
+		<-ra.slots
+	}
+	if err != nil && s.opens[j] {
+		return nil, err
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if err != nil {
+		r = io.MultiReader(r, &errorReader{err})
+	}
+	return io.NopCloser(r), nil
+}
+
+// close stops reading segments ahead once the block writer is done, segments
+// already being read are left to finish
+func (ra *readAhead) close() {
+	if ra != nil {
+		ra.stopOnce.Do(func() { close(ra.stop) })
+	}
+}
+
+// errorReader fails every read with err
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
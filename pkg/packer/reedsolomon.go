@@ -0,0 +1,181 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon erasure coding over GF(2^8). The encoding matrix is an identity
+// matrix for the data shards stacked on a Cauchy matrix for the parity shards,
+// so any combination of data shards can be rebuilt from as many parity shards
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	// Generate exponent and log tables using the primitive polynomial 0x11d
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	// Full multiplication table for fast slice operations
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInverse returns the multiplicative inverse of a non zero element
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAddSlice computes dst ^= c * src for every byte
+func mulAddSlice(c byte, src []byte, dst []byte) {
+	table := &gfMul[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// rsCodec encodes and reconstructs a fixed number of data and parity shards
+type rsCodec struct {
+	dataShards   int
+	parityShards int
+	parity       [][]byte // Cauchy rows used to compute each parity shard
+}
+
+func newRSCodec(dataShards int, parityShards int) (*rsCodec, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, fmt.Errorf("data and parity shard counts must be positive")
+	}
+	if dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("at most 256 data and parity shards are supported")
+	}
+
+	c := &rsCodec{dataShards: dataShards, parityShards: parityShards}
+	for i := 0; i < parityShards; i++ {
+		row := make([]byte, dataShards)
+		for j := range row {
+			row[j] = gfInverse(byte(dataShards+i) ^ byte(j))
+		}
+		c.parity = append(c.parity, row)
+	}
+	return c, nil
+}
+
+// row returns the encoding matrix row of a shard
+func (c *rsCodec) row(shard int) []byte {
+	if shard < c.dataShards {
+		row := make([]byte, c.dataShards)
+		row[shard] = 1
+		return row
+	}
+	return c.parity[shard-c.dataShards]
+}
+
+// encode computes the parity shards from the data shards, all shards must have
+// the same length
+func (c *rsCodec) encode(data [][]byte, parity [][]byte) {
+	for i, row := range c.parity {
+		clear(parity[i])
+		for j, coefficient := range row {
+			mulAddSlice(coefficient, data[j], parity[i])
+		}
+	}
+}
+
+// reconstruct rebuilds the missing data shards in place. Shards holds the data
+// shards followed by the parity shards and present marks which are intact
+func (c *rsCodec) reconstruct(shards [][]byte, present []bool) error {
+	// Pick the first intact shards to solve the system with
+	var rows []int
+	for i := range shards {
+		if present[i] {
+			rows = append(rows, i)
+		}
+		if len(rows) == c.dataShards {
+			break
+		}
+	}
+	if len(rows) < c.dataShards {
+		return errors.New("too many missing shards to reconstruct")
+	}
+
+	matrix := make([][]byte, c.dataShards)
+	for i, shard := range rows {
+		matrix[i] = append([]byte(nil), c.row(shard)...)
+	}
+	decode, err := invertMatrix(matrix)
+	if err != nil {
+		return err
+	}
+
+	for j := 0; j < c.dataShards; j++ {
+		if present[j] {
+			continue
+		}
+		clear(shards[j])
+		for k, shard := range rows {
+			mulAddSlice(decode[j][k], shards[shard], shards[j])
+		}
+	}
+	return nil
+}
+
+// invertMatrix inverts a square matrix using Gauss-Jordan elimination
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		// Find a pivot row and move it into place
+		pivot := -1
+		for row := col; row < n; row++ {
+			if m[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("matrix is singular")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		// Scale the pivot row to 1
+		scale := gfInverse(m[col][col])
+		for k := 0; k < n; k++ {
+			m[col][k] = gfMul[scale][m[col][k]]
+			inv[col][k] = gfMul[scale][inv[col][k]]
+		}
+
+		// Eliminate the column from every other row
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			factor := m[row][col]
+			mulAddSlice(factor, m[col], m[row])
+			mulAddSlice(factor, inv[col], inv[row])
+		}
+	}
+	return inv, nil
+}
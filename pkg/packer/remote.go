@@ -0,0 +1,232 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// UnpackFromURL extracts files from an archive served over HTTP, such as a
+// CDN or a bucket website, given the URL of its directory. The manifest is
+// fetched first, then the contents of each selected file are fetched with a
+// Range request, so only the requested bytes of each block are transferred
+func (p defaultPacker) UnpackFromURL(baseURL string, outputDir string, patterns ...string) error {
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	if err := p.checkUnpackScan("remote archives"); err != nil {
+		return err
+	}
+	if p.opts.AtomicUnpack {
+		return p.unpackAtomically(outputDir, func(p defaultPacker, dir string) error {
+			return p.UnpackFromURL(baseURL, dir, patterns...)
+		})
+	}
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkOverwritePolicy(); err != nil {
+		return err
+	}
+	p.failures = p.newFailureLog()
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	manifest, err := fetchManifest(baseURL)
+	if err != nil {
+		return err
+	}
+	files, blockNames, err := manifest.locate(patterns)
+	if err != nil {
+		return err
+	}
+	volumes := make(map[int32][]ManifestVolume)
+	for _, block := range manifest.Blocks {
+		volumes[block.ID] = block.Volumes
+	}
+	return p.extractIndexed(files, outputDir, func(metadata *FileMetadata) error {
+		return p.fetchFile(baseURL, blockNames[metadata.BlockID], volumes[metadata.BlockID], outputDir, metadata)
+	})
+}
+
+// extractIndexed extracts files located through a manifest, whose offsets are
+// relative to the start of their block file, with extract writing each one.
+// Per file failures are skipped with ContinueOnError
+func (p defaultPacker) extractIndexed(files []FileMetadata, outputDir string, extract func(metadata *FileMetadata) error) (err error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	var size int64
+	for _, metadata := range files {
+		size += metadata.Size
+	}
+	p.progress.start("unpack", len(files), size)
+	defer func() { p.progress.finish(err) }()
+
+	var stats extractStats
+	for _, metadata := range files {
+		if p.opts.Resume {
+			ok, err := p.isExtracted(outputDir, &metadata)
+			if err != nil {
+				if err := p.failures.skip(metadata.Path, fmt.Errorf("error checking extracted file: %w", err)); err != nil {
+					return fmt.Errorf("error checking extracted file %s: %w", metadata.Path, err)
+				}
+				continue
+			}
+			if ok {
+				stats.intact++
+				p.progress.file(&metadata, true)
+				continue
+			}
+		}
+
+		// Leave existing files alone under OverwritePolicy
+		keep, err := p.keepExisting(outputDir, &metadata)
+		if err != nil {
+			if err := p.failures.skip(metadata.Path, fmt.Errorf("error checking existing file: %w", err)); err != nil {
+				return fmt.Errorf("error checking existing file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+		if keep {
+			stats.kept++
+			p.progress.file(&metadata, true)
+			continue
+		}
+
+		if err := stats.record(extract(&metadata)); err != nil {
+			if err := p.failures.skip(metadata.Path, err); err != nil {
+				return fmt.Errorf("error extracting file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+		p.progress.file(&metadata, false)
+		p.pace.wait()
+	}
+
+	stats.print(p.logger())
+	if err := p.syncs.flush(); err != nil {
+		return err
+	}
+	return p.failures.result("unpack", nil)
+}
+
+// fetchManifest downloads and decodes the manifest of a remote archive
+func fetchManifest(baseURL string) (*Manifest, error) {
+	resp, err := http.Get(baseURL + "/" + manifestFileName)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("error fetching manifest: %s", resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+		}
+		return nil, err
+	}
+	return readManifest(resp.Body)
+}
+
+// fetchFile downloads the contents of a file from its block with a Range
+// request and extracts it, from each volume holding part of them when the
+// block was split into volumes. The contents are verified against the
+// checksum from the manifest while they are written
+func (p defaultPacker) fetchFile(baseURL string, blockName string, volumes []ManifestVolume, outputDir string, metadata *FileMetadata) error {
+	stored := metadata.storedSize()
+	if stored == 0 {
+		return p.extractFile(metadata.contents(strings.NewReader("")), outputDir, metadata, nil)
+	}
+	if len(volumes) == 0 {
+		volumes = []ManifestVolume{{Name: blockName, Size: metadata.Offset + stored}}
+	}
+
+	// Each volume is fetched once the contents before it are read
+	var parts []io.Reader
+	var start int64
+	for _, volume := range volumes {
+		from, to := max(metadata.Offset, start), min(metadata.Offset+stored, start+volume.Size)
+		if from < to {
+			volumeURL, off := baseURL+"/"+url.PathEscape(volume.Name), from-start
+			parts = append(parts, &lazyReader{open: func() (io.ReadCloser, error) {
+				return fetchRange(volumeURL, off, to-from)
+			}})
+		}
+		start += volume.Size
+	}
+	if start < metadata.Offset+stored {
+		return fmt.Errorf("contents of file %s end past the volumes of block %s: %w", metadata.Path, blockName, ErrCorrupted)
+	}
+	body := io.MultiReader(parts...)
+	defer func() {
+		for _, part := range parts {
+			part.(*lazyReader).Close()
+		}
+	}()
+	return p.extractFile(metadata.contents(body), outputDir, metadata, nil)
+}
+
+// fetchRange downloads n bytes of a file from off with a Range request
+func fetchRange(fileURL string, off int64, n int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching block: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range and sends the whole block
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error skipping to file contents: %w", err)
+		}
+	case http.StatusNotFound:
+		resp.Body.Close()
+		if name, _ := url.PathUnescape(path.Base(req.URL.Path)); volumeNumberOf(name) > 0 {
+			return nil, fmt.Errorf("volume %s: %w", name, ErrMissingVolume)
+		}
+		return nil, fmt.Errorf("error fetching block: %s", resp.Status)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("error fetching block: %s", resp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, n), resp.Body}, nil
+}
+
+// lazyReader reads from the reader open returns on the first read
+type lazyReader struct {
+	open func() (io.ReadCloser, error)
+	r    io.ReadCloser
+}
+
+func (l *lazyReader) Read(b []byte) (int, error) {
+	if l.r == nil {
+		r, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		l.r = r
+	}
+	return l.r.Read(b)
+}
+
+func (l *lazyReader) Close() error {
+	if l.r == nil {
+		return nil
+	}
+	return l.r.Close()
+}
@@ -0,0 +1,128 @@
+package packer
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// RemoveResult reports the files Remove marked deleted
+type RemoveResult struct {
+	Deleted         []string       // Archived paths of the files marked deleted, sorted
+	SnapshotEntries int            // Entries of the files dropped from snapshots
+	Compact         *CompactResult // Blocks compacting rewrote and removed, nil without CompactAfterRemove
+}
+
+// Remove marks the files whose archived path matches any of the patterns as
+// deleted in the manifest, so they are no longer listed or extracted, and
+// drops them from every snapshot. Their contents stay in the blocks until the
+// archive is compacted, which Remove does itself with CompactAfterRemove.
+// With DryRun it returns the files it would mark deleted, and the blocks
+// compacting would rewrite and remove, and leaves the archive as it is
+func (p defaultPacker) Remove(archiveDir string, patterns []string) (*RemoveResult, error) {
+	unlock, err := p.lockArchive(archiveDir, !p.opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("at least one pattern is required: %w", ErrInvalidOption)
+	}
+	if err := validatePatterns(patterns); err != nil {
+		return nil, err
+	}
+
+	m, err := p.buildManifest(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error building manifest: %w", err)
+	}
+	// Earlier versions of a file are stored under the same path
+	result := &RemoveResult{}
+	deleted := make(map[string]bool)
+	for i := range m.Files {
+		file := &m.Files[i]
+		if !file.Deleted && matchAny(patterns, file.Path) {
+			file.Deleted = true
+			if !deleted[file.Path] {
+				deleted[file.Path] = true
+				result.Deleted = append(result.Deleted, file.Path)
+			}
+		}
+	}
+	sort.Strings(result.Deleted)
+
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		kept := ref.manifest.Files[:0]
+		for _, file := range ref.manifest.Files {
+			if matchAny(patterns, file.Path) {
+				result.SnapshotEntries++
+				continue
+			}
+			kept = append(kept, file)
+		}
+		ref.manifest.Files = kept
+	}
+	if len(result.Deleted) == 0 && result.SnapshotEntries == 0 {
+		return nil, fmt.Errorf("%w matched the patterns", ErrNoFiles)
+	}
+	if p.opts.DryRun {
+		if p.opts.CompactAfterRemove {
+			if result.Compact, err = p.planRemoveCompact(archiveDir, m, refs); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	// Snapshots are updated first, an interrupted Remove is simply run again
+	for _, ref := range refs {
+		if err := ref.manifest.relocate(nil, manifestBlocks(m)); err != nil {
+			return nil, err
+		}
+		if err := writeManifestFile(ref.path, ref.manifest); err != nil {
+			return nil, fmt.Errorf("error updating snapshot %d: %w", ref.manifest.Generation, err)
+		}
+	}
+	if err := writeManifestFile(filepath.Join(archiveDir, manifestFileName), m); err != nil {
+		return nil, err
+	}
+	if err := p.resign(archiveDir); err != nil {
+		return nil, err
+	}
+	p.logger().Info("Marked files deleted", "files", len(result.Deleted))
+
+	if p.opts.CompactAfterRemove {
+		if result.Compact, err = p.Compact(archiveDir); err != nil {
+			return nil, fmt.Errorf("error compacting archive: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// planRemoveCompact returns the blocks compacting would rewrite and remove
+// once the manifest and snapshots were written as Remove changed them
+func (p defaultPacker) planRemoveCompact(archiveDir string, m *Manifest, refs []referencingManifest) (*CompactResult, error) {
+	var err error
+	if p.dictionary, err = latestDictionary(archiveDir); err != nil {
+		return nil, err
+	}
+	plan := planCompact(m, refs)
+	if _, err := p.moveContents(archiveDir, plan); err != nil {
+		return nil, err
+	}
+	return plan.result, nil
+}
+
+// manifestBlocks indexes the blocks of a manifest by ID
+func manifestBlocks(m *Manifest) map[int32]ManifestBlock {
+	blocks := make(map[int32]ManifestBlock, len(m.Blocks))
+	for _, block := range m.Blocks {
+		blocks[block.ID] = block
+	}
+	return blocks
+}
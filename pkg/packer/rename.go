@@ -0,0 +1,133 @@
+package packer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Rename moves an archived file, or every file below an archived directory,
+// from oldPath to newPath in the manifest and in every snapshot. The blocks
+// are not rewritten, they keep the original paths, which the manifest records
+// until the archive is compacted
+func (p defaultPacker) Rename(archiveDir string, oldPath string, newPath string) error {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oldPath, err = cleanArchivePath(oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = cleanArchivePath(newPath)
+	if err != nil {
+		return err
+	}
+	if oldPath == newPath {
+		return fmt.Errorf("%s is renamed to itself: %w", oldPath, ErrInvalidOption)
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		return fmt.Errorf("cannot move %s into itself: %w", oldPath, ErrInvalidOption)
+	}
+
+	m, err := p.buildManifest(archiveDir)
+	if err != nil {
+		return fmt.Errorf("error building manifest: %w", err)
+	}
+	// Entries record the path stored in their block while they differ from it
+	for i := range m.Files {
+		if m.Files[i].Original == "" {
+			m.Files[i].Original = m.Files[i].Path
+		}
+	}
+	count, err := renameFiles(m.Files, oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	for i := range m.Files {
+		if m.Files[i].Path == m.Files[i].Original {
+			m.Files[i].Original = ""
+		}
+	}
+
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return err
+	}
+	var renamed int
+	for _, ref := range refs {
+		n, err := renameFiles(ref.manifest.Files, oldPath, newPath)
+		if err != nil {
+			return fmt.Errorf("error renaming in snapshot %d: %w", ref.manifest.Generation, err)
+		}
+		renamed += n
+	}
+	if count == 0 && renamed == 0 {
+		return fmt.Errorf("%w at %s", ErrNoFiles, oldPath)
+	}
+
+	// Snapshots are updated first, an interrupted Rename is simply run again
+	for _, ref := range refs {
+		ref.manifest.sort()
+		if err := writeManifestFile(ref.path, ref.manifest); err != nil {
+			return fmt.Errorf("error updating snapshot %d: %w", ref.manifest.Generation, err)
+		}
+	}
+	m.sort()
+	if err := writeManifestFile(filepath.Join(archiveDir, manifestFileName), m); err != nil {
+		return err
+	}
+	if err := p.resign(archiveDir); err != nil {
+		return err
+	}
+	p.logger().Info("Renamed files", "files", count)
+	return nil
+}
+
+// renameFiles moves the files at or below oldPath to newPath. It fails
+// without changing anything when a renamed file would replace another one
+func renameFiles(files []ManifestFile, oldPath string, newPath string) (int, error) {
+	renamed := make(map[int]string)
+	taken := make(map[string]bool, len(files))
+	for i, file := range files {
+		if file.Deleted {
+			continue
+		}
+		switch {
+		case file.Path == oldPath:
+			renamed[i] = newPath
+		case strings.HasPrefix(file.Path, oldPath+"/"):
+			renamed[i] = newPath + strings.TrimPrefix(file.Path, oldPath)
+		default:
+			taken[file.Path] = true
+		}
+	}
+	for _, to := range renamed {
+		if taken[to] {
+			return 0, fmt.Errorf("%s already exists in the archive: %w", to, ErrInvalidOption)
+		}
+	}
+
+	for i, to := range renamed {
+		files[i].Path = to
+	}
+	return len(renamed), nil
+}
+
+// cleanArchivePath normalizes an archived path given by the caller, rejecting
+// paths that point outside the archive
+func cleanArchivePath(archivedPath string) (string, error) {
+	segments := splitPath(path.Clean("/" + archivedPath))
+	if len(segments) == 0 {
+		return "", fmt.Errorf("empty archived path: %w", ErrInvalidOption)
+	}
+	for _, segment := range splitPath(archivedPath) {
+		if segment == ".." {
+			return "", fmt.Errorf("archived path %s points outside the archive: %w", archivedPath, ErrPathUnsafe)
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
@@ -0,0 +1,253 @@
+package packer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ErrSourceChanged is returned by Repair for files of a damaged block whose
+// copy in the source directory no longer matches the archived contents
+var ErrSourceChanged = errors.New("source file changed since it was packed")
+
+// RepairResult reports how Repair changed an archive
+type RepairResult struct {
+	Repaired   []string // Damaged blocks rebuilt from the source directory, by their new names
+	Unrepaired []string // Damaged blocks left as they are, some of their files missing from the source directory or changed
+	Intact     int      // Blocks that passed validation and were left alone
+}
+
+// Repair validates every block of an archive and rebuilds the damaged ones,
+// including blocks missing altogether, from the files of sourceDir, which
+// is walked and mapped to archived paths as Pack would. The manifest tells
+// which files each block held, so only damaged blocks are rewritten, each
+// with the same ID and its files in the same order. Every file is checked
+// against its archived checksum as it is copied, so a block is only rebuilt
+// when all of its files are unchanged in the source directory. The manifest,
+// snapshots and parity are updated to the new blocks. Blocks that cannot be
+// rebuilt are listed in the result, which is returned along with an error
+func (p defaultPacker) Repair(archiveDir string, sourceDir string) (*RepairResult, error) {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if p.opts.Format != FormatBeam {
+		return nil, fmt.Errorf("only .beam archives can be repaired: %w", ErrInvalidOption)
+	}
+	manifestPath := filepath.Join(archiveDir, manifestFileName)
+	m, err := readManifestFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("repairing needs the manifest listing the files of each block, which archives with encrypted metadata do not have: %w", ErrInvalidOption)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	// Rebuilt blocks are compressed with the dictionary of the archive
+	if p.dictionary, err = latestDictionary(archiveDir); err != nil {
+		return nil, err
+	}
+
+	result := &RepairResult{}
+	var damaged []ManifestBlock
+	for _, block := range m.Blocks {
+		if err := p.validator.ValidateBlock(filepath.Join(archiveDir, block.Name)); err != nil {
+			p.logger().Warn("Block is damaged", "block", block.Name, "error", err)
+			damaged = append(damaged, block)
+			continue
+		}
+		result.Intact++
+	}
+	if len(damaged) == 0 {
+		p.logger().Info("Archive has no damaged blocks", "blocks", result.Intact)
+		return result, nil
+	}
+
+	sources, err := p.repairSources(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// New blocks are written next to the archive first, as an open block
+	// cannot be replaced on every platform
+	staging, err := os.MkdirTemp(archiveDir, ".repair-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	blocks := make(map[int32]ManifestBlock, len(m.Blocks))
+	for _, block := range m.Blocks {
+		blocks[block.ID] = block
+	}
+	stored := make(map[extentKey]ManifestFile)
+	var repaired []int32
+	for _, block := range damaged {
+		rebuilt, err := p.repairBlock(archiveDir, staging, block, m, sources, stored)
+		if err != nil {
+			p.logger().Error("Error repairing block", "block", block.Name, "error", err)
+			result.Unrepaired = append(result.Unrepaired, block.Name)
+			continue
+		}
+		p.logger().Info("Repaired block", "block", block.Name, "name", rebuilt.Name)
+		blocks[block.ID] = rebuilt
+		result.Repaired = append(result.Repaired, rebuilt.Name)
+		repaired = append(repaired, block.ID)
+	}
+
+	if len(repaired) > 0 {
+		// The manifest is updated rather than rebuilt from the blocks, which
+		// cannot be read while some remain damaged
+		if err := m.restore(stored, blocks); err != nil {
+			return nil, err
+		}
+		if err := writeManifestFile(manifestPath, m); err != nil {
+			return nil, fmt.Errorf("error updating manifest: %w", err)
+		}
+		for _, ref := range refs {
+			if err := ref.manifest.restore(stored, blocks); err != nil {
+				return nil, err
+			}
+			if err := writeManifestFile(ref.path, ref.manifest); err != nil {
+				return nil, fmt.Errorf("error updating snapshot %d: %w", ref.manifest.Generation, err)
+			}
+		}
+		// Parity computed over blocks still damaged would keep the damage,
+		// it is left for Reconstruct to use on them instead
+		if len(result.Unrepaired) == 0 {
+			if err := p.rewriteParity(archiveDir, repaired); err != nil {
+				return nil, err
+			}
+		} else {
+			p.logger().Warn("Parity left as it was, some blocks remain damaged")
+		}
+		if err := p.syncs.flush(); err != nil {
+			return nil, err
+		}
+		if err := p.resign(archiveDir); err != nil {
+			return nil, err
+		}
+	}
+
+	p.logger().Info("Repaired archive", "blocks_repaired", len(result.Repaired), "blocks_unrepaired", len(result.Unrepaired),
+		"blocks_intact", result.Intact)
+	if len(result.Unrepaired) > 0 {
+		return result, fmt.Errorf("%d of %d damaged blocks could not be repaired from %s: %w", len(result.Unrepaired), len(damaged), sourceDir, ErrCorrupted)
+	}
+	return result, nil
+}
+
+// repairSources returns the files of the source directory by archived path
+func (p defaultPacker) repairSources(sourceDir string) (map[string]FileInfo, error) {
+	files, err := p.planFiles(sourceDir)
+	if errors.Is(err, ErrNoFiles) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]FileInfo, len(files))
+	for _, file := range files {
+		sources[file.ArchivePath] = file
+	}
+	return sources, nil
+}
+
+// repairBlock writes a damaged block again from the source files of the files
+// the manifest lists in it, through the staging directory, recording where
+// their contents are stored in the new block by their old location
+func (p defaultPacker) repairBlock(archiveDir string, staging string, damaged ManifestBlock, m *Manifest, sources map[string]FileInfo, stored map[extentKey]ManifestFile) (ManifestBlock, error) {
+	block := &Block{ID: damaged.ID}
+	for i := range m.Files {
+		file := &m.Files[i]
+		if file.BlockID != damaged.ID {
+			continue
+		}
+		metadata, err := file.metadata()
+		if err != nil {
+			return ManifestBlock{}, err
+		}
+		// The block records the path a file was packed under
+		if file.Original != "" {
+			metadata.Path = file.Original
+		}
+		if !isSpecialMode(metadata.Mode) {
+			source, ok := sources[metadata.Path]
+			if !ok {
+				return ManifestBlock{}, fmt.Errorf("file %s is not in the source directory: %w", metadata.Path, fs.ErrNotExist)
+			}
+			if source.Size != metadata.Size {
+				return ManifestBlock{}, fmt.Errorf("file %s: %w", metadata.Path, ErrSourceChanged)
+			}
+			metadata.sourcePath = source.Path
+		}
+		block.Files = append(block.Files, metadata)
+		block.Size += metadata.Size
+	}
+	if len(block.Files) == 0 {
+		return ManifestBlock{}, fmt.Errorf("the manifest lists no files in block %d: %w", damaged.ID, ErrCorrupted)
+	}
+
+	// Files keep their order within the data section
+	sort.SliceStable(block.Files, func(i, j int) bool { return block.Files[i].Offset < block.Files[j].Offset })
+	offsets := make([]int64, len(block.Files))
+	for i := range block.Files {
+		offsets[i] = block.Files[i].Offset
+	}
+	err := p.writeBlock(block, staging, p.sourceOpener())
+	var integrityErr *FileIntegrityError
+	if errors.As(err, &integrityErr) {
+		return ManifestBlock{}, fmt.Errorf("file %s: %w", integrityErr.Path, ErrSourceChanged)
+	}
+	if err != nil {
+		return ManifestBlock{}, err
+	}
+	if len(block.Files) != len(offsets) {
+		return ManifestBlock{}, fmt.Errorf("%d of %d files copied from the source directory", len(block.Files), len(offsets))
+	}
+	for i := range block.Files {
+		stored[extentKey{block.ID, offsets[i]}] = manifestFile(&block.Files[i], blockHeaderSize+block.Files[i].Offset)
+	}
+
+	// The new block replaces the damaged one, which is only removed separately
+	// when the naming scheme gives the new block another name
+	path := filepath.Join(archiveDir, block.fileName)
+	if err := renameBlock(filepath.Join(staging, block.fileName), path); err != nil {
+		return ManifestBlock{}, fmt.Errorf("error replacing block: %w", err)
+	}
+	if block.fileName != damaged.Name {
+		if err := removeBlock(filepath.Join(archiveDir, damaged.Name)); err != nil && !os.IsNotExist(err) {
+			return ManifestBlock{}, fmt.Errorf("error removing damaged block: %w", err)
+		}
+	}
+	return ManifestBlock{
+		ID:       block.ID,
+		Name:     block.fileName,
+		Size:     block.length,
+		Checksum: hex.EncodeToString(block.Checksum),
+		Volumes:  block.volumes,
+	}, nil
+}
+
+// restore points the files of a manifest stored in rebuilt blocks at their
+// contents in the new blocks, keeping their paths and removals, and lists
+// the blocks they are now stored in
+func (m *Manifest) restore(stored map[extentKey]ManifestFile, blocks map[int32]ManifestBlock) error {
+	for i := range m.Files {
+		file := &m.Files[i]
+		if to, ok := stored[extentKey{file.BlockID, file.Offset}]; ok {
+			file.BlockID, file.Offset = to.BlockID, to.Offset
+			file.ZeroRuns, file.Compression, file.CompressedSize = to.ZeroRuns, to.Compression, to.CompressedSize
+		}
+	}
+	return m.relocate(nil, blocks)
+}
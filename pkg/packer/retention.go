@@ -0,0 +1,179 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy chooses the snapshots Prune keeps besides expired ones. A
+// snapshot is kept when any rule keeps it, the zero policy keeps every
+// snapshot that has not expired. Days, weeks and months are those of the
+// local time zone, weeks start on Monday as in ISO 8601
+type RetentionPolicy struct {
+	KeepLast    int // Keep the latest N snapshots
+	KeepDaily   int // Keep the latest snapshot of each of the latest N days that have one
+	KeepWeekly  int // Keep the latest snapshot of each of the latest N weeks that have one
+	KeepMonthly int // Keep the latest snapshot of each of the latest N months that have one
+}
+
+// PruneResult reports the snapshots and blocks Prune deleted, or would delete
+type PruneResult struct {
+	Kept      []int // Generations kept, oldest first
+	Expired   []int // Generations deleted as they expired, oldest first
+	Forgotten []int // Generations deleted as no rule of the policy keeps them, oldest first
+	GCResult        // Blocks no kept snapshot references any more
+}
+
+// isZero reports whether the policy has no rule
+func (r RetentionPolicy) isZero() bool {
+	return r == RetentionPolicy{}
+}
+
+// check rejects policies with negative counts
+func (r RetentionPolicy) check() error {
+	if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 {
+		return fmt.Errorf("retention policy keeps a negative number of snapshots: %w", ErrInvalidOption)
+	}
+	return nil
+}
+
+// Prune deletes the snapshots of an archive that expired, or that no rule of
+// the policy keeps, then removes the blocks no remaining snapshot references
+// as GC does
+func (p defaultPacker) Prune(archiveDir string, policy RetentionPolicy) (*PruneResult, error) {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	result, err := p.planPrune(archiveDir, policy)
+	if err != nil {
+		return nil, err
+	}
+	for _, generation := range append(append([]int(nil), result.Expired...), result.Forgotten...) {
+		if err := os.Remove(snapshotPath(archiveDir, generation)); err != nil {
+			return nil, fmt.Errorf("error deleting snapshot %d: %w", generation, err)
+		}
+	}
+	for _, name := range result.Removed {
+		if err := removeBlock(filepath.Join(archiveDir, name)); err != nil {
+			return nil, fmt.Errorf("error removing block %s: %w", name, err)
+		}
+	}
+	if err := p.writeManifest(archiveDir); err != nil {
+		return nil, err
+	}
+	p.logger().Info("Pruned archive", "snapshots_kept", len(result.Kept), "snapshots_expired", len(result.Expired),
+		"snapshots_forgotten", len(result.Forgotten), "blocks_removed", len(result.Removed), "bytes_reclaimed", result.ReclaimedBytes)
+	return result, nil
+}
+
+// PlanPrune computes which snapshots and blocks Prune would delete without
+// changing the archive
+func (p defaultPacker) PlanPrune(archiveDir string, policy RetentionPolicy) (*PruneResult, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return p.planPrune(archiveDir, policy)
+}
+
+// planPrune sorts the snapshots of an archive into kept, expired and
+// forgotten ones, and lists the blocks only the deleted ones reference
+func (p defaultPacker) planPrune(archiveDir string, policy RetentionPolicy) (*PruneResult, error) {
+	if err := policy.check(); err != nil {
+		return nil, err
+	}
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if refs == nil {
+		return nil, fmt.Errorf("%s has no snapshots: %w", archiveDir, ErrInvalidOption)
+	}
+
+	now := time.Now()
+	result := &PruneResult{}
+	var live []*Manifest
+	for _, ref := range refs {
+		if ref.manifest.Expires != nil && !now.Before(*ref.manifest.Expires) {
+			result.Expired = append(result.Expired, ref.manifest.Generation)
+			continue
+		}
+		live = append(live, ref.manifest)
+	}
+	kept := policy.keep(live)
+	var references []referencingManifest
+	for _, ref := range refs {
+		switch generation := ref.manifest.Generation; {
+		case kept[generation]:
+			result.Kept = append(result.Kept, generation)
+			references = append(references, ref)
+		case ref.manifest.Expires == nil || now.Before(*ref.manifest.Expires):
+			result.Forgotten = append(result.Forgotten, generation)
+		}
+	}
+
+	unreferenced, err := p.unreferencedBlocks(archiveDir, references)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range unreferenced {
+		result.Removed = append(result.Removed, block.Name)
+		result.ReclaimedBytes += block.Size
+	}
+	return result, nil
+}
+
+// keep returns the generations of the snapshots the policy keeps
+func (r RetentionPolicy) keep(snapshots []*Manifest) map[int]bool {
+	kept := make(map[int]bool, len(snapshots))
+	if r.isZero() {
+		for _, m := range snapshots {
+			kept[m.Generation] = true
+		}
+		return kept
+	}
+
+	// Snapshots are considered newest first
+	sorted := append([]*Manifest(nil), snapshots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Generation > sorted[j].Generation })
+	for i, m := range sorted {
+		if i < r.KeepLast {
+			kept[m.Generation] = true
+		}
+	}
+	periods := []struct {
+		n      int
+		period func(t time.Time) string
+	}{
+		{r.KeepDaily, func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{r.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{r.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, rule := range periods {
+		seen := make(map[string]bool)
+		for _, m := range sorted {
+			if len(seen) == rule.n {
+				break
+			}
+			var created time.Time
+			if m.Created != nil {
+				created = m.Created.Local()
+			}
+			if period := rule.period(created); !seen[period] {
+				seen[period] = true
+				kept[m.Generation] = true
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,142 @@
+package packer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Root is an input directory or file packed by PackRoots, so one archive can
+// hold trees from anywhere on disk such as /etc, /var/lib/app and /home/app
+type Root struct {
+	Path   string // Directory or file to pack
+	Prefix string // Archived path the files of the root are packed under, the base name of Path when empty
+}
+
+// prefix returns the archived path the files of the root are packed under,
+// checking that it stays inside the archive
+func (r Root) prefix() (string, error) {
+	prefix := r.Prefix
+	if prefix == "" {
+		prefix = filepath.Base(filepath.Clean(r.Path))
+	}
+	prefix = path.Clean(filepath.ToSlash(prefix))
+	if path.IsAbs(prefix) || filepath.IsAbs(prefix) || prefix == "." {
+		return "", fmt.Errorf("prefix %q of root %s is not a relative path: %w", r.Prefix, r.Path, ErrInvalidOption)
+	}
+	for _, segment := range splitPath(prefix) {
+		if segment == ".." {
+			return "", fmt.Errorf("prefix %q of root %s leads outside the archive: %w", r.Prefix, r.Path, ErrPathUnsafe)
+		}
+	}
+	return prefix, nil
+}
+
+func (p defaultPacker) PackRoots(roots []Root, outputDir string) error {
+	unlock, err := p.lockArchive(outputDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	p.failures = p.newFailureLog()
+	p.checkChanges = true
+	if len(roots) == 0 {
+		return fmt.Errorf("%w, no roots to pack", ErrNoFiles)
+	}
+	if p.opts.SourceSnapshot != nil {
+		return fmt.Errorf("roots are not frozen, pack them one by one to read them from snapshots: %w", ErrInvalidOption)
+	}
+	fileInfos, packed, err := p.planRoots(roots)
+	if err != nil {
+		return err
+	}
+	p.roots = packed
+	return p.failures.result("pack", p.packPlanned(fileInfos, outputDir, p.sourceOpener()))
+}
+
+// planRoots walks every root and returns the files to pack, largest first,
+// with their archived paths under the prefix of their root, and the roots to
+// record in the manifest
+func (p defaultPacker) planRoots(roots []Root) ([]FileInfo, []ManifestRoot, error) {
+	if err := p.checkPlanOptions(); err != nil {
+		return nil, nil, err
+	}
+
+	sources := make(map[string]string, len(roots))
+	var fileInfos []FileInfo
+	var packed []ManifestRoot
+	for _, root := range roots {
+		prefix, err := root.prefix()
+		if err != nil {
+			return nil, nil, err
+		}
+		if other, ok := sources[prefix]; ok {
+			return nil, nil, fmt.Errorf("roots %s and %s are both packed under %s, set a prefix for one: %w", other, root.Path, prefix, ErrInvalidOption)
+		}
+		sources[prefix] = root.Path
+		packed = append(packed, ManifestRoot{Prefix: prefix, Source: root.Path})
+
+		dir := filepath.Clean(root.Path)
+		files, err := p.walkInput(dir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error walking root %s: %w", root.Path, err)
+		}
+		infos, err := p.collectFileInfo(files)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error collecting file info: %w", err)
+		}
+		for i := range infos {
+			rel, err := filepath.Rel(dir, infos[i].Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			infos[i].ArchivePath = path.Join(prefix, filepath.ToSlash(rel))
+		}
+		fileInfos = append(fileInfos, infos...)
+	}
+
+	if len(fileInfos) == 0 {
+		return nil, nil, fmt.Errorf("%w found in the roots", ErrNoFiles)
+	}
+	fileInfos, err := p.orderFiles(fileInfos)
+	return fileInfos, packed, err
+}
+
+// readRoots reads the roots recorded in the manifest of an archive directory,
+// skipping its files. Archives without a manifest have none
+func readRoots(archiveDir string) ([]ManifestRoot, error) {
+	f, err := os.Open(filepath.Join(archiveDir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m struct {
+		Roots []ManifestRoot `json:"roots"`
+	}
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %w", err)
+	}
+	return m.Roots, nil
+}
+
+// mergeRoots adds the roots packed to those an archive has, a root packed
+// again under the same prefix replacing the one recorded
+func mergeRoots(roots []ManifestRoot, packed []ManifestRoot) []ManifestRoot {
+	byPrefix := make(map[string]ManifestRoot, len(roots)+len(packed))
+	for _, root := range append(roots, packed...) {
+		byPrefix[root.Prefix] = root
+	}
+	merged := make([]ManifestRoot, 0, len(byPrefix))
+	for _, root := range byPrefix {
+		merged = append(merged, root)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Prefix < merged[j].Prefix })
+	return merged
+}
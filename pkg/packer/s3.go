@@ -0,0 +1,273 @@
+package packer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store is a BlockStore keeping blocks as objects in an S3 compatible
+// bucket, such as Amazon S3, MinIO or Ceph. Objects are addressed with path
+// style URLs and requests are signed with AWS Signature Version 4
+type S3Store struct {
+	Endpoint        string       // Base URL of the service, https://s3.<Region>.amazonaws.com when empty
+	Region          string       // Region requests are signed for, us-east-1 when empty
+	Bucket          string       // Bucket holding the blocks
+	Prefix          string       // Prepended to every block name to form its key, e.g. "backups/host1/"
+	AccessKeyID     string       // Access key of the credentials
+	SecretAccessKey string       // Secret key of the credentials
+	SessionToken    string       // Token of temporary credentials, empty for long term credentials
+	Client          *http.Client // Client sending the requests, http.DefaultClient when nil
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// unsignedPayload marks an uploaded body that is not covered by the
+// signature, so blocks can be streamed without hashing them twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (s S3Store) Put(name string, r io.Reader, size int64) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	if size == 0 {
+		r = http.NoBody
+	}
+	resp, err := s.do(http.MethodPut, s.Prefix+name, "", r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s S3Store) Get(name string) (io.ReadCloser, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, s.Prefix+name, "", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s S3Store) Delete(name string) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, s.Prefix+name, "", nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is the response of a ListObjectsV2 request
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s S3Store) List() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := "list-type=2&prefix=" + uriEncode(s.Prefix, false)
+		if token != "" {
+			query = "continuation-token=" + uriEncode(token, false) + "&" + query
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding object list: %w", err)
+		}
+
+		// Only objects directly below the prefix are blocks of this archive
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.Prefix)
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// s3Error is the error document returned by a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for key, or for the bucket itself when key is
+// empty, and returns the response of a successful request
+func (s S3Store) do(method string, key string, query string, body io.Reader, size int64) (*http.Response, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region() + ".amazonaws.com"
+	}
+	url := strings.TrimSuffix(endpoint, "/") + "/" + uriEncode(s.Bucket, false)
+	if key != "" {
+		url += "/" + uriEncode(key, true)
+	}
+	if query != "" {
+		url += "?" + query
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil && body != http.NoBody {
+		req.ContentLength = size
+		payloadHash = unsignedPayload
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&s3Err)
+	err = fmt.Errorf("%s %s: %s %s %s", method, url, resp.Status, s3Err.Code, s3Err.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+	return nil, err
+}
+
+func (s S3Store) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req. The host,
+// range and every x-amz-* header are signed
+func (s S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.region() + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], s.region(), "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery sorts the already encoded parameters of a query string, a
+// parameter without a value is given an empty one
+func canonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		if !strings.Contains(param, "=") {
+			params[i] = param + "="
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent encodes every byte but the unreserved characters of RFC
+// 3986, and slashes when keepSlash is set, as Signature Version 4 requires
+func uriEncode(s string, keepSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		}
+	}
+	return b.String()
+}
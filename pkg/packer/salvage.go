@@ -0,0 +1,81 @@
+package packer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// newUnpackFailureLog returns the failure log of an unpacking call, which
+// Salvage keeps as ContinueOnError does to report the files lost
+func (p defaultPacker) newUnpackFailureLog() *failureLog {
+	if p.opts.Salvage {
+		p.opts.ContinueOnError = true
+	}
+	return p.newFailureLog()
+}
+
+// readSalvageIndex reads the index of a block of an archive. Under Salvage a
+// block whose own index cannot be read falls back on the files the manifest
+// lists in it, and is reported as damaged
+func (p defaultPacker) readSalvageIndex(blockPath string) (*Block, bool, error) {
+	block, err := p.readBlockIndex(blockPath)
+	if err == nil || !p.opts.Salvage {
+		return block, false, err
+	}
+	m, merr := readManifestFile(filepath.Join(filepath.Dir(blockPath), manifestFileName))
+	if merr != nil {
+		if !os.IsNotExist(merr) {
+			p.logger().Warn("Cannot read the manifest to salvage a block", "block", filepath.Base(blockPath), "error", merr)
+		}
+		return nil, false, err
+	}
+	var id int32
+	found := false
+	for _, b := range m.Blocks {
+		if b.Name == filepath.Base(blockPath) {
+			id, found = b.ID, true
+			break
+		}
+	}
+	if !found {
+		return nil, false, err
+	}
+	files, _, merr := m.locate(nil)
+	if merr != nil {
+		return nil, false, err
+	}
+	// Manifest offsets run from the start of the block file
+	salvaged := &Block{ID: id}
+	for _, metadata := range files {
+		if metadata.BlockID == id {
+			salvaged.Files = append(salvaged.Files, metadata)
+		}
+	}
+	p.logger().Debug("Reading the files of a damaged block from the manifest", "block", filepath.Base(blockPath), "error", err)
+	return salvaged, true, nil
+}
+
+// salvageFiles checks the files of a damaged block read through r against
+// their own checksums before any is extracted, returning those that match.
+// The others are recorded as lost
+func (p defaultPacker) salvageFiles(block *Block, files []FileMetadata, r blockReader) ([]FileMetadata, error) {
+	intact := files[:0]
+	for _, metadata := range files {
+		h := newChecksum()
+		contents := metadata.contents(r.section(block.DataOffset+metadata.Offset, metadata.storedSize()))
+		_, err := p.buffers.copyN(h, contents, metadata.Size)
+		if err == nil {
+			err = checkFileChecksum(metadata.Path, metadata.Checksum, h)
+		}
+		if err != nil {
+			if err := p.failures.skip(metadata.Path, fmt.Errorf("lost in damaged block %d: %w", block.ID, err)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		intact = append(intact, metadata)
+	}
+	p.logger().Info("Salvaged damaged block", "block", block.ID, "files", len(intact), "lost", len(files)-len(intact))
+	return intact, nil
+}
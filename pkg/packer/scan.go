@@ -0,0 +1,190 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrContentRejected is returned, wrapped, by a Scanner for files whose
+// contents are disallowed, such as malware or data a content policy forbids
+var ErrContentRejected = errors.New("content rejected")
+
+// Scanner inspects the contents of files as they are packed or before they
+// are extracted, such as with ClamAV or against a content policy. Scan reads
+// the contents of the file with the archived path from r, which it need not
+// read to the end, and returns an error wrapping ErrContentRejected to reject
+// the file. Any other error fails the file as well, as it could not be scanned.
+// Scan is called from several goroutines at once
+type Scanner interface {
+	Scan(path string, r io.Reader) error
+}
+
+// ScannerFunc adapts a function to a Scanner
+type ScannerFunc func(path string, r io.Reader) error
+
+func (f ScannerFunc) Scan(path string, r io.Reader) error {
+	return f(path, r)
+}
+
+// CommandScanner scans files with an external command reading the contents
+// from stdin, such as clamdscan - or a content policy script, which finds the
+// archived path in BEAM_SCAN_PATH. Exit status 0 accepts a file and 1 rejects
+// it, as with ClamAV, any other status fails the scan. The command is run once
+// per file
+type CommandScanner struct {
+	Command []string // Program and its arguments
+}
+
+func (s CommandScanner) Scan(path string, r io.Reader) error {
+	if len(s.Command) == 0 {
+		return fmt.Errorf("no scan command: %w", ErrInvalidOption)
+	}
+	cmd := exec.Command(s.Command[0], s.Command[1:]...)
+	cmd.Stdin = r
+	cmd.Env = append(os.Environ(), "BEAM_SCAN_PATH="+path)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(out.String()), ErrContentRejected)
+	}
+	if err != nil {
+		return fmt.Errorf("error running scan command: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// ScanPhase selects when Scanner is called
+type ScanPhase uint8
+
+const (
+	ScanPackAndUnpack ScanPhase = iota // Scan files both as they are packed and before they are extracted
+	ScanPack                           // Scan files as they are packed only
+	ScanUnpack                         // Scan files before they are extracted only
+)
+
+// scansPack tells whether files are scanned as they are packed
+func (p defaultPacker) scansPack() bool {
+	return p.opts.Scanner != nil && p.opts.ScanPhase != ScanUnpack
+}
+
+// scansUnpack tells whether files are scanned before they are extracted
+func (p defaultPacker) scansUnpack() bool {
+	return p.opts.Scanner != nil && p.opts.ScanPhase != ScanPack
+}
+
+// checkScanPhase rejects ScanPhase values this version does not know
+func (p defaultPacker) checkScanPhase() error {
+	if p.opts.ScanPhase > ScanUnpack {
+		return fmt.Errorf("unknown scan phase %d: %w", p.opts.ScanPhase, ErrInvalidOption)
+	}
+	return nil
+}
+
+// checkUnpackScan rejects scanning before extraction for the unpack calls
+// that read the contents of each file once, which leaves no way to scan them
+// before they are written
+func (p defaultPacker) checkUnpackScan(source string) error {
+	if p.scansUnpack() {
+		return fmt.Errorf("files of %s cannot be scanned before they are extracted, unpack from an archive directory or set ScanPhase to ScanPack: %w", source, ErrInvalidOption)
+	}
+	return nil
+}
+
+// scanError reports a file the Scanner failed, as rejected or as not scanned
+func scanError(path string, err error) error {
+	if errors.Is(err, ErrContentRejected) {
+		return fmt.Errorf("file %s: %w", path, err)
+	}
+	return fmt.Errorf("error scanning file %s: %w", path, err)
+}
+
+// scanWriter hands the contents written to it to the Scanner, which reads them
+// in a goroutine of its own while they are packed
+type scanWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newScanWriter starts scanning the contents of a file written to the writer
+// returned
+func (p defaultPacker) newScanWriter(path string) *scanWriter {
+	pr, pw := io.Pipe()
+	s := &scanWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := p.opts.Scanner.Scan(path, pr)
+		// Contents the scanner did not read are drained so writes go on
+		io.Copy(io.Discard, pr)
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *scanWriter) Write(b []byte) (int, error) {
+	return s.pw.Write(b)
+}
+
+// finish ends the contents, with the error copying them failed with if any,
+// and returns the verdict of the Scanner
+func (s *scanWriter) finish(copyErr error) error {
+	if copyErr != nil {
+		s.pw.CloseWithError(copyErr)
+	} else {
+		s.pw.Close()
+	}
+	return <-s.done
+}
+
+// scannedFile identifies a file of an archive the Scanner rejected
+type scannedFile struct {
+	block int32
+	path  string
+}
+
+// scanBlocks hands the files of the blocks that unpacking would extract to
+// the Scanner before any is written, so an archive holding disallowed
+// contents is rejected before anything lands in the output directory. When
+// failures are collected, the files that fail are returned instead so the
+// rest of the archive can be extracted without them
+func (p defaultPacker) scanBlocks(blockPaths []string, patterns []string, edits manifestEdits) (map[scannedFile]bool, error) {
+	rejected := make(map[scannedFile]bool)
+	for _, blockPath := range blockPaths {
+		block, _, err := p.readSalvageIndex(blockPath)
+		if err != nil {
+			// Blocks that cannot be read fail when they are unpacked
+			continue
+		}
+		edits.apply(block)
+		files := matchingFiles(block, patterns)
+		if len(files) == 0 {
+			continue
+		}
+		r, err := p.openBlockReader(blockPath)
+		if err != nil {
+			continue
+		}
+		for i := range files {
+			metadata := &files[i]
+			contents := metadata.contents(r.section(block.DataOffset+metadata.Offset, metadata.storedSize()))
+			if err := p.opts.Scanner.Scan(metadata.Path, io.LimitReader(contents, metadata.Size)); err != nil {
+				if err := p.failures.skip(metadata.Path, scanError(metadata.Path, err)); err != nil {
+					r.Close()
+					return nil, fmt.Errorf("error scanning block %s: %w", filepath.Base(blockPath), err)
+				}
+				rejected[scannedFile{block.ID, metadata.Path}] = true
+			}
+		}
+		r.Close()
+	}
+	if len(rejected) > 0 {
+		p.logger().Warn("Leaving out files the scanner failed", "files", len(rejected))
+	}
+	return rejected, nil
+}
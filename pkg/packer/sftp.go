@@ -0,0 +1,827 @@
+package packer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPOptions tune the connections of an SFTPStore
+type SFTPOptions struct {
+	MaxConns   int           // SSH connections open at once, 4 when 0
+	Retries    int           // Times an operation failing on a broken connection is retried on a new one, 3 when 0, negative for none
+	RetryDelay time.Duration // Delay before the first retry, doubled for each further one, 500ms when 0
+}
+
+// SFTPStore is a BlockStore keeping blocks as files in a directory of a
+// remote host, reached over SSH with the SFTP protocol. Connections are
+// pooled, up to MaxConns of them, and reused by later operations. An operation
+// failing because its connection broke is retried on a new connection after
+// a growing delay, and a Get whose connection breaks while the block is read
+// carries on from the same offset. Errors reported by the server, such as a
+// missing file, are not retried. A Get holds a connection until it is closed
+type SFTPStore struct {
+	addr   string
+	dir    string
+	config *ssh.ClientConfig
+	opts   SFTPOptions
+
+	idle  chan *sftpConn // Open connections not in use
+	slots chan struct{}  // One token per open connection, limiting them to MaxConns
+
+	mu         sync.Mutex
+	dirCreated bool
+}
+
+// NewSFTPStore returns an SFTPStore keeping blocks in dir on the SSH server
+// at addr, a host:port pair, connecting with config. A relative dir is
+// relative to the home directory of the user, and is created by the first Put
+func NewSFTPStore(addr string, dir string, config *ssh.ClientConfig, opts SFTPOptions) *SFTPStore {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = 4
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = 500 * time.Millisecond
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return &SFTPStore{
+		addr:   addr,
+		dir:    dir,
+		config: config,
+		opts:   opts,
+		idle:   make(chan *sftpConn, opts.MaxConns),
+		slots:  make(chan struct{}, opts.MaxConns),
+	}
+}
+
+// Close closes the connections of the store that are not in use
+func (s *SFTPStore) Close() error {
+	var errs []error
+	for {
+		select {
+		case c := <-s.idle:
+			errs = append(errs, c.close())
+			<-s.slots
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+func (s *SFTPStore) Put(name string, r io.Reader, size int64) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+
+	// A block read from a seekable source is read again from its start when
+	// retried, one read from anything else only until its first byte is sent
+	start := int64(-1)
+	if seeker, ok := r.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			start = offset
+		}
+	}
+
+	// Write to a temporary file so a failed Put never leaves a partial block
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("error naming temporary file: %w", err)
+	}
+	target := path.Join(s.dir, name)
+	temp := target + "." + hex.EncodeToString(suffix) + ".tmp"
+
+	counter := &countingReader{r: r}
+	return s.retry("put "+name, func(c *sftpConn) error {
+		if counter.n > 0 {
+			if start < 0 {
+				return &sftpSourceError{fmt.Errorf("block %s cannot be read again to retry it", name)}
+			}
+			if _, err := r.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+				return &sftpSourceError{err}
+			}
+			counter.n = 0
+		}
+		if err := s.createDir(c); err != nil {
+			return err
+		}
+		if err := c.writeFile(temp, io.LimitReader(counter, size), size); err != nil {
+			c.remove(temp)
+			return err
+		}
+		if err := c.rename(temp, target); err != nil {
+			c.remove(temp)
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *SFTPStore) Get(name string) (io.ReadCloser, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+	rd := &sftpReader{store: s, path: path.Join(s.dir, name)}
+	err := s.retry("get "+name, func(c *sftpConn) error {
+		handle, err := c.open(rd.path, sftpFlagRead)
+		if err != nil {
+			return err
+		}
+		rd.conn, rd.handle = c, handle
+		return errKeepConn
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (s *SFTPStore) List() ([]string, error) {
+	var names []string
+	err := s.retry("list", func(c *sftpConn) error {
+		entries, err := c.readDir(s.dir)
+		if err != nil {
+			return err
+		}
+		names = names[:0]
+		for _, entry := range entries {
+			if entry.mode&sftpModeType == sftpModeRegular && path.Ext(entry.name) != ".tmp" {
+				names = append(names, entry.name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing store directory: %w", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *SFTPStore) Delete(name string) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	return s.retry("delete "+name, func(c *sftpConn) error {
+		return c.remove(path.Join(s.dir, name))
+	})
+}
+
+// createDir creates the store directory and its missing parents once
+func (s *SFTPStore) createDir(c *sftpConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirCreated {
+		return nil
+	}
+	dir := ""
+	if strings.HasPrefix(s.dir, "/") {
+		dir = "/"
+	}
+	for _, part := range strings.Split(s.dir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		dir = path.Join(dir, part)
+		if _, err := c.stat(dir); err == nil {
+			continue
+		}
+		if err := c.mkdir(dir); err != nil {
+			// Another writer may have created it in the meantime
+			if _, statErr := c.stat(dir); statErr != nil {
+				return fmt.Errorf("error creating store directory: %w", err)
+			}
+		}
+	}
+	s.dirCreated = true
+	return nil
+}
+
+// errKeepConn is returned by an operation of retry that keeps using its
+// connection after it succeeded, so it is neither returned to the pool nor
+// closed
+var errKeepConn = errors.New("connection kept")
+
+// retry runs op on a pooled connection, and again on a new connection after
+// a delay doubling every time while its connection breaks, up to the Retries
+// of the store
+func (s *SFTPStore) retry(name string, op func(c *sftpConn) error) error {
+	delay := s.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		c, err := s.conn()
+		if err == nil {
+			if err = op(c); err == errKeepConn {
+				return nil
+			}
+			s.release(c, err)
+		}
+		if err == nil || connUsable(err) {
+			return err
+		}
+		if attempt >= s.opts.Retries {
+			return fmt.Errorf("sftp %s failed %d times: %w", name, attempt+1, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// connUsable reports whether a connection is still usable after an operation
+// failed with err, because the server reported the failure or the block being
+// put could not be read. Retrying such an operation cannot succeed
+func connUsable(err error) bool {
+	var status *sftpStatusError
+	var source *sftpSourceError
+	return errors.As(err, &status) || errors.As(err, &source)
+}
+
+// conn returns an idle connection, or a new one once fewer than MaxConns are
+// open
+func (s *SFTPStore) conn() (*sftpConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-s.idle:
+		return c, nil
+	case s.slots <- struct{}{}:
+	}
+	c, err := dialSFTP(s.addr, s.config)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// release returns a connection to the pool after an operation, or closes it
+// when the operation broke it
+func (s *SFTPStore) release(c *sftpConn, err error) {
+	if err == nil || connUsable(err) {
+		s.idle <- c
+		return
+	}
+	c.close()
+	<-s.slots
+}
+
+// sftpReader reads a block from an SFTPStore, reopening it on a new
+// connection and carrying on from the same offset when its connection breaks
+type sftpReader struct {
+	store  *SFTPStore
+	path   string
+	conn   *sftpConn
+	handle string
+	offset int64
+	eof    bool
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+	if len(p) > sftpMaxData {
+		p = p[:sftpMaxData]
+	}
+	delay := r.store.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if r.conn == nil {
+			err := r.store.retry("get "+path.Base(r.path), func(c *sftpConn) error {
+				handle, err := c.open(r.path, sftpFlagRead)
+				if err != nil {
+					return err
+				}
+				r.conn, r.handle = c, handle
+				return errKeepConn
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.conn.read(r.handle, r.offset, p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			r.eof = true
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+		if err == nil || connUsable(err) {
+			return n, err
+		}
+		r.conn.close()
+		<-r.store.slots
+		r.conn = nil
+		if attempt >= r.store.opts.Retries {
+			return n, fmt.Errorf("error reading %s: %w", r.path, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (r *sftpReader) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.closeHandle(r.handle)
+	r.store.release(r.conn, err)
+	r.conn = nil
+	return err
+}
+
+// SFTP version 3 packet types, status codes and flags, as used by OpenSSH
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpenDir  = 11
+	sftpReadDir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+	sftpNoAccess   = 3
+
+	sftpFlagRead     = 0x01
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	sftpModeType    = 0170000
+	sftpModeRegular = 0100000
+
+	// sftpMaxData is the most data read or written by one request, which
+	// every server accepts
+	sftpMaxData = 32 << 10
+
+	// sftpWindow is how many writes are sent before waiting for their replies
+	sftpWindow = 16
+
+	// sftpPosixRename is the OpenSSH extension replacing an existing file on
+	// rename, which plain SFTP version 3 refuses
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+// sftpStatusError is a failure reported by the SFTP server
+type sftpStatusError struct {
+	Op      string
+	Path    string
+	Code    uint32
+	Message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp %s %s: %s (status %d)", e.Op, e.Path, e.Message, e.Code)
+}
+
+// sftpSourceError is a failure to read the block an SFTPStore puts
+type sftpSourceError struct {
+	err error
+}
+
+func (e *sftpSourceError) Error() string { return e.err.Error() }
+
+func (e *sftpSourceError) Unwrap() error { return e.err }
+
+func (e *sftpStatusError) Unwrap() error {
+	switch e.Code {
+	case sftpNoSuchFile:
+		return fs.ErrNotExist
+	case sftpNoAccess:
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// sftpConn is an SFTP session over its own SSH connection, sending one
+// request at a time apart from pipelined writes
+type sftpConn struct {
+	client     *ssh.Client
+	session    *ssh.Session
+	w          io.WriteCloser
+	r          *bufio.Reader
+	id         uint32
+	extensions map[string]string
+}
+
+// dialSFTP connects to an SSH server and starts its sftp subsystem
+func dialSFTP(addr string, config *ssh.ClientConfig) (*sftpConn, error) {
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+	}
+	c, err := newSFTPConn(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error starting sftp on %s: %w", addr, err)
+	}
+	return c, nil
+}
+
+func newSFTPConn(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+	c := &sftpConn{client: client, session: session, w: w, r: bufio.NewReaderSize(r, 64<<10)}
+
+	var init sftpPacket
+	init.byte(sftpInit).uint32(3)
+	if err := c.send(init); err != nil {
+		return nil, err
+	}
+	typ, payload, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion || len(payload) < 4 {
+		return nil, fmt.Errorf("unexpected sftp packet %d: %w", typ, ErrCorrupted)
+	}
+	c.extensions = make(map[string]string)
+	rd := sftpReply(payload[4:])
+	for len(rd) > 0 {
+		name, data := rd.string(), rd.string()
+		c.extensions[name] = data
+	}
+	return c, nil
+}
+
+func (c *sftpConn) close() error {
+	c.session.Close()
+	return c.client.Close()
+}
+
+// sftpPacket builds the body of a packet, without its length
+type sftpPacket []byte
+
+func (p *sftpPacket) byte(b byte) *sftpPacket {
+	*p = append(*p, b)
+	return p
+}
+
+func (p *sftpPacket) uint32(v uint32) *sftpPacket {
+	*p = binary.BigEndian.AppendUint32(*p, v)
+	return p
+}
+
+func (p *sftpPacket) uint64(v uint64) *sftpPacket {
+	*p = binary.BigEndian.AppendUint64(*p, v)
+	return p
+}
+
+func (p *sftpPacket) string(s string) *sftpPacket {
+	p.uint32(uint32(len(s)))
+	*p = append(*p, s...)
+	return p
+}
+
+// sftpReply decodes the fields of a reply, yielding zero values once it is
+// exhausted
+type sftpReply []byte
+
+func (r *sftpReply) uint32() uint32 {
+	if len(*r) < 4 {
+		*r = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v
+}
+
+func (r *sftpReply) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+func (r *sftpReply) string() string {
+	n := r.uint32()
+	if uint32(len(*r)) < n {
+		*r = nil
+		return ""
+	}
+	s := string((*r)[:n])
+	*r = (*r)[n:]
+	return s
+}
+
+// attrs decodes file attributes, returning the permission bits and file type
+func (r *sftpReply) attrs() uint32 {
+	flags := r.uint32()
+	var mode uint32
+	if flags&sftpAttrSize != 0 {
+		r.uint64()
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		mode = r.uint32()
+	}
+	if flags&sftpAttrTimes != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	return mode
+}
+
+// request starts a request packet of the type with a new id
+func (c *sftpConn) request(typ byte) (sftpPacket, uint32) {
+	c.id++
+	var p sftpPacket
+	p.byte(typ).uint32(c.id)
+	return p, c.id
+}
+
+func (c *sftpConn) send(p sftpPacket) error {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(p)), uint32(len(p)))
+	_, err := c.w.Write(append(buf, p...))
+	return err
+}
+
+// recv reads the next packet, returning its type and the rest of its body. A
+// connection closed by the server fails with io.ErrUnexpectedEOF, so it is
+// not taken for the end of a file
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("sftp packet of %d bytes: %w", length, ErrCorrupted)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// reply reads the reply to the request with the id, returning its type and
+// the fields after the id. Status replies other than OK are returned as an
+// *sftpStatusError, io.EOF for an EOF status
+func (c *sftpConn) reply(id uint32, op string, name string) (byte, sftpReply, error) {
+	typ, payload, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	rd := sftpReply(payload)
+	if got := rd.uint32(); got != id {
+		return 0, nil, fmt.Errorf("sftp reply to request %d, expected %d: %w", got, id, ErrCorrupted)
+	}
+	if typ == sftpStatus {
+		code := rd.uint32()
+		switch code {
+		case sftpOK:
+		case sftpEOF:
+			return typ, rd, io.EOF
+		default:
+			return typ, rd, &sftpStatusError{Op: op, Path: name, Code: code, Message: rd.string()}
+		}
+	}
+	return typ, rd, nil
+}
+
+// call sends a request on a path and reads its reply, which must be of the
+// type expected
+func (c *sftpConn) call(typ byte, op string, name string, expect byte, fields func(p *sftpPacket)) (sftpReply, error) {
+	p, id := c.request(typ)
+	p.string(name)
+	if fields != nil {
+		fields(&p)
+	}
+	if err := c.send(p); err != nil {
+		return nil, err
+	}
+	got, rd, err := c.reply(id, op, name)
+	if err != nil {
+		return nil, err
+	}
+	if got != expect {
+		return nil, fmt.Errorf("unexpected sftp reply %d to %s %s: %w", got, op, name, ErrCorrupted)
+	}
+	return rd, nil
+}
+
+func (c *sftpConn) open(name string, flags uint32) (string, error) {
+	rd, err := c.call(sftpOpen, "open", name, sftpHandle, func(p *sftpPacket) {
+		p.uint32(flags).uint32(0)
+	})
+	if err != nil {
+		return "", err
+	}
+	return rd.string(), nil
+}
+
+func (c *sftpConn) closeHandle(handle string) error {
+	_, err := c.call(sftpClose, "close", handle, sftpStatus, nil)
+	return err
+}
+
+func (c *sftpConn) stat(name string) (uint32, error) {
+	rd, err := c.call(sftpStat, "stat", name, sftpAttrs, nil)
+	if err != nil {
+		return 0, err
+	}
+	return rd.attrs(), nil
+}
+
+func (c *sftpConn) mkdir(name string) error {
+	_, err := c.call(sftpMkdir, "mkdir", name, sftpStatus, func(p *sftpPacket) {
+		p.uint32(sftpAttrPermissions).uint32(0755)
+	})
+	return err
+}
+
+func (c *sftpConn) remove(name string) error {
+	_, err := c.call(sftpRemove, "remove", name, sftpStatus, nil)
+	return err
+}
+
+// rename moves a file over an existing one, with the posix-rename extension
+// when the server has it, otherwise by removing the existing file first
+func (c *sftpConn) rename(from string, to string) error {
+	if _, ok := c.extensions[sftpPosixRename]; ok {
+		_, err := c.call(sftpExtended, "rename", sftpPosixRename, sftpStatus, func(p *sftpPacket) {
+			p.string(from).string(to)
+		})
+		return err
+	}
+	if err := c.remove(to); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err := c.call(sftpRename, "rename", from, sftpStatus, func(p *sftpPacket) {
+		p.string(to)
+	})
+	return err
+}
+
+// read reads at most len(p) bytes of an open file at the offset, returning
+// io.EOF at its end
+func (c *sftpConn) read(handle string, offset int64, p []byte) (int, error) {
+	rd, err := c.call(sftpRead, "read", handle, sftpData, func(r *sftpPacket) {
+		r.uint64(uint64(offset)).uint32(uint32(len(p)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	data := rd.string()
+	if len(data) > len(p) {
+		return 0, fmt.Errorf("sftp read returned %d bytes for %d: %w", len(data), len(p), ErrCorrupted)
+	}
+	return copy(p, data), nil
+}
+
+// writeFile creates or truncates a file and writes size bytes read from r to
+// it, keeping up to sftpWindow writes in flight so links with a long round
+// trip are not left idle
+func (c *sftpConn) writeFile(name string, r io.Reader, size int64) error {
+	handle, err := c.open(name, sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate)
+	if err != nil {
+		return err
+	}
+
+	pending := make(map[uint32]bool)
+	wait := func() error {
+		typ, payload, err := c.recv()
+		if err != nil {
+			return err
+		}
+		rd := sftpReply(payload)
+		id := rd.uint32()
+		if typ != sftpStatus || !pending[id] {
+			return fmt.Errorf("unexpected sftp reply %d to a write of %s: %w", typ, name, ErrCorrupted)
+		}
+		delete(pending, id)
+		if code := rd.uint32(); code != sftpOK {
+			return &sftpStatusError{Op: "write", Path: name, Code: code, Message: rd.string()}
+		}
+		return nil
+	}
+
+	buf := make([]byte, sftpMaxData)
+	var offset int64
+	var writeErr error
+	for offset < size {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), size-offset)])
+		if err != nil {
+			writeErr = &sftpSourceError{fmt.Errorf("error reading block: %w", err)}
+			break
+		}
+		p, id := c.request(sftpWrite)
+		p.string(handle).uint64(uint64(offset)).string(string(buf[:n]))
+		if err := c.send(p); err != nil {
+			return err
+		}
+		pending[id] = true
+		offset += int64(n)
+		if len(pending) >= sftpWindow {
+			if err := wait(); err != nil {
+				return err
+			}
+		}
+	}
+	for len(pending) > 0 {
+		if err := wait(); err != nil {
+			return err
+		}
+	}
+	if err := c.closeHandle(handle); err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// sftpEntry is a directory entry read by readDir
+type sftpEntry struct {
+	name string
+	mode uint32
+}
+
+func (c *sftpConn) readDir(dir string) ([]sftpEntry, error) {
+	rd, err := c.call(sftpOpenDir, "opendir", dir, sftpHandle, nil)
+	if err != nil {
+		return nil, err
+	}
+	handle := rd.string()
+
+	var entries []sftpEntry
+	for {
+		rd, err := c.call(sftpReadDir, "readdir", handle, sftpName, nil)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for n := rd.uint32(); n > 0; n-- {
+			name := rd.string()
+			rd.string() // Long name, as ls -l shows it
+			mode := rd.attrs()
+			if name != "." && name != ".." {
+				entries = append(entries, sftpEntry{name: name, mode: mode})
+			}
+		}
+	}
+	return entries, c.closeHandle(handle)
+}
@@ -0,0 +1,450 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpTestServer is an SSH server serving the sftp subsystem from a local
+// directory, with the requests SFTPStore sends and nothing more
+type sftpTestServer struct {
+	t        *testing.T
+	root     string
+	addr     string
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	noRename bool // Leaves out the posix-rename extension
+
+	mu        sync.Mutex
+	interrupt func(typ byte) bool // Drops the connection before a request it returns true for
+}
+
+// newSFTPTestServer starts a server on a local port, closed when the test ends
+func newSFTPTestServer(t *testing.T) *sftpTestServer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sftpTestServer{t: t, root: t.TempDir(), addr: listener.Addr().String(), config: config, hostKey: signer.PublicKey()}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveConn(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// store returns an SFTPStore on the server keeping blocks in dir
+func (s *sftpTestServer) store(t *testing.T, dir string) *SFTPStore {
+	config := &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.FixedHostKey(s.hostKey)}
+	store := NewSFTPStore(s.addr, dir, config, SFTPOptions{MaxConns: 2, RetryDelay: time.Millisecond})
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// interruptAfter drops the connection before the request following the n
+// requests of the type, once
+func (s *sftpTestServer) interruptAfter(typ byte, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interrupt = func(got byte) bool {
+		if got != typ {
+			return false
+		}
+		if n--; n >= 0 {
+			return false
+		}
+		s.interrupt = nil
+		return true
+	}
+}
+
+// checkInterrupted fails the test when the connection set to be interrupted
+// was not
+func (s *sftpTestServer) checkInterrupted(t *testing.T) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.interrupt != nil {
+		t.Error("the connection was not interrupted")
+	}
+}
+
+func (s *sftpTestServer) interrupted(typ byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interrupt != nil && s.interrupt(typ)
+}
+
+func (s *sftpTestServer) serveConn(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session channels only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						s.serveSFTP(channel)
+						// Closing the connection rather than the channel is
+						// what a broken link looks like to the client
+						serverConn.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// local returns the path of the server directory a client path stands for
+func (s *sftpTestServer) local(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(strings.TrimPrefix(name, "/")))
+}
+
+// serveSFTP answers requests until the client goes away or the connection is
+// interrupted
+func (s *sftpTestServer) serveSFTP(rw io.ReadWriter) {
+	r := bufio.NewReader(rw)
+	files := make(map[string]*os.File)
+	dirs := make(map[string][]fs.DirEntry)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	send := func(p sftpPacket) {
+		buf := binary.BigEndian.AppendUint32(nil, uint32(len(p)))
+		rw.Write(append(buf, p...))
+	}
+	status := func(id uint32, err error) {
+		var p sftpPacket
+		code := uint32(sftpOK)
+		switch {
+		case errors.Is(err, io.EOF):
+			code = sftpEOF
+		case errors.Is(err, fs.ErrNotExist):
+			code = sftpNoSuchFile
+		case err != nil:
+			code = 4 // Failure
+		}
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		p.byte(sftpStatus).uint32(id).uint32(code).string(message).string("")
+		send(p)
+	}
+	attrs := func(p *sftpPacket, info fs.FileInfo) {
+		mode := uint32(info.Mode().Perm())
+		if info.IsDir() {
+			mode |= 0040000
+		} else if info.Mode().IsRegular() {
+			mode |= sftpModeRegular
+		}
+		p.uint32(sftpAttrSize | sftpAttrPermissions).uint64(uint64(info.Size())).uint32(mode)
+	}
+	handles := 0
+
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		typ, rd := header[4], sftpReply(payload)
+		if typ == sftpInit {
+			var p sftpPacket
+			p.byte(sftpVersion).uint32(3)
+			if !s.noRename {
+				p.string(sftpPosixRename).string("1")
+			}
+			send(p)
+			continue
+		}
+		if s.interrupted(typ) {
+			return
+		}
+
+		id := rd.uint32()
+		switch typ {
+		case sftpOpen:
+			name, flags := rd.string(), rd.uint32()
+			mode := os.O_RDONLY
+			if flags&sftpFlagWrite != 0 {
+				mode = os.O_WRONLY
+			}
+			if flags&sftpFlagCreate != 0 {
+				mode |= os.O_CREATE
+			}
+			if flags&sftpFlagTruncate != 0 {
+				mode |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(s.local(name), mode, 0644)
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			handles++
+			handle := strconv.Itoa(handles)
+			files[handle] = f
+			var p sftpPacket
+			p.byte(sftpHandle).uint32(id).string(handle)
+			send(p)
+		case sftpClose:
+			handle := rd.string()
+			if f, ok := files[handle]; ok {
+				delete(files, handle)
+				status(id, f.Close())
+			} else {
+				delete(dirs, handle)
+				status(id, nil)
+			}
+		case sftpRead:
+			f, offset, length := files[rd.string()], rd.uint64(), rd.uint32()
+			buf := make([]byte, length)
+			n, err := f.ReadAt(buf, int64(offset))
+			if n == 0 {
+				status(id, err)
+				continue
+			}
+			var p sftpPacket
+			p.byte(sftpData).uint32(id).string(string(buf[:n]))
+			send(p)
+		case sftpWrite:
+			f, offset, data := files[rd.string()], rd.uint64(), rd.string()
+			_, err := f.WriteAt([]byte(data), int64(offset))
+			status(id, err)
+		case sftpOpenDir:
+			entries, err := os.ReadDir(s.local(rd.string()))
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			handles++
+			handle := strconv.Itoa(handles)
+			dirs[handle] = entries
+			var p sftpPacket
+			p.byte(sftpHandle).uint32(id).string(handle)
+			send(p)
+		case sftpReadDir:
+			handle := rd.string()
+			entries := dirs[handle]
+			if len(entries) == 0 {
+				status(id, io.EOF)
+				continue
+			}
+			dirs[handle] = nil
+			var p sftpPacket
+			p.byte(sftpName).uint32(id).uint32(uint32(len(entries)))
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					s.t.Error(err)
+					return
+				}
+				p.string(entry.Name()).string(entry.Name())
+				attrs(&p, info)
+			}
+			send(p)
+		case sftpRemove:
+			status(id, os.Remove(s.local(rd.string())))
+		case sftpMkdir:
+			status(id, os.Mkdir(s.local(rd.string()), 0755))
+		case sftpStat:
+			info, err := os.Stat(s.local(rd.string()))
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			var p sftpPacket
+			p.byte(sftpAttrs).uint32(id)
+			attrs(&p, info)
+			send(p)
+		case sftpRename:
+			// Plain SFTP version 3 refuses to replace a file
+			from, to := s.local(rd.string()), s.local(rd.string())
+			if _, err := os.Stat(to); err == nil {
+				status(id, fs.ErrExist)
+				continue
+			}
+			status(id, os.Rename(from, to))
+		case sftpExtended:
+			if rd.string() != sftpPosixRename || s.noRename {
+				status(id, errors.ErrUnsupported)
+				continue
+			}
+			status(id, os.Rename(s.local(rd.string()), s.local(rd.string())))
+		default:
+			status(id, errors.ErrUnsupported)
+		}
+	}
+}
+
+func TestSFTPStore(t *testing.T) {
+	for _, noRename := range []bool{false, true} {
+		name := "posix-rename"
+		if noRename {
+			name = "rename"
+		}
+		t.Run(name, func(t *testing.T) {
+			server := newSFTPTestServer(t)
+			server.noRename = noRename
+			store := server.store(t, "backups/host1")
+
+			blocks := map[string][]byte{
+				"block-1.beam": testVectorData("block-1", 3*sftpWindow*sftpMaxData+100),
+				"block-2.beam": []byte("small block"),
+				"empty.beam":   nil,
+			}
+			for name, data := range blocks {
+				if err := store.Put(name, bytes.NewReader(data), int64(len(data))); err != nil {
+					t.Fatalf("put %s: %v", name, err)
+				}
+			}
+			// A block put again replaces the one stored
+			blocks["block-2.beam"] = []byte("replaced")
+			if err := store.Put("block-2.beam", bytes.NewReader(blocks["block-2.beam"]), 8); err != nil {
+				t.Fatal(err)
+			}
+
+			names, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(names, ",") != "block-1.beam,block-2.beam,empty.beam" {
+				t.Errorf("listed %q", names)
+			}
+			for name, data := range blocks {
+				got := getBlock(t, store, name)
+				if !bytes.Equal(got, data) {
+					t.Errorf("got %d bytes of %s, want %d", len(got), name, len(data))
+				}
+			}
+
+			if err := store.Delete("block-2.beam"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get("block-2.beam"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("get of a deleted block returned %v, want fs.ErrNotExist", err)
+			}
+			if err := store.Delete("block-2.beam"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("delete of a deleted block returned %v, want fs.ErrNotExist", err)
+			}
+			if names, err := store.List(); err != nil || len(names) != 2 {
+				t.Errorf("listed %q, %v after delete", names, err)
+			}
+		})
+	}
+}
+
+func TestSFTPStoreInterruptedUpload(t *testing.T) {
+	server := newSFTPTestServer(t)
+	store := server.store(t, "blocks")
+	data := testVectorData("interrupted", 4*sftpWindow*sftpMaxData)
+
+	// A seekable block is read again from its start on a new connection
+	server.interruptAfter(sftpWrite, sftpWindow+3)
+	if err := store.Put("block-1.beam", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got := getBlock(t, store, "block-1.beam"); !bytes.Equal(got, data) {
+		t.Error("block put over an interrupted connection differs")
+	}
+	server.checkInterrupted(t)
+
+	// Anything else cannot be sent again once read
+	server.interruptAfter(sftpWrite, sftpWindow+3)
+	err := store.Put("block-2.beam", io.MultiReader(bytes.NewReader(data)), int64(len(data)))
+	if err == nil || !strings.Contains(err.Error(), "cannot be read again") {
+		t.Fatalf("put of an unseekable block returned %v", err)
+	}
+	server.checkInterrupted(t)
+	names, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "block-1.beam" {
+		t.Errorf("listed %q, a failed put must not leave a block behind", names)
+	}
+
+	// A read carries on from the same offset on a new connection
+	server.interruptAfter(sftpRead, 5)
+	if got := getBlock(t, store, "block-1.beam"); !bytes.Equal(got, data) {
+		t.Error("block read over an interrupted connection differs")
+	}
+	server.checkInterrupted(t)
+}
+
+// getBlock returns the contents of a block in the store
+func getBlock(t *testing.T, store BlockStore, name string) []byte {
+	t.Helper()
+	rc, err := store.Get(name)
+	if err != nil {
+		t.Fatalf("get %s: %v", name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %s: %v", name, err)
+	}
+	return data
+}
@@ -0,0 +1,191 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// signatureFileName is the name of the detached signature next to the blocks
+// of an archive
+const signatureFileName = "archive.sig"
+
+// signatureVersion starts the signed statement, so statements of a later
+// layout can never be mistaken for this one
+const signatureVersion = "beam signature v1\n"
+
+var (
+	// ErrSignatureMissing is returned when an archive that must be signed
+	// has no signature
+	ErrSignatureMissing = errors.New("archive not signed")
+
+	// ErrSignatureInvalid is returned when the signature of an archive was
+	// not made by the key given or the archive changed since it was signed
+	ErrSignatureInvalid = errors.New("signature invalid")
+)
+
+// signedStatement describes an archive for signing: the name and footer
+// checksum of every block, then the SHA-256 checksum of the manifest and of
+// every snapshot manifest. The checksums of the blocks cover their contents,
+// so signing this much vouches for the whole archive without reading it
+func signedStatement(archiveDir string) ([]byte, error) {
+	blockPaths, err := listBlocks(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(blockPaths) == 0 {
+		return nil, fmt.Errorf("%w to sign in %s", ErrNoFiles, archiveDir)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(signatureVersion)
+	for _, blockPath := range blockPaths {
+		checksum, err := blockChecksum(blockPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading block %s: %w", filepath.Base(blockPath), err)
+		}
+		fmt.Fprintf(&b, "block %s %x\n", filepath.Base(blockPath), checksum)
+	}
+
+	manifests := []string{manifestFileName}
+	generations, err := listGenerations(archiveDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, generation := range generations {
+		manifests = append(manifests, snapshotDir+"/"+filepath.Base(snapshotPath(archiveDir, generation)))
+	}
+	for _, name := range manifests {
+		checksum, err := fileChecksum(filepath.Join(archiveDir, filepath.FromSlash(name)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		fmt.Fprintf(&b, "manifest %s %x\n", name, checksum)
+	}
+	return b.Bytes(), nil
+}
+
+// blockChecksum returns the checksum in the footer of a block file
+func blockChecksum(blockPath string) ([]byte, error) {
+	f, err := openBlockFile(blockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	footer, err := readBlockFooter(f, f.Size())
+	if err != nil {
+		return nil, err
+	}
+	return footer.Checksum, nil
+}
+
+// fileChecksum returns the SHA-256 checksum of a whole file
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := newChecksum()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (p defaultPacker) Sign(archiveDir string, key ed25519.PrivateKey) error {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid Ed25519 private key of %d bytes: %w", len(key), ErrInvalidOption)
+	}
+	statement, err := signedStatement(archiveDir)
+	if err != nil {
+		return err
+	}
+	signature := ed25519.Sign(key, statement)
+
+	path := filepath.Join(archiveDir, signatureFileName)
+	f, err := createArchiveTemp(archiveDir, signatureFileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating signature: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "%x\n", signature); err != nil {
+		return fmt.Errorf("error writing signature: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing signature: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (p defaultPacker) VerifySignature(archiveDir string, key ed25519.PublicKey) error {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid Ed25519 public key of %d bytes: %w", len(key), ErrInvalidOption)
+	}
+	data, err := os.ReadFile(filepath.Join(archiveDir, signatureFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: no %s in %s", ErrSignatureMissing, signatureFileName, archiveDir)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading signature: %w", err)
+	}
+	signature, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed %s", ErrSignatureInvalid, signatureFileName)
+	}
+
+	statement, err := signedStatement(archiveDir)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, statement, signature) {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// resign signs an archive again with SigningKey once its manifests changed,
+// it does nothing without a key
+func (p defaultPacker) resign(archiveDir string) error {
+	if p.opts.SigningKey == nil {
+		return nil
+	}
+	if err := p.Sign(archiveDir, p.opts.SigningKey); err != nil {
+		return fmt.Errorf("error signing archive: %w", err)
+	}
+	return nil
+}
+
+// checkSignature verifies the signature of an archive against TrustedKey, it
+// does nothing without a key
+func (p defaultPacker) checkSignature(archiveDir string) error {
+	if p.opts.TrustedKey == nil {
+		return nil
+	}
+	if err := p.VerifySignature(archiveDir, p.opts.TrustedKey); err != nil {
+		return fmt.Errorf("error verifying signature: %w", err)
+	}
+	return nil
+}
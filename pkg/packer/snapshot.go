@@ -0,0 +1,464 @@
+package packer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotDir is the directory of an archive holding one manifest per snapshot
+const snapshotDir = "snapshots"
+
+// SnapshotInfo summarizes a snapshot of an archive
+type SnapshotInfo struct {
+	Generation int       // Number of the snapshot, counting up from 1
+	Created    time.Time // When the snapshot was taken
+	Expires    time.Time // When the snapshot expires and Prune deletes it, zero when it never does
+	Source     string    // Directory the snapshot was taken of
+	Files      int       // Number of files in the snapshot
+	Size       int64     // Combined size of the files
+	Blocks     int       // Number of blocks holding the contents of the files
+	NewBlocks  int       // Blocks written by this snapshot, the others are shared with earlier ones
+}
+
+// GCResult reports the blocks removed by GC
+type GCResult struct {
+	Removed        []string // File names of the removed blocks
+	ReclaimedBytes int64    // Combined size of the removed blocks
+}
+
+// snapshotPath returns the path of the manifest of a snapshot generation
+func snapshotPath(archiveDir string, generation int) string {
+	return filepath.Join(archiveDir, snapshotDir, fmt.Sprintf("snapshot-%06d.json", generation))
+}
+
+// listGenerations returns the generations of the snapshots in an archive in
+// ascending order
+func listGenerations(archiveDir string) ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(archiveDir, snapshotDir))
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshots: %w", err)
+	}
+	var generations []int
+	for _, entry := range entries {
+		var generation int
+		if _, err := fmt.Sscanf(entry.Name(), "snapshot-%d.json", &generation); err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// readSnapshot reads the manifest of a snapshot generation, 0 reads the latest
+func readSnapshot(archiveDir string, generation int) (*Manifest, error) {
+	if generation < 0 {
+		return nil, fmt.Errorf("invalid snapshot generation %d: %w", generation, ErrInvalidOption)
+	}
+	if generation == 0 {
+		generations, err := listGenerations(archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(generations) == 0 {
+			return nil, fmt.Errorf("no snapshots in %s: %w", archiveDir, fs.ErrNotExist)
+		}
+		generation = generations[len(generations)-1]
+	}
+
+	f, err := os.Open(snapshotPath(archiveDir, generation))
+	if err != nil {
+		return nil, fmt.Errorf("error opening snapshot %d: %w", generation, err)
+	}
+	defer f.Close()
+	m, err := readManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot %d: %w", generation, err)
+	}
+	return m, nil
+}
+
+// Snapshot packs the input directory as a new snapshot generation of the
+// archive. Files whose contents are already stored in a block of the archive
+// reference that block instead of being packed again, so only new or changed
+// contents are written to new blocks
+func (p defaultPacker) Snapshot(inputDir string, archiveDir string) (info *SnapshotInfo, err error) {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	p.checkChanges = true
+	if p.opts.Format != FormatBeam {
+		return nil, fmt.Errorf("snapshots are only written as .beam blocks: %w", ErrInvalidOption)
+	}
+	if p.opts.ParityBlocks > 0 {
+		return nil, fmt.Errorf("parity blocks cannot protect blocks shared between snapshots: %w", ErrInvalidOption)
+	}
+	if p.encryptsMetadata() {
+		return nil, fmt.Errorf("snapshot manifests would list every path in the clear, they cannot be used with MetadataKey or Passphrase: %w", ErrInvalidOption)
+	}
+	p.failures = p.newFailureLog()
+	defer func() { err = p.failures.result("snapshot", err) }()
+
+	frozen, err := p.freezeSource(inputDir)
+	if err != nil {
+		return nil, err
+	}
+	defer frozen.close(p.logger())
+	p.frozen = frozen
+	fileInfos, err := p.planFiles(inputDir)
+	if err != nil {
+		return nil, err
+	}
+	p.opts.BlockSize = p.blockSizeFor(fileSizes(fileInfos))
+	if err := os.MkdirAll(filepath.Join(archiveDir, snapshotDir), 0755); err != nil {
+		return nil, fmt.Errorf("error creating snapshot directory: %w", err)
+	}
+	generations, err := listGenerations(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if p.dictionary, err = p.archiveDictionary(archiveDir, fileInfos, p.sourceOpener()); err != nil {
+		return nil, err
+	}
+
+	// Index the contents already stored in the archive by checksum
+	stored, err := p.buildManifest(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error indexing archive: %w", err)
+	}
+	blocks := make(map[int32]ManifestBlock, len(stored.Blocks))
+	nextID := int32(1)
+	for _, block := range stored.Blocks {
+		blocks[block.ID] = block
+		if block.ID >= nextID {
+			nextID = block.ID + 1
+		}
+	}
+	contents := make(map[string]*ManifestFile, len(stored.Files))
+	for i := range stored.Files {
+		if !stored.Files[i].Deleted {
+			contents[stored.Files[i].Checksum] = &stored.Files[i]
+		}
+	}
+
+	snapshot := &Manifest{Version: manifestVersion, Source: inputDir}
+	if len(generations) > 0 {
+		snapshot.Generation = generations[len(generations)-1] + 1
+	} else {
+		snapshot.Generation = 1
+	}
+	created := time.Now().UTC()
+	snapshot.Created = &created
+	if p.opts.ExpiresAfter > 0 {
+		expires := created.Add(p.opts.ExpiresAfter)
+		snapshot.Expires = &expires
+		// The expiry is the snapshot's, not the archive's
+		p.opts.ExpiresAfter = 0
+	}
+
+	p.progress.start("pack", len(fileInfos), totalBytes(fileInfos))
+	defer func() { p.progress.finish(err) }()
+
+	// reuse records a file whose contents are already stored, with the metadata
+	// of the file found on disk
+	referenced := make(map[int32]bool)
+	reuse := func(file *FileInfo, checksum []byte, stored *ManifestFile) error {
+		scratch := &Block{ID: stored.BlockID}
+		if err := p.addFileToBlock(scratch, file); err != nil {
+			return p.failures.skip(file.Path, err)
+		}
+		metadata := &scratch.Files[0]
+		metadata.Checksum = checksum
+		metadata.ZeroRuns = stored.ZeroRuns
+		metadata.Compression = stored.Compression
+		metadata.CompressedSize = stored.CompressedSize
+		snapshot.Files = append(snapshot.Files, manifestFile(metadata, stored.Offset))
+		referenced[stored.BlockID] = true
+		p.progress.file(metadata, true)
+		return nil
+	}
+
+	// Files repeating the contents of a file packed by this snapshot are
+	// recorded once that file has been written
+	var newFiles []FileInfo
+	type duplicate struct {
+		file     *FileInfo
+		checksum []byte
+	}
+	var duplicates []duplicate
+	pending := make(map[string]bool)
+	for i := range fileInfos {
+		file := &fileInfos[i]
+		checksum, err := p.validator.CalculateFileChecksum(file.Path)
+		if err != nil {
+			if err := p.failures.skip(file.Path, fmt.Errorf("error hashing file: %w", err)); err != nil {
+				return nil, fmt.Errorf("error hashing file %s: %w", file.Path, err)
+			}
+			continue
+		}
+		key := hex.EncodeToString(checksum)
+		if existing, ok := contents[key]; ok && existing.Size == file.Size {
+			if err := reuse(file, checksum, existing); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if pending[key] {
+			duplicates = append(duplicates, duplicate{file, checksum})
+			continue
+		}
+		pending[key] = true
+		newFiles = append(newFiles, *file)
+	}
+
+	var newBlocks int
+	err = p.packFiles(newFiles, nextID, func(block *Block) error {
+		if err := p.writeBlock(block, archiveDir, p.sourceOpener()); err != nil {
+			return fmt.Errorf("error writing block: %w", err)
+		}
+		size, err := blockFileSize(filepath.Join(archiveDir, block.fileName))
+		if err != nil {
+			return err
+		}
+		block.DataOffset = blockHeaderSize
+		snapshot.addBlock(block, block.fileName, size)
+		newBlocks++
+		p.progress.blockWritten(block, p.opts.BlockSize)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	packed := make(map[string]ManifestFile, len(snapshot.Files))
+	for _, file := range snapshot.Files {
+		packed[file.Checksum] = file
+	}
+	for _, dup := range duplicates {
+		file, ok := packed[hex.EncodeToString(dup.checksum)]
+		if !ok || file.Size != dup.file.Size {
+			// The file with these contents changed or failed while it was packed
+			if err := p.failures.skip(dup.file.Path, fmt.Errorf("contents changed while packing")); err != nil {
+				return nil, fmt.Errorf("error packing file %s: %w", dup.file.Path, err)
+			}
+			continue
+		}
+		if err := reuse(dup.file, dup.checksum, &file); err != nil {
+			return nil, err
+		}
+	}
+	// Blocks written by this snapshot are already listed
+	for id := range referenced {
+		if block, ok := blocks[id]; ok {
+			snapshot.Blocks = append(snapshot.Blocks, block)
+		}
+	}
+	snapshot.sort()
+
+	if err := writeManifestFile(snapshotPath(archiveDir, snapshot.Generation), snapshot); err != nil {
+		return nil, fmt.Errorf("error writing snapshot: %w", err)
+	}
+	if err := p.writeManifest(archiveDir); err != nil {
+		return nil, err
+	}
+
+	info = snapshot.info()
+	info.NewBlocks = newBlocks
+	p.logger().Info("Snapshot written", "generation", info.Generation, "files", info.Files, "blocks", info.Blocks, "new_blocks", newBlocks)
+	return info, nil
+}
+
+// info summarizes a snapshot manifest
+func (m *Manifest) info() *SnapshotInfo {
+	info := &SnapshotInfo{
+		Generation: m.Generation,
+		Source:     m.Source,
+		Files:      len(m.Files),
+		Blocks:     len(m.Blocks),
+	}
+	if m.Created != nil {
+		info.Created = *m.Created
+	}
+	if m.Expires != nil {
+		info.Expires = *m.Expires
+	}
+	for _, file := range m.Files {
+		info.Size += file.Size
+	}
+	return info
+}
+
+// Snapshots lists the snapshots of an archive, oldest first
+func (p defaultPacker) Snapshots(archiveDir string) ([]SnapshotInfo, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	generations, err := listGenerations(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]SnapshotInfo, 0, len(generations))
+	for _, generation := range generations {
+		m, err := readSnapshot(archiveDir, generation)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, *m.info())
+	}
+	return snapshots, nil
+}
+
+// RestoreSnapshot extracts the files of a snapshot generation, 0 restores the
+// latest one. Each file is read directly from the block holding its contents
+// and verified against its checksum as it is written
+func (p defaultPacker) RestoreSnapshot(archiveDir string, generation int, outputDir string, patterns ...string) error {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	if err := p.checkUnpackScan("snapshots"); err != nil {
+		return err
+	}
+	if p.opts.AtomicUnpack {
+		return p.unpackAtomically(outputDir, func(p defaultPacker, dir string) error {
+			return p.RestoreSnapshot(archiveDir, generation, dir, patterns...)
+		})
+	}
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkOverwritePolicy(); err != nil {
+		return err
+	}
+	p.failures = p.newFailureLog()
+
+	m, err := readSnapshot(archiveDir, generation)
+	if err != nil {
+		return err
+	}
+	if _, err := loadDictionaries(archiveDir); err != nil {
+		return err
+	}
+	files, blockNames, err := m.locate(patterns)
+	if err != nil {
+		return err
+	}
+
+	// Blocks are opened as files need them and stay open until the end
+	opened := make(map[int32]*blockFile)
+	defer func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}()
+	return p.extractIndexed(files, outputDir, func(metadata *FileMetadata) error {
+		f, ok := opened[metadata.BlockID]
+		if !ok {
+			var err error
+			f, err = openBlockFile(filepath.Join(archiveDir, blockNames[metadata.BlockID]))
+			if err != nil {
+				return fmt.Errorf("error opening block: %w", err)
+			}
+			opened[metadata.BlockID] = f
+		}
+		return p.extractFile(contentSection(f, metadata.Offset, metadata), outputDir, metadata, nil)
+	})
+}
+
+// ForgetSnapshot deletes the manifest of a snapshot generation. Its blocks
+// stay in the archive until GC removes the ones no other snapshot references
+func (p defaultPacker) ForgetSnapshot(archiveDir string, generation int) error {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if generation <= 0 {
+		return fmt.Errorf("invalid snapshot generation %d: %w", generation, ErrInvalidOption)
+	}
+	if err := os.Remove(snapshotPath(archiveDir, generation)); err != nil {
+		return fmt.Errorf("error deleting snapshot %d: %w", generation, err)
+	}
+	return nil
+}
+
+// GC removes the blocks of an archive that no snapshot references any more
+// and rebuilds the manifest. With DryRun it returns the blocks it would
+// remove and leaves the archive as it is
+func (p defaultPacker) GC(archiveDir string) (*GCResult, error) {
+	unlock, err := p.lockArchive(archiveDir, !p.opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if refs == nil {
+		return nil, fmt.Errorf("%s has no snapshots: %w", archiveDir, ErrInvalidOption)
+	}
+	unreferenced, err := p.unreferencedBlocks(archiveDir, refs)
+	if err != nil {
+		return nil, err
+	}
+	result := &GCResult{}
+	for _, block := range unreferenced {
+		if !p.opts.DryRun {
+			if err := removeBlock(filepath.Join(archiveDir, block.Name)); err != nil {
+				return nil, fmt.Errorf("error removing block %s: %w", block.Name, err)
+			}
+		}
+		result.Removed = append(result.Removed, block.Name)
+		result.ReclaimedBytes += block.Size
+	}
+	if p.opts.DryRun {
+		return result, nil
+	}
+	if err := p.writeManifest(archiveDir); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// unreferencedBlocks returns the blocks of an archive that none of the given
+// snapshots references
+func (p defaultPacker) unreferencedBlocks(archiveDir string, refs []referencingManifest) ([]ManifestBlock, error) {
+	referenced := make(map[int32]bool)
+	for _, ref := range refs {
+		for _, file := range ref.manifest.Files {
+			referenced[file.BlockID] = true
+		}
+	}
+
+	index, err := p.buildManifest(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("error indexing archive: %w", err)
+	}
+	var unreferenced []ManifestBlock
+	for _, block := range index.Blocks {
+		if !referenced[block.ID] {
+			unreferenced = append(unreferenced, block)
+		}
+	}
+	return unreferenced, nil
+}
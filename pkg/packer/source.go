@@ -0,0 +1,139 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// unknownSize marks a file whose size is only known once it has been read
+const unknownSize = -1
+
+// Source is a file packed from a reader instead of from disk, such as a pipe
+// or a socket. Sources of unknown size are read until they end
+type Source struct {
+	Path    string    // Path recorded in the archive
+	Reader  io.Reader // Contents of the file
+	Size    int64     // Size of the contents, or -1 if unknown
+	ModTime time.Time // Modification time recorded in the archive, defaults to the time of packing
+	Mode    uint32    // File permissions recorded in the archive, defaults to 0644
+}
+
+func (p defaultPacker) PackSources(sources []Source, outputDir string) (err error) {
+	unlock, err := p.lockArchive(outputDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	p.failures = p.newFailureLog()
+	defer func() { err = p.failures.result("pack", err) }()
+
+	if len(sources) == 0 {
+		return fmt.Errorf("%w, no sources to pack", ErrNoFiles)
+	}
+	if err := p.checkFormat(); err != nil {
+		return err
+	}
+
+	sizes := make([]int64, len(sources))
+	for i, source := range sources {
+		sizes[i] = source.Size
+	}
+	p.opts.BlockSize = p.blockSizeFor(sizes)
+
+	// Sources may depend on each other, such as pipes fed by one process, so
+	// they are read in order
+	p.opts.ReadWorkers = 0
+
+	// Validate sources
+	readers := make(map[string]io.Reader, len(sources))
+	var totalSize int64
+	for _, source := range sources {
+		if source.Path == "" || source.Reader == nil {
+			return fmt.Errorf("source needs a path and a reader: %w", ErrInvalidOption)
+		}
+		for _, segment := range splitPath(source.Path) {
+			if segment == ".." {
+				return fmt.Errorf("source path %s points outside the archive: %w", source.Path, ErrPathUnsafe)
+			}
+		}
+		if _, ok := readers[source.Path]; ok {
+			return fmt.Errorf("duplicate source path %s: %w", source.Path, ErrInvalidOption)
+		}
+		if source.Size < unknownSize {
+			return fmt.Errorf("invalid size %d for source %s: %w", source.Size, source.Path, ErrInvalidOption)
+		}
+		if source.Size > p.opts.BlockSize {
+			return fmt.Errorf("source %s of %d bytes: %w", source.Path, source.Size, ErrFileTooLarge)
+		}
+		readers[source.Path] = source.Reader
+		if source.Size > 0 {
+			totalSize += source.Size
+		}
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	p.progress.start("pack", len(sources), totalSize)
+	defer func() { p.progress.finish(err) }()
+
+	open := func(metadata *FileMetadata) (io.ReadCloser, error) {
+		return io.NopCloser(readers[metadata.Path]), nil
+	}
+	emit := func(block *Block) error {
+		if err := p.writeBlock(block, outputDir, open); err != nil {
+			return fmt.Errorf("error writing block: %w", err)
+		}
+		p.progress.blockWritten(block, p.opts.BlockSize)
+		return nil
+	}
+
+	now := time.Now()
+
+	// Sources are packed in order. A source of unknown size could fill a whole
+	// block, so it is given a block of its own
+	block := &Block{ID: 1}
+	for _, source := range sources {
+		full := block.Size+source.Size > p.opts.BlockSize
+		if len(block.Files) > 0 && (full || source.Size == unknownSize) {
+			if err := emit(block); err != nil {
+				return err
+			}
+			block = &Block{ID: block.ID + 1}
+		}
+
+		mode, modTime := source.Mode, source.ModTime
+		if mode == 0 {
+			mode = 0644
+		}
+		if modTime.IsZero() {
+			modTime = now
+		}
+		block.Files = append(block.Files, FileMetadata{
+			Path:    source.Path,
+			Size:    source.Size,
+			ModTime: modTime,
+			Mode:    mode,
+			BlockID: block.ID,
+		})
+		if source.Size == unknownSize {
+			if err := emit(block); err != nil {
+				return err
+			}
+			block = &Block{ID: block.ID + 1}
+		} else {
+			block.Size += source.Size
+		}
+	}
+
+	if len(block.Files) > 0 {
+		if err := emit(block); err != nil {
+			return err
+		}
+	}
+	return p.writeManifest(outputDir)
+}
@@ -0,0 +1,129 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// SourceRead selects how the contents of source files are read when packing
+type SourceRead int
+
+const (
+	SourceReadBuffered   SourceRead = iota // Plain reads through the page cache, the default
+	SourceReadSequential                   // Tell the kernel files are read once front to back, so it reads further ahead (Linux)
+	SourceReadDirect                       // O_DIRECT reads into aligned buffers that bypass the page cache (Linux), for fast NVMe arrays
+)
+
+// Files smaller than directReadMinSize are read with SourceReadSequential
+// instead of O_DIRECT, which only pays off for large reads. Direct reads go
+// through buffers of directReadBufferSize bytes aligned to directReadAlign
+const (
+	directReadMinSize    = 1024 * 1024
+	directReadBufferSize = 1024 * 1024
+	directReadAlign      = 4096
+)
+
+// checkSourceRead rejects read modes this version does not know
+func (p defaultPacker) checkSourceRead() error {
+	switch p.opts.SourceRead {
+	case SourceReadBuffered, SourceReadSequential, SourceReadDirect:
+		return nil
+	}
+	return fmt.Errorf("unknown source read mode %d: %w", p.opts.SourceRead, ErrInvalidOption)
+}
+
+// sourceOpener returns the opener of source files for the SourceRead mode.
+// Special files recorded with SpecialFileRecord are empty
+func (p defaultPacker) sourceOpener() contentOpener {
+	switch p.opts.SourceRead {
+	case SourceReadSequential:
+		return specialOpener(func(metadata *FileMetadata) (io.ReadCloser, error) {
+			return openSequential(metadata.source())
+		})
+	case SourceReadDirect:
+		return specialOpener(func(metadata *FileMetadata) (io.ReadCloser, error) {
+			if metadata.Size < directReadMinSize {
+				return openSequential(metadata.source())
+			}
+			return openDirect(metadata.source())
+		})
+	}
+	return specialOpener(openSourceFile)
+}
+
+// directBuffers holds the aligned buffers of direct reads
+var directBuffers = sync.Pool{
+	New: func() any {
+		buf := alignedBuffer(directReadBufferSize, directReadAlign)
+		return &buf
+	},
+}
+
+// alignedBuffer returns a buffer of size bytes starting at a multiple of align
+func alignedBuffer(size int, align int) []byte {
+	buf := make([]byte, size+align)
+	offset := 0
+	if rem := alignment(buf, align); rem != 0 {
+		offset = align - rem
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+// alignment returns the offset of the start of b past a multiple of align
+func alignment(b []byte, align int) int {
+	return int(uintptr(unsafe.Pointer(unsafe.SliceData(b))) & uintptr(align-1))
+}
+
+// directReader reads a file opened with O_DIRECT. Such reads must start at
+// aligned offsets into aligned memory, so the file is read a buffer at a time
+// and handed out from there, except for aligned reads of whole buffers
+type directReader struct {
+	f    *os.File
+	buf  *[]byte
+	data []byte // Bytes read into buf not handed out yet
+	err  error  // Error of the last read, returned once data is empty
+}
+
+func newDirectReader(f *os.File) *directReader {
+	return &directReader{f: f, buf: directBuffers.Get().(*[]byte)}
+}
+
+func (r *directReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		// Large aligned reads skip the buffer
+		if len(p) >= directReadAlign && alignment(p, directReadAlign) == 0 {
+			n, err := r.f.Read(p[:len(p)&^(directReadAlign-1)])
+			if n < len(p)&^(directReadAlign-1) && err == nil {
+				// Only the end of the file can be short, and it has no
+				// aligned offset to read from again
+				r.err = io.EOF
+			}
+			return n, err
+		}
+		n, err := r.f.Read(*r.buf)
+		r.data, r.err = (*r.buf)[:n], err
+		if n < len(*r.buf) && err == nil {
+			r.err = io.EOF
+		}
+		if n == 0 {
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *directReader) Close() error {
+	if r.buf != nil {
+		directBuffers.Put(r.buf)
+		r.buf, r.data = nil, nil
+	}
+	return r.f.Close()
+}
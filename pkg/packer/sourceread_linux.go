@@ -0,0 +1,34 @@
+package packer
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSequential opens a file that is read once from start to end, doubling
+// the readahead window of the kernel for it
+func openSequential(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// The hint is only advice, reading works the same without it
+	unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+	return f, nil
+}
+
+// openDirect opens a file for reads that bypass the page cache. Filesystems
+// without O_DIRECT, such as tmpfs, are read sequentially instead
+func openDirect(path string) (io.ReadCloser, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECT|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.EINVAL) {
+		return openSequential(path)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return newDirectReader(os.NewFile(uintptr(fd), path)), nil
+}
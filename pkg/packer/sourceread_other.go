@@ -0,0 +1,19 @@
+//go:build !linux
+
+package packer
+
+import (
+	"io"
+	"os"
+)
+
+// openSequential opens a file that is read once from start to end, only
+// Linux takes a hint for that
+func openSequential(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+// openDirect opens a file normally, O_DIRECT is only used on Linux
+func openDirect(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
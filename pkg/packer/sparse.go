@@ -0,0 +1,96 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxExtents bounds the number of holes or zero runs decoded for a single file
+const maxExtents = 1 << 20
+
+// Extent is a region of a file
+type Extent struct {
+	Offset int64 `json:"offset"` // Offset from the start of the file
+	Length int64 `json:"length"` // Length in bytes
+}
+
+// checkExtents rejects extent lists that are unsorted, overlapping or extend
+// past the end of the file
+func checkExtents(extents []Extent, size int64) error {
+	var end int64
+	for _, extent := range extents {
+		if extent.Offset < end || extent.Length <= 0 || extent.Length > size-extent.Offset {
+			return fmt.Errorf("invalid extent at offset %d of length %d: %w", extent.Offset, extent.Length, ErrCorrupted)
+		}
+		end = extent.Offset + extent.Length
+	}
+	return nil
+}
+
+// sparseWriter writes a sparse file, seeking over the parts of its holes that
+// hold only zeros instead of writing them, which leaves them unallocated. Data
+// that is not zero is written even inside a hole, so the file always matches
+// the contents its checksum was verified against
+type sparseWriter struct {
+	f     *os.File
+	holes []Extent // Remaining holes, the first one may already be partly written
+	pos   int64    // Offset the next write starts at
+}
+
+func newSparseWriter(f *os.File, holes []Extent) (*sparseWriter, error) {
+	// Holes only stay unallocated in a file without previous contents
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	return &sparseWriter{f: f, holes: holes}, nil
+}
+
+func (w *sparseWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		for len(w.holes) > 0 && w.holes[0].Offset+w.holes[0].Length <= w.pos {
+			w.holes = w.holes[1:]
+		}
+
+		// Write up to the next hole, or through the end of the current one
+		n := int64(len(b))
+		inHole := false
+		if len(w.holes) > 0 {
+			hole := w.holes[0]
+			if w.pos < hole.Offset {
+				n = min(n, hole.Offset-w.pos)
+			} else {
+				n = min(n, hole.Offset+hole.Length-w.pos)
+				inHole = isZero(b[:n])
+			}
+		}
+
+		if inHole {
+			if _, err := w.f.Seek(n, io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.f.Write(b[:n]); err != nil {
+			return written, err
+		}
+		w.pos += n
+		written += int(n)
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// finish sets the length of the file, which a trailing hole leaves short
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.pos)
+}
+
+// isZero reports whether b holds only zero bytes
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
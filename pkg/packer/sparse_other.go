@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package packer
+
+import "os"
+
+// fileHoles is not supported on this platform, files are stored densely
+func fileHoles(path string, info os.FileInfo) []Extent {
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd
+
+package packer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileHoles returns the holes of a sparse file, found with SEEK_HOLE and
+// SEEK_DATA. Files with every block allocated, and filesystems that cannot
+// report holes, return nil and are stored densely
+func fileHoles(path string, info os.FileInfo) []Extent {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= info.Size() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	size := info.Size()
+	var holes []Extent
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Nothing but a hole up to the end of the file
+			holes = append(holes, Extent{Offset: offset, Length: size - offset})
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		if data > offset {
+			holes = append(holes, Extent{Offset: offset, Length: min(data, size) - offset})
+		}
+		hole, err := unix.Seek(int(f.Fd()), data, unix.SEEK_HOLE)
+		if err != nil || hole <= data {
+			return nil
+		}
+		offset = hole
+	}
+	return holes
+}
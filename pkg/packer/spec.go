@@ -0,0 +1,454 @@
+package packer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/bits"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+//go:generate go run ../../cmd/beam spec --output ../../FORMAT.md
+
+// formatFlag documents a footer flag in the format specification
+type formatFlag struct {
+	flag uint32
+	doc  string
+}
+
+// formatFlags documents every flag in knownFooterFlags, WriteFormatSpec fails
+// when one is missing so the specification cannot fall behind the code
+var formatFlags = []formatFlag{
+	{footerFlagTrailingMetadata, "The metadata section follows the data section. Without it the metadata section directly follows the header and the data section follows the metadata"},
+	{footerFlagBirthTime, "Fixed width and compact records end with the birth time"},
+	{footerFlagAttributes, "Fixed width and compact records hold the Windows attributes after the birth time"},
+	{footerFlagHoles, "Fixed width and compact records hold the holes of sparse files after the attributes"},
+	{footerFlagZeroRuns, "Fixed width and compact records hold the zero runs left out of the data section after the holes"},
+	{footerFlagCompactMetadata, "Records use the compact encoding, only with bit 0"},
+	{footerFlagEncrypted, "The file count and metadata section are encrypted, only with bit 0"},
+	{footerFlagPassphrase, "The footer holds a key header, only with bit 6"},
+	{footerFlagCBORMetadata, "Records are length prefixed CBOR maps, only with bit 0"},
+	{footerFlagCompression, "Fixed width and compact records end with the compression method and compressed size after the zero runs"},
+	{footerFlagDevices, "Fixed width and compact records end with the device number after the compression method"},
+}
+
+// specFlag is a footer flag as rendered in the specification
+type specFlag struct {
+	Bit   int
+	Value string
+	Doc   string
+}
+
+// specField is a CBOR record or manifest field as rendered in the specification
+type specField struct {
+	Key      string
+	Type     string
+	Optional bool
+	Doc      string
+}
+
+// WriteFormatSpec writes the specification of the archive format as
+// Markdown. Sizes, flags, magic numbers and the fields of CBOR records and
+// manifests are taken from the code, so the specification describes exactly
+// the format this version reads and writes
+func WriteFormatSpec(w io.Writer) error {
+	var flags []specFlag
+	var documented uint32
+	for _, f := range formatFlags {
+		documented |= f.flag
+		flags = append(flags, specFlag{Bit: bits.TrailingZeros32(f.flag), Value: fmt.Sprintf("0x%03x", f.flag), Doc: f.doc})
+	}
+	if documented != knownFooterFlags {
+		return fmt.Errorf("footer flags %#x are not documented", knownFooterFlags&^documented)
+	}
+
+	cborFields, err := specCBORFields()
+	if err != nil {
+		return err
+	}
+	data := map[string]any{
+		"HeaderSize":         blockHeaderSize,
+		"MinFooterSize":      minFooterSize,
+		"TrailerSize":        footerTrailerSize,
+		"ChecksumSize":       sha256.Size,
+		"FooterMagic":        string(footerMagic[:]),
+		"StreamMagic":        string(streamMagic[:]),
+		"BlockExt":           blockExt,
+		"ManifestFile":       manifestFileName,
+		"ManifestVersion":    manifestVersion,
+		"SignatureFile":      signatureFileName,
+		"SnapshotDir":        snapshotDir,
+		"LeadingVersion":     blockVersionLeading,
+		"CurrentVersion":     currentBlockVersion,
+		"Flags":              flags,
+		"KnownFlags":         fmt.Sprintf("0x%03x", knownFooterFlags),
+		"StreamFlags":        fmt.Sprintf("0x%03x", streamBlockFlags),
+		"CompactMode":        compactFieldMode,
+		"CompactUid":         compactFieldUid,
+		"CompactGid":         compactFieldGid,
+		"CompactXattrs":      compactFieldXattrs,
+		"CBORVersion":        cborMetadataVersion,
+		"CBORFields":         cborFields,
+		"KeySize":            MetadataKeySize,
+		"KeyHeaderSize":      keyHeaderSize,
+		"SaltSize":           argonSaltSize,
+		"ArgonTime":          argonTime,
+		"ArgonMemory":        argonMemory,
+		"ArgonThreads":       argonThreads,
+		"ArgonMaxMemory":     argonMaxMemory,
+		"MinZeroRun":         minZeroRun,
+		"CompressionNone":    uint8(CompressionNone),
+		"CompressionDeflate": uint8(CompressionDeflate),
+		"CompressionZstd":    uint8(CompressionZstd),
+		"MaxPath":            maxPathLength,
+		"MaxXattrs":          maxXattrs,
+		"MaxExtents":         maxExtents,
+		"ModeDir":            fmt.Sprintf("0x%08x", uint32(fs.ModeDir)),
+		"ModeSetuid":         fmt.Sprintf("0x%08x", uint32(fs.ModeSetuid)),
+		"ModeSetgid":         fmt.Sprintf("0x%08x", uint32(fs.ModeSetgid)),
+		"ModeSticky":         fmt.Sprintf("0x%08x", uint32(fs.ModeSticky)),
+		"ModeNamedPipe":      fmt.Sprintf("0x%08x", uint32(fs.ModeNamedPipe)),
+		"ModeSocket":         fmt.Sprintf("0x%08x", uint32(fs.ModeSocket)),
+		"ModeDevice":         fmt.Sprintf("0x%08x", uint32(fs.ModeDevice)),
+		"ModeCharDevice":     fmt.Sprintf("0x%08x", uint32(fs.ModeCharDevice)),
+		"AttrHidden":         fmt.Sprintf("0x%x", AttributeHidden),
+		"AttrSystem":         fmt.Sprintf("0x%x", AttributeSystem),
+		"ManifestFields":     specJSONFields(reflect.TypeOf(Manifest{})),
+		"BlockFields":        specJSONFields(reflect.TypeOf(ManifestBlock{})),
+		"FileFields":         specJSONFields(reflect.TypeOf(ManifestFile{})),
+		"DictionaryFields":   specJSONFields(reflect.TypeOf(ManifestDictionary{})),
+		"VolumeFields":       specJSONFields(reflect.TypeOf(ManifestVolume{})),
+		"RootFields":         specJSONFields(reflect.TypeOf(ManifestRoot{})),
+	}
+	return formatSpecTemplate.Execute(w, data)
+}
+
+// specCBORFields returns the fields of CBOR metadata records from the tags of
+// cborMetadata
+func specCBORFields() ([]specField, error) {
+	t := reflect.TypeOf(cborMetadata{})
+	var fields []specField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("cbor"), ",")
+		doc := field.Tag.Get("doc")
+		if doc == "" {
+			return nil, fmt.Errorf("CBOR metadata field %s is not documented", field.Name)
+		}
+		fields = append(fields, specField{
+			Key:      tag[0],
+			Type:     specCBORType(field.Type),
+			Optional: strings.Contains(field.Tag.Get("cbor"), "omitempty"),
+			Doc:      doc,
+		})
+	}
+	return fields, nil
+}
+
+func specCBORType(t reflect.Type) string {
+	switch {
+	case t == reflect.TypeOf([]byte(nil)):
+		return "bytes"
+	case t == reflect.TypeOf([]cborExtent(nil)):
+		return "array of [offset, length]"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "text"
+	case reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		return "unsigned"
+	case reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Map:
+		return "map of text to bytes"
+	}
+	return t.String()
+}
+
+// specJSONFields returns the JSON keys of a manifest type
+func specJSONFields(t reflect.Type) []specField {
+	var fields []specField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		fields = append(fields, specField{
+			Key:      tag[0],
+			Type:     specJSONType(field.Type),
+			Optional: len(tag) > 1 && tag[1] == "omitempty",
+		})
+	}
+	return fields
+}
+
+func specJSONType(t reflect.Type) string {
+	switch t {
+	case reflect.TypeOf([]byte(nil)):
+		return "base64 string"
+	case reflect.TypeOf(ManifestBlock{}):
+		return "block"
+	case reflect.TypeOf(ManifestFile{}):
+		return "file"
+	case reflect.TypeOf(ManifestDictionary{}):
+		return "dictionary"
+	case reflect.TypeOf(ManifestVolume{}):
+		return "volume"
+	case reflect.TypeOf(ManifestRoot{}):
+		return "root"
+	case reflect.TypeOf(Extent{}):
+		return `{"offset", "length"}`
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return specJSONType(t.Elem())
+	case reflect.Slice:
+		return "array of " + specJSONType(t.Elem())
+	case reflect.Map:
+		return "object of " + specJSONType(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Struct:
+		return "RFC 3339 time"
+	}
+	return "number"
+}
+
+var formatSpecTemplate = template.Must(template.New("spec").Parse(`# Beam Archive Format
+
+<!-- Generated by go generate ./pkg/packer from the code of the packer package. Do not edit. -->
+
+This is the specification of the archive format written and read by this version of the packer package. It
+is generated from the constants and types of the implementation. Golden archives for every feature are in
+testdata/vectors, see [Test Vectors](#test-vectors).
+
+All integers are little endian. Sizes are in bytes. Checksums are SHA-256 ({{.ChecksumSize}} bytes).
+
+## Archives
+
+An archive is a directory holding:
+
+- Block files ending in ` + "`{{.BlockExt}}`" + `. Every block is self-contained, an archive can be read from its blocks
+  alone. Block names carry no meaning, readers take every ` + "`{{.BlockExt}}`" + ` file of the directory
+- ` + "`{{.ManifestFile}}`" + `, an optional index of the blocks and files, see [Manifest](#manifest)
+- ` + "`{{.SignatureFile}}`" + `, an optional Ed25519 signature over the manifests
+- ` + "`{{.SnapshotDir}}/`" + `, optional manifests of snapshot generations
+- Files ending in ` + "`.parity`" + `, optional Reed-Solomon parity of groups of blocks
+
+A block file may be split into volumes named after it with a three digit number from 001 appended, such as
+` + "`block-1{{.BlockExt}}.001`" + `. The volumes concatenated in order are the block file, and every volume but the last
+has the same size. Readers take the volumes of a block in place of its file.
+
+Readers only need the block files, and may ignore everything else. Files removed from or renamed in an
+archive after it was packed are only recorded in the manifest, see its ` + "`deleted` and `original`" + ` fields.
+
+## Block Layout
+
+A block is a header, a data section, a metadata section and a footer:
+
+| Field | Size | Description |
+|-------|------|-------------|
+| Block ID | 4 | int32, unique within the archive |
+| File count | 4 | int32, 0 when the metadata is encrypted |
+| Data section | variable | Contents of the files, at the offsets their metadata records |
+| Metadata section | variable | One record per file, in the encoding the footer flags select |
+| Footer | {{.MinFooterSize}} or more | Describes the block, see below |
+
+The header is {{.HeaderSize}} bytes. With footer flag bit 0 the data section starts right after the header and
+the metadata section follows it. Without it the metadata section follows the header and the data section
+follows the metadata, which is how blocks of earlier versions and of stream archives are laid out.
+
+Blocks carry no version number, the footer flags tell the layouts apart. Blocks without flag bit 0 are
+version {{.LeadingVersion}} and blocks with it version {{.CurrentVersion}}, the version written. Archives may mix versions, readers must
+read every one of them.
+
+The offset of a file is relative to the start of the data section. The bytes stored for a file are its
+contents less the zero runs left out, see [Zero Runs and Holes](#zero-runs-and-holes), or its compressed contents,
+see [Compression](#compression).
+
+## Footer
+
+| Field | Size | Description |
+|-------|------|-------------|
+| Checksum | {{.ChecksumSize}} | SHA-256 of every byte of the block before the footer |
+| Metadata offset | 8 | int64, offset of the metadata section from the start of the block |
+| Flags | 4 | uint32, see below |
+| Key header | {{.KeyHeaderSize}} | Only with flag bit 7, see [Encrypted Metadata](#encrypted-metadata) |
+| Payload length | 8 | int64, size of the block before the footer, absent from the {{.MinFooterSize}} byte footers of earlier versions |
+| Footer length | 4 | uint32, size of the whole footer |
+| CRC | 4 | uint32, CRC-32 (IEEE) of the footer bytes before it |
+| Magic | 4 | ` + "`{{.FooterMagic}}`" + ` |
+
+Readers locate the footer from its last {{.TrailerSize}} bytes: check the magic, read the footer length and check
+the CRC of the footer. Fields are added before the footer length, so a reader skips fields it does not know.
+A reader should check the payload length, when the footer is long enough to hold it, against the size of
+the block less the footer length, as a block missing bytes or holding extra ones may still have a valid footer.
+
+Flags change how the rest of the block is laid out. A reader must reject blocks with a flag it does not know,
+this version knows {{.KnownFlags}}:
+
+| Bit | Value | Meaning |
+|-----|-------|---------|
+{{range .Flags}}| {{.Bit}} | {{.Value}} | {{.Doc}} |
+{{end}}
+## Metadata Records
+
+Each record describes one file. Records are in the order of the files in the data section. Paths use forward
+slashes, blocks of earlier versions written on Windows may hold backslashes, which readers convert. Paths are
+at most {{.MaxPath}} bytes and may be absolute, readers decide where to extract them.
+
+The mode holds the permission bits and the Go ` + "`fs.FileMode`" + ` bits setuid ({{.ModeSetuid}}), setgid
+({{.ModeSetgid}}) and sticky ({{.ModeSticky}}). Special files recorded as metadata also hold a type bit: named pipe
+({{.ModeNamedPipe}}), socket ({{.ModeSocket}}) or device ({{.ModeDevice}}), with character device ({{.ModeCharDevice}}) added for character
+devices. They have no contents, and device nodes record their device number. Windows attributes are hidden ({{.AttrHidden}}) and system ({{.AttrSystem}}). Owner and group
+are 0 unless ownership was preserved. Modification times are Unix seconds. A birth time of 0 seconds and 0
+nanoseconds is unknown.
+
+### Fixed Width Records
+
+| Field | Size | Description |
+|-------|------|-------------|
+| Path length | 4 | int32 |
+| Path | variable | UTF-8 |
+| Size | 8 | int64 |
+| Modification time | 8 | int64 |
+| Offset | 8 | int64 |
+| Mode | 4 | uint32 |
+| Owner | 4 | uint32 |
+| Group | 4 | uint32 |
+| Checksum | {{.ChecksumSize}} | SHA-256 of the contents |
+| Xattr count | 4 | int32, at most {{.MaxXattrs}}, followed by the name and value of each as int32 length and bytes |
+| Birth time | 12 | int64 seconds and int32 nanoseconds, only with flag bit 1 |
+| Attributes | 4 | uint32, only with flag bit 2 |
+| Holes | variable | int32 count followed by int64 offset and length of each, only with flag bit 3 |
+| Zero runs | variable | int32 count followed by int64 offset and length of each, only with flag bit 4 |
+| Compression | 9 | uint8 method followed by the int64 size of the compressed contents, only with flag bit 9 |
+| Device | 8 | uint64 device number of a device node, only with flag bit 10 |
+
+### Compact Records
+
+With flag bit 5 every number is a varint (unsigned LEB128, signed ones zigzag encoded first) and most fields
+are relative to the previous record. The first record is relative to an empty record with a modification
+time of 0:
+
+1. Length of the path prefix shared with the previous record, length of the rest and the rest of the path
+2. Size
+3. Modification time minus the previous one (signed)
+4. Offset minus the end of the stored bytes of the previous file (signed)
+5. A byte of fields: {{.CompactMode}} when the mode follows, {{.CompactUid}} the owner, {{.CompactGid}} the group and {{.CompactXattrs}} the extended attributes.
+   Mode, owner and group not present are the ones of the previous record
+6. Mode, owner and group as present
+7. The {{.ChecksumSize}} byte checksum
+8. When present, the extended attribute count followed by the length and bytes of each name and value
+9. The fields announced by flag bits 1 to 4, 9 and 10 in the order of fixed width records, as varints (signed
+   birth time seconds) except for the compression method, a single byte
+
+### CBOR Records
+
+With flag bit 8 every record is its length (int32) followed by a CBOR map (RFC 8949) in the core deterministic
+encoding. Keys are small integers, and optional keys are left out when they hold a zero value. The schema
+version under key 0 is {{.CBORVersion}}. Readers ignore keys they do not know and reject records of a later
+schema version. Records carry every field they have whatever flag bits 1 to 4, 9 and 10 say.
+
+| Key | Type | Optional | Field |
+|-----|------|----------|-------|
+{{range .CBORFields}}| {{.Key}} | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} | {{.Doc}} |
+{{end}}
+## Zero Runs and Holes
+
+Zero runs are runs of at least {{.MinZeroRun}} zeros left out of the data section. Their offsets are relative to the
+file, and readers put them back while reading the stored bytes. Holes are the unallocated regions of sparse
+files, which read as zeros and are stored in the data section like any other contents. Both are sorted,
+do not overlap, end within the file and number at most {{.MaxExtents}} per file.
+
+## Compression
+
+With flag bit 9 every record holds the compression method of its file: {{.CompressionNone}} for contents stored as they
+are, {{.CompressionDeflate}} for a raw DEFLATE stream (RFC 1951) and {{.CompressionZstd}} for a single zstd frame (RFC 8878), which
+decompress to exactly the size of the file. The bytes stored for a compressed file are its compressed size and
+it has no zero runs. Readers reject methods they do not know. Writers choose per file, storing files of
+compressed formats and files a sample of which looks compressed already, so a block may mix stored and
+compressed files.
+
+A zstd frame with a dictionary ID was compressed with the dictionary of that ID in the ` + "`dictionaries`" + ` of the
+manifest, a zstd dictionary in the format of RFC 8878 section 5. Frames without one need no dictionary.
+Readers without the manifest cannot decompress files whose frames name a dictionary.
+
+## Encrypted Metadata
+
+With flag bit 6 the metadata section is a 12 byte nonce followed by the AES-256-GCM sealed file count (uint32)
+and records. The additional data is the block ID (int32) followed by the footer flags (uint32). The key is
+{{.KeySize}} bytes, either given to the reader or sealed in the key header of the footer with flag bit 7:
+
+| Field | Size | Description |
+|-------|------|-------------|
+| Salt | {{.SaltSize}} | Argon2id salt |
+| Time | 4 | uint32 Argon2id passes, {{.ArgonTime}} when written by this version |
+| Memory | 4 | uint32 Argon2id memory in KiB, {{.ArgonMemory}} when written, at most {{.ArgonMaxMemory}} when read |
+| Threads | 1 | Argon2id lanes, {{.ArgonThreads}} when written |
+| Nonce | 12 | AES-256-GCM nonce |
+| Sealed key | {{.KeySize}} + 16 | The metadata key sealed with AES-256-GCM |
+
+The key sealing the metadata key is the {{.KeySize}} byte Argon2id key of the passphrase with the salt and parameters,
+and the additional data is the salt and parameters.
+
+## Stream Archives
+
+A stream archive is the magic ` + "`{{.StreamMagic}}`" + ` followed by one frame per block. A frame is the block length (int64)
+followed by the block, and a frame of length 0 ends the stream. Blocks of a stream have the flags {{.StreamFlags}}, so
+their metadata precedes the data section and they can be read front to back.
+
+## Manifest
+
+` + "`{{.ManifestFile}}`" + ` is a JSON object indexing the blocks and files, version {{.ManifestVersion}}. Readers reject later
+versions. Checksums are hex encoded. Offsets of files are relative to the start of their block file, not the
+data section. Files marked deleted are no longer part of the archive, and files with an original path were
+renamed from the path their block records. Dictionaries are kept when the manifest is rebuilt, as files in the
+blocks may need them, see [Compression](#compression). So are roots, which record the input directory or file
+packed under each top level prefix of an archive packed from several roots; the blocks only hold the paths.
+
+| Key | Type | Optional |
+|-----|------|----------|
+{{range .ManifestFields}}| ` + "`{{.Key}}`" + ` | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} |
+{{end}}
+Blocks:
+
+| Key | Type | Optional |
+|-----|------|----------|
+{{range .BlockFields}}| ` + "`{{.Key}}`" + ` | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} |
+{{end}}
+Files:
+
+| Key | Type | Optional |
+|-----|------|----------|
+{{range .FileFields}}| ` + "`{{.Key}}`" + ` | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} |
+{{end}}
+Dictionaries:
+
+| Key | Type | Optional |
+|-----|------|----------|
+{{range .DictionaryFields}}| ` + "`{{.Key}}`" + ` | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} |
+{{end}}
+Volumes, in order, of a block split into volumes:
+
+| Key | Type | Optional |
+|-----|------|----------|
+{{range .VolumeFields}}| ` + "`{{.Key}}`" + ` | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} |
+{{end}}
+Roots:
+
+| Key | Type | Optional |
+|-----|------|----------|
+{{range .RootFields}}| ` + "`{{.Key}}`" + ` | {{.Type}} | {{if .Optional}}yes{{else}}no{{end}} |
+{{end}}
+## Test Vectors
+
+testdata/vectors holds a directory per feature, written by ` + "`beam vectors`" + ` from ` + "`packer.TestVectors`" + `. Each holds
+the archive, a directory of blocks or a stream file, and vector.json with the name of the archive, the
+metadata key (hex) or passphrase if it is encrypted, and the path, size, mode, modification time and SHA-256
+checksum of every file expected back from it. A reader conforms when it reads every file of every vector
+back with its contents and modification time. ` + "`beam vectors --check`" + ` checks this implementation.
+`))
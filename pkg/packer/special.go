@@ -0,0 +1,127 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// SpecialFilePolicy selects what packing does with special files: named
+// pipes, sockets and device nodes. Their contents are not files, reading a
+// pipe waits for a writer that may never come, so they are never read
+type SpecialFilePolicy int
+
+const (
+	SpecialFileSkip   SpecialFilePolicy = iota // Leave special files out with a warning, the default
+	SpecialFileRecord                          // Record their type, mode and device number without contents and create them again when unpacking
+	SpecialFileFail                            // Fail the file with ErrSpecialFile, which fails the pack unless ContinueOnError is set
+)
+
+// ErrSpecialFile is returned for the special files found when packing with
+// SpecialFileFail
+var ErrSpecialFile = errors.New("special file")
+
+// specialModes are the fs.FileMode type bits of special files
+const specialModes = fs.ModeNamedPipe | fs.ModeSocket | fs.ModeDevice | fs.ModeCharDevice | fs.ModeIrregular
+
+// errSpecialNotCreated is returned for special files unpacking leaves out:
+// sockets, which only exist while a program listens on them, device nodes
+// without the privileges to create them and any on platforms without them
+var errSpecialNotCreated = errors.New("special file not created")
+
+// isSpecialMode tells whether a recorded mode is the mode of a special file
+func isSpecialMode(mode uint32) bool {
+	return fs.FileMode(mode)&specialModes != 0
+}
+
+// checkSpecialFilePolicy rejects special file policies this version does not know
+func (p defaultPacker) checkSpecialFilePolicy() error {
+	switch p.opts.SpecialFiles {
+	case SpecialFileSkip, SpecialFileRecord, SpecialFileFail:
+		return nil
+	}
+	return fmt.Errorf("unknown special file policy %d: %w", p.opts.SpecialFiles, ErrInvalidOption)
+}
+
+// keepSpecial applies SpecialFiles to a special file found when packing and
+// tells whether it is recorded
+func (p defaultPacker) keepSpecial(path string, info os.FileInfo) (bool, error) {
+	switch p.opts.SpecialFiles {
+	case SpecialFileRecord:
+		return true, nil
+	case SpecialFileFail:
+		return false, p.failures.skip(path, fmt.Errorf("%s is a %s: %w", path, specialKind(info.Mode()), ErrSpecialFile))
+	}
+	p.logger().Warn("Skipping special file", "path", path, "type", specialKind(info.Mode()))
+	return false, nil
+}
+
+// specialKind names the type of a special file
+func specialKind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "block device"
+	}
+	return "irregular file"
+}
+
+// specialOpener wraps an opener of source files so special files read as
+// empty instead of being opened
+func specialOpener(open contentOpener) contentOpener {
+	return func(metadata *FileMetadata) (io.ReadCloser, error) {
+		if isSpecialMode(metadata.Mode) {
+			return io.NopCloser(eofReader{}), nil
+		}
+		return open(metadata)
+	}
+}
+
+// eofReader is empty contents
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// extractSpecial creates a special file recorded in the archive at its output
+// path. An existing file is handled as OverwritePolicy says, sockets and
+// device nodes that cannot be created are reported with errSpecialNotCreated
+func (p *defaultPacker) extractSpecial(outputPath string, metadata *FileMetadata) (string, error) {
+	mode := fs.FileMode(metadata.Mode)
+	if mode&(fs.ModeNamedPipe|fs.ModeDevice) == 0 {
+		return "", fmt.Errorf("%s is a %s: %w", metadata.Path, specialKind(mode), errSpecialNotCreated)
+	}
+	switch p.opts.Overwrite {
+	case OverwriteNever:
+		if _, err := os.Lstat(outputPath); err == nil {
+			return "", fmt.Errorf("error creating %s: %w", specialKind(mode), ErrFileExists)
+		}
+	case OverwriteKeepBoth:
+		base := outputPath
+		for n := 1; ; n++ {
+			if _, err := os.Lstat(outputPath); errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			outputPath = numberedPath(base, n)
+		}
+	default:
+		if info, err := os.Lstat(outputPath); err == nil && !info.IsDir() {
+			if err := os.Remove(outputPath); err != nil {
+				return "", fmt.Errorf("error replacing existing file: %w", err)
+			}
+		}
+	}
+	if err := makeSpecial(outputPath, mode, metadata.Device); err != nil {
+		if errors.Is(err, errSpecialNotCreated) {
+			return "", fmt.Errorf("%s %s: %w", specialKind(mode), metadata.Path, err)
+		}
+		return "", fmt.Errorf("error creating %s: %w", specialKind(mode), err)
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd)
+
+package packer
+
+import (
+	"io/fs"
+	"os"
+)
+
+// fileDeviceNumber is not supported on this platform, device nodes record 0
+func fileDeviceNumber(info os.FileInfo) uint64 {
+	return 0
+}
+
+// makeSpecial is not supported on this platform, special files are left out
+func makeSpecial(path string, mode fs.FileMode, device uint64) error {
+	return errSpecialNotCreated
+}
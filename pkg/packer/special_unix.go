@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd
+
+package packer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileDeviceNumber returns the device number of a device node, with the major
+// number in the upper 32 bits and the minor number in the lower 32 bits so it
+// means the same on every platform
+func fileDeviceNumber(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&fs.ModeDevice == 0 {
+		return 0
+	}
+	dev := uint64(stat.Rdev)
+	return uint64(unix.Major(dev))<<32 | uint64(unix.Minor(dev))
+}
+
+// makeSpecial creates a named pipe or device node. Device nodes need root,
+// without it they are reported with errSpecialNotCreated
+func makeSpecial(path string, mode fs.FileMode, device uint64) error {
+	perm := uint32(mode.Perm())
+	if mode&fs.ModeNamedPipe != 0 {
+		return unix.Mkfifo(path, perm)
+	}
+	kind := uint32(unix.S_IFBLK)
+	if mode&fs.ModeCharDevice != 0 {
+		kind = unix.S_IFCHR
+	}
+	err := mknod(unix.Mknod, path, kind|perm, unix.Mkdev(uint32(device>>32), uint32(device)))
+	if errors.Is(err, unix.EPERM) {
+		return errSpecialNotCreated
+	}
+	return err
+}
+
+// mknod calls unix.Mknod, which takes the device number as an int on Linux and
+// macOS and as a uint64 on FreeBSD
+func mknod[D int | uint64](mknod func(string, uint32, D) error, path string, mode uint32, dev uint64) error {
+	return mknod(path, mode, D(dev))
+}
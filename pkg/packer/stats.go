@@ -0,0 +1,95 @@
+package packer
+
+import "time"
+
+// Stats are the totals of a pack or unpack operation. Packing reads file
+// contents and writes blocks, unpacking reads blocks and writes file contents.
+// Ratios are 0 when no file contents were processed
+type Stats struct {
+	Op               string        `json:"op"`                // pack or unpack, empty before the first operation
+	Files            int           `json:"files"`             // Files packed or extracted
+	FilesSkipped     int           `json:"files_skipped"`     // Files reused from an earlier snapshot or already extracted intact
+	Blocks           int           `json:"blocks"`            // Blocks written or read
+	BytesIn          int64         `json:"bytes_in"`          // Bytes of file contents read when packing, of block data read when unpacking
+	BytesOut         int64         `json:"bytes_out"`         // Bytes of block files written when packing, of file contents written when unpacking
+	Duration         time.Duration `json:"duration_ns"`       // Time from the start of the operation to its end, or until now while it runs
+	Throughput       float64       `json:"throughput"`        // Bytes of file contents processed per second
+	DedupRatio       float64       `json:"dedup_ratio"`       // Bytes of all files over the bytes processed, above 1 when files are skipped
+	CompressionRatio float64       `json:"compression_ratio"` // Bytes of file contents over the block data holding them
+}
+
+// operationTotals are the running totals of an operation Stats are computed from
+type operationTotals struct {
+	op           string
+	started      time.Time
+	finished     time.Time // Zero while the operation runs
+	files        int
+	skipped      int
+	blocks       int
+	contents     int64 // Bytes of the contents of the files processed
+	stored       int64 // Bytes of block data holding those contents
+	skippedBytes int64 // Bytes of the contents of the files skipped
+	blockBytes   int64 // Bytes of the block files written
+}
+
+// file adds a file that was packed, extracted or skipped
+func (t *operationTotals) file(metadata *FileMetadata, skipped bool) {
+	if skipped {
+		t.skipped++
+		t.skippedBytes += metadata.Size
+		return
+	}
+	t.files++
+	t.contents += metadata.Size
+	t.stored += metadata.storedSize()
+}
+
+// stats computes the Stats of the totals
+func (t *operationTotals) stats() Stats {
+	stats := Stats{
+		Op:               t.op,
+		Files:            t.files,
+		FilesSkipped:     t.skipped,
+		Blocks:           t.blocks,
+		BytesIn:          t.contents,
+		BytesOut:         t.blockBytes,
+		DedupRatio:       ratio(t.contents+t.skippedBytes, t.contents),
+		CompressionRatio: ratio(t.contents, t.stored),
+	}
+	if t.op == "unpack" {
+		stats.BytesIn, stats.BytesOut = t.stored, t.contents
+	}
+	if !t.started.IsZero() {
+		end := t.finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		stats.Duration = end.Sub(t.started)
+		if seconds := stats.Duration.Seconds(); seconds > 0 {
+			stats.Throughput = float64(t.contents) / seconds
+		}
+	}
+	return stats
+}
+
+// ratio returns a over b, or 0 when b is 0
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// stats returns the Stats of the current operation, or the last one once finished
+func (r *progressReporter) stats() Stats {
+	if r == nil {
+		return Stats{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.totals.stats()
+}
+
+func (p defaultPacker) Stats() Stats {
+	return p.progress.stats()
+}
@@ -0,0 +1,433 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlockStore keeps the block files of an archive, such as a local directory
+// or an object storage bucket. Blocks are addressed by their file name
+type BlockStore interface {
+	// Put stores size bytes read from r under name, replacing any block of that name
+	Put(name string, r io.Reader, size int64) error
+
+	// Get returns the contents of the block stored under name
+	Get(name string) (io.ReadCloser, error)
+
+	// List returns the names of all stored blocks sorted by name
+	List() ([]string, error)
+
+	// Delete removes the block stored under name
+	Delete(name string) error
+}
+
+// checkStoreName rejects block names that would address anything but a
+// single entry of the store
+func checkStoreName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid block name %q: %w", name, ErrPathUnsafe)
+	}
+	return nil
+}
+
+// DirStore is a BlockStore keeping blocks as files in a local directory
+type DirStore struct {
+	Dir string // Directory holding the blocks, created by the first Put
+}
+
+func (s DirStore) Put(name string, r io.Reader, size int64) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating store directory: %w", err)
+	}
+
+	// Write to a temporary file so a failed Put never leaves a partial block
+	f, err := createArchiveTemp(s.Dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := io.CopyN(f, r, size); err != nil {
+		return fmt.Errorf("error writing block %s: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.Dir, name))
+}
+
+func (s DirStore) Get(name string) (io.ReadCloser, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.Dir, name))
+}
+
+func (s DirStore) List() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing store directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && filepath.Ext(entry.Name()) != ".tmp" {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s DirStore) Delete(name string) error {
+	if err := checkStoreName(name); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.Dir, name))
+}
+
+// PackToStore packs all files in the input directory and uploads every block
+// to the store as soon as it is complete. Only the block being written is
+// held in a temporary directory until its upload finishes
+func (p defaultPacker) PackToStore(inputDir string, store BlockStore) (err error) {
+	p.checkChanges = true
+	if err := p.checkFormat(); err != nil {
+		return err
+	}
+	if p.opts.ParityBlocks > 0 {
+		return fmt.Errorf("parity blocks are not written to block stores: %w", ErrInvalidOption)
+	}
+	if p.opts.VolumeSize > 0 {
+		return fmt.Errorf("blocks are put into block stores whole: %w", ErrInvalidOption)
+	}
+	p.failures = p.newFailureLog()
+
+	frozen, err := p.freezeSource(inputDir)
+	if err != nil {
+		return err
+	}
+	defer frozen.close(p.logger())
+	p.frozen = frozen
+	fileInfos, err := p.planFiles(inputDir)
+	if err != nil {
+		return err
+	}
+	p.opts.BlockSize = p.blockSizeFor(fileSizes(fileInfos))
+	if p.opts.TrainDictionary {
+		if p.dictionary, err = p.trainDictionary(fileInfos, p.sourceOpener()); err != nil {
+			return err
+		}
+	}
+
+	// Staged blocks are removed once uploaded, flushing them is up to the store
+	p.syncs = newSyncLog(SyncNone)
+
+	staging, err := os.MkdirTemp("", "beam-upload-")
+	if err != nil {
+		return fmt.Errorf("error creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	p.progress.start("pack", len(fileInfos), totalBytes(fileInfos))
+	defer func() { p.progress.finish(err) }()
+
+	manifest := &Manifest{Version: manifestVersion, Info: p.archiveInfo(nil)}
+	if p.dictionary != nil {
+		manifest.Dictionaries = []ManifestDictionary{p.dictionary.manifest()}
+	}
+	err = p.packFiles(fileInfos, 1, func(block *Block) error {
+		if err := p.writeBlock(block, staging, p.sourceOpener()); err != nil {
+			return fmt.Errorf("error writing block: %w", err)
+		}
+		path := filepath.Join(staging, block.fileName)
+		size, err := p.putFile(store, block.fileName, path)
+		if err != nil {
+			return fmt.Errorf("error uploading block %s: %w", block.fileName, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		block.DataOffset = blockHeaderSize
+		manifest.addBlock(block, block.fileName, size)
+		manifest.Blocks[len(manifest.Blocks)-1].Replicas = storedOn(store, []string{block.fileName})
+		p.progress.blockWritten(block, p.opts.BlockSize)
+		return nil
+	})
+	if err == nil && p.opts.Format == FormatBeam {
+		err = putManifest(store, manifest)
+	}
+	return p.failures.result("pack", err)
+}
+
+// putManifest uploads the manifest of the blocks put into the store
+func putManifest(store BlockStore, m *Manifest) error {
+	m.sort()
+	var buf bytes.Buffer
+	if err := m.encode(&buf); err != nil {
+		return err
+	}
+	if err := store.Put(manifestFileName, &buf, int64(buf.Len())); err != nil {
+		return fmt.Errorf("error uploading manifest: %w", err)
+	}
+	return nil
+}
+
+// loadStoreDictionaries registers the compression dictionaries recorded in the
+// manifest of a store, when it has one
+func loadStoreDictionaries(store BlockStore, names []string) error {
+	found := false
+	for _, name := range names {
+		found = found || name == manifestFileName
+	}
+	if !found {
+		return nil
+	}
+	_, err := getManifest(store)
+	return err
+}
+
+// putFile uploads a local file to the store under name and returns its size.
+// The upload is paced by MaxBytesPerSecond
+func (p defaultPacker) putFile(store BlockStore, name string, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), store.Put(name, p.throttleReader(f), info.Size())
+}
+
+// UnpackFromStore extracts the files of every block in the store to the
+// output directory. Each block is downloaded into memory and extracted from
+// there, nothing but the extracted files is written to disk
+func (p defaultPacker) UnpackFromStore(store BlockStore, outputDir string, patterns ...string) (err error) {
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	if err := p.checkUnpackScan("stores"); err != nil {
+		return err
+	}
+	if p.opts.AtomicUnpack {
+		return p.unpackAtomically(outputDir, func(p defaultPacker, dir string) error {
+			return p.UnpackFromStore(store, dir, patterns...)
+		})
+	}
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkOverwritePolicy(); err != nil {
+		return err
+	}
+	p.failures = p.newFailureLog()
+
+	names, err := store.List()
+	if err != nil {
+		return fmt.Errorf("error listing blocks: %w", err)
+	}
+	if err := loadStoreDictionaries(store, names); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// The contents of the blocks are only known once they are downloaded
+	p.progress.start("unpack", 0, 0)
+	defer func() { p.progress.finish(err) }()
+
+	for _, name := range names {
+		if filepath.Ext(name) != blockExt {
+			continue
+		}
+		if err := p.unpackStoredBlock(store, name, outputDir, patterns); err != nil {
+			err = fmt.Errorf("error unpacking block %s: %w", name, err)
+			if err := p.failures.skip(name, err); err != nil {
+				return err
+			}
+		}
+	}
+	if err := p.syncs.flush(); err != nil {
+		return err
+	}
+	return p.failures.result("unpack", nil)
+}
+
+// unpackStoredBlock downloads a single block and extracts its files matching
+// the patterns
+func (p defaultPacker) unpackStoredBlock(store BlockStore, name string, outputDir string, patterns []string) error {
+	rc, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("error downloading block: %w", err)
+	}
+
+	r := bytes.NewReader(data)
+	block, err := p.readBlockIndexAt(r, r.Size())
+	if err != nil {
+		return err
+	}
+	files := matchingFiles(block, patterns)
+	if len(files) == 0 {
+		return nil
+	}
+
+	if p.opts.VerifyIntegrity {
+		if err := p.validator.validateBlockAt(r, r.Size()); err != nil {
+			return fmt.Errorf("error verifying block integrity: %w", err)
+		}
+	}
+	return p.extractBlock(block, files, &memBlockReader{data: data}, outputDir)
+}
+
+// SyncResult reports what Sync transferred to a store, or would transfer
+// with DryRun
+type SyncResult struct {
+	Uploaded      []string // Names of the block and volume files uploaded, missing or changed in the store
+	UploadedBytes int64    // Combined size of the uploaded files, without the manifest
+	Unchanged     int      // Blocks the store already held with the same checksum and size
+	Deleted       []string // Names of the files deleted from the store under DeleteExtraneous
+}
+
+// Sync replicates an archive directory to a store, such as an offsite
+// bucket, transferring only what the store lacks. The blocks of the archive
+// manifest are compared by checksum and size with the manifest in the store,
+// and only blocks missing or changed there are uploaded, followed by the
+// manifest itself so the store never lists blocks it does not hold. Under
+// DeleteExtraneous files in the store that are not part of the archive are
+// deleted afterwards. Snapshots, parity and signatures stay local. With
+// DryRun the store is only read, and the result lists what would be uploaded
+// and deleted
+func (p defaultPacker) Sync(archiveDir string, store BlockStore) (*SyncResult, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if p.encryptsMetadata() {
+		return nil, fmt.Errorf("archives with encrypted metadata have no manifest to compare blocks by: %w", ErrInvalidOption)
+	}
+	local, err := readManifestFile(filepath.Join(archiveDir, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		local, err = p.buildManifest(archiveDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	// A dry run against a directory not created yet finds it empty
+	names, err := store.List()
+	if err != nil && !(p.opts.DryRun && errors.Is(err, os.ErrNotExist)) {
+		return nil, fmt.Errorf("error listing blocks: %w", err)
+	}
+	stored := make(map[string]bool, len(names))
+	for _, name := range names {
+		stored[name] = true
+	}
+	remote := make(map[string]ManifestBlock)
+	if stored[manifestFileName] {
+		m, err := getManifest(store)
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range m.Blocks {
+			remote[block.Name] = block
+		}
+	}
+
+	result := &SyncResult{}
+	wanted := map[string]bool{manifestFileName: true}
+	for i := range local.Blocks {
+		block := &local.Blocks[i]
+		var files []string
+		for _, file := range block.files() {
+			files = append(files, file.Name)
+		}
+		// A block is only trusted to be stored as recorded when every one of
+		// its files is still there, and on every replica of a MirrorStore
+		current, ok := remote[block.Name]
+		ok = ok && current.Size == block.Size && hexChecksumsEqual(current.Checksum, block.Checksum) && replicatedEverywhere(store, current)
+		for _, name := range files {
+			wanted[name] = true
+			ok = ok && stored[name]
+		}
+		if ok {
+			block.Replicas = current.Replicas
+			result.Unchanged++
+			continue
+		}
+		for _, name := range files {
+			if p.opts.DryRun {
+				info, err := os.Stat(filepath.Join(archiveDir, name))
+				if err != nil {
+					return nil, fmt.Errorf("error reading block %s: %w", name, err)
+				}
+				result.Uploaded = append(result.Uploaded, name)
+				result.UploadedBytes += info.Size()
+				continue
+			}
+			size, err := p.putFile(store, name, filepath.Join(archiveDir, name))
+			if err != nil {
+				return nil, fmt.Errorf("error uploading block %s: %w", name, err)
+			}
+			result.Uploaded = append(result.Uploaded, name)
+			result.UploadedBytes += size
+		}
+		block.Replicas = storedOn(store, files)
+	}
+	if !p.opts.DryRun {
+		if err := putManifest(store, local); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.opts.DeleteExtraneous {
+		for _, name := range names {
+			if wanted[name] {
+				continue
+			}
+			if !p.opts.DryRun {
+				if err := store.Delete(name); err != nil {
+					return nil, fmt.Errorf("error deleting %s from store: %w", name, err)
+				}
+			}
+			result.Deleted = append(result.Deleted, name)
+		}
+	}
+	if p.opts.DryRun {
+		return result, nil
+	}
+	p.logger().Info("Archive synced", "uploaded", len(result.Uploaded), "uploaded_bytes", result.UploadedBytes,
+		"unchanged", result.Unchanged, "deleted", len(result.Deleted))
+	return result, nil
+}
+
+// getManifest downloads the manifest of the blocks in the store
+func getManifest(store BlockStore) (*Manifest, error) {
+	rc, err := store.Get(manifestFileName)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading manifest: %w", err)
+	}
+	defer rc.Close()
+	m, err := readManifest(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest from store: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,274 @@
+package packer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// streamMagic starts every single stream archive
+var streamMagic = [4]byte{'B', 'M', 'S', 'T'}
+
+// A stream archive is the stream magic followed by one frame per block. Each
+// frame is the block length (8 bytes) followed by the block exactly as it
+// would be written to a .beam file, and a zero length frame ends the stream
+
+// streamBlockFlags are the footer flags of every block in a stream. Frames are
+// read front to back, so the metadata layout cannot depend on the footer
+const streamBlockFlags = footerFlagBirthTime
+
+func (p defaultPacker) PackStream(inputDir string, w io.Writer) (err error) {
+	p.checkChanges = true
+	if p.opts.Format != FormatBeam {
+		return fmt.Errorf("stream archives are always written as .beam blocks: %w", ErrInvalidOption)
+	}
+	if p.encryptsMetadata() {
+		return fmt.Errorf("stream archives cannot encrypt their metadata: %w", ErrInvalidOption)
+	}
+	if p.opts.Compression != CompressionNone {
+		return fmt.Errorf("stream archives store their files uncompressed, their sizes are written ahead of them: %w", ErrInvalidOption)
+	}
+	if p.opts.VolumeSize > 0 {
+		return fmt.Errorf("stream archives are a single stream, they are not split into volumes: %w", ErrInvalidOption)
+	}
+	if p.scansPack() {
+		return fmt.Errorf("stream archives write the checksums of their files ahead of them, files cannot be scanned as they are packed: %w", ErrInvalidOption)
+	}
+	if p.opts.Transform != nil {
+		return fmt.Errorf("stream archives write the sizes of their files ahead of them, transformed sizes are only known once read: %w", ErrInvalidOption)
+	}
+	if p.opts.SpecialFiles == SpecialFileRecord {
+		return fmt.Errorf("stream archives have no room for the device numbers of special files: %w", ErrInvalidOption)
+	}
+
+	frozen, err := p.freezeSource(inputDir)
+	if err != nil {
+		return err
+	}
+	defer frozen.close(p.logger())
+	p.frozen = frozen
+	fileInfos, err := p.planFiles(inputDir)
+	if err != nil {
+		return err
+	}
+	p.opts.BlockSize = p.blockSizeFor(fileSizes(fileInfos))
+
+	p.progress.start("pack", len(fileInfos), totalBytes(fileInfos))
+	defer func() { p.progress.finish(err) }()
+
+	bw := bufio.NewWriterSize(w, p.stripeSize())
+	if _, err := bw.Write(streamMagic[:]); err != nil {
+		return fmt.Errorf("error writing stream header: %w", err)
+	}
+
+	err = p.packFiles(fileInfos, 1, func(block *Block) error {
+		// The metadata precedes the data in a stream, so checksums are needed up front
+		if err := p.hashBlockFiles(block, p.sourceOpener()); err != nil {
+			return err
+		}
+
+		header, err := p.encodeBlockHeader(block, streamBlockFlags)
+		if err != nil {
+			return err
+		}
+
+		// Write frame length, the block size is known before any data is written
+		length := int64(len(header)) + block.Size + blockFooterSize
+		block.length = length
+		if err := binary.Write(bw, binary.LittleEndian, length); err != nil {
+			return fmt.Errorf("error writing frame length: %w", err)
+		}
+		if err := p.writeBlockTo(bw, block, p.sourceOpener()); err != nil {
+			return fmt.Errorf("error writing block %d: %w", block.ID, err)
+		}
+		p.progress.blockWritten(block, p.opts.BlockSize)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write end of stream marker
+	if err := binary.Write(bw, binary.LittleEndian, int64(0)); err != nil {
+		return fmt.Errorf("error writing end of stream: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	// Streams written to a file are flushed with any policy, pipes and
+	// other writers are left alone
+	if f, ok := w.(*os.File); ok && p.opts.SyncPolicy != SyncNone {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return f.Sync()
+		}
+	}
+	return nil
+}
+
+func (p defaultPacker) UnpackStream(r io.Reader, outputDir string, patterns ...string) (err error) {
+	if err := validatePatterns(patterns); err != nil {
+		return err
+	}
+	if err := p.checkUnpackScan("stream archives"); err != nil {
+		return err
+	}
+	if p.opts.AtomicUnpack {
+		return p.unpackAtomically(outputDir, func(p defaultPacker, dir string) error {
+			return p.UnpackStream(r, dir, patterns...)
+		})
+	}
+	if err := p.checkSyncPolicy(); err != nil {
+		return err
+	}
+	if err := p.checkOverwritePolicy(); err != nil {
+		return err
+	}
+
+	// The contents of a stream are only known once they have been read
+	p.progress.start("unpack", 0, 0)
+	defer func() { p.progress.finish(err) }()
+
+	br := bufio.NewReaderSize(r, p.stripeSize())
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return fmt.Errorf("error reading stream header: %w", err)
+	}
+	if magic != streamMagic {
+		return fmt.Errorf("input is not a beam stream")
+	}
+
+	for {
+		var length int64
+		if err := binary.Read(br, binary.LittleEndian, &length); err != nil {
+			return fmt.Errorf("error reading frame length: %w", err)
+		}
+		if length == 0 {
+			return p.syncs.flush()
+		}
+
+		if err := p.unpackFrame(io.LimitReader(br, length), length, outputDir, patterns); err != nil {
+			return err
+		}
+	}
+}
+
+// unpackFrame extracts the files of a single block read sequentially from a
+// stream. Every file is checked against its own checksum as it is written and
+// the block checksum is verified once the whole block has been read
+func (p defaultPacker) unpackFrame(r io.Reader, length int64, outputDir string, patterns []string) error {
+	h := newChecksum()
+	body := &countingReader{r: io.TeeReader(r, h)}
+
+	// Read block header and file metadata
+	block, err := p.readBlockHeader(body, streamBlockFlags)
+	if err != nil {
+		return err
+	}
+	dataOffset := body.n
+
+	// Extract files in the order they are stored
+	files := append([]FileMetadata(nil), block.Files...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+
+	var stats extractStats
+	verify := newVerifier(p.opts.VerifyWorkers, p.buffers)
+	for _, metadata := range files {
+		// Discard anything before the file contents
+		if gap := dataOffset + metadata.Offset - body.n; gap > 0 {
+			if _, err := io.CopyN(io.Discard, body, gap); err != nil {
+				return fmt.Errorf("error skipping to file %s: %w", metadata.Path, err)
+			}
+		}
+
+		skip := !matchAny(patterns, metadata.Path)
+		if !skip && p.opts.Resume {
+			ok, err := p.isExtracted(outputDir, &metadata)
+			if err != nil {
+				return fmt.Errorf("error checking extracted file %s: %w", metadata.Path, err)
+			}
+			if ok {
+				stats.intact++
+				p.progress.file(&metadata, true)
+				skip = true
+			}
+		}
+		if !skip {
+			keep, err := p.keepExisting(outputDir, &metadata)
+			if err != nil {
+				return fmt.Errorf("error checking existing file %s: %w", metadata.Path, err)
+			}
+			if keep {
+				stats.kept++
+				p.progress.file(&metadata, true)
+				skip = true
+			}
+		}
+		if skip {
+			if _, err := io.CopyN(io.Discard, body, metadata.storedSize()); err != nil {
+				return fmt.Errorf("error skipping file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+
+		if err := stats.record(p.extractFile(body, outputDir, &metadata, verify)); err != nil {
+			verify.wait()
+			return fmt.Errorf("error extracting file %s: %w", metadata.Path, err)
+		}
+		p.progress.file(&metadata, false)
+		p.pace.wait()
+	}
+
+	if err := verify.wait(); err != nil {
+		return err
+	}
+	verify.print(p.logger(), block.ID)
+	if err := p.syncs.blockDone(); err != nil {
+		return err
+	}
+
+	// Whatever is left of the frame is the footer
+	actualChecksum := h.Sum(nil)
+	footerBytes, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading block footer: %w", err)
+	}
+	if body.n+int64(len(footerBytes)) != length {
+		return fmt.Errorf("block %d: %w", block.ID, ErrBlockTruncated)
+	}
+	footer, err := readBlockFooter(bytes.NewReader(footerBytes), int64(len(footerBytes)))
+	if err != nil {
+		return fmt.Errorf("error reading block footer: %w", err)
+	}
+	if err := footer.checkLayout(length); err != nil {
+		return fmt.Errorf("block %d: %w", block.ID, err)
+	}
+	if !p.validator.ChecksumsEqual(footer.Checksum, actualChecksum) {
+		return &BlockIntegrityError{
+			BlockID:     int(block.ID),
+			ExpectedSum: footer.Checksum,
+			ActualSum:   actualChecksum,
+		}
+	}
+	block.Checksum = footer.Checksum
+
+	p.progress.block(block)
+	stats.print(p.logger(), "block", block.ID)
+	return nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
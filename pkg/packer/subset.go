@@ -0,0 +1,139 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// blockExtent locates the contents of a file inside an existing block file
+type blockExtent struct {
+	blockPath string
+	offset    int64
+}
+
+func (p defaultPacker) Subset(archiveDir string, outputDir string, include []string) error {
+	if len(include) == 0 {
+		return fmt.Errorf("at least one include pattern is required: %w", ErrInvalidOption)
+	}
+	if err := validatePatterns(include); err != nil {
+		return err
+	}
+
+	if filepath.Clean(archiveDir) == filepath.Clean(outputDir) {
+		return fmt.Errorf("output directory must differ from the archive directory: %w", ErrInvalidOption)
+	}
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	unlockOutput, err := p.lockArchive(outputDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlockOutput()
+
+	blockPaths, err := listBlocks(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	edits, err := loadEdits(archiveDir)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %w", err)
+	}
+
+	// Collect the matching files and where their contents live
+	var files []FileMetadata
+	extents := make(map[string]blockExtent)
+	for _, blockPath := range blockPaths {
+		if p.opts.VerifyIntegrity {
+			if err := p.validator.ValidateBlock(blockPath); err != nil {
+				return fmt.Errorf("error verifying block integrity: %w", err)
+			}
+		}
+
+		block, err := p.readBlockIndex(blockPath)
+		if err != nil {
+			return fmt.Errorf("error reading block %s: %w", filepath.Base(blockPath), err)
+		}
+		edits.apply(block)
+
+		for _, metadata := range block.Files {
+			if !matchAny(include, metadata.Path) {
+				continue
+			}
+			files = append(files, metadata)
+			extents[metadata.Path] = blockExtent{
+				blockPath: blockPath,
+				offset:    block.DataOffset + metadata.Offset,
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("%w matched the include patterns", ErrNoFiles)
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	// Contents are read straight out of the source blocks
+	open := func(metadata *FileMetadata) (io.ReadCloser, error) {
+		extent := extents[metadata.Path]
+		f, err := openBlockFile(extent.blockPath)
+		if err != nil {
+			return nil, err
+		}
+		return &sectionReadCloser{
+			SectionReader: contentSection(f, extent.offset, metadata),
+			closer:        f,
+		}, nil
+	}
+
+	sizes := make([]int64, len(files))
+	for i, metadata := range files {
+		sizes[i] = metadata.Size
+	}
+	p.opts.BlockSize = p.blockSizeFor(sizes)
+
+	blockNum := int32(1)
+	currentBlock := &Block{ID: blockNum}
+	for i, metadata := range files {
+		// If file doesnt fit in current block, write current block and start new one
+		if len(currentBlock.Files) > 0 && currentBlock.Size+metadata.Size > p.opts.BlockSize {
+			if err := p.writeBlock(currentBlock, outputDir, open); err != nil {
+				return fmt.Errorf("error writing block: %w", err)
+			}
+			blockNum++
+			currentBlock = &Block{ID: blockNum}
+		}
+
+		metadata.BlockID = blockNum
+		metadata.Offset = currentBlock.Size
+		currentBlock.Files = append(currentBlock.Files, metadata)
+		currentBlock.Size += metadata.Size
+
+		if i == len(files)-1 {
+			if err := p.writeBlock(currentBlock, outputDir, open); err != nil {
+				return fmt.Errorf("error writing block: %w", err)
+			}
+		}
+	}
+
+	p.logger().Info("Wrote subset", "files", len(files), "blocks", blockNum)
+	return p.writeManifest(outputDir)
+}
+
+// sectionReadCloser closes the underlying file of a section reader
+type sectionReadCloser struct {
+	*io.SectionReader
+	closer io.Closer
+}
+
+func (s *sectionReadCloser) Close() error {
+	return s.closer.Close()
+}
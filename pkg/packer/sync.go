@@ -0,0 +1,190 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// SyncPolicy selects when written files are flushed to disk, trading speed
+// for what survives a crash or power loss
+type SyncPolicy int
+
+const (
+	SyncNone     SyncPolicy = iota // Leave flushing to the operating system, the default
+	SyncFinal                      // Flush the blocks or extracted files written and their directories once at the end of each operation
+	SyncPerBlock                   // Flush each block before it is named and its directory after, and the files extracted from each block once it is done
+	SyncPerFile                    // As SyncPerBlock, and flush every extracted file and its directory before the next one is written
+)
+
+// reopenSync tells whether a file can be flushed by opening it again once it
+// is closed. Windows needs write access to flush a file, which files restored
+// read-only no longer grant, so files are flushed before they are closed there
+var reopenSync = runtime.GOOS != "windows"
+
+// syncLog flushes the files written by the operations of a packer according
+// to its SyncPolicy, deferring those that can wait until flush
+type syncLog struct {
+	policy SyncPolicy
+
+	mu    sync.Mutex
+	files []string        // Files written but not flushed yet
+	dirs  map[string]bool // Directories of the files, flushed after them
+}
+
+func newSyncLog(policy SyncPolicy) *syncLog {
+	return &syncLog{policy: policy, dirs: make(map[string]bool)}
+}
+
+// checkSyncPolicy rejects sync policies this version does not know
+func (p defaultPacker) checkSyncPolicy() error {
+	switch p.opts.SyncPolicy {
+	case SyncNone, SyncFinal, SyncPerBlock, SyncPerFile:
+		return nil
+	}
+	return fmt.Errorf("unknown sync policy %d: %w", p.opts.SyncPolicy, ErrInvalidOption)
+}
+
+// block is called with a block file once it is written and before it is
+// renamed. With SyncPerBlock or SyncPerFile the block is flushed before it
+// gets its name, and the name after
+func (s *syncLog) block(f *os.File) error {
+	if s.policy < SyncPerBlock {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error flushing block: %w", err)
+	}
+	return nil
+}
+
+// named is called once a block was renamed to path
+func (s *syncLog) named(path string) error {
+	switch {
+	case s.policy >= SyncPerBlock:
+		return syncDir(filepath.Dir(path))
+	case s.policy == SyncFinal:
+		s.add(path)
+	}
+	return nil
+}
+
+// written is called with a file that was written and closed, such as a
+// manifest. Any policy but SyncNone flushes it, SyncFinal at the end
+func (s *syncLog) written(path string) error {
+	switch {
+	case s.policy >= SyncPerBlock:
+		if err := syncFile(path); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(path))
+	case s.policy == SyncFinal:
+		s.add(path)
+	}
+	return nil
+}
+
+// extracted is called with an extracted file once its contents are written
+func (s *syncLog) extracted(f *os.File, path string) error {
+	if s.policy == SyncNone {
+		return nil
+	}
+	if s.policy < SyncPerFile && reopenSync {
+		s.add(path)
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error flushing file: %w", err)
+	}
+	if s.policy < SyncPerFile {
+		s.addDir(filepath.Dir(path))
+		return nil
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// blockDone is called once the files of a block were extracted
+func (s *syncLog) blockDone() error {
+	if s.policy != SyncPerBlock {
+		return nil
+	}
+	return s.flush()
+}
+
+func (s *syncLog) add(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, path)
+	s.dirs[filepath.Dir(path)] = true
+}
+
+func (s *syncLog) addDir(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirs[dir] = true
+}
+
+// flush flushes the files written so far and then their directories, it is
+// called at the end of every operation that writes files
+func (s *syncLog) flush() error {
+	if s.policy == SyncNone {
+		return nil
+	}
+	s.mu.Lock()
+	files, dirs := s.files, s.dirs
+	s.files, s.dirs = nil, make(map[string]bool)
+	s.mu.Unlock()
+
+	// Files an operation removed again, such as staged blocks, are skipped
+	for _, path := range files {
+		if err := syncFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile flushes a file that was already closed. Only files the packer
+// can still write are flushed this way on Windows
+func syncFile(path string) error {
+	flag := os.O_RDONLY
+	if !reopenSync {
+		flag = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return fmt.Errorf("error flushing file: %w", err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error flushing file: %w", err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory so the names created in it survive a crash.
+// Windows cannot open directories for flushing and some filesystems refuse
+// to flush them, their names are left to the operating system
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error flushing directory: %w", err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return fmt.Errorf("error flushing directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package packer
+
+// TagRule gives tags to the archived files whose path matches a pattern.
+// Tags are free form name and value pairs, such as ticket=ABC-123 or
+// retention=7y, kept in the manifest rather than the blocks
+type TagRule struct {
+	Pattern string            // Glob pattern of archived paths as for Unpack
+	Tags    map[string]string // Tags given to the matching files, replacing their tags of the same name
+}
+
+// applyTags gives the files of a manifest the tags of every rule their path
+// matches, later rules replacing the tags of earlier ones
+func (m *Manifest) applyTags(rules []TagRule) error {
+	for _, rule := range rules {
+		if err := validatePatterns([]string{rule.Pattern}); err != nil {
+			return err
+		}
+	}
+	for i := range m.Files {
+		file := &m.Files[i]
+		for _, rule := range rules {
+			if file.Deleted || !matchPattern(rule.Pattern, file.Path) {
+				continue
+			}
+			tags := make(map[string]string, len(file.Tags)+len(rule.Tags))
+			for name, value := range file.Tags {
+				tags[name] = value
+			}
+			for name, value := range rule.Tags {
+				tags[name] = value
+			}
+			file.Tags = tags
+		}
+	}
+	return nil
+}
+
+// matchTags reports whether tags hold every wanted tag, an empty wanted value
+// matching any value of the tag
+func matchTags(tags map[string]string, want map[string]string) bool {
+	for name, value := range want {
+		got, ok := tags[name]
+		if !ok || (value != "" && got != value) {
+			return false
+		}
+	}
+	return true
+}
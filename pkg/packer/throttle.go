@@ -0,0 +1,188 @@
+package packer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DestinationLimit throttles the files extracted below a destination path, so
+// restoring onto a shared filesystem does not starve the services using it
+type DestinationLimit struct {
+	Prefix         string // Destination path the limit applies to, including everything below it
+	BytesPerSecond int64  // Maximum combined write rate below the prefix, 0 for unlimited
+	MaxWriters     int    // Maximum number of files written below the prefix at once, 0 for unlimited
+}
+
+// rateBurst is how far a MaxBytesPerSecond schedule may fall behind, letting
+// that much unused time be caught up on at once
+const rateBurst = 250 * time.Millisecond
+
+// rateLimiter spreads reads or writes out so they do not exceed a byte rate.
+// Callers reserve time on a shared schedule and sleep until their slot comes
+// up. A schedule allowed to fall burst behind the clock is a token bucket
+// holding burst worth of bytes
+type rateLimiter struct {
+	bytesPerSecond int64
+	burst          time.Duration
+
+	mu   sync.Mutex
+	next time.Time // Time at which the schedule is free again
+}
+
+func newRateLimiter(bytesPerSecond int64, burst time.Duration) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, burst: burst}
+}
+
+// wait blocks until n more bytes may be transferred
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-l.burst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledWriter paces writes to w through a rate limiter
+type throttledWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	t.limiter.wait(len(b))
+	return t.w.Write(b)
+}
+
+// throttledReader paces reads from r through a rate limiter
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	if n > 0 {
+		t.limiter.wait(n)
+	}
+	return n, err
+}
+
+// throttledReadSeeker is a throttledReader keeping the Seek of its source,
+// so a store can read a block again to retry its upload
+type throttledReadSeeker struct {
+	throttledReader
+	s io.Seeker
+}
+
+func (t *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return t.s.Seek(offset, whence)
+}
+
+// throttleReader paces reads from r by MaxBytesPerSecond
+func (p defaultPacker) throttleReader(r io.Reader) io.Reader {
+	if p.rate == nil {
+		return r
+	}
+	if s, ok := r.(io.Seeker); ok {
+		return &throttledReadSeeker{throttledReader{r: r, limiter: p.rate}, s}
+	}
+	return &throttledReader{r: r, limiter: p.rate}
+}
+
+// throttleWriter paces writes to w by MaxBytesPerSecond, on the schedule
+// reads draw on too
+func (p defaultPacker) throttleWriter(w io.Writer) io.Writer {
+	if p.rate == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limiter: p.rate}
+}
+
+// destinationLimiter enforces one DestinationLimit
+type destinationLimiter struct {
+	prefix  string
+	limiter *rateLimiter
+	writers chan struct{} // Holds a token for every file being written, nil when unlimited
+}
+
+// acquire waits until another file may be written below the prefix and
+// returns the function releasing it again
+func (d *destinationLimiter) acquire() func() {
+	if d.writers == nil {
+		return func() {}
+	}
+	d.writers <- struct{}{}
+	return func() { <-d.writers }
+}
+
+// writer wraps w so writes below the prefix share its rate limit
+func (d *destinationLimiter) writer(w io.Writer) io.Writer {
+	if d.limiter == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limiter: d.limiter}
+}
+
+// destinationLimits holds the limiters of every configured destination. It is
+// shared by copies of the packer so concurrent unpacks respect the same limits
+type destinationLimits []*destinationLimiter
+
+func newDestinationLimits(limits []DestinationLimit) destinationLimits {
+	var d destinationLimits
+	for _, limit := range limits {
+		prefix, err := filepath.Abs(limit.Prefix)
+		if err != nil {
+			prefix = filepath.Clean(limit.Prefix)
+		}
+		limiter := &destinationLimiter{prefix: prefix, limiter: newRateLimiter(limit.BytesPerSecond, 0)}
+		if limit.MaxWriters > 0 {
+			limiter.writers = make(chan struct{}, limit.MaxWriters)
+		}
+		d = append(d, limiter)
+	}
+	return d
+}
+
+// match returns the limiter with the longest prefix containing path, nil when
+// no limit applies
+func (d destinationLimits) match(path string) *destinationLimiter {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	var best *destinationLimiter
+	for _, limiter := range d {
+		if !withinDir(limiter.prefix, abs) {
+			continue
+		}
+		if best == nil || len(limiter.prefix) > len(best.prefix) {
+			best = limiter
+		}
+	}
+	return best
+}
+
+// withinDir reports whether path is dir or lies below it
+func withinDir(dir string, path string) bool {
+	if path == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(os.PathSeparator)) {
+		dir += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, dir)
+}
@@ -0,0 +1,197 @@
+package packer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Block format versions. Blocks carry no version number, their footer flags
+// tell the layouts apart: version 1 blocks store the metadata section between
+// the header and the data section, version 2 blocks after the data section
+// with footerFlagTrailingMetadata. Readers take every version, writers only
+// write the current one, and Upgrade rewrites the older blocks of an archive.
+// Blocks of later versions set flags this version does not know and are
+// rejected with ErrUnsupportedVersion
+const (
+	blockVersionLeading  = 1
+	blockVersionTrailing = 2
+	currentBlockVersion  = blockVersionTrailing
+)
+
+// blockVersion returns the format version of a block with the given footer flags
+func blockVersion(flags uint32) int {
+	if flags&footerFlagTrailingMetadata == 0 {
+		return blockVersionLeading
+	}
+	return blockVersionTrailing
+}
+
+// UpgradeResult reports how Upgrade changed an archive
+type UpgradeResult struct {
+	Upgraded []string // Blocks rewritten in the current version, by their new names
+	Current  []string // Blocks already in the current version
+}
+
+// Upgrade rewrites the blocks of an archive written in an older version of
+// the format in the current one. Every file is copied with its checksum
+// verified, each new block replaces its old one once it is complete, and the
+// manifest, snapshots and parity are updated to the new locations. Archives
+// mixing versions stay readable throughout
+func (p defaultPacker) Upgrade(archiveDir string) (*UpgradeResult, error) {
+	unlock, err := p.lockArchive(archiveDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if p.opts.Format != FormatBeam {
+		return nil, fmt.Errorf("only .beam archives can be upgraded: %w", ErrInvalidOption)
+	}
+	refs, err := loadReferences(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if p.dictionary, err = latestDictionary(archiveDir); err != nil {
+		return nil, err
+	}
+	blockPaths, err := listBlocks(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// New blocks are written next to the archive first, as an open block
+	// cannot be replaced on every platform
+	staging, err := os.MkdirTemp(archiveDir, ".upgrade-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	result := &UpgradeResult{}
+	moved := make(map[extentKey]extentKey)
+	blocks := make(map[int32]ManifestBlock, len(blockPaths))
+	var upgraded []int32
+	for _, blockPath := range blockPaths {
+		block, ok, err := p.upgradeBlock(archiveDir, staging, blockPath, moved)
+		if err != nil {
+			return nil, fmt.Errorf("error upgrading block %s: %w", filepath.Base(blockPath), err)
+		}
+		blocks[block.ID] = block
+		if !ok {
+			result.Current = append(result.Current, block.Name)
+			continue
+		}
+		result.Upgraded = append(result.Upgraded, block.Name)
+		upgraded = append(upgraded, block.ID)
+	}
+	if len(upgraded) == 0 {
+		p.logger().Info("Archive is already in the current format", "blocks", len(result.Current))
+		return result, nil
+	}
+
+	// The manifest keeps the files removed or renamed by their location, so
+	// it is pointed at the moved contents before it is rebuilt
+	manifestPath := filepath.Join(archiveDir, manifestFileName)
+	m, err := readManifestFile(manifestPath)
+	if err == nil {
+		err = m.relocate(moved, blocks)
+	}
+	if err == nil {
+		err = writeManifestFile(manifestPath, m)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error updating manifest: %w", err)
+	}
+	for _, ref := range refs {
+		if err := ref.manifest.relocate(moved, blocks); err != nil {
+			return nil, err
+		}
+		if err := writeManifestFile(ref.path, ref.manifest); err != nil {
+			return nil, fmt.Errorf("error updating snapshot %d: %w", ref.manifest.Generation, err)
+		}
+	}
+
+	if err := p.rewriteParity(archiveDir, upgraded); err != nil {
+		return nil, err
+	}
+	if err := p.writeManifest(archiveDir); err != nil {
+		return nil, err
+	}
+	p.logger().Info("Upgraded archive", "blocks_upgraded", len(result.Upgraded), "blocks_current", len(result.Current))
+	return result, nil
+}
+
+// upgradeBlock writes a block of an older version again in the current one
+// through the staging directory, recording where the contents of its files
+// moved. Blocks already in the current version are left as they are
+func (p defaultPacker) upgradeBlock(archiveDir string, staging string, blockPath string, moved map[extentKey]extentKey) (ManifestBlock, bool, error) {
+	f, err := openBlockFile(blockPath)
+	if err != nil {
+		return ManifestBlock{}, false, fmt.Errorf("error opening block file: %w", err)
+	}
+	defer f.Close()
+	footer, err := readBlockFooter(f, f.Size())
+	if err != nil {
+		return ManifestBlock{}, false, fmt.Errorf("error reading block footer: %w", err)
+	}
+	block, err := p.readBlockIndexAt(f, f.Size())
+	if err != nil {
+		return ManifestBlock{}, false, err
+	}
+	if blockVersion(footer.Flags) == currentBlockVersion {
+		return ManifestBlock{
+			ID:       block.ID,
+			Name:     filepath.Base(blockPath),
+			Size:     f.Size(),
+			Checksum: hex.EncodeToString(block.Checksum),
+			Volumes:  f.manifest(),
+		}, false, nil
+	}
+
+	// The data section now starts right after the header, files keep their
+	// order within it
+	dataOffset := block.DataOffset
+	offsets := make([]int64, len(block.Files))
+	for i := range block.Files {
+		offsets[i] = block.Files[i].Offset
+	}
+	open := func(metadata *FileMetadata) (io.ReadCloser, error) {
+		return io.NopCloser(contentSection(f, dataOffset+metadata.Offset, metadata)), nil
+	}
+	if err := p.writeBlock(block, staging, open); err != nil {
+		return ManifestBlock{}, false, err
+	}
+	if len(block.Files) != len(offsets) {
+		return ManifestBlock{}, false, fmt.Errorf("%d of %d files copied: %w", len(block.Files), len(offsets), ErrCorrupted)
+	}
+	for i := range block.Files {
+		moved[extentKey{block.ID, dataOffset + offsets[i]}] = extentKey{block.ID, blockHeaderSize + block.Files[i].Offset}
+	}
+	if err := f.Close(); err != nil {
+		return ManifestBlock{}, false, err
+	}
+
+	// The new block replaces the old one, which is only removed separately
+	// when the naming scheme gives the new block another name
+	path := filepath.Join(archiveDir, block.fileName)
+	if err := renameBlock(filepath.Join(staging, block.fileName), path); err != nil {
+		return ManifestBlock{}, false, fmt.Errorf("error replacing block: %w", err)
+	}
+	if path != blockPath {
+		if err := removeBlock(blockPath); err != nil {
+			return ManifestBlock{}, false, fmt.Errorf("error removing old block: %w", err)
+		}
+	}
+	p.logger().Debug("Upgraded block", "block", block.ID, "name", block.fileName,
+		"from_version", blockVersion(footer.Flags), "to_version", currentBlockVersion)
+	return ManifestBlock{
+		ID:       block.ID,
+		Name:     block.fileName,
+		Size:     block.length,
+		Checksum: hex.EncodeToString(block.Checksum),
+		Volumes:  block.volumes,
+	}, true, nil
+}
@@ -0,0 +1,89 @@
+package packer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeMixedVersions(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "archive")
+	writeTree(t, archive, readTree(t, filepath.Join(vectorsDir, "mixed-versions", "archive")))
+	p := NewPacker(PackerOptions{})
+
+	fingerprint, err := p.Fingerprint(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := filepath.Join(t.TempDir(), "before")
+	if err := p.Unpack(archive, before); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := p.Upgrade(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Upgraded) == 0 || len(result.Current) == 0 {
+		t.Fatalf("upgraded %q and kept %q, want blocks of both versions", result.Upgraded, result.Current)
+	}
+	if err := p.Verify(archive); err != nil {
+		t.Fatalf("upgraded archive does not verify: %v", err)
+	}
+
+	blockPaths, err := listBlocks(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, blockPath := range blockPaths {
+		data, err := os.ReadFile(blockPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		footer, err := readBlockFooter(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if footer.Flags&footerFlagTrailingMetadata == 0 {
+			t.Errorf("%s is still in version %d", filepath.Base(blockPath), blockVersion(footer.Flags))
+		}
+		names = append(names, filepath.Base(blockPath))
+	}
+	upgraded := append(result.Upgraded, result.Current...)
+	sort.Strings(upgraded)
+	if strings.Join(upgraded, ",") != strings.Join(names, ",") {
+		t.Errorf("upgrade reported blocks %q, archive holds %q", upgraded, names)
+	}
+
+	if got, err := p.Fingerprint(archive); err != nil || got != fingerprint {
+		t.Errorf("fingerprint changed from %s to %s (%v)", fingerprint, got, err)
+	}
+	after := filepath.Join(t.TempDir(), "after")
+	if err := p.Unpack(archive, after); err != nil {
+		t.Fatal(err)
+	}
+	want, got := readTree(t, before), readTree(t, after)
+	if len(got) != len(want) {
+		t.Errorf("unpacked %d files after upgrading, %d before", len(got), len(want))
+	}
+	for name, data := range want {
+		if !bytes.Equal(got[name], data) {
+			t.Errorf("%s changed by upgrading", name)
+		}
+	}
+
+	// Upgrading again finds nothing left to do
+	contents := readTree(t, archive)
+	result, err = p.Upgrade(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Upgraded) != 0 || len(result.Current) != len(names) {
+		t.Errorf("second upgrade rewrote %q and kept %d blocks, want none rewritten and %d kept", result.Upgraded, len(result.Current), len(names))
+	}
+	assertUnchanged(t, archive, contents)
+}
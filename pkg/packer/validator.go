@@ -0,0 +1,163 @@
+package packer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BlockIntegrityError reports a block whose contents do not match its checksum
+type BlockIntegrityError struct {
+	BlockID     int
+	ExpectedSum []byte
+	ActualSum   []byte
+}
+
+func (e *BlockIntegrityError) Error() string {
+	return fmt.Sprintf("block %d checksum mismatch: expected %x, got %x", e.BlockID, e.ExpectedSum, e.ActualSum)
+}
+
+func (e *BlockIntegrityError) Is(target error) bool { return target == ErrCorrupted }
+
+// FileIntegrityError reports a file whose contents do not match its archived checksum
+type FileIntegrityError struct {
+	Path        string
+	ExpectedSum []byte
+	ActualSum   []byte
+}
+
+func (e *FileIntegrityError) Error() string {
+	return fmt.Sprintf("file %s checksum mismatch: expected %x, got %x", e.Path, e.ExpectedSum, e.ActualSum)
+}
+
+func (e *FileIntegrityError) Is(target error) bool { return target == ErrCorrupted }
+
+// ExtractedFilesError lists the differences between an archive and the files
+// extracted from it, each list sorted by path
+type ExtractedFilesError struct {
+	Mismatched []*FileIntegrityError // Files whose contents do not match the archived checksum
+	Missing    []string              // Archived files absent from the output directory
+	Extra      []string              // Files in the output directory that are not in the archive
+}
+
+func (e *ExtractedFilesError) Error() string {
+	return fmt.Sprintf("extracted files differ from archive: %d mismatched, %d missing, %d extra",
+		len(e.Mismatched), len(e.Missing), len(e.Extra))
+}
+
+// Is matches ErrCorrupted when any extracted file has the wrong contents
+func (e *ExtractedFilesError) Is(target error) bool {
+	return target == ErrCorrupted && len(e.Mismatched) > 0
+}
+
+// Validator computes and checks the SHA-256 checksums of files and blocks
+type Validator struct {
+	buffers *bufferPool
+}
+
+// NewValidator returns a Validator reading through buffers of bufferSize bytes
+func NewValidator(bufferSize int) *Validator {
+	return &Validator{
+		buffers: newBufferPool(bufferSize),
+	}
+}
+
+// VerifyFileIntegrity checks the file at path against expectedSum, returning a
+// *FileIntegrityError on mismatch
+func (v *Validator) VerifyFileIntegrity(path string, expectedSum []byte) error {
+	actualSum, err := v.CalculateFileChecksum(path)
+	if err != nil {
+		return fmt.Errorf("error calculating checksum: %w", err)
+	}
+	if !v.ChecksumsEqual(expectedSum, actualSum) {
+		return &FileIntegrityError{
+			Path:        path,
+			ExpectedSum: expectedSum,
+			ActualSum:   actualSum,
+		}
+	}
+	return nil
+}
+
+// CalculateFileChecksum returns the SHA-256 checksum of the file at path.
+// Special files such as named pipes and device nodes are archived without
+// contents, they have the checksum of empty contents and are never opened
+func (v *Validator) CalculateFileChecksum(path string) ([]byte, error) {
+	if info, err := os.Stat(path); err == nil && isSpecialMode(uint32(info.Mode())) {
+		return newChecksum().Sum(nil), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+
+	return v.CalculateReaderChecksum(f)
+}
+
+// CalculateReaderChecksum returns the SHA-256 checksum of everything read from r
+func (v *Validator) CalculateReaderChecksum(r io.Reader) ([]byte, error) {
+	h := newChecksum()
+	if _, err := v.buffers.copy(h, r); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// ValidateBlock checks a block file against the checksum in its footer, returning a
+// *BlockIntegrityError on mismatch
+func (v *Validator) ValidateBlock(blockPath string) error {
+	f, err := openBlockFile(blockPath)
+	if err != nil {
+		return fmt.Errorf("error opening block file: %w", err)
+	}
+	defer f.Close()
+	return v.validateBlockAt(f, f.Size())
+}
+
+// validateBlockAt checks a block of the given size read through f against the
+// checksum in its footer, after checking the block is whole: its footer ends
+// the block and its sections are as long as recorded
+func (v *Validator) validateBlockAt(f io.ReaderAt, size int64) error {
+	var blockID int32
+	if err := binary.Read(io.NewSectionReader(f, 0, size), binary.LittleEndian, &blockID); err != nil {
+		return fmt.Errorf("error reading block ID: %w", err)
+	}
+
+	footer, err := readBlockFooter(f, size)
+	if errors.Is(err, ErrBlockTruncated) {
+		if end, ok := findBlockFooter(f, size); ok {
+			return fmt.Errorf("%d bytes after the footer of block %d: %w", size-end, blockID, ErrTrailingData)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error reading block footer: %w", err)
+	}
+	if err := footer.checkLayout(size); err != nil {
+		return fmt.Errorf("block %d: %w", blockID, err)
+	}
+	storedChecksum := footer.Checksum
+
+	h := newChecksum()
+	if _, err := v.buffers.copyN(h, io.NewSectionReader(f, 0, size), size-footer.Length); err != nil {
+		return fmt.Errorf("error calculating checksum: %w", err)
+	}
+
+	actualChecksum := h.Sum(nil)
+
+	if !v.ChecksumsEqual(storedChecksum, actualChecksum) {
+		return &BlockIntegrityError{
+			BlockID:     int(blockID),
+			ExpectedSum: storedChecksum,
+			ActualSum:   actualChecksum,
+		}
+	}
+	return nil
+}
+
+// ChecksumsEqual reports whether two checksums are identical, in constant time
+func (v *Validator) ChecksumsEqual(a, b []byte) bool {
+	return checksumsEqual(a, b)
+}
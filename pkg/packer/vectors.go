@@ -0,0 +1,399 @@
+package packer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing/fstest"
+	"time"
+)
+
+// TestVector is a small archive exercising one feature of the format, for
+// checking that other implementations read archives the way this package
+// writes them. Write packs it into a directory together with a description
+// of the files expected back, and Check reads such a directory with this
+// package
+type TestVector struct {
+	Name        string           // Name of the directory the vector is written to
+	Description string           // Feature of the format the vector exercises
+	Stream      bool             // Written as a single stream archive instead of a directory of blocks
+	Mixed       bool             // Every other block is written in the version 1 layout, as older versions did
+	Options     PackerOptions    // Options the archive is packed with, keys and passphrases also read it
+	Files       []TestVectorFile // Files packed into the archive and expected back from it
+}
+
+// TestVectorFile is a file of a TestVector
+type TestVectorFile struct {
+	Path    string      // Archived path
+	Data    []byte      // Contents
+	Mode    fs.FileMode // Permission bits
+	ModTime time.Time   // Modification time, whole seconds as the format records it
+}
+
+// testVectorEntry is the JSON form of a file in vector.json
+type testVectorEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Mode     uint32    `json:"mode"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum"`
+}
+
+// testVectorInfo is the JSON form of vector.json, which describes a written
+// vector to readers in other languages
+type testVectorInfo struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Archive     string            `json:"archive"`                // Directory of blocks or stream file, relative to vector.json
+	MetadataKey string            `json:"metadata_key,omitempty"` // Hex encoded AES-256 key of encrypted metadata
+	Passphrase  string            `json:"passphrase,omitempty"`   // Passphrase sealing the metadata key
+	Files       []testVectorEntry `json:"files"`                  // Files sorted by path
+}
+
+// testVectorTime is the modification time of every vector file
+var testVectorTime = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// TestVectors returns the test vectors of this version of the format. Every
+// vector is packed from the same files by Write, and packed the same way on
+// every run except for the encrypted ones, whose keys and nonces are random,
+// and the one with a dictionary, as zstd does not train the same dictionary
+// twice
+func TestVectors() []TestVector {
+	files := []TestVectorFile{
+		testVectorFile("hello.txt", []byte("Hello, beam!\n"), 0644),
+		testVectorFile("empty", nil, 0600),
+		testVectorFile("docs/readme.md", []byte("# Test vectors\n\nEvery file is expected back as it was packed.\n"), 0644),
+		testVectorFile("docs/nested/deep/data.bin", testVectorData("data", 10000), 0640),
+		testVectorFile("unicode/grüße-日本.txt", []byte("non ASCII path\n"), 0644),
+		testVectorFile("tools/run.sh", []byte("#!/bin/sh\necho run\n"), 0755),
+	}
+
+	// Runs of zeros long enough to be left out with ZeroRunEncoding
+	zeros := append(testVectorData("head", 3000), make([]byte, 3*minZeroRun)...)
+	zeros = append(zeros, testVectorData("tail", 1000)...)
+	zeroFiles := append(files[:len(files):len(files)],
+		testVectorFile("zeros/middle.bin", zeros, 0644),
+		testVectorFile("zeros/all.bin", make([]byte, 2*minZeroRun), 0644),
+	)
+
+	// Text that compresses next to files stored by their extension or entropy
+	text := bytes.Repeat([]byte("Every file is expected back as it was packed.\n"), 100)
+	compressFiles := append(files[:len(files):len(files)],
+		testVectorFile("compress/text.txt", text, 0644),
+		testVectorFile("compress/photo.jpg", text, 0644),
+	)
+
+	// Small records of one kind, enough to train a dictionary on
+	dictionaryFiles := files[:len(files):len(files)]
+	for i := 0; i < 2*minDictionarySamples; i++ {
+		record := fmt.Sprintf(`{"id": %d, "name": "record-%02d", "status": "active", "tags": ["beam", "vector"], "checksum": "%x"}`+"\n",
+			i, i, testVectorData(fmt.Sprint("record", i), 8))
+		dictionaryFiles = append(dictionaryFiles, testVectorFile(fmt.Sprintf("records/%02d.json", i), []byte(record), 0644))
+	}
+
+	var multiBlock []TestVectorFile
+	for i := 0; i < 12; i++ {
+		multiBlock = append(multiBlock, testVectorFile(fmt.Sprintf("blocks/file-%02d.bin", i), testVectorData(fmt.Sprint(i), 1500+i*100), 0644))
+	}
+
+	key := sha256.Sum256([]byte("beam test vector metadata key"))
+	return []TestVector{
+		{Name: "basic", Description: "Fixed width metadata records after the data section", Files: files},
+		{Name: "multi-block", Description: "Files spread over several blocks of 4KB", Options: PackerOptions{BlockSize: 4096}, Files: multiBlock},
+		{Name: "mixed-versions", Description: "Blocks of version 1, without footer flag bit 0, next to blocks of version 2", Mixed: true, Options: PackerOptions{BlockSize: 4096}, Files: multiBlock},
+		{Name: "zero-runs", Description: "Runs of zeros left out of the data section, footer flag bit 4", Options: PackerOptions{ZeroRunEncoding: true}, Files: zeroFiles},
+		{Name: "compact-metadata", Description: "Compact metadata records, footer flag bit 5", Options: PackerOptions{CompactMetadata: true, ZeroRunEncoding: true}, Files: zeroFiles},
+		{Name: "cbor-metadata", Description: "CBOR metadata records, footer flag bit 8", Options: PackerOptions{CBORMetadata: true, ZeroRunEncoding: true}, Files: zeroFiles},
+		{Name: "compressed", Description: "Files compressed with DEFLATE next to stored files, footer flag bit 9", Options: PackerOptions{Compression: CompressionDeflate}, Files: compressFiles},
+		{Name: "zstd-dictionary", Description: "Files compressed with zstd and a dictionary kept in the manifest, footer flag bit 9", Options: PackerOptions{Compression: CompressionZstd, TrainDictionary: true}, Files: dictionaryFiles},
+		{Name: "encrypted", Description: "Metadata encrypted with a metadata key, footer flag bit 6", Options: PackerOptions{MetadataKey: key[:]}, Files: files},
+		{Name: "passphrase", Description: "Metadata key sealed with a passphrase, footer flag bits 6 and 7", Options: PackerOptions{Passphrase: "correct horse battery staple"}, Files: files},
+		{Name: "stream", Description: "Single stream archive, metadata before the data of every block", Stream: true, Files: files},
+	}
+}
+
+func testVectorFile(name string, data []byte, mode fs.FileMode) TestVectorFile {
+	return TestVectorFile{Path: name, Data: data, Mode: mode, ModTime: testVectorTime}
+}
+
+// testVectorData returns n bytes that look random but are the same on every
+// run, derived from seed
+func testVectorData(seed string, n int) []byte {
+	var data []byte
+	for i := 0; len(data) < n; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", seed, i)))
+		data = append(data, sum[:]...)
+	}
+	return data[:n]
+}
+
+// packer returns the packer reading and writing the vector
+func (v TestVector) packer() Packer {
+	opts := v.Options
+	opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	opts.VerifyIntegrity = true
+	// The lock file would be left in the vector directory
+	opts.NoArchiveLock = true
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 32 * 1024
+	}
+	return NewPacker(opts)
+}
+
+// archiveName returns the name of the archive within the vector directory
+func (v TestVector) archiveName() string {
+	if v.Stream {
+		return "archive.bms"
+	}
+	return "archive"
+}
+
+// Write packs the vector into dir, as a directory of blocks or a stream file
+// named archive, next to vector.json describing the files expected back
+func (v TestVector) Write(dir string) error {
+	archive := filepath.Join(dir, v.archiveName())
+	if err := os.RemoveAll(archive); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating vector directory: %w", err)
+	}
+
+	fsys := make(fstest.MapFS, len(v.Files))
+	for _, file := range v.Files {
+		fsys[file.Path] = &fstest.MapFile{Data: file.Data, Mode: file.Mode, ModTime: file.ModTime}
+	}
+	if v.Stream {
+		if err := v.writeStream(archive); err != nil {
+			return fmt.Errorf("error writing vector %s: %w", v.Name, err)
+		}
+	} else if err := v.packer().PackFS(fsys, archive); err != nil {
+		return fmt.Errorf("error writing vector %s: %w", v.Name, err)
+	}
+	if v.Mixed {
+		if err := v.downgrade(archive); err != nil {
+			return fmt.Errorf("error writing vector %s: %w", v.Name, err)
+		}
+	}
+	if !v.Stream {
+		if err := clearInfo(archive); err != nil {
+			return fmt.Errorf("error writing vector %s: %w", v.Name, err)
+		}
+	}
+
+	info := testVectorInfo{
+		Name:        v.Name,
+		Description: v.Description,
+		Archive:     v.archiveName(),
+		Passphrase:  v.Options.Passphrase,
+		Files:       v.expected(),
+	}
+	if v.Options.MetadataKey != nil && v.Options.Passphrase == "" {
+		info.MetadataKey = hex.EncodeToString(v.Options.MetadataKey)
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "vector.json"), append(data, '\n'), 0644)
+}
+
+// clearInfo drops the archive info from the manifest of a vector, the time and
+// host it records only tell where the vector happened to be written
+func clearInfo(archive string) error {
+	path := filepath.Join(archive, manifestFileName)
+	m, err := readManifestFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.Info = nil
+	return writeManifestFile(path, m)
+}
+
+// writeStream packs the vector into a stream file. Streams are only packed
+// from directories, so the files are written to a temporary one first
+func (v TestVector) writeStream(path string) error {
+	src, err := os.MkdirTemp("", "beam-vector-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(src)
+	if err := v.restore(src); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := v.Options
+	opts.PathMapper = func(srcPath string) (string, bool) {
+		rel, err := filepath.Rel(src, srcPath)
+		return rel, err != nil
+	}
+	vec := v
+	vec.Options = opts
+	if err := vec.packer().PackStream(src, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// downgrade writes the blocks of the archive with an even ID again in the
+// version 1 layout, with the metadata section before the data section
+func (v TestVector) downgrade(archive string) error {
+	p := v.packer().(defaultPacker)
+	blockPaths, err := listBlocks(archive)
+	if err != nil {
+		return err
+	}
+	for _, blockPath := range blockPaths {
+		block, err := p.readBlockIndex(blockPath)
+		if err != nil {
+			return err
+		}
+		if block.ID%2 != 0 {
+			continue
+		}
+		data, err := os.ReadFile(blockPath)
+		if err != nil {
+			return err
+		}
+		open := func(metadata *FileMetadata) (io.ReadCloser, error) {
+			return io.NopCloser(contentSection(bytes.NewReader(data), block.DataOffset+metadata.Offset, metadata)), nil
+		}
+		var buf bytes.Buffer
+		if err := p.writeBlockTo(&buf, block, open); err != nil {
+			return err
+		}
+		if err := os.WriteFile(blockPath, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return p.writeManifest(archive)
+}
+
+// restore writes the files of the vector below dir
+func (v TestVector) restore(dir string) error {
+	for _, file := range v.Files {
+		path := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, file.Data, file.Mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, file.Mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, file.ModTime, file.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expected returns the files expected back from the vector sorted by path
+func (v TestVector) expected() []testVectorEntry {
+	files := make([]testVectorEntry, 0, len(v.Files))
+	for _, file := range v.Files {
+		sum := sha256.Sum256(file.Data)
+		files = append(files, testVectorEntry{
+			Path:     file.Path,
+			Size:     int64(len(file.Data)),
+			Mode:     uint32(file.Mode),
+			ModTime:  file.ModTime.UTC(),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// Check reads the vector written to dir with this package and compares the
+// files read back with the files of the vector, reporting the first one that
+// is missing, extra or different
+func (v TestVector) Check(dir string) error {
+	out, err := os.MkdirTemp("", "beam-vector-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(out)
+
+	archive := filepath.Join(dir, v.archiveName())
+	p := v.packer()
+	if v.Stream {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		err = p.UnpackStream(f, out)
+	} else {
+		err = p.Unpack(archive, out)
+	}
+	if err != nil {
+		return fmt.Errorf("vector %s: %w", v.Name, err)
+	}
+
+	expected := make(map[string]TestVectorFile, len(v.Files))
+	for _, file := range v.Files {
+		expected[file.Path] = file
+	}
+	err = filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(out, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		file, ok := expected[name]
+		if !ok {
+			return fmt.Errorf("vector %s: unexpected file %s", v.Name, name)
+		}
+		delete(expected, name)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case !bytes.Equal(data, file.Data):
+			return fmt.Errorf("vector %s: contents of %s differ", v.Name, name)
+		case !info.ModTime().Equal(file.ModTime):
+			return fmt.Errorf("vector %s: modification time of %s is %s instead of %s", v.Name, name, info.ModTime(), file.ModTime)
+		case runtime.GOOS != "windows" && info.Mode().Perm() != file.Mode.Perm():
+			return fmt.Errorf("vector %s: mode of %s is %s instead of %s", v.Name, name, info.Mode().Perm(), file.Mode.Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range v.Files {
+		if _, missing := expected[file.Path]; missing {
+			return fmt.Errorf("vector %s: file %s is missing", v.Name, file.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package packer
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// vectorsDir holds the golden vectors, written again from the root of the
+// module with go run ./cmd/beam vectors testdata/vectors
+const vectorsDir = "../../testdata/vectors"
+
+// reproducible reports whether Write packs the vector the same way on every
+// run, so its archive can be compared with the golden one byte for byte
+func (v TestVector) reproducible() bool {
+	return v.Options.MetadataKey == nil && v.Options.Passphrase == "" && !v.Options.TrainDictionary
+}
+
+func TestVectorsMatchGolden(t *testing.T) {
+	entries, err := os.ReadDir(vectorsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := TestVectors()
+	if len(entries) != len(vectors) {
+		t.Errorf("%s holds %d vectors, TestVectors returns %d", vectorsDir, len(entries), len(vectors))
+	}
+
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			golden := filepath.Join(vectorsDir, v.Name)
+			if err := v.Check(golden); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			if err := v.Write(dir); err != nil {
+				t.Fatal(err)
+			}
+			compareVectorFile(t, golden, dir, "vector.json")
+			if !v.reproducible() {
+				return
+			}
+			got := vectorFiles(t, dir)
+			want := vectorFiles(t, golden)
+			for name := range want {
+				if _, ok := got[name]; !ok {
+					t.Errorf("%s is no longer written", name)
+				}
+			}
+			for name := range got {
+				compareVectorFile(t, golden, dir, name)
+			}
+		})
+	}
+}
+
+// vectorFiles returns the paths of the files below dir relative to it
+func vectorFiles(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	files := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[rel] = true
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// compareVectorFile fails the test when a file written for a vector differs
+// from the golden one
+func compareVectorFile(t *testing.T, golden string, dir string, name string) {
+	t.Helper()
+	want, err := os.ReadFile(filepath.Join(golden, name))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden vector, write the vectors again if the format changed", name)
+	}
+}
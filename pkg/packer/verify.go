@@ -0,0 +1,139 @@
+package packer
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// verifyQueueLength is the number of chunks queued per file before the writer
+// waits for its hash worker to catch up
+const verifyQueueLength = 8
+
+// verifier checks the checksums of extracted files on a bounded pool of hash
+// workers, so writing a file to disk overlaps with hashing it and with
+// verifying the files written before it
+type verifier struct {
+	buffers *bufferPool
+	slots   chan struct{} // Limits the number of files hashed concurrently
+
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	errs     []error
+	files    int
+	hashTime time.Duration // Time spent hashing across all workers
+	waitTime time.Duration // Time the writer spent waiting on workers
+}
+
+// newVerifier creates a verifier with the given number of workers, it returns
+// nil when workers is 0 so files are verified inline
+func newVerifier(workers int, buffers *bufferPool) *verifier {
+	if workers <= 0 {
+		return nil
+	}
+	return &verifier{
+		buffers: buffers,
+		slots:   make(chan struct{}, workers),
+	}
+}
+
+// chunk is a piece of file contents queued for hashing
+type chunk struct {
+	buf *[]byte
+	n   int
+}
+
+// fileVerifier receives the contents of one file as it is written and hashes
+// them on a worker
+type fileVerifier struct {
+	v        *verifier
+	chunks   chan chunk
+	complete bool // Set before chunks is closed, false if writing the file failed
+}
+
+// begin starts verifying a file against its metadata, waiting for a free
+// worker if all of them are busy
+func (v *verifier) begin(metadata *FileMetadata) *fileVerifier {
+	start := time.Now()
+	v.slots <- struct{}{}
+	v.mu.Lock()
+	v.waitTime += time.Since(start)
+	v.mu.Unlock()
+
+	fv := &fileVerifier{v: v, chunks: make(chan chunk, verifyQueueLength)}
+	v.wg.Add(1)
+	go fv.run(metadata.Path, metadata.Checksum)
+	return fv
+}
+
+// Write queues a copy of b for hashing, the caller may reuse b straight away
+func (fv *fileVerifier) Write(b []byte) (int, error) {
+	total := len(b)
+	for len(b) > 0 {
+		buf := fv.v.buffers.get()
+		n := copy(*buf, b)
+		fv.chunks <- chunk{buf: buf, n: n}
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// close ends the file, complete reports whether all of its contents were written
+func (fv *fileVerifier) close(complete bool) {
+	fv.complete = complete
+	close(fv.chunks)
+}
+
+func (fv *fileVerifier) run(path string, expected []byte) {
+	v := fv.v
+	defer v.wg.Done()
+	defer func() { <-v.slots }()
+
+	h := newChecksum()
+	var busy time.Duration
+	for c := range fv.chunks {
+		start := time.Now()
+		h.Write((*c.buf)[:c.n])
+		busy += time.Since(start)
+		v.buffers.put(c.buf)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.hashTime += busy
+	if !fv.complete {
+		return
+	}
+	v.files++
+	if err := checkFileChecksum(path, expected, h); err != nil {
+		v.errs = append(v.errs, err)
+	}
+}
+
+// wait blocks until every started file has been verified and returns the
+// checksum mismatches found
+func (v *verifier) wait() error {
+	if v == nil {
+		return nil
+	}
+	start := time.Now()
+	v.wg.Wait()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.waitTime += time.Since(start)
+	err := errors.Join(v.errs...)
+	v.errs = nil
+	return err
+}
+
+// print logs how long verification took next to how long the writer had to
+// wait for it, the difference is the time saved by overlapping the two
+func (v *verifier) print(log *slog.Logger, blockID int32) {
+	if v == nil || v.files == 0 {
+		return
+	}
+	log.Debug("Verified files", "block", blockID, "files", v.files,
+		"hashing", v.hashTime.Round(time.Millisecond), "waiting", v.waitTime.Round(time.Millisecond))
+}
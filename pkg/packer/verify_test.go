@@ -0,0 +1,42 @@
+package packer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyFailsOnMissingBlock(t *testing.T) {
+	p := NewPacker(PackerOptions{BlockSize: 32 << 10})
+	src := filepath.Join(t.TempDir(), "src")
+	archive := filepath.Join(t.TempDir(), "archive")
+	writeTree(t, src, generation(1))
+	if err := p.Pack(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	blockPaths, err := listBlocks(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blockPaths) < 2 {
+		t.Fatalf("packed %d blocks, want several", len(blockPaths))
+	}
+	if err := p.Verify(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(blockPaths[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(archive); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Verify returned %v, want ErrCorrupted", err)
+	}
+	report, err := p.VerifyWithReport(archive, 0)
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("VerifyWithReport returned %v, want ErrCorrupted", err)
+	}
+	if failed := report.Failed(); len(failed) != 1 || failed[0].Name != filepath.Base(blockPaths[1]) {
+		t.Errorf("report lists %+v as failed, want only %s", failed, filepath.Base(blockPaths[1]))
+	}
+}
@@ -0,0 +1,296 @@
+package packer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// verifyReportFileName is the name of the report VerifyWithReport keeps next
+// to the blocks of an archive
+const verifyReportFileName = "verify-report.json"
+
+// verifyCheckpointInterval is how often VerifyWithReport saves the report
+// while it runs, so a run that is interrupted can be resumed with since
+const verifyCheckpointInterval = 10 * time.Second
+
+// Statuses of the blocks and files of a VerifyReport
+const (
+	VerifyOK      = "ok"
+	VerifyCorrupt = "corrupt" // Contents do not match their checksum
+	VerifyError   = "error"   // Could not be read
+)
+
+// VerifyReport is the result of verifying every block of an archive. It is
+// saved next to the blocks so later runs can skip the blocks verified
+// recently
+type VerifyReport struct {
+	Archive     string              `json:"archive"`
+	Fingerprint string              `json:"fingerprint"` // Digest of the names and checksums of every block, changes when any block does
+	Started     time.Time           `json:"started"`
+	Finished    time.Time           `json:"finished"` // Zero in the checkpoints saved while verification runs
+	Blocks      []BlockVerification `json:"blocks"`   // Blocks in the order of their file names
+}
+
+// BlockVerification is the status of one block of a VerifyReport
+type BlockVerification struct {
+	ID         int32              `json:"id"`
+	Name       string             `json:"name"`     // File name of the block in the archive
+	Checksum   string             `json:"checksum"` // Checksum in the footer of the block, hex encoded
+	Status     string             `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	VerifiedAt time.Time          `json:"verified_at"` // When the block was last read, earlier than Started for blocks skipped with since
+	Files      []FileVerification `json:"files"`
+}
+
+// FileVerification is the status of one file of a verified block. Files of
+// a block that matches its checksum are ok, the files of one that does not
+// are checked against their own checksums to tell which ones are damaged.
+// Blocks with encrypted metadata list no files
+type FileVerification struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+}
+
+// Failed returns the blocks that are corrupt or could not be read
+func (r *VerifyReport) Failed() []BlockVerification {
+	var failed []BlockVerification
+	for _, block := range r.Blocks {
+		if block.Status != VerifyOK {
+			failed = append(failed, block)
+		}
+	}
+	return failed
+}
+
+func (p defaultPacker) VerifyWithReport(archiveDir string, since time.Duration) (*VerifyReport, error) {
+	unlock, err := p.lockArchive(archiveDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	blockPaths, err := archiveBlocks(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	reportPath, err := verifyReportPath(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkSignature(archiveDir); err != nil {
+		return nil, err
+	}
+	if _, err := loadDictionaries(archiveDir); err != nil {
+		return nil, err
+	}
+	missing, err := missingBlocks(archiveDir, blockPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks verified within since are carried over from the last report
+	previous := make(map[string]*BlockVerification)
+	if since > 0 {
+		last, err := readVerifyReport(reportPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			p.logger().Warn("Ignoring unreadable verify report", "path", reportPath, "error", err)
+		}
+		if last != nil {
+			for i := range last.Blocks {
+				previous[last.Blocks[i].Name] = &last.Blocks[i]
+			}
+		}
+	}
+
+	report := &VerifyReport{Archive: archiveDir, Started: time.Now(), Blocks: []BlockVerification{}}
+	cutoff := report.Started.Add(-since)
+	checkpoint := report.Started
+	fingerprint := newChecksum()
+	var verified, skipped int
+	for i, blockPath := range blockPaths {
+		result := p.verifyBlockReport(blockPath, previous[filepath.Base(blockPath)], cutoff)
+		if result.VerifiedAt.Before(report.Started) {
+			skipped++
+		} else {
+			verified++
+		}
+		if result.Status != VerifyOK {
+			p.logger().Warn("Block failed verification", "block", result.Name, "status", result.Status, "error", result.Error)
+		}
+		report.Blocks = append(report.Blocks, result)
+		fmt.Fprintf(fingerprint, "%s %s\n", result.Name, result.Checksum)
+
+		// Checkpoints keep the last results of the blocks still to come
+		if time.Since(checkpoint) >= verifyCheckpointInterval {
+			partial := *report
+			partial.Blocks = append([]BlockVerification(nil), report.Blocks...)
+			for _, next := range blockPaths[i+1:] {
+				if last := previous[filepath.Base(next)]; last != nil {
+					partial.Blocks = append(partial.Blocks, *last)
+				}
+			}
+			if err := writeVerifyReport(reportPath, &partial); err != nil {
+				return nil, err
+			}
+			checkpoint = time.Now()
+		}
+	}
+	// Blocks the manifests list but the archive no longer holds fail as well
+	for _, name := range missing {
+		p.logger().Warn("Block failed verification", "block", name, "status", VerifyError, "error", "block file missing")
+		report.Blocks = append(report.Blocks, BlockVerification{Name: name, Status: VerifyError, Error: "block file missing", VerifiedAt: time.Now(), Files: []FileVerification{}})
+		fmt.Fprintf(fingerprint, "%s missing\n", name)
+	}
+	sort.Slice(report.Blocks, func(i, j int) bool { return report.Blocks[i].Name < report.Blocks[j].Name })
+	report.Fingerprint = hex.EncodeToString(fingerprint.Sum(nil))
+	report.Finished = time.Now()
+	if err := writeVerifyReport(reportPath, report); err != nil {
+		return nil, err
+	}
+	p.logger().Info("Verified blocks", "verified", verified, "skipped", skipped, "failed", len(report.Failed()))
+
+	if failed := report.Failed(); len(failed) > 0 {
+		return report, fmt.Errorf("%d of %d blocks failed verification: %w", len(failed), len(report.Blocks), ErrCorrupted)
+	}
+	return report, nil
+}
+
+// verifyBlockReport verifies one block, or returns its last result when the
+// block has not changed since and was found ok after cutoff
+func (p defaultPacker) verifyBlockReport(blockPath string, last *BlockVerification, cutoff time.Time) BlockVerification {
+	result := BlockVerification{Name: filepath.Base(blockPath), VerifiedAt: time.Now(), Files: []FileVerification{}}
+	fail := func(err error) BlockVerification {
+		result.Status = VerifyError
+		if errors.Is(err, ErrCorrupted) {
+			result.Status = VerifyCorrupt
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	f, err := openBlockFile(blockPath)
+	if err != nil {
+		return fail(fmt.Errorf("error opening block file: %w", err))
+	}
+	defer f.Close()
+	footer, err := readBlockFooter(f, f.Size())
+	if err != nil {
+		return fail(fmt.Errorf("error reading block footer: %w", err))
+	}
+	result.Checksum = hex.EncodeToString(footer.Checksum)
+
+	if last != nil && hexChecksumsEqual(last.Checksum, result.Checksum) && last.Status == VerifyOK && last.VerifiedAt.After(cutoff) {
+		return *last
+	}
+
+	// Blocks with encrypted metadata are only checked as a whole, so the
+	// report reveals none of their paths
+	if footer.Flags&footerFlagEncrypted != 0 {
+		start, _, err := readBlockStart(io.NewSectionReader(f, 0, f.Size()))
+		if err != nil {
+			return fail(err)
+		}
+		result.ID = start.ID
+		if err := p.validator.validateBlockAt(f, f.Size()); err != nil {
+			return fail(err)
+		}
+		result.Status = VerifyOK
+		return result
+	}
+
+	block, err := p.readBlockIndexAt(f, f.Size())
+	if err != nil {
+		return fail(err)
+	}
+	result.ID = block.ID
+	blockErr := p.validator.validateBlockAt(f, f.Size())
+	if blockErr != nil && !errors.Is(blockErr, ErrCorrupted) {
+		return fail(blockErr)
+	}
+
+	// A block that matches its checksum holds intact files, the files of one
+	// that does not are hashed one by one
+	for i := range block.Files {
+		metadata := &block.Files[i]
+		file := FileVerification{Path: metadata.Path, Size: metadata.Size, Status: VerifyOK}
+		if blockErr != nil {
+			file.Status = p.verifyFileStatus(f, block.DataOffset+metadata.Offset, metadata)
+		}
+		result.Files = append(result.Files, file)
+	}
+	if blockErr != nil {
+		return fail(blockErr)
+	}
+	result.Status = VerifyOK
+	return result
+}
+
+// verifyFileStatus hashes the contents of a file stored at offset in a block
+// and compares them to its checksum
+func (p defaultPacker) verifyFileStatus(f io.ReaderAt, offset int64, metadata *FileMetadata) string {
+	h := newChecksum()
+	if _, err := p.buffers.copyN(h, contentSection(f, offset, metadata), metadata.Size); err != nil {
+		return VerifyError
+	}
+	if !checksumsEqual(h.Sum(nil), metadata.Checksum) {
+		return VerifyCorrupt
+	}
+	return VerifyOK
+}
+
+// verifyReportPath returns where the verify report of an archive is kept,
+// next to the blocks of a directory or next to a single block file
+func verifyReportPath(archiveDir string) (string, error) {
+	info, err := os.Stat(archiveDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get input directory info: %w", err)
+	}
+	if !info.IsDir() {
+		return archiveDir + "." + verifyReportFileName, nil
+	}
+	return filepath.Join(archiveDir, verifyReportFileName), nil
+}
+
+// readVerifyReport reads a report saved by VerifyWithReport
+func readVerifyReport(path string) (*VerifyReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report VerifyReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("error decoding verify report: %w", err)
+	}
+	return &report, nil
+}
+
+// writeVerifyReport saves a report to path, replacing any previous one only
+// once it is complete
+func writeVerifyReport(path string, report *VerifyReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding verify report: %w", err)
+	}
+	f, err := createArchiveTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating verify report: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing verify report: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing verify report: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,353 @@
+package packer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrMissingVolume is returned when a block split under VolumeSize is read in
+// a range held by a volume that is not in the archive directory
+var ErrMissingVolume = errors.New("block volume missing")
+
+// volumePath returns the path of volume n, counted from 1, of a block split
+// under VolumeSize
+func volumePath(blockPath string, n int) string {
+	return fmt.Sprintf("%s.%03d", blockPath, n)
+}
+
+// volumeNumber returns the number of the volume a path names and the path of
+// its block, or 0 and the path itself when it is not a volume of a block
+func volumeNumber(path string) (int, string) {
+	ext := filepath.Ext(path)
+	blockPath := strings.TrimSuffix(path, ext)
+	if len(ext) < 4 || filepath.Ext(blockPath) != blockExt || strings.Trim(ext[1:], "0123456789") != "" {
+		return 0, path
+	}
+	n, err := strconv.Atoi(ext[1:])
+	if err != nil || n < 1 {
+		return 0, path
+	}
+	return n, blockPath
+}
+
+// volumeNumberOf returns the number of the volume a path names, 0 when it is
+// not a volume of a block
+func volumeNumberOf(path string) int {
+	n, _ := volumeNumber(path)
+	return n
+}
+
+// blockVolume is one file of a block, the whole block unless it was split
+type blockVolume struct {
+	path   string
+	offset int64    // Offset of the volume within the block
+	size   int64    // Size of the volume, taken from the others for missing volumes
+	f      *os.File // Opened on the first read
+	err    error    // Error opening the volume
+}
+
+// blockFile reads a block file, or the volumes a block was split into under
+// VolumeSize as a single file. Volumes are opened as they are read, so the
+// ranges held by the volumes present still read when others are missing
+type blockFile struct {
+	mu      sync.Mutex
+	volumes []*blockVolume
+	size    int64
+}
+
+// openBlockFile opens the block at blockPath, or the volumes of the block
+// when it was split under VolumeSize. A path naming one of the volumes opens
+// the block it belongs to
+func openBlockFile(blockPath string) (*blockFile, error) {
+	if n, path := volumeNumber(blockPath); n > 0 {
+		blockPath = path
+	}
+	f, err := os.Open(blockPath)
+	if err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &blockFile{volumes: []*blockVolume{{path: blockPath, size: info.Size(), f: f}}, size: info.Size()}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	sizes, err := findVolumes(blockPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(sizes) == 0 {
+		return nil, &os.PathError{Op: "open", Path: blockPath, Err: os.ErrNotExist}
+	}
+	return newBlockFile(blockPath, sizes)
+}
+
+// findVolumes returns the sizes of the volumes of a split block found next to
+// blockPath by their number
+func findVolumes(blockPath string) (map[int]int64, error) {
+	entries, err := os.ReadDir(filepath.Dir(blockPath))
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[int]int64)
+	for _, entry := range entries {
+		n, path := volumeNumber(entry.Name())
+		if n == 0 || path != filepath.Base(blockPath) || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		sizes[n] = info.Size()
+	}
+	return sizes, nil
+}
+
+// newBlockFile lays out the volumes of a split block. Every volume but the
+// last holds the volume size, which places the missing volumes before the last
+// one present. A last volume that is full and does not end with the footer
+// means the volumes after it are missing
+func newBlockFile(blockPath string, sizes map[int]int64) (*blockFile, error) {
+	var numbers []int
+	for n := range sizes {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	last := numbers[len(numbers)-1]
+	if last > 1 && len(numbers) == 1 {
+		return nil, fmt.Errorf("volume %s: %w", filepath.Base(volumePath(blockPath, 1)), ErrMissingVolume)
+	}
+	volumeSize := sizes[numbers[0]]
+
+	b := &blockFile{}
+	for n := 1; n <= last; n++ {
+		size, ok := sizes[n]
+		if !ok || n != last && size != volumeSize {
+			size = volumeSize
+		}
+		b.volumes = append(b.volumes, &blockVolume{path: volumePath(blockPath, n), offset: b.size, size: size})
+		b.size += size
+	}
+	if last > 1 && sizes[last] == volumeSize {
+		trailer := make([]byte, len(footerMagic))
+		if _, err := b.ReadAt(trailer, b.size-int64(len(trailer))); err == nil && !bytes.Equal(trailer, footerMagic[:]) {
+			b.Close()
+			return nil, fmt.Errorf("volume %s: %w", filepath.Base(volumePath(blockPath, last+1)), ErrMissingVolume)
+		}
+	}
+	return b, nil
+}
+
+// Size returns the size of the whole block
+func (b *blockFile) Size() int64 {
+	return b.size
+}
+
+// split tells whether the block was split into volumes
+func (b *blockFile) split() bool {
+	return volumeNumberOf(b.volumes[0].path) > 0
+}
+
+// open returns the file of a volume, opening it on the first read
+func (b *blockFile) open(v *blockVolume) (*os.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v.f == nil && v.err == nil {
+		v.f, v.err = os.Open(v.path)
+		if os.IsNotExist(v.err) {
+			v.err = fmt.Errorf("volume %s: %w", filepath.Base(v.path), ErrMissingVolume)
+		}
+	}
+	return v.f, v.err
+}
+
+func (b *blockFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	i := sort.Search(len(b.volumes), func(i int) bool { return b.volumes[i].offset+b.volumes[i].size > off })
+	var read int
+	for ; read < len(p) && i < len(b.volumes); i++ {
+		v := b.volumes[i]
+		f, err := b.open(v)
+		if err != nil {
+			return read, err
+		}
+		n := min(int64(len(p)-read), v.offset+v.size-off)
+		m, err := f.ReadAt(p[read:read+int(n)], off-v.offset)
+		read += m
+		off += int64(m)
+		if err == io.EOF && int64(m) < n {
+			return read, fmt.Errorf("volume %s is shorter than the others: %w", filepath.Base(v.path), ErrBlockTruncated)
+		}
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close closes the volumes opened
+func (b *blockFile) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, v := range b.volumes {
+		if v.f != nil {
+			if cerr := v.f.Close(); err == nil {
+				err = cerr
+			}
+			v.f = nil
+		}
+	}
+	return err
+}
+
+// manifest returns the manifest entries of the volumes of a split block, none
+// for a whole block
+func (b *blockFile) manifest() []ManifestVolume {
+	if !b.split() {
+		return nil
+	}
+	volumes := make([]ManifestVolume, len(b.volumes))
+	for i, v := range b.volumes {
+		volumes[i] = ManifestVolume{Name: filepath.Base(v.path), Size: v.size}
+	}
+	return volumes
+}
+
+// blockFileSize returns the size of a block, whole or split into volumes
+func blockFileSize(blockPath string) (int64, error) {
+	b, err := openBlockFile(blockPath)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close()
+	return b.size, nil
+}
+
+// writeVolumes splits the block written to src into volumes of at most
+// VolumeSize bytes named after blockPath, each flushed and named like a whole
+// block, and returns them
+func (p defaultPacker) writeVolumes(src *os.File, size int64, blockPath string) ([]ManifestVolume, error) {
+	var volumes []ManifestVolume
+	for off := int64(0); off < size; off += p.opts.VolumeSize {
+		path := volumePath(blockPath, len(volumes)+1)
+		n := min(p.opts.VolumeSize, size-off)
+		f, err := createArchiveTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.buffers.copyN(f, io.NewSectionReader(src, off, n), n)
+		if err == nil {
+			err = p.syncs.block(f)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return nil, fmt.Errorf("error writing volume %s: %w", filepath.Base(path), err)
+		}
+		if err := p.syncs.named(path); err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, ManifestVolume{Name: filepath.Base(path), Size: n})
+	}
+	return volumes, nil
+}
+
+// removeStaleVolumes removes what an earlier block of the same path left next
+// to a block just written with the given number of volumes, 0 when it was
+// written whole: the whole block file of a split block and any volume past
+// the last one written
+func removeStaleVolumes(blockPath string, volumes int) error {
+	if volumes > 0 {
+		if err := os.Remove(blockPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	sizes, err := findVolumes(blockPath)
+	if err != nil {
+		return err
+	}
+	for n := range sizes {
+		if n > volumes {
+			if err := os.Remove(volumePath(blockPath, n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeBlock removes a block file, or all the volumes of a split block
+func removeBlock(blockPath string) error {
+	err := os.Remove(blockPath)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	sizes, ferr := findVolumes(blockPath)
+	if ferr != nil || len(sizes) == 0 {
+		return err
+	}
+	return removeStaleVolumes(blockPath, 0)
+}
+
+// renameBlock moves a block, whole or split into volumes, to a new path,
+// replacing the block there
+func renameBlock(oldPath string, newPath string) error {
+	sizes, err := findVolumes(oldPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(oldPath); err == nil || len(sizes) == 0 {
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+		return removeStaleVolumes(newPath, 0)
+	}
+	for n := range sizes {
+		if err := os.Rename(volumePath(oldPath, n), volumePath(newPath, n)); err != nil {
+			return err
+		}
+	}
+	return removeStaleVolumes(newPath, len(sizes))
+}
+
+// splitBlocks returns the paths of the blocks split into volumes in a
+// directory, one per block whatever volumes of it are present
+func splitBlocks(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, entry := range entries {
+		n, name := volumeNumber(entry.Name())
+		if n == 0 || entry.IsDir() || seen[name] {
+			continue
+		}
+		seen[name] = true
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths, nil
+}
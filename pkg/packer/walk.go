@@ -0,0 +1,85 @@
+package packer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// walkInput lists the files below the input directory in lexical order, as
+// filepath.WalkDir would. Symlinked directories are only descended into with
+// FollowSymlinks, skipping links back to a directory being walked, which would
+// loop forever. OneFileSystem keeps the walk on the device of the input
+// directory and MaxDepth stops it that many directories down
+func (p defaultPacker) walkInput(inputDir string) ([]string, error) {
+	if p.opts.MaxDepth < 0 {
+		return nil, fmt.Errorf("negative max depth %d: %w", p.opts.MaxDepth, ErrInvalidOption)
+	}
+	root, err := os.Stat(inputDir)
+	if err != nil {
+		// An unreadable input directory leaves nothing to pack
+		return nil, p.failures.skip(inputDir, err)
+	}
+	if !root.IsDir() {
+		return []string{inputDir}, nil
+	}
+	rootDevice, _ := fileDevice(root)
+
+	var files []string
+	var walk func(dir string, depth int, ancestors []os.FileInfo) error
+	walk = func(dir string, depth int, ancestors []os.FileInfo) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			// Unreadable directories are skipped along with their contents
+			return p.failures.skip(dir, err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			isLink := entry.Type()&fs.ModeSymlink != 0
+			if !entry.IsDir() && !(isLink && p.opts.FollowSymlinks) {
+				files = append(files, path)
+				continue
+			}
+
+			// Directories, and links that may lead to one, are stat'ed to
+			// tell where they lead. Broken links are left to collectFileInfo
+			info, err := os.Stat(path)
+			if err != nil || !info.IsDir() {
+				files = append(files, path)
+				continue
+			}
+			if p.opts.MaxDepth > 0 && depth >= p.opts.MaxDepth {
+				p.logger().Debug("Skipping directory below max depth", "path", path, "max_depth", p.opts.MaxDepth)
+				continue
+			}
+			if device, ok := fileDevice(info); ok && p.opts.OneFileSystem && device != rootDevice {
+				p.logger().Debug("Skipping directory on another file system", "path", path)
+				continue
+			}
+			if isLink && isAncestor(info, ancestors) {
+				p.logger().Warn("Skipping symlink loop", "path", path)
+				continue
+			}
+			if err := walk(path, depth+1, append(ancestors, info)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(inputDir, 1, []os.FileInfo{root}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// isAncestor reports whether a directory is one of the directories walked
+// down to reach it
+func isAncestor(info os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(info, ancestor) {
+			return true
+		}
+	}
+	return false
+}
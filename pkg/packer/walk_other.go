@@ -0,0 +1,10 @@
+//go:build !unix
+
+package packer
+
+import "os"
+
+// fileDevice is not supported on this platform, OneFileSystem has no effect
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package packer
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the device holding a file
+func fileDevice(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
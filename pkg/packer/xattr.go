@@ -0,0 +1,122 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	errXattrNotFound    = errors.New("extended attribute not found")
+	errXattrUnsupported = errors.New("extended attributes not supported")
+	errXattrPermission  = errors.New("insufficient privileges to set extended attribute")
+	errOwnerPermission  = errors.New("insufficient privileges to change file owner")
+)
+
+// aclXattrNames are the extended attributes POSIX ACLs are stored in
+var aclXattrNames = []string{
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+}
+
+// securityXattrNames are the extended attributes holding the SELinux context
+// and Linux file capabilities
+var securityXattrNames = []string{
+	"security.selinux",
+	"security.capability",
+}
+
+// preservesXattrs reports whether any extended attributes are preserved
+func (p defaultPacker) preservesXattrs() bool {
+	return p.opts.PreserveXattrs || len(p.xattrNames()) > 0
+}
+
+// captureNames returns the extended attributes to capture for a file, which
+// is every attribute it has when all xattrs are preserved
+func (p defaultPacker) captureNames(path string) ([]string, error) {
+	if !p.opts.PreserveXattrs {
+		return p.xattrNames(), nil
+	}
+	names, err := listXattr(path)
+	if errors.Is(err, errXattrUnsupported) {
+		return nil, nil
+	}
+	return names, err
+}
+
+// restoreNames returns the extended attributes to restore for a file, which
+// is every stored attribute when all xattrs are preserved
+func (p defaultPacker) restoreNames(metadata *FileMetadata) []string {
+	if !p.opts.PreserveXattrs {
+		return p.xattrNames()
+	}
+	names := make([]string, 0, len(metadata.Xattrs))
+	for name := range metadata.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// xattrNames returns the extended attributes the packer is configured to preserve
+func (p defaultPacker) xattrNames() []string {
+	var names []string
+	if p.opts.PreserveACLs {
+		names = append(names, aclXattrNames...)
+	}
+	if p.opts.PreserveSecurityLabels {
+		names = append(names, securityXattrNames...)
+	}
+	return names
+}
+
+// captureXattrs reads the named extended attributes of a file, returning nil
+// if none are set or the filesystem does not support them
+func captureXattrs(path string, names []string) (map[string][]byte, error) {
+	var xattrs map[string][]byte
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if errors.Is(err, errXattrNotFound) {
+			continue
+		}
+		if errors.Is(err, errXattrUnsupported) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// restoreXattrs applies the named extended attributes stored in the metadata
+// to a file. It returns errXattrUnsupported if the target filesystem lacks
+// xattr support and errXattrPermission if some attributes could not be set
+// with the current privileges, attributes that can be set are still applied
+func restoreXattrs(path string, metadata *FileMetadata, names []string) error {
+	var denied bool
+	for _, name := range names {
+		value, ok := metadata.Xattrs[name]
+		if !ok {
+			continue
+		}
+		err := setXattr(path, name, value)
+		switch {
+		case err == nil:
+		case errors.Is(err, errXattrUnsupported):
+			return err
+		case errors.Is(err, errXattrPermission):
+			denied = true
+		default:
+			return fmt.Errorf("error restoring %s: %w", name, err)
+		}
+	}
+	if denied {
+		return errXattrPermission
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package packer
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// getXattr reads a single extended attribute, returning nil if it is not set
+func getXattr(path string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, translateXattrError(err)
+	}
+
+	buf := make([]byte, size)
+	n, err := syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, translateXattrError(err)
+	}
+	return buf[:n], nil
+}
+
+// listXattr returns the names of all extended attributes of a file
+func listXattr(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		return nil, translateXattrError(err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	n, err := syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, translateXattrError(err)
+	}
+
+	// Names are NUL terminated
+	var names []string
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// setXattr writes a single extended attribute
+func setXattr(path string, name string, value []byte) error {
+	return translateXattrError(syscall.Setxattr(path, name, value, 0))
+}
+
+// translateXattrError maps platform errors onto the package level xattr errors
+func translateXattrError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENODATA):
+		return errXattrNotFound
+	case errors.Is(err, syscall.ENOTSUP):
+		return errXattrUnsupported
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return errXattrPermission
+	}
+	return err
+}
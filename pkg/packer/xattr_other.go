@@ -0,0 +1,18 @@
+//go:build !linux
+
+package packer
+
+// getXattr is not supported on this platform
+func getXattr(path string, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+// listXattr is not supported on this platform
+func listXattr(path string) ([]string, error) {
+	return nil, errXattrUnsupported
+}
+
+// setXattr is not supported on this platform
+func setXattr(path string, name string, value []byte) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,207 @@
+package packer
+
+import (
+	"io"
+	"sort"
+)
+
+// minZeroRun is the shortest run of zeros left out of the data section with
+// ZeroRunEncoding, shorter runs cost more metadata than they save
+const minZeroRun = 4096
+
+// zeroes is written in place of runs too short to leave out
+var zeroes [minZeroRun]byte
+
+// storedSize returns the number of bytes the contents of a file take up in
+// the data section, its compressed size or its size less the zero runs left out
+func (m *FileMetadata) storedSize() int64 {
+	if m.Compression != CompressionNone {
+		return m.CompressedSize
+	}
+	size := m.Size
+	for _, run := range m.ZeroRuns {
+		size -= run.Length
+	}
+	return size
+}
+
+// contents returns a reader of the contents of a file given a reader of the
+// bytes stored for it, decompressing them or putting back the zero runs left
+// out of the data section
+func (m *FileMetadata) contents(stored io.Reader) io.Reader {
+	if m.Compression != CompressionNone {
+		return newDecompressReader(stored, m)
+	}
+	if len(m.ZeroRuns) == 0 {
+		return stored
+	}
+	return &zeroRunReader{r: stored, runs: m.ZeroRuns, size: m.Size}
+}
+
+// contentSection returns a reader of the contents of a file whose stored bytes
+// start at offset in r
+func contentSection(r io.ReaderAt, offset int64, metadata *FileMetadata) *io.SectionReader {
+	stored := io.NewSectionReader(r, offset, metadata.storedSize())
+	if metadata.Compression != CompressionNone {
+		return io.NewSectionReader(newDecompressReaderAt(stored, metadata), 0, metadata.Size)
+	}
+	if len(metadata.ZeroRuns) == 0 {
+		return stored
+	}
+	return io.NewSectionReader(newZeroRunReaderAt(stored, metadata), 0, metadata.Size)
+}
+
+// zeroRunWriter writes file contents to a data section, leaving out runs of
+// at least minZeroRun zeros and recording them instead
+type zeroRunWriter struct {
+	w       io.Writer
+	pos     int64    // Bytes of contents written so far, including left out runs
+	pending int64    // Zeros at the end of the contents not yet written or recorded
+	stored  int64    // Bytes written to w
+	runs    []Extent // Runs left out
+}
+
+func (w *zeroRunWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if b[0] == 0 {
+			zeros := 1
+			for zeros < len(b) && b[zeros] == 0 {
+				zeros++
+			}
+			w.pending += int64(zeros)
+			w.pos += int64(zeros)
+			b = b[zeros:]
+			continue
+		}
+		if err := w.flush(); err != nil {
+			return n - len(b), err
+		}
+		data := 1
+		for data < len(b) && b[data] != 0 {
+			data++
+		}
+		if _, err := w.w.Write(b[:data]); err != nil {
+			return n - len(b), err
+		}
+		w.stored += int64(data)
+		w.pos += int64(data)
+		b = b[data:]
+	}
+	return n, nil
+}
+
+// flush records the pending zeros as a run, or writes them when they are too
+// few. It must be called once the contents are complete
+func (w *zeroRunWriter) flush() error {
+	if w.pending >= minZeroRun {
+		w.runs = append(w.runs, Extent{Offset: w.pos - w.pending, Length: w.pending})
+		w.pending = 0
+		return nil
+	}
+	for w.pending > 0 {
+		n, err := w.w.Write(zeroes[:w.pending])
+		w.stored += int64(n)
+		w.pending -= int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroRunReader reads file contents from the bytes stored for them, putting
+// back the zero runs left out
+type zeroRunReader struct {
+	r    io.Reader
+	runs []Extent // Runs not yet passed
+	pos  int64    // Offset within the contents
+	size int64
+}
+
+func (r *zeroRunReader) Read(b []byte) (int, error) {
+	for len(r.runs) > 0 && r.runs[0].Offset+r.runs[0].Length <= r.pos {
+		r.runs = r.runs[1:]
+	}
+	if len(r.runs) > 0 && r.runs[0].Offset <= r.pos {
+		n := min(int64(len(b)), r.runs[0].Offset+r.runs[0].Length-r.pos)
+		clear(b[:n])
+		r.pos += n
+		return int(n), nil
+	}
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	limit := r.size - r.pos
+	if len(r.runs) > 0 {
+		limit = r.runs[0].Offset - r.pos
+	}
+	if int64(len(b)) > limit {
+		b = b[:limit]
+	}
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// zeroRunReaderAt reads file contents at any offset from the bytes stored for
+// them, putting back the zero runs left out
+type zeroRunReaderAt struct {
+	r       io.ReaderAt // Stored bytes
+	runs    []Extent
+	skipped []int64 // Total length of the runs before each run
+	size    int64
+}
+
+func newZeroRunReaderAt(r io.ReaderAt, metadata *FileMetadata) *zeroRunReaderAt {
+	skipped := make([]int64, len(metadata.ZeroRuns))
+	var total int64
+	for i, run := range metadata.ZeroRuns {
+		skipped[i] = total
+		total += run.Length
+	}
+	return &zeroRunReaderAt{r: r, runs: metadata.ZeroRuns, skipped: skipped, size: metadata.Size}
+}
+
+func (r *zeroRunReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	read := 0
+	for len(b) > 0 {
+		if off >= r.size {
+			return read, io.EOF
+		}
+
+		// Find the first run that ends after off
+		i := sort.Search(len(r.runs), func(i int) bool { return r.runs[i].Offset+r.runs[i].Length > off })
+		var n int64
+		if i < len(r.runs) && r.runs[i].Offset <= off {
+			n = min(int64(len(b)), r.runs[i].Offset+r.runs[i].Length-off)
+			clear(b[:n])
+		} else {
+			end := r.size
+			skipped := int64(0)
+			if i < len(r.runs) {
+				end = r.runs[i].Offset
+				skipped = r.skipped[i]
+			} else if len(r.runs) > 0 {
+				last := len(r.runs) - 1
+				skipped = r.skipped[last] + r.runs[last].Length
+			}
+			n = min(int64(len(b)), end-off)
+			m, err := r.r.ReadAt(b[:n], off-skipped)
+			if m < int(n) {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return read + m, err
+			}
+		}
+		read += int(n)
+		off += n
+		b = b[n:]
+	}
+	return read, nil
+}
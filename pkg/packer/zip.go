@@ -0,0 +1,168 @@
+package packer
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format selects the file format of the volumes written by Pack, PackSources
+// and PackFS. Files are split into volumes the same way whatever the format
+type Format int
+
+const (
+	FormatBeam Format = iota // .beam blocks, the default
+	FormatZip                // Standard .zip volumes any zip tool can open, without SHA-256 checksums, owners or xattrs
+)
+
+// zipExt is the extension of every zip volume
+const zipExt = ".zip"
+
+// volumeExt returns the extension of the volume files the packer writes
+func (p defaultPacker) volumeExt() string {
+	if p.opts.Format == FormatZip {
+		return zipExt
+	}
+	return blockExt
+}
+
+// checkFormat rejects formats this version does not know and options the
+// format cannot honor
+func (p defaultPacker) checkFormat() error {
+	if p.opts.VolumeSize < 0 {
+		return fmt.Errorf("negative volume size %d: %w", p.opts.VolumeSize, ErrInvalidOption)
+	}
+	switch p.opts.Format {
+	case FormatBeam:
+		if p.opts.VolumeSize > 0 && p.opts.ParityBlocks > 0 {
+			return fmt.Errorf("parity blocks are computed over whole block files, they cannot protect volumes: %w", ErrInvalidOption)
+		}
+		if p.opts.CBORMetadata && p.opts.CompactMetadata {
+			return fmt.Errorf("metadata is either compact or CBOR: %w", ErrInvalidOption)
+		}
+		if p.opts.MetadataKey != nil && p.opts.Passphrase == "" {
+			_, err := metadataCipher(p.opts.MetadataKey)
+			return err
+		}
+		return nil
+	case FormatZip:
+		if p.opts.ParityBlocks > 0 {
+			return fmt.Errorf("parity blocks cannot protect zip volumes: %w", ErrInvalidOption)
+		}
+		if p.encryptsMetadata() {
+			return fmt.Errorf("zip volumes cannot encrypt their metadata: %w", ErrInvalidOption)
+		}
+		if p.opts.Compression != CompressionNone {
+			return fmt.Errorf("zip volumes store their files uncompressed: %w", ErrInvalidOption)
+		}
+		if p.opts.VolumeSize > 0 {
+			return fmt.Errorf("zip volumes are not split, each holds a block: %w", ErrInvalidOption)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %d: %w", p.opts.Format, ErrInvalidOption)
+}
+
+// writeZipTo writes a block as a standalone zip volume. Files are stored
+// uncompressed so every volume stays within the block size, and their CRC-32
+// is recorded by the zip writer
+func (p defaultPacker) writeZipTo(dst io.Writer, block *Block, open contentOpener) error {
+	dst = p.wrapWriter(dst)
+	h := newChecksum()
+	zw := zip.NewWriter(io.MultiWriter(dst, h))
+
+	kept := block.Files[:0]
+	for i := range block.Files {
+		metadata := &block.Files[i]
+		f, err := open(metadata)
+		if err != nil {
+			if err := p.failures.skip(metadata.source(), fmt.Errorf("failed to open file: %w", err)); err != nil {
+				return fmt.Errorf("failed to open file %s: %w", metadata.Path, err)
+			}
+			continue
+		}
+
+		header := &zip.FileHeader{
+			Name:     zipName(metadata.Path),
+			Method:   zip.Store,
+			Modified: metadata.ModTime,
+		}
+		header.SetMode(os.FileMode(metadata.Mode))
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to add file %s: %w", metadata.Path, err)
+		}
+
+		// The SHA-256 checksum is kept for the journal and progress events. A
+		// file the scanner rejects fails the volume, its entry is written already
+		fh := newChecksum()
+		var hashed io.Writer = fh
+		var sw *scanWriter
+		if p.scansPack() {
+			sw = p.newScanWriter(metadata.Path)
+			hashed = io.MultiWriter(fh, sw)
+		}
+		if metadata.Size == unknownSize || metadata.transformed {
+			metadata.Size, err = p.buffers.copy(io.MultiWriter(w, hashed), io.LimitReader(p.transformReader(metadata, p.wrapReader(f)), p.opts.BlockSize+1))
+			if err == nil && metadata.Size > p.opts.BlockSize {
+				err = ErrFileTooLarge
+			}
+		} else {
+			_, err = p.buffers.copyN(io.MultiWriter(w, hashed), p.wrapReader(f), metadata.Size)
+		}
+		f.Close()
+		if sw != nil {
+			if scanErr := sw.finish(err); scanErr != nil && err == nil {
+				err = scanError(metadata.Path, scanErr)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write file %s: %w", metadata.Path, err)
+		}
+		metadata.Checksum = fh.Sum(nil)
+		p.progress.file(metadata, false)
+		p.filePacked(metadata)
+		p.pace.wait()
+		kept = append(kept, *metadata)
+	}
+	block.Files = kept
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write zip directory: %w", err)
+	}
+	block.Checksum = h.Sum(nil)
+	return nil
+}
+
+// zipName returns the name of an archived path inside a zip volume, which
+// must be relative and slash separated
+func zipName(path string) string {
+	return strings.TrimLeft(filepath.ToSlash(path), "/")
+}
+
+// validateZip checks every file of a zip volume against its CRC-32, which the
+// zip reader verifies once a file is read to the end
+func validateZip(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("error opening zip volume: %w", err)
+	}
+	defer r.Close()
+
+	for _, file := range r.File {
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("error opening %s in zip volume: %w", file.Name, err)
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("error reading %s in zip volume: %w", file.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package packer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadersRejectZipVolumesAndEmptyArchives(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	zips := filepath.Join(t.TempDir(), "zips")
+	empty := t.TempDir()
+	writeTree(t, src, generation(1))
+	if err := NewPacker(PackerOptions{Format: FormatZip}).Pack(src, zips); err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := listVolumes(zips, zipExt)
+	if err != nil || len(volumes) == 0 {
+		t.Fatalf("packed zip volumes %v: %v", volumes, err)
+	}
+
+	p := NewPacker(PackerOptions{})
+	tests := []struct {
+		name    string
+		archive string
+		want    error
+	}{
+		{"zip directory", zips, ErrInvalidOption},
+		{"zip volume", volumes[0], ErrInvalidOption},
+		{"empty directory", empty, ErrNoFiles},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			if err := p.Unpack(tt.archive, out); !errors.Is(err, tt.want) {
+				t.Errorf("Unpack returned %v, want %v", err, tt.want)
+			}
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("Unpack created the output directory")
+			}
+			if err := p.Verify(tt.archive); !errors.Is(err, tt.want) {
+				t.Errorf("Verify returned %v, want %v", err, tt.want)
+			}
+			if _, err := p.VerifyWithReport(tt.archive, 0); !errors.Is(err, tt.want) {
+				t.Errorf("VerifyWithReport returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Package testgen creates directory trees of files described by a YAML spec,
+// used to produce test data for packing.
+package testgen
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type FileSpec struct {
+	Name  string `yaml:"name"`
+	Size  string `yaml:"size"`
+	Count int    `yaml:"count,omitempty"`
+}
+
+type DirectorySpec struct {
+	Name    string          `yaml:"name"`
+	Files   []FileSpec      `yaml:"files"`
+	Folders []DirectorySpec `yaml:"folders"`
+}
+
+// Generator creates the files of a spec
+type Generator struct {
+	Random *rand.Rand // Fills files with pseudo random bytes, nil creates sparse zero filled files
+}
+
+func ParseSize(sizeStr string) (int64, error) {
+	units := map[string]int64{
+		"B":  1,
+		"KB": 1000,
+		"MB": 1000 * 1000,
+		"GB": 1000 * 1000 * 1000,
+		"TB": 1000 * 1000 * 1000 * 1000,
+	}
+
+	sizeStr = strings.ToUpper(sizeStr)
+	var unit string
+	var value int64
+	var err error
+
+	for u := range units {
+		if matched, _ := regexp.MatchString(`\d+\s*`+u+`$`, sizeStr); matched {
+			// Extract the numeric part and the unit
+			numericPart := strings.TrimSuffix(sizeStr, u)
+			numericPart = strings.TrimSpace(numericPart)
+			if value, err = strconv.ParseInt(numericPart, 10, 64); err != nil {
+				return 0, err
+			}
+			unit = u
+			break
+		}
+	}
+
+	if unit == "" {
+		// Handle case without unit (assuming bytes)
+		if value, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+			return 0, fmt.Errorf("error parsing size string as integer: %w", err)
+		}
+	}
+
+	return value * units[unit], nil
+}
+
+func (g *Generator) createFile(path string, size int64) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if g.Random == nil {
+		return file.Truncate(size)
+	}
+	if _, err := io.CopyN(file, g.Random, size); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Generate creates the directory tree of spec inside parentPath
+func (g *Generator) Generate(spec DirectorySpec, parentPath string) error {
+	currentPath := filepath.Join(parentPath, spec.Name)
+	if err := os.MkdirAll(currentPath, 0700); err != nil {
+		return err
+	}
+
+	for _, file := range spec.Files {
+		size, err := ParseSize(file.Size)
+		if err != nil {
+			return err
+		}
+		count := 1
+		if file.Count > 1 {
+			count = file.Count
+		}
+		for i := 0; i < count; i++ {
+			fileName := file.Name
+			if fileName == "" {
+				fileName = fmt.Sprintf("%s file", file.Size)
+			}
+			if count > 1 {
+				fileName = fmt.Sprintf("%s_%03d", fileName, i+1)
+			}
+			if err := g.createFile(filepath.Join(currentPath, fileName), size); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, folder := range spec.Folders {
+		if err := g.Generate(folder, currentPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadSpec reads a spec from a YAML file
+func LoadSpec(yamlFilePath string) (DirectorySpec, error) {
+	var root DirectorySpec
+	data, err := os.ReadFile(yamlFilePath)
+	if err != nil {
+		return root, err
+	}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return root, err
+	}
+	return root, nil
+}
+
+// SizedSpec returns a spec of about total bytes that mixes small, medium and
+// large files across nested folders like sample-files.yml, with every file
+// small enough to fit in a 60MB block. A few files have names in composed
+// and decomposed Unicode and a path longer than the 260 characters Windows
+// allows without long path support
+func SizedSpec(name string, total int64) DirectorySpec {
+	share := total / 4
+	files := func(name string, size int64, sizeStr string) []FileSpec {
+		count := int(share / size)
+		if count == 0 {
+			return nil
+		}
+		return []FileSpec{{Name: name, Size: sizeStr, Count: count}}
+	}
+
+	spec := DirectorySpec{
+		Name: name,
+		Files: append(files("10KB-file", 10_000, "10KB"),
+			files("300KB-file", 300_000, "300KB")...),
+		Folders: []DirectorySpec{{
+			Name:  "medium-files",
+			Files: files("600KB-file", 600_000, "600KB"),
+			Folders: []DirectorySpec{{
+				Name:  "large-files",
+				Files: files("20MB-file", 20_000_000, "20MB"),
+			}},
+		}, namesSpec()},
+	}
+
+	// Whatever the fixed sizes leave over goes into one more file
+	var planned int64
+	for _, spec := range []DirectorySpec{spec, spec.Folders[0], spec.Folders[0].Folders[0], spec.Folders[1], spec.Folders[1].Folders[0]} {
+		for _, file := range spec.Files {
+			size, _ := ParseSize(file.Size)
+			planned += size * int64(file.Count)
+		}
+	}
+	if rest := total - planned; rest > 0 {
+		spec.Files = append(spec.Files, FileSpec{Name: "remainder-file", Size: strconv.FormatInt(rest, 10)})
+	}
+	return spec
+}
+
+// SmallFilesSpec returns a spec of count files of size bytes each, such as
+// "4KB", spread over directories of up to 1000 files like a source tree or
+// a mail spool
+func SmallFilesSpec(name string, count int, size string) DirectorySpec {
+	spec := DirectorySpec{Name: name}
+	for dir := 0; count > 0; dir++ {
+		n := min(count, 1000)
+		spec.Folders = append(spec.Folders, DirectorySpec{
+			Name:  fmt.Sprintf("dir-%04d", dir),
+			Files: []FileSpec{{Name: "file", Size: size, Count: n}},
+		})
+		count -= n
+	}
+	return spec
+}
+
+// namesSpec returns a folder of small files whose names exercise Unicode
+// normalization and long paths
+func namesSpec() DirectorySpec {
+	long := strings.Repeat("long-directory-name-", 7)
+	return DirectorySpec{
+		Name: "names",
+		Files: []FileSpec{
+			{Name: "caf\u00e9-composed", Size: "1KB"},
+			{Name: "re\u0301sume\u0301-decomposed", Size: "1KB"},
+			{Name: "\u65e5\u672c\u8a9e-\ud55c\uad6d\uc5b4", Size: "1KB"},
+		},
+		Folders: []DirectorySpec{{
+			Name:  long + "dir",
+			Files: []FileSpec{{Name: long + "file", Size: "1KB"}},
+		}},
+	}
+}
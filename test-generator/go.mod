@@ -2,4 +2,8 @@ module github.com/pavelbinar/beam-transfer/cmd/test-files
 
 go 1.23.2
 
-require gopkg.in/yaml.v2 v2.4.0
+require github.com/atterpac/bt-takehome v0.0.0
+
+require gopkg.in/yaml.v2 v2.4.0 // indirect
+
+replace github.com/atterpac/bt-takehome => ../